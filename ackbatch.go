@@ -0,0 +1,112 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"sync"
+	"time"
+)
+
+// ackBatcher sends the receipts held back by SetAckBatching once their
+// interval passes, even if no further tracked message arrives.
+type ackBatcher struct {
+	mu       sync.Mutex
+	interval time.Duration
+	running  bool
+	closed   bool
+	wake     chan struct{} // Signals the goroutine that interval changed or the batcher closed
+	done     chan struct{}
+}
+
+// SetAckBatching makes the peer acknowledge the tracked messages it receives
+// (see SendTracked and SendReliable) with cumulative receipts: a run of
+// consecutive messages from one sender is acknowledged by a single receipt,
+// sent once n messages are waiting for it or the oldest has waited interval,
+// whichever comes first. The sender clears every message in the run from
+// its pending sends, and SendReliable stops retransmitting them, just as if
+// each had been acknowledged alone. This cuts receipt traffic on busy
+// reliable streams the way TCP's cumulative acks do, at the cost of
+// delaying each receipt by up to interval. n of 1 or less, the default,
+// acknowledges each message at once; an interval of 0 waits for n messages
+// however long that takes, so keep it below the sender's
+// DefaultReceiptTimeout. The sender needs no setting and can run any
+// version of the library with receipts.
+func (p *Peer) SetAckBatching(n int, interval time.Duration) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	interval = max(interval, 0)
+	C.relay_set_ack_batching(p.ptr, C.int(n), C.int64_t(interval.Milliseconds()))
+	if n <= 1 {
+		interval = 0
+	}
+	p.acks.set(p, interval)
+}
+
+func (b *ackBatcher) set(p *Peer, interval time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.interval = interval
+	if b.running {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	b.running = true
+	b.wake = make(chan struct{}, 1)
+	b.done = make(chan struct{})
+	spawn(func() { b.run(p) })
+}
+
+// run sends due receipts every half interval until batching by interval is
+// turned off or the batcher is closed.
+func (b *ackBatcher) run(p *Peer) {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		interval, wake := b.interval, b.wake
+		if b.closed || interval == 0 {
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-time.After(max(interval/2, time.Millisecond)):
+			if p.enter() {
+				C.relay_flush_acks(p.ptr, 1)
+				p.leave()
+			}
+		}
+	}
+}
+
+// close stops the goroutine and waits for it to exit.
+func (b *ackBatcher) close() {
+	b.mu.Lock()
+	b.closed = true
+	running, done := b.running, b.done
+	if running {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	b.mu.Unlock()
+	if running {
+		<-done
+	}
+}
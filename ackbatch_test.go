@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckBatchingCount(t *testing.T) {
+	server, client := newPair(t)
+	server.SetAckBatching(4, 0)
+
+	var receipts []<-chan DeliveryStatus
+	for range 3 {
+		receipts = append(receipts, client.SendTracked("m"))
+	}
+	for range 3 {
+		receive(t, server)
+	}
+	select {
+	case s := <-receipts[0]:
+		t.Fatalf("receipt %v before the batch was complete", s)
+	case <-time.After(200 * time.Millisecond):
+	}
+	receipts = append(receipts, client.SendTracked("m"))
+	receive(t, server)
+	for i, r := range receipts {
+		select {
+		case s := <-r:
+			if s != Delivered {
+				t.Fatalf("message %d: %v, want %v", i, s, Delivered)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d: no receipt", i)
+		}
+	}
+}
+
+func TestAckBatchingInterval(t *testing.T) {
+	server, client := newPair(t)
+	server.SetAckBatching(100, 100*time.Millisecond)
+
+	first, second := client.SendTracked("a"), client.SendTracked("b")
+	receive(t, server)
+	receive(t, server)
+	for _, r := range []<-chan DeliveryStatus{first, second} {
+		select {
+		case s := <-r:
+			if s != Delivered {
+				t.Fatalf("got %v, want %v", s, Delivered)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("batched receipt not sent after the interval")
+		}
+	}
+}
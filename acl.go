@@ -0,0 +1,289 @@
+package relay
+
+/*
+#include "../include/relay.h"
+
+extern int relayGoAcceptClient(uintptr_t context, char *address, char *identity, size_t identityLen);
+*/
+import "C"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// AccessKind says what a PeerManager's access control is deciding on.
+type AccessKind int
+
+const (
+	// AccessAdd is a peer being added with Add or AddPeer.
+	AccessAdd AccessKind = iota
+	// AccessConnect is a client connecting to a managed server peer.
+	AccessConnect
+	// AccessRelay is a message being relayed to a managed peer.
+	AccessRelay
+)
+
+// String returns the kind's name.
+func (k AccessKind) String() string {
+	switch k {
+	case AccessAdd:
+		return "add"
+	case AccessConnect:
+		return "connect"
+	case AccessRelay:
+		return "relay"
+	default:
+		return "AccessKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// AccessRequest is what a PeerManager's access control decides on, and
+// what a policy set with SetAccessPolicy is given.
+type AccessRequest struct {
+	Kind AccessKind
+
+	// PeerID is the peer's ID. For AccessConnect it is the ID the client
+	// proved it holds (see WithIdentity and Client.PeerID), or empty if it
+	// proved none.
+	PeerID string
+
+	// Addr is the peer's address as "ip:port": the address a peer was
+	// created with, or a connecting client's remote address.
+	Addr string
+
+	// Via is the ID of the server peer the client connects to
+	// (AccessConnect), or of the peer the message is relayed from
+	// (AccessRelay). It is empty for AccessAdd.
+	Via string
+}
+
+// accessList is a PeerManager's access control.
+type accessList struct {
+	mu        sync.RWMutex
+	allowed   map[string]struct{} // If not empty, only these peer IDs are admitted
+	denied    map[string]struct{}
+	allowNets []netip.Prefix // If not empty, only addresses in these are admitted
+	denyNets  []netip.Prefix
+	policy    func(AccessRequest) bool
+}
+
+// Allow adds peerID to the manager's allowlist, taking it off the denylist.
+// Once the allowlist holds any ID, peers with other IDs cannot be added,
+// relay through the manager or be relayed to, or connect to a managed
+// server peer with a proven identity: Add and Relay return ErrAccessDenied,
+// and such clients are closed, which OnConnectionRejected reports.
+// Clients without an identity are only checked against address filters.
+func (m *PeerManager) Allow(peerID string) {
+	a := &m.acl
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.denied, peerID)
+	if a.allowed == nil {
+		a.allowed = make(map[string]struct{})
+	}
+	a.allowed[peerID] = struct{}{}
+}
+
+// Deny adds peerID to the manager's denylist, taking it off the allowlist.
+// A denied peer cannot be added or relayed to, messages it sends cannot be
+// relayed or broadcast through the manager, and clients proving its
+// identity are closed when they connect to a managed server peer. A peer
+// already managed stays managed, and Broadcast still reaches it; remove it
+// with RemovePeer to stop that.
+func (m *PeerManager) Deny(peerID string) {
+	a := &m.acl
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowed, peerID)
+	if a.denied == nil {
+		a.denied = make(map[string]struct{})
+	}
+	a.denied[peerID] = struct{}{}
+}
+
+// AllowCIDR admits addresses in cidr, such as "10.0.0.0/8". Once any range
+// is allowed, peers and clients at addresses outside every allowed range
+// are refused as for Allow. It returns ErrInvalidAddress if cidr cannot be
+// parsed.
+func (m *PeerManager) AllowCIDR(cidr string) error {
+	prefix, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	m.acl.mu.Lock()
+	defer m.acl.mu.Unlock()
+	m.acl.allowNets = append(m.acl.allowNets, prefix)
+	return nil
+}
+
+// DenyCIDR refuses peers and clients at addresses in cidr, as Deny does
+// for IDs, even if an allowed range also holds them. It returns
+// ErrInvalidAddress if cidr cannot be parsed.
+func (m *PeerManager) DenyCIDR(cidr string) error {
+	prefix, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	m.acl.mu.Lock()
+	defer m.acl.mu.Unlock()
+	m.acl.denyNets = append(m.acl.denyNets, prefix)
+	return nil
+}
+
+// SetAccessPolicy registers fn to decide on every request the allowlists,
+// denylists and address filters let through, replacing any policy set
+// before; a nil fn removes it. Returning false refuses the request as a
+// denylist would. fn runs on the goroutine adding the peer or relaying the
+// message, or on the thread accepting the client, so it should return
+// quickly and must not call back into the server peer.
+func (m *PeerManager) SetAccessPolicy(fn func(AccessRequest) bool) {
+	m.acl.mu.Lock()
+	defer m.acl.mu.Unlock()
+	m.acl.policy = fn
+}
+
+// ResetAccess clears the manager's allowlist, denylist, address filters and
+// policy, so every peer is admitted again.
+func (m *PeerManager) ResetAccess() {
+	a := &m.acl
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowed, a.denied, a.allowNets, a.denyNets, a.policy = nil, nil, nil, nil, nil
+}
+
+// parseCIDR parses an address range, reporting ErrInvalidAddress.
+func parseCIDR(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// admits reports whether the access control lets r through.
+func (a *accessList) admits(r AccessRequest) bool {
+	a.mu.RLock()
+	policy := a.policy
+	ok := a.admitsID(r.PeerID) && a.admitsAddr(r.Addr)
+	a.mu.RUnlock()
+	return ok && (policy == nil || policy(r))
+}
+
+// admitsID checks id against the ID lists; an empty ID is not checked.
+// Caller must hold mu.
+func (a *accessList) admitsID(id string) bool {
+	if id == "" {
+		return true
+	}
+	if _, denied := a.denied[id]; denied {
+		return false
+	}
+	if len(a.allowed) == 0 {
+		return true
+	}
+	_, allowed := a.allowed[id]
+	return allowed
+}
+
+// admitsAddr checks the IP of an "ip:port" address against the address
+// filters. An address that is not an IP, such as a host name, only passes
+// when no range is allowed. Caller must hold mu.
+func (a *accessList) admitsAddr(addr string) bool {
+	if len(a.allowNets) == 0 && len(a.denyNets) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return len(a.allowNets) == 0
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range a.denyNets {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowNets) == 0 {
+		return true
+	}
+	for _, prefix := range a.allowNets {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedSource reports whether messages from the peer with the given ID
+// may not be relayed: it is denied, or missing from a non-empty allowlist.
+func (a *accessList) deniedSource(id string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return !a.admitsID(id)
+}
+
+// admitsPeer checks a peer being added or relayed to.
+func (m *PeerManager) admitsPeer(kind AccessKind, p *Peer, via string) bool {
+	p.cfgMu.Lock()
+	addr := net.JoinHostPort(p.cfg.ip, strconv.Itoa(p.cfg.port))
+	p.cfgMu.Unlock()
+	return m.acl.admits(AccessRequest{Kind: kind, PeerID: p.id, Addr: addr, Via: via})
+}
+
+// acceptFilters maps the context given to relay_set_accept_filter to its
+// server peer. A filter call racing with Destroy then finds nothing,
+// rather than a deleted cgo.Handle.
+var (
+	acceptFilters    sync.Map // uintptr -> *Peer
+	nextAcceptFilter atomic.Uintptr
+)
+
+// filterClients makes the server peer p check every client it accepts
+// against the access control of the manager it belongs to at the time.
+func (p *Peer) filterClients() {
+	p.acceptOnce.Do(func() {
+		key := nextAcceptFilter.Add(1)
+		acceptFilters.Store(key, p)
+		p.acceptKey.Store(key)
+		if p.enter() {
+			C.relay_set_accept_filter(p.ptr, C.RelayAcceptCallback(C.relayGoAcceptClient), C.uintptr_t(key))
+			p.leave()
+		}
+	})
+}
+
+// stopFilteringClients undoes filterClients, for Destroy.
+func (p *Peer) stopFilteringClients() {
+	if key := p.acceptKey.Load(); key != 0 && p.enter() {
+		C.relay_set_accept_filter(p.ptr, nil, 0)
+		p.leave()
+		acceptFilters.Delete(key)
+	}
+}
+
+//export relayGoAcceptClient
+func relayGoAcceptClient(context C.uintptr_t, address *C.char, identity *C.char, n C.size_t) C.int {
+	v, ok := acceptFilters.Load(uintptr(context))
+	if !ok {
+		return 1
+	}
+	p := v.(*Peer)
+	m := p.mgr.Load()
+	if m == nil {
+		return 1
+	}
+	r := AccessRequest{Kind: AccessConnect, Addr: C.GoString(address), Via: p.id}
+	if n > 0 {
+		if key, err := identityKey(C.GoBytes(unsafe.Pointer(identity), C.int(n))); err == nil {
+			r.PeerID = PeerIDFromKey(key)
+		}
+	}
+	if !m.acl.admits(r) {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	_, c := newPairIDs(t, "c-server", "c")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+
+	m.Deny("c")
+	if err := m.Add(c); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("Add of a denied peer: %v, want ErrAccessDenied", err)
+	}
+	m.Deny("a")
+	if err := m.Relay("a", "b", "hello"); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("Relay from a denied peer: %v, want ErrAccessDenied", err)
+	}
+	m.ResetAccess()
+	if err := m.Relay("a", "b", "hello"); err != nil {
+		t.Fatalf("Relay after ResetAccess: %v", err)
+	}
+	receive(t, serverB)
+
+	if err := m.DenyCIDR("not a range"); !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("DenyCIDR of garbage: %v, want ErrInvalidAddress", err)
+	}
+	if err := m.AllowCIDR("10.0.0.0/8"); err != nil {
+		t.Fatalf("AllowCIDR: %v", err)
+	}
+	if err := m.Add(c); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("Add of a peer outside the allowed range: %v, want ErrAccessDenied", err)
+	}
+	m.ResetAccess()
+
+	var asked []AccessRequest
+	m.SetAccessPolicy(func(r AccessRequest) bool {
+		asked = append(asked, r)
+		return r.Kind != AccessRelay
+	})
+	if err := m.Add(c); err != nil {
+		t.Fatalf("Add admitted by the policy: %v", err)
+	}
+	if err := m.Relay("a", "c", "hello"); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("Relay refused by the policy: %v, want ErrAccessDenied", err)
+	}
+	if len(asked) != 2 || asked[0].Kind != AccessAdd || asked[1].PeerID != "c" || asked[1].Via != "a" {
+		t.Fatalf("policy asked %+v", asked)
+	}
+}
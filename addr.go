@@ -0,0 +1,97 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"unsafe"
+)
+
+// schemeAddr is the net.Addr of an in-process address or one on a
+// registered transport, whose network is the address's scheme.
+type schemeAddr string
+
+func (a schemeAddr) Network() string {
+	scheme, _, _ := strings.Cut(string(a), "://")
+	return scheme
+}
+
+func (a schemeAddr) String() string { return string(a) }
+
+// LocalAddr returns the address the peer's socket is bound to, such as the
+// port the OS picked for a server peer opened on port 0. It is a
+// *net.TCPAddr, a *net.UDPAddr with WithUDP and a *net.UnixAddr for a
+// UnixScheme address; for a MemoryScheme address it is the server peer's
+// address, and on a registered transport the address of the listener
+// Transport.Listen returned. It returns nil if the address is unknown, as
+// for a client peer on a Unix domain socket or a registered transport.
+func (p *Peer) LocalAddr() net.Addr {
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+	ip, udp := p.addrConfig()
+	if lookupTransport(ip) != nil {
+		return nil
+	}
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	cAddr := C.relay_get_local_address(p.ptr)
+	defer C.free(unsafe.Pointer(cAddr))
+	return parseAddr(C.GoString(cAddr), udp)
+}
+
+// RemoteAddr returns the address a client peer is connected to, of the same
+// types as LocalAddr's, after any reconnect. It returns nil for a server
+// peer, whose clients' addresses Client.Addr reports, and when the peer is
+// not connected.
+func (p *Peer) RemoteAddr() net.Addr {
+	ip, udp := p.addrConfig()
+	if lookupTransport(ip) != nil {
+		if p.listener != nil || !p.IsConnected() {
+			return nil
+		}
+		return schemeAddr(ip)
+	}
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	cAddr := C.relay_get_remote_address(p.ptr)
+	defer C.free(unsafe.Pointer(cAddr))
+	return parseAddr(C.GoString(cAddr), udp)
+}
+
+// addrConfig returns the peer's address and whether it uses WithUDP.
+func (p *Peer) addrConfig() (string, bool) {
+	p.cfgMu.Lock()
+	defer p.cfgMu.Unlock()
+	return p.cfg.ip, p.cfg.udp != nil
+}
+
+// parseAddr converts an address the C library reports for a peer's socket,
+// a UDP one if udp is set.
+func parseAddr(addr string, udp bool) net.Addr {
+	switch {
+	case addr == "":
+		return nil
+	case strings.HasPrefix(addr, UnixScheme):
+		return &net.UnixAddr{Name: strings.TrimPrefix(addr, UnixScheme), Net: "unix"}
+	case strings.HasPrefix(addr, MemoryScheme):
+		return schemeAddr(addr)
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	if udp {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
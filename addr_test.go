@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLocalAndRemoteAddr(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	local, ok := server.LocalAddr().(*net.TCPAddr)
+	if !ok || local.Port == 0 {
+		t.Fatalf("server LocalAddr = %v, want the bound port", server.LocalAddr())
+	}
+	if addr := server.RemoteAddr(); addr != nil {
+		t.Fatalf("server RemoteAddr = %v, want nil", addr)
+	}
+	remote, ok := client.RemoteAddr().(*net.TCPAddr)
+	if !ok || remote.Port != local.Port {
+		t.Fatalf("client RemoteAddr = %v, want port %d", client.RemoteAddr(), local.Port)
+	}
+	if got, want := conn.Addr(), client.LocalAddr().String(); got != want {
+		t.Fatalf("Client.Addr = %s, want the client's LocalAddr %s", got, want)
+	}
+}
+
+func TestIPv6DualStack(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	} else {
+		l.Close()
+	}
+	server, err := OpenPeer("server", "[::]", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+
+	for _, ip := range []string{"::1", "[::1]", "127.0.0.1"} {
+		client, conn := connect(t, server, func() (*Peer, error) { return OpenPeer("client", ip, port, 0) })
+		exchange(t, server, client, conn, 1)
+		client.Destroy()
+	}
+
+	v6only, err := OpenPeer("v6only", "::", 0, 1, WithIPv6Only())
+	if err != nil {
+		t.Fatalf("OpenPeer with WithIPv6Only: %v", err)
+	}
+	t.Cleanup(v6only.Destroy)
+	if _, err := OpenPeer("v4", "127.0.0.1", v6only.LocalAddr().(*net.TCPAddr).Port, 0); err == nil {
+		t.Fatal("IPv4 client reached an IPv6-only server")
+	}
+}
@@ -0,0 +1,79 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// WithAuthToken makes the peer admit only remote ends that know one of
+// tokens. A client peer proves it knows the first token when it connects,
+// and fails to open with ErrHandshakeFailed if the server does not accept
+// it; a server peer closes clients that know none of them, so several
+// tokens can be accepted while they are rotated. The handshake is a
+// challenge-response, so tokens are never sent, but traffic after it is
+// not encrypted: use WithTLS or WithNoiseKey where it must be kept secret.
+// Such peers are Authenticated. It cannot be combined with WithTLS,
+// WithNoiseKey or WithIdentity, and only takes effect when the peer is
+// created.
+func WithAuthToken(tokens ...string) PeerOption {
+	return func(c *peerConfig) {
+		c.authSecrets = nil
+		for _, token := range tokens {
+			c.authSecrets = append(c.authSecrets, []byte(token))
+		}
+	}
+}
+
+// WithPSK is WithAuthToken for a binary pre-shared key, such as 32 bytes
+// from crypto/rand, which both ends must be given.
+func WithPSK(key []byte) PeerOption {
+	return func(c *peerConfig) { c.authSecrets = [][]byte{append([]byte(nil), key...)} }
+}
+
+// Add adds a peer to the manager like AddPeer, but returns
+// ErrUnauthenticated, adding nothing, if the manager requires authenticated
+// peers and p is not Authenticated (see RequireAuthenticatedPeers), and
+// ErrAccessDenied if the access control refuses it (see Allow and Deny).
+func (m *PeerManager) Add(p *Peer) error {
+	if m.authOnly.Load() && !p.Authenticated() {
+		return ErrUnauthenticated
+	}
+	if !m.admitsPeer(AccessAdd, p, "") {
+		return ErrAccessDenied
+	}
+	m.addPeer(p)
+	return nil
+}
+
+// RequireAuthenticatedPeers makes the manager refuse peers that are not
+// Authenticated, or stop refusing them: Add then returns ErrUnauthenticated
+// and AddPeer ignores them. Since Relay only forwards messages between
+// managed peers, no message from an unauthenticated peer is relayed either.
+// Peers added before the call are kept.
+func (m *PeerManager) RequireAuthenticatedPeers(required bool) {
+	m.authOnly.Store(required)
+}
+
+// newCAuthOptions converts the shared secrets in cfg for the C library,
+// allocating in mem.
+func newCAuthOptions(cfg *peerConfig, mem *cMemory) (*C.RelayAuthOptions, error) {
+	for _, secret := range cfg.authSecrets {
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%w: empty auth token or PSK", ErrConfigureFailed)
+		}
+	}
+	n := len(cfg.authSecrets)
+	secrets := unsafe.Slice((**C.char)(mem.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof((*C.char)(nil))))), n)
+	lens := unsafe.Slice((*C.size_t)(mem.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof(C.size_t(0))))), n)
+	for i, secret := range cfg.authSecrets {
+		secrets[i] = (*C.char)(mem.bytes(secret))
+		lens[i] = C.size_t(len(secret))
+	}
+	opts := (*C.RelayAuthOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayAuthOptions{}))))
+	*opts = C.RelayAuthOptions{secrets: &secrets[0], secretLens: &lens[0], secretCount: C.int(n)}
+	return opts, nil
+}
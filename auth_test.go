@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAuthToken(t *testing.T) {
+	server, client, conn := openPair(t,
+		[]PeerOption{WithAuthToken("old", "new")},
+		[]PeerOption{WithAuthToken("new")})
+	if !server.Authenticated() || !client.Authenticated() {
+		t.Fatal("token peers are not Authenticated")
+	}
+	exchange(t, server, client, conn, 1)
+
+	go server.Accept()
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	if _, err := OpenPeer("intruder", "127.0.0.1", port, 0, WithAuthToken("wrong")); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("OpenPeer with a wrong token: %v, want ErrHandshakeFailed", err)
+	}
+}
+
+func TestPSK(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	server, client, conn := openPair(t, []PeerOption{WithPSK(key)}, []PeerOption{WithPSK(key)})
+	exchange(t, server, client, conn, 1)
+}
+
+func TestRequireAuthenticatedPeers(t *testing.T) {
+	_, plain := newPairIDs(t, "plain-server", "plain")
+	_, authed, _ := openPairIDs(t, "authed-server", "authed",
+		[]PeerOption{WithAuthToken("secret")}, []PeerOption{WithAuthToken("secret")})
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.RequireAuthenticatedPeers(true)
+	if err := m.Add(plain); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Add of an unauthenticated peer: %v, want ErrUnauthenticated", err)
+	}
+	if err := m.Add(authed); err != nil {
+		t.Fatalf("Add of an authenticated peer: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthLimit caps the bytes sent and received across every peer of a
+// manager together.
+type bandwidthLimit struct {
+	mu      sync.Mutex
+	rates   [2]float64 // Bytes per second, indexed by rateSend and rateReceive, 0 for no limit
+	buckets [2]tokenBucket
+}
+
+// SetBandwidthLimit caps the total upload and download, in bytes per
+// second, of every peer in the manager together, so relay traffic leaves
+// room for other applications on a constrained link. It meters the same
+// sends and receives as Peer.SetRateLimit, plus broadcasts, and applies on
+// top of any per-peer limits; a send or receive held back by it is
+// reported to OnThrottled with Shared set. Limits can be changed at any
+// time; a rate of 0 removes the cap in that direction.
+func (m *PeerManager) SetBandwidthLimit(upload, download float64) {
+	m.bandwidth.mu.Lock()
+	defer m.bandwidth.mu.Unlock()
+	m.bandwidth.rates = [2]float64{max(upload, 0), max(download, 0)}
+}
+
+// BandwidthLimit returns the caps set with SetBandwidthLimit.
+func (m *PeerManager) BandwidthLimit() (upload, download float64) {
+	m.bandwidth.mu.Lock()
+	defer m.bandwidth.mu.Unlock()
+	return m.bandwidth.rates[rateSend], m.bandwidth.rates[rateReceive]
+}
+
+// take meters bytes in direction dir and returns how long to wait before
+// they go through.
+func (b *bandwidthLimit) take(dir, bytes int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buckets[dir].take(b.rates[dir], float64(bytes), now)
+}
@@ -0,0 +1,120 @@
+package relay
+
+import "sync"
+
+// OverflowPolicy selects what happens to a message queued while its buffer
+// or queue limit is reached.
+type OverflowPolicy int
+
+const (
+	// Block makes the sender wait until enough queued messages have been
+	// written to make room.
+	Block OverflowPolicy = iota
+	// DropNewest discards the message being queued.
+	DropNewest
+	// DropOldest discards the oldest messages waiting in the same peer's
+	// queue until the new one fits, discarding the new message instead if
+	// that peer has nothing left to discard.
+	DropOldest
+	// Reject refuses the message being queued and reports ErrQueueFull to
+	// a sender that can take an error, such as Peer.Enqueue, which keeps
+	// the message; methods that return nothing discard it silently.
+	Reject
+)
+
+// bufferBudget caps the bytes queued across every outbox that shares it.
+type bufferBudget struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	limit  int // 0 for no limit
+	used   int
+	policy OverflowPolicy
+}
+
+// tryAcquire charges n bytes if they fit. A message larger than the whole
+// limit is admitted once nothing else is queued, so it cannot wait forever.
+func (b *bufferBudget) tryAcquire(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tryAcquireLocked(n)
+}
+
+func (b *bufferBudget) tryAcquireLocked(n int) bool {
+	if b.limit > 0 && b.used > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// acquire charges n bytes, waiting for room. It gives up and returns false
+// once cancelled reports true; wake must be called for it to notice.
+func (b *bufferBudget) acquire(n int, cancelled func() bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cond.L == nil {
+		b.cond.L = &b.mu
+	}
+	for !b.tryAcquireLocked(n) {
+		if cancelled() {
+			return false
+		}
+		b.cond.Wait()
+	}
+	return true
+}
+
+// release returns n bytes to the budget. A negative n charges them without
+// checking the limit.
+func (b *bufferBudget) release(n int) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.wake()
+}
+
+// wake rechecks every blocked acquire.
+func (b *bufferBudget) wake() {
+	b.mu.Lock()
+	if b.cond.L != nil {
+		b.cond.Broadcast()
+	}
+	b.mu.Unlock()
+}
+
+// overflowPolicy returns the policy for messages that do not fit.
+func (b *bufferBudget) overflowPolicy() OverflowPolicy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.policy
+}
+
+// SetGlobalBufferLimit caps the total size, in bytes, of the messages queued
+// by SendConflated across every peer in the manager, whatever other limits
+// each peer has. Once the cap is reached new messages are handled according
+// to the overflow policy (see SetOverflowPolicy); messages discarded are
+// passed to the dead-letter handler with ErrBufferFull. A single message
+// larger than the cap is still queued once nothing else is. A limit of 0
+// removes the cap.
+func (m *PeerManager) SetGlobalBufferLimit(bytes int) {
+	m.buffers.mu.Lock()
+	m.buffers.limit = max(bytes, 0)
+	m.buffers.mu.Unlock()
+	m.buffers.wake()
+}
+
+// SetOverflowPolicy sets what happens to a message queued while the global
+// buffer limit is reached. The default is Block.
+func (m *PeerManager) SetOverflowPolicy(policy OverflowPolicy) {
+	m.buffers.mu.Lock()
+	m.buffers.policy = policy
+	m.buffers.mu.Unlock()
+}
+
+// BufferedBytes returns the total size of the messages queued across every
+// peer in the manager, as counted against the global buffer limit.
+func (m *PeerManager) BufferedBytes() int {
+	m.buffers.mu.Lock()
+	defer m.buffers.mu.Unlock()
+	return m.buffers.used
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGlobalBufferLimit(t *testing.T) {
+	budget := &bufferBudget{limit: 10, policy: Reject}
+	var a, b outbox
+	var overflowed []string
+	onOverflow := func(message string) { overflowed = append(overflowed, message) }
+	a.setBudget(budget, onOverflow)
+	b.setBudget(budget, onOverflow)
+	s := newStalledSender()
+	a.push("", "", "first", s.send)
+	<-s.started
+
+	// The budget is shared, so b is refused once a holds most of it.
+	if err := a.push("", "", "12345", s.send); err != nil {
+		t.Fatalf("push within the limit: %v", err)
+	}
+	if err := b.push("", "", "x", s.send); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("push over the limit: %v, want ErrBufferFull", err)
+	}
+	if len(overflowed) != 0 {
+		t.Fatalf("Reject passed %q to the overflow handler", overflowed)
+	}
+
+	budget.policy = DropNewest
+	if err := b.push("", "", "y", s.send); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("push over the limit: %v, want ErrBufferFull", err)
+	}
+	if len(overflowed) != 1 || overflowed[0] != "y" {
+		t.Fatalf("overflowed %q, want the dropped message", overflowed)
+	}
+	s.release()
+	a.flush()
+	if budget.used != 0 {
+		t.Fatalf("%d bytes still charged once the queue drained", budget.used)
+	}
+	a.close()
+	b.close()
+}
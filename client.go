@@ -0,0 +1,102 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"unsafe"
+)
+
+// Client is one connection accepted by a server peer with Accept. It lets
+// the server address that client alone, where SendMessage and Broadcast
+// reach every client. A Client is only valid until the server peer
+// reconnects or is closed; its methods then return ErrPeerNotFound.
+type Client struct {
+	peer *Peer
+	id   uint64
+}
+
+// Accept waits for one client to connect to the server peer and returns a
+// handle for it. It returns ErrListenerClosed if the peer is closed or
+// StopAccepting is called while it waits. AcceptClients accepts several
+// without handles; clients accepted either way count toward AcceptedCount.
+func (p *Peer) Accept() (*Client, error) {
+	for {
+		if !p.enter() {
+			return nil, ErrListenerClosed
+		}
+		var id C.uint64_t
+		status := C.relay_accept_client_id(p.ptr, C.int64_t(acceptPollInterval.Milliseconds()), &id)
+		p.leave()
+		switch status {
+		case C.RELAY_OK:
+			return &Client{peer: p, id: uint64(id)}, nil
+		case C.RELAY_ERR_LISTENER_CLOSED:
+			return nil, ErrListenerClosed
+		}
+	}
+}
+
+// ID returns the client's ID, unique among the clients the server peer has
+// accepted since it last reconnected.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+// Addr returns the client's remote address as "ip:port", or an empty string
+// once the client is closed.
+func (c *Client) Addr() string {
+	if !c.peer.enter() {
+		return ""
+	}
+	defer c.peer.leave()
+	cAddr := C.relay_get_client_address(c.peer.ptr, C.uint64_t(c.id))
+	defer C.free(unsafe.Pointer(cAddr))
+	return C.GoString(cAddr)
+}
+
+// Send sends a message to this client only. It returns ErrPeerDisconnected
+// if the client's connection is closed.
+func (c *Client) Send(message string) error {
+	return c.SendBytes([]byte(message))
+}
+
+// SendBytes sends data to this client only, like Send; the data may hold any
+// bytes, including zeros.
+func (c *Client) SendBytes(data []byte) error {
+	if err := c.peer.checkSize(len(data)); err != nil {
+		return err
+	}
+	c.peer.throttle(rateSend, 1, len(data))
+	if !c.peer.enter() {
+		return ErrPeerNotFound
+	}
+	defer c.peer.leave()
+	cData := C.CBytes(data)
+	defer C.free(cData)
+	start := cgoStart()
+	status := C.relay_send_to_client(c.peer.ptr, C.uint64_t(c.id), (*C.char)(cData), C.size_t(len(data)))
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// IsConnected reports whether the client's connection is still open.
+func (c *Client) IsConnected() bool {
+	if !c.peer.enter() {
+		return false
+	}
+	defer c.peer.leave()
+	return C.relay_is_client_connected(c.peer.ptr, C.uint64_t(c.id)) == 1
+}
+
+// Close closes the connection to this client. The server peer and its other
+// clients are unaffected.
+func (c *Client) Close() error {
+	if !c.peer.enter() {
+		return ErrPeerNotFound
+	}
+	defer c.peer.leave()
+	return statusError(C.relay_close_client(c.peer.ptr, C.uint64_t(c.id)), ErrPeerNotFound)
+}
@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAcceptedClientHandle(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	if conn.ID() == 0 || conn.Addr() == "" {
+		t.Fatalf("client handle has ID %d and address %q", conn.ID(), conn.Addr())
+	}
+	if !conn.IsConnected() {
+		t.Fatal("accepted client is not connected")
+	}
+	if err := conn.Send("to you"); err != nil {
+		t.Fatalf("Client.Send: %v", err)
+	}
+	if got := receive(t, client); got != "to you" {
+		t.Fatalf("got %q, want %q", got, "to you")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Client.Close: %v", err)
+	}
+	if conn.IsConnected() {
+		t.Fatal("closed client is still connected")
+	}
+	if err := conn.Send("gone"); err == nil {
+		t.Fatal("Client.Send after Close succeeded")
+	}
+	server.Destroy()
+	if err := conn.Close(); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("Client.Close after the server was destroyed: %v, want ErrPeerNotFound", err)
+	}
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+type point struct {
+	X, Y  int
+	Label string
+}
+
+func TestCodecs(t *testing.T) {
+	server, client := newPair(t)
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		client.SetCodec(c)
+		server.SetCodec(c)
+		want := point{1, 2, c.ContentType()}
+		if err := client.SendEncoded(want); err != nil {
+			t.Fatalf("%s: SendEncoded: %v", c.ContentType(), err)
+		}
+		var got point
+		if err := server.ReceiveDecoded(&got); err != nil || got != want {
+			t.Fatalf("%s: ReceiveDecoded = %+v, %v, want %+v", c.ContentType(), got, err, want)
+		}
+	}
+
+	server.SetCodec(BinaryCodec)
+	client.SetCodec(BinaryCodec)
+	if err := client.SendEncoded(Message{ID: "m1", Payload: []byte("body")}); err != nil {
+		t.Fatalf("BinaryCodec: SendEncoded: %v", err)
+	}
+	var m Message
+	if err := server.ReceiveDecoded(&m); err != nil || m.ID != "m1" || string(m.Payload) != "body" {
+		t.Fatalf("BinaryCodec: ReceiveDecoded = %+v, %v", m, err)
+	}
+	if err := client.SendEncoded(point{}); !errors.Is(err, ErrCodec) {
+		t.Fatalf("BinaryCodec with a plain struct: %v, want ErrCodec", err)
+	}
+
+	server.SetCodec(nil)
+	if server.Codec() != JSONCodec {
+		t.Fatal("SetCodec(nil) did not restore JSONCodec")
+	}
+	if err := client.Send("not json"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := server.ReceiveDecoded(&point{}); !errors.Is(err, ErrCodec) {
+		t.Fatalf("ReceiveDecoded of invalid JSON: %v, want ErrCodec", err)
+	}
+}
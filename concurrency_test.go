@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSendWhileReceiving checks that a receive waiting for a message does
+// not hold up sends on the same peer.
+func TestSendWhileReceiving(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	received := make(chan string, 1)
+	go func() {
+		message, _ := client.Receive()
+		received <- message
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the receive start waiting.
+
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send("ping") }()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked behind a waiting receive")
+	}
+	if got := receive(t, server); got != "ping" {
+		t.Fatalf("server got %q, want ping", got)
+	}
+	if err := conn.Send("pong"); err != nil {
+		t.Fatalf("Client.Send: %v", err)
+	}
+	if got := <-received; got != "pong" {
+		t.Fatalf("client got %q, want pong", got)
+	}
+}
+
+// TestConcurrentSendReceiveManage runs sends, receives and manager changes
+// on the same peers at once; run it with -race.
+func TestConcurrentSendReceiveManage(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	const messages = 50
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			if err := client.Send(fmt.Sprint(i)); err != nil {
+				t.Errorf("Send %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			if _, err := server.ReceiveWithTimeout(5 * time.Second); err != nil {
+				t.Errorf("Receive %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			m.AddPeer(client)
+			m.GetPeer(client.ID())
+			m.RemovePeer(client.ID())
+		}
+	}()
+	wg.Wait()
+}
+
+// TestPartialFrameDoesNotBlock checks that a receive holding part of a frame
+// header does not hold up sends or Close while the rest never arrives.
+func TestPartialFrameDoesNotBlock(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err := Open("client", "127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	c := <-accepted
+	if c == nil {
+		t.Fatal("Accept failed")
+	}
+	defer c.Close()
+
+	// The start of a frame header, and then silence.
+	if _, err := c.Write([]byte{0xFE, 0xED, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan error, 1)
+	go func() {
+		_, err := client.Receive()
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the receive read the partial header.
+
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send("ping") }()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked behind a partial frame")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked behind a partial frame")
+	}
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Fatal("Receive returned a message from a partial frame")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive still waiting after Close")
+	}
+}
+
+// TestDestroyWakesBlockedSend checks that Destroy does not wait for a send
+// that the receiver never reads to finish.
+func TestDestroyWakesBlockedSend(t *testing.T) {
+	_, client := newPair(t)
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send(strings.Repeat("x", 20<<20)) }()
+	time.Sleep(100 * time.Millisecond) // Let the send fill the socket buffers.
+
+	destroyed := make(chan struct{})
+	go func() {
+		client.Destroy()
+		close(destroyed)
+	}()
+	select {
+	case <-destroyed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Destroy blocked behind a send")
+	}
+	if err := <-sent; err == nil {
+		t.Fatal("Send to a destroyed peer succeeded")
+	}
+}
+
+// TestManagerDestroyWaitsForRelay checks that destroying a manager waits for
+// a relay in progress instead of freeing the manager under it.
+func TestManagerDestroyWaitsForRelay(t *testing.T) {
+	_, source := newPairIDs(t, "source-server", "source")
+	_, target := newPairIDs(t, "target-server", "target")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(source)
+	m.AddPeer(target)
+
+	relayed := make(chan error, 1)
+	go func() { relayed <- m.Relay("source", "target", strings.Repeat("x", 20<<20)) }()
+	for inFlight := 0; inFlight == 0; time.Sleep(time.Millisecond) {
+		m.guard.mu.Lock()
+		inFlight = m.guard.calls
+		m.guard.mu.Unlock()
+	}
+
+	destroyed := make(chan struct{})
+	go func() {
+		m.Destroy()
+		close(destroyed)
+	}()
+	select {
+	case <-destroyed:
+		t.Fatal("Destroy returned while a relay was in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	target.Close()
+	select {
+	case <-destroyed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Destroy did not return once the relay ended")
+	}
+	if err := <-relayed; err == nil {
+		t.Fatal("Relay to a closed peer succeeded")
+	}
+}
@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connWriteChunk is the largest message a Conn's Write sends, so one large
+// write does not have to fit in a single frame.
+const connWriteChunk = 64 << 10
+
+// peerConn is the net.Conn Peer.Conn returns.
+type peerConn struct {
+	connState
+	peer *Peer
+
+	readMu  sync.Mutex
+	pending []byte // Rest of the last message received, not read yet
+	writeMu sync.Mutex
+}
+
+// connState holds what every Conn keeps besides its connection: its
+// deadlines and whether it was closed.
+type connState struct {
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Conn returns a net.Conn over the peer connection, for code built around
+// byte streams and deadlines, such as crypto/tls, yamux or gRPC. Write
+// sends its bytes as messages of up to 64 KiB and Read returns the bytes of
+// the messages received in order, so the other end may be another Conn or
+// send and receive messages itself; message boundaries are not kept. Read
+// returns io.EOF once the connection is closed and, like Write, an error
+// wrapping os.ErrDeadlineExceeded past its deadline. Closing the Conn closes
+// the peer, and CloseWrite shuts down its sending side.
+//
+// It is for client peers; a server peer reaches its clients through
+// Listener. Each call returns a new Conn that keeps its own partly read
+// message, so use one Conn per peer at a time and do not receive from the
+// peer directly while it is in use.
+func (p *Peer) Conn() net.Conn {
+	return &peerConn{connState: connState{closed: make(chan struct{})}, peer: p}
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(c.pending) == 0 {
+		ctx, done := c.context(&c.readDeadline)
+		data, err := c.peer.receive(ctx)
+		done()
+		if err != nil {
+			if errors.Is(err, ErrPeerDisconnected) && !c.isClosed() {
+				return 0, io.EOF
+			}
+			return 0, c.opError(c, "read", err, ctx)
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+connWriteChunk)]
+		ctx, done := c.context(&c.writeDeadline)
+		err := c.peer.waitWritable(ctx)
+		if err == nil {
+			err = c.peer.SendBytes(chunk)
+		}
+		done()
+		if err != nil {
+			return written, c.opError(c, "write", err, ctx)
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close closes the peer. Reads and writes in progress return net.ErrClosed.
+func (c *peerConn) Close() error {
+	err := error(&net.OpError{Op: "close", Net: "relay", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: net.ErrClosed})
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.peer.Close()
+		err = nil
+	})
+	return err
+}
+
+// CloseWrite shuts down the sending side of the peer connection, so the
+// remote end reads end-of-file while this end can still read.
+func (c *peerConn) CloseWrite() error {
+	c.peer.CloseWrite()
+	return nil
+}
+
+// LocalAddr returns the peer's LocalAddr, or an address of network "relay"
+// holding the peer's ID if that is unknown.
+func (c *peerConn) LocalAddr() net.Addr {
+	if addr := c.peer.LocalAddr(); addr != nil {
+		return addr
+	}
+	return connAddr(c.peer.id)
+}
+
+// RemoteAddr returns the peer's RemoteAddr, or an address of network
+// "relay" holding the address the peer was opened on if that is unknown.
+func (c *peerConn) RemoteAddr() net.Addr {
+	if addr := c.peer.RemoteAddr(); addr != nil {
+		return addr
+	}
+	ip, _ := c.peer.addrConfig()
+	return connAddr(ip)
+}
+
+func (c *connState) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *connState) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *connState) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *connState) isClosed() bool {
+	return isClosedChan(c.closed)
+}
+
+// context returns a context that is cancelled once d passes or the Conn is
+// closed, with os.ErrDeadlineExceeded or net.ErrClosed as its cause, and a
+// function that releases it.
+func (c *connState) context(d *connDeadline) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	expired := d.wait()
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-expired:
+			cancel(os.ErrDeadlineExceeded)
+		case <-c.closed:
+			cancel(net.ErrClosed)
+		case <-stop:
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel(nil)
+	}
+}
+
+// opError wraps err from a read or write on conn as a *net.OpError,
+// replacing the error of a cancelled ctx with its cause.
+func (c *connState) opError(conn net.Conn, op string, err error, ctx context.Context) error {
+	if errors.Is(err, context.Canceled) {
+		err = context.Cause(ctx)
+	}
+	if c.isClosed() {
+		err = net.ErrClosed
+	}
+	return &net.OpError{Op: op, Net: "relay", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+}
+
+// connAddr is the net.Addr of a Conn whose socket address is unknown.
+type connAddr string
+
+func (a connAddr) Network() string { return "relay" }
+
+func (a connAddr) String() string { return string(a) }
+
+// connDeadline is a read or write deadline of a Conn, as net.Pipe keeps
+// them. The channel wait returns is closed once the deadline passes; it is
+// only replaced after that, so calls already waiting see a moved deadline.
+type connDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // The timer fired; wait for it to close the channel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.expired)
+	if closed && (t.IsZero() || time.Until(t) > 0) {
+		d.expired = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() { close(expired) })
+		return
+	}
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *connDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
+
+func isClosedChan(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
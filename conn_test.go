@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	c := client.Conn()
+	// Larger than one Conn message, so the write is split.
+	data := strings.Repeat("c", 100<<10)
+	if n, err := c.Write([]byte(data)); err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	var got strings.Builder
+	for got.Len() < len(data) {
+		got.WriteString(receive(t, server))
+	}
+	if got.String() != data {
+		t.Fatal("server did not receive the bytes written")
+	}
+
+	if err := conn.Send("reply"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "rep" {
+		t.Fatalf("Read = %q, %v, want %q", buf, err, "rep")
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || string(buf[:2]) != "ly" {
+		t.Fatalf("Read = %q, %v, want the rest of the message", buf[:2], err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past the deadline: %v, want os.ErrDeadlineExceeded", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if client.IsConnected() {
+		t.Fatal("closing the Conn left the peer connected")
+	}
+}
@@ -0,0 +1,98 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"context"
+	"time"
+)
+
+// receivePollInterval and sendPollInterval bound how long
+// ReceiveMessageContext and SendMessageContext wait in the C library before
+// checking their context again.
+const (
+	receivePollInterval = 100 * time.Millisecond
+	sendPollInterval    = 100 * time.Millisecond
+)
+
+// pollWait returns how long a cancellable call should block before checking
+// ctx again: interval, or less if ctx's deadline is sooner.
+func pollWait(ctx context.Context, interval time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < interval {
+		return max(time.Until(deadline), time.Millisecond)
+	}
+	return interval
+}
+
+// ReceiveMessageContext receives a message like Receive, but gives up with
+// ctx.Err() once ctx is done, so a caller can bound the wait with a
+// deadline or cancel it without leaving a goroutine blocked. A message that
+// arrives after ctx is done is kept for the next receive.
+func (p *Peer) ReceiveMessageContext(ctx context.Context) (string, error) {
+	data, err := p.receive(ctx)
+	return string(data), err
+}
+
+// SendMessageContext sends a message like Send, but first waits until the
+// connection can take it, giving up with ctx.Err() if ctx is done first,
+// for example while a slow receiver has the send buffer full. Once the send
+// has started it runs to completion.
+func (p *Peer) SendMessageContext(ctx context.Context, message string) error {
+	if err := p.waitWritable(ctx); err != nil {
+		return err
+	}
+	return p.Send(message)
+}
+
+// waitWritable waits until the connection can take a message, giving up
+// with ctx's error once ctx is done.
+func (p *Peer) waitWritable(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.enter() {
+			return ErrPeerDisconnected
+		}
+		wait := pollWait(ctx, sendPollInterval)
+		status := C.relay_wait_writable(p.ptr, C.int64_t(wait.Milliseconds()))
+		p.leave()
+		switch status {
+		case C.RELAY_OK:
+			return nil
+		case C.RELAY_ERR_TIMEOUT:
+		default:
+			return statusError(status, ErrSendFailed)
+		}
+	}
+}
+
+// AcceptClientsContext accepts up to n clients like AcceptClients and
+// returns how many it accepted, but stops with ctx.Err() once ctx is done.
+// Clients accepted before that stay connected. Unlike WaitForClients it
+// counts the clients this call accepts, not those connected. If the peer is
+// closed or StopAccepting is called while it waits it returns
+// ErrListenerClosed.
+func (p *Peer) AcceptClientsContext(ctx context.Context, n int) (int, error) {
+	accepted := 0
+	for accepted < n {
+		if err := ctx.Err(); err != nil {
+			return accepted, err
+		}
+		if !p.enter() {
+			return accepted, ErrListenerClosed
+		}
+		wait := pollWait(ctx, acceptPollInterval)
+		status := C.relay_accept_client(p.ptr, C.int64_t(wait.Milliseconds()))
+		p.leave()
+		switch status {
+		case C.RELAY_OK:
+			accepted++
+		case C.RELAY_ERR_LISTENER_CLOSED:
+			return accepted, ErrListenerClosed
+		}
+	}
+	return accepted, nil
+}
@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReceiveMessageContext(t *testing.T) {
+	server, client := newPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := server.ReceiveMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReceiveMessageContext with nothing sent: %v, want DeadlineExceeded", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.SendMessageContext(canceled, "late"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendMessageContext with a canceled context: %v, want Canceled", err)
+	}
+	if err := client.SendMessageContext(context.Background(), "hello"); err != nil {
+		t.Fatalf("SendMessageContext: %v", err)
+	}
+	got, err := server.ReceiveMessageContext(context.Background())
+	if err != nil || got != "hello" {
+		t.Fatalf("ReceiveMessageContext = %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestAcceptClientsContext(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n, err := server.AcceptClientsContext(ctx, 1); n != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcceptClientsContext = %d, %v, want 0, DeadlineExceeded", n, err)
+	}
+}
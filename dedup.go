@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupFilter drops envelopes whose ID was already received within a
+// window, so retransmissions and relay loops reach the application once.
+type dedupFilter struct {
+	mu      sync.Mutex
+	window  time.Duration        // How long IDs are remembered, 0 when disabled
+	seen    map[string]time.Time // Envelope ID -> when it was first received
+	order   []string             // IDs in seen, oldest first
+	dropped uint64
+}
+
+// SetDuplicateWindow makes the peer drop a received envelope (see
+// SendEnvelope and SendReliable) whose ID it already received less than
+// window ago, so a message retransmitted by SendReliable, or looping
+// through relays, is delivered to the application once. It applies to
+// every way of receiving messages, including Messages and OnMessage;
+// messages that are not envelopes, or carry no ID, always get through.
+// IDs are remembered for window, so memory grows with the message rate. A
+// window of 0, the default, disables it and forgets the IDs seen.
+func (p *Peer) SetDuplicateWindow(window time.Duration) {
+	f := &p.dedup
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.window = max(window, 0)
+	if f.window == 0 {
+		f.seen, f.order = nil, nil
+	}
+}
+
+// DuplicatesDropped returns the number of received envelopes dropped as
+// duplicates (see SetDuplicateWindow).
+func (p *Peer) DuplicatesDropped() uint64 {
+	p.dedup.mu.Lock()
+	defer p.dedup.mu.Unlock()
+	return p.dedup.dropped
+}
+
+// duplicate reports whether message is an envelope whose ID was received
+// within the window, and otherwise remembers its ID.
+func (f *dedupFilter) duplicate(message []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.window == 0 || !IsEnvelope(message) {
+		return false
+	}
+	d := envelopeDecoder{data: message[len(envelopeMagic):]}
+	id := d.string()
+	if d.bad || id == "" {
+		return false
+	}
+
+	now := time.Now()
+	for len(f.order) > 0 && now.Sub(f.seen[f.order[0]]) >= f.window {
+		delete(f.seen, f.order[0])
+		f.order[0] = ""
+		f.order = f.order[1:]
+	}
+	if _, ok := f.seen[id]; ok {
+		f.dropped++
+		return true
+	}
+	if f.seen == nil {
+		f.seen = make(map[string]time.Time)
+	}
+	f.seen[id] = now
+	f.order = append(f.order, id)
+	return false
+}
@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayedDuplicateDropped(t *testing.T) {
+	server, client := newPair(t)
+	server.SetDuplicateWindow(time.Minute)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(server)
+	m.AddPeer(client)
+
+	for _, id := range []string{"dup", "dup", "next"} {
+		data, err := Message{ID: id, Payload: []byte(id)}.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Relay("server", "client", string(data)); err != nil {
+			t.Fatalf("Relay %s: %v", id, err)
+		}
+	}
+	for _, want := range []string{"dup", "next"} {
+		got, err := server.ReceiveEnvelope()
+		if err != nil {
+			t.Fatalf("ReceiveEnvelope: %v", err)
+		}
+		if got.ID != want {
+			t.Fatalf("received envelope %q, want %q", got.ID, want)
+		}
+	}
+	if n := server.DuplicatesDropped(); n != 1 {
+		t.Fatalf("DuplicatesDropped = %d, want 1", n)
+	}
+}
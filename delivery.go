@@ -0,0 +1,157 @@
+package relay
+
+import "sync"
+
+// DefaultAsyncQueueSize is how many messages SendAsync holds waiting to be
+// sent before it drops new ones.
+const DefaultAsyncQueueSize = 1024
+
+// Delivery tracks a message sent with SendAsync or SendReliable.
+type Delivery struct {
+	message string
+	id      string // Envelope ID given by SendReliable, empty otherwise
+	status  DeliveryStatus
+	done    chan struct{}
+}
+
+// Message returns the message sent.
+func (d *Delivery) Message() string {
+	return d.message
+}
+
+// ID returns the ID of the envelope SendReliable sent the message in, or
+// "" for SendAsync.
+func (d *Delivery) ID() string {
+	return d.id
+}
+
+// Done returns a channel that is closed once the outcome of the delivery is
+// known.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Status waits until Done is closed and returns the outcome: Delivered,
+// Failed or Timeout as for SendTracked, or Dropped if the message was never
+// sent, for example because it was an envelope that expired while queued.
+func (d *Delivery) Status() DeliveryStatus {
+	<-d.done
+	return d.status
+}
+
+// finish records the outcome. It is called exactly once.
+func (d *Delivery) finish(status DeliveryStatus) {
+	d.status = status
+	close(d.done)
+}
+
+// SendAsync queues a message to be sent in the background and returns at
+// once with a Delivery reporting its outcome, so a producer can keep
+// sending without waiting on each message and still learn which ones
+// failed. Messages are sent in order as with SendTracked, and each is
+// tracked by a receipt the same way, with the same requirements. If
+// DefaultAsyncQueueSize messages (see SetAsyncQueueSize) are already
+// waiting, the message is dropped instead and the Delivery reports
+// Dropped at once, as do queued messages when the peer is closed.
+// CloseGracefully sends the queued messages first.
+func (p *Peer) SendAsync(message string) *Delivery {
+	d := &Delivery{message: message, done: make(chan struct{})}
+	if !p.async.push(p, d) {
+		d.finish(Dropped)
+	}
+	return d
+}
+
+// SetAsyncQueueSize sets how many messages SendAsync holds waiting to be
+// sent, DefaultAsyncQueueSize by default. Messages already queued are kept
+// even if there are more than n.
+func (p *Peer) SetAsyncQueueSize(n int) {
+	p.async.mu.Lock()
+	defer p.async.mu.Unlock()
+	p.async.size = n
+}
+
+// asyncSender sends the messages queued by SendAsync from a goroutine that
+// runs while any are waiting.
+type asyncSender struct {
+	mu      sync.Mutex
+	idle    sync.Cond // Signalled when the queue empties and nothing is being sent
+	queue   []*Delivery
+	size    int // Queue capacity, DefaultAsyncQueueSize if 0
+	running bool
+	closed  bool
+	done    chan struct{}
+}
+
+// push queues d and starts the sender if it is not running. It reports
+// false if the queue is full or the peer is closed.
+func (a *asyncSender) push(p *Peer, d *Delivery) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed || len(a.queue) >= sizeOr(a.size, DefaultAsyncQueueSize) {
+		return false
+	}
+	a.queue = append(a.queue, d)
+	if !a.running {
+		a.running = true
+		a.done = make(chan struct{})
+		spawn(func() { a.run(p) })
+	}
+	return true
+}
+
+// run sends queued messages until the queue is empty or the sender is
+// closed.
+func (a *asyncSender) run(p *Peer) {
+	defer close(a.done)
+	for {
+		a.mu.Lock()
+		if a.closed || len(a.queue) == 0 {
+			a.running = false
+			if a.idle.L != nil {
+				a.idle.Broadcast()
+			}
+			a.mu.Unlock()
+			return
+		}
+		d := a.queue[0]
+		a.queue[0] = nil
+		a.queue = a.queue[1:]
+		a.mu.Unlock()
+
+		if isExpired([]byte(d.message)) {
+			d.finish(Dropped)
+			continue
+		}
+		p.sendTracked(d.message, d.finish)
+	}
+}
+
+// flush waits until every queued message has been sent.
+func (a *asyncSender) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.idle.L == nil {
+		a.idle.L = &a.mu
+	}
+	for a.running {
+		a.idle.Wait()
+	}
+}
+
+// close reports Dropped for the messages still queued and waits for the
+// message being sent, if any.
+func (a *asyncSender) close() {
+	a.mu.Lock()
+	a.closed = true
+	queue := a.queue
+	a.queue = nil
+	running, done := a.running, a.done
+	a.mu.Unlock()
+	for _, d := range queue {
+		d.finish(Dropped)
+	}
+	if running {
+		<-done
+	}
+}
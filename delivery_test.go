@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+// status waits for the outcome of d.
+func status(t *testing.T, d *Delivery) DeliveryStatus {
+	t.Helper()
+	select {
+	case <-d.Done():
+		return d.Status()
+	case <-time.After(DefaultReceiptTimeout + 2*time.Second):
+		t.Fatalf("no outcome for %q", d.Message())
+		return 0
+	}
+}
+
+func TestSendAsync(t *testing.T) {
+	server, client := newPair(t)
+	deliveries := []*Delivery{client.SendAsync("one"), client.SendAsync("two"), client.SendAsync("three")}
+	for _, d := range deliveries {
+		if got := receive(t, server); got != d.Message() {
+			t.Fatalf("got %q, want %q in order", got, d.Message())
+		}
+	}
+	for _, d := range deliveries {
+		if s := status(t, d); s != Delivered {
+			t.Fatalf("%q: status = %v, want delivered", d.Message(), s)
+		}
+	}
+
+	client.Destroy()
+	if s := status(t, client.SendAsync("late")); s != Dropped {
+		t.Fatalf("SendAsync on a closed peer: %v, want dropped", s)
+	}
+}
+
+func TestSendReliable(t *testing.T) {
+	server, client := newPair(t)
+	client.SetReliableRetries(3, 10*time.Millisecond)
+	d := client.SendReliable("at least once")
+	m, err := server.ReceiveEnvelope()
+	if err != nil {
+		t.Fatalf("ReceiveEnvelope: %v", err)
+	}
+	if m.ID != d.ID() || string(m.Payload) != "at least once" {
+		t.Fatalf("envelope = %+v, want ID %s", m, d.ID())
+	}
+	if s := status(t, d); s != Delivered {
+		t.Fatalf("status = %v, want delivered", s)
+	}
+}
+
+func TestSendReliableStopsOnClose(t *testing.T) {
+	_, client, conn := openPair(t, nil, nil)
+	client.SetReliableRetries(100, time.Hour)
+	// The server is gone, so the first attempt fails and the retry waits.
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	d := client.SendReliable("lost")
+	time.Sleep(50 * time.Millisecond)
+	client.Destroy()
+	if s := status(t, d); s != Failed {
+		t.Fatalf("status = %v, want failed", s)
+	}
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// openDiscovery opens a discovery on loopback, destroyed when the test
+// ends, and skips the test where multicast is unavailable.
+func openDiscovery(t *testing.T) *PeerDiscovery {
+	t.Helper()
+	d, err := OpenPeerDiscovery("239.255.0.1", freePort(t), "127.0.0.1")
+	if errors.Is(err, ErrMulticastUnavailable) {
+		t.Skip("multicast unavailable:", err)
+	}
+	if err != nil {
+		t.Fatalf("OpenPeerDiscovery: %v", err)
+	}
+	t.Cleanup(d.Destroy)
+	return d
+}
+
+// waitForPeers waits for d, which hears its own announcements, to discover
+// a peer and returns the peers discovered.
+func waitForPeers(t *testing.T, d *PeerDiscovery) []PeerInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if peers := d.GetDiscoveredPeerInfos(); len(peers) > 0 {
+			return peers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no peer discovered")
+	return nil
+}
+
+func TestParsePeerInfo(t *testing.T) {
+	for addr, want := range map[string]PeerInfo{
+		"10.0.0.1:9000": {IP: "10.0.0.1", Port: 9000},
+		"[::1]:9000":    {IP: "::1", Port: 9000},
+	} {
+		got := parsePeerInfo(addr)
+		if got.IP != want.IP || got.Port != want.Port {
+			t.Fatalf("parsePeerInfo(%q) = %+v, want %+v", addr, got, want)
+		}
+		if got.Addr() != addr {
+			t.Fatalf("Addr() = %q, want %q", got.Addr(), addr)
+		}
+	}
+}
+
+func TestDiscoveredPeersPageEmpty(t *testing.T) {
+	d := openDiscovery(t)
+	peers, total := d.GetDiscoveredPeersPage(0, 10)
+	if peers != nil || total != 0 {
+		t.Fatalf("page of a new discovery = %v, %d, want none", peers, total)
+	}
+}
+
+func TestOpenDiscoveryReportsMulticast(t *testing.T) {
+	d, err := OpenPeerDiscovery("239.255.0.1", freePort(t), "127.0.0.1")
+	if err != nil {
+		if !errors.Is(err, ErrMulticastUnavailable) {
+			t.Fatalf("OpenPeerDiscovery: %v, want nil or ErrMulticastUnavailable", err)
+		}
+		if NewPeerDiscovery("239.255.0.1", freePort(t), "127.0.0.1") != nil {
+			t.Fatal("NewPeerDiscovery returned a discovery OpenPeerDiscovery could not open")
+		}
+		return
+	}
+	d.Destroy()
+}
+
+func TestAddressResolver(t *testing.T) {
+	d := openDiscovery(t)
+	d.SetAddressResolver(func(advertised PeerInfo) PeerInfo {
+		advertised.IP = "192.0.2.1"
+		return advertised
+	})
+	d.Start()
+	t.Cleanup(d.Stop)
+	peers := waitForPeers(t, d)
+	if peers[0].IP != "192.0.2.1" {
+		t.Fatalf("resolved peer = %+v, want IP 192.0.2.1", peers[0])
+	}
+}
+
+func TestAnnouncementMetadata(t *testing.T) {
+	d := openDiscovery(t)
+	if err := d.SetAnnouncementMetadata(map[string]string{"a=b": "c"}); !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("SetAnnouncementMetadata with '=' in a key: %v, want ErrInvalidMetadata", err)
+	}
+	if err := d.SetAnnouncementMetadata(map[string]string{"role": "relay"}); err != nil {
+		t.Fatalf("SetAnnouncementMetadata: %v", err)
+	}
+	d.Start()
+	t.Cleanup(d.Stop)
+	peers := waitForPeers(t, d)
+	if peers[0].Metadata["role"] != "relay" {
+		t.Fatalf("discovered metadata = %v, want role=relay", peers[0].Metadata)
+	}
+}
+
+func TestDiscoveredPeerInterface(t *testing.T) {
+	d := openDiscovery(t)
+	d.Start()
+	t.Cleanup(d.Stop)
+	peers := waitForPeers(t, d)
+	if peers[0].Interface == "" {
+		t.Fatalf("discovered peer %+v has no interface", peers[0])
+	}
+}
@@ -0,0 +1,43 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import "time"
+
+// DrainingReason is the goodbye reason a draining server sends a client
+// whose connection has no handshake to carry the news (see SetDraining).
+const DrainingReason = "server draining"
+
+// SetDraining makes a server peer turn away the clients it accepts from now
+// on, while it finishes with the ones it has, so that clients behind a load
+// balancer or discovery move on to another server instead of connecting to
+// one about to go away. Clients keep being accepted, so keep Accept or
+// AcceptClients running, but are closed straight after their handshake:
+// with WithTLS, WithNoiseKey, WithIdentity, WithAuthToken or WithWebSocket
+// the handshake tells the client, whose OpenPeer fails with
+// ErrServerDraining; without one the client connects but is sent a goodbye
+// with DrainingReason, reported by its GoodbyeReason, and then end-of-file.
+// Clients already accepted are not affected. SetDraining(false) accepts
+// clients again.
+func (p *Peer) SetDraining(draining bool) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	d := C.int(0)
+	if draining {
+		d = 1
+	}
+	C.relay_set_draining(p.ptr, d)
+}
+
+// DrainAndClose shuts a server peer down without surprising new clients: it
+// turns them away as SetDraining does and then closes the peer with
+// CloseGracefully, waiting up to timeout for the clients already accepted
+// to close. It returns what CloseGracefully returns.
+func (p *Peer) DrainAndClose(timeout time.Duration) error {
+	p.SetDraining(true)
+	return p.CloseGracefully(timeout)
+}
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptAll accepts clients on server until the test ends.
+func acceptAll(t *testing.T, server *Peer) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		server.StopAccepting()
+		<-done
+	})
+}
+
+func TestDrainingHandshake(t *testing.T) {
+	auth := WithAuthToken("secret")
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1, auth)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	acceptAll(t, server)
+
+	server.SetDraining(true)
+	start := time.Now()
+	if _, err := OpenPeer("client", "127.0.0.1", port, 0, auth); !errors.Is(err, ErrServerDraining) {
+		t.Fatalf("OpenPeer to draining server = %v, want ErrServerDraining", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("draining server took %v to turn the client away", d)
+	}
+
+	server.SetDraining(false)
+	client, err := OpenPeer("client", "127.0.0.1", port, 0, auth)
+	if err != nil {
+		t.Fatalf("OpenPeer after draining ended: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	for server.AcceptedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+}
+
+func TestDrainingPlaintextGoodbye(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	server.SetDraining(true)
+	acceptAll(t, server)
+
+	client, err := OpenPeer("client", "127.0.0.1", port, 0)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	if _, err := client.ReceiveWithTimeout(2 * time.Second); err == nil {
+		t.Fatal("Receive from draining server succeeded")
+	}
+	if reason := client.GoodbyeReason(); reason != DrainingReason {
+		t.Fatalf("GoodbyeReason = %q, want %q", reason, DrainingReason)
+	}
+}
@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// sealedPrefix starts every message made by Seal, so relays and receivers
+// can tell sealed messages from plaintext ones.
+const sealedPrefix = "relay-e2e1:"
+
+// relayedMarker is put in front of every text message a PeerManager relays.
+const relayedMarker = "[Relayed] "
+
+// sealInfo binds the derived keys to this use.
+const sealInfo = "relay end-to-end v1"
+
+// Seal encrypts message to the holder of the X25519 key to, so that it can
+// be relayed through peer managers that only learn its source and target
+// IDs. Only OpenSealed with the matching private key, or a peer created
+// with WithE2EKey, can read it. Each message is encrypted with AES-256-GCM
+// under a key agreed with a fresh ephemeral X25519 key, and the result is
+// text, so it can be passed to Send and Relay like any other message.
+// Sealing hides the content, not the size, of a message.
+func Seal(to *ecdh.PublicKey, message string) (string, error) {
+	if to == nil || to.Curve() != ecdh.X25519() {
+		return "", ErrConfigureFailed
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(to)
+	if err != nil {
+		return "", err
+	}
+	aead, err := sealCipher(shared, ephemeral.PublicKey(), to)
+	if err != nil {
+		return "", err
+	}
+	// The key is never reused, so a fixed nonce is safe.
+	nonce := make([]byte, aead.NonceSize())
+	data := aead.Seal(ephemeral.PublicKey().Bytes(), nonce, []byte(message), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// OpenSealed decrypts a message made by Seal for the public key of key. A
+// message received through Relay keeps the "[Relayed] " marker each manager
+// on the way put in front of it. It returns ErrNotSealed if message was not
+// made by Seal and ErrOpenFailed if it was sealed to another key or altered
+// on the way.
+func OpenSealed(key *ecdh.PrivateKey, message string) (string, error) {
+	if !IsSealed(message) {
+		return "", ErrNotSealed
+	}
+	markers, message := splitRelayed(message)
+	data, err := base64.RawStdEncoding.DecodeString(message[len(sealedPrefix):])
+	if err != nil || len(data) < 32 {
+		return "", ErrOpenFailed
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return "", ErrOpenFailed
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", ErrOpenFailed
+	}
+	aead, err := sealCipher(shared, ephemeral, key.PublicKey())
+	if err != nil {
+		return "", ErrOpenFailed
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), data[32:], nil)
+	if err != nil {
+		return "", ErrOpenFailed
+	}
+	return markers + string(plaintext), nil
+}
+
+// IsSealed reports whether message was made by Seal, including once
+// relayed.
+func IsSealed(message string) bool {
+	_, message = splitRelayed(message)
+	return strings.HasPrefix(message, sealedPrefix)
+}
+
+// splitRelayed splits the relayed markers off the front of message.
+func splitRelayed(message string) (markers, rest string) {
+	rest = message
+	for strings.HasPrefix(rest, relayedMarker) {
+		rest = rest[len(relayedMarker):]
+	}
+	return message[:len(message)-len(rest)], rest
+}
+
+// sealCipher returns the AEAD for a message from the ephemeral key to the
+// recipient key, given the secret shared between them.
+func sealCipher(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	// HKDF-SHA256 (RFC 5869) with both public keys as the salt; one block
+	// of output is the AES-256 key.
+	extract := hmac.New(sha256.New, append(ephemeral.Bytes(), recipient.Bytes()...))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(sealInfo))
+	expand.Write([]byte{1})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WithE2EKey makes the peer open messages sealed to key's public key (see
+// Seal) as it receives them, so Receive, Messages and OnMessage return the
+// plaintext. Sealed messages it cannot open, for example because they were
+// sealed to another key, are dropped; plaintext messages are returned as
+// they are. It only takes effect when the peer is created.
+func WithE2EKey(key *ecdh.PrivateKey) PeerOption {
+	return func(c *peerConfig) { c.e2eKey = key }
+}
+
+// SendSealed seals message to the key to and sends it, like Send. Errors
+// are reported as for Send, and as for Seal if to is not an X25519 key.
+func (p *Peer) SendSealed(to *ecdh.PublicKey, message string) error {
+	sealed, err := Seal(to, message)
+	if err != nil {
+		return err
+	}
+	return p.Send(sealed)
+}
+
+// openReceived opens message if the peer has an E2E key and message is
+// sealed. It reports false for a sealed message that cannot be opened.
+func (p *Peer) openReceived(message []byte) ([]byte, bool) {
+	if p.e2eKey == nil || !IsSealed(string(message)) {
+		return message, true
+	}
+	plaintext, err := OpenSealed(p.e2eKey, string(message))
+	if err != nil {
+		return nil, false
+	}
+	return []byte(plaintext), true
+}
+
+// SetPeerKey sets the X25519 key RelaySealed seals messages for the peer
+// with the given ID to, or with a nil key forgets it. Keys are kept until
+// the peer is removed.
+func (m *PeerManager) SetPeerKey(id string, key *ecdh.PublicKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key == nil {
+		delete(m.sealKeys, id)
+		return
+	}
+	if m.sealKeys == nil {
+		m.sealKeys = make(map[string]*ecdh.PublicKey)
+	}
+	m.sealKeys[id] = key
+}
+
+// RelaySealed seals message to the key set for targetId with SetPeerKey and
+// relays it like Relay, so managers further along the way, and the relay
+// transform, only see the target's ciphertext. It returns ErrNoPeerKey if no
+// key is set for targetId; other errors are as for Relay.
+func (m *PeerManager) RelaySealed(sourceId, targetId, message string) error {
+	m.mu.RLock()
+	key := m.sealKeys[targetId]
+	m.mu.RUnlock()
+	if key == nil {
+		return ErrNoPeerKey
+	}
+	sealed, err := Seal(key, message)
+	if err != nil {
+		return err
+	}
+	return m.Relay(sourceId, targetId, sealed)
+}
+
+// RequireSealedRelays turns end-to-end mode on or off. In end-to-end mode
+// Relay refuses messages that were not made by Seal, returning
+// ErrNotSealed, so the manager never forwards content it can read.
+func (m *PeerManager) RequireSealedRelays(required bool) {
+	m.sealedOnly.Store(required)
+}
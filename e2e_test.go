@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	sealed, err := Seal(key.PublicKey(), "secret")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) || IsSealed("secret") {
+		t.Fatal("IsSealed does not tell sealed from plain messages")
+	}
+	if got, err := OpenSealed(key, sealed); err != nil || got != "secret" {
+		t.Fatalf("OpenSealed = %q, %v, want %q", got, err, "secret")
+	}
+	if _, err := OpenSealed(other, sealed); !errors.Is(err, ErrOpenFailed) {
+		t.Fatalf("OpenSealed with the wrong key: %v, want ErrOpenFailed", err)
+	}
+}
+
+func TestRelaySealed(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	_, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.RequireSealedRelays(true)
+
+	if err := m.Relay("a", "b", "plain"); !errors.Is(err, ErrNotSealed) {
+		t.Fatalf("Relay of a plain message: %v, want ErrNotSealed", err)
+	}
+	if err := m.RelaySealed("a", "b", "secret"); !errors.Is(err, ErrNoPeerKey) {
+		t.Fatalf("RelaySealed without a key: %v, want ErrNoPeerKey", err)
+	}
+	m.SetPeerKey("b", key.PublicKey())
+	if err := m.RelaySealed("a", "b", "secret"); err != nil {
+		t.Fatalf("RelaySealed: %v", err)
+	}
+	sealed := receive(t, serverB)
+	if got, err := OpenSealed(key, sealed); err != nil || got != "[Relayed] secret" {
+		t.Fatalf("relayed message opened as %q, %v, want %q", got, err, "[Relayed] secret")
+	}
+}
+
+func TestWithE2EKey(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	server, client, _ := openPair(t, []PeerOption{WithE2EKey(key)}, nil)
+	if err := client.SendSealed(other.PublicKey(), "not for you"); err != nil {
+		t.Fatalf("SendSealed: %v", err)
+	}
+	if err := client.SendSealed(key.PublicKey(), "for you"); err != nil {
+		t.Fatalf("SendSealed: %v", err)
+	}
+	if got := receive(t, server); got != "for you" {
+		t.Fatalf("got %q, want the message sealed to the peer's key opened", got)
+	}
+}
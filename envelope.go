@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// envelopeMagic starts every encoded envelope. Its leading NUL keeps it
+// from matching a message sent with Send, which cannot contain NUL bytes.
+const envelopeMagic = "\x00RE1"
+
+// SendEnvelope sends m, with its metadata and headers, as one binary
+// message that the other end decodes with ReceiveEnvelope or
+// Message.UnmarshalBinary. An empty ID is replaced by a random one and a
+// zero Time by the current time. It returns ErrMessageExpired for a
+// message whose Expires has passed. Errors are reported as for Send.
+func (p *Peer) SendEnvelope(m Message) error {
+	if m.Expired() {
+		return ErrMessageExpired
+	}
+	if m.ID == "" {
+		m.ID = NewMessageID()
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return p.SendBytes(data)
+}
+
+// ReceiveEnvelope receives a message sent with SendEnvelope and decodes
+// it, setting an empty Source to the peer's ID as Messages does. It returns ErrInvalidEnvelope, dropping the message, if the message
+// received is not an envelope, and otherwise reports errors as for
+// Receive.
+func (p *Peer) ReceiveEnvelope() (Message, error) {
+	data, err := p.ReceiveBytes()
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	if err := m.UnmarshalBinary(data); err != nil {
+		return Message{}, err
+	}
+	if m.Source == "" {
+		m.Source = p.id
+	}
+	return m, nil
+}
+
+// NewMessageID returns a random 128-bit message ID in hex.
+func NewMessageID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// IsEnvelope reports whether data holds a message encoded as an envelope,
+// such as the Payload of a Message from Messages or OnMessage that was sent
+// with SendEnvelope.
+func IsEnvelope(data []byte) bool {
+	return len(data) >= len(envelopeMagic) && string(data[:len(envelopeMagic)]) == envelopeMagic
+}
+
+// MarshalBinary encodes m as an envelope: the magic bytes, then the ID,
+// Source, Target and ContentType as length-prefixed strings, the Time and
+// Expires in Unix nanoseconds, the Headers in key order and finally the
+// Payload, so an empty message costs a few bytes of overhead.
+func (m Message) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, len(envelopeMagic)+len(m.ID)+len(m.Source)+len(m.Target)+len(m.ContentType)+len(m.Payload)+32)
+	b = append(b, envelopeMagic...)
+	for _, s := range []string{m.ID, m.Source, m.Target, m.ContentType} {
+		b = appendEnvelopeString(b, s)
+	}
+	b = binary.AppendVarint(b, unixNanos(m.Time))
+	b = binary.AppendVarint(b, unixNanos(m.Expires))
+
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendEnvelopeString(b, k)
+		b = appendEnvelopeString(b, m.Headers[k])
+	}
+	return append(b, m.Payload...), nil
+}
+
+// UnmarshalBinary decodes an envelope encoded by MarshalBinary into m,
+// replacing all its fields. It returns ErrInvalidEnvelope if data is not
+// a well-formed envelope.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if !IsEnvelope(data) {
+		return ErrInvalidEnvelope
+	}
+	d := envelopeDecoder{data: data[len(envelopeMagic):]}
+	var decoded Message
+	decoded.ID = d.string()
+	decoded.Source = d.string()
+	decoded.Target = d.string()
+	decoded.ContentType = d.string()
+	decoded.Time = fromUnixNanos(d.varint())
+	decoded.Expires = fromUnixNanos(d.varint())
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		// Each header takes at least two bytes.
+		return ErrInvalidEnvelope
+	}
+	if n > 0 {
+		decoded.Headers = make(map[string]string, n)
+	}
+	for ; n > 0 && !d.bad; n-- {
+		k := d.string()
+		decoded.Headers[k] = d.string()
+	}
+	if d.bad {
+		return ErrInvalidEnvelope
+	}
+	decoded.Payload = append([]byte(nil), d.data...)
+	*m = decoded
+	return nil
+}
+
+// unixNanos returns t in Unix nanoseconds, 0 for the zero time.
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNanos reverses unixNanos.
+func fromUnixNanos(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// envelopeExpires returns the Expires of the envelope in data without
+// decoding the rest, and false if data is not an envelope.
+func envelopeExpires(data []byte) (time.Time, bool) {
+	if !IsEnvelope(data) {
+		return time.Time{}, false
+	}
+	d := envelopeDecoder{data: data[len(envelopeMagic):]}
+	for i := 0; i < 4; i++ {
+		d.string()
+	}
+	d.varint()
+	expires := fromUnixNanos(d.varint())
+	return expires, !d.bad
+}
+
+func appendEnvelopeString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// envelopeDecoder reads the fields of an envelope in order. Once one is
+// malformed, bad is set and the rest read as zero values.
+type envelopeDecoder struct {
+	data []byte
+	bad  bool
+}
+
+func (d *envelopeDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.bad = true
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *envelopeDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.bad = true
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *envelopeDecoder) string() string {
+	n := d.uvarint()
+	if d.bad || n > uint64(len(d.data)) {
+		d.bad = true
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
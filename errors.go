@@ -0,0 +1,284 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import "errors"
+
+var (
+	// ErrSendFailed is returned when a message could not be sent and the C
+	// library reported no more specific reason.
+	ErrSendFailed = errors.New("relay: send failed")
+
+	// ErrCircuitOpen is returned when a send is rejected because the peer's
+	// circuit breaker is open. See Peer.SetCircuitBreaker.
+	ErrCircuitOpen = errors.New("relay: circuit open")
+
+	// ErrConfigureFailed is returned when a socket setting could not be
+	// applied to a peer.
+	ErrConfigureFailed = errors.New("relay: failed to configure peer")
+
+	// ErrReconnectFailed is returned when a peer could not establish the new
+	// connection a configuration change required.
+	ErrReconnectFailed = errors.New("relay: failed to reconnect peer")
+
+	// ErrConnectFailed is returned when a new peer connection could not be
+	// established.
+	ErrConnectFailed = errors.New("relay: failed to connect to peer")
+
+	// ErrConnectionRefused is returned by OpenPeer when nothing is listening
+	// at the address a client peer connects to.
+	ErrConnectionRefused = errors.New("relay: connection refused")
+
+	// ErrAddressInUse is returned by OpenPeer when the address a server peer
+	// listens on, or a client peer's local address, is already taken.
+	ErrAddressInUse = errors.New("relay: address in use")
+
+	// ErrInvalidAddress is returned by OpenPeer when an IP address cannot be
+	// parsed.
+	ErrInvalidAddress = errors.New("relay: invalid address")
+
+	// ErrServerDraining is returned by OpenPeer when the server said in
+	// the connection handshake that it is draining for shutdown (see
+	// Peer.SetDraining), so the client should pick another server.
+	ErrServerDraining = errors.New("relay: server draining")
+
+	// ErrHandshakeFailed is returned by OpenPeer when the TLS or Noise
+	// handshake with the server failed, for example because its certificate
+	// was not trusted or its Noise key is not pinned. For TLS the error
+	// wraps ErrHandshakeFailed and says what was wrong with the certificate
+	// when that is why. See WithTLS and WithNoiseKey.
+	ErrHandshakeFailed = errors.New("relay: handshake failed")
+
+	// ErrNotEncrypted is returned by RotateKeys when a connection has no
+	// session keys to rotate: it runs neither TLS 1.3 nor Noise.
+	ErrNotEncrypted = errors.New("relay: connection not encrypted")
+
+	// ErrUnauthenticated is returned by Relay when the manager requires
+	// authenticated peers and the source peer is not, and by Add for such
+	// a peer. See PeerManager.RequireAuthenticatedRelays and
+	// PeerManager.RequireAuthenticatedPeers.
+	ErrUnauthenticated = errors.New("relay: peer not authenticated")
+
+	// ErrAccessDenied is returned by PeerManager.Add and Relay when the
+	// manager's access control refuses a peer, and reported by
+	// OnConnectionRejected for refused clients. See PeerManager.Allow.
+	ErrAccessDenied = errors.New("relay: access denied")
+
+	// ErrNotSealed is returned by OpenSealed for a message Seal did not
+	// make, and by Relay in end-to-end mode for such a message. See
+	// PeerManager.RequireSealedRelays.
+	ErrNotSealed = errors.New("relay: message not sealed")
+
+	// ErrOpenFailed is returned by OpenSealed when a sealed message was
+	// sealed to another key or altered on the way.
+	ErrOpenFailed = errors.New("relay: cannot open sealed message")
+
+	// ErrNoPeerKey is returned by RelaySealed when no key is set for the
+	// target peer. See PeerManager.SetPeerKey.
+	ErrNoPeerKey = errors.New("relay: no key for peer")
+
+	// ErrTimeout is returned when an operation did not finish in time, such
+	// as a graceful close whose remote end did not close its side of the
+	// connection.
+	ErrTimeout = errors.New("relay: operation timed out")
+
+	// ErrPathMTUUnavailable is returned by Peer.PathMTU when the path MTU
+	// cannot be determined.
+	ErrPathMTUUnavailable = errors.New("relay: path MTU unavailable")
+
+	// ErrBufferSizesUnavailable is returned by Peer.BufferSizes when the
+	// socket buffer sizes cannot be read.
+	ErrBufferSizesUnavailable = errors.New("relay: buffer sizes unavailable")
+
+	// ErrRelayFailed is returned when a message could not be relayed and the
+	// C library reported no more specific reason.
+	ErrRelayFailed = errors.New("relay: message relay failed")
+
+	// ErrRelayDenied is returned when a relay rule forbids the source peer
+	// from sending to the target peer.
+	ErrRelayDenied = errors.New("relay: relay denied by rule")
+
+	// ErrRelayDropped is returned by Relay when the relay transform drops the
+	// message. See PeerManager.SetRelayTransform.
+	ErrRelayDropped = errors.New("relay: message dropped by relay transform")
+
+	// ErrPeerNotFound is returned when a peer ID is not known to the manager.
+	ErrPeerNotFound = errors.New("relay: peer not found")
+
+	// ErrPeerDisconnected is returned when a message could not be delivered
+	// because the target peer's connection is closed.
+	ErrPeerDisconnected = errors.New("relay: peer disconnected")
+
+	// ErrTemporary is returned when a send failed transiently, for example
+	// because the send buffer was full or the network was briefly
+	// unreachable, and nothing was written, so sending again may succeed.
+	ErrTemporary = errors.New("relay: temporary send failure")
+
+	// ErrReceiveFailed is returned by Peer.Receive when no message was
+	// received and the C library reported no more specific reason, for
+	// example on a read timeout.
+	ErrReceiveFailed = errors.New("relay: receive failed")
+
+	// ErrFrameDesync is returned by Peer.Receive when the connection was
+	// closed because the incoming stream lost track of frame boundaries;
+	// see Peer.SetFrameResync.
+	ErrFrameDesync = errors.New("relay: frame desync")
+
+	// ErrReadIdle is returned by Peer.Receive when nothing arrived within
+	// the peer's read idle timeout. The connection stays open. See
+	// Peer.SetReadIdleTimeout.
+	ErrReadIdle = errors.New("relay: read idle timeout")
+
+	// ErrListenerClosed is returned when a server peer stops accepting
+	// clients because it was closed.
+	ErrListenerClosed = errors.New("relay: listener closed")
+
+	// ErrSendQueueTimeout is passed to the dead-letter handler for a queued
+	// message dropped because it waited longer than the peer's send queue
+	// timeout. See Peer.SetSendQueueTimeout.
+	ErrSendQueueTimeout = errors.New("relay: message expired in send queue")
+
+	// ErrQuiesced is returned by PeerManager methods called after Quiesce.
+	ErrQuiesced = errors.New("relay: manager quiesced")
+
+	// ErrBufferFull is passed to the dead-letter handler for a queued message
+	// discarded because the manager's global buffer limit was reached. See
+	// PeerManager.SetGlobalBufferLimit.
+	ErrBufferFull = errors.New("relay: buffer limit reached")
+
+	// ErrQueueFull is returned by Peer.Enqueue, and passed to the
+	// dead-letter handler for a discarded message, when a peer's send queue
+	// holds as many messages as its limit. See Peer.SetSendQueueLimit.
+	ErrQueueFull = errors.New("relay: queue full")
+
+	// ErrMessageTooLarge is returned, before anything is sent, for a message
+	// over the limit set with WithMaxMessageSize or SetMaxMessageSize.
+	ErrMessageTooLarge = errors.New("relay: message too large")
+
+	// ErrNoGroupPeers is returned by RelayToGroup when no peer in the group
+	// can receive the message.
+	ErrNoGroupPeers = errors.New("relay: no eligible peer in group")
+
+	// ErrMulticastUnavailable is returned by OpenPeerDiscovery when the host
+	// has no multicast-capable network interface or cannot join the
+	// discovery group.
+	ErrMulticastUnavailable = errors.New("relay: multicast unavailable")
+
+	// ErrDiscoveryFailed is returned when peer discovery could not be set up
+	// and the C library reported no more specific reason.
+	ErrDiscoveryFailed = errors.New("relay: failed to start peer discovery")
+
+	// ErrUpstreamClosed is reported by a RelayStream whose source peer
+	// disconnected.
+	ErrUpstreamClosed = errors.New("relay: upstream peer closed")
+
+	// ErrDownstreamClosed is reported by a RelayStream whose target peer
+	// disconnected.
+	ErrDownstreamClosed = errors.New("relay: downstream peer closed")
+
+	// ErrInvalidMetadata is returned by PeerDiscovery.SetAnnouncementMetadata
+	// for an entry it cannot encode or metadata too large to announce.
+	ErrInvalidMetadata = errors.New("relay: invalid announcement metadata")
+
+	// ErrInvalidEnvelope is returned by Peer.ReceiveEnvelope and
+	// Message.UnmarshalBinary for a message that is not a well-formed
+	// envelope.
+	ErrInvalidEnvelope = errors.New("relay: invalid message envelope")
+
+	// ErrMessageExpired is returned by Peer.SendEnvelope and
+	// PeerManager.Relay for an envelope whose expiry time has passed, and
+	// passed to the dead-letter handler with envelopes that expire while
+	// queued to be sent.
+	ErrMessageExpired = errors.New("relay: message expired")
+
+	// ErrCodec is wrapped by the errors Peer.SendEncoded and
+	// Peer.ReceiveDecoded return when a value cannot be encoded or a
+	// message decoded.
+	ErrCodec = errors.New("relay: codec error")
+
+	// ErrRequestFailed is wrapped by the errors Peer.Request returns for an
+	// error from the server's handler, a *RemoteError, or a malformed reply.
+	ErrRequestFailed = errors.New("relay: request failed")
+
+	// ErrUnknownRequest is returned by Peer.Respond and Peer.RespondError
+	// for a correlation ID that names no request waiting for its reply.
+	ErrUnknownRequest = errors.New("relay: unknown correlation ID")
+
+	// ErrStreamOpenFailed is returned by Peer.OpenStream when a stream could
+	// not be opened on a connected peer, for example on a server peer, which
+	// accepts streams with Peer.AcceptStream instead.
+	ErrStreamOpenFailed = errors.New("relay: failed to open stream")
+
+	// ErrStreamClosed is returned by Stream.Send and Stream.Close once the
+	// stream has been closed.
+	ErrStreamClosed = errors.New("relay: stream closed")
+
+	// ErrStreamAborted is returned by the reader from Peer.ReceiveStream when
+	// the sender's reader failed before the end of the data.
+	ErrStreamAborted = errors.New("relay: stream aborted by sender")
+
+	// ErrTransferCanceled is returned by Transfer.Err when either end
+	// canceled a file transfer.
+	ErrTransferCanceled = errors.New("relay: file transfer canceled")
+
+	// ErrChecksumMismatch is returned by Transfer.Err when the file received
+	// does not match the SHA-256 the sender announced.
+	ErrChecksumMismatch = errors.New("relay: file checksum mismatch")
+
+	// ErrTransferRefused is wrapped by the errors Peer.SendFile and
+	// Transfer.Err return when the receiver could not store the file.
+	ErrTransferRefused = errors.New("relay: file transfer refused")
+
+	// ErrNotFileTransfer is returned by Peer.ReceiveFile when the stream a
+	// client opened was not started with Peer.SendFile.
+	ErrNotFileTransfer = errors.New("relay: stream is not a file transfer")
+)
+
+// statusError maps a status code returned by the C library to an error,
+// using fallback for RELAY_ERR_FAILED and any code it does not recognise.
+func statusError(status C.int, fallback error) error {
+	switch status {
+	case C.RELAY_OK:
+		return nil
+	case C.RELAY_ERR_DENIED:
+		return ErrRelayDenied
+	case C.RELAY_ERR_CIRCUIT_OPEN:
+		return ErrCircuitOpen
+	case C.RELAY_ERR_TIMEOUT:
+		return ErrTimeout
+	case C.RELAY_ERR_MULTICAST_UNAVAILABLE:
+		return ErrMulticastUnavailable
+	case C.RELAY_ERR_NOT_FOUND:
+		return ErrPeerNotFound
+	case C.RELAY_ERR_DISCONNECTED:
+		return ErrPeerDisconnected
+	case C.RELAY_ERR_LISTENER_CLOSED:
+		return ErrListenerClosed
+	case C.RELAY_ERR_TEMPORARY:
+		return ErrTemporary
+	case C.RELAY_ERR_FRAME_DESYNC:
+		return ErrFrameDesync
+	case C.RELAY_ERR_READ_IDLE:
+		return ErrReadIdle
+	case C.RELAY_ERR_CONNECTION_REFUSED:
+		return ErrConnectionRefused
+	case C.RELAY_ERR_ADDRESS_IN_USE:
+		return ErrAddressInUse
+	case C.RELAY_ERR_INVALID_ADDRESS:
+		return ErrInvalidAddress
+	case C.RELAY_ERR_HANDSHAKE_FAILED:
+		return ErrHandshakeFailed
+	case C.RELAY_ERR_UNAUTHENTICATED:
+		return ErrUnauthenticated
+	case C.RELAY_ERR_INVALID_CONFIG:
+		return ErrConfigureFailed
+	case C.RELAY_ERR_NOT_ENCRYPTED:
+		return ErrNotEncrypted
+	case C.RELAY_ERR_SERVER_DRAINING:
+		return ErrServerDraining
+	default:
+		return fallback
+	}
+}
@@ -0,0 +1,288 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// eventPollInterval is how often lifecycle events are collected from the C
+// library, and so roughly how late a handler may hear of one.
+const eventPollInterval = 100 * time.Millisecond
+
+// ConnectionEvent describes a connection lifecycle event passed to the
+// handlers registered with OnPeerConnected, OnPeerDisconnected, OnError and
+// OnConnectionRejected.
+type ConnectionEvent struct {
+	PeerID   string // ID of the local peer the connection belongs to
+	ClientID uint64 // The accepted client (see Accept), 0 for a client peer's own connection
+	Addr     string // The remote address as "ip:port"
+
+	// Err says why the connection closed or failed: ErrPeerDisconnected when
+	// the remote end closed it or it dropped, ErrFrameDesync, ErrReadIdle,
+	// ErrTimeout for a retired client that did not close in time (see
+	// SetMaxConnectionAge), ErrSendFailed or ErrReceiveFailed. It is nil for
+	// OnPeerConnected, and ErrAccessDenied for OnConnectionRejected.
+	Err error
+}
+
+// lifecycleHooks holds the lifecycle handlers of a peer or a manager.
+type lifecycleHooks struct {
+	mu           sync.Mutex
+	connected    func(ConnectionEvent)
+	disconnected func(ConnectionEvent)
+	failed       func(ConnectionEvent)
+	rejected     func(ConnectionEvent)
+}
+
+// OnPeerConnected registers fn to be called when a server peer accepts a
+// client, or a client peer reconnects, replacing any handler registered
+// before; a nil fn removes it. Handlers run on a goroutine shared by every
+// peer and should return quickly. Events are collected every 100ms, so a
+// handler may run somewhat after the fact.
+func (p *Peer) OnPeerConnected(fn func(ConnectionEvent)) {
+	p.hooks.set(&p.hooks.connected, fn)
+	p.watchEvents()
+}
+
+// OnPeerDisconnected registers fn to be called when one of the peer's
+// connections closes without the application closing it, replacing any
+// handler registered before; a nil fn removes it. A closed connection is
+// only noticed when the peer reads from or writes to it, for example in
+// Receive, Messages or OnMessage. Handlers run as for OnPeerConnected.
+func (p *Peer) OnPeerDisconnected(fn func(ConnectionEvent)) {
+	p.hooks.set(&p.hooks.disconnected, fn)
+	p.watchEvents()
+}
+
+// OnError registers fn to be called when sending or receiving on one of
+// the peer's connections fails, replacing any handler registered before; a
+// nil fn removes it. The event's Err says what failed. An error that also
+// closes the connection is followed by an OnPeerDisconnected event.
+// Handlers run as for OnPeerConnected.
+func (p *Peer) OnError(fn func(ConnectionEvent)) {
+	p.hooks.set(&p.hooks.failed, fn)
+	p.watchEvents()
+}
+
+// OnConnectionRejected registers fn to be called when the server peer
+// closes a client its manager's access control refuses, right after the
+// client's handshake, replacing any handler registered before; a nil fn
+// removes it. The event's ClientID is 0, since the client was never
+// accepted. Handlers run as for OnPeerConnected.
+func (p *Peer) OnConnectionRejected(fn func(ConnectionEvent)) {
+	p.hooks.set(&p.hooks.rejected, fn)
+	p.watchEvents()
+}
+
+// OnPeerConnected registers fn to be called when any managed peer, present
+// or added later, reports a connection as described for
+// Peer.OnPeerConnected. It runs after the peer's own handler, if any.
+func (m *PeerManager) OnPeerConnected(fn func(ConnectionEvent)) {
+	m.hooks.set(&m.hooks.connected, fn)
+	m.watchEvents()
+}
+
+// OnPeerDisconnected registers fn to be called when any managed peer
+// reports a closed connection as described for Peer.OnPeerDisconnected. It
+// runs after the peer's own handler, if any.
+func (m *PeerManager) OnPeerDisconnected(fn func(ConnectionEvent)) {
+	m.hooks.set(&m.hooks.disconnected, fn)
+	m.watchEvents()
+}
+
+// OnError registers fn to be called when any managed peer reports an error
+// as described for Peer.OnError. It runs after the peer's own handler, if
+// any.
+func (m *PeerManager) OnError(fn func(ConnectionEvent)) {
+	m.hooks.set(&m.hooks.failed, fn)
+	m.watchEvents()
+}
+
+// OnConnectionRejected registers fn to be called when any managed server
+// peer refuses a client as described for Peer.OnConnectionRejected. It runs
+// after the peer's own handler, if any.
+func (m *PeerManager) OnConnectionRejected(fn func(ConnectionEvent)) {
+	m.hooks.set(&m.hooks.rejected, fn)
+	m.watchEvents()
+}
+
+// set replaces the handler in slot.
+func (h *lifecycleHooks) set(slot *func(ConnectionEvent), fn func(ConnectionEvent)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*slot = fn
+}
+
+// any reports whether any handler is registered.
+func (h *lifecycleHooks) any() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected != nil || h.disconnected != nil || h.failed != nil || h.rejected != nil
+}
+
+// handle passes e to the handler for kind, if one is registered.
+func (h *lifecycleHooks) handle(kind C.int, e ConnectionEvent) {
+	h.mu.Lock()
+	var fn func(ConnectionEvent)
+	switch kind {
+	case C.RELAY_EVENT_CONNECTED:
+		fn = h.connected
+	case C.RELAY_EVENT_DISCONNECTED:
+		fn = h.disconnected
+	case C.RELAY_EVENT_ERROR:
+		fn = h.failed
+	case C.RELAY_EVENT_REJECTED:
+		fn = h.rejected
+	}
+	h.mu.Unlock()
+	if fn != nil {
+		fn(e)
+	}
+}
+
+// watchEvents starts or stops collecting the peer's lifecycle events,
+// depending on whether it or its manager has a handler.
+func (p *Peer) watchEvents() {
+	m := p.mgr.Load()
+	events.watch(p, p.hooks.any() || (m != nil && m.hooks.any()))
+}
+
+// watchEvents updates event collection for every managed peer.
+func (m *PeerManager) watchEvents() {
+	m.mu.RLock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	m.mu.RUnlock()
+	for _, p := range peers {
+		p.watchEvents()
+	}
+}
+
+// eventPoller collects the lifecycle events of every watched peer on one
+// goroutine, which runs while any peer is watched.
+type eventPoller struct {
+	mu      sync.Mutex
+	peers   map[*Peer]struct{}
+	running bool
+}
+
+// events is the process-wide event poller.
+var events eventPoller
+
+// watch starts or stops collecting p's events.
+func (e *eventPoller) watch(p *Peer, enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.peers[p]; ok == enabled {
+		return
+	}
+	if !enabled {
+		delete(e.peers, p)
+		if p.enter() {
+			C.relay_set_peer_events(p.ptr, 0)
+			p.leave()
+		}
+		return
+	}
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	if e.peers == nil {
+		e.peers = make(map[*Peer]struct{})
+	}
+	e.peers[p] = struct{}{}
+	C.relay_set_peer_events(p.ptr, 1)
+	if !e.running {
+		e.running = true
+		spawn(e.run)
+	}
+}
+
+// peerEvent is an event taken from the C library, waiting to be handled.
+type peerEvent struct {
+	peer *Peer
+	kind C.int
+	ConnectionEvent
+}
+
+// run collects and handles events until no peer is watched.
+func (e *eventPoller) run() {
+	for {
+		time.Sleep(eventPollInterval)
+		e.mu.Lock()
+		if len(e.peers) == 0 {
+			e.running = false
+			e.mu.Unlock()
+			return
+		}
+		// Taken while holding mu, so watch(p, false) returns only once p is no
+		// longer being read and can be destroyed.
+		var taken []peerEvent
+		for p := range e.peers {
+			taken = append(taken, takeEvents(p)...)
+		}
+		e.mu.Unlock()
+
+		for _, ev := range taken {
+			ev.peer.hooks.handle(ev.kind, ev.ConnectionEvent)
+			if m := ev.peer.mgr.Load(); m != nil {
+				m.hooks.handle(ev.kind, ev.ConnectionEvent)
+			}
+		}
+	}
+}
+
+// takeEvents returns the events recorded for p since the last call.
+func takeEvents(p *Peer) []peerEvent {
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	var list *C.RelayPeerEvent
+	var count C.int
+	if C.relay_take_peer_events(p.ptr, &list, &count) != C.RELAY_OK || count == 0 {
+		return nil
+	}
+	defer C.relay_free_peer_events(list, count)
+	taken := make([]peerEvent, 0, int(count))
+	for _, ev := range unsafe.Slice(list, int(count)) {
+		taken = append(taken, peerEvent{peer: p, kind: ev.kind, ConnectionEvent: ConnectionEvent{
+			PeerID:   p.id,
+			ClientID: uint64(ev.clientId),
+			Addr:     C.GoString(ev.address),
+			Err:      eventError(ev.reason),
+		}})
+	}
+	return taken
+}
+
+// eventError maps the reason for an event to an error.
+func eventError(reason C.int) error {
+	switch reason {
+	case C.RELAY_EVENT_REASON_NONE:
+		return nil
+	case C.RELAY_EVENT_REASON_DESYNC:
+		return ErrFrameDesync
+	case C.RELAY_EVENT_REASON_IDLE:
+		return ErrReadIdle
+	case C.RELAY_EVENT_REASON_EXPIRED:
+		return ErrTimeout
+	case C.RELAY_EVENT_REASON_SEND_FAILED:
+		return ErrSendFailed
+	case C.RELAY_EVENT_REASON_RECEIVE_FAILED:
+		return ErrReceiveFailed
+	case C.RELAY_EVENT_REASON_DENIED:
+		return ErrAccessDenied
+	default:
+		return ErrPeerDisconnected
+	}
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// event returns the next event on ch, failing the test if none arrives.
+func event(t *testing.T, ch <-chan ConnectionEvent) ConnectionEvent {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return ConnectionEvent{}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	connected := make(chan ConnectionEvent, 1)
+	disconnected := make(chan ConnectionEvent, 1)
+	server.OnPeerConnected(func(e ConnectionEvent) { connected <- e })
+	server.OnPeerDisconnected(func(e ConnectionEvent) { disconnected <- e })
+	acceptAll(t, server)
+
+	client, err := OpenPeer("client", "127.0.0.1", server.LocalAddr().(*net.TCPAddr).Port, 0)
+	if err != nil {
+		t.Fatalf("OpenPeer client: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	e := event(t, connected)
+	if e.PeerID != "server" || e.ClientID == 0 || e.Err != nil {
+		t.Fatalf("connected event = %+v", e)
+	}
+
+	client.Close()
+	// The disconnect is noticed by a receive.
+	server.TryReceive()
+	server.Receive()
+	d := event(t, disconnected)
+	if d.ClientID != e.ClientID || !errors.Is(d.Err, ErrPeerDisconnected) {
+		t.Fatalf("disconnected event = %+v, want client %d with ErrPeerDisconnected", d, e.ClientID)
+	}
+}
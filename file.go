@@ -0,0 +1,487 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileStreamName names the streams SendFile opens.
+const fileStreamName = "relay-file"
+
+// fileHeaderPrefix starts the first message of a file transfer, which goes
+// on with the file's size, its SHA-256 in hex and its name.
+const fileHeaderPrefix = "relay-file1 "
+
+// Replies the receiver of a file sends on the stream: the offset to resume
+// from after the header, then one of the others once the transfer ends.
+const (
+	fileOffsetReply   = "offset "
+	fileDoneReply     = "done"
+	fileCanceledReply = "canceled"
+	fileErrorReply    = "error "
+)
+
+// Transfer is a file transfer started by Peer.SendFile or Peer.ReceiveFile.
+// It runs in the background until Done is closed, and can be paused,
+// resumed and canceled from either end. A Transfer is safe for concurrent
+// use.
+type Transfer struct {
+	name    string
+	path    string
+	size    int64
+	offset  int64
+	sum     string
+	sending bool
+	stream  *Stream
+	meter   *progressMeter
+
+	mu        sync.Mutex
+	cond      sync.Cond
+	paused    bool
+	canceled  bool
+	err       error
+	done      chan struct{}
+	abortOnce sync.Once
+}
+
+// SendFile sends the file at path to the server, which stores it with
+// ReceiveFile. It reads the whole file once to compute its SHA-256, then
+// announces its name, size and checksum and returns once the receiver has
+// replied with how much of it it already holds from an earlier attempt;
+// the rest is sent in the background in messages of up to 64 KiB over a
+// stream of its own (see OpenNamedStream). Like OpenStream it is only for
+// client peers.
+//
+// The returned Transfer reports the outcome: nil once the receiver has
+// verified and stored the file, ErrChecksumMismatch if the data it got did
+// not match, or ErrTransferCanceled if either end canceled. An interrupted
+// or canceled transfer of the same file resumes where it stopped the next
+// time it is sent to the same directory.
+func (p *Peer) SendFile(path string) (*Transfer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := p.startSend(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	spawn(func() {
+		t.finish(t.send(f))
+		f.Close()
+	})
+	return t, nil
+}
+
+// startSend hashes f, announces it and seeks f to the offset the receiver
+// replies with.
+func (p *Peer) startSend(f *os.File) (*Transfer, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("relay: %s is not a regular file", f.Name())
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	s, err := p.OpenNamedStream(fileStreamName)
+	if err != nil {
+		return nil, err
+	}
+	t := newTransfer(filepath.Base(f.Name()), f.Name(), info.Size(), s)
+	t.sum = hex.EncodeToString(h.Sum(nil))
+	t.sending = true
+
+	err = s.Send(fmt.Sprintf("%s%d %s %s", fileHeaderPrefix, t.size, t.sum, t.name))
+	if err == nil {
+		var reply string
+		if reply, err = s.Receive(); err == nil {
+			t.offset, err = parseOffsetReply(reply)
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(t.offset, io.SeekStart)
+	}
+	if err != nil {
+		t.abort()
+		return nil, err
+	}
+	t.meter = newProgressMeter(t.offset, t.size, nil)
+	return t, nil
+}
+
+// send sends the rest of f and waits for the receiver's verdict.
+func (t *Transfer) send(f *os.File) error {
+	verdict := make(chan error, 1)
+	spawn(func() {
+		reply, err := t.stream.Receive()
+		if err == nil {
+			err = replyError(reply)
+		}
+		if err == ErrTransferCanceled {
+			t.Cancel()
+		}
+		verdict <- err
+	})
+
+	buf := make([]byte, transferChunk)
+	for {
+		if err := t.wait(); err != nil {
+			return err
+		}
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if err := t.stream.Send(string(buf[:n])); err != nil {
+				if t.isCanceled() {
+					return ErrTransferCanceled
+				}
+				return err
+			}
+			t.meter.add(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			t.abort()
+			return readErr
+		}
+	}
+	if err := t.stream.Close(); err != nil {
+		if t.isCanceled() {
+			return ErrTransferCanceled
+		}
+		return err
+	}
+	return <-verdict
+}
+
+// ReceiveFile waits for a client to start a transfer with SendFile and
+// stores the file in dir under the name it was sent with. Data arrives in
+// a hidden ".part" file beside it, which is renamed into place once its
+// SHA-256 matches the sender's; if the transfer is interrupted or canceled
+// the part file is kept, and the next transfer of the same file picks up
+// where it stopped. ReceiveFile returns once it has told the sender where
+// to resume from; the Transfer reports the outcome.
+//
+// It takes the next stream a client opens, so do not mix it with
+// AcceptStream or ReceiveStream on the same peer; a stream not started
+// with SendFile is discarded and ErrNotFileTransfer returned. It returns
+// ErrPeerDisconnected once the peer is closed.
+func (p *Peer) ReceiveFile(dir string) (*Transfer, error) {
+	s, err := p.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	header, err := s.Receive()
+	if err != nil {
+		drainStream(s)
+		s.Close()
+		return nil, err
+	}
+	t, ok := parseFileHeader(header, s)
+	if !ok || s.Name() != fileStreamName {
+		refuse(s, "not a file transfer")
+		return nil, ErrNotFileTransfer
+	}
+	t.path = filepath.Join(dir, t.name)
+	part := filepath.Join(dir, "."+t.name+"."+t.sum[:16]+".part")
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		refuse(s, err.Error())
+		return nil, err
+	}
+	// Resume after what an earlier attempt stored, hashing it again.
+	h := sha256.New()
+	t.offset, err = io.Copy(h, f)
+	if err == nil && t.offset > t.size {
+		h.Reset()
+		t.offset = 0
+		if err = f.Truncate(0); err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err == nil {
+		err = s.Send(fileOffsetReply + strconv.FormatInt(t.offset, 10))
+	}
+	if err != nil {
+		f.Close()
+		refuse(s, err.Error())
+		return nil, err
+	}
+	t.meter = newProgressMeter(t.offset, t.size, nil)
+	spawn(func() {
+		err := t.receive(f, h, part)
+		if err != nil {
+			drainStream(s)
+			s.Close()
+		}
+		t.finish(err)
+	})
+	return t, nil
+}
+
+// receive writes the data of the transfer to f, then verifies it and moves
+// part into place.
+func (t *Transfer) receive(f *os.File, h hash.Hash, part string) error {
+	written := t.offset
+	for {
+		if err := t.wait(); err != nil {
+			f.Close()
+			return err
+		}
+		data, err := t.stream.Receive()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && data == "" {
+			// An empty message marks the transfer aborted by the sender.
+			err = ErrTransferCanceled
+		}
+		if err == nil && written+int64(len(data)) > t.size {
+			err = ErrChecksumMismatch
+		}
+		if err == nil {
+			_, err = f.WriteString(data)
+		}
+		if err != nil {
+			f.Close()
+			if err == ErrChecksumMismatch {
+				os.Remove(part)
+				t.stream.Send(fileErrorReply + err.Error())
+			}
+			return err
+		}
+		h.Write([]byte(data))
+		written += int64(len(data))
+		t.meter.add(len(data))
+	}
+
+	err := f.Close()
+	if err == nil && (written != t.size || hex.EncodeToString(h.Sum(nil)) != t.sum) {
+		os.Remove(part)
+		err = ErrChecksumMismatch
+	}
+	if err == nil {
+		err = os.Rename(part, t.path)
+	}
+	if err != nil {
+		t.stream.Send(fileErrorReply + err.Error())
+		t.stream.Close()
+		return err
+	}
+	if err := t.stream.Send(fileDoneReply); err != nil {
+		return err
+	}
+	return t.stream.Close()
+}
+
+func newTransfer(name, path string, size int64, s *Stream) *Transfer {
+	t := &Transfer{name: name, path: path, size: size, stream: s, done: make(chan struct{})}
+	t.cond.L = &t.mu
+	return t
+}
+
+// Name returns the file's name as sent, without any directory.
+func (t *Transfer) Name() string {
+	return t.name
+}
+
+// Path returns where the file is read from when sending, or where it is
+// stored once received.
+func (t *Transfer) Path() string {
+	return t.path
+}
+
+// Size returns the size of the file in bytes.
+func (t *Transfer) Size() int64 {
+	return t.size
+}
+
+// Offset returns how many bytes of the file the receiver already held from
+// an earlier attempt when the transfer started; only the rest is sent.
+func (t *Transfer) Offset() int64 {
+	return t.offset
+}
+
+// Progress returns how far the transfer has got.
+func (t *Transfer) Progress() Progress {
+	return t.meter.progress()
+}
+
+// OnProgress registers fn to be passed the progress of the transfer as it
+// goes, at most every 250ms and once more when it ends, replacing any
+// callback registered before; a nil fn removes it. Callbacks run on the
+// goroutine moving the data and should return quickly. A callback
+// registered after the transfer has ended is never called.
+func (t *Transfer) OnProgress(fn func(Progress)) {
+	t.meter.setCallback(fn)
+}
+
+// Pause stops the transfer moving data until Resume. The other end simply
+// waits; flow control holds the sender back when the receiver pauses.
+func (t *Transfer) Pause() {
+	t.mu.Lock()
+	t.paused = true
+	t.mu.Unlock()
+}
+
+// Resume lets a paused transfer go on.
+func (t *Transfer) Resume() {
+	t.mu.Lock()
+	t.paused = false
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// Cancel stops the transfer at both ends; Err then returns
+// ErrTransferCanceled. The receiver keeps what it has stored so the file
+// can be sent again later without starting over. Canceling a transfer
+// that has ended does nothing.
+func (t *Transfer) Cancel() {
+	t.mu.Lock()
+	if t.canceled || isClosedChan(t.done) {
+		t.mu.Unlock()
+		return
+	}
+	t.canceled = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	t.abort()
+}
+
+// Done returns a channel that is closed once the transfer has ended.
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns why the transfer ended, nil if it succeeded or is still
+// running.
+func (t *Transfer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// wait blocks while the transfer is paused and returns ErrTransferCanceled
+// once it is canceled.
+func (t *Transfer) wait() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.paused && !t.canceled {
+		t.cond.Wait()
+	}
+	if t.canceled {
+		return ErrTransferCanceled
+	}
+	return nil
+}
+
+func (t *Transfer) isCanceled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.canceled
+}
+
+// abort tells the other end the transfer is over: the sender sends the
+// empty message that marks it aborted and closes the stream, unblocking a
+// Send waiting for window; the receiver asks the sender to stop.
+func (t *Transfer) abort() {
+	t.abortOnce.Do(func() {
+		if !t.sending {
+			t.stream.Send(fileCanceledReply)
+			return
+		}
+		if t.stream.Send("") == nil {
+			t.stream.Close()
+		}
+	})
+}
+
+func (t *Transfer) finish(err error) {
+	t.meter.finish()
+	t.mu.Lock()
+	t.err = err
+	close(t.done)
+	t.mu.Unlock()
+}
+
+// refuse tells the sender of a file why it cannot be stored and discards
+// the stream.
+func refuse(s *Stream, reason string) {
+	s.Send(fileErrorReply + reason)
+	s.Close()
+	drainStream(s)
+}
+
+// parseFileHeader returns a receiving Transfer for the header a sender
+// announced, or false if it is malformed.
+func parseFileHeader(header string, s *Stream) (*Transfer, bool) {
+	rest, ok := strings.CutPrefix(header, fileHeaderPrefix)
+	if !ok {
+		return nil, false
+	}
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) != 3 {
+		return nil, false
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return nil, false
+	}
+	if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != 2*sha256.Size {
+		return nil, false
+	}
+	// Keep only the last element so a name cannot escape the directory.
+	name := filepath.Base(fields[2])
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, false
+	}
+	t := newTransfer(name, "", size, s)
+	t.sum = fields[1]
+	return t, true
+}
+
+// parseOffsetReply returns the offset in the receiver's first reply.
+func parseOffsetReply(reply string) (int64, error) {
+	if offset, ok := strings.CutPrefix(reply, fileOffsetReply); ok {
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if err == nil && n >= 0 {
+			return n, nil
+		}
+	}
+	if err := replyError(reply); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%w: unexpected reply %q", ErrTransferRefused, reply)
+}
+
+// replyError returns the outcome the receiver's last reply reports.
+func replyError(reply string) error {
+	switch {
+	case reply == fileDoneReply:
+		return nil
+	case reply == fileCanceledReply:
+		return ErrTransferCanceled
+	case reply == fileErrorReply+ErrChecksumMismatch.Error():
+		return ErrChecksumMismatch
+	case strings.HasPrefix(reply, fileErrorReply):
+		return fmt.Errorf("%w: %s", ErrTransferRefused, strings.TrimPrefix(reply, fileErrorReply))
+	default:
+		return fmt.Errorf("%w: unexpected reply %q", ErrTransferRefused, reply)
+	}
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// transferFile sends src to dir and waits for both ends of the transfer.
+func transferFile(t *testing.T, server, client *Peer, src, dir string) (sent, received *Transfer) {
+	t.Helper()
+	type result struct {
+		t   *Transfer
+		err error
+	}
+	receiving := make(chan result, 1)
+	go func() {
+		tr, err := server.ReceiveFile(dir)
+		receiving <- result{tr, err}
+	}()
+	sent, err := client.SendFile(src)
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	r := <-receiving
+	if r.err != nil {
+		t.Fatalf("ReceiveFile: %v", r.err)
+	}
+	for _, tr := range []*Transfer{sent, r.t} {
+		select {
+		case <-tr.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("transfer did not finish")
+		}
+		if err := tr.Err(); err != nil {
+			t.Fatalf("transfer failed: %v", err)
+		}
+	}
+	return sent, r.t
+}
+
+func TestSendFile(t *testing.T) {
+	server, client := newPair(t)
+	data := bytes.Repeat([]byte("file data "), 50000)
+	src := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	_, received := transferFile(t, server, client, src, dir)
+	if received.Name() != "payload.bin" || received.Size() != int64(len(data)) {
+		t.Fatalf("received %s of %d bytes, want payload.bin of %d", received.Name(), received.Size(), len(data))
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "payload.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("stored file differs from the one sent: %v", err)
+	}
+}
+
+func TestSendFileResumes(t *testing.T) {
+	server, client := newPair(t)
+	data := bytes.Repeat([]byte("resumable "), 50000)
+	src := filepath.Join(t.TempDir(), "resume.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Leave behind the first half, as an interrupted transfer would.
+	dir := t.TempDir()
+	sum := sha256.Sum256(data)
+	part := filepath.Join(dir, ".resume.bin."+hex.EncodeToString(sum[:])[:16]+".part")
+	half := len(data) / 2
+	if err := os.WriteFile(part, data[:half], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, _ := transferFile(t, server, client, src, dir)
+	if sent.Offset() != int64(half) {
+		t.Fatalf("Offset = %d, want %d held from the earlier attempt", sent.Offset(), half)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "resume.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("resumed file differs from the one sent: %v", err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+}
+
+func TestFileTransferProgress(t *testing.T) {
+	server, client := newPair(t)
+	data := bytes.Repeat([]byte("progress "), 50000)
+	src := filepath.Join(t.TempDir(), "progress.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, received := transferFile(t, server, client, src, t.TempDir())
+	for _, tr := range []*Transfer{sent, received} {
+		if p := tr.Progress(); !p.Done || p.Bytes != int64(len(data)) || p.Total != int64(len(data)) || p.ETA != 0 {
+			t.Fatalf("progress = %+v, want Done with all %d bytes", p, len(data))
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"math/rand/v2"
+	"sort"
+)
+
+// LBStrategy selects which peer of a group RelayToGroup relays to.
+type LBStrategy int
+
+const (
+	// RoundRobin cycles through the group, visiting each peer in proportion
+	// to its weight.
+	RoundRobin LBStrategy = iota
+	// Random picks a peer at random, with probability proportional to its
+	// weight.
+	Random
+	// LeastPending picks the peer with the fewest messages waiting in its
+	// send queue (see Peer.Pending) plus relays to it still in progress, so
+	// a peer slow to take relayed messages is passed over. Peers tied for
+	// fewest are visited in weighted round-robin order.
+	LeastPending
+)
+
+// groupBalancer holds the round-robin state for one tag.
+type groupBalancer struct {
+	current map[string]int // Peer ID -> smooth weighted round-robin counter
+}
+
+// TagPeer adds tag to the managed peer with the given ID. Peers sharing a tag
+// form a group that RelayToGroup can balance across.
+func (m *PeerManager) TagPeer(id, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[id]; !ok {
+		return ErrPeerNotFound
+	}
+	if m.tags[tag] == nil {
+		m.tags[tag] = make(map[string]struct{})
+	}
+	m.tags[tag][id] = struct{}{}
+	return nil
+}
+
+// UntagPeer removes tag from the peer with the given ID.
+func (m *PeerManager) UntagPeer(id, tag string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tags[tag], id)
+	if len(m.tags[tag]) == 0 {
+		delete(m.tags, tag)
+		delete(m.groups, tag)
+	}
+}
+
+// PeersWithTag returns the IDs of the peers carrying tag, in sorted order.
+func (m *PeerManager) PeersWithTag(tag string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.taggedLocked(tag)
+}
+
+// SetPeerWeight sets the load-balancing weight of the peer with the given ID.
+// Peers start with a weight of 1; a weight of 0 or less takes the peer out of
+// rotation without untagging it.
+func (m *PeerManager) SetPeerWeight(id string, weight int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[id]; !ok {
+		return ErrPeerNotFound
+	}
+	if weight == 1 {
+		delete(m.weights, id)
+	} else {
+		m.weights[id] = weight
+	}
+	return nil
+}
+
+// RelayToGroup relays a message from sourceId to exactly one peer carrying
+// groupTag, chosen by strategy, and returns the ID of that peer. The source
+// peer, disconnected peers, peers with a weight of 0 and peers that a relay
+// rule forbids sourceId from reaching are never chosen. It returns
+// ErrNoGroupPeers if no peer is eligible; otherwise the error is that of
+// Relay for the chosen peer.
+func (m *PeerManager) RelayToGroup(sourceId, groupTag, message string, strategy LBStrategy) (chosenID string, err error) {
+	if !m.work.enter() {
+		return "", ErrQuiesced
+	}
+	defer m.work.exit()
+	chosenID = m.choose(sourceId, groupTag, strategy)
+	if chosenID == "" {
+		m.deadLetterMessage("", message, ErrNoGroupPeers)
+		return "", ErrNoGroupPeers
+	}
+	return chosenID, m.Relay(sourceId, chosenID, message)
+}
+
+// choose picks the group member to relay to, or returns "" if none is
+// eligible.
+func (m *PeerManager) choose(sourceId, tag string, strategy LBStrategy) string {
+	m.mu.RLock()
+	ids := m.taggedLocked(tag)
+	var candidates []*Peer
+	var weights []int
+	for _, id := range ids {
+		w := m.weightLocked(id)
+		if id == sourceId || w <= 0 {
+			continue
+		}
+		candidates = append(candidates, m.peers[id])
+		weights = append(weights, w)
+	}
+	m.mu.RUnlock()
+
+	// Connectivity and rules are checked without m.mu, as they call into C.
+	n := 0
+	for i, p := range candidates {
+		if p.IsConnected() && m.relayAllowed(sourceId, p.id) {
+			candidates[n], weights[n] = p, weights[i]
+			n++
+		}
+	}
+	candidates, weights = candidates[:n], weights[:n]
+	if n == 0 {
+		return ""
+	}
+
+	switch strategy {
+	case Random:
+		return candidates[weightedIndex(weights, rand.IntN(sum(weights)))].id
+	case LeastPending:
+		least := candidates[0].load()
+		n = 0
+		for i, p := range candidates {
+			pending := p.load()
+			if pending < least {
+				least, n = pending, 0
+			}
+			if pending == least {
+				candidates[n], weights[n] = p, weights[i]
+				n++
+			}
+		}
+		candidates, weights = candidates[:n], weights[:n]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g := m.groups[tag]
+	if g == nil {
+		g = &groupBalancer{current: make(map[string]int)}
+		m.groups[tag] = g
+	}
+	return candidates[g.next(candidates, weights)].id
+}
+
+// load returns the messages waiting to be sent to p, counted by LeastPending.
+func (p *Peer) load() int {
+	return p.Pending() + int(p.relaying.Load())
+}
+
+// next advances smooth weighted round-robin over candidates and returns the
+// index of the chosen one: every candidate's counter grows by its weight, and
+// the highest counter wins and is reduced by the total weight.
+func (g *groupBalancer) next(candidates []*Peer, weights []int) int {
+	best := 0
+	for i, p := range candidates {
+		g.current[p.id] += weights[i]
+		if g.current[p.id] > g.current[candidates[best].id] {
+			best = i
+		}
+	}
+	g.current[candidates[best].id] -= sum(weights)
+	return best
+}
+
+// taggedLocked returns the sorted IDs of the peers carrying tag. Caller must
+// hold m.mu.
+func (m *PeerManager) taggedLocked(tag string) []string {
+	ids := make([]string, 0, len(m.tags[tag]))
+	for id := range m.tags[tag] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// weightLocked returns the weight of the peer with the given ID. Caller must
+// hold m.mu.
+func (m *PeerManager) weightLocked(id string) int {
+	if w, ok := m.weights[id]; ok {
+		return w
+	}
+	return 1
+}
+
+// weightedIndex returns the index whose cumulative weight range contains r,
+// for 0 <= r < sum(weights).
+func weightedIndex(weights []int, r int) int {
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(weights) - 1
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
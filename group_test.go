@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRelayToGroupWeighted(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	serverC, c := newPairIDs(t, "c-server", "c")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	for _, p := range []*Peer{a, b, c} {
+		m.AddPeer(p)
+		if err := m.TagPeer(p.ID(), "workers"); err != nil {
+			t.Fatalf("TagPeer: %v", err)
+		}
+	}
+	if err := m.SetPeerWeight("b", 2); err != nil {
+		t.Fatalf("SetPeerWeight: %v", err)
+	}
+
+	chosen := make(map[string]int)
+	for range 6 {
+		id, err := m.RelayToGroup("a", "workers", "job", RoundRobin)
+		if err != nil {
+			t.Fatalf("RelayToGroup: %v", err)
+		}
+		chosen[id]++
+	}
+	// The source is never chosen, and b takes twice c's share.
+	if chosen["a"] != 0 || chosen["b"] != 4 || chosen["c"] != 2 {
+		t.Fatalf("chosen = %v, want b 4 times and c twice", chosen)
+	}
+	for _, server := range []*Peer{serverB, serverB, serverC} {
+		if got := receive(t, server); got != "[Relayed] job" {
+			t.Fatalf("%s got %q", server.ID(), got)
+		}
+	}
+
+	m.SetPeerWeight("b", 0)
+	m.SetPeerWeight("c", 0)
+	if _, err := m.RelayToGroup("a", "workers", "job", Random); !errors.Is(err, ErrNoGroupPeers) {
+		t.Fatalf("RelayToGroup with every weight 0: %v, want ErrNoGroupPeers", err)
+	}
+	if err := m.TagPeer("missing", "workers"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("TagPeer of an unknown peer: %v, want ErrPeerNotFound", err)
+	}
+}
+
+func TestLeastPendingCountsRelays(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	_, b := newPairIDs(t, "b-server", "b")
+	serverC, c := newPairIDs(t, "c-server", "c")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	for _, p := range []*Peer{a, b, c} {
+		m.AddPeer(p)
+		m.TagPeer(p.ID(), "workers")
+	}
+
+	// Hold a relay to b in progress; b would otherwise be chosen first.
+	release := make(chan struct{})
+	m.SetRelayTransform(func(sourceID, targetID, message string) (string, bool) {
+		if message == "slow" {
+			<-release
+		}
+		return message, true
+	})
+	done := make(chan error, 1)
+	go func() { done <- m.Relay("a", "b", "slow") }()
+	for b.relaying.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	id, err := m.RelayToGroup("a", "workers", "job", LeastPending)
+	if err != nil || id != "c" {
+		t.Fatalf("RelayToGroup = %q, %v, want c while b has a relay in progress", id, err)
+	}
+	if got := receive(t, serverC); got != "[Relayed] job" {
+		t.Fatalf("c got %q", got)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"runtime"
+	"sync"
+)
+
+// handleGuard counts the calls using a C handle, such as a peer's or a
+// manager's, so that Destroy can wait for them to return before it frees
+// the handle. Calls may nest.
+type handleGuard struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	calls   int
+	retired bool // Set by Destroy; no call may start after it
+}
+
+// enter reports whether the handle may still be used and, if so, counts the
+// caller in until it calls leave.
+func (g *handleGuard) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.calls++
+	return true
+}
+
+// leave ends a call begun by a successful enter.
+func (g *handleGuard) leave() {
+	g.mu.Lock()
+	g.calls--
+	if g.calls == 0 && g.cond.L != nil {
+		g.cond.Broadcast()
+	}
+	g.mu.Unlock()
+}
+
+// retire makes later enter calls fail and waits for the calls in progress
+// to leave.
+func (g *handleGuard) retire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = true
+	g.cond.L = &g.mu
+	for g.calls > 0 {
+		g.cond.Wait()
+	}
+}
+
+// enter reports whether p's C handle may still be used and, if so, counts
+// the caller in until it calls leave. Blocking C calls must only be made
+// inside enter and leave if closing the peer wakes them, and nothing that
+// can call back into user code may run between the two, or Destroy would
+// wait for it.
+func (p *Peer) enter() bool {
+	return p.guard.enter()
+}
+
+// leave ends a call begun by a successful enter.
+func (p *Peer) leave() {
+	p.guard.leave()
+	// Keep p, and so its finalizer, from running before the C call is done.
+	runtime.KeepAlive(p)
+}
+
+// retire makes later enter calls fail and waits for the calls in progress
+// to leave.
+func (p *Peer) retire() {
+	p.guard.retire()
+}
+
+// enter reports whether m's C handle may still be used and, if so, counts
+// the caller in until it calls leave. As for Peer.enter, nothing that can
+// call back into user code may run between the two.
+func (m *PeerManager) enter() bool {
+	return m.guard.enter()
+}
+
+// leave ends a call begun by a successful enter.
+func (m *PeerManager) leave() {
+	m.guard.leave()
+	runtime.KeepAlive(m)
+}
@@ -0,0 +1,79 @@
+package relay
+
+/*
+#include "../include/relay.h"
+
+extern void relayGoOnMessage(uintptr_t context, int status, char *data, size_t len, int urgent);
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// messageHandler is a handler registered with OnMessage.
+type messageHandler struct {
+	peer *Peer
+	fn   func(Message)
+}
+
+// OnMessage registers fn to be called with every message the peer receives,
+// replacing any handler registered before; a nil fn removes it. Handlers
+// are called by a single thread in the C library that waits on the
+// connections of every peer with a handler, so an application serving
+// hundreds of peers needs no receiving goroutine per peer. Handlers run one
+// at a time and should return quickly, handing slow work to another
+// goroutine, since a handler that blocks delays every peer.
+//
+// Urgent messages go to the OnUrgentMessage handler if one is set. The
+// handler is removed once the connection is lost, when Receive reports why,
+// and when the peer is closed or destroyed. Do not call Receive or Messages
+// while a handler is registered, as they would take its messages. When
+// called from a goroutine other than a handler, OnMessage returns once the
+// previous handler is no longer running.
+func (p *Peer) OnMessage(fn func(Message)) {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	old := p.handler
+	p.handler = 0
+	if p.enter() {
+		if fn == nil {
+			C.relay_set_message_callback(p.ptr, nil, 0)
+		} else {
+			p.handler = cgo.NewHandle(&messageHandler{peer: p, fn: fn})
+			C.relay_set_message_callback(p.ptr, C.RelayMessageCallback(C.relayGoOnMessage), C.uintptr_t(p.handler))
+		}
+		p.leave()
+	}
+	if old != 0 {
+		old.Delete()
+	}
+}
+
+//export relayGoOnMessage
+func relayGoOnMessage(context C.uintptr_t, status C.int, data *C.char, n C.size_t, urgent C.int) {
+	h, ok := cgo.Handle(context).Value().(*messageHandler)
+	if !ok || status != C.RELAY_OK {
+		return
+	}
+	payload, ok := h.peer.openReceived(C.GoBytes(unsafe.Pointer(data), C.int(n)))
+	if !ok || h.peer.dropStale(payload) || h.peer.dedup.duplicate(payload) {
+		return
+	}
+	if fn := h.peer.onUrgent.Load(); urgent != 0 && fn != nil {
+		(*fn)(string(payload))
+		return
+	}
+	p := h.peer
+	p.reorder.expire()
+	if !p.reorder.push(payload, 0) {
+		h.fn(Message{Source: p.id, Payload: payload})
+	}
+	for {
+		held, _, ok := p.reorder.pop()
+		if !ok {
+			return
+		}
+		h.fn(Message{Source: p.id, Payload: held})
+	}
+}
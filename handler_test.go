@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnMessage(t *testing.T) {
+	server, client := newPair(t)
+	got := make(chan Message, 1)
+	server.OnMessage(func(m Message) { got <- m })
+	if err := client.Send("handled"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case m := <-got:
+		if string(m.Payload) != "handled" {
+			t.Fatalf("handler got %q, want %q", m.Payload, "handled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+	server.OnMessage(nil)
+	if err := client.Send("polled"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "polled" {
+		t.Fatalf("got %q once the handler was removed, want %q", got, "polled")
+	}
+}
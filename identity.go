@@ -0,0 +1,211 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// idEncoding turns public keys into peer IDs: lowercase base32 without
+// padding, so IDs are safe in file names, hosts and log lines.
+var idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Identity is an Ed25519 keypair that a peer proves it holds when it
+// connects, so the peer ID derived from its public key cannot be claimed by
+// anyone else. See WithIdentity.
+type Identity struct {
+	key ed25519.PrivateKey
+}
+
+// GenerateIdentity returns a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// NewIdentity returns the identity of an existing Ed25519 private key.
+func NewIdentity(key ed25519.PrivateKey) *Identity {
+	return &Identity{key: key}
+}
+
+// LoadIdentity reads an identity saved by Save: a PEM-encoded PKCS #8
+// Ed25519 private key, as written by openssl genpkey -algorithm ed25519.
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("relay: %s holds no PEM private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("relay: %s holds a %T, not an Ed25519 key", path, key)
+	}
+	return &Identity{key: edKey}, nil
+}
+
+// Save writes the identity's private key to path, readable by its owner
+// only, for LoadIdentity.
+func (id *Identity) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+// PublicKey returns the identity's public key.
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.key.Public().(ed25519.PublicKey)
+}
+
+// ID returns the peer ID derived from the identity's public key.
+func (id *Identity) ID() string {
+	return PeerIDFromKey(id.PublicKey())
+}
+
+// PeerIDFromKey returns the peer ID of an Ed25519 public key: the key itself
+// encoded in lowercase base32, so the key can be recovered from the ID.
+func PeerIDFromKey(key ed25519.PublicKey) string {
+	return idEncoding.EncodeToString(key)
+}
+
+// KeyFromPeerID returns the public key a peer ID was derived from, or false
+// if id was not made by PeerIDFromKey.
+func KeyFromPeerID(id string) (ed25519.PublicKey, bool) {
+	key, err := idEncoding.DecodeString(id)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(key), true
+}
+
+// WithIdentity makes the peer prove it holds local when it connects, and
+// verify the identity of the remote end, over TLS with self-signed Ed25519
+// certificates, so no certificate authority is needed. A client peer's ID
+// must be the ID of the server it expects (see Identity.ID), and OpenPeer
+// fails with ErrHandshakeFailed if the server holds another key. A server
+// peer's ID must be local's ID, or empty to use it, and the server requires
+// every client to present an identity, which Client.PeerID returns. Such
+// peers are Authenticated. It cannot be combined with WithTLS, WithNoiseKey
+// or WithAuthToken, and only takes effect when the peer is created.
+func WithIdentity(local *Identity) PeerOption {
+	return func(c *peerConfig) { c.identity = local }
+}
+
+// PeerID returns the ID derived from the identity the client proved it holds
+// when it connected to a server peer created with WithIdentity, or an empty
+// string if the client presented no Ed25519 identity or is unknown.
+func (c *Client) PeerID() string {
+	if !c.peer.enter() {
+		return ""
+	}
+	defer c.peer.leave()
+	var data *C.char
+	var n C.size_t
+	if C.relay_get_remote_identity(c.peer.ptr, C.uint64_t(c.id), &data, &n) != C.RELAY_OK {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(data))
+	key, err := identityKey(C.GoBytes(unsafe.Pointer(data), C.int(n)))
+	if err != nil {
+		return ""
+	}
+	return PeerIDFromKey(key)
+}
+
+// applyIdentity sets up TLS for c.identity and returns the ID of a peer
+// created as id.
+func (c *peerConfig) applyIdentity(id string) (string, error) {
+	cert, err := c.identity.certificate()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrConfigureFailed, err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.server {
+		if id == "" {
+			id = c.identity.ID()
+		} else if id != c.identity.ID() {
+			return "", fmt.Errorf("%w: server peer ID %q is not its identity's ID", ErrConfigureFailed, id)
+		}
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			_, err := identityKey(raw[0])
+			return err
+		}
+	} else {
+		want, ok := KeyFromPeerID(id)
+		if !ok {
+			return "", fmt.Errorf("%w: %q is not an identity's peer ID", ErrConfigureFailed, id)
+		}
+		cfg.InsecureSkipVerify = true // The self-signed certificate is checked below.
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			key, err := identityKey(raw[0])
+			if err != nil {
+				return err
+			}
+			if !key.Equal(want) {
+				return fmt.Errorf("server identity is %s, not %s", PeerIDFromKey(key), id)
+			}
+			return nil
+		}
+	}
+	c.tls = cfg
+	return id, nil
+}
+
+// certificate returns a self-signed certificate for the identity's key.
+func (id *Identity) certificate() (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id.ID()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(100, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, id.PublicKey(), id.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.key}, nil
+}
+
+// identityKey returns the Ed25519 key of a DER certificate presented by a
+// peer with an identity. The TLS handshake has already proven the remote
+// end holds the key's private half.
+func identityKey(der []byte) (ed25519.PublicKey, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("remote end presented no Ed25519 identity")
+	}
+	return key, nil
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentitySaveLoad(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id.pem")
+	if err := id.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity: %v", err)
+	}
+	if loaded.ID() != id.ID() {
+		t.Fatalf("loaded ID %q, want %q", loaded.ID(), id.ID())
+	}
+	key, ok := KeyFromPeerID(id.ID())
+	if !ok || !key.Equal(id.PublicKey()) || PeerIDFromKey(key) != id.ID() {
+		t.Fatal("peer ID does not round-trip to the public key")
+	}
+	if _, ok := KeyFromPeerID("not an id"); ok {
+		t.Fatal("KeyFromPeerID accepted a malformed ID")
+	}
+}
+
+func TestIdentityHandshake(t *testing.T) {
+	serverID, _ := GenerateIdentity()
+	clientID, _ := GenerateIdentity()
+	server, client, conn := openPairIDs(t, "", serverID.ID(),
+		[]PeerOption{WithIdentity(serverID)}, []PeerOption{WithIdentity(clientID)})
+	if conn.PeerID() != clientID.ID() {
+		t.Fatalf("Client.PeerID = %q, want %q", conn.PeerID(), clientID.ID())
+	}
+	if !server.Authenticated() || !client.Authenticated() {
+		t.Fatal("identity peers are not Authenticated")
+	}
+	exchange(t, server, client, conn, 1)
+
+	go server.Accept()
+	impostor, _ := GenerateIdentity()
+	if _, err := OpenPeer(impostor.ID(), "127.0.0.1", server.LocalAddr().(*net.TCPAddr).Port, 0, WithIdentity(clientID)); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("OpenPeer expecting another server: %v, want ErrHandshakeFailed", err)
+	}
+}
@@ -0,0 +1,252 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultInboxSize is how many received messages the channels returned by
+// Peer.Messages and PeerManager.Inbox hold before the reader waits for the
+// application to catch up.
+const DefaultInboxSize = 64
+
+// Message is a message received from a peer. Messages from Messages and
+// OnMessage carry only Source and the raw Payload; the other fields travel
+// with messages sent with SendEnvelope and are filled in by
+// ReceiveEnvelope or by decoding the Payload with UnmarshalBinary.
+type Message struct {
+	Source  string // ID of the peer the message was received from
+	Payload []byte
+
+	ID          string            // Identifies the message, for tracing and deduplication
+	Target      string            // ID of the peer the message is meant for, empty for any
+	Time        time.Time         // When the message was sent, zero if unknown
+	Expires     time.Time         // When the message goes stale and is dropped instead of delivered, zero for never
+	ContentType string            // MIME type of the Payload, such as "application/json"
+	Headers     map[string]string // Application metadata, such as trace IDs
+}
+
+// inbox delivers a peer's messages on a channel. Once Messages has been
+// called a goroutine receives messages until the connection or the peer is
+// closed.
+type inbox struct {
+	mu      sync.Mutex
+	size    int            // Channel capacity, DefaultInboxSize if 0
+	policy  OverflowPolicy // What the reader does with a message while ch is full
+	dropped uint64         // Messages discarded because ch was full
+	ch      chan Message
+	err     error // Why the channel was closed
+	closed  bool
+	stopped bool               // The reader finished and ch is closed
+	cancel  context.CancelFunc // Stops the reader
+	done    chan struct{}
+}
+
+// Messages returns a channel that receives every message the peer receives,
+// so a caller can range over it or select on it instead of looping on
+// Receive. The first call starts a goroutine that receives messages in the
+// background; later calls return the same channel. The channel is closed
+// once the connection is lost or the peer is closed or destroyed, and
+// MessagesErr then reports why. While it is in use, do not call Receive or
+// ReceiveMessage, which would take messages meant for the channel.
+func (p *Peer) Messages() <-chan Message {
+	in := &p.in
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.ch != nil {
+		return in.ch
+	}
+	in.ch = make(chan Message, sizeOr(in.size, DefaultInboxSize))
+	if in.closed {
+		in.err = ErrPeerDisconnected
+		in.stopped = true
+		close(in.ch)
+		return in.ch
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	in.cancel = cancel
+	in.done = make(chan struct{})
+	spawn(func() { in.run(ctx, p) })
+	return in.ch
+}
+
+// SetInboxSize sets how many received messages the Messages channel holds,
+// DefaultInboxSize by default. It only takes effect if called before the
+// first call to Messages.
+func (p *Peer) SetInboxSize(n int) {
+	p.in.mu.Lock()
+	defer p.in.mu.Unlock()
+	p.in.size = n
+}
+
+// MessagesErr returns why the Messages channel was closed, as Receive would
+// report it, or nil while it is open. A peer closed with Close reports
+// ErrPeerDisconnected.
+func (p *Peer) MessagesErr() error {
+	p.in.mu.Lock()
+	defer p.in.mu.Unlock()
+	if !p.in.stopped {
+		return nil
+	}
+	return p.in.err
+}
+
+// sizeOr returns n if it is positive and fallback otherwise.
+func sizeOr(n, fallback int) int {
+	if n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// run receives messages into the channel until receiving fails or ctx is
+// canceled.
+func (in *inbox) run(ctx context.Context, p *Peer) {
+	defer close(in.done)
+	var err error
+	for err == nil {
+		var data []byte
+		if data, err = p.receive(ctx); err == nil {
+			in.deliver(ctx, Message{Source: p.id, Payload: data})
+		}
+	}
+	if ctx.Err() != nil {
+		err = ErrPeerDisconnected
+	}
+	in.mu.Lock()
+	in.err = err
+	in.stopped = true
+	close(in.ch)
+	in.mu.Unlock()
+}
+
+// close stops the reader, which closes the channel, and waits for it to
+// finish.
+func (in *inbox) close() {
+	in.mu.Lock()
+	in.closed = true
+	cancel, done := in.cancel, in.done
+	in.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// managerInbox merges the Messages channels of a manager's peers.
+type managerInbox struct {
+	mu      sync.Mutex
+	size    int            // Channel capacity, DefaultInboxSize if 0
+	policy  OverflowPolicy // What the reader does with a message while ch is full
+	dropped uint64         // Messages discarded because ch was full
+	ch      chan Message
+	stops   map[string]chan struct{} // Peer ID -> stops that peer's forwarder
+	readers sync.WaitGroup
+	closed  bool
+}
+
+// Inbox returns a channel that receives the messages of every peer in the
+// manager, each tagged with the ID of the peer it came from, so one
+// goroutine can serve them all. Peers added later are included and removed
+// peers stop contributing. The first call starts reading each peer's
+// Messages channel; later calls return the same channel, which is closed
+// when the manager is destroyed. A peer whose connection is lost simply
+// stops contributing; its MessagesErr reports why.
+func (m *PeerManager) Inbox() <-chan Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	in := &m.in
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.ch != nil {
+		return in.ch
+	}
+	in.ch = make(chan Message, sizeOr(in.size, DefaultInboxSize))
+	in.stops = make(map[string]chan struct{})
+	if in.closed {
+		close(in.ch)
+		return in.ch
+	}
+	for _, p := range m.peers {
+		in.addLocked(p)
+	}
+	return in.ch
+}
+
+// SetInboxSize sets how many messages the Inbox channel holds,
+// DefaultInboxSize by default. It only takes effect if called before the
+// first call to Inbox.
+func (m *PeerManager) SetInboxSize(n int) {
+	m.in.mu.Lock()
+	defer m.in.mu.Unlock()
+	m.in.size = n
+}
+
+// add starts forwarding p's messages if Inbox has been called.
+func (in *managerInbox) add(p *Peer) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.ch != nil && !in.closed {
+		in.addLocked(p)
+	}
+}
+
+// addLocked starts forwarding p's messages. Caller must hold in.mu.
+func (in *managerInbox) addLocked(p *Peer) {
+	if _, ok := in.stops[p.id]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	in.stops[p.id] = stop
+	messages := p.Messages()
+	in.readers.Add(1)
+	spawn(func() {
+		defer in.readers.Done()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case in.ch <- msg:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// remove stops forwarding the messages of the peer with the given ID.
+func (in *managerInbox) remove(id string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if stop, ok := in.stops[id]; ok {
+		close(stop)
+		delete(in.stops, id)
+	}
+}
+
+// close stops every forwarder and closes the channel.
+func (in *managerInbox) close() {
+	in.mu.Lock()
+	if in.closed {
+		in.mu.Unlock()
+		return
+	}
+	in.closed = true
+	for id, stop := range in.stops {
+		close(stop)
+		delete(in.stops, id)
+	}
+	ch := in.ch
+	in.mu.Unlock()
+	in.readers.Wait()
+	if ch != nil {
+		close(ch)
+	}
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// next returns the next message on ch, failing the test if none arrives
+// in time or ch is closed.
+func next(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+	}
+	return Message{}
+}
+
+func TestMessagesChannel(t *testing.T) {
+	server, client := newPair(t)
+	ch := server.Messages()
+	if err := client.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if m := next(t, ch); string(m.Payload) != "hello" {
+		t.Fatalf("got %q, want %q", m.Payload, "hello")
+	}
+	if server.MessagesErr() != nil {
+		t.Fatalf("MessagesErr while open = %v", server.MessagesErr())
+	}
+
+	server.Close()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("message after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages channel not closed by Close")
+	}
+	if err := server.MessagesErr(); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("MessagesErr = %v, want ErrPeerDisconnected", err)
+	}
+}
+
+func TestManagerInbox(t *testing.T) {
+	_, a, connA := openPairIDs(t, "a-server", "a", nil, nil)
+	_, b, connB := openPairIDs(t, "b-server", "b", nil, nil)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	inbox := m.Inbox()
+	m.AddPeer(b)
+
+	connA.Send("from a")
+	connB.Send("from b")
+	got := make(map[string]string)
+	for range 2 {
+		msg := next(t, inbox)
+		got[msg.Source] = string(msg.Payload)
+	}
+	if got["a"] != "from a" || got["b"] != "from b" {
+		t.Fatalf("inbox got %v, want a message from each peer", got)
+	}
+}
@@ -1,6 +1,9 @@
 #ifndef RELAY_H
 #define RELAY_H
 
+#include <stddef.h>
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C"
 {
@@ -11,33 +14,299 @@ extern "C"
     typedef void *RelayPeerManager;
     typedef void *RelayPeerDiscovery;
 
+    // Status codes. Functions documented as returning a status report RELAY_OK on
+    // success, RELAY_ERR_FAILED when no more specific reason is known, or one of
+    // the negative codes below.
+    enum
+    {
+        RELAY_OK = 1,
+        RELAY_ERR_FAILED = 0,
+        RELAY_ERR_DENIED = -1,       // A relay rule forbids the direction
+        RELAY_ERR_CIRCUIT_OPEN = -2, // The peer's circuit breaker is open
+        RELAY_ERR_TIMEOUT = -3,      // The operation did not finish in time
+        RELAY_ERR_MULTICAST_UNAVAILABLE = -4, // No interface supports multicast
+        RELAY_ERR_NOT_FOUND = -5,    // A peer ID is not known to the manager
+        RELAY_ERR_DISCONNECTED = -6, // The peer's connection is closed
+        RELAY_ERR_LISTENER_CLOSED = -7, // A server peer's listening socket is closed
+        RELAY_ERR_TEMPORARY = -8,    // A send failed transiently and may succeed if retried
+        RELAY_ERR_FRAME_DESYNC = -9, // The connection was closed because frame boundaries were lost
+        RELAY_ERR_READ_IDLE = -10,   // Nothing arrived within the read idle timeout; the connection stays open
+        RELAY_ERR_CONNECTION_REFUSED = -11, // Nothing is listening at the address a client peer connected to
+        RELAY_ERR_ADDRESS_IN_USE = -12,     // The address a peer binds or listens on is taken
+        RELAY_ERR_INVALID_ADDRESS = -13,    // An IP address could not be parsed
+        RELAY_ERR_HANDSHAKE_FAILED = -14,   // A TLS, Noise or shared-secret handshake failed, or the remote end's certificate, key or secret was rejected
+        RELAY_ERR_UNAUTHENTICATED = -15,    // A relay's source peer is not authenticated
+        RELAY_ERR_INVALID_CONFIG = -16,     // A setting, such as a TLS certificate or key, could not be used
+        RELAY_ERR_NOT_ENCRYPTED = -17,      // A connection has no session keys to rotate
+        RELAY_ERR_SERVER_DRAINING = -18,    // The server announced in the handshake that it is draining
+    };
+
+    // Stream frame kinds for relay_send_stream_frame and relay_receive_stream_frame.
+    enum
+    {
+        RELAY_STREAM_OPEN = 0,   // A client opened the stream
+        RELAY_STREAM_DATA = 1,   // One message
+        RELAY_STREAM_WINDOW = 2, // Send credit, a 32-bit big-endian byte count
+        RELAY_STREAM_CLOSE = 3,  // The other end will send no more
+        RELAY_STREAM_RESET = 4,  // The stream's connection was lost
+    };
+
+    // Socket settings for relay_configure_peer. A zero value leaves a setting unchanged.
+    typedef struct
+    {
+        int sendBufferSize;       // SO_SNDBUF in bytes
+        int receiveBufferSize;    // SO_RCVBUF in bytes
+        int64_t sendTimeoutMs;    // SO_SNDTIMEO
+        int64_t receiveTimeoutMs; // SO_RCVTIMEO
+        int noDelay;              // TCP_NODELAY: 1 to set, -1 to clear
+        int64_t keepAliveMs;      // SO_KEEPALIVE idle time, and probe interval without keepAliveIntervalMs; -1 to disable
+        int64_t keepAliveIntervalMs; // TCP_KEEPINTVL
+        int keepAliveCount;       // TCP_KEEPCNT
+    } RelayPeerOptions;
+
+    // Checks the certificate chain the remote end of a TLS connection presented, DER-encoded and leaf
+    // first; count is 0 if it presented none. Returns 1 to accept the connection. Called during the
+    // handshake, on the thread that opens the peer or accepts the client.
+    typedef int (*RelayVerifyCallback)(uintptr_t context, const char **certificates, const size_t *lens, int count);
+
+    // TLS settings in RelayOpenOptions.
+    typedef struct
+    {
+        const char **certificates;    // DER certificate chain, leaf first; required for a server peer
+        const size_t *certificateLens;
+        int certificateCount;
+        const char *privateKey;       // DER private key of the leaf certificate
+        size_t privateKeyLen;
+        const char *serverName;       // Sent as SNI by a client peer, NULL or empty for none
+        int clientAuth;               // Server peers: 0 to not ask clients for a certificate, 1 to ask, 2 to require one
+        int minVersion;               // Lowest TLS version, e.g. 0x0303 for TLS 1.2; 0 for TLS 1.2
+        int maxVersion;               // Highest TLS version, 0 for the highest supported
+        int authenticated;            // Non-zero if verify only accepts chains that prove who the remote end is
+        RelayVerifyCallback verify;   // NULL accepts any chain
+        uintptr_t verifyContext;
+    } RelayTlsOptions;
+
+    // Noise settings in RelayOpenOptions. Keys are raw X25519 keys of 32 bytes.
+    typedef struct
+    {
+        const char *privateKey; // The peer's static private key
+        const char *remoteKeys; // remoteKeyCount public keys, back to back; the remote end must hold one
+        int remoteKeyCount;     // 0 accepts any remote key; 1 makes a client peer use the IK pattern
+    } RelayNoiseOptions;
+
+    // Shared-secret settings in RelayOpenOptions: pre-shared keys or tokens, proven by
+    // challenge-response without sending them.
+    typedef struct
+    {
+        const char **secrets;     // The remote end must know one of them; a client peer proves the first
+        const size_t *secretLens;
+        int secretCount;
+    } RelayAuthOptions;
+
+    // WebSocket settings in RelayOpenOptions.
+    typedef struct
+    {
+        const char *path; // Request path, NULL or empty for "/"; a server peer refuses other paths
+        const char *host; // Host header a client peer sends, NULL or empty for the server's address
+    } RelayWebSocketOptions;
+
+    // UDP settings in RelayOpenOptions. A zero value picks the default.
+    typedef struct
+    {
+        int64_t retransmitTimeoutMs; // Wait before resending until round trips are measured; 200 by default
+        int window;                  // Segments sent ahead of acknowledgements; 256 by default
+        int64_t idleTimeoutMs;       // Drops a connection that hears nothing for this long; 15000 by default
+        int64_t reassemblyTimeoutMs; // Drops an unreliable message still missing fragments after this long; 1000 by default
+    } RelayUdpOptions;
+
+    // Proxy settings in RelayOpenOptions.
+    typedef struct
+    {
+        int http;             // 1 for an HTTP proxy tunnelling with CONNECT, 0 for SOCKS5
+        const char *ip;       // IPv4 or IPv6 address of the proxy
+        int port;             // Port of the proxy
+        const char *username; // NULL or empty for no authentication
+        const char *password;
+    } RelayProxyOptions;
+
+    // Connection settings for relay_open_peer_with. A zero value picks the default.
+    typedef struct
+    {
+        const char *localIp;      // Local address a client peer connects from, NULL or empty for any
+        int localPort;            // Local port a client peer connects from, 0 for an ephemeral one
+        int64_t connectTimeoutMs; // Longest wait for a client peer to connect
+        int backlog;              // Pending connections a server peer queues
+        const RelayTlsOptions *tls; // Runs TLS on every connection, NULL for plaintext
+        const RelayNoiseOptions *noise; // Runs Noise on every connection instead, NULL for none
+        const RelayAuthOptions *auth;   // Admits only remote ends knowing a shared secret instead, NULL for none
+        const RelayWebSocketOptions *websocket; // Carries the connection in WebSocket messages, inside any of the above (wss:// with TLS); NULL for none
+        const RelayUdpOptions *udp;             // Carries connections over UDP with retransmission instead of TCP, NULL for TCP
+        int socketMode;           // Permission bits of a server peer's "unix://" socket file, 0 for those of the umask
+        const RelayProxyOptions *proxy; // Proxy a client peer connects through, which also resolves a host name in ip; NULL for none
+        int ipv6Only;             // Non-zero for a server peer listening on "::" to refuse IPv4 connections
+        int reuseAddress;         // Non-zero to set SO_REUSEADDR on a server peer's socket before it binds
+        int reusePort;            // Non-zero to set SO_REUSEPORT on a server peer's socket before it binds
+    } RelayOpenOptions;
+
+    // A peer a broadcast was not delivered to, reported by relay_broadcast_report.
+    typedef struct
+    {
+        char *peerId;
+        int status; // RELAY_ERR_CIRCUIT_OPEN, RELAY_ERR_DISCONNECTED or RELAY_ERR_FAILED
+    } RelayDeliveryFailure;
+
+    // Connection lifecycle events reported by relay_take_peer_events.
+    enum
+    {
+        RELAY_EVENT_CONNECTED = 0,    // A client was accepted, or a client peer reconnected
+        RELAY_EVENT_DISCONNECTED = 1, // The connection closed without this end closing it
+        RELAY_EVENT_ERROR = 2,        // Sending or receiving failed
+        RELAY_EVENT_REJECTED = 3,     // A client was closed before being accepted; clientId is 0
+    };
+
+    // Why a lifecycle event happened.
+    enum
+    {
+        RELAY_EVENT_REASON_NONE = 0,
+        RELAY_EVENT_REASON_CLOSED = 1,         // Closed by the remote end or dropped
+        RELAY_EVENT_REASON_GOODBYE = 2,        // The remote end said goodbye
+        RELAY_EVENT_REASON_DESYNC = 3,         // Frame boundaries were lost
+        RELAY_EVENT_REASON_IDLE = 4,           // The read idle timeout expired
+        RELAY_EVENT_REASON_EXPIRED = 5,        // A retired client did not close in time
+        RELAY_EVENT_REASON_SEND_FAILED = 6,    // Writing failed
+        RELAY_EVENT_REASON_RECEIVE_FAILED = 7, // Reading failed
+        RELAY_EVENT_REASON_DENIED = 8,         // The accept filter refused the client
+    };
+
+    typedef struct
+    {
+        int kind;          // RELAY_EVENT_*
+        int reason;        // RELAY_EVENT_REASON_*
+        uint64_t clientId; // Accepted client, 0 for the peer's own connection
+        char *address;     // Remote "ip:port"
+    } RelayPeerEvent;
+
+    // Receives a peer's messages from relay_set_message_callback, on the library's dispatcher thread.
+    // Called with RELAY_OK and each message, then once with the status that ended the connection.
+    typedef void (*RelayMessageCallback)(uintptr_t context, int status, const char *data, size_t len, int urgent);
+
+    // Decides whether a server peer accepts a client, given its remote "ip:port" and the certificate or
+    // static key it presented (identityLen 0 if none). Returns 1 to accept it. Called on the accepting
+    // thread once the client's handshake completed.
+    typedef int (*RelayAcceptCallback)(uintptr_t context, const char *address, const char *identity, size_t identityLen);
+
     // Peer functions
     RelayPeer relay_create_peer(const char *id, const char *ip, int port, int isServer);
-    int relay_send_message(RelayPeer peer, const char *message);
+    RelayPeer relay_create_peer_from(const char *id, const char *ip, int port, int isServer, const char *localIp, int localPort); // Client peers connect from localIp:localPort; NULL/0 for any
+    RelayPeer relay_open_peer(const char *id, const char *ip, int port, int isServer, const char *localIp, int localPort, int *status); // As relay_create_peer_from; NULL on failure, with the reason in *status
+    RelayPeer relay_open_peer_with(const char *id, const char *ip, int port, int isServer, const RelayOpenOptions *options, int *status); // As relay_open_peer; options may be NULL
+    RelayPeer relay_open_peer_fd(const char *id, int fd, const char *address, const RelayOpenOptions *options, int *status); // Client peer on the connected stream socket fd, which it takes over; address is only reported
+    int relay_connect_memory(const char *address, int *fd); // Connects to the server peer at a "mem://" address; *fd is the caller's stream socket; returns a status
+    int relay_send_message(RelayPeer peer, const char *message); // Returns a status
+    int relay_send_urgent(RelayPeer peer, const char *message);  // Returns a status
+    int relay_send_unreliable(RelayPeer peer, const char *data, size_t len); // May be dropped or reordered over UDP; returns a status
+    uint64_t relay_get_fragments_lost(RelayPeer peer);                       // Fragments of unreliable messages that never arrived
+    int relay_send_bytes(RelayPeer peer, const char *data, size_t len); // Binary-safe relay_send_message; returns a status
+    int relay_wait_writable(RelayPeer peer, int64_t timeoutMs);         // RELAY_OK once a send would not block, RELAY_ERR_TIMEOUT if not within timeoutMs
+    int relay_send_batch(RelayPeer peer, const char **messages, int count, int compress); // Returns a status
+    void relay_set_compression_dictionary(RelayPeer peer, const char *dictionary, size_t len);
+    void relay_set_compression_level(RelayPeer peer, int level); // 1 (fastest) to 9 (smallest), clamped
+    int relay_get_compression_level(RelayPeer peer);
+    void relay_set_compression_threshold(RelayPeer peer, uint64_t bytes); // 0 turns per-message compression off
+    void relay_get_compression_stats(RelayPeer peer, uint64_t *messages, uint64_t *bytesIn, uint64_t *bytesOut);
+    int relay_send_tracked(RelayPeer peer, const char *message, uint64_t receiptId); // Returns a status
+    int relay_send_tracked_bytes(RelayPeer peer, const char *data, size_t len, uint64_t receiptId); // Binary-safe relay_send_tracked; returns a status
+    int relay_poll_receipts(RelayPeer peer, uint64_t *ids, int maxIds, int64_t timeoutMs); // Receipt count, or RELAY_ERR_DISCONNECTED
+    void relay_set_ack_batching(RelayPeer peer, int count, int64_t intervalMs); // Acknowledge up to count consecutive tracked messages per receipt, each waiting at most intervalMs (0 for no limit)
+    void relay_flush_acks(RelayPeer peer, int dueOnly); // Send batched receipts, only those due by the interval if dueOnly
     const char *relay_receive_message(RelayPeer peer); // Caller must free
+    char *relay_receive(RelayPeer peer, int *status, int *urgent); // NULL if no message, with the reason in status; urgent is set to 1 for urgent messages; caller must free
+    int relay_receive_bytes(RelayPeer peer, char **data, size_t *len, int *urgent); // Binary-safe relay_receive; RELAY_OK with *data set (caller must free), otherwise the reason none was received
+    int relay_receive_bytes_within(RelayPeer peer, int64_t timeoutMs, char **data, size_t *len, int *urgent); // As relay_receive_bytes, RELAY_ERR_TIMEOUT if nothing arrives within timeoutMs (negative to block)
+    int relay_receive_bytes_from(RelayPeer peer, int64_t timeoutMs, char **data, size_t *len, int *urgent, uint64_t *clientId); // As relay_receive_bytes_within, setting clientId to the accepted client that sent the message, 0 for a client peer's own connection
+    int relay_peek_message(RelayPeer peer, char **data, size_t *len); // Returns 1 if a message is available; caller must free *data
     void relay_close_peer(RelayPeer peer);
+    void relay_shutdown_peer_write(RelayPeer peer);
+    int relay_close_peer_gracefully(RelayPeer peer, int64_t timeoutMs); // Returns a status
     void relay_destroy_peer(RelayPeer peer);
-    void relay_accept_clients(RelayPeer peer, int maxClients);
+    void relay_set_peer_events(RelayPeer peer, int enabled); // Starts or stops recording lifecycle events
+    int relay_take_peer_events(RelayPeer peer, RelayPeerEvent **events, int *count); // Returns a status; free *events with relay_free_peer_events
+    void relay_free_peer_events(RelayPeerEvent *events, int count);
+    int relay_set_message_callback(RelayPeer peer, RelayMessageCallback callback, uintptr_t context); // NULL callback removes it; returns once the old one is not running
+    int relay_accept_clients(RelayPeer peer, int maxClients, int *accepted); // Returns a status, with the clients accepted in accepted
+    void relay_stop_accepting(RelayPeer peer);
+    void relay_set_draining(RelayPeer peer, int draining); // Turns away clients accepted from now on, until called with 0
+    int relay_accept_client(RelayPeer peer, int64_t timeoutMs); // RELAY_OK if a client was accepted, 0 if none arrived in time, or RELAY_ERR_LISTENER_CLOSED
+    int relay_accept_client_id(RelayPeer peer, int64_t timeoutMs, uint64_t *clientId); // Like relay_accept_client, reporting the accepted client's ID in clientId
+    int relay_send_to_client(RelayPeer peer, uint64_t clientId, const char *data, size_t len); // Returns a status; RELAY_ERR_NOT_FOUND for an unknown client
+    int relay_send_to_client_unreliable(RelayPeer peer, uint64_t clientId, const char *data, size_t len); // Like relay_send_unreliable, for one client
+    int relay_close_client(RelayPeer peer, uint64_t clientId); // Returns a status; RELAY_ERR_NOT_FOUND for an unknown client
+    int relay_is_client_connected(RelayPeer peer, uint64_t clientId);
+    int relay_is_client_drained(RelayPeer peer, uint64_t clientId); // 1 once the client is closed and every message it sent was received, or if it is unknown
+    char *relay_get_client_address(RelayPeer peer, uint64_t clientId); // Empty if unknown; caller must free
+    char *relay_get_local_address(RelayPeer peer);  // Address the peer's socket is bound to, empty if unknown; caller must free
+    char *relay_get_remote_address(RelayPeer peer); // Address a client peer is connected to, empty for a server peer or if unknown; caller must free
+    int relay_get_client_count(RelayPeer peer);
+    uint32_t relay_open_stream(RelayPeer peer); // Stream ID, 0 on failure
+    uint32_t relay_open_named_stream(RelayPeer peer, const char *name, size_t len); // Like relay_open_stream; the server receives name as the data of the RELAY_STREAM_OPEN frame
+    int relay_send_stream_frame(RelayPeer peer, uint32_t streamId, int kind, const char *data, size_t len); // Returns a status
+    int relay_receive_stream_frame(RelayPeer peer, int64_t timeoutMs, uint32_t *streamId, int *kind, char **data, size_t *len); // RELAY_OK with *data set (caller must free), 0 if none in time, or RELAY_ERR_DISCONNECTED
+    int relay_close_expired_clients(RelayPeer peer, int64_t maxAgeMs, int64_t graceMs, const char *reason); // Returns the clients sent a goodbye
+    char *relay_get_goodbye_reason(RelayPeer peer); // Caller must free
     int64_t relay_get_peer_latency(RelayPeer peer);
     int relay_get_peer_messages_sent(RelayPeer peer);
     int relay_get_peer_messages_received(RelayPeer peer);
     size_t relay_get_peer_bytes_sent(RelayPeer peer);
     size_t relay_get_peer_bytes_received(RelayPeer peer);
     int relay_is_peer_connected(RelayPeer peer);
-    const char **relay_get_recent_errors(int *count);
+    int relay_is_peer_authenticated(RelayPeer peer); // 1 if the peer's TLS, Noise or shared-secret connections prove who the remote end is
+    int relay_rotate_keys(RelayPeer peer); // Rekeys every open TLS 1.3 or Noise connection in band; returns a status, RELAY_ERR_NOT_ENCRYPTED if a connection cannot rekey
+    int relay_set_accept_filter(RelayPeer peer, RelayAcceptCallback filter, uintptr_t context); // Closes clients filter refuses, recording RELAY_EVENT_REJECTED; NULL accepts all
+    int relay_get_remote_identity(RelayPeer peer, uint64_t clientId, char **data, size_t *len); // Certificate or static key of the remote end of an accepted client, or of a client peer's connection for clientId 0; RELAY_OK with *data set (caller must free), RELAY_ERR_NOT_FOUND if there is none
+    void relay_set_circuit_breaker(RelayPeer peer, int failureThreshold, int64_t cooldownMs);
+    void relay_set_replay_protection(RelayPeer peer, int64_t windowMs);
+    uint64_t relay_get_replays_rejected(RelayPeer peer);
+    void relay_set_frame_resync(RelayPeer peer, int enabled);
+    uint64_t relay_get_frame_desyncs(RelayPeer peer);
+    void relay_set_read_idle_timeout(RelayPeer peer, int64_t timeoutMs);
+    void relay_set_max_message_size(RelayPeer peer, uint64_t bytes); // Largest fragmented message reassembled; 0 for the default of 64 MiB
+    int relay_configure_peer(RelayPeer peer, const RelayPeerOptions *options); // Returns a status
+    int relay_reconnect_peer(RelayPeer peer, const char *ip, int port, const char *localIp, int localPort); // Returns a status
+    int relay_set_peer_cork(RelayPeer peer, int enabled);                      // Returns a status
+    int relay_get_peer_path_mtu(RelayPeer peer);                               // -1 if unknown
+    int relay_get_peer_buffer_sizes(RelayPeer peer, int *sendBytes, int *recvBytes); // Returns a status
+    int relay_grow_receive_buffer(RelayPeer peer, int64_t bytes);              // Returns a status
+    char **relay_get_recent_errors(int *count); // Oldest first; free with relay_free_recent_errors
+    void relay_free_recent_errors(char **errors, int count);
 
     // PeerManager functions
     RelayPeerManager relay_create_peer_manager();
     void relay_add_peer(RelayPeerManager mgr, RelayPeer peer);
-    int relay_relay_message(RelayPeerManager mgr, const char *sourceId, const char *targetId, const char *message);
+    int relay_remove_peer(RelayPeerManager mgr, const char *peerId); // Returns a status
+    int relay_relay_message(RelayPeerManager mgr, const char *sourceId, const char *targetId, const char *message); // Returns a status
+    int relay_relay_bytes(RelayPeerManager mgr, const char *sourceId, const char *targetId, const char *data, size_t len); // Binary-safe relay_relay_message; returns a status
     void relay_destroy_peer_manager(RelayPeerManager mgr);
     int relay_broadcast(RelayPeerManager mgr, const char *message);
+    int relay_broadcast_from(RelayPeerManager mgr, const char *sourceId, const char *message);
+    int relay_broadcast_to(RelayPeerManager mgr, const char *peerId, const char *message); // Returns a status
+    int relay_broadcast_to_bytes(RelayPeerManager mgr, const char *peerId, const char *data, size_t len); // Binary-safe relay_broadcast_to; returns a status
+    int relay_broadcast_report(RelayPeerManager mgr, const char *sourceId, const char *message, RelayDeliveryFailure **failures, int *count); // Free *failures with relay_free_delivery_failures
+    int relay_broadcast_report_bytes(RelayPeerManager mgr, const char *sourceId, const char *data, size_t len, RelayDeliveryFailure **failures, int *count); // Binary-safe relay_broadcast_report
+    void relay_free_delivery_failures(RelayDeliveryFailure *failures, int count);
+    void relay_add_relay_rule(RelayPeerManager mgr, const char *fromId, const char *toId, int allowed);
+    int relay_is_relay_allowed(RelayPeerManager mgr, const char *fromId, const char *toId);
+    void relay_set_require_authenticated_relays(RelayPeerManager mgr, int required); // Refuse relays from peers relay_is_peer_authenticated rejects
 
     // PeerDiscovery functions
-    RelayPeerDiscovery relay_create_peer_discovery(const char *multicastIp, int multicastPort, const char *localIp);
+    RelayPeerDiscovery relay_create_peer_discovery(const char *multicastIp, int multicastPort, const char *localIp);  // NULL on failure
+    RelayPeerDiscovery relay_open_peer_discovery(const char *multicastIp, int multicastPort, const char *localIp, int *status); // NULL on failure, with the reason in status
     void relay_start_discovery(RelayPeerDiscovery discovery);
     void relay_stop_discovery(RelayPeerDiscovery discovery);
     const char **relay_get_discovered_peers(RelayPeerDiscovery discovery, int *count); // Caller must free
+    const char **relay_get_discovered_peers_page(RelayPeerDiscovery discovery, int offset, int limit, int *count, int *total); // Caller must free
+    int relay_set_announcement_metadata(RelayPeerDiscovery discovery, const char **keys, const char **values, int count);
+    char *relay_get_discovered_peer_metadata(RelayPeerDiscovery discovery, const char *peerAddr); // "key=value" lines, NULL if none; caller must free
+    char *relay_get_discovered_peer_interface(RelayPeerDiscovery discovery, const char *peerAddr); // Receiving interface name, NULL if unknown; caller must free
     void relay_destroy_peer_discovery(RelayPeerDiscovery discovery);
 
 #ifdef __cplusplus
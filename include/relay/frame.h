@@ -0,0 +1,284 @@
+#ifndef RELAY_FRAME_H
+#define RELAY_FRAME_H
+
+#include <cstdint>
+#include <cstddef>
+#include <optional>
+#include <string>
+#include <string_view>
+#include <vector>
+
+/**
+ * @file frame.h
+ * @brief Defines the wire frames exchanged between TCP peers.
+ *
+ * Every frame starts with an 8-byte header: the sync marker 0xFE 0xED, a type
+ * byte, a flags byte and the payload length as a 32-bit big-endian integer,
+ * followed by the payload. The marker lets a receiver notice when it has lost
+ * track of frame boundaries and find the next frame (see resyncFrame()); 0xFE
+ * never occurs in UTF-8 text, so text payloads cannot hold a false marker.
+ */
+
+namespace relay
+{
+
+    /**
+     * @enum FrameType
+     * @brief Identifies what a frame's payload holds.
+     */
+    enum class FrameType : uint8_t
+    {
+        MESSAGE = 1, ///< A single message.
+        BATCH = 2,   ///< Several messages, each prefixed with its 32-bit big-endian length.
+        RECEIPT = 3, ///< Acknowledges tracked messages (see makeReceipt()).
+        GOODBYE = 4, ///< Announces that the sender is closing the connection; carries the reason as text.
+        URGENT = 5,  ///< A single message the receiver returns ahead of those already queued.
+        STREAM = 6,  ///< A frame of one multiplexed stream (see encodeStreamFrame()).
+        FRAGMENT = 7, ///< A piece of a message too large for one frame (see encodeFragment()).
+    };
+
+    /**
+     * @brief Frame flag bits.
+     */
+    enum FrameFlags : uint8_t
+    {
+        FRAME_COMPRESSED = 0x01, ///< The payload is zlib-compressed (see compressPayload()).
+        FRAME_STAMPED = 0x02,    ///< The payload starts with a send timestamp and nonce (see stampFrame()).
+        FRAME_TRACKED = 0x04,    ///< The payload starts with a tracking ID (see trackFrame()).
+        FRAME_UNRELIABLE = 0x08, ///< A UDP connection may drop or reorder the frame (see udp.h); TCP ignores it.
+    };
+
+    constexpr char FRAME_MARKER[] = "\xFE\xED";      ///< Sync marker opening every frame.
+    constexpr size_t FRAME_MARKER_SIZE = 2;          ///< Bytes in FRAME_MARKER.
+    constexpr size_t FRAME_HEADER_SIZE = 8;          ///< Marker, type, flags and 32-bit length.
+    constexpr uint32_t MAX_FRAME_SIZE = 16u << 20;    ///< Largest accepted payload, in bytes.
+
+    /**
+     * @struct Frame
+     * @brief A decoded frame.
+     */
+    struct Frame
+    {
+        FrameType type = FrameType::MESSAGE;
+        uint8_t flags = 0;
+        std::string payload;
+    };
+
+    /**
+     * @brief Encodes a frame for the wire.
+     * @param frame Frame to encode.
+     * @return Header followed by the payload.
+     */
+    std::string encodeFrame(const Frame &frame);
+
+    /**
+     * @brief Decodes the first frame in a buffer.
+     *
+     * @param buffer Bytes read from the connection. A decoded frame is removed from the front.
+     * @param corrupt Set to true if the buffer does not start with a valid frame header: the
+     *                marker is missing, or the type or length is invalid.
+     * @return The frame, or an empty optional if the buffer does not hold a whole frame yet.
+     */
+    std::optional<Frame> decodeFrame(std::string &buffer, bool &corrupt);
+
+    /**
+     * @brief Skips to the next frame marker after a corrupt header.
+     *
+     * Discards bytes from the front of the buffer up to the next FRAME_MARKER past the first
+     * byte. If there is none, the buffer is emptied except for a trailing byte that could
+     * start a marker split across reads.
+     *
+     * @param buffer Bytes read from the connection, starting with a corrupt header.
+     * @return True if the buffer now starts with a marker.
+     */
+    bool resyncFrame(std::string &buffer);
+
+    /**
+     * @brief Builds the frame payload for a batch of messages.
+     * @param messages Messages in send order.
+     * @return The length-prefixed messages.
+     */
+    std::string encodeBatch(const std::vector<std::string> &messages);
+
+    /**
+     * @brief Splits a batch payload back into its messages.
+     * @param payload Uncompressed batch payload.
+     * @param messages Receives the messages in send order.
+     * @return True if the payload was well formed, false otherwise.
+     */
+    bool decodeBatch(const std::string &payload, std::vector<std::string> &messages);
+
+    /**
+     * @enum StreamFrameKind
+     * @brief What a stream frame does to its stream.
+     */
+    enum class StreamFrameKind : uint8_t
+    {
+        OPEN = 0,   ///< Opens the stream; sent by the client end before anything else, carrying the stream's name.
+        DATA = 1,   ///< Carries one message.
+        WINDOW = 2, ///< Lets the other end send more; carries a 32-bit big-endian byte count.
+        CLOSE = 3,  ///< The sender will send no more on the stream.
+        RESET = 4,  ///< The stream's connection was lost. Never sent; reported by Peer::receiveStreamFrame().
+    };
+
+    /**
+     * @struct StreamFrame
+     * @brief A decoded stream frame.
+     */
+    struct StreamFrame
+    {
+        uint32_t streamId = 0;
+        StreamFrameKind kind = StreamFrameKind::DATA;
+        std::string data;
+    };
+
+    constexpr size_t STREAM_HEADER_SIZE = 5; ///< 32-bit stream ID and kind byte.
+
+    /**
+     * @brief Builds the payload of a STREAM frame.
+     * @param frame Stream frame to encode.
+     * @return The stream ID and kind followed by the data.
+     */
+    std::string encodeStreamFrame(const StreamFrame &frame);
+
+    /**
+     * @brief Parses the payload of a STREAM frame.
+     * @param payload STREAM frame payload.
+     * @param frame Receives the stream frame.
+     * @return True if the payload was well formed, false otherwise.
+     */
+    bool decodeStreamFrame(const std::string &payload, StreamFrame &frame);
+
+    constexpr size_t FRAGMENT_HEADER_SIZE = 12;                   ///< 32-bit fragment index and 64-bit message size.
+    constexpr size_t FRAGMENT_DATA_SIZE = 1u << 20;               ///< Message bytes carried by each FRAGMENT frame.
+    constexpr size_t MAX_UNFRAGMENTED_SIZE = MAX_FRAME_SIZE - 64; ///< Largest message sent in one frame, leaving room for a stamp and tracking ID.
+
+    /**
+     * @brief Builds the payload of a FRAGMENT frame.
+     *
+     * A message larger than MAX_UNFRAGMENTED_SIZE is sent as consecutive FRAGMENT frames, each
+     * carrying up to FRAGMENT_DATA_SIZE bytes of it in order, numbered from 0.
+     *
+     * @param index Position of the fragment in the message, from 0.
+     * @param total Size of the whole message in bytes.
+     * @param data The fragment's bytes of the message.
+     * @return The index and total followed by the data.
+     */
+    std::string encodeFragment(uint32_t index, uint64_t total, std::string_view data);
+
+    /**
+     * @brief Parses the payload of a FRAGMENT frame.
+     * @param payload FRAGMENT frame payload.
+     * @param index Receives the fragment's position in the message.
+     * @param total Receives the size of the whole message.
+     * @param data Receives the fragment's bytes of the message.
+     * @return True if the payload was well formed, false otherwise.
+     */
+    bool decodeFragment(const std::string &payload, uint32_t &index, uint64_t &total, std::string &data);
+
+    constexpr size_t FRAME_STAMP_SIZE = 16; ///< 64-bit timestamp and 64-bit nonce.
+
+    /**
+     * @brief Prefixes a frame's payload with a send timestamp and nonce and sets FRAME_STAMPED.
+     *
+     * The stamp is applied after compression, so it is readable without decompressing.
+     *
+     * @param frame Frame to stamp.
+     * @param timestampMs Send time in milliseconds since the Unix epoch.
+     * @param nonce Value the sender never reuses on a connection.
+     */
+    void stampFrame(Frame &frame, int64_t timestampMs, uint64_t nonce);
+
+    /**
+     * @brief Removes the stamp added by stampFrame() and clears FRAME_STAMPED.
+     * @param frame Stamped frame.
+     * @param timestampMs Receives the send timestamp.
+     * @param nonce Receives the nonce.
+     * @return True if the frame carried a well-formed stamp, false otherwise.
+     */
+    bool unstampFrame(Frame &frame, int64_t &timestampMs, uint64_t &nonce);
+
+    constexpr size_t FRAME_TRACKING_SIZE = 8; ///< 64-bit tracking ID.
+
+    /**
+     * @brief Prefixes a frame's payload with a tracking ID and sets FRAME_TRACKED.
+     *
+     * A peer receiving a tracked message answers with a RECEIPT frame tracked with the same
+     * ID. Tracking is applied after compression and before stamping.
+     *
+     * @param frame Frame to track.
+     * @param trackingId ID the sender uses to match the receipt.
+     */
+    void trackFrame(Frame &frame, uint64_t trackingId);
+
+    /**
+     * @brief Removes the tracking ID added by trackFrame() and clears FRAME_TRACKED.
+     * @param frame Tracked frame.
+     * @param trackingId Receives the tracking ID.
+     * @return True if the frame carried a well-formed tracking ID, false otherwise.
+     */
+    bool untrackFrame(Frame &frame, uint64_t &trackingId);
+
+    constexpr uint64_t MAX_RECEIPT_RANGE = 1u << 16; ///< Most tracking IDs one cumulative receipt acknowledges.
+
+    /**
+     * @brief Makes a RECEIPT frame acknowledging the tracking IDs first to last.
+     *
+     * A receipt for a single ID is tracked with it and carries nothing else, as older peers
+     * expect. A cumulative receipt is tracked with last and its payload holds first as a 64-bit
+     * big-endian integer.
+     *
+     * @param first Lowest tracking ID acknowledged.
+     * @param last Highest tracking ID acknowledged, not below first.
+     */
+    Frame makeReceipt(uint64_t first, uint64_t last);
+
+    /**
+     * @brief Decodes a RECEIPT frame made by makeReceipt().
+     * @param frame Received RECEIPT frame, still tracked.
+     * @param first Receives the lowest tracking ID acknowledged.
+     * @param last Receives the highest tracking ID acknowledged.
+     * @return False if the frame is malformed or acknowledges more than MAX_RECEIPT_RANGE IDs.
+     */
+    bool parseReceipt(Frame &frame, uint64_t &first, uint64_t &last);
+
+    constexpr int MIN_COMPRESSION_LEVEL = 1; ///< Fastest zlib compression level.
+    constexpr int MAX_COMPRESSION_LEVEL = 9; ///< zlib level that compresses best; the default.
+
+    /**
+     * @brief Compresses a payload with zlib.
+     *
+     * The result is the uncompressed size as a 32-bit big-endian integer followed by
+     * the zlib stream.
+     *
+     * @param payload Payload to compress.
+     * @param compressed Receives the compressed payload.
+     * @param dictionary Preset dictionary of bytes likely to occur in the payload, or empty for none.
+     *                   The zlib stream records its Adler-32, so the receiver can tell a mismatch.
+     * @param level zlib compression level, from MIN_COMPRESSION_LEVEL (fastest) to MAX_COMPRESSION_LEVEL
+     *              (smallest output). The receiver does not need to know it.
+     * @return True on success, false otherwise.
+     */
+    bool compressPayload(const std::string &payload, std::string &compressed, const std::string &dictionary = "",
+                         int level = MAX_COMPRESSION_LEVEL);
+
+    /**
+     * @brief Returns the original size compressPayload() recorded in a compressed payload, or 0 if it is too short
+     *        to hold one.
+     */
+    uint64_t decompressedSize(const std::string &compressed);
+
+    /**
+     * @brief Reverses compressPayload().
+     * @param compressed Compressed payload.
+     * @param payload Receives the original payload.
+     * @param maxSize Largest original size accepted; a larger one is refused before any memory is allocated for it.
+     * @param dictionary The dictionary the payload was compressed with, or empty for none.
+     * @return True on success, false if the data is corrupt, over maxSize or needs a different dictionary.
+     */
+    bool decompressPayload(const std::string &compressed, std::string &payload, uint64_t maxSize,
+                           const std::string &dictionary = "");
+
+} // namespace relay
+
+#endif
@@ -0,0 +1,74 @@
+#ifndef RELAY_INET_ADDRESS_H
+#define RELAY_INET_ADDRESS_H
+
+#include <string>
+#include <sys/socket.h>
+#include <netinet/in.h>
+
+namespace relay
+{
+
+    /**
+     * @struct InetAddress
+     * @brief An IPv4 or IPv6 socket address.
+     */
+    struct InetAddress
+    {
+        sockaddr_storage storage{};
+        socklen_t length = 0; ///< Size of the address in storage, 0 for none.
+
+        int family() const { return storage.ss_family; }
+        sockaddr *get() { return reinterpret_cast<sockaddr *>(&storage); }
+        const sockaddr *get() const { return reinterpret_cast<const sockaddr *>(&storage); }
+    };
+
+    /**
+     * @brief Parses an IPv4 or IPv6 address and a port.
+     *
+     * IPv6 addresses may be bracketed, as in "[::1]", and may name a zone, as in "fe80::1%eth0".
+     *
+     * @param ip The address, such as "192.0.2.1", "::" or "[2001:db8::1]".
+     * @param port The port.
+     * @param address Set to the parsed address.
+     * @return True if ip is an IPv4 or IPv6 address.
+     */
+    bool parseInetAddress(const std::string &ip, int port, InetAddress &address);
+
+    /**
+     * @brief Formats an IPv4 or IPv6 socket address as "192.0.2.1:80" or "[2001:db8::1]:80".
+     *
+     * An IPv4-mapped IPv6 address, as a dual-stack socket reports IPv4 peers, is formatted as IPv4.
+     *
+     * @return The formatted address, or an empty string for another family.
+     */
+    std::string formatInetAddress(const sockaddr *address);
+
+    /**
+     * @struct BindOptions
+     * @brief Settings of a socket that a server binds, applied before bind().
+     */
+    struct BindOptions
+    {
+        bool ipv6Only = false;     ///< IPV6_V6ONLY: an AF_INET6 socket bound to "::" refuses IPv4 traffic instead of serving both families.
+        bool reuseAddress = false; ///< SO_REUSEADDR: bind while connections of an earlier socket on the port linger in TIME_WAIT.
+        bool reusePort = false;    ///< SO_REUSEPORT: share the port with other sockets that set it, such as a restarting server's successor.
+    };
+
+    /**
+     * @brief Applies options to a socket of family that is not bound yet.
+     * @return True on success, false with errno set.
+     */
+    bool applyBindOptions(int fd, int family, const BindOptions &options);
+
+    /**
+     * @brief Creates a socket for an address family.
+     * @param family AF_INET or AF_INET6.
+     * @param type SOCK_STREAM or SOCK_DGRAM.
+     * @param options Applied with applyBindOptions().
+     * @return The socket, or -1 with errno set.
+     */
+    int openInetSocket(int family, int type, const BindOptions &options = {});
+
+} // namespace relay
+
+#endif
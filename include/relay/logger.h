@@ -7,6 +7,7 @@
 #include <string>
 #include <memory>
 #include <map>
+#include <vector>
 
 namespace relay
 {
@@ -70,7 +71,7 @@ namespace relay
         Logger(const Logger &) = delete;
         Logger &operator=(const Logger &) = delete;
 
-        std::mutex mutex_;
+        mutable std::mutex mutex_;
         LogLevel logLevel_;
         std::ofstream logFile_;
         bool fileLoggingEnabled_;
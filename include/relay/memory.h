@@ -0,0 +1,83 @@
+#ifndef RELAY_MEMORY_H
+#define RELAY_MEMORY_H
+
+#include <memory>
+#include <string>
+
+namespace relay
+{
+
+    /// Prefix of the address SocketWrapper::initialize() takes for an in-process connection, as in "mem://tests/server".
+    constexpr char MEMORY_SOCKET_PREFIX[] = "mem://";
+
+    /**
+     * @brief Checks whether an address names an in-process listener.
+     */
+    bool isMemoryAddress(const std::string &address);
+
+    struct MemoryListenerState;
+
+    /**
+     * @class MemoryListener
+     * @brief Accepts in-process connections under a name, for tests that must not touch the network.
+     *
+     * Names live only in the process that registered them, so ports are never taken and parallel
+     * tests cannot collide unless they choose the same name. Each connection is a socketpair, so a
+     * SocketWrapper uses it in place of a TCP socket.
+     */
+    class MemoryListener
+    {
+    public:
+        /**
+         * @brief Registers a name and starts accepting connections under it.
+         * @param name Name connectMemory() connects to.
+         * @param error Set to EADDRINUSE if another listener holds the name, EINVAL if it is empty,
+         *              or the errno of a failed pipe.
+         * @return The listener, or nullptr on failure.
+         */
+        static std::unique_ptr<MemoryListener> open(const std::string &name, int &error);
+
+        /**
+         * @brief Stops the listener and frees its name.
+         */
+        ~MemoryListener();
+
+        /**
+         * @brief Gets a descriptor that polls readable while a connection waits for accept().
+         */
+        int readyFd() const;
+
+        /**
+         * @brief Sets how many connections may wait for accept(); later ones are refused.
+         */
+        void setBacklog(int backlog);
+
+        /**
+         * @brief Waits for a connection.
+         * @return The server end of the connection, which the caller owns, or -1 once the listener is stopped.
+         */
+        int accept();
+
+        /**
+         * @brief Frees the name, refuses new connections and wakes blocked accept() calls, closing
+         *        the connections that were waiting for one.
+         */
+        void stop();
+
+    private:
+        explicit MemoryListener(std::shared_ptr<MemoryListenerState> state);
+        std::shared_ptr<MemoryListenerState> state_;
+    };
+
+    /**
+     * @brief Opens an in-process connection to a listener.
+     * @param name Name the listener registered.
+     * @param error Set to ECONNREFUSED if no listener holds the name or its backlog is full, or to
+     *              the errno of a failed socketpair.
+     * @return The client end of the connection, which the caller owns, or -1 on failure.
+     */
+    int connectMemory(const std::string &name, int &error);
+
+} // namespace relay
+
+#endif
@@ -0,0 +1,97 @@
+#ifndef RELAY_MESSAGE_DISPATCHER_H
+#define RELAY_MESSAGE_DISPATCHER_H
+
+#include "peer.h"
+#include <condition_variable>
+#include <functional>
+#include <mutex>
+#include <string>
+#include <thread>
+#include <unordered_map>
+
+namespace relay
+{
+
+    /**
+     * @brief Callback receiving a peer's messages. Called with ReceiveStatus::OK and each message,
+     * then once with the status that ended the connection, after which it is unsubscribed.
+     */
+    using MessageHandler = std::function<void(ReceiveStatus status, const std::string &message, bool urgent)>;
+
+    /**
+     * @class MessageDispatcher
+     * @brief Receives the messages of many peers on a single thread and passes them to handlers.
+     *
+     * The dispatcher polls the connections of every subscribed peer at once, so an application with
+     * hundreds of peers does not need a receiving thread for each. Handlers run on the dispatcher
+     * thread one at a time and should return quickly, since a slow handler delays every peer.
+     * This class is thread-safe.
+     */
+    class MessageDispatcher
+    {
+    public:
+        /**
+         * @brief Constructor for the MessageDispatcher. The thread starts with the first subscription.
+         */
+        MessageDispatcher() = default;
+
+        /**
+         * @brief Destructor for the MessageDispatcher. Stops the dispatcher thread.
+         */
+        ~MessageDispatcher();
+
+        /**
+         * @brief Passes every message the peer receives to handler, replacing any previous handler.
+         *
+         * When called off the dispatcher thread it returns once the previous handler, if any, is no
+         * longer running.
+         * @param peer The peer to receive from. It must stay alive until it is unsubscribed.
+         * @param handler The handler to call.
+         */
+        void subscribe(Peer *peer, MessageHandler handler);
+
+        /**
+         * @brief Stops passing the peer's messages to its handler.
+         *
+         * When called off the dispatcher thread it returns once the handler is no longer running,
+         * so the peer can then be destroyed.
+         * @param peer The peer to stop receiving from.
+         * @return False if the peer was not subscribed.
+         */
+        bool unsubscribe(Peer *peer);
+
+    private:
+        /**
+         * @brief Dispatches messages until the dispatcher is destroyed.
+         */
+        void run();
+
+        /**
+         * @brief Waits until the handler for peer is not running, unless called from the dispatcher thread.
+         * @param lock Lock on mutex_, held by the caller.
+         * @param peer The peer whose handler to wait for.
+         */
+        void awaitIdleLocked(std::unique_lock<std::mutex> &lock, Peer *peer);
+
+        /**
+         * @struct Subscription
+         * @brief A subscribed peer's handler.
+         */
+        struct Subscription
+        {
+            MessageHandler handler; ///< Handler for the peer's messages.
+            uint64_t generation;    ///< Distinguishes a replaced handler from the one that replaced it.
+        };
+
+        std::mutex mutex_;                                     ///< Mutex for thread safety.
+        std::condition_variable idle_;                         ///< Signals that a handler returned.
+        std::unordered_map<Peer *, Subscription> subscribers_; ///< Subscribed peers.
+        uint64_t generation_ = 0;                              ///< Last generation handed out.
+        Peer *dispatching_ = nullptr;                          ///< Peer whose handler is running, if any.
+        std::thread thread_;                                   ///< The dispatcher thread.
+        bool stopping_ = false;                                ///< Set to stop the thread.
+    };
+
+} // namespace relay
+
+#endif // RELAY_MESSAGE_DISPATCHER_H
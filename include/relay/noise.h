@@ -0,0 +1,64 @@
+#ifndef RELAY_NOISE_H
+#define RELAY_NOISE_H
+
+#include "secure_channel.h"
+#include <string>
+#include <vector>
+
+namespace relay
+{
+
+    /// Size in bytes of the Curve25519 keys NoiseContext uses.
+    constexpr size_t NOISE_KEY_SIZE = 32;
+
+    /**
+     * @struct NoiseSettings
+     * @brief Configuration of a NoiseContext.
+     */
+    struct NoiseSettings
+    {
+        std::string staticPrivateKey;              ///< Raw X25519 private key, NOISE_KEY_SIZE bytes.
+        std::vector<std::string> remoteStaticKeys; ///< Raw X25519 public keys the remote end must hold one of; empty accepts any.
+    };
+
+    /**
+     * @class NoiseContext
+     * @brief ChannelSecurity that runs the Noise protocol framework on a peer's connections.
+     *
+     * Connecting ends use Noise_IK_25519_ChaChaPoly_SHA256 when exactly one remote static key is
+     * pinned, since they then know the accepting end's key in advance, and
+     * Noise_XX_25519_ChaChaPoly_SHA256 otherwise; accepting ends take either. Handshake and
+     * transport messages are sent with a 2-byte big-endian length, as the Noise specification
+     * suggests. Each channel's remoteIdentity() is the remote end's raw static public key. This
+     * class is thread-safe.
+     */
+    class NoiseContext : public ChannelSecurity
+    {
+    public:
+        /**
+         * @brief Creates the context.
+         * @param settings The configuration.
+         * @throws std::invalid_argument if a key has the wrong size or the private key is unusable.
+         */
+        explicit NoiseContext(NoiseSettings settings);
+
+        std::unique_ptr<SecureChannel> handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const override;
+
+        /**
+         * @brief Returns true if remote static keys are pinned, since any other key is then refused.
+         */
+        bool authenticatesPeer() const override;
+
+        /**
+         * @brief Gets the raw X25519 public key of the static private key.
+         */
+        const std::string &getPublicKey() const;
+
+    private:
+        NoiseSettings settings_;
+        std::string publicKey_;
+    };
+
+} // namespace relay
+
+#endif
@@ -6,7 +6,15 @@
 #include <chrono>
 #include <optional>
 #include <queue>
+#include <deque>
+#include <vector>
+#include <unordered_map>
+#include <map>
+#include <utility>
+#include <functional>
+#include <atomic>
 #include "../relay/socket_wrapper.h"
+#include "../relay/frame.h"
 
 /**
  * @file peer.h
@@ -16,6 +24,74 @@
 namespace relay
 {
 
+    /**
+     * @enum ReceiveStatus
+     * @brief Why Peer::receiveMessage() did or did not return a message.
+     */
+    enum class ReceiveStatus
+    {
+        OK,     ///< A message was received.
+        FAILED, ///< Nothing was received, for example on a read timeout or a dropped frame.
+        CLOSED, ///< The connection is closed.
+        DESYNC, ///< The connection was closed because frame boundaries were lost.
+        IDLE,    ///< Nothing arrived within the read idle timeout; the connection stays open.
+        TIMEOUT, ///< Nothing arrived within the wait passed to receiveMessage().
+    };
+
+    constexpr size_t URGENT_READ_AHEAD = 64; ///< Frames read past the next message while looking for urgent ones.
+    constexpr size_t MAX_PEER_EVENTS = 256;  ///< Lifecycle events kept for takeEvents(); older ones are dropped.
+    constexpr std::chrono::milliseconds RECEIVE_WAIT_SLICE{100}; ///< Longest a receive waits before rechecking the peer's connections.
+    constexpr int DEFAULT_LISTEN_BACKLOG = 5; ///< Pending connections a server peer queues unless told otherwise.
+    constexpr uint64_t DEFAULT_MAX_MESSAGE_SIZE = 64u << 20; ///< Largest fragmented message reassembled unless told otherwise.
+    constexpr char DRAINING_REASON[] = "server draining";   ///< Goodbye reason a draining server sends clients it turns away.
+
+    /**
+     * @enum PeerEventKind
+     * @brief What happened to one of a peer's connections.
+     */
+    enum class PeerEventKind
+    {
+        CONNECTED,    ///< A client was accepted, or a client peer reconnected.
+        DISCONNECTED, ///< The connection closed without this end closing it.
+        ERROR,        ///< Sending or receiving on the connection failed.
+        REJECTED,     ///< A client was closed before being accepted; clientId is 0.
+    };
+
+    /**
+     * @enum PeerEventReason
+     * @brief Why a PeerEvent happened.
+     */
+    enum class PeerEventReason
+    {
+        NONE,           ///< A connection event needs no reason.
+        CLOSED,         ///< The remote end closed the connection or it dropped.
+        GOODBYE,        ///< The remote end said goodbye.
+        DESYNC,         ///< Frame boundaries were lost.
+        IDLE,           ///< Nothing arrived within the read idle timeout.
+        EXPIRED,        ///< A retired client did not close within its grace period.
+        SEND_FAILED,    ///< Writing to the connection failed.
+        RECEIVE_FAILED, ///< Reading from the connection failed.
+        DENIED,         ///< The accept filter refused the client.
+    };
+
+    /**
+     * @struct PeerEvent
+     * @brief A connection lifecycle event, recorded once setEventRecording() is enabled.
+     */
+    struct PeerEvent
+    {
+        PeerEventKind kind;
+        PeerEventReason reason = PeerEventReason::NONE;
+        uint64_t clientId = 0; ///< The accepted client, 0 for the peer's own connection.
+        std::string address;   ///< The remote address as "ip:port".
+    };
+
+    /**
+     * @brief Decides whether a server peer accepts a client, given its remote address ("ip:port") and
+     *        the identity its security handshake established (see SecureChannel::remoteIdentity()).
+     */
+    using AcceptFilter = std::function<bool(const std::string &address, const std::string &identity)>;
+
     /**
      * @class Peer
      * @brief Represents an individual peer in the P2P network.
@@ -86,13 +162,328 @@ namespace relay
          */
         bool sendMessage(const std::string &message);
 
+        /**
+         * @brief Sends several messages to this peer as a single batch frame.
+         *
+         * The receiver splits the batch back into messages, which receiveMessage() then returns
+         * one at a time in send order. Compressing the whole batch at once compresses many small,
+         * similar messages far better than compressing each one.
+         *
+         * @param messages The messages to be sent.
+         * @param compress True to zlib-compress the batch.
+         * @return True if the batch was successfully sent, false otherwise.
+         */
+        bool sendBatch(const std::vector<std::string> &messages, bool compress);
+
+        /**
+         * @brief Sends an urgent message to this peer.
+         *
+         * The message uses its own frame type, and the receiver returns it from receiveMessage()
+         * ahead of any messages it has already received but not yet returned, including up to
+         * URGENT_READ_AHEAD frames waiting on its connections. It is written at once, after
+         * the frame being written, if any.
+         *
+         * @param message The message to be sent.
+         * @return True if the message was successfully sent, false otherwise.
+         */
+        bool sendUrgent(const std::string &message);
+
+        /**
+         * @brief Sends a message that a UDP connection may drop or deliver out of order, for data
+         *        such as positions that the next message replaces anyway.
+         *
+         * The frame is flagged FRAME_UNRELIABLE, so a connection set up with
+         * SocketWrapper::useUdpTransport() sends it without retransmission. Over TCP, a channel
+         * set up by a ChannelSecurity, or with a replay window (which would take a message
+         * overtaking others for a replay of them), it is sent like sendMessage().
+         *
+         * @param message The message to be sent.
+         * @return True if the message was handed to the connection, false otherwise.
+         */
+        bool sendUnreliable(const std::string &message);
+
+        /**
+         * @brief Sets the preset dictionary for compressed batches sent to and received from this peer.
+         *
+         * Priming zlib with bytes that recur across messages, such as common JSON keys, makes
+         * small batches compress far better. Both ends must set the same dictionary; a compressed
+         * batch made with a different one (or none) cannot be read and is dropped.
+         *
+         * @param dictionary The dictionary, or empty to compress without one.
+         */
+        void setCompressionDictionary(const std::string &dictionary);
+
+        /**
+         * @brief Sets the zlib level used to compress batches sent to this peer.
+         *
+         * Lower levels use less CPU, higher ones less bandwidth. Only the sender's level matters.
+         *
+         * @param level Level from MIN_COMPRESSION_LEVEL to MAX_COMPRESSION_LEVEL; values outside are clamped.
+         */
+        void setCompressionLevel(int level);
+
+        /**
+         * @brief Gets the zlib level used to compress batches sent to this peer.
+         * @return The compression level, MAX_COMPRESSION_LEVEL unless changed.
+         */
+        int getCompressionLevel() const;
+
+        /**
+         * @brief Compresses single-frame messages of at least bytes sent to this peer.
+         *
+         * Each message is compressed with the zlib level and dictionary used for batches and sent
+         * compressed only if that makes it smaller. The receiver inflates any compressed frame, so
+         * only the sender needs to enable it, but both ends must share the dictionary if one is set.
+         * Fragmented messages are sent as they are.
+         *
+         * @param bytes Smallest message to compress, 0 to turn compression off.
+         */
+        void setCompressionThreshold(uint64_t bytes);
+
+        /**
+         * @brief Gets how much per-message compression has saved.
+         * @param messages Set to the number of messages sent compressed.
+         * @param bytesIn Set to their total size before compression.
+         * @param bytesOut Set to their total size after compression.
+         */
+        void getCompressionStats(uint64_t &messages, uint64_t &bytesIn, uint64_t &bytesOut) const;
+
+        /**
+         * @brief Sends a message to this peer and asks it to acknowledge receipt.
+         *
+         * The receiving peer answers with a receipt as soon as it has read the message off its
+         * connection, before the application consumes it. Receipts are collected by pollReceipts().
+         * There is no retransmission: a message that is never acknowledged is simply lost.
+         *
+         * @param message The message to be sent.
+         * @param receiptId ID the receipt will carry, chosen by the caller.
+         * @return True if the message was successfully sent, false otherwise.
+         */
+        bool sendTracked(const std::string &message, uint64_t receiptId);
+
+        /**
+         * @brief Collects receipts for messages sent with sendTracked().
+         *
+         * If no receipt has arrived yet, waits up to timeout for data on the connection and reads
+         * one frame; any message it holds is kept for receiveMessage(). Only client peers receive
+         * receipts.
+         *
+         * @param timeout How long to wait for incoming data if no receipt is buffered.
+         * @param maxReceipts Largest number of receipt IDs to return; the rest stay buffered.
+         * @return The IDs of the receipts received, oldest first.
+         */
+        std::vector<uint64_t> pollReceipts(std::chrono::milliseconds timeout, size_t maxReceipts);
+
+        /**
+         * @brief Batches the receipts this peer sends for tracked messages it receives.
+         *
+         * Instead of answering each tracked message at once, the peer acknowledges a run of
+         * consecutive tracking IDs from one connection with a single cumulative receipt, sent once
+         * count messages are waiting for it or the oldest has waited interval. A tracking ID that
+         * does not continue the run sends the run first. Receipts that are due by interval go out
+         * when the next tracked message arrives or flushAcks() is called.
+         *
+         * @param count Messages acknowledged per receipt, at most MAX_RECEIPT_RANGE; 1 or less
+         *              acknowledges each message at once, the default.
+         * @param interval Longest a message waits for its receipt; 0 for no limit.
+         */
+        void setAckBatching(size_t count, std::chrono::milliseconds interval);
+
+        /**
+         * @brief Sends the cumulative receipts held back by setAckBatching().
+         * @param dueOnly Only send receipts whose oldest message has waited the batching interval.
+         */
+        void flushAcks(bool dueOnly);
+
+        /**
+         * @brief Configures the circuit breaker for sends to this peer.
+         *
+         * After failureThreshold consecutive send failures the circuit opens and sends fail
+         * immediately for the cooldown period. The first send after the cooldown is let
+         * through as a trial: success closes the circuit, failure re-opens it.
+         *
+         * @param failureThreshold Consecutive failures that open the circuit, or 0 to disable it.
+         * @param cooldown How long the circuit stays open before a trial send.
+         */
+        void setCircuitBreaker(int failureThreshold, std::chrono::milliseconds cooldown);
+
+        /**
+         * @brief Checks whether the circuit breaker is currently rejecting sends.
+         * @return True if the circuit is open and still cooling down, false otherwise.
+         */
+        bool isCircuitOpen() const;
+
+        /**
+         * @brief Enables or disables replay protection for frames exchanged with this peer.
+         *
+         * While enabled every frame sent is stamped with the send time and a nonce that only
+         * increases, and every frame received must carry a stamp within window of the local
+         * clock and a nonce higher than the last one seen on its connection. Frames that fail
+         * either check, or carry no stamp, are dropped and counted. Both ends must enable it.
+         *
+         * @param window Largest accepted difference between a frame's timestamp and the local clock, or 0 to disable.
+         */
+        void setReplayProtection(std::chrono::milliseconds window);
+
+        /**
+         * @brief Gets the number of received frames dropped by replay protection.
+         * @return The number of rejected frames.
+         */
+        uint64_t getReplaysRejected() const;
+
+        /**
+         * @brief Stamps a frame for replay protection if it is enabled.
+         *
+         * sendMessage() and sendBatch() do this themselves; it is for callers that write
+         * frames to this peer's client sockets directly.
+         *
+         * @param frame Frame about to be sent.
+         */
+        void prepareFrame(Frame &frame);
+
         /**
          * @brief Receives a message from this peer.
          *
+         * Messages left over from a received batch are returned before reading the socket again.
+         *
          * @return The received message.
          */
         std::string receiveMessage();
 
+        /**
+         * @brief Receives a message from this peer, reporting why none was received.
+         * @param message Set to the received message.
+         * @return ReceiveStatus::OK if a message was received, otherwise the reason there was none.
+         */
+        ReceiveStatus receiveMessage(std::string &message);
+
+        /**
+         * @brief Receives a message from this peer, reporting whether it was sent with sendUrgent().
+         *
+         * Urgent messages are returned before any other message already received.
+         *
+         * @param message Set to the received message.
+         * @param urgent Set to true if the message is urgent.
+         * @return ReceiveStatus::OK if a message was received, otherwise the reason there was none.
+         */
+        ReceiveStatus receiveMessage(std::string &message, bool &urgent);
+
+        /**
+         * @brief Receives a message from this peer like receiveMessage(), giving up if none arrives in time.
+         *
+         * @param message Set to the received message.
+         * @param urgent Set to true if the message is urgent.
+         * @param wait How long to wait for data to arrive, or a negative duration to wait as long as
+         *             receiveMessage(message, urgent) would.
+         * @return ReceiveStatus::OK if a message was received, TIMEOUT if nothing arrived in time,
+         *         otherwise the reason there was none.
+         */
+        ReceiveStatus receiveMessage(std::string &message, bool &urgent, std::chrono::milliseconds wait);
+
+        /**
+         * @brief Receives a message like receiveMessage(message, urgent, wait), reporting which
+         *        connection it arrived on.
+         * @param clientId Set to the ID acceptClient() reported for the client that sent the message,
+         *                 or 0 for a client peer's own connection.
+         */
+        ReceiveStatus receiveMessage(std::string &message, bool &urgent, std::chrono::milliseconds wait, uint64_t &clientId);
+
+        /**
+         * @brief Waits until the connection can take more data without blocking; for a server
+         *        peer, until every client connection can.
+         * @param timeout How long to wait.
+         * @return True if it can, false if the timeout expired or the peer has no open connection.
+         */
+        bool waitWritable(std::chrono::milliseconds timeout) const;
+
+        /**
+         * @brief Opens a stream multiplexed over the peer connection (TCP client only).
+         *
+         * Streams are carried in STREAM frames, so many of them share the one connection. The
+         * server end learns of the stream from receiveStreamFrame(), with the name as the data of
+         * the StreamFrameKind::OPEN frame. Streams do not survive reconnect().
+         *
+         * @param name Tells the server what the stream is for; need not be unique.
+         * @return The stream's ID, or 0 if it could not be opened.
+         */
+        uint32_t openStream(const std::string &name = "");
+
+        /**
+         * @brief Sends a frame on a stream opened by openStream() or reported by receiveStreamFrame().
+         *
+         * A server peer sends it on the client connection the stream arrived on. Once both ends
+         * have sent StreamFrameKind::CLOSE the stream is forgotten.
+         *
+         * @param streamId The stream's ID.
+         * @param kind StreamFrameKind::DATA, WINDOW or CLOSE.
+         * @param data The message for DATA, the byte count for WINDOW, empty for CLOSE.
+         * @return True if the frame was sent, false if the stream is unknown or closed, or the send failed.
+         */
+        bool sendStreamFrame(uint32_t streamId, StreamFrameKind kind, const std::string &data);
+
+        /**
+         * @brief Receives the next stream frame, waiting up to timeout for one to arrive.
+         *
+         * Frames of other types read meanwhile are kept for receiveMessage() and pollReceipts().
+         * A stream whose connection closed or was replaced is reported once with
+         * StreamFrameKind::RESET. A server peer gives each client's streams IDs unique across
+         * its clients, so they need not match the IDs the clients chose.
+         *
+         * @param frame Set to the stream frame received.
+         * @param timeout How long to wait for incoming data if no stream frame is buffered.
+         * @return ReceiveStatus::OK if frame was set, FAILED if none arrived in time, CLOSED if the connection is closed.
+         */
+        ReceiveStatus receiveStreamFrame(StreamFrame &frame, std::chrono::milliseconds timeout);
+
+        /**
+         * @brief Selects what happens when a connection's frame boundaries are lost; see
+         *        SocketWrapper::setFrameResync(). Applies to the current and future connections.
+         * @param enabled True to skip to the next frame, false, the default, to close the connection.
+         */
+        void setFrameResync(bool enabled);
+
+        /**
+         * @brief Counts the times this peer's connections lost track of frame boundaries.
+         * @return Desyncs across the peer's connections, including ones replaced by reconnect().
+         */
+        uint64_t getFrameDesyncs() const;
+
+        /**
+         * @brief Counts the fragments of unreliable messages that never arrived over UDP.
+         * @return Fragments lost across the peer's connections, including ones replaced by reconnect().
+         */
+        uint64_t getFragmentsLost() const;
+
+        /**
+         * @brief Fails receives with ReceiveStatus::IDLE once no frame of any kind has arrived for
+         *        timeout, without closing the connection. Every frame received restarts the timer.
+         * @param timeout How long a connection may be silent, 0 to disable.
+         */
+        void setReadIdleTimeout(std::chrono::milliseconds timeout);
+
+        /**
+         * @brief Sets the largest message this peer accepts, whole or reassembled from FRAGMENT frames.
+         *
+         * Messages larger than MAX_UNFRAGMENTED_SIZE are sent as fragments and reassembled by the
+         * receiver. One whose announced size exceeds the limit is dropped as its first fragment
+         * arrives, and a smaller one, or one in a batch, once its frame is read; either way the
+         * connection stays in step, the receive fails and a RECEIVE_FAILED error event is recorded.
+         *
+         * @param bytes The limit; 0 restores DEFAULT_MAX_MESSAGE_SIZE.
+         */
+        void setMaxMessageSize(uint64_t bytes);
+
+        /**
+         * @brief Returns the next message without consuming it.
+         *
+         * If no message is buffered one is read from the connection, waiting as long as
+         * receiveMessage() would. The next receiveMessage() returns the same message.
+         *
+         * @param message Receives a copy of the next message.
+         * @return True if a message is available, false otherwise.
+         */
+        bool peekMessage(std::string &message);
+
         /**
          * @brief Checks if the peer is connected.
          * @return True if the peers is connected, false otherwise.
@@ -101,37 +492,371 @@ namespace relay
 
         /**
          * @brief Closes the peer connection.
+         *
+         * The connections are shut down before mutex_ is taken, so a send or receive blocked on
+         * one returns first instead of holding up the close.
          */
         void closeConnection();
 
+        /**
+         * @brief Closes the peer connection without losing data already sent.
+         *
+         * Shuts down the write side so the remote end reads everything sent followed by
+         * end-of-file, waits up to timeout for the remote end to close its side, then closes.
+         * Anything received meanwhile is discarded. For a server peer every accepted client
+         * connection is closed this way.
+         *
+         * @param timeout How long to wait for the remote end to close.
+         * @return True if every remote end closed within the timeout, false otherwise.
+         */
+        bool closeGracefully(std::chrono::milliseconds timeout);
+
+        /**
+         * @brief Gracefully closes accepted client connections older than maxAge (TCP server only).
+         *
+         * Each such client is sent a goodbye frame carrying reason and its write side is shut
+         * down, so it reads everything sent before the goodbye and then end-of-file. The server
+         * can still receive what the client sent before it saw the goodbye; the connection is
+         * closed when the client closes it, or after grace at the latest. Call it periodically.
+         *
+         * @param maxAge Age, counted from acceptance, past which a client connection is retired.
+         * @param grace How long a retired client may take to close its side.
+         * @param reason Goodbye reason reported to the client by getGoodbyeReason().
+         * @return The number of client connections sent a goodbye by this call.
+         */
+        int closeExpiredClients(std::chrono::milliseconds maxAge, std::chrono::milliseconds grace, const std::string &reason);
+
+        /**
+         * @brief Gets the reason carried by the last goodbye frame received.
+         *
+         * A peer that receives a goodbye closes the connection it arrived on, after the messages
+         * sent before it.
+         *
+         * @return The goodbye reason, or empty if no goodbye was received.
+         */
+        std::string getGoodbyeReason() const;
+
+        /**
+         * @brief Shuts down the write side of the peer connection.
+         *
+         * The remote end reads end-of-file while this peer can still receive. For a server peer
+         * every accepted client connection is shut down.
+         */
+        void shutdownWrite();
+
+        /**
+         * @brief Applies socket settings to the peer connection.
+         *
+         * The settings are remembered and also applied to clients accepted later and to the
+         * socket created by reconnect(). Zero values leave the current setting unchanged.
+         *
+         * @param options Settings to apply.
+         * @return True if every setting was applied, false otherwise.
+         */
+        bool setSocketOptions(const SocketOptions &options);
+
+        /**
+         * @brief Sets how reconnect() establishes the peer's new socket.
+         *
+         * The peer's first socket is set up by its creator, which should apply the same settings.
+         *
+         * @param connectTimeout Longest wait for a client peer to connect, or 0 for the OS default.
+         * @param backlog Pending connections a server peer queues (the listen() backlog).
+         */
+        void setConnectionSetup(std::chrono::milliseconds connectTimeout, int backlog);
+
+        /**
+         * @brief Secures the peer's connections with security.
+         *
+         * The handshake runs on every client accepted later and on the socket created by
+         * reconnect(); a client whose handshake fails is closed. The peer's first socket is
+         * secured by its creator.
+         *
+         * @param security Sets up each connection's channel, or nullptr for plaintext.
+         */
+        void setSecurity(std::shared_ptr<const ChannelSecurity> security);
+
+        /**
+         * @brief Makes a server peer close clients that filter refuses, after their security handshake.
+         *
+         * The filter runs on the accepting thread without the peer's lock held. Each refused client
+         * is recorded as a REJECTED event with reason DENIED.
+         *
+         * @param filter The filter, or an empty function to accept every client.
+         */
+        void setAcceptFilter(AcceptFilter filter);
+
+        /**
+         * @brief Makes a server peer turn away the clients it accepts while draining for shutdown.
+         *
+         * Clients already accepted are not affected. A client whose connection runs a security
+         * handshake is told in its ConnectionHello and fails to connect; any other is sent a
+         * goodbye carrying DRAINING_REASON. Either way the server closes the connection and the
+         * client is not added.
+         *
+         * @param draining True to start draining, false to accept clients again.
+         */
+        void setDraining(bool draining);
+
+        /**
+         * @brief Checks whether setDraining() is turning clients away.
+         */
+        bool isDraining() const;
+
+        /**
+         * @brief Checks whether the peer's connections prove who the remote end is.
+         * @return True if the peer's security authenticates every connection it completes.
+         */
+        bool isAuthenticated() const;
+
+        /**
+         * @brief Rotates the session keys of every open connection in band; see SecureChannel::rekey().
+         * @return False with errno set if any connection's keys were not rotated: ENOTSUP if its
+         *         security has no keys to rotate, ENOTCONN if no connection is open.
+         */
+        bool rotateKeys();
+
+        /**
+         * @brief Gets what identifies the remote end of a client peer's connection; see
+         *        SocketWrapper::getRemoteIdentity().
+         * @return The raw bytes, or empty for a server peer or a plaintext connection.
+         */
+        std::string getRemoteIdentity() const;
+
+        /**
+         * @brief Grows the receive buffers of the peer connection; see SocketWrapper::growReceiveBuffer().
+         *
+         * For a server peer every accepted client connection is grown. The size is remembered and
+         * applied to clients accepted later and to the socket created by reconnect(), so a
+         * connection that needs more room can be grown live without over-provisioning the rest.
+         *
+         * @param bytes Size to grow the buffers to.
+         * @return True if every connection was grown, false otherwise.
+         */
+        bool growReceiveBuffer(size_t bytes);
+
+        /**
+         * @brief Corks or uncorks the peer connection; see SocketWrapper::setCork().
+         *
+         * For a server peer every accepted client connection is corked. Unlike
+         * setSocketOptions() the setting is not remembered for clients accepted later.
+         *
+         * @param enabled True to cork, false to uncork and flush.
+         * @return True if every connection was updated, false otherwise.
+         */
+        bool setCork(bool enabled);
+
+        /**
+         * @brief Gets the path MTU of the peer connection; see SocketWrapper::getPathMtu().
+         *
+         * A server peer reports the smallest path MTU among its connected clients.
+         *
+         * @return The path MTU in bytes, or -1 if it cannot be determined.
+         */
+        int getPathMtu() const;
+
+        /**
+         * @brief Reads the buffer sizes the kernel applied to the peer connection; see
+         *        SocketWrapper::getBufferSizes().
+         *
+         * A server peer reports the smallest sizes among its connected clients.
+         *
+         * @param sendBytes Set to the send buffer size.
+         * @param receiveBytes Set to the receive buffer size.
+         * @return True on success, false if the peer has no open connection or the sizes could not be read.
+         */
+        bool getBufferSizes(int &sendBytes, int &receiveBytes) const;
+
+        /**
+         * @brief Checks whether the last failed send can be retried; see SocketWrapper::isSendRetryable().
+         * @return True if the last send failed transiently, false otherwise.
+         */
+        bool isSendRetryable() const;
+
+        /**
+         * @brief Replaces the peer connection with a new one to the given address.
+         *
+         * A client peer connects to ip:port and a server peer binds and listens there; accepted
+         * clients of a server peer are closed. The peer keeps its ID, metadata and statistics.
+         * If the new connection cannot be established the current one is kept.
+         *
+         * @param ip IP address to connect or bind to.
+         * @param port Port to connect or bind to.
+         * @param localIp Local IP address a client peer connects from, or empty for any.
+         * @param localPort Local port a client peer connects from, or 0 for an ephemeral one.
+         * @return True if the peer was reconnected, false otherwise.
+         */
+        bool reconnect(const std::string &ip, int port, const std::string &localIp = "", int localPort = 0);
+
         /**
          * @brief Accepts multiple clients
+         *
+         * Blocks until maxClients connections have arrived. The peer is not locked while waiting,
+         * so closeConnection() or stopAccepting() from another thread interrupts the wait.
+         *
          * @param maxClients Maximum number of clients that can be accepted
+         * @param accepted Set to the number of clients this call accepted.
+         * @return False if the listening socket was closed before maxClients were accepted.
+         */
+        bool acceptClients(int maxClients, int &accepted);
+
+        /**
+         * @brief Stops a server peer from accepting clients, interrupting acceptClients() and acceptClient().
+         *
+         * Clients already accepted stay connected and can still be sent to. The peer accepts
+         * again only after reconnect().
+         */
+        void stopAccepting();
+
+        /**
+         * @brief Accepts one client if a connection arrives within the timeout (TCP server only).
+         *
+         * Unlike acceptClients() it gives up after the timeout, so a caller can check for
+         * cancellation between attempts.
+         *
+         * @param timeout How long to wait for a connection.
+         * @return True if a client was accepted, false otherwise.
+         */
+        bool acceptClient(std::chrono::milliseconds timeout);
+
+        /**
+         * @brief Accepts one client like acceptClient(), reporting the ID it can be addressed by.
+         * @param timeout How long to wait for a connection.
+         * @param clientId Set to the accepted client's ID, unique for the life of the peer.
+         * @return True if a client was accepted, false otherwise.
+         */
+        bool acceptClient(std::chrono::milliseconds timeout, uint64_t &clientId);
+
+        /**
+         * @brief Sends a message to one accepted client (TCP server only).
+         * @param clientId ID reported by acceptClient().
+         * @param message The message to send.
+         * @param unreliable True to let a UDP connection drop or reorder it, as sendUnreliable() does.
+         * @return True if the message was sent, false if the client is unknown, closed or the send failed.
+         */
+        bool sendToClient(uint64_t clientId, const std::string &message, bool unreliable = false);
+
+        /**
+         * @brief Closes the connection to one accepted client. Other clients are unaffected.
+         * @param clientId ID reported by acceptClient().
+         * @return False if the client is unknown.
+         */
+        bool closeClient(uint64_t clientId);
+
+        /**
+         * @brief Checks whether an accepted client's connection is still open.
+         * @param clientId ID reported by acceptClient().
+         */
+        bool isClientOpen(uint64_t clientId) const;
+
+        /**
+         * @brief Checks whether a client with this ID was accepted since the last reconnect, open or not.
+         * @param clientId ID reported by acceptClient().
+         */
+        bool hasClient(uint64_t clientId) const;
+
+        /**
+         * @brief Checks whether an accepted client is closed and every message it sent has been
+         *        returned by receiveMessage(), so nothing more will be received from it.
+         * @param clientId ID reported by acceptClient().
+         * @return True if so, or if the client is unknown.
+         */
+        bool isClientDrained(uint64_t clientId) const;
+
+        /**
+         * @brief Gets the remote address of an accepted client; see SocketWrapper::getRemoteAddress().
+         * @param clientId ID reported by acceptClient().
+         * @return The address as "ip:port", or empty if the client is unknown.
+         */
+        std::string getClientAddress(uint64_t clientId) const;
+
+        /**
+         * @brief Gets what identifies an accepted client; see SocketWrapper::getRemoteIdentity().
+         * @param clientId ID reported by acceptClient().
+         * @return The raw bytes, or empty if the client is unknown or its connection is plaintext.
+         */
+        std::string getClientRemoteIdentity(uint64_t clientId) const;
+
+        /**
+         * @brief Starts or stops recording connection lifecycle events for takeEvents().
+         * @param enabled True to record events; false also discards those not yet taken.
+         */
+        void setEventRecording(bool enabled);
+
+        /**
+         * @brief Returns and forgets the lifecycle events recorded since the last call, oldest first.
+         * At most MAX_PEER_EVENTS are kept.
          */
-        void acceptClients(int maxClients);
+        std::vector<PeerEvent> takeEvents();
+
+        /**
+         * @brief Gets the file descriptors of the open connections messages are received on:
+         * the peer's socket, or a server's accepted clients.
+         * @return The descriptors, for example to poll() many peers at once.
+         */
+        std::vector<int> getConnectionFds() const;
+
+        /**
+         * @brief Checks whether a message can be received without waiting for the network:
+         * one is queued already, or a connection holds bytes it has read.
+         */
+        bool hasQueuedInbound() const;
+
+        /**
+         * @brief Gets the number of accepted clients whose connection is still open.
+         * @return The number of connected clients.
+         */
+        int getClientCount() const;
 
         /**
          * @brief Returns the socket occupied by the peer
          * @return Returns the socket occupied by the peer
          */
-        std::shared_ptr<SocketWrapper> getSocket() const { return socket_; }
+        std::shared_ptr<SocketWrapper> getSocket() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return socket_;
+        }
 
         /**
          * @brief Returns the list of clients of the peer
          * @return Returns the list of clients of the peer
          */
-        std::vector<std::shared_ptr<SocketWrapper>> getClients() const { return clients_; }
+        std::vector<std::shared_ptr<SocketWrapper>> getClients() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return clients_;
+        }
 
         /**
          * [DEMO]
          * @brief Following methods are for the GUI feature
          */
-        int64_t getLatency() const { return latencyMs_; }
-        int getMessagesSent() const { return messagesSent_; }
-        int getMessagesReceived() const { return messagesReceived_; }
-        size_t getBytesSent() const { return bytesSent_; }
-        size_t getBytesReceived() const { return bytesReceived_; }
-        bool isConnected() const { return isConnected_; }
+        int64_t getLatency() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return latencyMs_;
+        }
+        int getMessagesSent() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return messagesSent_;
+        }
+        int getMessagesReceived() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return messagesReceived_;
+        }
+        size_t getBytesSent() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return bytesSent_;
+        }
+        size_t getBytesReceived() const
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return bytesReceived_;
+        }
         void updateLatency()
         {
             if (lastSent_ != std::chrono::steady_clock::time_point() && lastReceived_ != std::chrono::steady_clock::time_point())
@@ -151,17 +876,285 @@ namespace relay
 
         std::shared_ptr<SocketWrapper> socket_; ///< Peer's socket connection.
         std::vector<std::shared_ptr<SocketWrapper>> clients_;
+        mutable std::mutex connectionsMutex_; ///< Also held to change socket_ and clients_, so closeConnection() can reach them without mutex_.
         mutable std::mutex messageQueueMutex_;
-        std::queue<std::string> messageQueue_;
+
+        /**
+         * @struct QueuedMessage
+         * @brief A received message and the client it arrived from.
+         */
+        struct QueuedMessage
+        {
+            std::string data;      ///< The message.
+            uint64_t clientId = 0; ///< Client that sent it, 0 for a client peer's own connection.
+        };
+
+        std::queue<QueuedMessage> messageQueue_; ///< Received messages not yet returned by receiveMessage().
+        std::queue<QueuedMessage> urgentQueue_;  ///< Received urgent messages, returned ahead of messageQueue_.
+        std::unordered_map<uint64_t, size_t> queuedFrom_; ///< Messages in either queue by the client that sent them.
 
         std::chrono::steady_clock::time_point lastSent_;
         std::chrono::steady_clock::time_point lastReceived_;
-        int64_t latencyMs_;
-        int messagesSent_;
-        int messagesReceived_;
-        size_t bytesSent_;
-        size_t bytesReceived_;
-        bool isConnected_;
+        int64_t latencyMs_ = 0;
+        int messagesSent_ = 0;
+        int messagesReceived_ = 0;
+        size_t bytesSent_ = 0;
+        size_t bytesReceived_ = 0;
+        bool isConnected_ = false;
+
+        SocketOptions socketOptions_; ///< Settings applied to every socket of this peer.
+        size_t receiveBufferSize_ = 0; ///< Size set by growReceiveBuffer(), 0 if never called.
+        std::chrono::milliseconds connectTimeout_{0}; ///< Longest connect in reconnect(), 0 for the OS default.
+        int listenBacklog_ = DEFAULT_LISTEN_BACKLOG;   ///< listen() backlog of a server peer.
+        std::shared_ptr<const ChannelSecurity> security_; ///< Secures each connection, nullptr for plaintext.
+        AcceptFilter acceptFilter_;                           ///< Refuses clients, empty to accept all.
+        std::atomic<bool> draining_{false};                   ///< Turn away newly accepted clients; atomic so a graceful close holding mutex_ does not stall accepts.
+
+        std::chrono::milliseconds replayWindow_{0};                    ///< Accepted clock difference, 0 if disabled.
+        uint64_t nextNonce_ = 0;                                       ///< Nonce for the next stamped frame.
+        uint64_t replaysRejected_ = 0;                                 ///< Frames dropped by replay protection.
+        bool frameResync_ = false;                                     ///< Resync instead of closing on a corrupt frame header.
+        uint64_t retiredFrameDesyncs_ = 0;                             ///< Desyncs on connections replaced by reconnect().
+        uint64_t retiredFragmentsLost_ = 0;                            ///< Fragments lost on connections replaced by reconnect().
+        ReceiveStatus readStatus_ = ReceiveStatus::FAILED;             ///< Why the last readFrameLocked() read nothing.
+        std::chrono::milliseconds readIdleTimeout_{0};                 ///< Silence that fails receives, 0 if disabled.
+        std::chrono::steady_clock::time_point lastInbound_;            ///< When the last frame arrived or the idle timer was restarted.
+        std::unordered_map<const SocketWrapper *, uint64_t> lastNonces_; ///< Highest nonce seen per connection.
+
+        /**
+         * @struct PartialMessage
+         * @brief A fragmented message still being reassembled.
+         */
+        struct PartialMessage
+        {
+            std::string data;        ///< Fragments received so far.
+            uint64_t total = 0;      ///< Size of the whole message.
+            uint32_t nextIndex = 0;  ///< Index of the fragment expected next.
+            bool discard = false;    ///< Over maxMessageSize_; its fragments are skipped.
+        };
+
+        uint64_t maxMessageSize_ = DEFAULT_MAX_MESSAGE_SIZE;                            ///< Largest message reassembled from fragments.
+        std::unordered_map<const SocketWrapper *, PartialMessage> partialMessages_; ///< Message being reassembled per connection.
+
+        std::unordered_map<const SocketWrapper *, std::chrono::steady_clock::time_point> clientAcceptedAt_; ///< When each client was accepted.
+        std::unordered_map<const SocketWrapper *, std::chrono::steady_clock::time_point> clientCloseBy_;    ///< Deadline of each client sent a goodbye.
+        std::string goodbyeReason_; ///< Reason carried by the last goodbye received.
+        std::unordered_map<uint64_t, std::shared_ptr<SocketWrapper>> clientsById_; ///< Accepted clients by ID.
+        uint64_t nextClientId_ = 0;                                                ///< Last client ID handed out.
+        std::unordered_map<const SocketWrapper *, std::pair<uint64_t, std::string>> clientInfo_; ///< ID and address of each client.
+
+        bool recordEvents_ = false;  ///< Whether lifecycle events are recorded.
+        std::deque<PeerEvent> events_; ///< Events not yet returned by takeEvents().
+
+        std::deque<uint64_t> receipts_; ///< Receipt IDs received and not yet returned by pollReceipts().
+
+        /**
+         * @struct PendingAck
+         * @brief A run of consecutive tracking IDs received and not yet acknowledged.
+         */
+        struct PendingAck
+        {
+            uint64_t first = 0;                           ///< Lowest tracking ID in the run.
+            uint64_t last = 0;                            ///< Highest tracking ID in the run.
+            std::chrono::steady_clock::time_point since; ///< When first arrived.
+        };
+
+        size_t ackBatchSize_ = 1;                                         ///< Messages acknowledged per receipt.
+        std::chrono::milliseconds ackInterval_{0};                        ///< Longest a message waits for its receipt, 0 for no limit.
+        std::unordered_map<SocketWrapper *, PendingAck> pendingAcks_; ///< Run awaiting its receipt per connection.
+
+        /**
+         * @struct StreamRoute
+         * @brief Where an open stream's frames are sent.
+         */
+        struct StreamRoute
+        {
+            std::shared_ptr<SocketWrapper> connection; ///< Connection the stream runs over.
+            uint32_t wireId = 0;                       ///< Stream ID on that connection.
+            bool sentClose = false;                    ///< This end sent CLOSE.
+            bool receivedClose = false;                ///< The other end sent CLOSE.
+        };
+        std::unordered_map<uint32_t, StreamRoute> streams_;                    ///< Open streams by local ID.
+        std::map<std::pair<const SocketWrapper *, uint32_t>, uint32_t> streamIds_; ///< Local ID of each client's stream, by connection and wire ID.
+        uint32_t nextStreamId_ = 0;                                            ///< Last local stream ID handed out.
+        std::deque<StreamFrame> streamFrames_;                                 ///< Stream frames not yet returned by receiveStreamFrame().
+        std::string compressionDictionary_; ///< zlib preset dictionary for compressed batches, empty if none.
+        int compressionLevel_ = MAX_COMPRESSION_LEVEL; ///< zlib level for compressed batches sent.
+        uint64_t compressionThreshold_ = 0;            ///< Smallest message compressed on its own, 0 for none.
+        uint64_t compressedMessages_ = 0;              ///< Messages sent compressed on their own.
+        uint64_t compressedBytesIn_ = 0;               ///< Their size before compression.
+        uint64_t compressedBytesOut_ = 0;              ///< Their size after compression.
+
+        int circuitThreshold_ = 0;                            ///< Failures that open the circuit, 0 if disabled.
+        std::chrono::milliseconds circuitCooldown_{0};        ///< How long an open circuit rejects sends.
+        int consecutiveFailures_ = 0;                         ///< Send failures since the last success.
+        bool circuitOpen_ = false;                            ///< Whether the circuit is open (or half-open).
+        std::chrono::steady_clock::time_point circuitOpenedAt_; ///< When the circuit last opened.
+
+        /**
+         * @brief Sends a message without consulting the circuit breaker. Caller must hold mutex_.
+         */
+        bool sendLocked(const std::string &message);
+
+        /**
+         * @brief Sends a frame and updates the send statistics. Caller must hold mutex_.
+         */
+        bool sendFrameLocked(Frame frame, int messageCount);
+
+        /**
+         * @brief Sends a message larger than MAX_UNFRAGMENTED_SIZE as FRAGMENT frames through send,
+         *        stopping at the first that fails. Caller must hold mutex_.
+         */
+        bool sendFragmentsLocked(const std::string &message, const std::function<bool(Frame)> &send);
+
+        /**
+         * @brief Records a lifecycle event on connection, if recording is enabled. Caller must hold mutex_.
+         */
+        void recordEventLocked(PeerEventKind kind, PeerEventReason reason, const SocketWrapper *connection);
+
+        /**
+         * @brief Runs the accept filter on a client whose handshake completed, closing it if refused.
+         * @return True if the client may be added.
+         */
+        bool admitClient(SocketWrapper &client);
+
+        /**
+         * @brief Closes a client accepted while draining, sending a plaintext one a goodbye first.
+         */
+        void turnAwayClient(SocketWrapper &client);
+
+        /**
+         * @brief How long a connection's security handshake may take. Caller must hold mutex_.
+         */
+        std::chrono::milliseconds handshakeTimeoutLocked() const;
+
+        /**
+         * @brief Adds a client accepted on listener, unless the peer has since reconnected.
+         * @return False if the client was closed because listener is no longer the peer's socket.
+         */
+        bool addClient(const std::shared_ptr<SocketWrapper> &listener, const std::shared_ptr<SocketWrapper> &client, uint64_t *clientId = nullptr);
+
+        /**
+         * @brief Reads frames until messageQueue_ or urgentQueue_ holds a message, then up to
+         *        URGENT_READ_AHEAD frames that have already arrived to find urgent ones. Caller must
+         *        hold mutex_ through lock, which is released while waiting for data.
+         * @param deadline When to give up, or none to wait as long as the receive timeout set with
+         *        setSocketOptions() allows.
+         * @return True if either queue holds a message afterwards.
+         */
+        bool fillMessageQueueLocked(std::unique_lock<std::mutex> &lock, std::optional<std::chrono::steady_clock::time_point> deadline = std::nullopt);
+
+        /**
+         * @brief Waits until a connection has data to read, the read idle timeout expires or
+         *        deadline passes. Caller must hold mutex_ through lock; it is released during the
+         *        wait, which polls in slices of RECEIVE_WAIT_SLICE so connections closed or clients
+         *        accepted meanwhile are noticed.
+         * @return False, with readStatus_ set to IDLE or TIMEOUT, if the wait ran out.
+         */
+        bool awaitInboundLocked(std::unique_lock<std::mutex> &lock, std::optional<std::chrono::steady_clock::time_point> deadline);
+
+        /**
+         * @brief Reads one frame from the connection and decodes it. Caller must hold mutex_.
+         *
+         * Only bytes that have already arrived are read, so mutex_ is never held while waiting on
+         * the socket; if just part of a frame is there it returns true without queueing anything
+         * and the caller waits for the rest with awaitInboundLocked().
+         * @param readyOnly Skip connections with no data waiting, and return true without reading
+         *        if none has any.
+         * @return False if no frame could be read or the frame was dropped, with the reason in readStatus_.
+         */
+        bool readFrameLocked(bool readyOnly = false);
+
+        /**
+         * @brief Decodes a received frame onto messageQueue_ or urgentQueue_, or a receipt onto receipts_, and
+         *        acknowledges tracked messages on connection. Caller must hold mutex_.
+         */
+        bool queueFrameLocked(Frame frame, SocketWrapper *connection);
+
+        /**
+         * @brief Acknowledges a tracked message received on connection, at once or batched as
+         *        set by setAckBatching(). Caller must hold mutex_.
+         */
+        void acknowledgeLocked(uint64_t trackingId, SocketWrapper *connection);
+
+        /**
+         * @brief Sends the receipt for connection's pending run, if the connection is still open
+         *        and one of this peer's, and forgets the run. Caller must hold mutex_.
+         */
+        void sendAckLocked(SocketWrapper *connection);
+
+        /**
+         * @brief Reads one frame from a connection that has data waiting, without blocking for
+         *        one to arrive. Caller must hold mutex_.
+         * @return True if a frame was read.
+         */
+        bool readReadyFrameLocked();
+
+        /**
+         * @brief Decodes a STREAM frame onto streamFrames_, registering streams opened by clients. Caller must hold mutex_.
+         */
+        bool queueStreamFrameLocked(const Frame &frame, SocketWrapper *connection);
+
+        /**
+         * @brief Adds a FRAGMENT frame to the message being reassembled from connection, queueing the
+         *        message once complete. Caller must hold mutex_.
+         * @return False if the fragment was malformed, out of order or starts a message over maxMessageSize_.
+         */
+        bool queueFragmentLocked(const Frame &frame, const SocketWrapper *connection, uint64_t clientId);
+
+        /**
+         * @brief Compresses a MESSAGE frame's payload if it reaches compressionThreshold_ and shrinks, and
+         *        the remote end of connection can inflate it. Caller must hold mutex_.
+         *
+         * A secured connection's ConnectionHello says whether the remote end inflates zlib; a plain
+         * connection has no hello, and is assumed to, as every version of the library inflates
+         * compressed batches and messages alike.
+         *
+         * @param connection The connection the frame is sent on, or nullptr to skip the check.
+         */
+        void compressMessageLocked(Frame &frame, const SocketWrapper *connection);
+
+        /**
+         * @brief Reports whether a received message of size bytes is over maxMessageSize_, logging it and
+         *        recording a RECEIVE_FAILED error event if so. Caller must hold mutex_.
+         */
+        bool oversizedLocked(uint64_t size, const SocketWrapper *connection);
+
+        /**
+         * @brief Sends a stream frame. Caller must hold mutex_.
+         */
+        bool sendStreamFrameLocked(uint32_t streamId, StreamFrameKind kind, const std::string &data);
+
+        /**
+         * @brief Queues a RESET for every stream whose connection closed or was replaced. Caller must hold mutex_.
+         */
+        void resetLostStreamsLocked();
+
+        /**
+         * @brief Forgets a stream. Caller must hold mutex_.
+         */
+        void retireStreamLocked(uint32_t streamId);
+
+        /**
+         * @brief Stamps a frame if replay protection is enabled. Caller must hold mutex_.
+         */
+        void prepareFrameLocked(Frame &frame);
+
+        /**
+         * @brief Checks and strips a received frame's replay stamp. Caller must hold mutex_.
+         * @return False if the frame must be dropped.
+         */
+        bool acceptStampLocked(Frame &frame, const SocketWrapper *connection);
+
+        /**
+         * @brief Checks whether the circuit breaker rejects a send now. Caller must hold mutex_.
+         */
+        bool circuitRejectsLocked() const;
+
+        /**
+         * @brief Updates the circuit breaker with the outcome of a send. Caller must hold mutex_.
+         */
+        void recordSendResultLocked(bool sent);
     };
 
 } // namespace relay
@@ -7,8 +7,11 @@
 #include <vector>
 #include <mutex>
 #include <unordered_set>
+#include <unordered_map>
+#include <map>
 #include <functional>
 #include <memory>
+#include <stdexcept>
 #include "peer_manager.h"
 #include "socket_wrapper.h"
 
@@ -24,6 +27,18 @@ namespace relay
     std::string toString(DiscoveryMessageType type);
     size_t messageSize(DiscoveryMessageType type);
 
+    constexpr size_t MAX_ANNOUNCEMENT_SIZE = 1024; ///< Largest discovery datagram, metadata included.
+
+    /**
+     * @class MulticastUnavailableError
+     * @brief Thrown by PeerDiscovery when no interface can send or receive multicast.
+     */
+    class MulticastUnavailableError : public std::runtime_error
+    {
+    public:
+        using std::runtime_error::runtime_error;
+    };
+
     /**
      * @class PeerDiscovery
      * @brief Handles peer discovery using UDP multicast.
@@ -39,6 +54,8 @@ namespace relay
          * @param multicastIp Multicast group address (e.g., "224.0.0.251").
          * @param multicastPort UDP port for discovery (e.g., 5353).
          * @param localIp Local interface IP to bind to (e.g., "0.0.0.0").
+         * @throws MulticastUnavailableError If no usable interface supports multicast or the group cannot be joined.
+         * @throws std::runtime_error If the discovery socket cannot be created or bound.
          */
         PeerDiscovery(const std::string &multicastIp, int multicastPort, const std::string &localIp = "0.0.0.0");
 
@@ -68,13 +85,65 @@ namespace relay
          * @return Vector of peer addresses.
          */
         std::vector<std::string> getDiscoveredPeers() const;
-        
+
+        /**
+         * @brief Gets one page of the discovered peers (IP:port strings).
+         * @param offset Index of the first peer to return.
+         * @param limit Maximum number of peers to return.
+         * @param total Output parameter for the total number of discovered peers.
+         * @return Vector of at most limit peer addresses, in discovery order.
+         */
+        std::vector<std::string> getDiscoveredPeers(size_t offset, size_t limit, size_t &total) const;
+
+        /**
+         * @brief Sets the key-value metadata carried by this peer's discovery responses.
+         *
+         * The response is DISCOVERY_RESPONSE followed by one "key=value" line per entry, so
+         * peers running older versions still recognize it. Keys may not be empty or contain '='
+         * or a newline, and values may not contain a newline.
+         *
+         * @param metadata Metadata to announce, or empty for none.
+         * @return False, leaving the current metadata, if an entry is invalid or the response
+         *         would exceed MAX_ANNOUNCEMENT_SIZE.
+         */
+        bool setAnnouncementMetadata(const std::map<std::string, std::string> &metadata);
+
+        /**
+         * @brief Gets the metadata a discovered peer announced in its latest response.
+         * @param peerAddr Peer address as returned by getDiscoveredPeers().
+         * @return The metadata, empty if the peer announced none or is unknown.
+         */
+        std::map<std::string, std::string> getPeerMetadata(const std::string &peerAddr) const;
+
+        /**
+         * @brief Gets the local interface that received a discovered peer's latest response.
+         *
+         * On a multi-homed host this is the interface to reach the peer through.
+         *
+         * @param peerAddr Peer address as returned by getDiscoveredPeers().
+         * @return The interface name, such as "eth0", or empty if unknown.
+         */
+        std::string getPeerInterface(const std::string &peerAddr) const;
+
+        /**
+         * @brief Checks whether an interface that is up supports multicast.
+         *
+         * Loopback interfaces are ignored unless localIp names one explicitly.
+         *
+         * @param localIp Interface address discovery binds to, or "0.0.0.0" for any interface.
+         * @return True if a matching interface is up and multicast-capable, false otherwise.
+         */
+        static bool hasMulticastInterface(const std::string &localIp);
+
     private:
         std::string multicastIp_;                      ///< Multicast group address.
         int multicastPort_;                            ///< Multicast port.
         std::string localIp_;                          ///< Local interface IP.
         std::shared_ptr<SocketWrapper> socketWrapper_; ///< UDP socket for multicast.
         std::vector<std::string> peers_;               ///< Discovered peers (IP:port).
+        std::unordered_map<std::string, std::map<std::string, std::string>> peerMetadata_; ///< Latest metadata per discovered peer.
+        std::unordered_map<std::string, std::string> peerInterfaces_; ///< Interface that received each peer's latest response.
+        std::string announcement_;                     ///< Encoded metadata lines appended to responses.
         mutable std::mutex peersMutex_;                ///< Mutex for peers list.
         std::atomic<bool> stopDiscovery_;              ///< Flag to stop discovery.
         std::unique_ptr<std::thread> senderThread_;    ///< Thread for sending discovery requests.
@@ -101,8 +170,9 @@ namespace relay
          * @brief Handles a discovery response, adding the peer if new.
          * @param response Response message.
          * @param senderAddr Address of the responding peer.
+         * @param interfaceName Local interface the response arrived on, or empty if unknown.
          */
-        void handleDiscoveryResponse(const std::string &response, struct ::sockaddr_in &senderAddr);
+        void handleDiscoveryResponse(const std::string &response, struct ::sockaddr_in &senderAddr, const std::string &interfaceName);
 
         /**
          * @brief Logs an error message via the error handler or logger.
@@ -5,12 +5,33 @@
 #include <unordered_map>
 #include <memory>
 #include <string>
+#include <functional>
 #include <vector>
 #include <mutex>
+#include <map>
+#include <optional>
+#include <utility>
+#include <atomic>
 
 namespace relay
 {
 
+    /**
+     * @enum DeliveryFailure
+     * @brief Why a message could not be delivered to a peer.
+     */
+    enum class DeliveryFailure
+    {
+        CIRCUIT_OPEN, ///< The peer's circuit breaker is open.
+        DISCONNECTED, ///< The peer's connection is closed.
+        SEND_FAILED,  ///< Writing to the peer's connection failed.
+    };
+
+    /**
+     * @brief Callback receiving the ID of a peer a message was not delivered to, and why.
+     */
+    using DeliveryFailureHandler = std::function<void(const std::string &peerId, DeliveryFailure reason)>;
+
     /**
      * @class PeerManager
      * @brief Manages a collection of peers in the P2P network.
@@ -68,6 +89,9 @@ namespace relay
         /**
          * @brief Relays a message from one peer to another.
          *
+         * Text messages are marked with a "[Relayed] " prefix; binary messages,
+         * which start with a NUL byte, are forwarded unchanged.
+         *
          * @param sourceId The unique identifier of the source peer.
          * @param targetId The unique identifier of the target peer.
          * @param message The message to be relayed.
@@ -105,8 +129,70 @@ namespace relay
 
         /**
          * @brief Broadcasts a message to all available peers.
+         *
+         * Peers the relay rules do not allow sourceId to reach are skipped. The source peer itself
+         * is never sent its own broadcast.
+         *
+         * @param message The message to broadcast.
+         * @param sourceId The unique identifier of the originating peer, or empty for the manager itself.
+         * @param onFailure Called for each peer the message could not be delivered to. Peers skipped by
+         *                  relay rules are not failures.
+         */
+        void broadcast(const std::string& message, const std::string &sourceId = "", const DeliveryFailureHandler &onFailure = nullptr);
+
+        /**
+         * @brief Delivers a broadcast from the manager to a single peer, as broadcast() would.
+         *
+         * The manager's lock is not held while sending, so broadcasts to different peers may
+         * run in parallel.
+         *
+         * @param peerId The unique identifier of the target peer.
+         * @param message The message to broadcast.
+         * @param onFailure Called if the message could not be delivered to the peer.
+         * @return False if the peer is not managed or the relay rules deny it, true otherwise.
+         */
+        bool broadcastTo(const std::string &peerId, const std::string &message, const DeliveryFailureHandler &onFailure = nullptr);
+
+        /**
+         * @brief Allows or denies relaying messages from one peer to another.
+         *
+         * Rules are directional: a rule for fromId -> toId says nothing about toId -> fromId.
+         * Either ID may be "*" to match any peer, and an empty fromId stands for the manager
+         * itself (see broadcast()). Exact rules take precedence over wildcard ones.
+         *
+         * @param fromId The unique identifier of the sending peer.
+         * @param toId The unique identifier of the receiving peer.
+         * @param allowed True to allow the direction, false to deny it.
+         */
+        void setRelayRule(const std::string &fromId, const std::string &toId, bool allowed);
+
+        /**
+         * @brief Checks whether the relay rules allow messages from one peer to another.
+         *
+         * @param fromId The unique identifier of the sending peer.
+         * @param toId The unique identifier of the receiving peer.
+         * @return True if no rule denies the direction, false otherwise.
+         */
+        bool isRelayAllowed(const std::string &fromId, const std::string &toId) const;
+
+        /**
+         * @brief Refuses, or stops refusing, relays and broadcasts from peers that are not authenticated.
+         *
+         * A peer is authenticated when its connections prove who the remote end is; see
+         * Peer::isAuthenticated(). Broadcasts from the manager itself are not affected.
+         *
+         * @param required True to refuse relays from unauthenticated peers.
          */
-        void broadcast(const std::string& message);
+        void setRequireAuthenticatedRelays(bool required);
+
+        /**
+         * @brief Checks whether messages from a peer may be relayed under the authentication requirement.
+         *
+         * @param sourceId The unique identifier of the sending peer, or empty for the manager itself.
+         * @return False if authentication is required and the peer is unknown or not authenticated.
+         */
+        bool isRelayAuthenticated(const std::string &sourceId) const;
+
     private:
         /**
          * @brief A map that stores peers by their unique IDs.
@@ -117,6 +203,28 @@ namespace relay
          * @brief Mutex to ensure thread-safe access to the peers map.
          */
         mutable std::mutex mutex_;
+
+        /**
+         * @brief Relay rules keyed by (fromId, toId). Pairs without a rule are allowed.
+         */
+        std::map<std::pair<std::string, std::string>, bool> relayRules_;
+
+        /**
+         * @brief Mutex to ensure thread-safe access to the relay rules.
+         */
+        mutable std::mutex rulesMutex_;
+
+        /**
+         * @brief Whether relays from unauthenticated peers are refused.
+         */
+        std::atomic<bool> requireAuthenticated_{false};
+
+        /**
+         * @brief Sends a broadcast to one peer, or to a server peer's clients.
+         *
+         * @return Why the message was not delivered, or nothing if it was.
+         */
+        std::optional<DeliveryFailure> deliverBroadcast(const std::string &id, Peer &peer, const std::string &message);
     };
 
 } // namespace relay
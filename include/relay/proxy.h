@@ -0,0 +1,52 @@
+#ifndef RELAY_PROXY_H
+#define RELAY_PROXY_H
+
+#include <chrono>
+#include <string>
+#include "inet_address.h"
+
+namespace relay
+{
+
+    /**
+     * @enum ProxyKind
+     * @brief The protocol a proxy speaks.
+     */
+    enum class ProxyKind
+    {
+        SOCKS5,       ///< SOCKS version 5 (RFC 1928), with optional username/password authentication (RFC 1929).
+        HTTP_CONNECT, ///< An HTTP proxy that opens tunnels with CONNECT, with optional Basic authentication.
+    };
+
+    /**
+     * @struct ProxySettings
+     * @brief A proxy that outbound TCP connections go through.
+     */
+    struct ProxySettings
+    {
+        ProxyKind kind = ProxyKind::SOCKS5;
+        InetAddress address;  ///< Where the proxy listens.
+        std::string username;  ///< Empty for no authentication.
+        std::string password;
+    };
+
+    /**
+     * @brief Asks a proxy to open a tunnel to a target, over a connection to the proxy.
+     *
+     * Once it returns 0, the bytes written to socketFd reach the target and its replies are read
+     * from socketFd.
+     *
+     * @param socketFd Connected socket to the proxy.
+     * @param proxy The proxy.
+     * @param host Target IPv4 or IPv6 address, or a host name for the proxy to resolve.
+     * @param port Target port.
+     * @param deadline When to give up.
+     * @return 0 on success; ECONNREFUSED if the proxy could not reach the target, EACCES if it
+     *         refused the credentials, ETIMEDOUT past the deadline, or EPROTO if it broke the protocol.
+     */
+    int openProxyTunnel(int socketFd, const ProxySettings &proxy, const std::string &host, int port,
+                        std::chrono::steady_clock::time_point deadline);
+
+} // namespace relay
+
+#endif
@@ -0,0 +1,126 @@
+#ifndef RELAY_SECURE_CHANNEL_H
+#define RELAY_SECURE_CHANNEL_H
+
+#include <chrono>
+#include <cstddef>
+#include <memory>
+#include <string>
+#include <sys/types.h>
+
+namespace relay
+{
+
+    /// How long a security handshake may take unless the peer's connect timeout is shorter.
+    constexpr std::chrono::milliseconds DEFAULT_HANDSHAKE_TIMEOUT{10000};
+
+    /**
+     * @class SecureChannel
+     * @brief Protects the bytes sent and received on one connected socket.
+     *
+     * A SocketWrapper with a channel passes everything it sends and receives through it. read() and
+     * write() behave like recv() and send(): they return the number of bytes moved, 0 from read()
+     * once the remote end has closed the channel, or -1 with errno set (EAGAIN when the socket
+     * timeout expired). Callers serialize access, as SocketWrapper does with its mutex.
+     */
+    class SecureChannel
+    {
+    public:
+        virtual ~SecureChannel() = default;
+
+        /**
+         * @brief Receives and decrypts up to len bytes.
+         * @return Bytes read, 0 once the channel is closed, or -1 with errno set.
+         */
+        virtual ssize_t read(char *buffer, size_t len) = 0;
+
+        /**
+         * @brief Encrypts and sends up to len bytes.
+         * @return Bytes sent, or -1 with errno set.
+         */
+        virtual ssize_t write(const char *data, size_t len) = 0;
+
+        /**
+         * @brief Checks for decrypted bytes that read() can return without touching the socket.
+         */
+        virtual bool hasPending() const = 0;
+
+        /**
+         * @brief Tells the remote end no more data follows. Does nothing after a fatal error.
+         */
+        virtual void shutdown() = 0;
+
+        /**
+         * @brief Gets what identifies the remote end: its certificate or static key, as the
+         *        security that set the channel up defines it.
+         * @return The raw bytes, or empty if the remote end presented nothing.
+         */
+        virtual std::string remoteIdentity() const = 0;
+
+        /**
+         * @brief Replaces the channel's session keys in band, without interrupting the connection.
+         *
+         * Bytes written before the call are protected by the old keys and bytes written after it by
+         * the new ones; the remote end switches at the same point in the stream and rotates the
+         * keys of its own direction in turn, so nothing in flight is lost.
+         *
+         * @return False with errno set if the keys were not rotated: ENOTSUP if the channel has no
+         *         keys to rotate, or the error that stopped the rotation from being sent.
+         */
+        virtual bool rekey() = 0;
+    };
+
+    /**
+     * @class ChannelSecurity
+     * @brief Sets up a SecureChannel on each connection of a peer.
+     */
+    class ChannelSecurity
+    {
+    public:
+        virtual ~ChannelSecurity() = default;
+
+        /**
+         * @brief Runs the handshake on a connected socket.
+         * @param socketFd The connected socket. Its blocking mode is restored before returning.
+         * @param server True on the accepting end of the connection.
+         * @param timeout Longest time the handshake may take.
+         * @param error Set to the errno of a failed handshake: ETIMEDOUT, EACCES if the remote
+         *              end's identity was rejected, or EPROTO.
+         * @return The channel, or nullptr if the handshake failed.
+         */
+        virtual std::unique_ptr<SecureChannel> handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const = 0;
+
+        /**
+         * @brief Checks whether a completed handshake proves who the remote end is.
+         */
+        virtual bool authenticatesPeer() const = 0;
+    };
+
+    /**
+     * @brief Creates a SecureChannel that passes bytes through unchanged, for securities that only
+     *        authenticate the remote end or frame the stream.
+     */
+    std::unique_ptr<SecureChannel> plainChannel(int socketFd);
+
+    /**
+     * @brief Blocking-style I/O for handshakes, on a socket the handshake switched to non-blocking mode.
+     */
+    namespace handshake
+    {
+        using Deadline = std::chrono::steady_clock::time_point;
+
+        /**
+         * @brief Sends all of data before the deadline.
+         * @param error Set to ETIMEDOUT past the deadline, or EPROTO if the connection failed.
+         */
+        bool sendAll(int socketFd, const std::string &data, Deadline deadline, int &error);
+
+        /**
+         * @brief Receives exactly len bytes into out before the deadline.
+         * @param error Set as by sendAll(); EPROTO also means the remote end gave up on the handshake.
+         */
+        bool receiveExactly(int socketFd, size_t len, std::string &out, Deadline deadline, int &error);
+    } // namespace handshake
+
+} // namespace relay
+
+#endif
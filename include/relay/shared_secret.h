@@ -0,0 +1,55 @@
+#ifndef RELAY_SHARED_SECRET_H
+#define RELAY_SHARED_SECRET_H
+
+#include "secure_channel.h"
+#include <string>
+#include <vector>
+
+namespace relay
+{
+
+    /**
+     * @struct SharedSecretSettings
+     * @brief Configuration of a SharedSecretContext.
+     */
+    struct SharedSecretSettings
+    {
+        /// Secrets the remote end must know one of: pre-shared keys or tokens. Connecting ends
+        /// prove they know the first.
+        std::vector<std::string> secrets;
+    };
+
+    /**
+     * @class SharedSecretContext
+     * @brief ChannelSecurity that admits only remote ends knowing a secret shared in advance.
+     *
+     * The handshake is a challenge-response that never sends the secret: the accepting end sends
+     * a random challenge, the connecting end answers with its own challenge and an HMAC-SHA256 of
+     * both under the secret, and the accepting end, once it has found a secret matching the
+     * answer, proves it knows that secret too. Traffic after the handshake is not encrypted, and
+     * remoteIdentity() is empty. This class is thread-safe.
+     */
+    class SharedSecretContext : public ChannelSecurity
+    {
+    public:
+        /**
+         * @brief Creates the context.
+         * @param settings The configuration.
+         * @throws std::invalid_argument if there is no secret or a secret is empty.
+         */
+        explicit SharedSecretContext(SharedSecretSettings settings);
+
+        std::unique_ptr<SecureChannel> handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const override;
+
+        /**
+         * @brief Returns true, since only remote ends knowing a secret complete the handshake.
+         */
+        bool authenticatesPeer() const override;
+
+    private:
+        SharedSecretSettings settings_;
+    };
+
+} // namespace relay
+
+#endif
@@ -10,12 +10,22 @@
 #include <optional>
 #include <functional>
 #include <atomic>
+#include <chrono>
 #include <netinet/in.h>
 #include <arpa/inet.h> 
+#include <sys/types.h>
+#include "frame.h"
+#include "secure_channel.h"
+#include "memory.h"
+#include "proxy.h"
+#include "udp.h"
 
 namespace relay
 {
 
+    /// Prefix of the address initialize() takes for a Unix domain socket, as in "unix:///run/relay.sock".
+    constexpr char UNIX_SOCKET_PREFIX[] = "unix://";
+
     enum class SocketMode
     {
         TCP_SERVER,
@@ -23,6 +33,51 @@ namespace relay
         UDP
     };
 
+    /**
+     * @struct SocketOptions
+     * @brief Tunable socket settings. A zero value leaves the current setting unchanged.
+     */
+    struct SocketOptions
+    {
+        int sendBufferSize = 0;                      ///< SO_SNDBUF in bytes.
+        int receiveBufferSize = 0;                   ///< SO_RCVBUF in bytes.
+        std::chrono::milliseconds sendTimeout{0};    ///< SO_SNDTIMEO.
+        std::chrono::milliseconds receiveTimeout{0}; ///< SO_RCVTIMEO.
+        std::optional<bool> noDelay;                 ///< TCP_NODELAY, unchanged if empty.
+        std::chrono::milliseconds keepAlive{0};      ///< SO_KEEPALIVE idle time, and probe interval unless keepAliveInterval is set; negative to disable.
+        std::chrono::milliseconds keepAliveInterval{0}; ///< TCP_KEEPINTVL, between unanswered keep-alive probes.
+        int keepAliveCount = 0;                      ///< TCP_KEEPCNT, unanswered keep-alive probes before the connection is dropped.
+
+        /**
+         * @brief Overwrites the settings that are set in other.
+         * @param other Options whose non-zero values take precedence.
+         */
+        void merge(const SocketOptions &other);
+    };
+
+    /// Bits of ConnectionHello::flags.
+    constexpr uint8_t HELLO_DRAINING = 1; ///< The accepting end is draining and closes the connection.
+    constexpr uint8_t HELLO_ZLIB = 2;     ///< The end inflates frames compressed with zlib; always announced.
+
+    /**
+     * @struct ConnectionHello
+     * @brief What each end of a connection announces once secure() has run the security handshake.
+     */
+    struct ConnectionHello
+    {
+        uint8_t flags = 0; ///< HELLO_* bits.
+    };
+
+    /**
+     * @class ListenerClosedError
+     * @brief Thrown by SocketWrapper::accept() when the listening socket is closed.
+     */
+    class ListenerClosedError : public std::runtime_error
+    {
+    public:
+        using std::runtime_error::runtime_error;
+    };
+
     /**
      * @class SocketWrapper
      * @brief Thread-safe socket abstraction for TCP and UDP operations.
@@ -47,14 +102,159 @@ namespace relay
          */
         ~SocketWrapper();
 
+        /**
+         * @brief Sets the local address a TCP client socket connects from; initialize() binds it.
+         * @param ip Local IPv4 or IPv6 address, of the same family as the one initialize() connects
+         *           to, or empty for any.
+         * @param port Local port, or 0 to let the OS pick an ephemeral one.
+         * @return True if the address was recorded, false if it is invalid.
+         */
+        bool bindLocal(const std::string &ip, int port);
+
+        /**
+         * @brief Carries the connection over UDP with retransmission (see udp.h) instead of TCP.
+         *
+         * Call on a TCP_SERVER or TCP_CLIENT socket before initialize(), which then binds a UDP
+         * listener or connects to one. The socket keeps its mode, and frames flagged
+         * FRAME_UNRELIABLE are sent without retransmission unless secure() set up a channel.
+         *
+         * @param settings Reliability settings.
+         */
+        void useUdpTransport(const UdpSettings &settings);
+
+        /**
+         * @brief Gets the settings passed to useUdpTransport(), or empty for TCP.
+         */
+        std::optional<UdpSettings> getUdpTransport() const;
+
+        /**
+         * @brief Makes initialize() connect a TCP_CLIENT socket through a proxy.
+         *
+         * Call before initialize(), which then connects to the proxy and has it open a tunnel to
+         * the remote end, within setConnectTimeout() (DEFAULT_HANDSHAKE_TIMEOUT if unbounded).
+         * initialize() also takes a host name for the proxy to resolve. UDP, Unix domain and
+         * in-process connections do not use the proxy.
+         *
+         * @param proxy The proxy.
+         */
+        void useProxy(const ProxySettings &proxy);
+
+        /**
+         * @brief Gets the proxy passed to useProxy(), or empty for direct connections.
+         */
+        std::optional<ProxySettings> getProxy() const;
+
+        /**
+         * @brief Sets the permission bits initialize() gives a Unix domain server socket's file,
+         *        before it listens.
+         * @param mode Bits such as 0660, or 0 to keep those the umask gives.
+         */
+        void setUnixSocketMode(int mode);
+
+        /**
+         * @brief Gets the permission bits set with setUnixSocketMode().
+         */
+        int getUnixSocketMode() const;
+
+        /**
+         * @brief Sets the options a TCP_SERVER socket applies before initialize() binds it, such as
+         *        IPv6-only listening on "::" or SO_REUSEADDR for a fast restart.
+         */
+        void setBindOptions(const BindOptions &options);
+
+        /**
+         * @brief Gets the options setBindOptions() set.
+         */
+        BindOptions getBindOptions() const;
+
         /**
          * @brief Initializes the socket (bind for servers/UDP, connect for TCP clients).
+         *
+         * An ip of UNIX_SOCKET_PREFIX followed by a path makes a TCP_SERVER or TCP_CLIENT socket a
+         * Unix domain stream socket instead, ignoring port; on Linux a path starting with '@' names
+         * an abstract socket. A server replaces a socket file no server listens on, and removes
+         * its own file when closed. An ip of MEMORY_SOCKET_PREFIX followed by a name listens for or
+         * connects to an in-process connection (see memory.h) instead.
+         *
+         * The socket takes the family of ip, which may be IPv4 or IPv6 (see parseInetAddress()). A
+         * server bound to "::" also accepts IPv4 connections unless setBindOptions() asked otherwise.
+         *
          * @param ip IP address to bind/connect to.
          * @param port Port to bind/connect to.
-         * @param useIPv6 Use IPv6 instead of IPv4 (default: false).
+         * @param useIPv6 Use IPv6 even for an IPv4 ip, as an IPv4-mapped address (default: false).
          */
         bool initialize(const std::string &ip, int port, bool useIPv6 = false);
 
+        /**
+         * @brief Bounds how long initialize() waits for a TCP client connection to be established.
+         *
+         * A connection that is not established in time fails with getSetupError() reporting ETIMEDOUT.
+         *
+         * @param timeout Longest wait, or 0 to wait as long as the OS allows.
+         */
+        void setConnectTimeout(std::chrono::milliseconds timeout);
+
+        /**
+         * @brief Runs a security handshake on the connected socket; everything sent and received
+         *        afterwards passes through the resulting channel.
+         *
+         * Once the channel is up both ends send each other a ConnectionHello through it. A
+         * connecting end told that the accepting end is draining fails with getSetupError()
+         * reporting ESHUTDOWN; other failures are reported as by ChannelSecurity::handshake().
+         *
+         * @param security Sets up the channel.
+         * @param server True on the accepting end of the connection.
+         * @param timeout Longest time the handshake and the hello may take together.
+         * @param hello What this end announces.
+         * @return True if the channel is up, false otherwise.
+         */
+        bool secure(const ChannelSecurity &security, bool server, std::chrono::milliseconds timeout, const ConnectionHello &hello = {});
+
+        /**
+         * @brief Gets what the remote end announced when secure() set up the channel.
+         * @return The remote hello, all zero if secure() was not run.
+         */
+        ConnectionHello getRemoteHello() const;
+
+        /**
+         * @brief Checks whether secure() set up a channel on this socket.
+         */
+        bool isSecured() const;
+
+        /**
+         * @brief Rotates the session keys of the channel secure() set up; see SecureChannel::rekey().
+         * @return False with errno set if the keys were not rotated: ENOTSUP if there is no channel
+         *         or it has no keys to rotate.
+         */
+        bool rekey();
+
+        /**
+         * @brief Gets what identifies the remote end of the channel secure() set up; see
+         *        SecureChannel::remoteIdentity().
+         * @return The raw bytes, or empty without a channel.
+         */
+        std::string getRemoteIdentity() const;
+
+        /**
+         * @brief Reports why the last bindLocal() or initialize() call failed.
+         * @return The errno of the failed bind or connect, EINVAL for an invalid IP address, or 0 if none failed.
+         */
+        int getSetupError() const;
+
+        /**
+         * @brief Gets the address of the remote end of a connected socket.
+         * @return The address as "ip:port", or empty if the socket is not connected.
+         */
+        std::string getRemoteAddress() const;
+
+        /**
+         * @brief Gets the address the socket is bound to, such as the port the OS picked for a server
+         *        initialized with port 0.
+         * @return The address as "ip:port", "unix://path" or "mem://name", or empty if the socket is
+         *         not bound or its Unix domain socket is unnamed.
+         */
+        std::string getLocalAddress() const;
+
         /**
          * @brief Enables multicast on a UDP socket.
          * @param multicastIp Multicast group address (e.g., "224.0.0.251").
@@ -70,7 +270,13 @@ namespace relay
 
         /**
          * @brief Accepts a TCP client connection (TCP server only).
+         *
+         * The socket is not locked while waiting, so close() or stopListening() from another
+         * thread interrupts a blocked accept.
+         *
          * @return Shared pointer to a new SocketWrapper for the client.
+         * @throws ListenerClosedError If the socket is closed or stops listening before or while waiting.
+         * @throws std::runtime_error If accepting fails for another reason.
          */
         std::shared_ptr<SocketWrapper> accept();
 
@@ -81,6 +287,13 @@ namespace relay
          */
         size_t send(const std::string &data);
 
+        /**
+         * @brief Sends a whole frame, retrying partial writes.
+         * @param frame Frame to send.
+         * @return Bytes sent including the header, or 0 on failure.
+         */
+        size_t sendFrame(const Frame &frame);
+
         /**
          * @brief Sends data to a specific address (UDP only).
          * @param data Data to send.
@@ -96,6 +309,23 @@ namespace relay
          */
         std::string receive(size_t bufferSize);
 
+        /**
+         * @brief Receives the next frame.
+         *
+         * Bytes that arrive ahead of a complete frame are kept for the next call, so a frame
+         * split across reads or a read timeout is not lost. If the stream does not hold a valid
+         * frame the connection is closed, or with setFrameResync(true) the bytes up to the next
+         * frame marker are skipped; either way the desync is counted.
+         *
+         * It never waits for the socket: only bytes that have already arrived are read, so a
+         * frame whose rest is still on its way leaves incomplete set and the caller waits for
+         * readability (see waitReadable()) before calling again.
+         *
+         * @param incomplete Set if no frame was returned only because the rest of it has not arrived.
+         * @return The frame, or an empty optional if incomplete, on error or end-of-file.
+         */
+        std::optional<Frame> receiveFrame(bool &incomplete);
+
         /**
          * @brief Receives data with sender address (UDP only).
          * @param bufferSize Buffer size for receiving.
@@ -104,11 +334,44 @@ namespace relay
          */
         std::string receiveFrom(size_t bufferSize, struct ::sockaddr_in &senderAddr);
 
+        /**
+         * @brief Receives data with sender address and the local interface it arrived on (UDP only).
+         *
+         * The interface is known only once enableMulticast() has been called on the socket.
+         *
+         * @param bufferSize Buffer size for receiving.
+         * @param senderAddr Output parameter for sender’s address.
+         * @param interfaceName Output parameter for the receiving interface's name, such as "eth0", or empty if unknown.
+         * @return Received data, or empty string if failed.
+         */
+        std::string receiveFrom(size_t bufferSize, struct ::sockaddr_in &senderAddr, std::string &interfaceName);
+
         /**
          * @brief Closes the socket.
          */
         void close();
 
+        /**
+         * @brief Shuts a connection down without taking mutex_, waking a send or receive blocked on it.
+         *
+         * The socket stays open until close(). Listening sockets are left alone.
+         */
+        void interrupt();
+
+        /**
+         * @brief Stops a TCP server socket from accepting connections, waking any blocked accept().
+         *
+         * Unlike close() the socket stays open, so a peer that owns it keeps serving the clients
+         * it already accepted. Listening cannot be resumed; reinitialize the socket instead.
+         */
+        void stopListening();
+
+        /**
+         * @brief Checks whether a TCP server socket is open and still accepting connections.
+         * @return False for other modes, a closed socket, or after stopListening().
+         */
+        bool isListening() const;
+
         /**
          * @brief Checks if the socket is open.
          * @return True if open, false otherwise.
@@ -140,19 +403,167 @@ namespace relay
          */
         void shutdown(bool read = true, bool write = true);
 
+        /**
+         * @brief Corks or uncorks the socket (TCP_CORK on Linux, TCP_NOPUSH on BSD).
+         *
+         * While corked the kernel holds back partial segments so that small writes are
+         * coalesced into full ones; uncorking sends whatever is pending immediately.
+         *
+         * @param enabled True to cork, false to uncork.
+         * @return True on success, false if the option is unsupported or could not be set.
+         */
+        bool setCork(bool enabled);
+
+        /**
+         * @brief Gets the path MTU of a connected socket.
+         *
+         * Reads IP_MTU where available; otherwise, for TCP, reports the maximum segment size
+         * (TCP_MAXSEG) plus the IPv4 and TCP header sizes.
+         *
+         * @return The path MTU in bytes, or -1 if it cannot be determined.
+         */
+        int getPathMtu() const;
+
+        /**
+         * @brief Reads the send and receive buffer sizes (SO_SNDBUF, SO_RCVBUF) the kernel applied.
+         *
+         * These can differ from the sizes requested: Linux doubles them for bookkeeping overhead
+         * and caps them at net.core.wmem_max and net.core.rmem_max.
+         *
+         * @param sendBytes Set to the send buffer size.
+         * @param receiveBytes Set to the receive buffer size.
+         * @return True on success, false if the socket is closed or the sizes could not be read.
+         */
+        bool getBufferSizes(int &sendBytes, int &receiveBytes) const;
+
+        /**
+         * @brief Grows the kernel receive buffer (SO_RCVBUF) and the chunk receiveFrame() reads at once.
+         *
+         * Neither is shrunk. Bytes already read, including a partially received frame, are kept,
+         * so the connection carries on undisturbed.
+         *
+         * @param bytes Size to grow both to.
+         * @return True if both are at least bytes afterwards (as far as the kernel allows), false on error.
+         */
+        bool growReceiveBuffer(size_t bytes);
+
+        /**
+         * @brief Checks whether bytes read from the socket are waiting to be decoded by receiveFrame().
+         *
+         * Part of a frame that needs more bytes from the socket does not count.
+         * @return True if receiveFrame() has buffered data, false otherwise.
+         */
+        bool hasBufferedData() const;
+
+        /**
+         * @brief Checks whether the last sendFrame() failed transiently, so sending it again may succeed.
+         *
+         * Transient failures are a full send buffer or send timeout (EAGAIN), no buffer space
+         * (ENOBUFS) and an unreachable or down network (ENETUNREACH, EHOSTUNREACH, ENETDOWN),
+         * and only count if no bytes of the frame were written. A closed or reset connection is
+         * never transient.
+         *
+         * @return True if the last sendFrame() failed transiently, false if it succeeded or failed otherwise.
+         */
+        bool isSendRetryable() const;
+
+        /**
+         * @brief Selects whether receiveFrame() skips to the next frame marker, rather than
+         *        closing the connection, when it finds a corrupt frame header.
+         * @param enabled True to resync; false, the default, to close.
+         */
+        void setFrameResync(bool enabled);
+
+        /**
+         * @brief Counts the times receiveFrame() lost track of frame boundaries.
+         * @return Desyncs seen on this socket; a resync that needs several attempts counts once.
+         */
+        uint64_t getFrameDesyncs() const;
+
+        /**
+         * @brief Counts the fragments of unreliable frames that never arrived on a UDP connection.
+         * @return Fragments lost (see UdpStream::fragmentsLost()), 0 for other transports.
+         */
+        uint64_t getFragmentsLost() const;
+
+        /**
+         * @brief Checks whether receiveFrame() closed the socket because of a corrupt frame header.
+         * @return True if a desync closed the socket, false otherwise.
+         */
+        bool isDesynced() const;
+
+        /**
+         * @brief Waits until the socket is readable, or for a listening socket, has a pending connection.
+         * @param timeout How long to wait.
+         * @return True if the socket became readable within the timeout, false otherwise.
+         */
+        bool waitReadable(std::chrono::milliseconds timeout) const;
+
+        /**
+         * @brief Waits until the socket can take more data without blocking.
+         * @param timeout How long to wait.
+         * @return True if the socket became writable within the timeout, false otherwise.
+         */
+        bool waitWritable(std::chrono::milliseconds timeout) const;
+
+        /**
+         * @brief Waits for the remote end to close the connection, discarding anything it sends.
+         *
+         * Used after shutting down the write side so that close() does not reset a connection
+         * while the remote end is still reading what was sent.
+         *
+         * @param timeout How long to wait for end-of-file.
+         * @return True if the remote end closed within the timeout, false otherwise.
+         */
+        bool drainUntilClosed(std::chrono::milliseconds timeout);
+
         int getSocketFd() const { return socketFd_; };
 
         SocketMode getMode() const { return mode_; };
         
         void setReceiveTimeout(int seconds);
-        
+
+        /**
+         * @brief Applies the non-zero settings in options to the socket.
+         * @param options Settings to apply.
+         * @return True if every setting was applied, false otherwise.
+         */
+        bool applyOptions(const SocketOptions &options);
+
     private:
         int socketFd_; ///< Socket file descriptor.
         SocketMode mode_;
         mutable std::mutex mutex_;
         std::optional<std::function<void(const std::string &)>> errorHandler_;
         std::atomic<bool> isSocketOpen_;
-        bool useIPv6_;
+        bool useIPv6_; ///< Whether socketFd_ is an AF_INET6 socket.
+        BindOptions bindOptions_; ///< Set by setBindOptions().
+        std::string readBuffer_; ///< Received bytes not yet returned by receiveFrame().
+        size_t readChunkSize_ = 64 * 1024; ///< Bytes receiveFrame() asks recv() for at once.
+        bool readStalled_ = false; ///< readBuffer_ holds only part of a frame and the socket had no more.
+        int setupError_ = 0; ///< errno of the last failed bindLocal() or initialize().
+        std::chrono::milliseconds connectTimeout_{0}; ///< Longest connect() in initialize(), 0 for the OS default.
+        std::unique_ptr<SecureChannel> channel_; ///< Set by secure(); carries all traffic once set.
+        ConnectionHello remoteHello_;            ///< Announced by the remote end in secure().
+        int acceptsInFlight_ = 0; ///< Threads blocked in accept().
+        bool frameResync_ = false;  ///< Skip to the next marker on a corrupt header instead of closing.
+        bool resyncing_ = false;    ///< Scanning for a marker since the last corrupt header.
+        bool desynced_ = false;     ///< A corrupt header closed the socket.
+        uint64_t frameDesyncs_ = 0; ///< Times framing was lost.
+        bool sendRetryable_ = false; ///< Whether the last sendFrame() failed transiently; see isSendRetryable().
+        std::atomic<bool> listenerStopped_{false}; ///< Set by stopListening(); accept() refuses to wait.
+        int deferredCloseFd_ = -1; ///< Listening FD closed while accepts were in flight, released by the last of them.
+        std::optional<UdpSettings> udpSettings_;    ///< Set by useUdpTransport().
+        std::shared_ptr<UdpListener> udpListener_;  ///< UDP server sockets: accepts connections; socketFd_ polls its readyFd().
+        std::unique_ptr<UdpStream> udpStream_;      ///< UDP connections: socketFd_ is its stream socket.
+        std::string unixPath_;  ///< Path of a Unix domain server socket's file, removed by cleanup(); empty otherwise.
+        int unixMode_ = 0;      ///< Set by setUnixSocketMode().
+        dev_t unixDevice_ = 0;  ///< Identify the file unixPath_ names, so cleanup() leaves a replaced one alone.
+        ino_t unixInode_ = 0;
+        std::optional<ProxySettings> proxy_;             ///< Set by useProxy().
+        std::optional<std::pair<std::string, int>> local_; ///< IP and port set by bindLocal(), bound by initialize().
+        std::shared_ptr<MemoryListener> memoryListener_; ///< In-process server sockets: accepts connections; socketFd_ polls its readyFd().
+        std::string memoryAddress_;                      ///< Address of the in-process listener the socket is or is connected to.
 
         SocketWrapper(const SocketWrapper &) = delete;
         SocketWrapper &operator=(const SocketWrapper &) = delete;
@@ -161,6 +572,63 @@ namespace relay
 
         void handleError(const std::string &errorMessage);
         void cleanup();
+
+        /**
+         * @brief Connects the socket, waiting at most connectTimeout_. Caller must hold mutex_.
+         * @return 0 once connected, otherwise the errno of the failure.
+         */
+        int connectWithin(const sockaddr *address, socklen_t len);
+
+        /**
+         * @brief Does initialize() for a Unix domain socket at path. Caller must hold mutex_.
+         */
+        bool initializeUnixLocked(const std::string &path);
+
+        /**
+         * @brief Does initialize() for an in-process connection to or listener under name. Caller must hold mutex_.
+         */
+        bool initializeMemoryLocked(const std::string &name);
+
+        /**
+         * @brief Checks whether the socket is an IP socket, to which TCP options apply. Caller must hold mutex_.
+         */
+        bool isInetLocked() const;
+
+        /**
+         * @brief Replaces the socket with one of family unless it already is one. Fails with EINVAL
+         *        if bindLocal() set an address of another family. Caller must hold mutex_.
+         */
+        bool useFamilyLocked(int family);
+
+        /**
+         * @brief Gets the address bindLocal() set, as an address of family. Caller must hold mutex_.
+         * @return False if bindLocal() was not called.
+         */
+        bool localAddressLocked(int family, InetAddress &address) const;
+
+        /**
+         * @brief Sends through the channel if there is one, like ::send(). Caller must hold mutex_.
+         */
+        ssize_t sendLocked(const char *data, size_t len, int flags);
+
+        /**
+         * @brief Receives through the channel if there is one, like ::recv(). Caller must hold mutex_.
+         */
+        ssize_t receiveLocked(char *buffer, size_t len);
+
+        /**
+         * @brief Receives like receiveLocked(), but fails with EAGAIN rather than wait for data.
+         *        Caller must hold mutex_.
+         */
+        ssize_t receiveAvailableLocked(char *buffer, size_t len);
+
+        /**
+         * @brief Sends hello through the channel and receives the remote end's into remoteHello_.
+         *        Caller must hold mutex_.
+         * @param error Set to an errno value on failure.
+         * @return True if both hellos were exchanged before deadline.
+         */
+        bool exchangeHelloLocked(const ConnectionHello &hello, std::chrono::steady_clock::time_point deadline, int &error);
     };
 
 } // namespace relay
@@ -0,0 +1,79 @@
+#ifndef RELAY_TLS_H
+#define RELAY_TLS_H
+
+#include "secure_channel.h"
+#include <functional>
+#include <string>
+#include <vector>
+
+typedef struct ssl_ctx_st SSL_CTX;
+
+namespace relay
+{
+
+    /**
+     * @brief Checks the certificate chain the remote end presented, DER-encoded and leaf first,
+     * after the handshake. An empty chain means the remote end presented none.
+     */
+    using CertificateVerifier = std::function<bool(const std::vector<std::string> &chain)>;
+
+    /**
+     * @enum ClientAuth
+     * @brief Whether the accepting end of a TLS connection asks for a client certificate.
+     */
+    enum class ClientAuth
+    {
+        NONE,    ///< Do not ask.
+        REQUEST, ///< Ask, but accept a client without one.
+        REQUIRE  ///< Fail the handshake of a client without one.
+    };
+
+    /**
+     * @struct TlsSettings
+     * @brief Configuration of a TlsContext.
+     */
+    struct TlsSettings
+    {
+        std::vector<std::string> certificateChain; ///< DER certificates, leaf first. Required to accept connections.
+        std::string privateKey;                    ///< DER (PKCS#8 or traditional) key of the leaf certificate.
+        std::string serverName;                    ///< Name sent in the SNI extension when connecting, empty for none.
+        ClientAuth clientAuth = ClientAuth::NONE;  ///< Client certificates asked for when accepting.
+        int minVersion = 0;                        ///< Lowest protocol version, e.g. 0x0303 for TLS 1.2; 0 for TLS 1.2.
+        int maxVersion = 0;                        ///< Highest protocol version, 0 for the highest supported.
+        bool authenticatesPeer = false;            ///< Whether verify only accepts chains that prove who the remote end is.
+        CertificateVerifier verify;                ///< Called after each handshake; empty accepts any chain.
+    };
+
+    /**
+     * @class TlsContext
+     * @brief ChannelSecurity that runs TLS, using OpenSSL, on a peer's connections.
+     *
+     * OpenSSL's own chain verification is disabled: the chain is passed to the settings' verifier
+     * instead, so the caller decides which certificates it trusts. Each channel's remoteIdentity()
+     * is the remote end's DER leaf certificate. This class is thread-safe.
+     */
+    class TlsContext : public ChannelSecurity
+    {
+    public:
+        /**
+         * @brief Creates the context.
+         * @param settings The configuration.
+         * @throws std::runtime_error if the certificate or key cannot be loaded or do not match.
+         */
+        explicit TlsContext(TlsSettings settings);
+        ~TlsContext() override;
+
+        std::unique_ptr<SecureChannel> handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const override;
+        bool authenticatesPeer() const override;
+
+    private:
+        TlsSettings settings_;
+        SSL_CTX *ctx_ = nullptr;
+
+        TlsContext(const TlsContext &) = delete;
+        TlsContext &operator=(const TlsContext &) = delete;
+    };
+
+} // namespace relay
+
+#endif
@@ -0,0 +1,157 @@
+#ifndef RELAY_UDP_H
+#define RELAY_UDP_H
+
+#include <chrono>
+#include <cstddef>
+#include <memory>
+#include <string>
+#include "inet_address.h"
+
+namespace relay
+{
+
+    /// Largest datagram a UDP connection sends, so datagrams fit the path MTU of common networks unfragmented.
+    constexpr size_t UDP_DATAGRAM_SIZE = 1200;
+
+    /**
+     * @struct UdpSettings
+     * @brief Reliability settings of UDP connections.
+     */
+    struct UdpSettings
+    {
+        std::chrono::milliseconds retransmitTimeout{200}; ///< Wait for an acknowledgement before resending, until round trips have been measured.
+        size_t window = 256;                              ///< Segments sent ahead of acknowledgements, and held for reassembly.
+        std::chrono::milliseconds idleTimeout{15000};     ///< A connection that hears nothing for this long is dropped; keepalives go out at a quarter of it.
+        std::chrono::milliseconds reassemblyTimeout{1000}; ///< An unreliable frame still missing fragments this long after its first arrived is dropped.
+    };
+
+    class UdpEndpoint;
+    struct UdpSession;
+
+    /**
+     * @class UdpStream
+     * @brief The local end of a UDP connection: a stream socket whose bytes the connection carries.
+     *
+     * The bytes written to fd() are sent reliably and in order, and the bytes the remote end sent
+     * are read from it, so a SocketWrapper can use it in place of a TCP socket. Closing fd() closes
+     * the connection; shutting down its write side sends end-of-file to the remote end. While the
+     * stream holds relay frames (see frame.h), a frame flagged FRAME_UNRELIABLE is sent in
+     * datagrams without retransmission instead, and the receiver inserts it between the frames it
+     * has reassembled, or drops it if a datagram was lost: its fragments may arrive in any order,
+     * and one still incomplete after UdpSettings::reassemblyTimeout is dropped.
+     */
+    class UdpStream
+    {
+    public:
+        /**
+         * @brief Wraps the local end of a connection. Used by connectUdp() and UdpListener::accept().
+         */
+        UdpStream(std::shared_ptr<UdpSession> session, int fd, std::string remoteAddress);
+
+        /**
+         * @brief Gets the stream socket. The caller owns it and closes it to end the connection.
+         */
+        int fd() const { return fd_; }
+
+        /**
+         * @brief Gets the remote end's address as "ip:port".
+         */
+        const std::string &remoteAddress() const { return remoteAddress_; }
+
+        /**
+         * @brief Gets the address of the UDP socket the connection runs on, as "ip:port".
+         */
+        std::string localAddress() const;
+
+        /**
+         * @brief Stops treating the stream as relay frames, so bytes a ChannelSecurity encrypts or frames
+         *        pass through intact; every byte is then sent reliably. Call before writing to fd().
+         */
+        void disableFraming();
+
+        /**
+         * @brief Counts the fragments of unreliable frames that never arrived, in frames dropped
+         *        because they were still incomplete after the reassembly timeout or were evicted by
+         *        newer ones.
+         */
+        uint64_t fragmentsLost() const;
+
+    private:
+        std::shared_ptr<UdpSession> session_;
+        int fd_;
+        std::string remoteAddress_;
+    };
+
+    /**
+     * @class UdpListener
+     * @brief Accepts UDP connections on a bound UDP socket.
+     *
+     * One background thread sends, receives and retransmits for every connection the listener
+     * accepted; it runs until the listener is stopped and all of them have closed.
+     */
+    class UdpListener
+    {
+    public:
+        /**
+         * @brief Binds a UDP socket and starts accepting connections on it.
+         * @param address Local address to bind.
+         * @param settings Reliability settings of the accepted connections.
+         * @param bind Settings of the UDP socket.
+         * @param error Set to the errno of a failed bind.
+         * @return The listener, or nullptr on failure.
+         */
+        static std::unique_ptr<UdpListener> open(const InetAddress &address, const UdpSettings &settings, const BindOptions &bind, int &error);
+
+        /**
+         * @brief Stops the listener. Accepted connections stay open.
+         */
+        ~UdpListener();
+
+        /**
+         * @brief Gets a descriptor that polls readable while a connection waits for accept().
+         */
+        int readyFd() const;
+
+        /**
+         * @brief Gets the address the UDP socket is bound to, as "ip:port".
+         */
+        std::string localAddress() const;
+
+        /**
+         * @brief Sets how many connections may wait for accept(); later ones are refused.
+         */
+        void setBacklog(int backlog);
+
+        /**
+         * @brief Waits for a connection.
+         * @return The connection, or nullptr once the listener is stopped.
+         */
+        std::unique_ptr<UdpStream> accept();
+
+        /**
+         * @brief Refuses new connections and wakes blocked accept() calls, closing the connections
+         *        that were waiting for one.
+         */
+        void stop();
+
+    private:
+        explicit UdpListener(std::shared_ptr<UdpEndpoint> endpoint);
+        std::shared_ptr<UdpEndpoint> endpoint_;
+    };
+
+    /**
+     * @brief Opens a UDP connection to a listener.
+     * @param local Local address to bind, of the same family as remote, or nullptr for an ephemeral port.
+     * @param remote Address of the listener.
+     * @param settings Reliability settings.
+     * @param timeout Longest wait for the listener to answer, or 0 for settings.idleTimeout.
+     * @param error Set to the errno of a failure: that of a failed bind, EINVAL if local and remote
+     *              are of different families, ECONNREFUSED if nothing listens at remote, or ETIMEDOUT.
+     * @return The connection, or nullptr on failure.
+     */
+    std::unique_ptr<UdpStream> connectUdp(const InetAddress *local, const InetAddress &remote, const UdpSettings &settings,
+                                          std::chrono::milliseconds timeout, int &error);
+
+} // namespace relay
+
+#endif
@@ -0,0 +1,59 @@
+#ifndef RELAY_WEBSOCKET_H
+#define RELAY_WEBSOCKET_H
+
+#include "secure_channel.h"
+#include <memory>
+#include <string>
+
+namespace relay
+{
+
+    /// Largest WebSocket message payload a WebSocketContext channel accepts, in bytes.
+    constexpr size_t MAX_WEBSOCKET_PAYLOAD = 16u << 20;
+
+    /**
+     * @struct WebSocketSettings
+     * @brief Configuration of a WebSocketContext.
+     */
+    struct WebSocketSettings
+    {
+        std::string path = "/"; ///< Request path a connecting end asks for and an accepting end requires.
+        std::string host;       ///< Host header a connecting end sends; empty sends the socket's peer address.
+        std::shared_ptr<const ChannelSecurity> inner; ///< Runs first on the socket (TLS for wss://), nullptr for ws://.
+    };
+
+    /**
+     * @class WebSocketContext
+     * @brief ChannelSecurity that carries a peer's byte stream in WebSocket binary messages (RFC 6455).
+     *
+     * The handshake is the HTTP/1.1 upgrade: connecting ends send a GET for the path and accepting
+     * ends answer 101, or 404 for another path. Each write() is sent as one binary message, masked
+     * by connecting ends as the RFC requires; read() returns the payloads of binary and text
+     * messages as one stream, so message boundaries need not match the frames inside them. Pings
+     * are answered and a close message ends the channel. authenticatesPeer() and each channel's
+     * remoteIdentity() are those of the inner security. This class is thread-safe.
+     */
+    class WebSocketContext : public ChannelSecurity
+    {
+    public:
+        /**
+         * @brief Creates the context.
+         * @param settings The configuration.
+         * @throws std::invalid_argument if the path does not start with '/' or holds spaces or line breaks.
+         */
+        explicit WebSocketContext(WebSocketSettings settings);
+
+        std::unique_ptr<SecureChannel> handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const override;
+
+        /**
+         * @brief Returns whether the inner security authenticates the remote end.
+         */
+        bool authenticatesPeer() const override;
+
+    private:
+        WebSocketSettings settings_;
+    };
+
+} // namespace relay
+
+#endif
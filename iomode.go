@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// IOMode selects how a PeerManager's peers write the messages queued by
+// SendConflated.
+type IOMode int
+
+const (
+	// IOModePerPeer gives each peer its own writer goroutine, started on
+	// first use and kept until the peer is closed.
+	IOModePerPeer IOMode = iota
+	// IOModePooled shares a fixed pool of runtime.GOMAXPROCS(0) writer
+	// goroutines among every peer in the manager, so the goroutine count
+	// stays constant however many peers are managed.
+	IOModePooled
+)
+
+// goroutines counts the background goroutines the package is running.
+var goroutines atomic.Int64
+
+// Goroutines returns the number of background goroutines the package is
+// running across all peers and managers, such as writers, receipt pollers
+// and relay streams.
+func Goroutines() int {
+	return int(goroutines.Load())
+}
+
+// spawn runs fn in a goroutine counted by Goroutines.
+func spawn(fn func()) {
+	goroutines.Add(1)
+	go func() {
+		defer goroutines.Add(-1)
+		fn()
+	}()
+}
+
+// ioPool is a PeerManager's shared writer pool. Outboxes with messages
+// waiting are queued on it and served one message per turn, so a busy peer
+// cannot starve the others.
+type ioPool struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	mode    IOMode
+	closed  bool
+	ready   []*outbox
+	workers int // Writer goroutines running
+}
+
+// pooled reports whether outboxes sharing the pool should be served by it.
+func (p *ioPool) pooled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode == IOModePooled && !p.closed
+}
+
+// setMode switches the pool's mode. Workers exit once no outbox is waiting
+// after a switch to IOModePerPeer.
+func (p *ioPool) setMode(mode IOMode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mode = mode
+	if p.cond.L != nil {
+		p.cond.Broadcast()
+	}
+}
+
+// submit queues o to have its next message written, starting a worker if
+// fewer than the pool size are running.
+func (p *ioPool) submit(o *outbox) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cond.L == nil {
+		p.cond.L = &p.mu
+	}
+	p.ready = append(p.ready, o)
+	if p.workers < runtime.GOMAXPROCS(0) {
+		p.workers++
+		spawn(p.work)
+		return
+	}
+	p.cond.Signal()
+}
+
+// work serves queued outboxes until none is waiting and the pool is no
+// longer in pooled mode.
+func (p *ioPool) work() {
+	p.mu.Lock()
+	for {
+		for len(p.ready) == 0 && p.mode == IOModePooled && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.ready) == 0 {
+			p.workers--
+			p.mu.Unlock()
+			return
+		}
+		o := p.ready[0]
+		p.ready[0] = nil
+		p.ready = p.ready[1:]
+		p.mu.Unlock()
+		o.serve()
+		p.mu.Lock()
+	}
+}
+
+// close stops the workers once the outboxes already queued are served.
+func (p *ioPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.cond.L != nil {
+		p.cond.Broadcast()
+	}
+}
+
+// SetIOMode selects how the manager's peers write the messages queued by
+// SendConflated. With IOModePooled a fixed pool of goroutines writes for
+// every peer instead of one goroutine per peer; see Goroutines to check the
+// footprint. Peers switch modes between messages, and a peer keeps the mode
+// of its manager only while it is managed.
+func (m *PeerManager) SetIOMode(mode IOMode) {
+	m.io.setMode(mode)
+	m.mu.RLock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	m.mu.RUnlock()
+	for _, p := range peers {
+		// Let idle per-peer writers hand over to the pool.
+		p.out.wake()
+	}
+}
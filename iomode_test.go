@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestPooledIOMode(t *testing.T) {
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.SetIOMode(IOModePooled)
+	n := runtime.GOMAXPROCS(0) + 4
+	servers := make([]*Peer, n)
+	clients := make([]*Peer, n)
+	for i := range n {
+		servers[i], clients[i] = newPairIDs(t, fmt.Sprint("server", i), fmt.Sprint("client", i))
+		m.AddPeer(clients[i])
+	}
+
+	before := Goroutines()
+	for _, client := range clients {
+		client.SendConflated("", "pooled")
+	}
+	for _, client := range clients {
+		client.Flush()
+	}
+	if grown := Goroutines() - before; grown > runtime.GOMAXPROCS(0) {
+		t.Fatalf("%d goroutines started for %d peers, want at most the pool size", grown, n)
+	}
+	for _, server := range servers {
+		if got := receive(t, server); got != "pooled" {
+			t.Fatalf("got %q, want %q", got, "pooled")
+		}
+	}
+}
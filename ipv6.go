@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IPPreference chooses the address a peer uses when its host name resolves
+// to both IPv4 and IPv6 addresses.
+type IPPreference int
+
+const (
+	// PreferIPv4 uses an IPv4 address of a host name if it has one. It is
+	// the default.
+	PreferIPv4 IPPreference = iota
+
+	// PreferIPv6 uses an IPv6 address of a host name if it has one.
+	PreferIPv6
+)
+
+// WithIPPreference sets which of a host name's addresses the peer connects
+// to or listens on when the name has both. A peer's address may be an IPv4
+// address, an IPv6 address with or without brackets ("::1" or "[::1]",
+// with a zone as in "fe80::1%eth0") or a host name, which is resolved when
+// the peer is created or moved with WithAddress, unless a proxy resolves
+// it (see WithProxy).
+func WithIPPreference(pref IPPreference) PeerOption {
+	return func(c *peerConfig) { c.ipPreference = pref }
+}
+
+// WithIPv6Only makes a server peer listening on the IPv6 wildcard address
+// "::" accept only IPv6 clients. Without it the peer is dual-stack: IPv4
+// clients connect too, and their addresses read as IPv4. It only takes
+// effect when the peer is created.
+func WithIPv6Only() PeerOption {
+	return func(c *peerConfig) { c.ipv6Only = true }
+}
+
+// unbracket strips the brackets around an IPv6 address such as "[::1]".
+func unbracket(ip string) string {
+	if len(ip) > 2 && ip[0] == '[' && ip[len(ip)-1] == ']' {
+		return ip[1 : len(ip)-1]
+	}
+	return ip
+}
+
+// hostIP returns the address the C library opens cfg's peer at: cfg.ip
+// itself if it is an IP address, has a scheme or is resolved by a proxy,
+// and otherwise the address cfg.ip resolves to.
+func (c *peerConfig) hostIP() (string, error) {
+	if _, err := netip.ParseAddr(c.ip); err == nil || c.ip == "" || strings.Contains(c.ip, "://") || c.proxyURL() != "" {
+		return c.ip, nil
+	}
+	return resolveHost(c.ip, c.ipPreference)
+}
+
+// resolveHost returns an address of host of the family pref asks for, or
+// another address if it has none.
+func resolveHost(host string, pref IPPreference) (string, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return "", fmt.Errorf("%w: cannot resolve %q", ErrInvalidAddress, host)
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (pref == PreferIPv4) {
+			return ip.String(), nil
+		}
+	}
+	return ips[0].String(), nil
+}
@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"sort"
+	"strings"
+)
+
+// SendMessageLane queues a message to be sent to the peer in the background
+// on the named priority lane. Each lane is its own queue; the writer picks
+// the next message from the waiting lanes in proportion to their weights
+// (see SetLaneWeights), or always from the heaviest one with
+// SetStrictLanes, so urgent traffic is not stuck behind a bulk transfer.
+// The empty lane is the one SendConflated uses.
+func (p *Peer) SendMessageLane(message, lane string) {
+	p.out.push(lane, "", message, p.sendQueued)
+}
+
+// Priority is the class of a message sent with SendPriority. Waiting
+// messages of a higher class are always written first, whatever their
+// lanes' weights, so control traffic is never starved behind bulk data.
+type Priority int
+
+const (
+	// PriorityBulk is for large transfers and other traffic that can wait.
+	PriorityBulk Priority = iota - 1
+	// PriorityNormal is the class of messages queued by SendConflated and
+	// SendMessageLane.
+	PriorityNormal
+	// PriorityHigh is for latency-sensitive application messages.
+	PriorityHigh
+	// PriorityControl is for heartbeats and control messages.
+	PriorityControl
+)
+
+// String returns the priority name.
+func (p Priority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityControl:
+		return "control"
+	default:
+		return "unknown"
+	}
+}
+
+// priorityLanes names the internal lanes of the priority classes other
+// than PriorityNormal, which uses the empty lane. The leading NUL keeps
+// them apart from lanes named by the application.
+var priorityLanes = map[Priority]string{
+	PriorityBulk:    "\x00bulk",
+	PriorityHigh:    "\x00high",
+	PriorityControl: "\x00control",
+}
+
+// SendPriority queues a message to be sent to the peer in the background
+// in the given priority class. The writer always takes the next message
+// from the highest class that has messages waiting; PriorityNormal shares
+// the queue of SendConflated and SendMessageLane, whose lanes compete by
+// weight among themselves. A message already being written is finished
+// first, and SendUrgent still jumps every queue.
+func (p *Peer) SendPriority(message string, priority Priority) {
+	p.out.push(priorityLanes[priority], "", message, p.sendQueued)
+}
+
+// lanePriority returns the priority class of lane.
+func lanePriority(lane string) Priority {
+	if !strings.HasPrefix(lane, "\x00") {
+		return PriorityNormal
+	}
+	for priority, name := range priorityLanes {
+		if name == lane {
+			return priority
+		}
+	}
+	return PriorityNormal
+}
+
+// SetLaneWeights sets the weight of each named lane used by SendMessageLane.
+// Lanes not listed, and weights below 1, count as 1. With weights of 4 for
+// "control" and 1 for "bulk", four control messages are written for every
+// bulk one while both have messages waiting.
+func (p *Peer) SetLaneWeights(weights map[string]int) {
+	o := &p.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.laneWeights = make(map[string]int, len(weights))
+	for lane, w := range weights {
+		o.laneWeights[lane] = w
+	}
+	o.laneCurrent = nil
+}
+
+// SetStrictLanes selects strict priority between lanes: when enabled the
+// writer always takes the next message from the waiting lane with the
+// highest weight, so lighter lanes wait until heavier ones are empty.
+func (p *Peer) SetStrictLanes(strict bool) {
+	p.out.mu.Lock()
+	defer p.out.mu.Unlock()
+	p.out.laneStrict = strict
+}
+
+// BroadcastLane queues a message for every managed peer on the named lane,
+// as if SendMessageLane were called on each of them. It returns false once
+// the manager is quiescing.
+func (m *PeerManager) BroadcastLane(message, lane string) bool {
+	if !m.work.enter() {
+		return false
+	}
+	defer m.work.exit()
+	m.mu.RLock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	m.mu.RUnlock()
+	for _, p := range peers {
+		p.SendMessageLane(message, lane)
+	}
+	return true
+}
+
+// laneWeightLocked returns the weight of lane. Caller must hold o.mu.
+func (o *outbox) laneWeightLocked(lane string) int {
+	if w, ok := o.laneWeights[lane]; ok && w > 1 {
+		return w
+	}
+	return 1
+}
+
+// nextLaneLocked returns the lane to write from next among the waiting
+// lanes of the highest priority class: the heaviest one in strict mode,
+// otherwise the one chosen by smooth weighted round-robin. Caller must hold
+// o.mu and the queue must not be empty.
+func (o *outbox) nextLaneLocked() string {
+	top := PriorityBulk
+	for lane := range o.lanes {
+		top = max(top, lanePriority(lane))
+	}
+	lanes := make([]string, 0, len(o.lanes))
+	for lane := range o.lanes {
+		if lanePriority(lane) == top {
+			lanes = append(lanes, lane)
+		}
+	}
+	if len(lanes) == 1 {
+		return lanes[0]
+	}
+	sort.Strings(lanes)
+	best, total := 0, 0
+	if o.laneCurrent == nil {
+		o.laneCurrent = make(map[string]int)
+	}
+	for i, lane := range lanes {
+		w := o.laneWeightLocked(lane)
+		if o.laneStrict {
+			if w > o.laneWeightLocked(lanes[best]) {
+				best = i
+			}
+			continue
+		}
+		total += w
+		o.laneCurrent[lane] += w
+		if o.laneCurrent[lane] > o.laneCurrent[lanes[best]] {
+			best = i
+		}
+	}
+	if !o.laneStrict {
+		o.laneCurrent[lanes[best]] -= total
+	}
+	return lanes[best]
+}
+
+// popLaneLocked takes the oldest message off lane. Caller must hold o.mu
+// and the lane must not be empty.
+func (o *outbox) popLaneLocked(lane string) *queuedMessage {
+	queue := o.lanes[lane]
+	q := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		// An empty lane gives up its place in the rotation.
+		delete(o.lanes, lane)
+		delete(o.laneCurrent, lane)
+	} else {
+		o.lanes[lane] = queue[1:]
+	}
+	o.queued--
+	return q
+}
+
+// popOldestLocked takes the message queued first, across all lanes, off
+// the queue. Caller must hold o.mu and the queue must not be empty.
+func (o *outbox) popOldestLocked() *queuedMessage {
+	oldest := ""
+	var seq uint64
+	for lane, queue := range o.lanes {
+		if seq == 0 || queue[0].seq < seq {
+			oldest, seq = lane, queue[0].seq
+		}
+	}
+	return o.popLaneLocked(oldest)
+}
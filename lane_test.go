@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+)
+
+// laneOrder queues four bulk and four control messages behind a stalled
+// write and returns the order the lanes were written in.
+func laneOrder(t *testing.T, strict bool) string {
+	t.Helper()
+	var o outbox
+	o.laneWeights = map[string]int{"control": 3}
+	o.laneStrict = strict
+	s := newStalledSender()
+	o.push("", "", "first", s.send)
+	<-s.started
+	for range 4 {
+		o.push("bulk", "", "b", s.send)
+	}
+	for range 4 {
+		o.push("control", "", "c", s.send)
+	}
+	s.release()
+	o.flush()
+	o.close()
+	return strings.Join(s.messages()[1:], "")
+}
+
+func TestLaneWeights(t *testing.T) {
+	// Weighted-fair lanes write three control messages for each bulk one.
+	if got := laneOrder(t, false); strings.Count(got[:4], "c") != 3 {
+		t.Fatalf("lanes written as %q, want 3 control messages in the first 4", got)
+	}
+	if got := laneOrder(t, true); got != "ccccbbbb" {
+		t.Fatalf("strict lanes written as %q, want every control message first", got)
+	}
+}
+
+func TestPriorityClasses(t *testing.T) {
+	var o outbox
+	s := newStalledSender()
+	o.push("", "", "first", s.send)
+	<-s.started
+	o.push(priorityLanes[PriorityBulk], "", "bulk", s.send)
+	o.push("", "", "normal", s.send)
+	o.push(priorityLanes[PriorityHigh], "", "high", s.send)
+	o.push(priorityLanes[PriorityControl], "", "control", s.send)
+	s.release()
+	o.flush()
+	o.close()
+
+	if got, want := strings.Join(s.messages()[1:], " "), "control high normal bulk"; got != want {
+		t.Fatalf("written as %q, want %q", got, want)
+	}
+}
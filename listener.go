@@ -0,0 +1,352 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listenerPollInterval bounds how long the reader of a Listener's Conns
+// waits for a message before checking for closed clients and whether it
+// should stop.
+const listenerPollInterval = 100 * time.Millisecond
+
+// peerListener is the net.Listener Peer.Listener returns.
+type peerListener struct {
+	peer      *Peer
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Listener returns a net.Listener over a server peer, so an HTTP or gRPC
+// server can run directly on the relay listener. Each Accept waits for a
+// client to connect and returns a net.Conn to that client alone, which
+// works like the Conn of Peer.Conn: Write sends its bytes to the client as
+// messages of up to 64 KiB, and Read returns the bytes of the messages the
+// client sent, then io.EOF once the client has closed. Write deadlines are
+// checked before each message, since a send to one client cannot be
+// interrupted.
+//
+// While any such Conn is open a goroutine receives the peer's messages and
+// hands each to the Conn of the client that sent it, holding them until
+// they are read. Messages from clients accepted otherwise are dropped, so
+// do not receive from the peer directly or accept clients with Accept or
+// AcceptClients while the Listener is in use. Closing the Listener stops
+// the peer accepting clients like StopAccepting and leaves the Conns it
+// accepted open; closing the peer closes them.
+func (p *Peer) Listener() net.Listener {
+	return &peerListener{peer: p, closed: make(chan struct{})}
+}
+
+// Accept waits for the next client and returns a Conn to it. Once the
+// Listener or the peer is closed it returns an error wrapping
+// net.ErrClosed.
+func (l *peerListener) Accept() (net.Conn, error) {
+	client, err := l.peer.Accept()
+	if err == nil {
+		c := &clientConn{
+			connState: connState{closed: make(chan struct{})},
+			client:    client,
+			remote:    l.peer.clientAddr(client),
+			arrived:   make(chan struct{}, 1),
+		}
+		if l.peer.conns.add(l.peer, c) {
+			return c, nil
+		}
+		client.Close()
+		err = net.ErrClosed
+	}
+	if err == ErrListenerClosed {
+		err = net.ErrClosed
+	}
+	return nil, &net.OpError{Op: "accept", Net: "relay", Addr: l.Addr(), Err: err}
+}
+
+// Close stops the peer accepting clients. Conns already accepted stay open.
+func (l *peerListener) Close() error {
+	err := error(&net.OpError{Op: "close", Net: "relay", Addr: l.Addr(), Err: net.ErrClosed})
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.peer.StopAccepting()
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the peer's LocalAddr, or an address of network "relay"
+// holding the peer's ID if that is unknown.
+func (l *peerListener) Addr() net.Addr {
+	if addr := l.peer.LocalAddr(); addr != nil {
+		return addr
+	}
+	return connAddr(l.peer.id)
+}
+
+// clientAddr returns the remote address of a client of the server peer,
+// or an address of network "relay" holding it if it cannot be parsed.
+func (p *Peer) clientAddr(c *Client) net.Addr {
+	addr := c.Addr()
+	_, udp := p.addrConfig()
+	if parsed := parseAddr(addr, udp); parsed != nil {
+		return parsed
+	}
+	return connAddr(addr)
+}
+
+// clientConn is the net.Conn a Listener returns for one client.
+type clientConn struct {
+	connState
+	client *Client
+	remote net.Addr
+
+	readMu  sync.Mutex
+	pending []byte // Rest of the last message read, not returned yet
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	incoming [][]byte      // Messages received from the client and not read yet
+	eof      bool          // The client closed and nothing more will arrive
+	arrived  chan struct{} // Signalled when incoming or eof changes
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(c.pending) == 0 {
+		ctx, done := c.context(&c.readDeadline)
+		data, err := c.next(ctx)
+		done()
+		if err != nil {
+			if err == io.EOF && !c.isClosed() {
+				return 0, io.EOF
+			}
+			return 0, c.opError(c, "read", err, ctx)
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+connWriteChunk)]
+		var err error
+		switch {
+		case c.isClosed():
+			err = net.ErrClosed
+		case isClosedChan(c.writeDeadline.wait()):
+			err = os.ErrDeadlineExceeded
+		default:
+			err = c.client.SendBytes(chunk)
+		}
+		if err != nil {
+			return written, c.opError(c, "write", err, context.Background())
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close closes the connection to the client. Reads and writes in progress
+// return net.ErrClosed.
+func (c *clientConn) Close() error {
+	err := error(&net.OpError{Op: "close", Net: "relay", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: net.ErrClosed})
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.client.peer.conns.remove(c)
+		c.client.Close()
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the server peer's LocalAddr, or an address of network
+// "relay" holding the peer's ID if that is unknown.
+func (c *clientConn) LocalAddr() net.Addr {
+	if addr := c.client.peer.LocalAddr(); addr != nil {
+		return addr
+	}
+	return connAddr(c.client.peer.id)
+}
+
+// RemoteAddr returns the address of the client as it was accepted.
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// next returns the next message received from the client, waiting until
+// one arrives, the client closes or ctx is done.
+func (c *clientConn) next(ctx context.Context) ([]byte, error) {
+	for {
+		c.mu.Lock()
+		if len(c.incoming) > 0 {
+			data := c.incoming[0]
+			c.incoming[0] = nil
+			c.incoming = c.incoming[1:]
+			c.mu.Unlock()
+			return data, nil
+		}
+		eof := c.eof
+		c.mu.Unlock()
+		if eof {
+			return nil, io.EOF
+		}
+		select {
+		case <-c.arrived:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// deliver queues a message received from the client for Read.
+func (c *clientConn) deliver(data []byte) {
+	c.mu.Lock()
+	c.incoming = append(c.incoming, data)
+	c.mu.Unlock()
+	c.signal()
+}
+
+// finish makes Read return io.EOF once the messages queued are read.
+func (c *clientConn) finish() {
+	c.mu.Lock()
+	c.eof = true
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *clientConn) signal() {
+	select {
+	case c.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// connDemux hands the messages a server peer receives to the Conns of the
+// clients its Listener accepted. While any of them is open a goroutine
+// receives the messages.
+type connDemux struct {
+	mu      sync.Mutex
+	conns   map[uint64]*clientConn
+	running bool
+	closed  bool
+	done    chan struct{}
+}
+
+// add registers c and starts the reader if it is not running. It reports
+// false once the peer is closed.
+func (d *connDemux) add(p *Peer, c *clientConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	if d.conns == nil {
+		d.conns = make(map[uint64]*clientConn)
+	}
+	d.conns[c.client.id] = c
+	if !d.running {
+		d.running = true
+		d.done = make(chan struct{})
+		spawn(func() { d.run(p) })
+	}
+	return true
+}
+
+// remove forgets c, dropping messages that arrive for it later.
+func (d *connDemux) remove(c *clientConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[c.client.id] == c {
+		delete(d.conns, c.client.id)
+	}
+}
+
+// run receives messages until no Conn is open or the demux is closed.
+func (d *connDemux) run(p *Peer) {
+	defer close(d.done)
+	swept := time.Now()
+	for {
+		d.mu.Lock()
+		if d.closed || len(d.conns) == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		data, id, status := p.receiveFrom(C.int64_t(listenerPollInterval.Milliseconds()))
+		switch status {
+		case C.RELAY_OK:
+			d.mu.Lock()
+			if c := d.conns[id]; c != nil {
+				c.deliver(data)
+			}
+			d.mu.Unlock()
+		case C.RELAY_ERR_TIMEOUT:
+		default:
+			// A server peer with no open clients fails at once instead of
+			// waiting for a message.
+			time.Sleep(listenerPollInterval)
+		}
+		if status != C.RELAY_OK || time.Since(swept) >= listenerPollInterval {
+			d.sweep(p)
+			swept = time.Now()
+		}
+	}
+}
+
+// sweep ends the Conns of clients that have closed and whose messages have
+// all been delivered.
+func (d *connDemux) sweep(p *Peer) {
+	d.mu.Lock()
+	conns := make([]*clientConn, 0, len(d.conns))
+	for _, c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	for _, c := range conns {
+		if C.relay_is_client_drained(p.ptr, C.uint64_t(c.client.id)) == 1 {
+			d.remove(c)
+			c.finish()
+		}
+	}
+}
+
+// close stops the reader and ends every Conn; their reads return io.EOF
+// once the messages already delivered are read.
+func (d *connDemux) close() {
+	d.mu.Lock()
+	d.closed = true
+	running, done := d.running, d.done
+	d.mu.Unlock()
+	if running {
+		<-done
+	}
+	d.mu.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.mu.Unlock()
+	for _, c := range conns {
+		c.finish()
+	}
+}
@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	l := server.Listener()
+	if l.Addr().String() != server.LocalAddr().String() {
+		t.Fatalf("Listener Addr = %v, want %v", l.Addr(), server.LocalAddr())
+	}
+	// Echo whatever each client writes.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	for _, id := range []string{"first", "second"} {
+		client, err := OpenPeer(id, "127.0.0.1", port, 0)
+		if err != nil {
+			t.Fatalf("OpenPeer %s: %v", id, err)
+		}
+		t.Cleanup(client.Destroy)
+		c := client.Conn()
+		if _, err := c.Write([]byte("hello " + id)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		buf := make([]byte, len("hello "+id))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello "+id {
+			t.Fatalf("echo = %q, %v, want %q", buf, err, "hello "+id)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close: %v, want net.ErrClosed", err)
+	}
+}
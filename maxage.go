@@ -0,0 +1,126 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// MaxAgeReason is the goodbye reason sent to a client whose connection is
+// closed by SetMaxConnectionAge.
+const MaxAgeReason = "max age reached"
+
+// maxAgePollInterval bounds how often the connection ager checks for
+// expired clients.
+const maxAgePollInterval = time.Second
+
+// connectionAger retires a server peer's client connections once they reach
+// the maximum age, from a goroutine that runs while a maximum is set.
+type connectionAger struct {
+	mu      sync.Mutex
+	maxAge  time.Duration
+	running bool
+	closed  bool
+	wake    chan struct{} // Signals the goroutine that maxAge changed or the ager closed
+	done    chan struct{}
+}
+
+// SetMaxConnectionAge limits how long a server peer keeps an accepted client
+// connection. Once a connection is older than d the client is sent a goodbye
+// with the reason MaxAgeReason and the connection is closed gracefully: the
+// client reads every message sent before the goodbye, and messages it sent
+// before seeing it can still be received here. The client then closes its
+// side, and reports ErrPeerDisconnected with the reason in GoodbyeReason, so
+// it can reconnect, possibly to another server behind a load balancer. A
+// client that does not close within DefaultCloseTimeout is disconnected.
+// Connections are checked at least once a second, so one may outlive d by
+// that much. A d of 0 removes the limit.
+func (p *Peer) SetMaxConnectionAge(d time.Duration) {
+	p.ager.set(p, d)
+}
+
+// GoodbyeReason returns the reason the remote end gave for closing the
+// connection with a goodbye, such as MaxAgeReason, or "" if it gave none.
+func (p *Peer) GoodbyeReason() string {
+	if !p.enter() {
+		return ""
+	}
+	defer p.leave()
+	cStr := C.relay_get_goodbye_reason(p.ptr)
+	defer C.free(unsafe.Pointer(cStr))
+	return C.GoString(cStr)
+}
+
+// set changes the maximum age, starting the goroutine if a maximum is set and
+// it is not running.
+func (a *connectionAger) set(p *Peer, maxAge time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.maxAge = max(maxAge, 0)
+	if a.running {
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if a.maxAge == 0 {
+		return
+	}
+	a.running = true
+	a.wake = make(chan struct{}, 1)
+	a.done = make(chan struct{})
+	spawn(func() { a.run(p) })
+}
+
+// run retires expired clients until the maximum age is removed or the ager
+// is closed.
+func (a *connectionAger) run(p *Peer) {
+	defer close(a.done)
+	cReason := C.CString(MaxAgeReason)
+	defer C.free(unsafe.Pointer(cReason))
+	for {
+		a.mu.Lock()
+		maxAge, wake := a.maxAge, a.wake
+		if a.closed || maxAge == 0 {
+			a.running = false
+			a.mu.Unlock()
+			return
+		}
+		a.mu.Unlock()
+
+		if p.enter() {
+			C.relay_close_expired_clients(p.ptr, C.int64_t(maxAge.Milliseconds()), C.int64_t(DefaultCloseTimeout.Milliseconds()), cReason)
+			p.leave()
+		}
+		select {
+		case <-wake:
+		case <-time.After(min(max(maxAge/4, time.Millisecond), maxAgePollInterval)):
+		}
+	}
+}
+
+// close stops the goroutine and waits for it to exit.
+func (a *connectionAger) close() {
+	a.mu.Lock()
+	a.closed = true
+	running, done := a.running, a.done
+	if running {
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+	}
+	a.mu.Unlock()
+	if running {
+		<-done
+	}
+}
@@ -0,0 +1,35 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionAge(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	if err := conn.Send("before"); err != nil {
+		t.Fatalf("Client.Send: %v", err)
+	}
+	server.SetMaxConnectionAge(time.Millisecond)
+
+	if got := receive(t, client); got != "before" {
+		t.Fatalf("got %q, want %q", got, "before")
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Receive()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPeerDisconnected) {
+			t.Fatalf("Receive after max age: %v, want ErrPeerDisconnected", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection outlived its max age")
+	}
+	if reason := client.GoodbyeReason(); reason != MaxAgeReason {
+		t.Fatalf("GoodbyeReason = %q, want %q", reason, MaxAgeReason)
+	}
+}
@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	server, err := network.Listen("server", "hub")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	if _, err := network.Listen("again", "hub"); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("second Listen on the name: %v, want ErrAddressInUse", err)
+	}
+	if _, err := NewMemoryNetwork().Dial("stranger", "hub"); !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("Dial from another network: %v, want ErrConnectionRefused", err)
+	}
+
+	client, conn := connect(t, server, func() (*Peer, error) { return network.Dial("client", "hub") })
+	exchange(t, server, client, conn, 3)
+	if got, want := server.LocalAddr(), network.Addr("hub"); got == nil || got.String() != want {
+		t.Fatalf("server LocalAddr = %v, want %s", got, want)
+	}
+}
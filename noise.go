@@ -0,0 +1,105 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"crypto/ecdh"
+	"fmt"
+	"unsafe"
+)
+
+// WithNoiseKey secures every connection of the peer with the Noise
+// protocol, for deployments without the certificates WithTLS needs: both
+// ends prove they hold a static X25519 key, and the connection is encrypted
+// with keys derived from it. Every peer, client or server, needs its own
+// key, from ecdh.X25519().GenerateKey. A client peer uses the Noise XX
+// handshake, or IK when WithNoisePeerKeys pins a single key; a server peer
+// accepts both.
+//
+// Noise alone does not say who the remote end is, only that it holds the
+// key RemoteStaticKey returns, so either pin the expected keys with
+// WithNoisePeerKeys or check RemoteStaticKey before trusting a connection.
+// Handshake failures are reported as for WithTLS. It cannot be combined
+// with WithTLS, WithIdentity or WithAuthToken, and only takes effect when
+// the peer is created.
+func WithNoiseKey(priv *ecdh.PrivateKey) PeerOption {
+	return func(c *peerConfig) { c.noise = priv }
+}
+
+// WithNoisePeerKeys makes a peer using WithNoiseKey accept only remote ends
+// holding one of keys: a client peer fails to open with ErrHandshakeFailed
+// if the server's key is not among them, and a server peer closes such
+// clients. With a single key a client peer uses the Noise IK handshake,
+// which encrypts its own static key to the server's. Pinned peers are
+// Authenticated. It only takes effect when the peer is created.
+func WithNoisePeerKeys(keys ...*ecdh.PublicKey) PeerOption {
+	return func(c *peerConfig) { c.noisePeers = keys }
+}
+
+// RemoteStaticKey returns the static key the server proved it holds during
+// a client peer's Noise handshake, for pinning it. It returns nil for a
+// server peer, whose clients each have their own (see
+// Client.RemoteStaticKey), and for peers without WithNoiseKey.
+func (p *Peer) RemoteStaticKey() *ecdh.PublicKey {
+	if !p.noise || !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	return remoteStaticKey(p.ptr, 0)
+}
+
+// RemoteStaticKey returns the static key the client proved it holds during
+// its Noise handshake, or nil if the server peer does not use WithNoiseKey
+// or the client is unknown.
+func (c *Client) RemoteStaticKey() *ecdh.PublicKey {
+	if !c.peer.noise || !c.peer.enter() {
+		return nil
+	}
+	defer c.peer.leave()
+	return remoteStaticKey(c.peer.ptr, c.id)
+}
+
+// remoteStaticKey reads the remote identity of a client peer's connection
+// (clientID 0) or an accepted client as an X25519 key.
+func remoteStaticKey(ptr C.RelayPeer, clientID uint64) *ecdh.PublicKey {
+	var data *C.char
+	var n C.size_t
+	if C.relay_get_remote_identity(ptr, C.uint64_t(clientID), &data, &n) != C.RELAY_OK {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(data))
+	key, err := ecdh.X25519().NewPublicKey(C.GoBytes(unsafe.Pointer(data), C.int(n)))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// newCNoiseOptions converts the Noise settings in cfg for the C library,
+// allocating in mem.
+func newCNoiseOptions(cfg *peerConfig, mem *cMemory) (*C.RelayNoiseOptions, error) {
+	if cfg.noise == nil {
+		return nil, fmt.Errorf("%w: WithNoisePeerKeys needs WithNoiseKey", ErrConfigureFailed)
+	}
+	if cfg.noise.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%w: Noise keys must be X25519 keys", ErrConfigureFailed)
+	}
+	opts := (*C.RelayNoiseOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayNoiseOptions{}))))
+	*opts = C.RelayNoiseOptions{}
+	opts.privateKey = (*C.char)(mem.bytes(cfg.noise.Bytes()))
+	if len(cfg.noisePeers) > 0 {
+		var keys []byte
+		for _, key := range cfg.noisePeers {
+			if key == nil || key.Curve() != ecdh.X25519() {
+				return nil, fmt.Errorf("%w: Noise keys must be X25519 keys", ErrConfigureFailed)
+			}
+			keys = append(keys, key.Bytes()...)
+		}
+		opts.remoteKeys = (*C.char)(mem.bytes(keys))
+		opts.remoteKeyCount = C.int(len(cfg.noisePeers))
+	}
+	return opts, nil
+}
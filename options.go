@@ -0,0 +1,402 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// PeerOption configures a peer. Options are passed to NewPeer or applied to
+// an existing peer with Peer.Reconfigure.
+type PeerOption func(*peerConfig)
+
+// peerConfig holds the settings that PeerOptions modify.
+type peerConfig struct {
+	ip        string
+	port      int
+	localIP   string // Local address a client peer connects from, empty for any
+	localPort int
+
+	sendBuffer        int
+	receiveBuffer     int
+	sendTimeout       time.Duration
+	receiveTimeout    time.Duration
+	noDelay           int           // 1 for TCP_NODELAY, -1 to clear it, 0 if never set
+	keepAlive         time.Duration // Keep-alive period, negative to disable, 0 if never set
+	keepAliveInterval time.Duration // Interval between keep-alive probes, 0 if never set
+	keepAliveCount    int           // Unanswered keep-alive probes, 0 if never set
+	readBuffer        int           // Size passed to GrowReceiveBuffer, 0 if never set
+	maxMessageSize    int           // Size passed to SetMaxMessageSize, 0 if never set
+
+	// Used only when the peer is created.
+	server         bool
+	connectTimeout time.Duration
+	backlog        int
+	tls            *tls.Config
+	noise          *ecdh.PrivateKey
+	noisePeers     []*ecdh.PublicKey
+	e2eKey         *ecdh.PrivateKey
+	identity       *Identity
+	authSecrets    [][]byte
+	websocket      bool
+	wsPath         string
+	wsHost         string // Host header, empty for the server's address
+	udp            *UDPConfig
+	unixMode       os.FileMode // Permission bits of a Unix domain socket file, 0 for the umask's
+	proxy          *string     // Proxy URL set with WithProxy, nil for the default proxy
+	ipPreference   IPPreference
+	ipv6Only       bool
+	reuseAddr      bool
+	reusePort      bool
+}
+
+// WithAddress moves the peer to a different address. A client peer connects
+// to ip:port and a server peer listens there. Changing the address requires a
+// reconnect.
+func WithAddress(ip string, port int) PeerOption {
+	return func(c *peerConfig) {
+		c.ip = ip
+		c.port = port
+	}
+}
+
+// WithLocalAddr makes a client peer connect from ip:port, like
+// net.Dialer.LocalAddr, for example to satisfy a firewall that only allows a
+// particular source address. An empty ip lets the OS choose the interface
+// and a port of 0 an ephemeral port. Server peers ignore it. Changing it
+// requires a reconnect.
+func WithLocalAddr(ip string, port int) PeerOption {
+	return func(c *peerConfig) {
+		c.localIP = ip
+		c.localPort = port
+	}
+}
+
+// WithSendBufferSize sets the socket send buffer size (SO_SNDBUF) in bytes.
+// It can be changed without a reconnect.
+func WithSendBufferSize(bytes int) PeerOption {
+	return func(c *peerConfig) { c.sendBuffer = bytes }
+}
+
+// WithReceiveBufferSize sets the socket receive buffer size (SO_RCVBUF) in
+// bytes. It can be changed without a reconnect.
+func WithReceiveBufferSize(bytes int) PeerOption {
+	return func(c *peerConfig) { c.receiveBuffer = bytes }
+}
+
+// WithSendTimeout bounds how long a send may block (SO_SNDTIMEO). It can be
+// changed without a reconnect.
+func WithSendTimeout(d time.Duration) PeerOption {
+	return func(c *peerConfig) { c.sendTimeout = d }
+}
+
+// WithReceiveTimeout bounds how long ReceiveMessage may block (SO_RCVTIMEO).
+// It can be changed without a reconnect.
+func WithReceiveTimeout(d time.Duration) PeerOption {
+	return func(c *peerConfig) { c.receiveTimeout = d }
+}
+
+// WithNoDelay sets TCP_NODELAY, which sends small writes immediately instead
+// of waiting to coalesce them (Nagle's algorithm). It can be changed without
+// a reconnect. See Peer.SetCork for how the two interact.
+func WithNoDelay(enabled bool) PeerOption {
+	return func(c *peerConfig) {
+		c.noDelay = -1
+		if enabled {
+			c.noDelay = 1
+		}
+	}
+}
+
+// WithServerMode makes NewPeer, OpenPeer and Open create a server peer,
+// which listens at the peer's address, whatever their isServer argument
+// says. Reconfigure cannot turn a client peer into a server.
+func WithServerMode() PeerOption {
+	return func(c *peerConfig) { c.server = true }
+}
+
+// WithReadBuffer grows the peer's receive buffers to at least bytes, as
+// GrowReceiveBuffer does: the socket receive buffer and the chunk the
+// library reads at once. Like GrowReceiveBuffer it never shrinks them. It
+// can be changed without a reconnect.
+func WithReadBuffer(bytes int) PeerOption {
+	return func(c *peerConfig) { c.readBuffer = bytes }
+}
+
+// WithMaxMessageSize sets the largest message the peer sends or accepts, as
+// SetMaxMessageSize does: sending a larger message fails with
+// ErrMessageTooLarge, and a larger one received is dropped without closing
+// the connection. It can be changed without a reconnect.
+func WithMaxMessageSize(bytes int) PeerOption {
+	return func(c *peerConfig) { c.maxMessageSize = bytes }
+}
+
+// WithConnectTimeout bounds how long a client peer waits for its connection
+// to be established, when it is created and when it reconnects; creating it
+// then fails with ErrTimeout. Without it the OS default applies, often more
+// than a minute. Server peers ignore it. It only takes effect when the peer
+// is created.
+func WithConnectTimeout(d time.Duration) PeerOption {
+	return func(c *peerConfig) { c.connectTimeout = d }
+}
+
+// WithKeepAlive turns on TCP keep-alive (SO_KEEPALIVE) with d as both the
+// idle time before the first probe and the interval between probes, rounded
+// down to whole seconds and at least one, so a dead connection is noticed
+// even when the peer is not sending. A negative d turns keep-alive off. A
+// server peer applies it to the clients it accepts. It can be changed
+// without a reconnect.
+func WithKeepAlive(d time.Duration) PeerOption {
+	return func(c *peerConfig) {
+		c.keepAlive = d
+		c.keepAliveInterval = d
+		if d < 0 {
+			c.keepAlive = -1
+			c.keepAliveInterval = 0
+		}
+	}
+}
+
+// WithKeepAliveConfig turns on TCP keep-alive with a separate idle time
+// before the first probe (cfg.Idle), interval between probes (cfg.Interval)
+// and number of unanswered probes before the connection is dropped
+// (cfg.Count), or turns it off if cfg.Enable is false. A zero or negative
+// Idle or Interval is 15 seconds and a Count of zero or less leaves the
+// OS's count, usually 9; times are rounded down to whole seconds and at
+// least one. A later WithKeepAlive sets the idle time and interval and
+// keeps the count. A server peer applies it to the clients it accepts. It
+// can be changed without a reconnect.
+func WithKeepAliveConfig(cfg net.KeepAliveConfig) PeerOption {
+	return func(c *peerConfig) {
+		if !cfg.Enable {
+			c.keepAlive, c.keepAliveInterval = -1, 0
+			return
+		}
+		c.keepAlive, c.keepAliveInterval = cfg.Idle, cfg.Interval
+		if c.keepAlive <= 0 {
+			c.keepAlive = 15 * time.Second
+		}
+		if c.keepAliveInterval <= 0 {
+			c.keepAliveInterval = 15 * time.Second
+		}
+		if cfg.Count > 0 {
+			c.keepAliveCount = cfg.Count
+		}
+	}
+}
+
+// WithReuseAddr sets SO_REUSEADDR on a server peer's socket before it
+// binds, so a restarted server can listen again while connections of the
+// previous one linger in TIME_WAIT. Client peers ignore it; one with a
+// fixed local port (see WithLocalAddr) always sets it. It only takes effect
+// when the peer is created.
+func WithReuseAddr(enabled bool) PeerOption {
+	return func(c *peerConfig) { c.reuseAddr = enabled }
+}
+
+// WithReusePort sets SO_REUSEPORT on a server peer's socket before it
+// binds, so several server peers, in this or other processes, can listen on
+// the same address and port, for example to hand over to a new process
+// during a restart; the OS spreads incoming connections among them. Every
+// socket on the port must set it, and on Linux belong to the same user.
+// Client peers ignore it. It only takes effect when the peer is created.
+func WithReusePort(enabled bool) PeerOption {
+	return func(c *peerConfig) { c.reusePort = enabled }
+}
+
+// WithBacklog sets how many connections a server peer queues before they
+// are accepted (the listen backlog), 5 by default; the OS may cap it. Client
+// peers ignore it. It only takes effect when the peer is created.
+func WithBacklog(n int) PeerOption {
+	return func(c *peerConfig) { c.backlog = n }
+}
+
+// needsReconnect reports whether moving from c to next requires a new
+// connection rather than updating the current one.
+func (c *peerConfig) needsReconnect(next *peerConfig) bool {
+	return c.ip != next.ip || c.port != next.port || c.localIP != next.localIP || c.localPort != next.localPort
+}
+
+// fixedOption returns the name of the option behind the first setting that
+// next changes from c but that only takes effect when a peer is created, or
+// "" if there is none.
+func (c *peerConfig) fixedOption(next *peerConfig) string {
+	switch {
+	case c.server != next.server:
+		return "WithServerMode"
+	case c.connectTimeout != next.connectTimeout:
+		return "WithConnectTimeout"
+	case c.backlog != next.backlog:
+		return "WithBacklog"
+	case c.identity != next.identity:
+		return "WithIdentity"
+	case c.tls != next.tls:
+		return "WithTLS"
+	case c.noise != next.noise:
+		return "WithNoiseKey"
+	case !slices.Equal(c.noisePeers, next.noisePeers):
+		return "WithNoisePeerKeys"
+	case c.e2eKey != next.e2eKey:
+		return "WithE2EKey"
+	case !slices.EqualFunc(c.authSecrets, next.authSecrets, bytes.Equal):
+		return "WithAuthToken"
+	case c.websocket != next.websocket || c.wsPath != next.wsPath || c.wsHost != next.wsHost:
+		return "WithWebSocket"
+	case (c.udp == nil) != (next.udp == nil) || c.udp != nil && *c.udp != *next.udp:
+		return "WithUDP"
+	case c.unixMode != next.unixMode:
+		return "WithUnixSocketMode"
+	case (c.proxy == nil) != (next.proxy == nil) || c.proxy != nil && *c.proxy != *next.proxy:
+		return "WithProxy"
+	case c.ipPreference != next.ipPreference:
+		return "WithIPPreference"
+	case c.ipv6Only != next.ipv6Only:
+		return "WithIPv6Only"
+	case c.reuseAddr != next.reuseAddr:
+		return "WithReuseAddr"
+	case c.reusePort != next.reusePort:
+		return "WithReusePort"
+	}
+	return ""
+}
+
+// securityCount returns how many of the mutually exclusive connection
+// securities c asks for.
+func (c *peerConfig) securityCount() int {
+	n := 0
+	for _, set := range []bool{c.tls != nil, c.noise != nil || len(c.noisePeers) > 0, c.identity != nil, len(c.authSecrets) > 0} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// socketOptions returns the settings in c that can be applied to a live
+// socket. Settings c leaves at zero are left unchanged by the C library.
+func (c *peerConfig) socketOptions() C.RelayPeerOptions {
+	return C.RelayPeerOptions{
+		sendBufferSize:      C.int(c.sendBuffer),
+		receiveBufferSize:   C.int(c.receiveBuffer),
+		sendTimeoutMs:       C.int64_t(c.sendTimeout.Milliseconds()),
+		receiveTimeoutMs:    C.int64_t(c.receiveTimeout.Milliseconds()),
+		noDelay:             C.int(c.noDelay),
+		keepAliveMs:         C.int64_t(keepAliveMillis(c.keepAlive)),
+		keepAliveIntervalMs: C.int64_t(keepAliveMillis(c.keepAliveInterval)),
+		keepAliveCount:      C.int(c.keepAliveCount),
+	}
+}
+
+// keepAliveMillis converts a keep-alive period for the C library, which
+// reads a zero as unchanged: a positive period below a millisecond is
+// rounded up so it is not lost.
+func keepAliveMillis(d time.Duration) int64 {
+	if d > 0 && d < time.Millisecond {
+		return 1
+	}
+	return d.Milliseconds()
+}
+
+// Reconfigure applies opts to the peer. Settings that can be changed on a
+// live socket, such as buffer sizes and timeouts, are applied without
+// dropping the connection; settings that cannot, such as the address, make
+// the peer reconnect. Either way the peer keeps its ID and its membership of
+// any PeerManager. If reconnecting fails the peer keeps its old connection
+// and configuration and ErrReconnectFailed is returned.
+//
+// Options that only take effect when a peer is created, such as
+// WithServerMode, WithTLS, WithNoiseKey or WithAuthToken, cannot change a
+// live peer: if opts change one of them nothing is applied and
+// ErrConfigureFailed is returned. The new configuration is only kept once
+// every setting has been applied; if one fails ErrConfigureFailed is
+// returned and the peer keeps its old configuration, except for an address
+// it has already moved to.
+func (p *Peer) Reconfigure(opts ...PeerOption) error {
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	p.cfgMu.Lock()
+	defer p.cfgMu.Unlock()
+
+	next := p.cfg
+	for _, opt := range opts {
+		opt(&next)
+	}
+	next.ip, next.localIP = unbracket(next.ip), unbracket(next.localIP)
+	if name := p.cfg.fixedOption(&next); name != "" {
+		return fmt.Errorf("%w: %s cannot be changed on a live peer", ErrConfigureFailed, name)
+	}
+
+	if p.cfg.needsReconnect(&next) {
+		if lookupTransport(p.cfg.ip) != nil || lookupTransport(next.ip) != nil {
+			return fmt.Errorf("%w: peers on a registered transport cannot move", ErrReconnectFailed)
+		}
+		if p.tls != nil {
+			p.tls.setHost(next.ip)
+		}
+		ip, err := next.hostIP()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrReconnectFailed, err)
+		}
+		cIP := C.CString(ip)
+		cLocalIP := C.CString(next.localIP)
+		status := C.relay_reconnect_peer(p.ptr, cIP, C.int(next.port), cLocalIP, C.int(next.localPort))
+		C.free(unsafe.Pointer(cIP))
+		C.free(unsafe.Pointer(cLocalIP))
+		if err := statusError(status, ErrReconnectFailed); err != nil {
+			return err
+		}
+		// The peer has moved, whether or not the other settings apply.
+		p.cfg.ip, p.cfg.port, p.cfg.localIP, p.cfg.localPort = next.ip, next.port, next.localIP, next.localPort
+	}
+
+	cOpts := next.socketOptions()
+	status := C.relay_configure_peer(p.ptr, &cOpts)
+	if status == C.RELAY_OK && next.readBuffer > 0 {
+		status = C.relay_grow_receive_buffer(p.ptr, C.int64_t(next.readBuffer))
+	}
+	if err := statusError(status, ErrConfigureFailed); err != nil {
+		return err
+	}
+	if next.maxMessageSize > 0 {
+		p.SetMaxMessageSize(next.maxMessageSize)
+	}
+	p.cfg = next
+	return nil
+}
+
+// SetNoDelay turns TCP_NODELAY on or off for the peer connection. It is
+// shorthand for Reconfigure(WithNoDelay(enabled)).
+func (p *Peer) SetNoDelay(enabled bool) error {
+	return p.Reconfigure(WithNoDelay(enabled))
+}
+
+// GrowReceiveBuffer grows the peer's receive buffers to at least bytes
+// without dropping the connection: the socket receive buffer (SO_RCVBUF,
+// subject to the kernel's limit) and the chunk the library reads at once.
+// Bytes already received, including a partially read message, are kept.
+// Neither buffer is ever shrunk, so a peer can start small and grow only
+// the connections that carry large bursts. A server peer grows every client
+// connection and the ones it accepts later; the size also survives a
+// reconnect. It returns ErrPeerDisconnected if the connection is closed and
+// ErrConfigureFailed if bytes is not positive or a buffer could not be
+// grown.
+func (p *Peer) GrowReceiveBuffer(bytes int) error {
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	return statusError(C.relay_grow_receive_buffer(p.ptr, C.int64_t(bytes)), ErrConfigureFailed)
+}
@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconfigureMovesClient(t *testing.T) {
+	_, client := newPair(t)
+	server2, err := OpenPeer("server2", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server2.Destroy)
+	acceptAll(t, server2)
+
+	port := server2.LocalAddr().(*net.TCPAddr).Port
+	if err := client.Reconfigure(WithAddress("127.0.0.1", port)); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	for server2.AcceptedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Send("moved"); err != nil {
+		t.Fatalf("Send after Reconfigure: %v", err)
+	}
+	if got := receive(t, server2); got != "moved" {
+		t.Fatalf("got %q, want %q", got, "moved")
+	}
+}
+
+func TestReconfigureRejectsCreationOptions(t *testing.T) {
+	_, client := newPair(t)
+	for _, opt := range []PeerOption{WithServerMode(), WithAuthToken("secret"), WithTLS(&tls.Config{}), WithBacklog(8)} {
+		if err := client.Reconfigure(WithSendTimeout(time.Second), opt); !errors.Is(err, ErrConfigureFailed) {
+			t.Fatalf("Reconfigure with a creation-only option: %v, want ErrConfigureFailed", err)
+		}
+	}
+	if d := client.cfg.sendTimeout; d != 0 {
+		t.Fatalf("rejected Reconfigure kept send timeout %v", d)
+	}
+	if err := client.Reconfigure(WithSendTimeout(time.Second), WithConnectTimeout(0)); err != nil {
+		t.Fatalf("Reconfigure leaving creation-only options unchanged: %v", err)
+	}
+}
+
+func TestReconfigureKeepsConfigOnFailure(t *testing.T) {
+	_, client := newPair(t)
+	client.Close()
+	if err := client.Reconfigure(WithSendTimeout(time.Second)); !errors.Is(err, ErrConfigureFailed) {
+		t.Fatalf("Reconfigure of a closed peer: %v, want ErrConfigureFailed", err)
+	}
+	if d := client.cfg.sendTimeout; d != 0 {
+		t.Fatalf("failed Reconfigure kept send timeout %v", d)
+	}
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	server, err := Open("server", "127.0.0.1", 0, WithServerMode(), WithBacklog(16), WithKeepAlive(time.Second))
+	if err != nil {
+		t.Fatalf("Open server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	acceptAll(t, server)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+
+	client, err := Open("client", "127.0.0.1", port, WithConnectTimeout(time.Second), WithReadBuffer(1<<16),
+		WithKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: 5 * time.Second, Count: 3}))
+	if err != nil {
+		t.Fatalf("Open client: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	if client.LocalAddr().(*net.TCPAddr).Port == port {
+		t.Fatal("client was opened as a server")
+	}
+	for server.AcceptedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+
+	if _, err := Open("refused", "127.0.0.1", freePort(t), WithConnectTimeout(time.Second)); !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("Open to a closed port: %v, want ErrConnectionRefused", err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	first, err := Open("first", "127.0.0.1", 0, WithServerMode(), WithReusePort(true))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(first.Destroy)
+	port := first.LocalAddr().(*net.TCPAddr).Port
+
+	if _, err := Open("plain", "127.0.0.1", port, WithServerMode()); err == nil {
+		t.Fatal("second server without SO_REUSEPORT bound a port in use")
+	}
+	second, err := Open("second", "127.0.0.1", port, WithServerMode(), WithReusePort(true), WithReuseAddr(true))
+	if err != nil {
+		t.Fatalf("Open second server with SO_REUSEPORT: %v", err)
+	}
+	second.Destroy()
+}
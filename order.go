@@ -0,0 +1,247 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sequenceHeader is the envelope header SendOrdered numbers messages with:
+// the sender's epoch, the sequence number and the sequence name, separated
+// by spaces.
+const sequenceHeader = "relay-seq"
+
+// Gap describes messages sent with SendOrdered that never arrived: the
+// numbers From through To of a sequence were skipped so the messages after
+// them could be delivered.
+type Gap struct {
+	Sequence string // Name passed to SendOrdered
+	ClientID uint64 // The accepted client that sent the sequence, 0 on a client peer
+	From, To uint64
+}
+
+// sequencer numbers the messages a peer sends with SendOrdered.
+type sequencer struct {
+	mu    sync.Mutex
+	epoch string            // Tells this peer's sequences from those of an earlier run
+	last  map[string]uint64 // Sequence name -> last number sent
+}
+
+// SendOrdered sends a message in an envelope (see SendEnvelope) numbered
+// in the named sequence, so a receiver that has enabled SetReordering
+// delivers the messages of each sequence in the order they were sent even
+// if they arrive out of order, for example over UDP, after a retransmission
+// or across different relay paths. Sequences are independent of each
+// other; use one per stream of related messages. Errors are reported as
+// for Send.
+func (p *Peer) SendOrdered(sequence, message string) error {
+	q := &p.ordered
+	q.mu.Lock()
+	if q.epoch == "" {
+		var epoch [8]byte
+		rand.Read(epoch[:])
+		q.epoch = hex.EncodeToString(epoch[:])
+		q.last = make(map[string]uint64)
+	}
+	q.last[sequence]++
+	header := fmt.Sprintf("%s %d %s", q.epoch, q.last[sequence], sequence)
+	q.mu.Unlock()
+	return p.SendEnvelope(Message{Payload: []byte(message), Headers: map[string]string{sequenceHeader: header}})
+}
+
+// SetReordering makes the peer deliver the messages each sender numbered
+// with SendOrdered in sequence order, holding back those that arrive
+// early. A message that is missing for longer than timeout is given up on:
+// onGap, if not nil, is called with the numbers skipped and the messages
+// held behind it are delivered. Messages that arrive after being given up
+// on, or twice, are dropped. Other messages are delivered as they arrive.
+// onGap runs on the receiving goroutine and should return quickly.
+//
+// Held messages are released by Receive and the other receiving methods
+// while they wait; with an OnMessage handler they are only released when
+// the next message arrives. A timeout of 0, the default, disables
+// reordering and delivers any messages still held.
+func (p *Peer) SetReordering(timeout time.Duration, onGap func(Gap)) {
+	b := &p.reorder
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.timeout = max(timeout, 0)
+	b.onGap = onGap
+	if b.timeout == 0 {
+		for _, s := range b.sequences {
+			b.releaseLocked(s, ^uint64(0))
+		}
+		b.sequences = nil
+	}
+}
+
+// reorderBuffer holds back messages numbered with SendOrdered that arrive
+// ahead of their turn.
+type reorderBuffer struct {
+	mu        sync.Mutex
+	timeout   time.Duration // How long a missing message is waited for, 0 when disabled
+	onGap     func(Gap)
+	sequences map[sequenceKey]*sequenceState
+	ready     []orderedMessage // Messages released, in delivery order
+	gaps      []Gap            // Gaps found and not reported yet
+}
+
+type sequenceKey struct {
+	client uint64
+	name   string
+}
+
+// sequenceState tracks one sender's sequence.
+type sequenceState struct {
+	key     sequenceKey
+	epoch   string
+	next    uint64                    // Number of the next message to deliver
+	held    map[uint64]orderedMessage // Messages that arrived ahead of next
+	waiting time.Time                 // When the oldest held message arrived
+}
+
+type orderedMessage struct {
+	data   []byte
+	client uint64
+}
+
+// push takes a received message. It reports false, leaving the message to
+// the caller, if it is not part of a sequence or reordering is disabled;
+// otherwise the message is held or released to pop.
+func (b *reorderBuffer) push(data []byte, client uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timeout == 0 || !IsEnvelope(data) {
+		return false
+	}
+	var m Message
+	if m.UnmarshalBinary(data) != nil {
+		return false
+	}
+	fields := strings.SplitN(m.Headers[sequenceHeader], " ", 3)
+	if len(fields) != 3 {
+		return false
+	}
+	n, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || n == 0 {
+		return false
+	}
+
+	key := sequenceKey{client: client, name: fields[2]}
+	s := b.sequences[key]
+	if s == nil || s.epoch != fields[0] {
+		if s != nil {
+			// The sender started over; deliver what the old run left.
+			b.releaseLocked(s, ^uint64(0))
+		}
+		if b.sequences == nil {
+			b.sequences = make(map[sequenceKey]*sequenceState)
+		}
+		s = &sequenceState{key: key, epoch: fields[0], next: 1, held: make(map[uint64]orderedMessage)}
+		b.sequences[key] = s
+	}
+	switch {
+	case n < s.next:
+		// Late after its gap was skipped, or a duplicate.
+	case n == s.next:
+		b.ready = append(b.ready, orderedMessage{data, client})
+		s.next++
+		b.releaseLocked(s, 0)
+	default:
+		if _, ok := s.held[n]; !ok {
+			if len(s.held) == 0 {
+				s.waiting = time.Now()
+			}
+			s.held[n] = orderedMessage{data, client}
+		}
+	}
+	return true
+}
+
+// releaseLocked moves the held messages of s that are now in turn to
+// ready, first skipping every missing number below upTo. Caller must hold
+// b.mu.
+func (b *reorderBuffer) releaseLocked(s *sequenceState, upTo uint64) {
+	for len(s.held) > 0 {
+		m, ok := s.held[s.next]
+		if !ok {
+			if s.next >= upTo {
+				break
+			}
+			from := s.next
+			for !ok {
+				s.next++
+				m, ok = s.held[s.next]
+			}
+			b.gaps = append(b.gaps, Gap{Sequence: s.key.name, ClientID: s.key.client, From: from, To: s.next - 1})
+		}
+		delete(s.held, s.next)
+		b.ready = append(b.ready, m)
+		s.next++
+	}
+	s.waiting = time.Now()
+}
+
+// expire gives up on the missing messages that have been waited for longer
+// than the timeout.
+func (b *reorderBuffer) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, s := range b.sequences {
+		if len(s.held) > 0 && now.Sub(s.waiting) >= b.timeout {
+			// Skip only the first gap; later ones get their own timeout.
+			b.releaseLocked(s, s.next+1)
+		}
+	}
+}
+
+// pop returns the next released message, reporting the gaps found first.
+func (b *reorderBuffer) pop() ([]byte, uint64, bool) {
+	b.mu.Lock()
+	gaps, onGap := b.gaps, b.onGap
+	b.gaps = nil
+	var m orderedMessage
+	ok := len(b.ready) > 0
+	if ok {
+		m = b.ready[0]
+		b.ready[0] = orderedMessage{}
+		b.ready = b.ready[1:]
+	}
+	b.mu.Unlock()
+	if onGap != nil {
+		for _, g := range gaps {
+			onGap(g)
+		}
+	}
+	return m.data, m.client, ok
+}
+
+// limitWait shortens a wait in milliseconds, negative for none, so it ends
+// by the time a held message is due to be released.
+func (b *reorderBuffer) limitWait(wait C.int64_t) C.int64_t {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limit := C.int64_t(-1)
+	for _, s := range b.sequences {
+		if len(s.held) == 0 {
+			continue
+		}
+		due := C.int64_t(max(time.Until(s.waiting.Add(b.timeout)).Milliseconds(), 0))
+		if limit < 0 || due < limit {
+			limit = due
+		}
+	}
+	if limit >= 0 && (wait < 0 || limit < wait) {
+		return limit
+	}
+	return wait
+}
@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sendNumbered sends message as number n of sequence "s" from a sender of
+// the given epoch, as SendOrdered would.
+func sendNumbered(t *testing.T, p *Peer, epoch string, n int, message string) {
+	t.Helper()
+	header := epoch + " " + strconv.Itoa(n) + " s"
+	if err := p.SendEnvelope(Message{Payload: []byte(message), Headers: map[string]string{sequenceHeader: header}}); err != nil {
+		t.Fatalf("SendEnvelope: %v", err)
+	}
+}
+
+func TestReordering(t *testing.T) {
+	server, client := newPair(t)
+	server.SetReordering(time.Second, nil)
+	sendNumbered(t, client, "e1", 2, "second")
+	sendNumbered(t, client, "e1", 1, "first")
+	sendNumbered(t, client, "e1", 1, "duplicate")
+	sendNumbered(t, client, "e1", 3, "third")
+	for _, want := range []string{"first", "second", "third"} {
+		m, err := server.ReceiveEnvelope()
+		if err != nil || string(m.Payload) != want {
+			t.Fatalf("ReceiveEnvelope = %q, %v, want %q", m.Payload, err, want)
+		}
+	}
+
+	// SendOrdered numbers its own messages.
+	for _, message := range []string{"a", "b"} {
+		if err := client.SendOrdered("other", message); err != nil {
+			t.Fatalf("SendOrdered: %v", err)
+		}
+	}
+	for _, want := range []string{"a", "b"} {
+		if m, err := server.ReceiveEnvelope(); err != nil || string(m.Payload) != want {
+			t.Fatalf("ReceiveEnvelope = %q, %v, want %q", m.Payload, err, want)
+		}
+	}
+}
+
+func TestReorderingGap(t *testing.T) {
+	server, client := newPair(t)
+	gaps := make(chan Gap, 1)
+	server.SetReordering(50*time.Millisecond, func(g Gap) { gaps <- g })
+	sendNumbered(t, client, "e1", 1, "first")
+	sendNumbered(t, client, "e1", 3, "third")
+	for _, want := range []string{"first", "third"} {
+		if m, err := server.ReceiveEnvelope(); err != nil || string(m.Payload) != want {
+			t.Fatalf("ReceiveEnvelope = %q, %v, want %q", m.Payload, err, want)
+		}
+	}
+	select {
+	case g := <-gaps:
+		if g.Sequence != "s" || g.From != 2 || g.To != 2 {
+			t.Fatalf("gap = %+v, want number 2 of s", g)
+		}
+	default:
+		t.Fatal("onGap was not called for the missing message")
+	}
+}
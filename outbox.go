@@ -0,0 +1,379 @@
+package relay
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queuedMessage is a message waiting in a peer's outbox.
+type queuedMessage struct {
+	key      string // Conflation key, empty if the message is never replaced
+	message  string
+	queuedAt time.Time
+	seq      uint64        // Queueing order across lanes
+	charged  *bufferBudget // Budget len(message) is charged to, nil if none
+}
+
+// uncharge returns the message's bytes to the budget it was charged to.
+func (q *queuedMessage) uncharge() {
+	if q.charged != nil {
+		q.charged.release(len(q.message))
+		q.charged = nil
+	}
+}
+
+// outbox holds messages queued for a peer and writes them from a background
+// goroutine, started on first use, so callers never block on the socket. A
+// managed peer's outbox may instead be served by its manager's pool.
+type outbox struct {
+	mu        sync.Mutex
+	cond      sync.Cond
+	lanes     map[string][]*queuedMessage // Lane name -> messages waiting in it, oldest first
+	queued    int                         // Messages waiting across all lanes
+	seq       uint64                      // Sequence number of the last message queued
+	send      func(string) bool           // Writes one message, set by push
+	sending   bool                        // The writer is sending a message taken off the queue
+	started   bool                        // The outbox's own writer goroutine is running
+	scheduled bool                        // Queued on, or being served by, pool
+	closed    bool
+	stopped   atomic.Bool // Mirrors closed for readers that cannot take mu
+	done      chan struct{}
+	pool      *ioPool // Manager's writer pool, nil if unmanaged
+
+	timeout  time.Duration        // How long a message may wait before it is dropped, 0 for no limit
+	expired  uint64               // Messages dropped for waiting longer than timeout or past their expiry time
+	onDrop   func(message string) // Called, without mu, for each message dropped by timeout
+	onExpire func(message string) // Called, without mu, for each envelope dropped past its expiry time
+
+	budget     *bufferBudget        // Shared cap on queued bytes, nil for none
+	onOverflow func(message string) // Called, without mu, for each message discarded by the budget
+
+	limit  int                  // Cap on queued messages, 0 for none
+	policy OverflowPolicy       // What push does once limit is reached
+	full   uint64               // Messages discarded or refused by limit
+	onFull func(message string) // Called, without mu, for each message discarded by limit
+
+	laneWeights map[string]int // Lane name -> weight, if not 1
+	laneStrict  bool           // Drain the heaviest waiting lane first instead of weighted-fair
+	laneCurrent map[string]int // Lane name -> smooth weighted round-robin counter
+}
+
+// push queues message in lane to be written with send. If key is not empty
+// and a message with the same key is still queued in the lane, that message
+// is replaced in place instead, keeping its position in the queue. If the
+// outbox shares a budget that is exhausted, or holds as many messages as its
+// limit, push applies the overflow policy. It returns ErrQueueFull or
+// ErrBufferFull if the message was discarded or refused, and
+// ErrPeerDisconnected if the outbox is closed.
+func (o *outbox) push(lane, key, message string, send func(string) bool) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrPeerDisconnected
+	}
+	if o.replaceLocked(lane, key, message) {
+		o.mu.Unlock()
+		return nil
+	}
+	budget, onOverflow := o.budget, o.onOverflow
+	o.mu.Unlock()
+
+	if budget != nil && !o.charge(budget, len(message), onOverflow) {
+		if onOverflow != nil && budget.overflowPolicy() != Reject {
+			onOverflow(message)
+		}
+		return ErrBufferFull
+	}
+
+	o.mu.Lock()
+	discarded, err := o.admitLocked()
+	if err == nil && o.closed {
+		err = ErrPeerDisconnected
+	}
+	if err != nil || o.replaceLocked(lane, key, message) {
+		// A message with the same key was queued while waiting for the
+		// budget or for room.
+		if budget != nil {
+			budget.release(len(message))
+		}
+		policy, onFull := o.policy, o.onFull
+		o.mu.Unlock()
+		o.discarded(discarded, onFull)
+		if err == ErrQueueFull && policy != Reject && onFull != nil {
+			onFull(message)
+		}
+		return err
+	}
+	if o.lanes == nil {
+		o.lanes = make(map[string][]*queuedMessage)
+	}
+	o.seq++
+	o.lanes[lane] = append(o.lanes[lane], &queuedMessage{key: key, message: message, queuedAt: time.Now(), seq: o.seq, charged: budget})
+	o.queued++
+	o.send = send
+	o.cond.L = &o.mu
+	o.cond.Broadcast()
+	o.scheduleLocked()
+	onFull := o.onFull
+	o.mu.Unlock()
+	o.discarded(discarded, onFull)
+	return nil
+}
+
+// scheduleLocked makes sure a writer will pick up the queue: the outbox's
+// own goroutine or, in pooled mode, the manager's pool. Caller must hold
+// o.mu.
+func (o *outbox) scheduleLocked() {
+	if o.started || o.scheduled || o.queued == 0 {
+		return
+	}
+	if o.pool != nil && o.pool.pooled() {
+		o.scheduled = true
+		o.pool.submit(o)
+		return
+	}
+	o.started = true
+	o.done = make(chan struct{})
+	spawn(o.run)
+}
+
+// replaceLocked replaces the message queued in lane with the given key, if
+// any, and reports whether it did. Caller must hold o.mu.
+func (o *outbox) replaceLocked(lane, key, message string) bool {
+	if key == "" {
+		return false
+	}
+	for _, q := range o.lanes[lane] {
+		if q.key == key {
+			if q.charged != nil {
+				// Replacing never waits for room; the difference is charged as is.
+				q.charged.release(len(q.message) - len(message))
+			}
+			q.message = message
+			q.queuedAt = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+// charge takes n bytes from budget according to its overflow policy,
+// discarding this outbox's oldest messages for DropOldest. It returns false
+// if the message must be discarded.
+func (o *outbox) charge(budget *bufferBudget, n int, onOverflow func(string)) bool {
+	switch budget.overflowPolicy() {
+	case DropNewest, Reject:
+		return budget.tryAcquire(n)
+	case DropOldest:
+		for !budget.tryAcquire(n) {
+			o.mu.Lock()
+			if o.queued == 0 {
+				o.mu.Unlock()
+				return false
+			}
+			q := o.popOldestLocked()
+			q.uncharge()
+			o.cond.Broadcast()
+			o.mu.Unlock()
+			if onOverflow != nil {
+				onOverflow(q.message)
+			}
+		}
+		return true
+	default:
+		return budget.acquire(n, o.isClosed)
+	}
+}
+
+// isClosed reports whether the outbox has been closed. It does not take
+// o.mu, so it is safe to call while holding a budget's lock.
+func (o *outbox) isClosed() bool {
+	return o.stopped.Load()
+}
+
+// setBudget makes the outbox count its queued bytes against budget, calling
+// onOverflow for each message the budget discards. Messages already queued
+// stay charged to the budget they were queued under.
+func (o *outbox) setBudget(budget *bufferBudget, onOverflow func(message string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.budget = budget
+	o.onOverflow = onOverflow
+}
+
+// setExpiry sets the function called for each queued envelope dropped
+// because its expiry time passed, nil for none.
+func (o *outbox) setExpiry(onExpire func(message string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.onExpire = onExpire
+}
+
+// setPool makes the outbox follow pool's mode, or gives it its own writer
+// again for a nil pool. A change takes effect between messages.
+func (o *outbox) setPool(pool *ioPool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pool = pool
+	if o.cond.L != nil {
+		o.cond.Broadcast()
+	}
+}
+
+// wake makes an idle writer recheck whether it should hand over to the pool.
+func (o *outbox) wake() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cond.L != nil {
+		o.cond.Broadcast()
+	}
+}
+
+// run writes queued messages in order until the outbox is closed or its
+// manager's pool takes over.
+func (o *outbox) run() {
+	o.mu.Lock()
+	for {
+		for o.queued == 0 && !o.closed && !o.poolTakesOverLocked() {
+			o.cond.Wait()
+		}
+		if o.closed || o.poolTakesOverLocked() {
+			o.started = false
+			close(o.done)
+			if !o.closed {
+				o.scheduleLocked()
+			}
+			o.mu.Unlock()
+			return
+		}
+		o.writeNextLocked()
+	}
+}
+
+// poolTakesOverLocked reports whether the manager's pool should write for
+// the outbox instead of its own goroutine. Caller must hold o.mu.
+func (o *outbox) poolTakesOverLocked() bool {
+	return o.pool != nil && o.pool.pooled()
+}
+
+// serve writes the next queued message on a pool worker, then queues the
+// outbox on the pool again if more are waiting.
+func (o *outbox) serve() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed && o.queued > 0 {
+		o.writeNextLocked()
+	}
+	// Only now, so a push while writing cannot hand the outbox to a second worker.
+	o.scheduled = false
+	if !o.closed {
+		o.scheduleLocked()
+	}
+}
+
+// writeNextLocked takes the next message off the queue, choosing its lane
+// by the lane weights, and writes it, or drops it if it waited longer than
+// the timeout or is an envelope past its expiry time. It releases o.mu while
+// writing. Caller must hold o.mu and the queue must not be empty.
+func (o *outbox) writeNextLocked() {
+	q := o.popLaneLocked(o.nextLaneLocked())
+	o.sending = true
+	stale := o.timeout > 0 && time.Since(q.queuedAt) > o.timeout
+	expired := !stale && isExpired([]byte(q.message))
+	if stale || expired {
+		o.expired++
+	}
+	send, onDrop, onExpire := o.send, o.onDrop, o.onExpire
+	o.mu.Unlock()
+	switch {
+	case stale:
+		if onDrop != nil {
+			onDrop(q.message)
+		}
+	case expired:
+		if onExpire != nil {
+			onExpire(q.message)
+		}
+	default:
+		send(q.message)
+	}
+	q.uncharge()
+	o.mu.Lock()
+	o.sending = false
+	o.cond.Broadcast()
+}
+
+// setTimeout sets how long a message may wait in the queue before the writer
+// drops it instead of sending it, and the function called for each message
+// dropped. A timeout of 0 disables expiry.
+func (o *outbox) setTimeout(timeout time.Duration, onDrop func(message string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.timeout = timeout
+	o.onDrop = onDrop
+}
+
+// expiredCount returns the number of messages dropped by the timeout.
+func (o *outbox) expiredCount() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.expired
+}
+
+// flush waits until every queued message has been sent or the outbox is
+// closed.
+func (o *outbox) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cond.L == nil {
+		return
+	}
+	for (o.queued > 0 || o.sending) && !o.closed {
+		o.cond.Wait()
+	}
+}
+
+// pending returns the number of messages queued or being sent.
+func (o *outbox) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := o.queued
+	if o.sending {
+		n++
+	}
+	return n
+}
+
+// close discards any queued messages and stops the writer, waiting for a
+// send already in progress to return.
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.stopped.Store(true)
+	for _, lane := range o.lanes {
+		for _, q := range lane {
+			q.uncharge()
+		}
+	}
+	o.lanes = nil
+	o.queued = 0
+	started, done, budget := o.started, o.done, o.budget
+	if o.cond.L != nil {
+		o.cond.Broadcast()
+	}
+	o.mu.Unlock()
+	if budget != nil {
+		// Let a push blocked on the budget see that the outbox is closed.
+		budget.wake()
+	}
+	if started {
+		<-done
+	}
+	o.mu.Lock()
+	for o.sending {
+		// A pool worker is still writing.
+		o.cond.Wait()
+	}
+	o.mu.Unlock()
+}
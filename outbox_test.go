@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledSender records the messages an outbox writes. Writing the first
+// one blocks until release is called, so later messages stay queued.
+type stalledSender struct {
+	started chan struct{}
+	unblock chan struct{}
+	mu      sync.Mutex
+	sent    []string
+}
+
+func newStalledSender() *stalledSender {
+	return &stalledSender{started: make(chan struct{}), unblock: make(chan struct{})}
+}
+
+func (s *stalledSender) send(message string) bool {
+	s.mu.Lock()
+	first := s.sent == nil
+	s.sent = append(s.sent, message)
+	s.mu.Unlock()
+	if first {
+		close(s.started)
+		<-s.unblock
+	}
+	return true
+}
+
+func (s *stalledSender) release() {
+	close(s.unblock)
+}
+
+func (s *stalledSender) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.sent)
+}
+
+func TestConflatedReplacesQueued(t *testing.T) {
+	var o outbox
+	s := newStalledSender()
+	o.push("", "k", "first", s.send)
+	<-s.started
+	// The writer is busy, so these wait in the queue and replace each other.
+	for _, message := range []string{"stale", "older", "latest"} {
+		o.push("", "k", message, s.send)
+	}
+	o.push("", "", "unkeyed", s.send)
+	if n := o.pending(); n != 3 {
+		t.Fatalf("pending = %d, want 3", n)
+	}
+	s.release()
+	o.flush()
+	o.close()
+
+	if got, want := s.messages(), []string{"first", "latest", "unkeyed"}; !slices.Equal(got, want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestSendQueueTimeoutDropsStale(t *testing.T) {
+	var o outbox
+	var dropped []string
+	o.setTimeout(10*time.Millisecond, func(message string) { dropped = append(dropped, message) })
+	s := newStalledSender()
+	o.push("", "", "first", s.send)
+	<-s.started
+	o.push("", "", "stale", s.send)
+	time.Sleep(20 * time.Millisecond)
+	s.release()
+	o.flush()
+	o.push("", "", "fresh", s.send)
+	o.flush()
+	o.close()
+
+	if got, want := s.messages(), []string{"first", "fresh"}; !slices.Equal(got, want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+	if !slices.Equal(dropped, []string{"stale"}) || o.expiredCount() != 1 {
+		t.Fatalf("dropped %q, expired %d, want the stale message once", dropped, o.expiredCount())
+	}
+}
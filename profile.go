@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CgoStat summarises the calls made across the cgo boundary for one kind of
+// operation.
+type CgoStat struct {
+	Calls uint64        // Number of calls into the C library
+	Time  time.Duration // Total time spent inside those calls
+}
+
+// Avg returns the mean time per call, or 0 if no calls were made.
+func (s CgoStat) Avg() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Time / time.Duration(s.Calls)
+}
+
+// CgoProfile is a snapshot of the cgo call counters returned by CgoStats.
+type CgoProfile struct {
+	Send    CgoStat // Send, SendMessage, SendAll and SendAllCompressed
+	Receive CgoStat // ReceiveMessage
+	Relay   CgoStat // Relay and RelayMessage
+}
+
+// cgoCounter accumulates the calls and nanoseconds behind a CgoStat.
+type cgoCounter struct {
+	calls atomic.Uint64
+	nanos atomic.Uint64
+}
+
+var (
+	cgoProfiling atomic.Bool
+	cgoSend      cgoCounter
+	cgoReceive   cgoCounter
+	cgoRelay     cgoCounter
+)
+
+// EnableCgoProfiling starts counting calls into the C library on the send,
+// receive and relay paths and timing how long they take. The measured time
+// includes the work the C library does, such as writing to the socket, as
+// well as the cost of crossing the boundary itself. While profiling is off
+// the only cost is one atomic load per call.
+func EnableCgoProfiling() {
+	cgoProfiling.Store(true)
+}
+
+// DisableCgoProfiling stops counting calls. The counters keep their values
+// until ResetCgoStats is called.
+func DisableCgoProfiling() {
+	cgoProfiling.Store(false)
+}
+
+// CgoStats returns the counters collected while profiling was enabled.
+func CgoStats() CgoProfile {
+	return CgoProfile{
+		Send:    cgoSend.stat(),
+		Receive: cgoReceive.stat(),
+		Relay:   cgoRelay.stat(),
+	}
+}
+
+// ResetCgoStats sets every counter back to zero.
+func ResetCgoStats() {
+	for _, c := range []*cgoCounter{&cgoSend, &cgoReceive, &cgoRelay} {
+		c.calls.Store(0)
+		c.nanos.Store(0)
+	}
+}
+
+// cgoStart returns the time a profiled cgo call starts, or the zero time if
+// profiling is off.
+func cgoStart() time.Time {
+	if !cgoProfiling.Load() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// done records a call that began at start, as returned by cgoStart.
+func (c *cgoCounter) done(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	c.nanos.Add(uint64(time.Since(start)))
+	c.calls.Add(1)
+}
+
+func (c *cgoCounter) stat() CgoStat {
+	return CgoStat{Calls: c.calls.Load(), Time: time.Duration(c.nanos.Load())}
+}
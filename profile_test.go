@@ -0,0 +1,31 @@
+package relay
+
+import "testing"
+
+func TestCgoStatsCountSends(t *testing.T) {
+	server, client := newPair(t)
+	EnableCgoProfiling()
+	t.Cleanup(DisableCgoProfiling)
+	ResetCgoStats()
+
+	for range 3 {
+		if err := client.Send("x"); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		receive(t, server)
+	}
+	stats := CgoStats()
+	if stats.Send.Calls < 3 || stats.Receive.Calls < 3 {
+		t.Fatalf("CgoStats = %+v, want at least 3 sends and 3 receives", stats)
+	}
+	if stats.Send.Avg() <= 0 {
+		t.Fatalf("average send time %v, want > 0", stats.Send.Avg())
+	}
+
+	DisableCgoProfiling()
+	ResetCgoStats()
+	client.Send("x")
+	if n := CgoStats().Send.Calls; n != 0 {
+		t.Fatalf("%d sends counted with profiling off", n)
+	}
+}
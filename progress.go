@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// progressInterval is the least time between two progress reports of a
+// transfer, other than the last.
+const progressInterval = 250 * time.Millisecond
+
+// Progress reports how far a transfer has got. It is passed to the
+// callbacks of Transfer.OnProgress and SendStreamProgress.
+type Progress struct {
+	Bytes int64         // Bytes sent or received so far, counting a resumed file's Offset
+	Total int64         // Size of the whole data, -1 if unknown
+	Rate  float64       // Average bytes per second moved since the transfer started
+	ETA   time.Duration // Estimated time left at Rate, -1 if unknown
+	Done  bool          // The transfer has ended; this is the last report
+}
+
+// progressMeter counts the bytes a transfer moves and reports them to a
+// callback at most every progressInterval.
+type progressMeter struct {
+	mu       sync.Mutex
+	fn       func(Progress)
+	start    time.Time
+	base     int64 // Bytes done before the transfer started
+	bytes    int64
+	total    int64
+	reported time.Time
+	done     bool
+	ended    time.Time // When finish was called
+}
+
+func newProgressMeter(base, total int64, fn func(Progress)) *progressMeter {
+	now := time.Now()
+	return &progressMeter{fn: fn, start: now, base: base, bytes: base, total: total, reported: now}
+}
+
+// setCallback replaces the callback; a nil fn removes it.
+func (m *progressMeter) setCallback(fn func(Progress)) {
+	m.mu.Lock()
+	m.fn = fn
+	m.mu.Unlock()
+}
+
+// add counts n more bytes and reports them if progressInterval has passed
+// since the last report.
+func (m *progressMeter) add(n int) {
+	m.mu.Lock()
+	m.bytes += int64(n)
+	now := time.Now()
+	if m.fn == nil || now.Sub(m.reported) < progressInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.reported = now
+	fn, p := m.fn, m.progressLocked(now)
+	m.mu.Unlock()
+	fn(p)
+}
+
+// finish sends the last report, once.
+func (m *progressMeter) finish() {
+	m.mu.Lock()
+	if m.done {
+		m.mu.Unlock()
+		return
+	}
+	m.done, m.ended = true, time.Now()
+	fn, p := m.fn, m.progressLocked(m.ended)
+	m.mu.Unlock()
+	if fn != nil {
+		fn(p)
+	}
+}
+
+func (m *progressMeter) progress() Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return m.progressLocked(m.ended)
+	}
+	return m.progressLocked(time.Now())
+}
+
+// progressLocked returns the progress at now. Caller must hold m.mu.
+func (m *progressMeter) progressLocked(now time.Time) Progress {
+	p := Progress{Bytes: m.bytes, Total: m.total, ETA: -1, Done: m.done}
+	if elapsed := now.Sub(m.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(m.bytes-m.base) / elapsed
+	}
+	switch {
+	case m.done:
+		p.ETA = 0
+	case m.total >= 0 && p.Rate > 0:
+		p.ETA = time.Duration(float64(max(m.total-m.bytes, 0)) / p.Rate * float64(time.Second))
+	}
+	return p
+}
@@ -0,0 +1,135 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// defaultProxy is the proxy set with SetDefaultProxy, nil for none.
+var defaultProxy atomic.Pointer[string]
+
+// WithProxy makes a client peer connect through a proxy, for networks that
+// do not let it dial out directly. rawURL is "socks5://host:port" for a
+// SOCKS5 proxy (port 1080 if omitted) or "http://host:port" for an HTTP
+// proxy that tunnels with CONNECT (port 8080 if omitted), with
+// "user:password@" before the host if the proxy wants credentials. The
+// peer's address may then be a host name, which the proxy resolves. The
+// proxy is used again when the peer reconnects. An empty rawURL connects
+// directly even if SetDefaultProxy set a proxy.
+//
+// OpenPeer reports ErrConfigureFailed if rawURL cannot be used,
+// ErrConnectionRefused if the proxy cannot be reached or cannot reach the
+// peer's address, and ErrHandshakeFailed if the proxy refuses the
+// credentials. Server peers, WithUDP and unix:// and mem:// addresses do
+// not use a proxy. It only takes effect when the peer is created.
+func WithProxy(rawURL string) PeerOption {
+	return func(c *peerConfig) {
+		c.proxy = &rawURL
+	}
+}
+
+// SetDefaultProxy sets the proxy of every client peer created afterwards
+// without WithProxy, including those PeerManager.Reconcile connects and
+// DialWebSocket opens, as WithProxy(rawURL) would. An empty rawURL goes
+// back to connecting directly. It returns ErrConfigureFailed if rawURL
+// cannot be used.
+func SetDefaultProxy(rawURL string) error {
+	if rawURL != "" {
+		if _, err := parseProxy(rawURL); err != nil {
+			return err
+		}
+	}
+	defaultProxy.Store(&rawURL)
+	return nil
+}
+
+// proxyURL returns the proxy a client peer created with cfg connects
+// through, or "" for none.
+func (c *peerConfig) proxyURL() string {
+	if c.server || c.udp != nil || strings.HasPrefix(c.ip, UnixScheme) || strings.HasPrefix(c.ip, MemoryScheme) {
+		return ""
+	}
+	if c.proxy != nil {
+		return *c.proxy
+	}
+	if p := defaultProxy.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// proxySettings is a parsed proxy URL.
+type proxySettings struct {
+	http               bool
+	host               string
+	port               int
+	username, password string
+}
+
+// parseProxy parses a proxy URL given to WithProxy or SetDefaultProxy.
+func parseProxy(rawURL string) (*proxySettings, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid proxy URL: %v", ErrConfigureFailed, err)
+	}
+	p := &proxySettings{host: u.Hostname()}
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		p.port = 1080
+	case "http":
+		p.http = true
+		p.port = 8080
+	default:
+		return nil, fmt.Errorf("%w: proxy URL %q is not socks5:// or http://", ErrConfigureFailed, rawURL)
+	}
+	if port := u.Port(); port != "" {
+		if p.port, err = strconv.Atoi(port); err != nil || p.port <= 0 || p.port > 65535 {
+			return nil, fmt.Errorf("%w: invalid proxy port %q", ErrConfigureFailed, port)
+		}
+	}
+	if p.host == "" {
+		return nil, fmt.Errorf("%w: proxy URL %q has no host", ErrConfigureFailed, rawURL)
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// newCProxyOptions converts a proxy URL for the C library, resolving the
+// proxy's host name as pref asks and allocating in mem.
+func newCProxyOptions(rawURL string, pref IPPreference, mem *cMemory) (*C.RelayProxyOptions, error) {
+	p, err := parseProxy(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ip := p.host
+	if _, err := netip.ParseAddr(ip); err != nil {
+		if ip, err = resolveHost(p.host, pref); err != nil {
+			return nil, err
+		}
+	}
+	http := 0
+	if p.http {
+		http = 1
+	}
+	opts := (*C.RelayProxyOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayProxyOptions{}))))
+	*opts = C.RelayProxyOptions{
+		http:     C.int(http),
+		ip:       (*C.char)(mem.bytes(append([]byte(ip), 0))),
+		port:     C.int(p.port),
+		username: (*C.char)(mem.bytes(append([]byte(p.username), 0))),
+		password: (*C.char)(mem.bytes(append([]byte(p.password), 0))),
+	}
+	return opts, nil
+}
@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// connectProxy runs an HTTP proxy that tunnels with CONNECT, and returns
+// its URL and a channel receiving the target of each tunnel.
+func connectProxy(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targets := make(chan string, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				req, err := http.ReadRequest(r)
+				if err != nil || req.Method != http.MethodConnect {
+					io.WriteString(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+				targets <- req.Host
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, r)
+				io.Copy(c, upstream)
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), targets
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy, targets := connectProxy(t)
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	target := server.LocalAddr().String()
+	port := server.LocalAddr().(*net.TCPAddr).Port
+
+	client, conn := connect(t, server, func() (*Peer, error) {
+		return OpenPeer("client", "127.0.0.1", port, 0, WithProxy(proxy))
+	})
+	select {
+	case got := <-targets:
+		if got != target {
+			t.Fatalf("proxy tunnelled to %s, want %s", got, target)
+		}
+	default:
+		t.Fatal("client did not connect through the proxy")
+	}
+	exchange(t, server, client, conn, 3)
+}
+
+func TestDefaultProxy(t *testing.T) {
+	proxy, targets := connectProxy(t)
+	if err := SetDefaultProxy("ftp://127.0.0.1"); err == nil {
+		t.Fatal("SetDefaultProxy accepted an ftp:// URL")
+	}
+	if err := SetDefaultProxy(proxy); err != nil {
+		t.Fatalf("SetDefaultProxy: %v", err)
+	}
+	t.Cleanup(func() { SetDefaultProxy("") })
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+
+	connect(t, server, func() (*Peer, error) { return OpenPeer("proxied", "127.0.0.1", port, 0) })
+	if len(targets) != 1 {
+		t.Fatal("client did not use the default proxy")
+	}
+	connect(t, server, func() (*Peer, error) { return OpenPeer("direct", "127.0.0.1", port, 0, WithProxy("")) })
+	if len(targets) != 1 {
+		t.Fatal("WithProxy(\"\") did not bypass the default proxy")
+	}
+}
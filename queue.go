@@ -0,0 +1,162 @@
+package relay
+
+import "context"
+
+// QueueStats describes a peer's send and receive queues. A limit of 0 means
+// the queue is unbounded.
+type QueueStats struct {
+	SendDepth   int    // Messages waiting to be written, as counted by Pending
+	SendLimit   int    // See SetSendQueueLimit
+	SendDropped uint64 // Messages the send queue discarded or refused for being full
+
+	ReceiveDepth   int    // Messages waiting in the Messages channel
+	ReceiveLimit   int    // Capacity of the Messages channel
+	ReceiveDropped uint64 // Messages the Messages channel discarded for being full
+}
+
+// SetSendQueueLimit caps how many messages SendConflated, SendMessageLane,
+// SendPriority and Enqueue hold waiting to be written, and selects what
+// happens to a message queued while the cap is reached: Block makes the
+// sender wait for the writer to make room, DropNewest discards the new
+// message, DropOldest discards the message queued first, and Reject
+// refuses the new message so Enqueue can return ErrQueueFull. Discarded
+// messages are counted in QueueStats and, if the peer belongs to a
+// PeerManager, passed to its dead-letter handler with ErrQueueFull. A
+// message that replaces one with the same key never needs room. A limit of
+// 0, the default, leaves the queue unbounded; a global buffer limit set on
+// the manager applies as well.
+func (p *Peer) SetSendQueueLimit(n int, policy OverflowPolicy) {
+	o := &p.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.limit = max(n, 0)
+	o.policy = policy
+	o.onFull = func(message string) {
+		if m := p.mgr.Load(); m != nil {
+			m.deadLetterMessage(p.id, message, ErrQueueFull)
+		}
+	}
+	if o.cond.L != nil {
+		// Let senders blocked on the old limit recheck it.
+		o.cond.Broadcast()
+	}
+}
+
+// Enqueue queues a message of the given priority class like SendPriority,
+// but reports what became of it: ErrQueueFull if the send queue limit (see
+// SetSendQueueLimit) discarded or refused it, ErrBufferFull if the
+// manager's global buffer limit did, ErrMessageTooLarge if it is over the
+// peer's message size limit, and ErrPeerDisconnected once the peer is
+// closed. With the Reject policy a refused message is left to the
+// caller and not passed to the dead-letter handler.
+func (p *Peer) Enqueue(message string, priority Priority) error {
+	if err := p.checkSize(len(message)); err != nil {
+		return err
+	}
+	return p.out.push(priorityLanes[priority], "", message, p.sendQueued)
+}
+
+// SetReceiveQueueLimit sets how many received messages the Messages
+// channel holds, like SetInboxSize, and what the reader does with a message
+// that arrives while it is full: Block, the default, stops reading until
+// the application catches up, so the connection's flow control holds the
+// sender back; DropNewest and Reject discard the new message; DropOldest
+// discards the message that has waited longest. Discarded messages are
+// counted in QueueStats. The size only takes effect if set before the
+// first call to Messages; the policy applies at once. Receive and the other
+// receiving methods read from the connection directly and are always
+// subject to flow control alone.
+func (p *Peer) SetReceiveQueueLimit(n int, policy OverflowPolicy) {
+	p.in.mu.Lock()
+	defer p.in.mu.Unlock()
+	p.in.size = n
+	p.in.policy = policy
+}
+
+// QueueStats returns the current depth, limit and discard count of the
+// peer's send and receive queues.
+func (p *Peer) QueueStats() QueueStats {
+	var s QueueStats
+	s.SendDepth = p.out.pending()
+	p.out.mu.Lock()
+	s.SendLimit, s.SendDropped = p.out.limit, p.out.full
+	p.out.mu.Unlock()
+
+	p.in.mu.Lock()
+	defer p.in.mu.Unlock()
+	s.ReceiveLimit, s.ReceiveDropped = sizeOr(p.in.size, DefaultInboxSize), p.in.dropped
+	if p.in.ch != nil {
+		s.ReceiveDepth, s.ReceiveLimit = len(p.in.ch), cap(p.in.ch)
+	}
+	return s
+}
+
+// admitLocked makes room for one more message under the queue limit
+// according to the policy, waiting on o.cond for Block. It returns the
+// messages DropOldest discarded to make room, and ErrQueueFull if the new
+// message must be discarded or refused instead. Caller must hold o.mu.
+func (o *outbox) admitLocked() (discarded []*queuedMessage, err error) {
+	for o.limit > 0 && o.queued >= o.limit && !o.closed {
+		switch o.policy {
+		case Block:
+			o.cond.L = &o.mu
+			o.cond.Wait()
+		case DropOldest:
+			q := o.popOldestLocked()
+			q.uncharge()
+			o.full++
+			discarded = append(discarded, q)
+		default:
+			o.full++
+			return discarded, ErrQueueFull
+		}
+	}
+	return discarded, nil
+}
+
+// discarded passes the messages admitLocked discarded to onFull. It must be
+// called without o.mu.
+func (o *outbox) discarded(queue []*queuedMessage, onFull func(message string)) {
+	if onFull == nil {
+		return
+	}
+	for _, q := range queue {
+		onFull(q.message)
+	}
+}
+
+// deliver puts m on the channel according to the overflow policy, waiting
+// for room or for ctx to be canceled with Block.
+func (in *inbox) deliver(ctx context.Context, m Message) {
+	in.mu.Lock()
+	policy := in.policy
+	in.mu.Unlock()
+	if policy == Block {
+		select {
+		case in.ch <- m:
+		case <-ctx.Done():
+		}
+		return
+	}
+	for {
+		select {
+		case in.ch <- m:
+			return
+		default:
+		}
+		if policy == DropOldest {
+			select {
+			case <-in.ch:
+			default:
+				// The application made room meanwhile.
+				continue
+			}
+		}
+		in.mu.Lock()
+		in.dropped++
+		in.mu.Unlock()
+		if policy != DropOldest {
+			return
+		}
+	}
+}
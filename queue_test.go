@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSendQueueLimit(t *testing.T) {
+	for _, tc := range []struct {
+		policy  OverflowPolicy
+		wantErr error
+		want    []string
+	}{
+		{DropNewest, ErrQueueFull, []string{"first", "a", "b"}},
+		{DropOldest, nil, []string{"first", "b", "c"}},
+		{Reject, ErrQueueFull, []string{"first", "a", "b"}},
+	} {
+		o := outbox{limit: 2, policy: tc.policy}
+		var discarded []string
+		o.onFull = func(message string) { discarded = append(discarded, message) }
+		s := newStalledSender()
+		o.push("", "", "first", s.send)
+		<-s.started
+		o.push("", "", "a", s.send)
+		o.push("", "", "b", s.send)
+		if err := o.push("", "", "c", s.send); err != tc.wantErr {
+			t.Fatalf("policy %v: push over the limit = %v, want %v", tc.policy, err, tc.wantErr)
+		}
+		if tc.policy == Reject && len(discarded) != 0 {
+			t.Fatalf("policy Reject passed %q to the dead-letter handler", discarded)
+		}
+		if o.full != 1 {
+			t.Fatalf("policy %v: %d messages counted as discarded, want 1", tc.policy, o.full)
+		}
+		s.release()
+		o.flush()
+		o.close()
+		if got := s.messages(); !slices.Equal(got, tc.want) {
+			t.Fatalf("policy %v: sent %q, want %q", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	server, client := newPair(t)
+	client.SetSendQueueLimit(8, Reject)
+	client.SetMaxMessageSize(100)
+	if err := client.Enqueue("queued", PriorityHigh); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if got := receive(t, server); got != "queued" {
+		t.Fatalf("got %q, want %q", got, "queued")
+	}
+	if err := client.Enqueue(string(make([]byte, 101)), PriorityNormal); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Enqueue over the size limit: %v, want ErrMessageTooLarge", err)
+	}
+	if s := client.QueueStats(); s.SendLimit != 8 || s.ReceiveLimit != DefaultInboxSize {
+		t.Fatalf("QueueStats = %+v", s)
+	}
+	client.Destroy()
+	if err := client.Enqueue("late", PriorityNormal); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("Enqueue on a closed peer: %v, want ErrPeerDisconnected", err)
+	}
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"context"
+	"sync"
+)
+
+// workGroup counts work in flight on a PeerManager. Unlike sync.WaitGroup
+// it can be closed to new work while waiting, so work started from within
+// other work never races the wait.
+type workGroup struct {
+	mu       sync.Mutex
+	n        int
+	closed   bool
+	idle     chan struct{} // Closed when n drops to 0 after close
+	stopping chan struct{} // Closed by close, for work that must wind down
+}
+
+// enter records the start of a piece of work. It returns false, recording
+// nothing, once the group is closed.
+func (w *workGroup) enter() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// exit records the end of a piece of work started with enter.
+func (w *workGroup) exit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.n--
+	if w.n == 0 && w.idle != nil {
+		close(w.idle)
+		w.idle = nil
+	}
+}
+
+// stopped returns a channel that is closed once close has been called, so
+// long-running work can stop instead of holding up the wait.
+func (w *workGroup) stopped() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping == nil {
+		w.stopping = make(chan struct{})
+		if w.closed {
+			close(w.stopping)
+		}
+	}
+	return w.stopping
+}
+
+// close stops new work from entering and returns a channel that is closed
+// once the work in flight has finished.
+func (w *workGroup) close() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed && w.stopping != nil {
+		close(w.stopping)
+	}
+	w.closed = true
+	idle := make(chan struct{})
+	if w.n == 0 {
+		close(idle)
+		return idle
+	}
+	if w.idle == nil {
+		w.idle = idle
+	}
+	return w.idle
+}
+
+// Quiesce stops the manager taking on new work and waits until the work
+// already in flight has finished: relays, broadcasts, relay streams and
+// running dead-letter handler calls, including those for messages expiring
+// in a managed peer's send queue. From the moment it is called Relay,
+// RelayToGroup, RelayStream and Reconcile return ErrQuiesced, Broadcast and
+// BroadcastFrom return false, and dead letters are no longer reported. Once
+// it returns nil the manager and its peers can be destroyed without a
+// callback still running. Running relay streams stop with ErrQuiesced, even
+// while their source is silent.
+//
+// If ctx is done first Quiesce returns ctx.Err(); the manager still refuses
+// new work and a later Quiesce can wait again. It must not be called from a
+// dead-letter handler, which would wait for itself.
+func (m *PeerManager) Quiesce(ctx context.Context) error {
+	select {
+	case <-m.work.close():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
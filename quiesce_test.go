@@ -0,0 +1,38 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuiesceWaitsForDeadLetters(t *testing.T) {
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	m.SetDeadLetterHandler(func(targetID, message string, reason error) {
+		close(entered)
+		<-release
+	})
+	go m.Relay("a", "missing", "lost")
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Quiesce(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Quiesce with a handler running: %v, want DeadlineExceeded", err)
+	}
+	if err := m.Relay("a", "b", "new"); !errors.Is(err, ErrQuiesced) {
+		t.Fatalf("Relay while quiescing: %v, want ErrQuiesced", err)
+	}
+	if m.Broadcast("new") {
+		t.Fatal("Broadcast succeeded while quiescing")
+	}
+
+	close(release)
+	if err := m.Quiesce(context.Background()); err != nil {
+		t.Fatalf("Quiesce: %v", err)
+	}
+}
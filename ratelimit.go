@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit caps the traffic of one peer in one direction. Each rate is
+// enforced with a token bucket that holds up to one second's worth, so
+// bursts up to that size pass at once; after that sends or receives are
+// held back just long enough to keep to the rate. A message larger than a
+// second's worth of bytes still goes through, after a proportionally longer
+// wait. The zero RateLimit sets no limit.
+type RateLimit struct {
+	Messages float64 // Messages per second, 0 for no limit
+	Bytes    float64 // Bytes per second, 0 for no limit
+}
+
+// ThrottleEvent describes a send or receive held back by a rate limit,
+// passed to the handlers registered with OnThrottled.
+type ThrottleEvent struct {
+	PeerID  string
+	Receive bool          // A receive was held back, otherwise a send
+	Wait    time.Duration // How long it is held back
+	Shared  bool          // Held back by the manager's bandwidth limit rather than the peer's own
+}
+
+// Directions of a rateLimiter's buckets.
+const (
+	rateSend = iota
+	rateReceive
+)
+
+// rateLimiter holds a peer's rate limits and the buckets that enforce them,
+// or a manager's limits for the peers it holds.
+type rateLimiter struct {
+	mu          sync.Mutex
+	limits      [2]RateLimit // Indexed by rateSend and rateReceive
+	messages    [2]tokenBucket
+	bytes       [2]tokenBucket
+	onThrottled func(ThrottleEvent)
+}
+
+// tokenBucket meters one rate. It starts full.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date, zero if never used
+}
+
+// SetRateLimit caps how fast the peer sends and receives. Sends covered
+// are Send, SendBytes, the batch, tracked, unreliable and stream methods,
+// and Client sends; messages queued by SendConflated and the other
+// background methods are held back on the writer, which under
+// IOModePooled occupies a pool worker while it waits. Urgent messages are
+// never held back. A receive is held back after the message arrives, which
+// in turn stops the connection being read and holds the sender back. A
+// zero limit in either direction falls back to the limit of the peer's
+// manager, if any (see PeerManager.SetRateLimit).
+func (p *Peer) SetRateLimit(send, receive RateLimit) {
+	p.limiter.set(send, receive)
+}
+
+// OnThrottled registers fn to be called each time a send or receive of the
+// peer is held back by a rate limit, replacing any handler registered
+// before; a nil fn removes it. It runs on the throttled goroutine just
+// before it waits and should return quickly.
+func (p *Peer) OnThrottled(fn func(ThrottleEvent)) {
+	p.limiter.mu.Lock()
+	defer p.limiter.mu.Unlock()
+	p.limiter.onThrottled = fn
+}
+
+// SetRateLimit sets the rate limits for each managed peer, present or added
+// later, that has none of its own in that direction (see Peer.SetRateLimit).
+// Each peer is metered separately, so one busy peer cannot use up the
+// allowance of the others; messages the manager relays count against the
+// target's send limit. Broadcasts are not held back.
+func (m *PeerManager) SetRateLimit(send, receive RateLimit) {
+	m.limiter.set(send, receive)
+}
+
+// OnThrottled registers fn to be called whenever a managed peer is held
+// back by a rate limit, as described for Peer.OnThrottled. It runs after
+// the peer's own handler, if any.
+func (m *PeerManager) OnThrottled(fn func(ThrottleEvent)) {
+	m.limiter.mu.Lock()
+	defer m.limiter.mu.Unlock()
+	m.limiter.onThrottled = fn
+}
+
+func (r *rateLimiter) set(send, receive RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limits = [2]RateLimit{send, receive}
+}
+
+// throttle meters a send or receive of the given number of messages and
+// bytes against the peer's limits and its manager's bandwidth limit, and
+// waits if they are exceeded.
+func (p *Peer) throttle(dir, messages, bytes int) {
+	var limit RateLimit
+	var managed func(ThrottleEvent)
+	m := p.mgr.Load()
+	if m != nil {
+		m.limiter.mu.Lock()
+		limit, managed = m.limiter.limits[dir], m.limiter.onThrottled
+		m.limiter.mu.Unlock()
+	}
+
+	r := &p.limiter
+	r.mu.Lock()
+	if r.limits[dir] != (RateLimit{}) {
+		limit = r.limits[dir]
+	}
+	now := time.Now()
+	wait := max(r.messages[dir].take(limit.Messages, float64(messages), now),
+		r.bytes[dir].take(limit.Bytes, float64(bytes), now))
+	own := r.onThrottled
+	r.mu.Unlock()
+	var shared time.Duration
+	if m != nil {
+		shared = m.bandwidth.take(dir, bytes, now)
+	}
+	if wait <= 0 && shared <= 0 {
+		return
+	}
+
+	e := ThrottleEvent{PeerID: p.id, Receive: dir == rateReceive, Wait: max(wait, shared), Shared: shared > wait}
+	if own != nil {
+		own(e)
+	}
+	if managed != nil {
+		managed(e)
+	}
+	time.Sleep(e.Wait)
+}
+
+// take removes n tokens from a bucket that refills at rate per second, going
+// into debt if there are not enough, and returns how long until the debt is
+// repaid. A rate of 0 never waits.
+func (b *tokenBucket) take(rate, n float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		b.last = time.Time{}
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, rate)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttleLog records the events passed to an OnThrottled handler.
+type throttleLog struct {
+	mu     sync.Mutex
+	events []ThrottleEvent
+}
+
+func (l *throttleLog) add(e ThrottleEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *throttleLog) all() []ThrottleEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ThrottleEvent(nil), l.events...)
+}
+
+func TestRateLimit(t *testing.T) {
+	server, client := newPair(t)
+	var log throttleLog
+	client.SetRateLimit(RateLimit{Messages: 20}, RateLimit{})
+	client.OnThrottled(log.add)
+
+	start := time.Now()
+	// A burst of 20 passes at once; the other 5 wait a quarter second.
+	for range 25 {
+		if err := client.Send("m"); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("25 sends at 20 per second took %v", elapsed)
+	}
+	events := log.all()
+	if len(events) == 0 {
+		t.Fatal("OnThrottled was not called")
+	}
+	if e := events[0]; e.PeerID != "client" || e.Receive || e.Shared || e.Wait <= 0 {
+		t.Fatalf("event = %+v, want a send held back by the peer's own limit", e)
+	}
+	for range 25 {
+		receive(t, server)
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(client)
+	var log throttleLog
+	m.OnThrottled(log.add)
+	m.SetBandwidthLimit(4000, 0)
+	if up, down := m.BandwidthLimit(); up != 4000 || down != 0 {
+		t.Fatalf("BandwidthLimit = %v, %v", up, down)
+	}
+
+	start := time.Now()
+	// One second's worth passes at once; the rest waits half a second.
+	for range 3 {
+		if err := client.Send(strings.Repeat("b", 2000)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("6000 bytes at 4000 per second took %v", elapsed)
+	}
+	events := log.all()
+	if len(events) == 0 || !events[0].Shared {
+		t.Fatalf("events = %+v, want one held back by the shared limit", events)
+	}
+	for range 3 {
+		receive(t, server)
+	}
+}
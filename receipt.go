@@ -0,0 +1,300 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// DeliveryStatus is the outcome of a message sent with Peer.SendTracked or
+// Peer.SendAsync.
+type DeliveryStatus int
+
+const (
+	// Delivered means the remote peer read the message off its connection.
+	// It says nothing about whether the application there has consumed it.
+	Delivered DeliveryStatus = iota
+	// Failed means the message could not be sent, or the connection closed
+	// before a receipt arrived.
+	Failed
+	// Timeout means no receipt arrived within DefaultReceiptTimeout. The
+	// message may still have been delivered.
+	Timeout
+	// Canceled means CancelSend stopped waiting for the receipt. The message
+	// may still have been delivered.
+	Canceled
+	// Dropped means the message was never sent: SendAsync found its queue
+	// full, or the peer was closed while the message was still queued.
+	Dropped
+)
+
+// String returns the status name.
+func (s DeliveryStatus) String() string {
+	switch s {
+	case Delivered:
+		return "delivered"
+	case Failed:
+		return "failed"
+	case Timeout:
+		return "timeout"
+	case Canceled:
+		return "canceled"
+	case Dropped:
+		return "dropped"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultReceiptTimeout is how long SendTracked waits for a receipt before
+// reporting Timeout.
+const DefaultReceiptTimeout = 5 * time.Second
+
+// receiptPollInterval bounds how long the receipt tracker waits for incoming
+// data before checking for timed-out receipts.
+const receiptPollInterval = 100 * time.Millisecond
+
+// jitterSamples is how many of the latest receipt round trips Jitter is
+// computed over.
+const jitterSamples = 32
+
+// pendingReceipt is a tracked message waiting for its receipt.
+type pendingReceipt struct {
+	message  string
+	report   func(DeliveryStatus) // Called once with the outcome, holding receiptTracker.mu
+	sentAt   time.Time
+	deadline time.Time
+}
+
+// PendingSend describes a message sent with SendTracked that is still
+// waiting for its receipt.
+type PendingSend struct {
+	ID      uint64        // Identifies the send to CancelSend
+	Message string        // The message sent
+	Age     time.Duration // Time since it was sent
+}
+
+// receiptTracker matches receipts to messages sent with SendTracked. While
+// any receipt is outstanding a goroutine polls the connection for receipts.
+type receiptTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	waiting map[uint64]*pendingReceipt
+	rtts    [jitterSamples]time.Duration // Latest round trips, a ring indexed by nextRTT
+	nextRTT int                          // Round trips recorded, the next index modulo jitterSamples
+	running bool
+	closed  bool
+	done    chan struct{}
+}
+
+// SendTracked sends a message and returns a channel that receives exactly
+// one DeliveryStatus for it: Delivered once the remote peer acknowledges it,
+// Failed if the send fails or the connection closes first, Timeout after
+// DefaultReceiptTimeout, or Canceled after CancelSend. Unlike reliable
+// delivery nothing is retransmitted; the receipt only reports what happened.
+// PendingSends lists the sends still waiting.
+//
+// Receipts are read from the connection in the background. A message
+// received meanwhile is kept for ReceiveMessage. Only client peers receive
+// receipts, and the remote peer must be running this version of the
+// library.
+func (p *Peer) SendTracked(message string) (receipt <-chan DeliveryStatus) {
+	status := make(chan DeliveryStatus, 1)
+	p.sendTracked(message, func(s DeliveryStatus) { status <- s })
+	return status
+}
+
+// sendTracked sends message as SendTracked does, passing its outcome to
+// report once known.
+func (p *Peer) sendTracked(message string, report func(DeliveryStatus)) {
+	if p.checkSize(len(message)) != nil || !p.enter() {
+		report(Failed)
+		return
+	}
+	defer p.leave()
+	id, ok := p.receipts.add(message, report)
+	if !ok {
+		report(Failed)
+		return
+	}
+
+	p.throttle(rateSend, 1, len(message))
+	cMsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cMsg))
+	start := cgoStart()
+	sent := C.relay_send_tracked_bytes(p.ptr, cMsg, C.size_t(len(message)), C.uint64_t(id))
+	cgoSend.done(start)
+	if sent != C.RELAY_OK {
+		p.receipts.resolve(id, Failed)
+		return
+	}
+	p.receipts.start(p)
+}
+
+// add registers a receipt before its message is sent, so a fast receipt is
+// never missed. It returns false once the tracker is closed.
+func (t *receiptTracker) add(message string, report func(DeliveryStatus)) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, false
+	}
+	if t.waiting == nil {
+		t.waiting = make(map[uint64]*pendingReceipt)
+	}
+	t.nextID++
+	now := time.Now()
+	t.waiting[t.nextID] = &pendingReceipt{message: message, report: report, sentAt: now, deadline: now.Add(DefaultReceiptTimeout)}
+	return t.nextID, true
+}
+
+// PendingSends returns the messages sent with SendTracked that are still
+// waiting for a receipt, oldest first. Nothing is retransmitted, so there is
+// no other in-flight state to report; messages queued by SendConflated are
+// counted by Pending instead.
+func (p *Peer) PendingSends() []PendingSend {
+	return p.receipts.pending()
+}
+
+// CancelSend stops waiting for the receipt of the tracked send with the
+// given ID, reporting Canceled on its channel, for example on shutdown or
+// once the outcome no longer matters. The message itself has already been
+// written and may still be delivered. It returns false if the send is not
+// pending, for example because its receipt already arrived.
+func (p *Peer) CancelSend(id uint64) bool {
+	return p.receipts.resolve(id, Canceled)
+}
+
+// Jitter returns the standard deviation of the round-trip times of the
+// latest messages sent with SendTracked, from sending each message to
+// receiving its receipt, over a window of the last 32 receipts. A high
+// jitter marks a path as a poor choice for latency-sensitive traffic even
+// when its average round trip looks fine. It returns 0 until two receipts
+// have arrived.
+func (p *Peer) Jitter() time.Duration {
+	return p.receipts.jitter()
+}
+
+// jitter computes the standard deviation of the recorded round trips.
+func (t *receiptTracker) jitter() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := min(t.nextRTT, jitterSamples)
+	if n < 2 {
+		return 0
+	}
+	var mean float64
+	for _, rtt := range t.rtts[:n] {
+		mean += float64(rtt)
+	}
+	mean /= float64(n)
+	var variance float64
+	for _, rtt := range t.rtts[:n] {
+		d := float64(rtt) - mean
+		variance += d * d
+	}
+	return time.Duration(math.Sqrt(variance / float64(n)))
+}
+
+// pending lists the outstanding receipts, oldest first.
+func (t *receiptTracker) pending() []PendingSend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	sends := make([]PendingSend, 0, len(t.waiting))
+	for id, r := range t.waiting {
+		sends = append(sends, PendingSend{ID: id, Message: r.message, Age: now.Sub(r.sentAt)})
+	}
+	sort.Slice(sends, func(i, j int) bool { return sends[i].ID < sends[j].ID })
+	return sends
+}
+
+// resolve reports status for the receipt with the given ID, if it is still
+// outstanding, and reports whether it was.
+func (t *receiptTracker) resolve(id uint64, status DeliveryStatus) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.waiting[id]
+	if ok {
+		delete(t.waiting, id)
+		r.report(status)
+	}
+	return ok
+}
+
+// start runs the polling goroutine if it is not already running.
+func (t *receiptTracker) start(p *Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running || t.closed || len(t.waiting) == 0 {
+		return
+	}
+	t.running = true
+	t.done = make(chan struct{})
+	spawn(func() { t.run(p) })
+}
+
+// run polls for receipts until none are outstanding or the tracker is
+// closed.
+func (t *receiptTracker) run(p *Peer) {
+	defer close(t.done)
+	ids := make([]C.uint64_t, 64)
+	for {
+		n := C.int(C.RELAY_ERR_DISCONNECTED)
+		if p.enter() {
+			n = C.relay_poll_receipts(p.ptr, &ids[0], C.int(len(ids)), C.int64_t(receiptPollInterval.Milliseconds()))
+			p.leave()
+		}
+
+		t.mu.Lock()
+		now := time.Now()
+		for _, id := range ids[:max(int(n), 0)] {
+			if r, ok := t.waiting[uint64(id)]; ok {
+				delete(t.waiting, uint64(id))
+				t.rtts[t.nextRTT%jitterSamples] = now.Sub(r.sentAt)
+				t.nextRTT++
+				r.report(Delivered)
+			}
+		}
+		for id, r := range t.waiting {
+			switch {
+			case n == C.RELAY_ERR_DISCONNECTED:
+				r.report(Failed)
+			case now.After(r.deadline):
+				r.report(Timeout)
+			default:
+				continue
+			}
+			delete(t.waiting, id)
+		}
+		if t.closed || len(t.waiting) == 0 {
+			t.running = false
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+	}
+}
+
+// close reports Failed for every outstanding receipt and waits for the
+// polling goroutine to stop.
+func (t *receiptTracker) close() {
+	t.mu.Lock()
+	t.closed = true
+	for id, r := range t.waiting {
+		r.report(Failed)
+		delete(t.waiting, id)
+	}
+	running, done := t.running, t.done
+	t.mu.Unlock()
+	if running {
+		<-done
+	}
+}
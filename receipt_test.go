@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendTrackedDelivered(t *testing.T) {
+	server, client := newPair(t)
+	receipt := client.SendTracked("tracked")
+	if got := receive(t, server); got != "tracked" {
+		t.Fatalf("got %q, want %q", got, "tracked")
+	}
+	select {
+	case status := <-receipt:
+		if status != Delivered {
+			t.Fatalf("status = %v, want delivered", status)
+		}
+	case <-time.After(DefaultReceiptTimeout + time.Second):
+		t.Fatal("no receipt")
+	}
+	if pending := client.PendingSends(); len(pending) != 0 {
+		t.Fatalf("PendingSends = %+v after the receipt", pending)
+	}
+}
+
+func TestSendTrackedFailsOnClose(t *testing.T) {
+	_, client, conn := openPair(t, nil, nil)
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	for range 10 {
+		if status := <-client.SendTracked("lost"); status == Failed {
+			return
+		}
+	}
+	t.Fatal("SendTracked to a closed connection never failed")
+}
+
+func TestCancelSend(t *testing.T) {
+	_, client := newPair(t)
+	// The server never reads, so no receipt comes back.
+	receipt := client.SendTracked("ignored")
+	pending := client.PendingSends()
+	if len(pending) != 1 || pending[0].Message != "ignored" {
+		t.Fatalf("PendingSends = %+v, want the tracked send", pending)
+	}
+	if !client.CancelSend(pending[0].ID) {
+		t.Fatal("CancelSend of a pending send returned false")
+	}
+	if status := <-receipt; status != Canceled {
+		t.Fatalf("status = %v, want canceled", status)
+	}
+	if client.CancelSend(pending[0].ID) {
+		t.Fatal("CancelSend of a canceled send returned true")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	server, client := newPair(t)
+	if j := client.Jitter(); j != 0 {
+		t.Fatalf("Jitter before any receipt = %v, want 0", j)
+	}
+	for i := range 5 {
+		receipt := client.SendTracked("ping")
+		receive(t, server)
+		if status := <-receipt; status != Delivered {
+			t.Fatalf("status = %v, want delivered", status)
+		}
+		if i == 0 && client.Jitter() != 0 {
+			t.Fatalf("Jitter after one receipt = %v, want 0", client.Jitter())
+		}
+	}
+	if j := client.Jitter(); j <= 0 {
+		t.Fatalf("Jitter after 5 receipts = %v, want > 0", j)
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Reconcile makes the manager's peers match desired. Each entry is keyed by
+// its ID, or by its address (see PeerInfo.Addr) if the ID is empty. Entries
+// with no managed peer are connected as client peers and added; managed peers
+// with no entry are removed and closed, including ones added with AddPeer;
+// peers whose entry is unchanged are left alone. A peer whose address
+// changed is replaced by a new connection, so its ID appears in both added
+// and removed.
+//
+// New connections are made before anything is removed. If any of them fails,
+// the ones already made are destroyed, the manager is left as it was, and an
+// error wrapping ErrConnectFailed names the address. Removed peers are closed
+// but not destroyed, as callers may still hold them. Both returned lists are
+// sorted.
+func (m *PeerManager) Reconcile(desired []PeerInfo) (added, removed []string, err error) {
+	if !m.work.enter() {
+		return nil, nil, ErrQuiesced
+	}
+	defer m.work.exit()
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+
+	want := make(map[string]PeerInfo, len(desired))
+	for _, info := range desired {
+		id := info.ID
+		if id == "" {
+			id = info.Addr()
+		}
+		want[id] = info
+	}
+
+	m.mu.RLock()
+	current := make(map[string]*Peer, len(m.peers))
+	for id, p := range m.peers {
+		current[id] = p
+	}
+	m.mu.RUnlock()
+
+	for id, p := range current {
+		if info, ok := want[id]; ok && p.hasAddress(info.IP, info.Port) {
+			delete(want, id)
+			continue
+		}
+		removed = append(removed, id)
+	}
+	for id := range want {
+		added = append(added, id)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	created := make([]*Peer, 0, len(added))
+	for _, id := range added {
+		info := want[id]
+		p := NewPeer(id, info.IP, info.Port, 0)
+		if p == nil {
+			for _, c := range created {
+				c.Destroy()
+			}
+			return nil, nil, fmt.Errorf("%w: %s", ErrConnectFailed, info.Addr())
+		}
+		created = append(created, p)
+	}
+
+	for _, id := range removed {
+		m.RemovePeer(id)
+		current[id].Close()
+	}
+	for _, p := range created {
+		m.AddPeer(p)
+	}
+	return added, removed, nil
+}
+
+// hasAddress reports whether the peer was last connected to ip:port.
+func (p *Peer) hasAddress(ip string, port int) bool {
+	p.cfgMu.Lock()
+	defer p.cfgMu.Unlock()
+	return p.cfg.ip == ip && p.cfg.port == port
+}
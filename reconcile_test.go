@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	acceptAll(t, server)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+
+	desired := []PeerInfo{{ID: "a", IP: "127.0.0.1", Port: port}, {IP: "127.0.0.1", Port: port}}
+	unkeyed := desired[1].Addr()
+	added, removed, err := m.Reconcile(desired)
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if want := []string{unkeyed, "a"}; !slices.Equal(added, want) || len(removed) != 0 {
+		t.Fatalf("Reconcile added %q and removed %q, want %q added", added, removed, want)
+	}
+	a := m.peer("a")
+
+	added, removed, err = m.Reconcile(desired[:1])
+	if err != nil || len(added) != 0 || !slices.Equal(removed, []string{unkeyed}) {
+		t.Fatalf("Reconcile = %q, %q, %v, want the unkeyed peer removed", added, removed, err)
+	}
+	if m.peer("a") != a {
+		t.Fatal("unchanged peer was replaced")
+	}
+
+	bad := append(desired[:1:1], PeerInfo{ID: "b", IP: "127.0.0.1", Port: freePort(t)})
+	if _, _, err := m.Reconcile(bad); !errors.Is(err, ErrConnectFailed) {
+		t.Fatalf("Reconcile with an unreachable peer: %v, want ErrConnectFailed", err)
+	}
+	if m.peer("a") != a || m.peer("b") != nil {
+		t.Fatal("failed Reconcile changed the manager")
+	}
+	t.Cleanup(a.Destroy)
+}
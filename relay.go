@@ -2,123 +2,1676 @@ package relay
 
 /*
 #cgo CFLAGS: -I${SRCDIR}/include
-#cgo LDFLAGS: -L${SRCDIR}/build -lrelay
+#cgo LDFLAGS: -L${SRCDIR}/build -lrelay -lz -lssl -lcrypto
 #include "../include/relay.h"
 #include <stdlib.h> // For free()
 */
 import "C"
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"runtime/cgo"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
-// Peer represents a P2P peer
+// Peer represents a P2P peer. A peer's ID is its identity: two *Peer values
+// refer to the same peer exactly when their IDs match (see Equal), so use
+// ID rather than the *Peer pointer as the key in maps and sets.
+//
+// A Peer is safe for concurrent use by multiple goroutines. Messages sent
+// from different goroutines at once are each written as a whole frame,
+// never interleaved, in no particular order between goroutines.
 type Peer struct {
-	ptr C.RelayPeer
+	ptr      C.RelayPeer
+	id       string
+	out      outbox
+	receipts receiptTracker
+	acks     ackBatcher // Sends receipts batched by SetAckBatching
+	async    asyncSender
+	retries  retransmitter // Retries of SendReliable
+	dedup    dedupFilter
+	reorder  reorderBuffer
+	ordered  sequencer // Numbers the messages of SendOrdered
+	ager     connectionAger
+	mux      muxer
+	conns    connDemux // Hands received messages to the Conns of Listener
+	in       inbox
+	peeked   peekBuffer                  // Message returned by Peek and not yet received
+	limiter  rateLimiter                 // Rate limits set with SetRateLimit
+	mgr      atomic.Pointer[PeerManager] // Manager the peer was added to, for dead letters
+	onUrgent atomic.Pointer[func(message string)]
+	codec    atomic.Pointer[Codec] // Set with SetCodec, nil for JSONCodec
+	rpcSeq   atomic.Uint64         // Correlation ID of the last Request
+	served   servedRequests        // Requests being answered, by correlation ID
+	stale    atomic.Uint64         // Expired envelopes dropped on receipt
+	maxSize  atomic.Int64          // Largest message sent, 0 for no limit
+	relaying atomic.Int64          // Relays to the peer in progress, for LeastPending
+
+	handlerMu sync.Mutex
+	handler   cgo.Handle       // OnMessage handler, 0 if none
+	tls       *tlsVerifier     // Checks TLS certificates, nil without TLS
+	noise     bool             // Connections run Noise
+	e2eKey    *ecdh.PrivateKey // Opens received sealed messages, nil if none
+	listener  net.Listener     // Accepts the clients of a server peer on a registered Transport, nil otherwise
+	hooks     lifecycleHooks
+	destroyed atomic.Bool
+	guard     handleGuard // Calls using ptr, which Destroy waits for
+
+	acceptOnce sync.Once
+	acceptKey  atomic.Uintptr // Context of the accept filter, 0 if none
+
+	cfgMu sync.Mutex
+	cfg   peerConfig
 }
 
-// PeerManager manages a collection of peers
+// PeerManager manages a collection of peers. It is safe for concurrent use
+// by multiple goroutines, including while peers are added and removed.
 type PeerManager struct {
-	ptr C.RelayPeerManager
+	ptr   C.RelayPeerManager
+	mu    sync.RWMutex
+	peers map[string]*Peer
+
+	deadLetter func(targetID, message string, reason error)
+	transform  func(sourceID, targetID, message string) (string, bool)
+	sealKeys   map[string]*ecdh.PublicKey // Peer ID -> key RelaySealed seals to
+	sealedOnly atomic.Bool                // Relay only forwards sealed messages
+	authOnly   atomic.Bool                // Add refuses unauthenticated peers
+	acl        accessList
+
+	tags    map[string]map[string]struct{} // Tag -> IDs of the peers carrying it
+	weights map[string]int                 // Peer ID -> load-balancing weight, if not 1
+	groups  map[string]*groupBalancer      // Tag -> RelayToGroup state
+
+	reconcileMu sync.Mutex   // Serializes Reconcile calls
+	work        workGroup    // Work in flight, for Quiesce
+	buffers     bufferBudget // Cap on bytes queued across all peers
+	io          ioPool       // Shared writers for IOModePooled
+	in          managerInbox // Merged messages for Inbox
+	limiter     rateLimiter  // Rate limits for peers without their own
+	bandwidth   bandwidthLimit
+	hooks       lifecycleHooks
+	destroyed   atomic.Bool
+	guard       handleGuard // Calls using ptr, which Destroy waits for
 }
 
 // PeerDiscovery handles peer discovery
 type PeerDiscovery struct {
-	ptr C.RelayPeerDiscovery
+	ptr       C.RelayPeerDiscovery
+	destroyed atomic.Bool
+
+	mu      sync.Mutex
+	resolve func(advertised PeerInfo) PeerInfo
+}
+
+// PeerInfo describes a peer by its address, for example one found by
+// PeerDiscovery.
+type PeerInfo struct {
+	ID       string // Peer ID, empty if the peer has not announced one
+	IP       string
+	Port     int
+	Metadata map[string]string // Announced key-values, nil if none
+
+	// Interface is the local network interface, such as "eth0", that
+	// received the peer's latest discovery response, or "" if unknown. On a
+	// multi-homed host, connect to the peer through this interface.
+	Interface string
+}
+
+// Addr returns the peer's address as "IP:port".
+func (i PeerInfo) Addr() string {
+	return net.JoinHostPort(i.IP, strconv.Itoa(i.Port))
+}
+
+// parsePeerInfo parses an "IP:port" address reported by the C library.
+func parsePeerInfo(addr string) PeerInfo {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return PeerInfo{IP: addr}
+	}
+	n, _ := strconv.Atoi(port)
+	return PeerInfo{IP: host, Port: n}
+}
+
+// NewPeer creates a new peer. A non-zero isServer, like WithServerMode,
+// creates a server peer; Open does the same without the flag. The address
+// and connection options in opts are used to connect (or listen, for a
+// server peer); the rest are applied once the socket is up. A server peer
+// given port 0 listens on a port the OS picks, which LocalAddr reports. It
+// returns nil if the peer cannot be created or an option cannot be applied;
+// use OpenPeer to find out why.
+func NewPeer(id, ip string, port int, isServer int, opts ...PeerOption) *Peer {
+	p, _ := OpenPeer(id, ip, port, isServer, opts...)
+	return p
 }
 
-// NewPeer creates a new peer
-func NewPeer(id, ip string, port int, isServer int) *Peer {
+// Open creates a new peer configured by opts, a client peer unless
+// WithServerMode is given, and reports why it could not be created as
+// OpenPeer does.
+func Open(id, ip string, port int, opts ...PeerOption) (*Peer, error) {
+	return OpenPeer(id, ip, port, 0, opts...)
+}
+
+// OpenPeer creates a new peer like NewPeer, but reports why it could not be
+// created: ErrConnectionRefused if nothing is listening at a client peer's
+// address, ErrTimeout if connecting timed out (see WithConnectTimeout),
+// ErrAddressInUse if a server peer's address or a client peer's local
+// address is taken, ErrInvalidAddress if an IP address, Unix socket path or
+// in-process name (see UnixScheme and MemoryScheme) cannot be used or a
+// host name cannot be resolved (see WithIPPreference),
+// ErrHandshakeFailed if the TLS, Noise or shared-secret handshake fails or
+// the remote end's identity is not the expected one (see WithTLS,
+// WithNoiseKey, WithIdentity and WithAuthToken), ErrServerDraining if the
+// server said in that handshake that it is draining (see SetDraining),
+// ErrConfigureFailed if an option cannot be applied, and
+// ErrConnectFailed otherwise. The errors work with errors.Is.
+func OpenPeer(id, ip string, port int, isServer int, opts ...PeerOption) (*Peer, error) {
+	cfg := peerConfig{ip: ip, port: port, server: isServer != 0}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.ip, cfg.localIP = unbracket(cfg.ip), unbracket(cfg.localIP)
+	if cfg.securityCount() > 1 {
+		return nil, fmt.Errorf("%w: only one of WithTLS, WithNoiseKey, WithIdentity and WithAuthToken or WithPSK can be used", ErrConfigureFailed)
+	}
+	if err := checkLocalConfig(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.identity != nil {
+		var err error
+		if id, err = cfg.applyIdentity(id); err != nil {
+			return nil, err
+		}
+	}
+	hostIP, err := cfg.hostIP()
+	if err != nil {
+		return nil, err
+	}
 	cID := C.CString(id)
-	cIP := C.CString(ip)
+	cIP := C.CString(hostIP)
+	cLocalIP := C.CString(cfg.localIP)
 	defer C.free(unsafe.Pointer(cID))
 	defer C.free(unsafe.Pointer(cIP))
-	ptr := C.relay_create_peer(cID, cIP, C.int(port), C.int(isServer))
+	defer C.free(unsafe.Pointer(cLocalIP))
+	cOpen := C.RelayOpenOptions{
+		localIp:          cLocalIP,
+		localPort:        C.int(cfg.localPort),
+		connectTimeoutMs: C.int64_t(cfg.connectTimeout.Milliseconds()),
+		backlog:          C.int(cfg.backlog),
+		socketMode:       C.int(cfg.unixMode),
+	}
+	for _, flag := range []struct {
+		set bool
+		c   *C.int
+	}{{cfg.ipv6Only, &cOpen.ipv6Only}, {cfg.reuseAddr, &cOpen.reuseAddress}, {cfg.reusePort, &cOpen.reusePort}} {
+		if flag.set {
+			*flag.c = 1
+		}
+	}
+	server := 0
+	if cfg.server {
+		server = 1
+	}
+	var mem cMemory
+	defer mem.free()
+	var verifier *tlsVerifier
+	if cfg.tls != nil {
+		verifier = newTLSVerifier(cfg.tls, cfg.server, cfg.ip)
+		cTLS, err := newCTLSOptions(cfg.tls, verifier, &mem)
+		if err != nil {
+			verifier.handle.Delete()
+			return nil, err
+		}
+		cOpen.tls = cTLS
+	}
+	if cfg.noise != nil || len(cfg.noisePeers) > 0 {
+		cNoise, err := newCNoiseOptions(&cfg, &mem)
+		if err != nil {
+			return nil, err
+		}
+		cOpen.noise = cNoise
+	}
+	if len(cfg.authSecrets) > 0 {
+		cAuth, err := newCAuthOptions(&cfg, &mem)
+		if err != nil {
+			return nil, err
+		}
+		cOpen.auth = cAuth
+	}
+	if cfg.websocket {
+		cWS, err := newCWebSocketOptions(&cfg, &mem)
+		if err != nil {
+			return nil, err
+		}
+		cOpen.websocket = cWS
+	}
+	if cfg.udp != nil {
+		cOpen.udp = newCUDPOptions(cfg.udp, &mem)
+	}
+	if proxy := cfg.proxyURL(); proxy != "" {
+		cProxy, err := newCProxyOptions(proxy, cfg.ipPreference, &mem)
+		if err != nil {
+			return nil, err
+		}
+		cOpen.proxy = cProxy
+	}
+	var ptr C.RelayPeer
+	var listener net.Listener
+	if t := lookupTransport(cfg.ip); t != nil {
+		ptr, listener, err = openOnTransport(t, cID, &cfg, &cOpen)
+	} else {
+		var status C.int
+		ptr = C.relay_open_peer_with(cID, cIP, C.int(cfg.port), C.int(server), &cOpen, &status)
+		err = statusError(status, ErrConnectFailed)
+	}
 	if ptr == nil {
-		return nil
+		if verifier != nil {
+			if verr := verifier.lastError(); verr != nil && err == ErrHandshakeFailed {
+				err = fmt.Errorf("%w: %v", ErrHandshakeFailed, verr)
+			}
+			verifier.handle.Delete()
+		}
+		return nil, err
+	}
+	p := &Peer{ptr: ptr, id: id, cfg: cfg, tls: verifier, noise: cfg.noise != nil, e2eKey: cfg.e2eKey, listener: listener}
+	if len(opts) > 0 {
+		cOpts := cfg.socketOptions()
+		ok := C.relay_configure_peer(ptr, &cOpts) == C.RELAY_OK
+		if ok && cfg.readBuffer > 0 {
+			ok = C.relay_grow_receive_buffer(ptr, C.int64_t(cfg.readBuffer)) == C.RELAY_OK
+		}
+		if !ok {
+			C.relay_destroy_peer(ptr)
+			if listener != nil {
+				listener.Close()
+			}
+			if verifier != nil {
+				verifier.handle.Delete()
+			}
+			return nil, ErrConfigureFailed
+		}
+		if cfg.maxMessageSize > 0 {
+			p.SetMaxMessageSize(cfg.maxMessageSize)
+		}
+	}
+	runtime.SetFinalizer(p, (*Peer).Destroy)
+	return p, nil
+}
+
+// ID returns the peer's unique ID, as passed to NewPeer. It is the canonical
+// key for a peer.
+func (p *Peer) ID() string {
+	return p.id
+}
+
+// Equal reports whether p and other refer to the same peer, that is whether
+// they carry the same ID. Destroying a peer does not change its identity.
+// Two nil peers are equal.
+func (p *Peer) Equal(other *Peer) bool {
+	if p == nil || other == nil {
+		return p == other
 	}
-	return &Peer{ptr: ptr}
+	return p.id == other.id
+}
+
+// Hash returns a hash of the peer's ID, consistent with Equal: equal peers
+// have equal hashes.
+func (p *Peer) Hash() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p.id))
+	return h.Sum64()
 }
 
 // SendMessage sends a message to the peer
 func (p *Peer) SendMessage(message string) bool {
+	return p.Send(message) == nil
+}
+
+// sendQueued writes a message taken off the send queue. Unlike SendMessage
+// it passes the length to the C library, so queued envelopes arrive intact.
+func (p *Peer) sendQueued(message string) bool {
+	return p.SendBytes([]byte(message)) == nil
+}
+
+// Send sends a message to the peer. It returns ErrCircuitOpen without
+// attempting the send while the peer's circuit breaker is open,
+// ErrPeerDisconnected if the connection is closed, and ErrTemporary for a
+// transient failure worth retrying (see SendWithRetry).
+func (p *Peer) Send(message string) error {
+	if err := p.checkSize(len(message)); err != nil {
+		return err
+	}
+	p.throttle(rateSend, 1, len(message))
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
 	cMsg := C.CString(message)
 	defer C.free(unsafe.Pointer(cMsg))
-	return C.relay_send_message(p.ptr, cMsg) != 0
+	start := cgoStart()
+	status := C.relay_send_message(p.ptr, cMsg)
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// SendBytes sends a binary message, such as an encoded protobuf or an
+// encrypted blob, to the peer. Unlike Send it passes the length across to
+// the C library, so a payload containing NUL bytes arrives intact. Errors
+// are reported as for Send.
+func (p *Peer) SendBytes(data []byte) error {
+	if err := p.checkSize(len(data)); err != nil {
+		return err
+	}
+	p.throttle(rateSend, 1, len(data))
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	cData := C.CBytes(data)
+	defer C.free(cData)
+	start := cgoStart()
+	status := C.relay_send_bytes(p.ptr, (*C.char)(cData), C.size_t(len(data)))
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// SendWithRetry sends a message like Send, retrying up to attempts times in
+// all while the send fails with ErrTemporary. It waits backoff before the
+// first retry and doubles the wait before each later one. Any other error,
+// such as ErrPeerDisconnected for a closed connection, is returned at once;
+// otherwise the last error is returned once the attempts are used up.
+func (p *Peer) SendWithRetry(message string, attempts int, backoff time.Duration) error {
+	var err error
+	for attempt := 0; attempt < max(attempts, 1); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = p.Send(message); !errors.Is(err, ErrTemporary) {
+			return err
+		}
+	}
+	return err
+}
+
+// SendAll sends messages to the peer as a single batch frame. The receiving
+// peer's ReceiveMessage returns them one at a time, in order.
+func (p *Peer) SendAll(messages []string) error {
+	return p.sendBatch(messages, false)
+}
+
+// SendAllCompressed is like SendAll but compresses the batch as a whole
+// before sending it. Many small, similar messages compress far better
+// together than one at a time.
+func (p *Peer) SendAllCompressed(messages []string) error {
+	return p.sendBatch(messages, true)
 }
 
-// ReceiveMessage receives a message from the peer
+// SetCompressionDictionary primes the compression used by SendAllCompressed
+// with dict, a sample of bytes that recur across messages such as common
+// JSON keys or fixed headers. Small batches have too little data of their
+// own for zlib to find repetition, so a shared dictionary improves them the
+// most. Both ends must set the same dictionary before exchanging compressed
+// batches; a batch compressed with a different one is dropped by the
+// receiver. A nil or empty dict turns the dictionary off.
+func (p *Peer) SetCompressionDictionary(dict []byte) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	if len(dict) == 0 {
+		C.relay_set_compression_dictionary(p.ptr, nil, 0)
+		return
+	}
+	cDict := C.CBytes(dict)
+	defer C.free(cDict)
+	C.relay_set_compression_dictionary(p.ptr, (*C.char)(cDict), C.size_t(len(dict)))
+}
+
+// Compression levels for SetCompressionLevel. Any level in between is valid
+// too.
+const (
+	CompressionFastest = 1 // Least CPU, largest output
+	CompressionDefault = 6 // zlib's usual trade-off
+	CompressionBest    = 9 // Smallest output; the level a peer starts with
+)
+
+// SetCompressionLevel sets the zlib level SendAllCompressed uses, from
+// CompressionFastest to CompressionBest, trading CPU for bandwidth: a
+// CPU-bound relay might prefer CompressionFastest, a peer on a slow link
+// CompressionBest. Levels outside that range are clamped. The receiver
+// decompresses any level, so the two ends need not agree.
+func (p *Peer) SetCompressionLevel(level int) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_set_compression_level(p.ptr, C.int(level))
+}
+
+// CompressionLevel returns the zlib level SendAllCompressed uses.
+func (p *Peer) CompressionLevel() int {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return int(C.relay_get_compression_level(p.ptr))
+}
+
+// SetCompressionThreshold makes the peer compress each message of at least
+// bytes it sends, with the level and dictionary SendAllCompressed uses, if
+// that makes the message smaller; JSON and other text typically shrink
+// several times over. Receivers inflate compressed messages whatever their
+// own settings, so only the sender needs to enable it, but a dictionary
+// must be set on both ends as for SendAllCompressed. It covers Send,
+// SendBytes, the tracked and unreliable sends and Client sends; messages
+// over about 16 MiB, which are sent in fragments, are not compressed.
+//
+// zlib is the only algorithm built in. The handshake of a connection with
+// WithTLS, WithNoiseKey, WithIdentity, WithAuthToken or WithWebSocket
+// announces whether each end inflates it, and messages are only compressed
+// toward a remote end that did. Other connections have no handshake to
+// negotiate in, so messages on them are compressed whatever the remote end
+// runs; every version of the library inflates compressed messages. A bytes
+// of 0, the default, turns compression off.
+func (p *Peer) SetCompressionThreshold(bytes int) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_set_compression_threshold(p.ptr, C.uint64_t(max(bytes, 0)))
+}
+
+// CompressionStats reports how much SetCompressionThreshold has saved.
+type CompressionStats struct {
+	Messages        uint64 // Messages sent compressed
+	OriginalBytes   uint64 // Their total size before compression
+	CompressedBytes uint64 // Their total size as sent
+}
+
+// Ratio returns CompressedBytes as a fraction of OriginalBytes, or 1 if no
+// message has been compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.OriginalBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.OriginalBytes)
+}
+
+// CompressionStats returns how many messages the peer has sent compressed
+// and how much smaller they were. Messages that would not have shrunk are
+// sent as they are and not counted.
+func (p *Peer) CompressionStats() CompressionStats {
+	if !p.enter() {
+		return CompressionStats{}
+	}
+	defer p.leave()
+	var messages, in, out C.uint64_t
+	C.relay_get_compression_stats(p.ptr, &messages, &in, &out)
+	return CompressionStats{Messages: uint64(messages), OriginalBytes: uint64(in), CompressedBytes: uint64(out)}
+}
+
+func (p *Peer) sendBatch(messages []string, compress bool) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	for _, m := range messages {
+		if err := p.checkSize(len(m)); err != nil {
+			return err
+		}
+	}
+	cMsgs := make([]*C.char, len(messages))
+	size := 0
+	for i, m := range messages {
+		cMsgs[i] = C.CString(m)
+		size += len(m)
+	}
+	p.throttle(rateSend, len(messages), size)
+	defer func() {
+		for _, c := range cMsgs {
+			C.free(unsafe.Pointer(c))
+		}
+	}()
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	cCompress := C.int(0)
+	if compress {
+		cCompress = 1
+	}
+	start := cgoStart()
+	status := C.relay_send_batch(p.ptr, &cMsgs[0], C.int(len(messages)), cCompress)
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// SetCircuitBreaker makes sends to the peer fail fast with ErrCircuitOpen for
+// cooldown after failures consecutive send failures. Once the cooldown has
+// passed one trial send is let through: success closes the circuit again and
+// failure re-opens it. Broadcasts skip the peer while its circuit is open.
+// A failures count of 0 disables the breaker.
+func (p *Peer) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_set_circuit_breaker(p.ptr, C.int(failures), C.int64_t(cooldown.Milliseconds()))
+}
+
+// SetCork corks or uncorks the peer connection (TCP_CORK on Linux,
+// TCP_NOPUSH on BSD). While corked the kernel holds back partial segments so
+// that many small writes go out as a few full ones; uncorking sends whatever
+// is pending straight away. Cork around a burst of sends and uncork at the
+// end of it, since a corked connection may delay its last partial segment
+// for up to 200ms.
+//
+// Cork and SetNoDelay pull in opposite directions: no-delay sends each write
+// as soon as possible, cork holds writes back. While both are set cork wins
+// on Linux, and uncorking flushes immediately regardless of no-delay, so a
+// latency-sensitive peer can keep no-delay on and cork only for bulk sends.
+// For a server peer every accepted client connection is corked, but clients
+// accepted later are not. Failures are logged by the C library.
+func (p *Peer) SetCork(enabled bool) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	cEnabled := C.int(0)
+	if enabled {
+		cEnabled = 1
+	}
+	C.relay_set_peer_cork(p.ptr, cEnabled)
+}
+
+// PathMTU returns the path MTU of the peer connection in bytes, read from
+// IP_MTU or, failing that, derived from the TCP maximum segment size. A
+// message fits in one segment if its frame (the message plus an 8-byte
+// header) is no larger than the MTU minus 40 bytes of IPv4 and TCP headers.
+// A server peer reports the smallest MTU among its clients. It returns
+// ErrPathMTUUnavailable if the peer is not connected or the MTU cannot be
+// read.
+func (p *Peer) PathMTU() (int, error) {
+	if !p.enter() {
+		return 0, ErrPathMTUUnavailable
+	}
+	defer p.leave()
+	mtu := int(C.relay_get_peer_path_mtu(p.ptr))
+	if mtu <= 0 {
+		return 0, ErrPathMTUUnavailable
+	}
+	return mtu, nil
+}
+
+// SetReplayProtection guards the peer against replayed frames. While it is
+// enabled every frame sent is stamped with the send time and a nonce that
+// only increases, and a received frame is dropped if its timestamp is more
+// than window away from the local clock, if its nonce is not higher than the
+// last one seen on the same connection, or if it carries no stamp at all.
+// Dropped frames are counted by ReplaysRejected. Both ends of a connection
+// must enable it, with clocks synchronised to well within window. A window
+// of 0 disables it.
+func (p *Peer) SetReplayProtection(window time.Duration) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_set_replay_protection(p.ptr, C.int64_t(window.Milliseconds()))
+}
+
+// SetFrameResync selects what happens when the incoming stream loses track
+// of frame boundaries, for example after corruption or a misbehaving peer.
+// By default the connection is closed and Receive returns ErrFrameDesync;
+// when enabled the bytes up to the next frame marker are skipped instead,
+// losing the messages in between. Either way FrameDesyncs counts it.
+func (p *Peer) SetFrameResync(enabled bool) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	cEnabled := C.int(0)
+	if enabled {
+		cEnabled = 1
+	}
+	C.relay_set_frame_resync(p.ptr, cEnabled)
+}
+
+// SetReadIdleTimeout makes Receive and ReceiveMessage fail with ErrReadIdle
+// once nothing has arrived from the remote end for d, so the application can
+// probe the peer or switch to another while keeping the connection open for
+// sending. Any frame received restarts the timer, including receipts, stream
+// frames and messages consumed by others, so a silent peer is one that sent
+// nothing at all. The timer also restarts when the timeout is set and when
+// the peer connects or accepts a client. A d of 0 disables it.
+func (p *Peer) SetReadIdleTimeout(d time.Duration) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_set_read_idle_timeout(p.ptr, C.int64_t(d.Milliseconds()))
+}
+
+// DefaultMaxMessageSize is the largest message a peer reassembles unless
+// SetMaxMessageSize says otherwise.
+const DefaultMaxMessageSize = 64 << 20
+
+// SetMaxMessageSize sets the largest message the peer sends or accepts
+// from the remote end. Messages too large for one frame, over about 16 MiB,
+// are sent as a series of fragments and reassembled by the receiving peer,
+// so Send, SendBytes and Client.Send take messages of any size up to the
+// limit; urgent and batched messages are not fragmented. Sending a larger
+// message fails with ErrMessageTooLarge before anything is written, and a
+// larger message received is dropped, as its first fragment or its frame
+// arrives, without disturbing the connection: that receive fails with
+// ErrReceiveFailed and OnError reports it. Frames over 16 MiB are never
+// read at all. A bytes of 0 restores DefaultMaxMessageSize for receiving
+// and lifts the limit for sending.
+func (p *Peer) SetMaxMessageSize(bytes int) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	p.maxSize.Store(int64(max(bytes, 0)))
+	C.relay_set_max_message_size(p.ptr, C.uint64_t(max(bytes, 0)))
+}
+
+// checkSize returns ErrMessageTooLarge if a message of n bytes is over the
+// peer's limit for sending.
+func (p *Peer) checkSize(n int) error {
+	if limit := p.maxSize.Load(); limit > 0 && int64(n) > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, n, limit)
+	}
+	return nil
+}
+
+// FrameDesyncs returns the number of times the peer's connections lost
+// track of frame boundaries. A steadily rising count points to a
+// misbehaving peer.
+func (p *Peer) FrameDesyncs() uint64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return uint64(C.relay_get_frame_desyncs(p.ptr))
+}
+
+// BufferSizes returns the send and receive buffer sizes (SO_SNDBUF and
+// SO_RCVBUF) the kernel actually applied to the peer connection. They are
+// often not the sizes requested with WithSendBufferSize,
+// WithReceiveBufferSize or GrowReceiveBuffer: Linux reports twice the size
+// set, to account for bookkeeping overhead, and caps it at
+// net.core.wmem_max and net.core.rmem_max. A server peer reports the
+// smallest sizes among its clients. It returns ErrPeerDisconnected if the
+// peer is not connected and ErrBufferSizesUnavailable if the sizes cannot
+// be read, for example on a server peer with no clients.
+func (p *Peer) BufferSizes() (sendBytes, recvBytes int, err error) {
+	if !p.enter() {
+		return 0, 0, ErrPeerDisconnected
+	}
+	defer p.leave()
+	var cSend, cRecv C.int
+	if err := statusError(C.relay_get_peer_buffer_sizes(p.ptr, &cSend, &cRecv), ErrBufferSizesUnavailable); err != nil {
+		return 0, 0, err
+	}
+	return int(cSend), int(cRecv), nil
+}
+
+// ReplaysRejected returns the number of received frames dropped by replay
+// protection.
+func (p *Peer) ReplaysRejected() uint64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return uint64(C.relay_get_replays_rejected(p.ptr))
+}
+
+// SendConflated queues a message to be sent to the peer in the background.
+// If a message with the same key is still waiting to be sent it is replaced
+// rather than appended, so a slow peer only ever receives the latest value
+// for each key. For a peer in a PeerManager with a global buffer limit it may
+// block, or discard messages, while the limit is reached; see
+// PeerManager.SetGlobalBufferLimit. The background writer is the peer's own
+// goroutine unless its manager uses IOModePooled; see PeerManager.SetIOMode.
+func (p *Peer) SendConflated(key, message string) {
+	p.out.push("", key, message, p.sendQueued)
+}
+
+// SetSendQueueTimeout bounds how long a message queued by SendConflated may
+// wait to be written. A message still queued after d is dropped instead of
+// sent, counted by SendQueueExpired and, if the peer belongs to a
+// PeerManager, passed to its dead-letter handler with ErrSendQueueTimeout.
+// A d of 0 means queued messages never expire. Queued envelopes past their
+// own expiry time (see SendWithTTL) are dropped whatever the timeout, and
+// dead-lettered with ErrMessageExpired.
+func (p *Peer) SetSendQueueTimeout(d time.Duration) {
+	p.out.setTimeout(d, func(message string) {
+		if m := p.mgr.Load(); m != nil {
+			m.deadLetterMessage(p.id, message, ErrSendQueueTimeout)
+		}
+	})
+}
+
+// SendQueueExpired returns the number of queued messages dropped because
+// they waited longer than the send queue timeout, or were envelopes whose
+// expiry time passed while queued.
+func (p *Peer) SendQueueExpired() uint64 {
+	return p.out.expiredCount()
+}
+
+// ReceiveMessage receives a message from the peer. It returns "" if none
+// could be received; use Receive to find out why.
 func (p *Peer) ReceiveMessage() string {
-	cStr := C.relay_receive_message(p.ptr)
-	if cStr == nil {
-		return ""
+	message, _ := p.Receive()
+	return message
+}
+
+// Receive receives a message from the peer like ReceiveMessage, but reports
+// why none was received: ErrPeerDisconnected once the connection is closed,
+// ErrFrameDesync when corrupt framing closed it, ErrReadIdle when the read
+// idle timeout expired (see SetReadIdleTimeout), and ErrReceiveFailed
+// otherwise, for example on a read timeout.
+//
+// Urgent messages (see SendUrgent) are returned ahead of messages already
+// received, or passed to the OnUrgentMessage handler if one is set.
+func (p *Peer) Receive() (string, error) {
+	data, err := p.ReceiveBytes()
+	return string(data), err
+}
+
+// ReceiveBytes receives a message like Receive, but returns it as bytes
+// with its full length, so a binary message sent with SendBytes is not cut
+// short at its first NUL byte. Errors and urgent messages are handled as
+// for Receive.
+func (p *Peer) ReceiveBytes() ([]byte, error) {
+	return p.receive(context.Background())
+}
+
+// TryReceive returns the next message if one can be received without
+// waiting, and false otherwise, for example to poll many peers from one
+// loop. It never blocks on the network; errors are not reported, so use
+// Receive to find out why a peer has nothing to return. Urgent messages are
+// handled as for Receive.
+func (p *Peer) TryReceive() (string, bool) {
+	data, status := p.receiveWithin(0)
+	return string(data), status == C.RELAY_OK
+}
+
+// ReceiveWithTimeout receives a message like Receive, but waits at most d
+// and then returns ErrTimeout. Other errors are reported as for Receive.
+func (p *Peer) ReceiveWithTimeout(d time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	data, err := p.receive(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "", ErrTimeout
+	}
+	return string(data), err
+}
+
+// receive receives a message, giving up with ctx's error once ctx is done.
+// It blocks in the C library for as long as it takes if ctx can never be
+// done, and otherwise for at most receivePollInterval at a time.
+func (p *Peer) receive(ctx context.Context) ([]byte, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		wait := C.int64_t(-1)
+		if ctx.Done() != nil {
+			wait = C.int64_t(pollWait(ctx, receivePollInterval).Milliseconds())
+		}
+		message, status := p.receiveWithin(wait)
+		if status == C.RELAY_ERR_TIMEOUT && wait >= 0 {
+			continue
+		}
+		if status != C.RELAY_OK {
+			return nil, statusError(status, ErrReceiveFailed)
+		}
+		return message, nil
+	}
+}
+
+// receiveWithin receives a message, waiting at most wait milliseconds for
+// each one, or blocking if wait is negative. Urgent messages passed to the
+// OnUrgentMessage handler are not returned. It returns the C library's
+// status.
+func (p *Peer) receiveWithin(wait C.int64_t) ([]byte, C.int) {
+	message, _, status := p.receiveFrom(wait)
+	return message, status
+}
+
+// receiveFrom receives a message like receiveWithin, also returning the ID
+// of the accepted client that sent it, 0 for a client peer.
+func (p *Peer) receiveFrom(wait C.int64_t) ([]byte, uint64, C.int) {
+	if message, client, ok := p.peeked.take(); ok {
+		return message, client, C.RELAY_OK
+	}
+	return p.receiveNext(wait)
+}
+
+// receiveNext receives a message like receiveFrom, ignoring any message
+// returned by Peek.
+func (p *Peer) receiveNext(wait C.int64_t) ([]byte, uint64, C.int) {
+	deadline := time.Now().Add(time.Duration(wait) * time.Millisecond)
+	for {
+		p.reorder.expire()
+		if message, client, ok := p.reorder.pop(); ok {
+			return message, client, C.RELAY_OK
+		}
+		limited := p.reorder.limitWait(wait)
+		var data *C.char
+		var n C.size_t
+		var urgent C.int
+		var client C.uint64_t
+		if !p.enter() {
+			return nil, 0, C.RELAY_ERR_DISCONNECTED
+		}
+		start := cgoStart()
+		status := C.relay_receive_bytes_from(p.ptr, limited, &data, &n, &urgent, &client)
+		cgoReceive.done(start)
+		p.leave()
+		if status == C.RELAY_ERR_TIMEOUT && limited != wait {
+			// Woken to release messages held for reordering.
+			if wait > 0 {
+				wait = C.int64_t(max(time.Until(deadline).Milliseconds(), 0))
+			}
+			continue
+		}
+		if status != C.RELAY_OK {
+			return nil, 0, status
+		}
+		message := C.GoBytes(unsafe.Pointer(data), C.int(n))
+		C.free(unsafe.Pointer(data))
+		if urgent == 0 {
+			p.throttle(rateReceive, 1, len(message))
+		}
+		message, ok := p.openReceived(message)
+		if !ok || p.dropStale(message) || p.dedup.duplicate(message) {
+			continue
+		}
+		if fn := p.onUrgent.Load(); urgent != 0 && fn != nil {
+			(*fn)(string(message))
+			continue
+		}
+		if p.reorder.push(message, uint64(client)) {
+			continue
+		}
+		return message, uint64(client), status
 	}
-	defer C.free(unsafe.Pointer(cStr))
-	return C.GoString(cStr)
 }
 
-// Close closes the peer connection
+// SendUrgent sends a message that bypasses the queue of messages waiting in
+// SendConflated and, on the receiving end, jumps ahead of the messages that
+// peer has received but not yet consumed, for example to cancel an ongoing
+// transfer. It is written right after the message being written, if any,
+// and errors are reported as for Send. The remote peer must be running
+// this version of the library.
+func (p *Peer) SendUrgent(message string) error {
+	if err := p.checkSize(len(message)); err != nil {
+		return err
+	}
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	cMsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cMsg))
+	start := cgoStart()
+	status := C.relay_send_urgent(p.ptr, cMsg)
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// OnUrgentMessage sets a function called with each urgent message received
+// instead of returning it from Receive or ReceiveMessage. It runs on the
+// goroutine calling Receive, before that call returns the next ordinary
+// message. A nil fn makes Receive return urgent messages again.
+func (p *Peer) OnUrgentMessage(fn func(message string)) {
+	if fn == nil {
+		p.onUrgent.Store(nil)
+		return
+	}
+	p.onUrgent.Store(&fn)
+}
+
+// Peek returns a copy of the next message without consuming it, so the next
+// ReceiveMessage, or any other receive, still returns it. The message has
+// been through the same steps as one received: it is decrypted, reordered,
+// and dropped if expired or a duplicate, and an urgent message handled by
+// OnUrgentMessage is never peeked. If no message has been peeked already
+// Peek receives one, waiting as long as ReceiveMessage would, and reports
+// false if none arrives.
+// Other receives are not held up while Peek waits; whichever call receives
+// the next message returns it.
+func (p *Peer) Peek() ([]byte, bool) {
+	p.peeked.receiving.Lock()
+	defer p.peeked.receiving.Unlock()
+	p.peeked.mu.Lock()
+	message, ok := bytes.Clone(p.peeked.message), p.peeked.ok
+	p.peeked.mu.Unlock()
+	if ok {
+		return message, true
+	}
+	message, client, status := p.receiveNext(-1)
+	if status != C.RELAY_OK {
+		return nil, false
+	}
+	p.peeked.mu.Lock()
+	p.peeked.message, p.peeked.client, p.peeked.ok = message, client, true
+	p.peeked.mu.Unlock()
+	return bytes.Clone(message), true
+}
+
+// peekBuffer holds the message returned by Peek until it is received.
+type peekBuffer struct {
+	receiving sync.Mutex // Held by Peek, so only one Peek receives at a time
+	mu        sync.Mutex // Guards the fields below
+	message   []byte
+	client    uint64
+	ok        bool
+}
+
+// take removes and returns the peeked message, if any.
+func (b *peekBuffer) take() ([]byte, uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ok {
+		return nil, 0, false
+	}
+	b.ok = false
+	message := b.message
+	b.message = nil
+	return message, b.client, true
+}
+
+// Close closes the peer connection. Messages still queued by SendConflated
+// are discarded, those queued by SendAsync are reported as Dropped, and
+// messages sent with SendTracked or SendAsync that have no receipt yet are
+// reported as Failed. Open streams report ErrPeerDisconnected, and the
+// Conns of Listener read io.EOF. Closing a closed or destroyed peer does
+// nothing.
 func (p *Peer) Close() {
-	C.relay_close_peer(p.ptr)
+	p.OnMessage(nil)
+	events.watch(p, false)
+	p.ager.close()
+	p.acks.close()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.enter() {
+		C.relay_close_peer(p.ptr)
+		p.leave()
+	}
+	p.out.close()
+	p.async.close()
+	p.retries.close()
+	p.receipts.close()
+	p.mux.close()
+	p.conns.close()
+	p.in.close()
+}
+
+// DefaultCloseTimeout is how long SendAndClose waits for the remote end to
+// close its side of the connection.
+const DefaultCloseTimeout = 5 * time.Second
+
+// Pending returns the number of messages queued by SendConflated that have
+// not been sent yet, including one being sent.
+func (p *Peer) Pending() int {
+	return p.out.pending()
+}
+
+// Flush waits until every message queued by SendConflated has been sent.
+func (p *Peer) Flush() {
+	p.out.flush()
+}
+
+// CloseGracefully closes the peer connection without losing messages that
+// were already sent. It flushes messages queued by SendConflated, shuts down
+// the sending side so the remote end reads everything followed by
+// end-of-file, and waits up to timeout for the remote end to close before
+// closing the socket. Anything received in the meantime is discarded. If the
+// remote end does not close in time the connection is closed anyway and
+// ErrTimeout is returned.
+func (p *Peer) CloseGracefully(timeout time.Duration) error {
+	p.ager.close()
+	p.mux.close()
+	p.conns.close()
+	p.out.flush()
+	p.out.close()
+	p.async.flush()
+	p.async.close()
+	p.retries.close()
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	return statusError(C.relay_close_peer_gracefully(p.ptr, C.int64_t(timeout.Milliseconds())), ErrTimeout)
+}
+
+// SendAndClose sends a single message and then closes the peer gracefully,
+// waiting up to DefaultCloseTimeout for the remote end to close. If the send
+// fails the connection is still closed and the send error is returned.
+func (p *Peer) SendAndClose(message string) error {
+	if err := p.Send(message); err != nil {
+		p.Close()
+		return err
+	}
+	return p.CloseGracefully(DefaultCloseTimeout)
 }
 
-// Destroy frees the peer resources
+// CloseWrite shuts down the sending side of the peer connection, so the
+// remote end reads end-of-file while this peer can still receive.
+func (p *Peer) CloseWrite() {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_shutdown_peer_write(p.ptr)
+}
+
+// Destroy frees the peer resources, closing the connection and removing
+// the peer from its PeerManager. Calls in progress on other goroutines are
+// ended as by Close, and the resources are only freed once they return.
+// Calling Destroy again does nothing, and other methods then fail or return
+// zero values instead of touching freed memory.
+// Call Destroy once done with a peer. The garbage collector destroys a peer
+// that became unreachable only if nothing refers to it, including the peer
+// itself: never one in a PeerManager, which refers back to it, nor one that
+// has queued messages with SendConflated, opened a stream, or set an
+// OnMessage or connection event handler. Such a peer stays open until
+// Destroy is called.
 func (p *Peer) Destroy() {
+	if !p.destroyed.CompareAndSwap(false, true) {
+		return
+	}
+	runtime.SetFinalizer(p, nil)
+	if m := p.mgr.Load(); m != nil {
+		m.RemovePeer(p.id)
+	}
+	// Closing wakes the calls blocked on the connection, among them a send
+	// by the queue writers closed below, so that the ones still using the
+	// handle return before it is freed.
+	C.relay_close_peer(p.ptr)
+	p.out.close()
+	p.async.close()
+	p.retries.close()
+	p.receipts.close()
+	p.ager.close()
+	p.acks.close()
+	p.mux.close()
+	p.conns.close()
+	p.in.close()
+	p.OnMessage(nil)
+	events.watch(p, false)
+	p.stopFilteringClients()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.retire()
 	C.relay_destroy_peer(p.ptr)
+	p.ptr = nil
+	if p.tls != nil {
+		p.tls.handle.Delete()
+	}
+}
+
+// AcceptClients allows the server to send brodcast to multiple clients. It
+// blocks until maxClient clients have connected and returns how many it
+// accepted. Closing the peer or calling StopAccepting from another goroutine
+// interrupts it, even mid-accept, and it then returns the partial count with
+// ErrListenerClosed. Clients accepted before that stay connected.
+func (p *Peer) AcceptClients(maxClient int) (int, error) {
+	if !p.enter() {
+		return 0, ErrListenerClosed
+	}
+	defer p.leave()
+	var accepted C.int
+	status := C.relay_accept_clients(p.ptr, C.int(maxClient), &accepted)
+	return int(accepted), statusError(status, ErrListenerClosed)
 }
 
-// AcceptClients allows the server to send brodcast to multiple clients
-func (p *Peer) AcceptClients(maxClient int) {
-	C.relay_accept_clients(p.ptr, C.int(maxClient))
+// StopAccepting stops a server peer from accepting clients, for example on
+// SIGTERM. Blocked AcceptClients and WaitForClients calls return
+// ErrListenerClosed right away, and so do later ones. Unlike Close, clients
+// already accepted stay connected and can still be sent to. Reconnect starts
+// a new listener.
+func (p *Peer) StopAccepting() {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	C.relay_stop_accepting(p.ptr)
+}
+
+// acceptPollInterval bounds how long WaitForClients waits for a connection
+// before checking its context again.
+const acceptPollInterval = 100 * time.Millisecond
+
+// AcceptedCount returns the number of accepted clients whose connection is
+// still open.
+func (p *Peer) AcceptedCount() int {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return int(C.relay_get_client_count(p.ptr))
+}
+
+// WaitForClients accepts clients until at least n are connected, returning
+// ctx.Err() if ctx is done first. Clients accepted before ctx is done stay
+// connected. Unlike AcceptClients it can be cancelled, and progress can be
+// watched with AcceptedCount. If the peer is closed or StopAccepting is
+// called while it waits it returns ErrListenerClosed.
+func (p *Peer) WaitForClients(ctx context.Context, n int) error {
+	for p.AcceptedCount() < n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.enter() {
+			return ErrListenerClosed
+		}
+		wait := pollWait(ctx, acceptPollInterval)
+		status := C.relay_accept_client(p.ptr, C.int64_t(wait.Milliseconds()))
+		p.leave()
+		if status == C.RELAY_ERR_LISTENER_CLOSED {
+			return ErrListenerClosed
+		}
+	}
+	return nil
 }
 
 // NewPeerManager creates a new peer manager
 func NewPeerManager() *PeerManager {
-	return &PeerManager{ptr: C.relay_create_peer_manager()}
+	m := &PeerManager{
+		ptr:     C.relay_create_peer_manager(),
+		peers:   make(map[string]*Peer),
+		tags:    make(map[string]map[string]struct{}),
+		weights: make(map[string]int),
+		groups:  make(map[string]*groupBalancer),
+	}
+	runtime.SetFinalizer(m, (*PeerManager).Destroy)
+	return m
 }
 
-// AddPeer adds a peer to the manager
+// AddPeer adds a peer to the manager. A peer that is not Authenticated is
+// ignored if the manager requires authenticated peers, and so is one the
+// access control refuses; use Add to learn whether it was added.
 func (m *PeerManager) AddPeer(p *Peer) {
+	m.Add(p)
+}
+
+// addPeer adds p without checking it.
+func (m *PeerManager) addPeer(p *Peer) {
+	if !p.enter() {
+		return
+	}
+	defer p.leave()
+	p.cfgMu.Lock()
+	server := p.cfg.server
+	p.cfgMu.Unlock()
+	if server {
+		p.filterClients()
+	}
+	if !m.enter() {
+		return
+	}
 	C.relay_add_peer(m.ptr, p.ptr)
+	m.leave()
+	m.mu.Lock()
+	_, known := m.peers[p.id]
+	if !known {
+		m.peers[p.id] = p
+		p.mgr.Store(m)
+		p.out.setBudget(&m.buffers, func(message string) {
+			m.deadLetterMessage(p.id, message, ErrBufferFull)
+		})
+		p.out.setExpiry(func(message string) {
+			m.deadLetterMessage(p.id, message, ErrMessageExpired)
+		})
+		p.out.setPool(&m.io)
+	}
+	m.mu.Unlock()
+	if !known {
+		m.in.add(p)
+		p.watchEvents()
+	}
+}
+
+// RemovePeer removes the peer with the given ID from the manager, along with
+// its tags, weight and key. The peer itself is left open; it returns
+// ErrPeerNotFound if the manager has no such peer.
+func (m *PeerManager) RemovePeer(id string) error {
+	status := C.int(C.RELAY_ERR_NOT_FOUND)
+	if m.enter() {
+		cID := C.CString(id)
+		status = C.relay_remove_peer(m.ptr, cID)
+		C.free(unsafe.Pointer(cID))
+		m.leave()
+	}
+	m.mu.Lock()
+	p := m.peers[id]
+	delete(m.peers, id)
+	for tag, ids := range m.tags {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(m.tags, tag)
+			delete(m.groups, tag)
+		}
+	}
+	delete(m.weights, id)
+	delete(m.sealKeys, id)
+	m.mu.Unlock()
+	m.in.remove(id)
+	if p != nil {
+		p.mgr.CompareAndSwap(m, nil)
+		p.out.setBudget(nil, nil)
+		p.out.setExpiry(nil)
+		p.out.setPool(nil)
+		p.watchEvents()
+	}
+	return statusError(status, ErrPeerNotFound)
+}
+
+// GetPeer returns the managed peer with the given ID, or nil if there is
+// none. The same *Peer passed to AddPeer is returned.
+func (m *PeerManager) GetPeer(id string) *Peer {
+	return m.peer(id)
+}
+
+// peer returns the managed peer with the given ID, or nil if there is none.
+func (m *PeerManager) peer(id string) *Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.peers[id]
 }
 
 // RelayMessage relays a message between peers
 func (m *PeerManager) RelayMessage(sourceId, targetId, message string) bool {
+	return m.Relay(sourceId, targetId, message) == nil
+}
+
+// Relay relays a message between peers. It returns ErrPeerNotFound if either
+// peer is unknown, ErrRelayDenied if a relay rule forbids sourceId from
+// sending to targetId, and ErrCircuitOpen or ErrPeerDisconnected if the
+// target cannot take the message. Undelivered messages are passed to the
+// dead-letter handler, except those denied by a rule. If a relay transform
+// drops the message it returns ErrRelayDropped. In end-to-end mode it
+// returns ErrNotSealed for a message Seal did not make (see
+// RequireSealedRelays). It returns ErrAccessDenied if the access control
+// refuses the source or the target (see Allow and Deny), and
+// ErrMessageExpired for an envelope past its expiry time (see
+// Peer.SendWithTTL). After Quiesce it returns ErrQuiesced.
+//
+// The target receives a text message with "[Relayed] " in front of it. A
+// binary message, one starting with a NUL byte such as an envelope from
+// SendEnvelope or SendReliable, arrives unchanged so that it still decodes.
+func (m *PeerManager) Relay(sourceId, targetId, message string) error {
+	if !m.work.enter() {
+		return ErrQuiesced
+	}
+	defer m.work.exit()
+	target := m.peer(targetId)
+	if target != nil {
+		target.relaying.Add(1)
+		defer target.relaying.Add(-1)
+	}
+	if m.acl.deniedSource(sourceId) {
+		return ErrAccessDenied
+	}
+	if target != nil && !m.admitsPeer(AccessRelay, target, sourceId) {
+		return ErrAccessDenied
+	}
+	if strings.HasPrefix(message, envelopeMagic) && isExpired([]byte(message)) {
+		m.deadLetterMessage(targetId, message, ErrMessageExpired)
+		return ErrMessageExpired
+	}
+	m.mu.RLock()
+	transform := m.transform
+	m.mu.RUnlock()
+	if transform != nil {
+		var ok bool
+		if message, ok = transform(sourceId, targetId, message); !ok {
+			return ErrRelayDropped
+		}
+	}
+	if m.sealedOnly.Load() && !IsSealed(message) {
+		return ErrNotSealed
+	}
+	if target != nil {
+		target.throttle(rateSend, 1, len(message))
+	}
 	cSource := C.CString(sourceId)
 	cTarget := C.CString(targetId)
 	cMsg := C.CString(message)
 	defer C.free(unsafe.Pointer(cSource))
 	defer C.free(unsafe.Pointer(cTarget))
 	defer C.free(unsafe.Pointer(cMsg))
-	return C.relay_relay_message(m.ptr, cSource, cTarget, cMsg) != 0
+	status := C.int(C.RELAY_ERR_FAILED)
+	if m.enter() {
+		start := cgoStart()
+		status = C.relay_relay_bytes(m.ptr, cSource, cTarget, cMsg, C.size_t(len(message)))
+		cgoRelay.done(start)
+		m.leave()
+	}
+	err := statusError(status, ErrRelayFailed)
+	if err != nil && err != ErrRelayDenied && err != ErrUnauthenticated {
+		m.deadLetterMessage(targetId, message, err)
+	}
+	return err
 }
 
-// Broadcast sends a message to all available peers
+// Broadcast sends a message to all available peers. Peers that relay rules
+// added with an empty fromId deny are skipped. Peers the message could not be
+// delivered to are reported to the dead-letter handler.
 func (m *PeerManager) Broadcast(message string) bool {
+	return m.broadcast("", message)
+}
+
+// BroadcastFrom sends a message from sourceId to every other peer that the
+// relay rules allow it to reach. Peers the message could not be delivered to
+// are reported to the dead-letter handler. Nothing is sent if the access
+// control refuses sourceId (see Deny).
+func (m *PeerManager) BroadcastFrom(sourceId, message string) bool {
+	return m.broadcast(sourceId, message)
+}
+
+func (m *PeerManager) broadcast(sourceId, message string) bool {
+	if !m.work.enter() {
+		return false
+	}
+	defer m.work.exit()
+	if sourceId != "" && m.acl.deniedSource(sourceId) {
+		return false
+	}
+	m.mu.RLock()
+	size := len(message) * len(m.peers)
+	m.mu.RUnlock()
+	time.Sleep(m.bandwidth.take(rateSend, size, time.Now()))
+	cSource := C.CString(sourceId)
+	cMsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cSource))
+	defer C.free(unsafe.Pointer(cMsg))
+	var failures *C.RelayDeliveryFailure
+	var count C.int
+	if !m.enter() {
+		return false
+	}
+	ok := C.relay_broadcast_report_bytes(m.ptr, cSource, cMsg, C.size_t(len(message)), &failures, &count) != 0
+	m.leave()
+	if !ok {
+		return false
+	}
+	if count > 0 {
+		defer C.relay_free_delivery_failures(failures, count)
+		for _, f := range unsafe.Slice(failures, int(count)) {
+			m.deadLetterMessage(C.GoString(f.peerId), message, statusError(f.status, ErrSendFailed))
+		}
+	}
+	return true
+}
+
+// BroadcastParallel sends a message to all available peers like Broadcast,
+// but from up to concurrency goroutines at once, so one slow peer does not
+// hold up the rest; a concurrency below 1 is treated as 1. It returns the
+// result for every managed peer: nil if the message was sent,
+// ErrRelayDenied for peers that relay rules added with an empty fromId deny,
+// and otherwise the reason it was not delivered, which is also reported to
+// the dead-letter handler. It returns nil after Quiesce.
+func (m *PeerManager) BroadcastParallel(message string, concurrency int) map[string]error {
+	if !m.work.enter() {
+		return nil
+	}
+	defer m.work.exit()
+	m.mu.RLock()
+	n := len(m.peers)
+	ids := make(chan string, n)
+	for id := range m.peers {
+		ids <- id
+	}
+	m.mu.RUnlock()
+	close(ids)
+
 	cMsg := C.CString(message)
 	defer C.free(unsafe.Pointer(cMsg))
-	return C.relay_broadcast(m.ptr, cMsg) != 0
+	results := make(map[string]error, n)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range min(max(concurrency, 1), n) {
+		wg.Add(1)
+		spawn(func() {
+			defer wg.Done()
+			for id := range ids {
+				time.Sleep(m.bandwidth.take(rateSend, len(message), time.Now()))
+				status := C.int(C.RELAY_ERR_FAILED)
+				if m.enter() {
+					cId := C.CString(id)
+					start := cgoStart()
+					status = C.relay_broadcast_to_bytes(m.ptr, cId, cMsg, C.size_t(len(message)))
+					cgoRelay.done(start)
+					C.free(unsafe.Pointer(cId))
+					m.leave()
+				}
+				err := statusError(status, ErrSendFailed)
+				if err != nil && err != ErrRelayDenied {
+					m.deadLetterMessage(id, message, err)
+				}
+				mu.Lock()
+				results[id] = err
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// SetRelayTransform registers fn to rewrite every message passed to Relay,
+// and so to RelayToGroup and relay streams, on its way from sourceID to
+// targetID: the returned string is forwarded in place of the message, and
+// returning false drops it, making Relay return ErrRelayDropped. fn runs
+// before the peers and relay rules are checked, so a dead letter carries the
+// transformed message. Broadcasts are sent unchanged. A nil fn relays
+// messages verbatim again.
+func (m *PeerManager) SetRelayTransform(fn func(sourceID, targetID, message string) (string, bool)) {
+	m.mu.Lock()
+	m.transform = fn
+	m.mu.Unlock()
+}
+
+// SetDeadLetterHandler registers fn to be called with every message the
+// manager fails to deliver: by Relay, RelayToGroup, Broadcast, BroadcastFrom
+// and BroadcastParallel, once per target. reason is the error explaining the
+// failure, such as ErrPeerNotFound, ErrPeerDisconnected or ErrCircuitOpen;
+// when RelayToGroup finds no eligible peer, targetID is empty and reason is
+// ErrNoGroupPeers. Messages withheld by relay rules are policy rather than
+// failures and are not reported. fn runs on the goroutine that attempted the
+// delivery, after the attempt, and may use the manager. A nil fn removes the
+// handler.
+func (m *PeerManager) SetDeadLetterHandler(fn func(targetID, message string, reason error)) {
+	m.mu.Lock()
+	m.deadLetter = fn
+	m.mu.Unlock()
+}
+
+// deadLetterMessage passes an undelivered message to the dead-letter
+// handler, if one is set and the manager has not been quiesced.
+func (m *PeerManager) deadLetterMessage(targetID, message string, reason error) {
+	if !m.work.enter() {
+		return
+	}
+	defer m.work.exit()
+	m.mu.RLock()
+	fn := m.deadLetter
+	m.mu.RUnlock()
+	if fn != nil {
+		fn(targetID, message, reason)
+	}
+}
+
+// AddRelayRule allows or denies relaying messages from fromId to toId.
+// Rules are directional, either ID may be "*" to match any peer, and an empty
+// fromId matches messages the manager itself sends with Broadcast. Directions
+// without a rule are allowed.
+func (m *PeerManager) AddRelayRule(fromId, toId string, allowed bool) {
+	cFrom := C.CString(fromId)
+	cTo := C.CString(toId)
+	defer C.free(unsafe.Pointer(cFrom))
+	defer C.free(unsafe.Pointer(cTo))
+	var cAllowed C.int
+	if allowed {
+		cAllowed = 1
+	}
+	if !m.enter() {
+		return
+	}
+	defer m.leave()
+	C.relay_add_relay_rule(m.ptr, cFrom, cTo, cAllowed)
+}
+
+// relayAllowed reports whether the relay rules allow fromId to reach toId.
+func (m *PeerManager) relayAllowed(fromId, toId string) bool {
+	cFrom := C.CString(fromId)
+	cTo := C.CString(toId)
+	defer C.free(unsafe.Pointer(cFrom))
+	defer C.free(unsafe.Pointer(cTo))
+	if !m.enter() {
+		return false
+	}
+	defer m.leave()
+	return C.relay_is_relay_allowed(m.ptr, cFrom, cTo) != 0
 }
 
-// Destroy frees the peer manager
+// Destroy frees the peer manager. The managed peers are left open and no
+// longer refer to it. Relays and broadcasts in progress on other goroutines
+// finish first, and later calls fail or return zero values instead of
+// touching freed memory. Calling it again does nothing, and like Peer.Destroy
+// it runs from the garbage collector if the manager is never destroyed, but
+// only once it manages no peers; see Peer.Destroy.
 func (m *PeerManager) Destroy() {
+	if !m.destroyed.CompareAndSwap(false, true) {
+		return
+	}
+	runtime.SetFinalizer(m, nil)
+	m.mu.Lock()
+	for _, p := range m.peers {
+		p.out.setPool(nil)
+		p.mgr.CompareAndSwap(m, nil)
+	}
+	m.mu.Unlock()
+	m.io.close()
+	m.in.close()
+	m.guard.retire()
 	C.relay_destroy_peer_manager(m.ptr)
+	m.ptr = nil
 }
 
-func (p *Peer) GetLatency() int64     { return int64(C.relay_get_peer_latency(p.ptr)) }
-func (p *Peer) MessagesSent() int     { return int(C.relay_get_peer_messages_sent(p.ptr)) }
-func (p *Peer) MessagesReceived() int { return int(C.relay_get_peer_messages_received(p.ptr)) }
-func (p *Peer) BytesSent() uint64     { return uint64(C.relay_get_peer_bytes_sent(p.ptr)) }
-func (p *Peer) BytesReceived() uint64 { return uint64(C.relay_get_peer_bytes_received(p.ptr)) }
-func (p *Peer) IsConnected() bool     { return C.relay_is_peer_connected(p.ptr) != 0 }
-func GetRecentErrors() []string       { /* Implement fetching errors */ }
+// GetLatency returns the time in milliseconds between the last message the
+// peer sent and the next one it received, 0 until both have happened.
+func (p *Peer) GetLatency() int64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return int64(C.relay_get_peer_latency(p.ptr))
+}
 
-// NewPeerDiscovery creates a new peer discovery instance
+// MessagesSent returns how many messages the peer has sent.
+func (p *Peer) MessagesSent() int {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return int(C.relay_get_peer_messages_sent(p.ptr))
+}
+
+// MessagesReceived returns how many messages the peer has received.
+func (p *Peer) MessagesReceived() int {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return int(C.relay_get_peer_messages_received(p.ptr))
+}
+
+// BytesSent returns how many bytes the peer has written, framing included.
+func (p *Peer) BytesSent() uint64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return uint64(C.relay_get_peer_bytes_sent(p.ptr))
+}
+
+// BytesReceived returns the size of the messages the peer has received.
+func (p *Peer) BytesReceived() uint64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return uint64(C.relay_get_peer_bytes_received(p.ptr))
+}
+
+func (p *Peer) IsConnected() bool {
+	if !p.enter() {
+		return false
+	}
+	defer p.leave()
+	return C.relay_is_peer_connected(p.ptr) != 0
+}
+
+// GetRecentErrors returns the last few errors the library logged across all
+// peers, oldest first, each prefixed with the time it was logged. It is a
+// diagnostic aid; use OnError for errors of a particular peer.
+func GetRecentErrors() []string {
+	var count C.int
+	list := C.relay_get_recent_errors(&count)
+	if list == nil {
+		return nil
+	}
+	defer C.relay_free_recent_errors(list, count)
+	errs := make([]string, 0, int(count))
+	for _, e := range unsafe.Slice(list, int(count)) {
+		errs = append(errs, C.GoString(e))
+	}
+	return errs
+}
+
+// NewPeerDiscovery creates a new peer discovery instance. It returns nil if
+// discovery cannot be set up; use OpenPeerDiscovery to find out why.
 func NewPeerDiscovery(multicastIp string, multicastPort int, localIp string) *PeerDiscovery {
+	d, _ := OpenPeerDiscovery(multicastIp, multicastPort, localIp)
+	return d
+}
+
+// OpenPeerDiscovery creates a new peer discovery instance. It returns
+// ErrMulticastUnavailable if no network interface that is up supports
+// multicast (loopback only counts when localIp names it) or the multicast
+// group cannot be joined, as is common in containers and cloud networks.
+func OpenPeerDiscovery(multicastIp string, multicastPort int, localIp string) (*PeerDiscovery, error) {
 	cMulticastIp := C.CString(multicastIp)
 	cLocalIp := C.CString(localIp)
 	defer C.free(unsafe.Pointer(cMulticastIp))
 	defer C.free(unsafe.Pointer(cLocalIp))
-	return &PeerDiscovery{ptr: C.relay_create_peer_discovery(cMulticastIp, C.int(multicastPort), cLocalIp)}
+	var status C.int
+	ptr := C.relay_open_peer_discovery(cMulticastIp, C.int(multicastPort), cLocalIp, &status)
+	if ptr == nil {
+		return nil, statusError(status, ErrDiscoveryFailed)
+	}
+	d := &PeerDiscovery{ptr: ptr}
+	runtime.SetFinalizer(d, (*PeerDiscovery).Destroy)
+	return d, nil
 }
 
 // Start starts peer discovery
@@ -146,10 +1699,157 @@ func (d *PeerDiscovery) GetDiscoveredPeers() []string {
 		peers[i] = C.GoString(cStr)
 		C.free(unsafe.Pointer(cStr))
 	}
+	if resolve := d.resolver(); resolve != nil {
+		for i, addr := range peers {
+			peers[i] = resolve(parsePeerInfo(addr)).Addr()
+		}
+	}
 	return peers
 }
 
-// Destroy frees the peer discovery resources
+// GetDiscoveredPeersPage returns at most limit discovered peers starting at
+// offset, in discovery order, along with the total number discovered so far.
+// Only the requested page is copied out of the C library, so polling a large
+// network does not materialize the whole list.
+func (d *PeerDiscovery) GetDiscoveredPeersPage(offset, limit int) ([]PeerInfo, int) {
+	var count, total C.int
+	cPeers := C.relay_get_discovered_peers_page(d.ptr, C.int(offset), C.int(limit), &count, &total)
+	if cPeers == nil || count == 0 {
+		return nil, int(total)
+	}
+	defer C.free(unsafe.Pointer(cPeers))
+
+	resolve := d.resolver()
+	peers := make([]PeerInfo, count)
+	for i, cStr := range unsafe.Slice(cPeers, int(count)) {
+		peers[i] = parsePeerInfo(C.GoString(cStr))
+		peers[i].Metadata = d.peerMetadata(cStr)
+		peers[i].Interface = d.peerInterface(cStr)
+		C.free(unsafe.Pointer(cStr))
+		if resolve != nil {
+			peers[i] = resolve(peers[i])
+		}
+	}
+	return peers, int(total)
+}
+
+// GetDiscoveredPeerInfos returns every discovered peer, in discovery order,
+// with the metadata each one announced in its latest response and the
+// interface that received it.
+func (d *PeerDiscovery) GetDiscoveredPeerInfos() []PeerInfo {
+	_, total := d.GetDiscoveredPeersPage(0, 1)
+	if total == 0 {
+		return nil
+	}
+	peers, _ := d.GetDiscoveredPeersPage(0, total)
+	return peers
+}
+
+// SetAnnouncementMetadata sets key-values, such as a version or role, that
+// this peer includes in its discovery responses. Other peers see them in
+// PeerInfo.Metadata. Keys may not be empty or contain '=' or a newline, values
+// may not contain a newline, and the encoded entries must fit in a single
+// datagram; otherwise ErrInvalidMetadata is returned and the current metadata
+// stays in place. A nil or empty meta stops announcing metadata.
+func (d *PeerDiscovery) SetAnnouncementMetadata(meta map[string]string) error {
+	if len(meta) == 0 {
+		return statusError(C.relay_set_announcement_metadata(d.ptr, nil, nil, 0), ErrInvalidMetadata)
+	}
+	cKeys := make([]*C.char, 0, len(meta))
+	cValues := make([]*C.char, 0, len(meta))
+	for k, v := range meta {
+		cKeys = append(cKeys, C.CString(k))
+		cValues = append(cValues, C.CString(v))
+	}
+	defer func() {
+		for i := range cKeys {
+			C.free(unsafe.Pointer(cKeys[i]))
+			C.free(unsafe.Pointer(cValues[i]))
+		}
+	}()
+	status := C.relay_set_announcement_metadata(d.ptr, &cKeys[0], &cValues[0], C.int(len(meta)))
+	return statusError(status, ErrInvalidMetadata)
+}
+
+// peerMetadata returns the metadata announced by the peer at the advertised
+// address addr, or nil if it announced none.
+func (d *PeerDiscovery) peerMetadata(addr *C.char) map[string]string {
+	cMeta := C.relay_get_discovered_peer_metadata(d.ptr, addr)
+	if cMeta == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(cMeta))
+	meta := make(map[string]string)
+	for _, line := range strings.Split(C.GoString(cMeta), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+// peerInterface returns the local interface that received the latest
+// response of the peer at the advertised address addr, or "" if unknown.
+func (d *PeerDiscovery) peerInterface(addr *C.char) string {
+	cName := C.relay_get_discovered_peer_interface(d.ptr, addr)
+	if cName == nil {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(cName))
+	return C.GoString(cName)
+}
+
+// SetAddressResolver sets a function that rewrites the address each
+// discovered peer advertised into the one to connect to from here, for
+// example translating a private or container IP behind NAT. Every peer
+// returned by GetDiscoveredPeers and GetDiscoveredPeersPage passes through
+// it. A nil fn restores the advertised addresses.
+func (d *PeerDiscovery) SetAddressResolver(fn func(advertised PeerInfo) PeerInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resolve = fn
+}
+
+// resolver returns the function set by SetAddressResolver, or nil.
+func (d *PeerDiscovery) resolver() func(PeerInfo) PeerInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.resolve
+}
+
+// Destroy frees the peer discovery resources. Calling it again does
+// nothing, and like Peer.Destroy it runs from the garbage collector if the
+// discovery is never destroyed.
 func (d *PeerDiscovery) Destroy() {
+	if !d.destroyed.CompareAndSwap(false, true) {
+		return
+	}
+	runtime.SetFinalizer(d, nil)
 	C.relay_destroy_peer_discovery(d.ptr)
+	d.ptr = nil
+}
+
+// cMemory tracks C memory that is released at once by free.
+type cMemory []unsafe.Pointer
+
+// malloc allocates n bytes.
+func (m *cMemory) malloc(n C.size_t) unsafe.Pointer {
+	ptr := C.malloc(n)
+	*m = append(*m, ptr)
+	return ptr
+}
+
+// bytes copies data to C memory.
+func (m *cMemory) bytes(data []byte) unsafe.Pointer {
+	ptr := C.CBytes(data)
+	*m = append(*m, ptr)
+	return ptr
+}
+
+// free releases everything allocated.
+func (m *cMemory) free() {
+	for _, ptr := range *m {
+		C.free(ptr)
+	}
+	*m = nil
 }
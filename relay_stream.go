@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"context"
+	"sync"
+)
+
+// RelayStream forwards every message received from a source peer to a target
+// peer until one of them goes away or the stream is closed.
+//
+// When the source disconnects the stream shuts down the write side of the
+// target connection, so the peer at the far end reads end-of-file just as it
+// would through a pipe. Chained streams (A to B, B to C) therefore carry the
+// teardown all the way down.
+type RelayStream struct {
+	m        *PeerManager
+	source   *Peer
+	target   *Peer
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// RelayStream starts forwarding messages received from sourceId to targetId.
+// The stream takes over receiving from the source peer; callers must not call
+// ReceiveMessage on it while the stream is running.
+//
+// It returns ErrPeerNotFound if either peer is unknown to the manager,
+// ErrRelayDenied if a relay rule forbids the direction, and ErrQuiesced after
+// Quiesce.
+func (m *PeerManager) RelayStream(sourceId, targetId string) (*RelayStream, error) {
+	source, target := m.peer(sourceId), m.peer(targetId)
+	if source == nil || target == nil {
+		return nil, ErrPeerNotFound
+	}
+	if !m.relayAllowed(sourceId, targetId) {
+		return nil, ErrRelayDenied
+	}
+	if !m.work.enter() {
+		return nil, ErrQuiesced
+	}
+	s := &RelayStream{
+		m:      m,
+		source: source,
+		target: target,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	spawn(s.run)
+	return s, nil
+}
+
+func (s *RelayStream) run() {
+	defer close(s.done)
+	defer s.m.work.exit()
+	// Cancel the receive once the stream is closed or the manager quiesced,
+	// so a silent source cannot keep the stream waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quiesced := s.m.work.stopped()
+	spawn(func() {
+		select {
+		case <-s.stop:
+		case <-quiesced:
+		case <-ctx.Done():
+		}
+		cancel()
+	})
+	for {
+		msg, err := s.source.receive(ctx)
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			select {
+			case <-s.stop:
+			default:
+				s.err = ErrQuiesced
+			}
+			return
+		case !s.source.IsConnected():
+			// Only the end of the upstream connection ends the stream, not
+			// a receive timeout.
+			s.err = ErrUpstreamClosed
+			s.target.CloseWrite()
+			return
+		default:
+			continue
+		}
+
+		if err := s.m.Relay(s.source.id, s.target.id, string(msg)); err != nil {
+			if !s.target.IsConnected() {
+				s.err = ErrDownstreamClosed
+				return
+			}
+			if err == ErrRelayDenied || err == ErrQuiesced {
+				s.err = err
+				return
+			}
+		}
+	}
+}
+
+// Done returns a channel that is closed once the stream has stopped.
+func (s *RelayStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err reports why the stream stopped: ErrUpstreamClosed, ErrDownstreamClosed,
+// ErrRelayDenied if a rule added after the stream started forbids it,
+// ErrQuiesced if the manager was quiesced, or nil if it was closed with
+// Close. It returns nil while the stream is running.
+func (s *RelayStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close stops forwarding and waits for the stream to finish, cancelling a
+// receive in progress on the source peer. A message already being relayed
+// is delivered first. Neither peer connection is closed.
+func (s *RelayStream) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRelayStreamPropagatesEOF(t *testing.T) {
+	_, a, connA := openPairIDs(t, "a-server", "a", nil, nil)
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+
+	s, err := m.RelayStream("a", "b")
+	if err != nil {
+		t.Fatalf("RelayStream: %v", err)
+	}
+	if err := connA.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, serverB); got != "[Relayed] hello" {
+		t.Fatalf("got %q, want %q", got, "[Relayed] hello")
+	}
+
+	connA.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop when its source disconnected")
+	}
+	if err := s.Err(); !errors.Is(err, ErrUpstreamClosed) {
+		t.Fatalf("Err = %v, want ErrUpstreamClosed", err)
+	}
+	if _, err := serverB.Receive(); err == nil {
+		t.Fatal("target's far end did not read end-of-file")
+	}
+}
+
+func TestRelayStreamDenied(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	_, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.AddRelayRule("a", "b", false)
+
+	if _, err := m.RelayStream("a", "b"); !errors.Is(err, ErrRelayDenied) {
+		t.Fatalf("RelayStream against a deny rule: %v, want ErrRelayDenied", err)
+	}
+	if _, err := m.RelayStream("a", "missing"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("RelayStream to an unknown peer: %v, want ErrPeerNotFound", err)
+	}
+}
+
+func TestRelayStreamStopsWhileSourceSilent(t *testing.T) {
+	for _, quiesce := range []bool{false, true} {
+		_, a := newPairIDs(t, "a-server", "a")
+		_, b := newPairIDs(t, "b-server", "b")
+		m := NewPeerManager()
+		t.Cleanup(m.Destroy)
+		m.AddPeer(a)
+		m.AddPeer(b)
+		s, err := m.RelayStream("a", "b")
+		if err != nil {
+			t.Fatalf("RelayStream: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond) // Let the stream start waiting.
+
+		stopped := make(chan struct{})
+		go func() {
+			if quiesce {
+				m.Quiesce(context.Background())
+			} else {
+				s.Close()
+			}
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("quiesce %v: stream kept waiting on a silent source", quiesce)
+		}
+		want := error(nil)
+		if quiesce {
+			want = ErrQuiesced
+		}
+		<-s.Done()
+		if err := s.Err(); err != want {
+			t.Fatalf("quiesce %v: Err = %v, want %v", quiesce, err, want)
+		}
+	}
+}
+
+func TestRelayStreamBinary(t *testing.T) {
+	_, a, connA := openPairIDs(t, "a-server", "a", nil, nil)
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	s, err := m.RelayStream("a", "b")
+	if err != nil {
+		t.Fatalf("RelayStream: %v", err)
+	}
+	defer s.Close()
+
+	for _, msg := range [][]byte{{0, 1, 2, 0, 3}, {}} {
+		if err := connA.SendBytes(msg); err != nil {
+			t.Fatalf("SendBytes: %v", err)
+		}
+		got, err := serverB.ReceiveBytes()
+		if err != nil {
+			t.Fatalf("ReceiveBytes: %v", err)
+		}
+		want := msg
+		if len(msg) == 0 {
+			want = []byte("[Relayed] ")
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
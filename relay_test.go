@@ -0,0 +1,992 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPair returns a server peer listening on a free loopback port and a
+// client peer connected to it, both destroyed when the test ends. opts are
+// applied to both.
+func newPair(t *testing.T, opts ...PeerOption) (server, client *Peer) {
+	t.Helper()
+	server, client, _ = openPair(t, opts, opts)
+	return server, client
+}
+
+// newPairIDs is newPair with the given peer IDs.
+func newPairIDs(t *testing.T, serverID, clientID string, opts ...PeerOption) (server, client *Peer) {
+	t.Helper()
+	server, client, _ = openPairIDs(t, serverID, clientID, opts, opts)
+	return server, client
+}
+
+// openPair is newPair with separate options for the server and the client.
+// It also returns the server's handle for the client's connection.
+func openPair(t *testing.T, serverOpts, clientOpts []PeerOption) (server, client *Peer, conn *Client) {
+	t.Helper()
+	return openPairIDs(t, "server", "client", serverOpts, clientOpts)
+}
+
+// openPairIDs is openPair with the given peer IDs, for tests that put
+// several pairs in one PeerManager.
+func openPairIDs(t *testing.T, serverID, clientID string, serverOpts, clientOpts []PeerOption) (server, client *Peer, conn *Client) {
+	t.Helper()
+	server, err := OpenPeer(serverID, "127.0.0.1", 0, 1, serverOpts...)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	var port int
+	switch addr := server.LocalAddr().(type) {
+	case *net.TCPAddr:
+		port = addr.Port
+	case *net.UDPAddr:
+		port = addr.Port
+	}
+	// Accept concurrently, since a secured client's handshake needs the server.
+	accepted := make(chan error, 1)
+	go func() {
+		var err error
+		conn, err = server.Accept()
+		accepted <- err
+	}()
+	client, err = OpenPeer(clientID, "127.0.0.1", port, 0, clientOpts...)
+	if err != nil {
+		server.StopAccepting()
+		<-accepted
+		t.Fatalf("OpenPeer client: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	if err := <-accepted; err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return server, client, conn
+}
+
+// receive receives a message on p, failing the test on error.
+func receive(t *testing.T, p *Peer) string {
+	t.Helper()
+	message, err := p.Receive()
+	if err != nil {
+		t.Fatalf("Receive on %s: %v", p.ID(), err)
+	}
+	return message
+}
+
+// freePort returns a loopback port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// connect opens a client peer with dial while server accepts it, and
+// returns the client and the server's handle for it.
+func connect(t *testing.T, server *Peer, dial func() (*Peer, error)) (client *Peer, conn *Client) {
+	t.Helper()
+	accepted := make(chan error, 1)
+	go func() {
+		var err error
+		conn, err = server.Accept()
+		accepted <- err
+	}()
+	client, err := dial()
+	if err != nil {
+		server.StopAccepting()
+		<-accepted
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	if err := <-accepted; err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return client, conn
+}
+
+func TestSendReceive(t *testing.T) {
+	server, client := newPair(t)
+	if err := client.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestGetRecentErrors(t *testing.T) {
+	if _, err := OpenPeer("refused", "127.0.0.1", freePort(t), 0); err == nil {
+		t.Fatal("OpenPeer to a closed port succeeded")
+	}
+	errs := GetRecentErrors()
+	if len(errs) == 0 {
+		t.Fatal("no recent errors after a failed connect")
+	}
+}
+
+func TestTrafficCounters(t *testing.T) {
+	server, client := newPair(t)
+	if client.MessagesSent() != 0 || client.BytesSent() != 0 || server.MessagesReceived() != 0 {
+		t.Fatal("a new peer has nonzero counters")
+	}
+	for _, message := range []string{"one", "two"} {
+		if err := client.Send(message); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		receive(t, server)
+	}
+	if n := client.MessagesSent(); n != 2 {
+		t.Fatalf("MessagesSent = %d, want 2", n)
+	}
+	if n := server.MessagesReceived(); n != 2 {
+		t.Fatalf("MessagesReceived = %d, want 2", n)
+	}
+	if n := server.BytesReceived(); n != 6 {
+		t.Fatalf("BytesReceived = %d, want the 6 bytes of the messages", n)
+	}
+	if n := client.BytesSent(); n <= 6 {
+		t.Fatalf("BytesSent = %d, want the messages and their framing", n)
+	}
+	if client.GetLatency() < 0 {
+		t.Fatalf("GetLatency = %d", client.GetLatency())
+	}
+}
+
+func TestEqualByID(t *testing.T) {
+	server, client := newPair(t)
+	if server.Equal(client) {
+		t.Fatal("peers with different IDs are equal")
+	}
+	a, b := &Peer{id: "x"}, &Peer{id: "x"}
+	if !a.Equal(b) || a.Hash() != b.Hash() {
+		t.Fatal("peers with the same ID are not equal or hash differently")
+	}
+	server.Destroy()
+	client.Destroy()
+	if server.Equal(client) {
+		t.Fatal("destroyed peers with different IDs are equal")
+	}
+	if server.Hash() == client.Hash() {
+		t.Fatal("distinct IDs hash the same")
+	}
+}
+
+func TestPeekThenReceive(t *testing.T) {
+	server, client := newPair(t)
+	server.SetDuplicateWindow(time.Minute)
+
+	m := Message{ID: NewMessageID(), Payload: []byte("first")}
+	for range 2 {
+		if err := client.SendEnvelope(m); err != nil {
+			t.Fatalf("SendEnvelope: %v", err)
+		}
+	}
+	if err := client.Send("second"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	peeked, ok := server.Peek()
+	if !ok {
+		t.Fatal("Peek found no message")
+	}
+	got, err := server.ReceiveEnvelope()
+	if err != nil {
+		t.Fatalf("ReceiveEnvelope: %v", err)
+	}
+	var p Message
+	if err := p.UnmarshalBinary(peeked); err != nil || p.ID != m.ID || got.ID != m.ID {
+		t.Fatalf("Peek returned %q and Receive %q, want the envelope %s", peeked, got.ID, m.ID)
+	}
+	// The duplicate is dropped before Peek sees it.
+	if peeked, ok := server.Peek(); !ok || string(peeked) != "second" {
+		t.Fatalf("Peek = %q, %v, want %q", peeked, ok, "second")
+	}
+	if got := receive(t, server); got != "second" {
+		t.Fatalf("Receive = %q, want %q", got, "second")
+	}
+}
+
+func TestPeekDoesNotBlockReceive(t *testing.T) {
+	server, client := newPair(t)
+	peeked := make(chan string, 1)
+	go func() {
+		message, _ := server.Peek()
+		peeked <- string(message)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.TryReceive()
+		server.ReceiveWithTimeout(20 * time.Millisecond)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receive blocked behind a waiting Peek")
+	}
+
+	if err := client.Send("late"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := <-peeked; got != "late" {
+		t.Fatalf("Peek = %q, want %q", got, "late")
+	}
+	if got := receive(t, server); got != "late" {
+		t.Fatalf("Receive = %q, want %q", got, "late")
+	}
+}
+
+func TestDestroyTwiceAndCloseAfter(t *testing.T) {
+	_, client := newPair(t)
+	client.Destroy()
+	client.Destroy()
+	client.Close()
+	if err := client.Send("late"); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("Send after Destroy: %v, want ErrPeerDisconnected", err)
+	}
+	if _, err := client.Receive(); err == nil {
+		t.Fatal("Receive after Destroy succeeded")
+	}
+	if client.IsConnected() || client.MessagesSent() != 0 || client.LocalAddr() != nil {
+		t.Fatal("destroyed peer reports a live connection")
+	}
+}
+
+func TestDestroyWaitsForCalls(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	received := make(chan error, 1)
+	go func() {
+		_, err := client.Receive()
+		received <- err
+	}()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := server.Accept()
+		accepted <- err
+	}()
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			client.Send("x")
+			client.BytesSent()
+			conn.IsConnected()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		client.Destroy()
+		server.Destroy()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destroy did not return while calls were in progress")
+	}
+	if err := <-received; err == nil {
+		t.Fatal("Receive in progress during Destroy succeeded")
+	}
+	if err := <-accepted; !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("Accept in progress during Destroy: %v, want ErrListenerClosed", err)
+	}
+	close(stop)
+	<-sent
+	if conn.IsConnected() {
+		t.Fatal("client of a destroyed server reports a connection")
+	}
+}
+
+func TestRelayMarksTextOnly(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(server)
+	m.AddPeer(client)
+
+	if err := m.Relay("server", "client", "hello"); err != nil {
+		t.Fatalf("Relay text: %v", err)
+	}
+	if got := receive(t, server); got != "[Relayed] hello" {
+		t.Fatalf("relayed text = %q, want %q", got, "[Relayed] hello")
+	}
+
+	data, err := Message{ID: "e1", Payload: []byte("payload")}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Relay("server", "client", string(data)); err != nil {
+		t.Fatalf("Relay envelope: %v", err)
+	}
+	got, err := server.ReceiveEnvelope()
+	if err != nil {
+		t.Fatalf("ReceiveEnvelope of a relayed envelope: %v", err)
+	}
+	if got.ID != "e1" || string(got.Payload) != "payload" {
+		t.Fatalf("relayed envelope = %+v", got)
+	}
+}
+
+func TestCompressedMessageOverMaxSize(t *testing.T) {
+	server, client := newPair(t)
+	client.SetCompressionThreshold(1)
+	server.SetMaxMessageSize(1000)
+
+	if err := client.Send(strings.Repeat("a", 4000)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if client.CompressionStats().Messages != 1 {
+		t.Fatal("large message was not sent compressed")
+	}
+	if _, err := server.Receive(); !errors.Is(err, ErrReceiveFailed) {
+		t.Fatalf("Receive of an oversized compressed message: %v, want ErrReceiveFailed", err)
+	}
+	if err := client.Send("small"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "small" {
+		t.Fatalf("got %q after the oversized message, want %q", got, "small")
+	}
+}
+
+func TestCompressionNegotiatedInHandshake(t *testing.T) {
+	opts := []PeerOption{WithAuthToken("secret")}
+	server, client, conn := openPair(t, opts, opts)
+	client.SetCompressionThreshold(1)
+	server.SetCompressionThreshold(1)
+	message := strings.Repeat("json ", 200)
+
+	if err := client.Send(message); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != message {
+		t.Fatalf("server got %d bytes, want %d", len(got), len(message))
+	}
+	if err := conn.Send(message); err != nil {
+		t.Fatalf("Client.Send: %v", err)
+	}
+	if got := receive(t, client); got != message {
+		t.Fatalf("client got %d bytes, want %d", len(got), len(message))
+	}
+	if n := client.CompressionStats().Messages; n != 1 {
+		t.Fatalf("client compressed %d messages, want 1", n)
+	}
+	if n := server.CompressionStats().Messages; n != 1 {
+		t.Fatalf("server compressed %d messages, want 1", n)
+	}
+}
+
+func TestRelayRulesAreDirectional(t *testing.T) {
+	serverA, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.AddRelayRule("a", "b", false)
+
+	if err := m.Relay("a", "b", "denied"); !errors.Is(err, ErrRelayDenied) {
+		t.Fatalf("Relay against a deny rule: %v, want ErrRelayDenied", err)
+	}
+	if err := m.Relay("b", "a", "allowed"); err != nil {
+		t.Fatalf("Relay in the other direction: %v", err)
+	}
+	if got := receive(t, serverA); got != "[Relayed] allowed" {
+		t.Fatalf("got %q, want %q", got, "[Relayed] allowed")
+	}
+	m.AddRelayRule("a", "b", true)
+	if err := m.Relay("a", "b", "now allowed"); err != nil {
+		t.Fatalf("Relay after the rule was lifted: %v", err)
+	}
+	if got := receive(t, serverB); got != "[Relayed] now allowed" {
+		t.Fatalf("got %q, want %q", got, "[Relayed] now allowed")
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	_, client, conn := openPair(t, nil, nil)
+	client.SetCircuitBreaker(1, time.Minute)
+	conn.Close()
+
+	for range 100 {
+		err := client.Send("x")
+		if errors.Is(err, ErrCircuitOpen) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("sends to a closed connection never opened the circuit")
+}
+
+func TestSendAllBatches(t *testing.T) {
+	server, client := newPair(t)
+	batch := []string{"one", "two", "three"}
+	if err := client.SendAll(batch); err != nil {
+		t.Fatalf("SendAll: %v", err)
+	}
+	if err := client.SendAllCompressed(batch); err != nil {
+		t.Fatalf("SendAllCompressed: %v", err)
+	}
+	for range 2 {
+		for _, want := range batch {
+			if got := receive(t, server); got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+	}
+}
+
+func TestSendAndClose(t *testing.T) {
+	server, client, conn := openPair(t, nil, nil)
+	closed := make(chan error, 1)
+	go func() { closed <- client.SendAndClose("bye") }()
+
+	if got := receive(t, server); got != "bye" {
+		t.Fatalf("got %q, want %q", got, "bye")
+	}
+	if _, err := server.Receive(); err == nil {
+		t.Fatal("Receive after SendAndClose succeeded, want end-of-file")
+	}
+	conn.Close()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("SendAndClose: %v", err)
+		}
+	case <-time.After(DefaultCloseTimeout):
+		t.Fatal("SendAndClose did not return once the server closed")
+	}
+	if client.IsConnected() {
+		t.Fatal("client still connected after SendAndClose")
+	}
+}
+
+func TestReplayProtectionDropsUnstamped(t *testing.T) {
+	server, client := newPair(t)
+	server.SetReplayProtection(time.Minute)
+	if err := client.Send("unstamped"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	client.SetReplayProtection(time.Minute)
+	if err := client.Send("stamped"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := server.Receive(); !errors.Is(err, ErrReceiveFailed) {
+		t.Fatalf("Receive of an unstamped frame: %v, want ErrReceiveFailed", err)
+	}
+	if got := receive(t, server); got != "stamped" {
+		t.Fatalf("got %q, want %q", got, "stamped")
+	}
+	if n := server.ReplaysRejected(); n != 1 {
+		t.Fatalf("ReplaysRejected = %d, want 1", n)
+	}
+}
+
+func TestWaitForClients(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := server.LocalAddr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.WaitForClients(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitForClients with no clients: %v, want DeadlineExceeded", err)
+	}
+
+	for _, id := range []string{"c1", "c2"} {
+		client, err := OpenPeer(id, "127.0.0.1", port, 0)
+		if err != nil {
+			t.Fatalf("OpenPeer %s: %v", id, err)
+		}
+		t.Cleanup(client.Destroy)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitForClients(ctx, 2); err != nil {
+		t.Fatalf("WaitForClients: %v", err)
+	}
+	if n := server.AcceptedCount(); n != 2 {
+		t.Fatalf("AcceptedCount = %d, want 2", n)
+	}
+}
+
+func TestCorkedSendsArrive(t *testing.T) {
+	server, client := newPair(t, WithNoDelay(true))
+	client.SetCork(true)
+	for _, message := range []string{"a", "b", "c"} {
+		if err := client.Send(message); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	client.SetCork(false)
+	for _, want := range []string{"a", "b", "c"} {
+		if got := receive(t, server); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if err := client.SetNoDelay(false); err != nil {
+		t.Fatalf("SetNoDelay: %v", err)
+	}
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	_, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	type letter struct {
+		target, message string
+		reason          error
+	}
+	var letters []letter
+	m.SetDeadLetterHandler(func(targetID, message string, reason error) {
+		letters = append(letters, letter{targetID, message, reason})
+	})
+
+	if err := m.Relay("a", "missing", "lost"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("Relay to an unknown peer: %v, want ErrPeerNotFound", err)
+	}
+	m.AddRelayRule("a", "b", false)
+	if err := m.Relay("a", "b", "withheld"); !errors.Is(err, ErrRelayDenied) {
+		t.Fatalf("Relay against a deny rule: %v, want ErrRelayDenied", err)
+	}
+	if len(letters) != 1 || letters[0].target != "missing" || letters[0].message != "lost" ||
+		!errors.Is(letters[0].reason, ErrPeerNotFound) {
+		t.Fatalf("dead letters = %+v, want only the message to the unknown peer", letters)
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	_, client := newPair(t)
+	mtu, err := client.PathMTU()
+	if err != nil || mtu <= 0 {
+		t.Fatalf("PathMTU = %d, %v, want a positive MTU", mtu, err)
+	}
+	client.Close()
+	if _, err := client.PathMTU(); !errors.Is(err, ErrPathMTUUnavailable) {
+		t.Fatalf("PathMTU after Close: %v, want ErrPathMTUUnavailable", err)
+	}
+}
+
+func TestCloseInterruptsAcceptClients(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	type result struct {
+		n   int
+		err error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		n, err := server.AcceptClients(2)
+		accepted <- result{n, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+	select {
+	case r := <-accepted:
+		if r.n != 0 || !errors.Is(r.err, ErrListenerClosed) {
+			t.Fatalf("AcceptClients = %d, %v, want 0, ErrListenerClosed", r.n, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not interrupt AcceptClients")
+	}
+}
+
+func TestWithLocalAddr(t *testing.T) {
+	port := freePort(t)
+	_, client := newPair(t, WithLocalAddr("127.0.0.1", port))
+	addr, ok := client.LocalAddr().(*net.TCPAddr)
+	if !ok || addr.Port != port {
+		t.Fatalf("LocalAddr = %v, want port %d", client.LocalAddr(), port)
+	}
+}
+
+func TestCompressionDictionary(t *testing.T) {
+	server, client := newPair(t)
+	dict := []byte(`{"type":"update","value":`)
+	client.SetCompressionDictionary(dict)
+	server.SetCompressionDictionary(dict)
+	batch := []string{`{"type":"update","value":1}`, `{"type":"update","value":2}`}
+	if err := client.SendAllCompressed(batch); err != nil {
+		t.Fatalf("SendAllCompressed: %v", err)
+	}
+	for _, want := range batch {
+		if got := receive(t, server); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	server.SetCompressionDictionary([]byte("something else"))
+	if err := client.SendAllCompressed(batch); err != nil {
+		t.Fatalf("SendAllCompressed: %v", err)
+	}
+	if _, err := server.Receive(); err == nil {
+		t.Fatal("batch compressed with another dictionary was received")
+	}
+}
+
+func TestRelayTransform(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.SetRelayTransform(func(sourceID, targetID, message string) (string, bool) {
+		if message == "secret" {
+			return "", false
+		}
+		return strings.ToUpper(message), true
+	})
+
+	if err := m.Relay("a", "b", "secret"); !errors.Is(err, ErrRelayDropped) {
+		t.Fatalf("Relay of a dropped message: %v, want ErrRelayDropped", err)
+	}
+	if err := m.Relay("a", "b", "hello"); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+	if got := receive(t, serverB); got != "[Relayed] HELLO" {
+		t.Fatalf("got %q, want %q", got, "[Relayed] HELLO")
+	}
+}
+
+func TestStopAcceptingReportsPartialCount(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	type result struct {
+		n   int
+		err error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		n, err := server.AcceptClients(3)
+		accepted <- result{n, err}
+	}()
+	client, err := OpenPeer("client", "127.0.0.1", server.LocalAddr().(*net.TCPAddr).Port, 0)
+	if err != nil {
+		t.Fatalf("OpenPeer client: %v", err)
+	}
+	t.Cleanup(client.Destroy)
+	for server.AcceptedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	server.StopAccepting()
+	r := <-accepted
+	if r.n != 1 || !errors.Is(r.err, ErrListenerClosed) {
+		t.Fatalf("AcceptClients = %d, %v, want 1, ErrListenerClosed", r.n, r.err)
+	}
+	if err := client.Send("still here"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "still here" {
+		t.Fatalf("got %q, want %q", got, "still here")
+	}
+}
+
+func TestSendWithRetryStopsOnDisconnect(t *testing.T) {
+	server, client := newPair(t)
+	if err := client.SendWithRetry("hello", 3, time.Millisecond); err != nil {
+		t.Fatalf("SendWithRetry: %v", err)
+	}
+	if got := receive(t, server); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+
+	client.Close()
+	start := time.Now()
+	if err := client.SendWithRetry("late", 5, time.Second); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("SendWithRetry on a closed peer: %v, want ErrPeerDisconnected", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("SendWithRetry retried a permanent failure for %v", d)
+	}
+}
+
+func TestFrameDesync(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	acceptAll(t, server)
+	c, err := net.Dial("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for server.AcceptedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := c.Write([]byte("this is not a frame, just noise")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Receive(); !errors.Is(err, ErrFrameDesync) {
+		t.Fatalf("Receive of corrupt framing: %v, want ErrFrameDesync", err)
+	}
+	if n := server.FrameDesyncs(); n != 1 {
+		t.Fatalf("FrameDesyncs = %d, want 1", n)
+	}
+}
+
+func TestUrgentJumpsQueue(t *testing.T) {
+	server, client := newPair(t)
+	for _, urgent := range []bool{false, true} {
+		if err := client.Send("normal"); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if err := client.SendUrgent("urgent"); err != nil {
+			t.Fatalf("SendUrgent: %v", err)
+		}
+		// Let both arrive, so the urgent one is behind the normal one.
+		time.Sleep(50 * time.Millisecond)
+		if !urgent {
+			for _, want := range []string{"urgent", "normal"} {
+				if got := receive(t, server); got != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+			}
+			continue
+		}
+
+		var handled []string
+		server.OnUrgentMessage(func(message string) { handled = append(handled, message) })
+		if got := receive(t, server); got != "normal" {
+			t.Fatalf("got %q with an urgent handler, want %q", got, "normal")
+		}
+		if len(handled) != 1 || handled[0] != "urgent" {
+			t.Fatalf("urgent handler got %q, want the urgent message", handled)
+		}
+	}
+}
+
+func TestCompressionLevelClamped(t *testing.T) {
+	server, client := newPair(t)
+	if got := client.CompressionLevel(); got != CompressionBest {
+		t.Fatalf("initial level %d, want CompressionBest", got)
+	}
+	client.SetCompressionLevel(100)
+	if got := client.CompressionLevel(); got != CompressionBest {
+		t.Fatalf("level %d after setting 100, want CompressionBest", got)
+	}
+	client.SetCompressionLevel(-1)
+	if got := client.CompressionLevel(); got != CompressionFastest {
+		t.Fatalf("level %d after setting -1, want CompressionFastest", got)
+	}
+	if err := client.SendAllCompressed([]string{"fast", "faster"}); err != nil {
+		t.Fatalf("SendAllCompressed: %v", err)
+	}
+	for _, want := range []string{"fast", "faster"} {
+		if got := receive(t, server); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestGrowReceiveBuffer(t *testing.T) {
+	server, client := newPair(t)
+	if err := server.GrowReceiveBuffer(0); !errors.Is(err, ErrConfigureFailed) {
+		t.Fatalf("GrowReceiveBuffer(0): %v, want ErrConfigureFailed", err)
+	}
+	if err := server.GrowReceiveBuffer(1 << 20); err != nil {
+		t.Fatalf("GrowReceiveBuffer: %v", err)
+	}
+	message := strings.Repeat("x", 1<<19)
+	if err := client.Send(message); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != message {
+		t.Fatalf("got %d bytes, want %d", len(got), len(message))
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	_, client := newPair(t)
+	client.SetReadIdleTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := client.Receive(); !errors.Is(err, ErrReadIdle) {
+		t.Fatalf("Receive from a silent peer: %v, want ErrReadIdle", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("read idle timeout fired after %v", d)
+	}
+	if !client.IsConnected() {
+		t.Fatal("read idle timeout closed the connection")
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	server, err := OpenPeer("server", "127.0.0.1", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	if _, _, err := server.BufferSizes(); !errors.Is(err, ErrBufferSizesUnavailable) {
+		t.Fatalf("BufferSizes of a server with no clients: %v, want ErrBufferSizesUnavailable", err)
+	}
+
+	_, client := newPair(t, WithSendBufferSize(64<<10))
+	send, recv, err := client.BufferSizes()
+	if err != nil || send < 64<<10 || recv <= 0 {
+		t.Fatalf("BufferSizes = %d, %d, %v, want a send buffer of at least 64KiB", send, recv, err)
+	}
+	client.Close()
+	if _, _, err := client.BufferSizes(); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("BufferSizes after Close: %v, want ErrPeerDisconnected", err)
+	}
+}
+
+func TestBroadcastParallel(t *testing.T) {
+	serverA, a := newPairIDs(t, "a-server", "a")
+	serverB, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.AddRelayRule("", "b", false)
+
+	results := m.BroadcastParallel("news", 2)
+	if len(results) != 2 || results["a"] != nil || !errors.Is(results["b"], ErrRelayDenied) {
+		t.Fatalf("BroadcastParallel = %v, want a delivered and b denied", results)
+	}
+	if got := receive(t, serverA); got != "news" {
+		t.Fatalf("got %q, want %q", got, "news")
+	}
+	if _, ok := serverB.TryReceive(); ok {
+		t.Fatal("denied peer received the broadcast")
+	}
+
+	m.AddRelayRule("", "b", true)
+	if !m.Broadcast("more") {
+		t.Fatal("Broadcast failed")
+	}
+	for _, server := range []*Peer{serverA, serverB} {
+		if got := receive(t, server); got != "more" {
+			t.Fatalf("%s got %q, want %q", server.ID(), got, "more")
+		}
+	}
+
+	binary := "\x00a\x00b"
+	results = m.BroadcastParallel(binary, 2)
+	if results["a"] != nil || results["b"] != nil {
+		t.Fatalf("BroadcastParallel = %v, want both delivered", results)
+	}
+	for _, server := range []*Peer{serverA, serverB} {
+		got, err := server.ReceiveBytes()
+		if err != nil || string(got) != binary {
+			t.Fatalf("%s ReceiveBytes = %q, %v, want %q", server.ID(), got, err, binary)
+		}
+	}
+}
+
+func TestSendBytesKeepsNULs(t *testing.T) {
+	server, client := newPair(t)
+	data := []byte("a\x00b\x00\x00c")
+	if err := client.SendBytes(data); err != nil {
+		t.Fatalf("SendBytes: %v", err)
+	}
+	got, err := server.ReceiveBytes()
+	if err != nil {
+		t.Fatalf("ReceiveBytes: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+}
+
+func TestBroadcastKeepsNULs(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(client)
+	message := "\x00a\x00b"
+	if !m.Broadcast(message) {
+		t.Fatal("Broadcast failed")
+	}
+	got, err := server.ReceiveBytes()
+	if err != nil {
+		t.Fatalf("ReceiveBytes: %v", err)
+	}
+	if string(got) != message {
+		t.Fatalf("got %q, want %q", got, message)
+	}
+}
+
+func TestTryReceiveAndTimeout(t *testing.T) {
+	server, client := newPair(t)
+	if _, ok := server.TryReceive(); ok {
+		t.Fatal("TryReceive returned a message nobody sent")
+	}
+	if _, err := server.ReceiveWithTimeout(20 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("ReceiveWithTimeout with nothing sent: %v, want ErrTimeout", err)
+	}
+	if err := client.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got, err := server.ReceiveWithTimeout(5 * time.Second)
+	if err != nil || got != "hello" {
+		t.Fatalf("ReceiveWithTimeout = %q, %v, want %q", got, err, "hello")
+	}
+	if err := client.Send("again"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for range 500 {
+		if got, ok := server.TryReceive(); ok {
+			if got != "again" {
+				t.Fatalf("TryReceive = %q, want %q", got, "again")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("TryReceive never returned the message")
+}
+
+func TestLargeMessageFragmented(t *testing.T) {
+	server, client := newPair(t, WithMaxMessageSize(40<<20))
+	// Over the 16 MiB a single frame can carry.
+	message := strings.Repeat("f", 20<<20)
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send(message) }()
+	if got := receive(t, server); got != message {
+		t.Fatalf("received %d bytes, want %d", len(got), len(message))
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	client.SetMaxMessageSize(1000)
+	if err := client.Send(strings.Repeat("x", 1001)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Send over the limit: %v, want ErrMessageTooLarge", err)
+	}
+}
@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultReliableAttempts is how many times SendReliable sends a message
+// before reporting it lost.
+const DefaultReliableAttempts = 5
+
+// DefaultReliableBackoff is how long SendReliable waits before sending a
+// message again the first time; the wait doubles before each later try.
+const DefaultReliableBackoff = 100 * time.Millisecond
+
+// retransmitter holds the retry settings of SendReliable and stops its
+// retries when the peer is closed.
+type retransmitter struct {
+	mu       sync.Mutex
+	attempts int           // DefaultReliableAttempts if 0
+	backoff  time.Duration // DefaultReliableBackoff if 0
+	closed   bool
+	stop     chan struct{} // Closed by close, created on first use
+}
+
+// SendReliable sends a message with at-least-once delivery: it goes out in
+// an envelope (see SendEnvelope) with a fresh ID, the receiver
+// acknowledges it with a receipt as for SendTracked, and if no receipt
+// arrives, or the send fails, it is sent again after a backoff that
+// doubles each time, up to the attempts set with SetReliableRetries. It
+// returns at once; the Delivery reports Delivered once a receipt arrives,
+// or the outcome of the last attempt. Closing the peer stops the retries
+// and reports Failed.
+//
+// A retransmitted message may arrive twice if only its receipt was lost.
+// The receiver reads messages with ReceiveEnvelope, whose Payload is the
+// message and whose ID is the same on every copy; SetDuplicateWindow on
+// the receiver drops the copies. Receipts have the requirements described
+// for SendTracked.
+func (p *Peer) SendReliable(message string) *Delivery {
+	m := Message{ID: NewMessageID(), Time: time.Now(), Payload: []byte(message)}
+	data, _ := m.MarshalBinary()
+	d := &Delivery{message: message, id: m.ID, done: make(chan struct{})}
+	attempts, backoff, stop := p.retries.settings()
+	spawn(func() { d.finish(p.retransmit(string(data), attempts, backoff, stop)) })
+	return d
+}
+
+// SetReliableRetries sets how many times SendReliable sends a message in
+// all, DefaultReliableAttempts by default, and how long it waits before the
+// first retry, DefaultReliableBackoff by default; a value of 0 restores
+// the default. It applies to messages sent afterwards.
+func (p *Peer) SetReliableRetries(attempts int, backoff time.Duration) {
+	p.retries.mu.Lock()
+	defer p.retries.mu.Unlock()
+	p.retries.attempts = attempts
+	p.retries.backoff = backoff
+}
+
+// retransmit sends data until a receipt arrives or the attempts are used
+// up, and returns the last outcome.
+func (p *Peer) retransmit(data string, attempts int, backoff time.Duration, stop <-chan struct{}) DeliveryStatus {
+	status := make(chan DeliveryStatus, 1)
+	for attempt := 1; ; attempt++ {
+		p.sendTracked(data, func(s DeliveryStatus) { status <- s })
+		s := <-status
+		if s == Delivered || attempt >= attempts {
+			return s
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return Failed
+		}
+		backoff *= 2
+	}
+}
+
+// settings returns the retry settings and a channel closed when the peer
+// is.
+func (r *retransmitter) settings() (attempts int, backoff time.Duration, stop <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+		if r.closed {
+			close(r.stop)
+		}
+	}
+	backoff = r.backoff
+	if backoff <= 0 {
+		backoff = DefaultReliableBackoff
+	}
+	return sizeOr(r.attempts, DefaultReliableAttempts), backoff, r.stop
+}
+
+// close stops the retries in progress.
+func (r *retransmitter) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
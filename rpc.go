@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// rpcStreamName names the streams Request opens.
+const rpcStreamName = "relay-rpc"
+
+// Status bytes that follow the correlation ID of a reply. An error reply
+// goes on with the error code as a varint and then the message.
+const (
+	rpcReplyOK    = 0
+	rpcReplyError = 1
+)
+
+// RequestHandler answers a request sent with Peer.Request. A non-nil error
+// is passed back to the requester as the error of Request: a *RemoteError
+// keeps its code, any other error is sent with code 0 and its text.
+type RequestHandler func(request []byte) ([]byte, error)
+
+// CorrelatedHandler receives a request sent with Peer.Request together with
+// its correlation ID, for ServeCorrelated. It answers, now or later and
+// from any goroutine, by passing the ID to Respond or RespondError.
+type CorrelatedHandler func(correlationID string, request []byte)
+
+// RemoteError is the error Request returns when the server's handler
+// rejected the request, as opposed to the request or its reply failing to
+// travel. It wraps ErrRequestFailed. Handlers return one, or pass one to
+// RespondError, to choose the code the requester sees.
+type RemoteError struct {
+	Code    int    // Application-defined; 0 for a handler error that is not a *RemoteError
+	Message string // Text of the handler's error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%v: remote error %d: %s", ErrRequestFailed, e.Code, e.Message)
+}
+
+// Unwrap returns ErrRequestFailed.
+func (e *RemoteError) Unwrap() error {
+	return ErrRequestFailed
+}
+
+// servedRequests holds the requests ServeCorrelated has handed out and
+// that have not been answered yet.
+type servedRequests struct {
+	mu       sync.Mutex
+	requests map[string]servedRequest
+}
+
+// servedRequest is one request waiting for its reply.
+type servedRequest struct {
+	s  *Stream
+	id uint64 // Correlation ID as sent by the requester
+}
+
+// Request sends payload to the server and waits for the reply its Serve
+// handler returns. Each request carries a correlation ID that the reply
+// must echo and travels on a stream of its own (see OpenNamedStream), so
+// any number of requests can be outstanding at once and replies never mix
+// with ordinary messages. Like OpenStream it is only for client peers.
+//
+// If ctx is done before the reply arrives Request returns ctx.Err() and
+// the reply is discarded when it comes; the request is not withdrawn, and
+// a request too large to fit in StreamWindow is sent in full before ctx is
+// checked. A request the server's handler rejected returns a *RemoteError
+// carrying the handler's code and message; any other error means the
+// request or its reply did not get through, and a server that closes
+// without replying gives ErrPeerDisconnected.
+func (p *Peer) Request(ctx context.Context, payload []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := p.OpenNamedStream(rpcStreamName)
+	if err != nil {
+		return nil, err
+	}
+	id := p.rpcSeq.Add(1)
+	request := append(binary.AppendUvarint(nil, id), payload...)
+	if err := s.Send(string(request)); err != nil {
+		return nil, err
+	}
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		reply string
+		err   error
+	}
+	replies := make(chan result, 1)
+	spawn(func() {
+		reply, err := s.Receive()
+		replies <- result{reply, err}
+		for err == nil {
+			_, err = s.Receive()
+		}
+	})
+	select {
+	case r := <-replies:
+		if r.err == io.EOF {
+			return nil, ErrPeerDisconnected
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return parseReply(id, r.reply)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Serve answers the requests clients send with Request, calling handler on
+// a goroutine of its own for each and sending back what it returns. It
+// takes every stream clients open, so do not mix it with AcceptStream,
+// ReceiveStream or ReceiveFile on the same peer; streams not opened by
+// Request are closed unanswered. Serve blocks until the peer is closed and
+// then returns ErrPeerDisconnected.
+func (p *Peer) Serve(handler RequestHandler) error {
+	return p.ServeCorrelated(func(correlationID string, request []byte) {
+		if payload, err := handler(request); err != nil {
+			p.RespondError(correlationID, err)
+		} else {
+			p.Respond(correlationID, payload)
+		}
+	})
+}
+
+// ServeCorrelated is like Serve, but leaves the reply to the handler: it
+// calls handler on a goroutine of its own for each request, with a
+// correlation ID that is unique among the peer's unanswered requests, and
+// the request is answered once that ID is passed to Respond or
+// RespondError. A request never answered keeps its stream open until the
+// connection closes.
+func (p *Peer) ServeCorrelated(handler CorrelatedHandler) error {
+	for {
+		s, err := p.AcceptStream(context.Background())
+		if err != nil {
+			return err
+		}
+		spawn(func() { p.serveRequest(s, handler) })
+	}
+}
+
+// Respond sends payload as the reply to the request with the given
+// correlation ID, which Request then returns. It returns
+// ErrUnknownRequest if the request was already answered or the ID was
+// never handed out, and otherwise the error of sending the reply.
+func (p *Peer) Respond(correlationID string, payload []byte) error {
+	r, ok := p.served.take(correlationID)
+	if !ok {
+		return ErrUnknownRequest
+	}
+	reply := append(binary.AppendUvarint(nil, r.id), rpcReplyOK)
+	return r.reply(append(reply, payload...))
+}
+
+// RespondError answers the request with the given correlation ID with an
+// error, which Request returns as a *RemoteError: the code and message of
+// err if it is a *RemoteError (see errors.As), or code 0 and err's text
+// otherwise. It returns what Respond would.
+func (p *Peer) RespondError(correlationID string, err error) error {
+	r, ok := p.served.take(correlationID)
+	if !ok {
+		return ErrUnknownRequest
+	}
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		remote = &RemoteError{Message: err.Error()}
+	}
+	reply := append(binary.AppendUvarint(nil, r.id), rpcReplyError)
+	reply = binary.AppendVarint(reply, int64(remote.Code))
+	return r.reply(append(reply, remote.Message...))
+}
+
+// serveRequest reads the request on s and passes it to handler, or closes
+// s if it does not hold one.
+func (p *Peer) serveRequest(s *Stream, handler CorrelatedHandler) {
+	request, err := s.Receive()
+	if err == nil && s.Name() == rpcStreamName {
+		if id, n := binary.Uvarint([]byte(request)); n > 0 {
+			handler(p.served.add(s, id), []byte(request[n:]))
+			return
+		}
+	}
+	s.Close()
+	drainStream(s)
+}
+
+// add records a request received on s and returns its correlation ID.
+// Stream IDs are unique among a peer's open streams, so the ID cannot
+// clash with that of another unanswered request.
+func (q *servedRequests) add(s *Stream, id uint64) string {
+	correlationID := fmt.Sprintf("%d.%d", s.id, id)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.requests == nil {
+		q.requests = make(map[string]servedRequest)
+	}
+	q.requests[correlationID] = servedRequest{s, id}
+	return correlationID
+}
+
+// take removes and returns the request with the given correlation ID.
+func (q *servedRequests) take(correlationID string) (servedRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, ok := q.requests[correlationID]
+	delete(q.requests, correlationID)
+	return r, ok
+}
+
+// reply sends reply on the request's stream and closes it.
+func (r servedRequest) reply(reply []byte) error {
+	defer drainStream(r.s)
+	err := r.s.Send(string(reply))
+	if closeErr := r.s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseReply returns the payload of the reply to request id.
+func parseReply(id uint64, reply string) ([]byte, error) {
+	got, n := binary.Uvarint([]byte(reply))
+	if n <= 0 || got != id || len(reply) == n {
+		return nil, fmt.Errorf("%w: malformed reply", ErrRequestFailed)
+	}
+	payload := []byte(reply[n+1:])
+	if reply[n] == rpcReplyOK {
+		return payload, nil
+	}
+	code, m := binary.Varint(payload)
+	if reply[n] != rpcReplyError || m <= 0 {
+		return nil, fmt.Errorf("%w: malformed reply", ErrRequestFailed)
+	}
+	return nil, &RemoteError{Code: int(code), Message: string(payload[m:])}
+}
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestRemoteError(t *testing.T) {
+	server, client := newPair(t)
+	go server.Serve(func(request []byte) ([]byte, error) {
+		switch string(request) {
+		case "ping":
+			return []byte("pong"), nil
+		case "coded":
+			return nil, &RemoteError{Code: 404, Message: "no such thing"}
+		}
+		return nil, errors.New("bad request")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := client.Request(ctx, []byte("ping"))
+	if err != nil || string(reply) != "pong" {
+		t.Fatalf("Request(ping) = %q, %v; want pong", reply, err)
+	}
+
+	_, err = client.Request(ctx, []byte("coded"))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != 404 || remote.Message != "no such thing" {
+		t.Fatalf("Request(coded) error = %v, want RemoteError 404", err)
+	}
+	if !errors.Is(err, ErrRequestFailed) {
+		t.Fatalf("RemoteError does not wrap ErrRequestFailed")
+	}
+
+	_, err = client.Request(ctx, []byte("other"))
+	if !errors.As(err, &remote) || remote.Code != 0 || remote.Message != "bad request" {
+		t.Fatalf("Request(other) error = %v, want RemoteError 0", err)
+	}
+}
+
+func TestRespondErrorByCorrelationID(t *testing.T) {
+	server, client := newPair(t)
+	ids := make(chan string, 1)
+	go server.ServeCorrelated(func(correlationID string, request []byte) {
+		ids <- correlationID
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Request(ctx, []byte("slow"))
+		errs <- err
+	}()
+	id := <-ids
+	if err := server.RespondError(id, &RemoteError{Code: 7, Message: "rejected"}); err != nil {
+		t.Fatalf("RespondError: %v", err)
+	}
+	var remote *RemoteError
+	if err := <-errs; !errors.As(err, &remote) || remote.Code != 7 || remote.Message != "rejected" {
+		t.Fatalf("Request error = %v, want RemoteError 7", err)
+	}
+	if err := server.RespondError(id, errors.New("again")); err != ErrUnknownRequest {
+		t.Fatalf("second RespondError = %v, want ErrUnknownRequest", err)
+	}
+	if err := server.Respond("nope", nil); err != ErrUnknownRequest {
+		t.Fatalf("Respond(unknown) = %v, want ErrUnknownRequest", err)
+	}
+}
+
+func TestRequestTransportError(t *testing.T) {
+	_, client := newPair(t)
+	client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := client.Request(ctx, []byte("ping"))
+	var remote *RemoteError
+	if err == nil || errors.As(err, &remote) {
+		t.Fatalf("Request on closed peer = %v, want a transport error", err)
+	}
+}
@@ -0,0 +1,295 @@
+#include "../include/relay/frame.h"
+#include <zlib.h>
+#include <algorithm>
+
+namespace relay
+{
+    namespace
+    {
+        void putUint32(std::string &out, uint32_t value)
+        {
+            out.push_back(static_cast<char>((value >> 24) & 0xff));
+            out.push_back(static_cast<char>((value >> 16) & 0xff));
+            out.push_back(static_cast<char>((value >> 8) & 0xff));
+            out.push_back(static_cast<char>(value & 0xff));
+        }
+
+        uint32_t getUint32(const std::string &in, size_t offset)
+        {
+            const auto *p = reinterpret_cast<const unsigned char *>(in.data() + offset);
+            return (uint32_t(p[0]) << 24) | (uint32_t(p[1]) << 16) | (uint32_t(p[2]) << 8) | uint32_t(p[3]);
+        }
+    } // namespace
+
+    std::string encodeFrame(const Frame &frame)
+    {
+        std::string out;
+        out.reserve(FRAME_HEADER_SIZE + frame.payload.size());
+        out.append(FRAME_MARKER, FRAME_MARKER_SIZE);
+        out.push_back(static_cast<char>(frame.type));
+        out.push_back(static_cast<char>(frame.flags));
+        putUint32(out, static_cast<uint32_t>(frame.payload.size()));
+        out += frame.payload;
+        return out;
+    }
+
+    std::optional<Frame> decodeFrame(std::string &buffer, bool &corrupt)
+    {
+        corrupt = false;
+        // Check the marker as soon as its bytes arrive, so a desync is not mistaken for a short read.
+        if (buffer.compare(0, std::min(buffer.size(), FRAME_MARKER_SIZE), FRAME_MARKER, std::min(buffer.size(), FRAME_MARKER_SIZE)) != 0)
+        {
+            corrupt = true;
+            return std::nullopt;
+        }
+        if (buffer.size() < FRAME_HEADER_SIZE)
+            return std::nullopt;
+
+        auto type = static_cast<FrameType>(buffer[FRAME_MARKER_SIZE]);
+        uint32_t length = getUint32(buffer, FRAME_MARKER_SIZE + 2);
+        bool knownType = type == FrameType::MESSAGE || type == FrameType::BATCH || type == FrameType::RECEIPT ||
+                         type == FrameType::GOODBYE || type == FrameType::URGENT || type == FrameType::STREAM ||
+                         type == FrameType::FRAGMENT;
+        if (!knownType || length > MAX_FRAME_SIZE)
+        {
+            corrupt = true;
+            return std::nullopt;
+        }
+        if (buffer.size() < FRAME_HEADER_SIZE + length)
+            return std::nullopt;
+
+        Frame frame;
+        frame.type = type;
+        frame.flags = static_cast<uint8_t>(buffer[FRAME_MARKER_SIZE + 1]);
+        frame.payload = buffer.substr(FRAME_HEADER_SIZE, length);
+        buffer.erase(0, FRAME_HEADER_SIZE + length);
+        return frame;
+    }
+
+    bool resyncFrame(std::string &buffer)
+    {
+        size_t next = buffer.find(FRAME_MARKER, 1, FRAME_MARKER_SIZE);
+        if (next != std::string::npos)
+        {
+            buffer.erase(0, next);
+            return true;
+        }
+        bool partialMarker = !buffer.empty() && buffer.back() == FRAME_MARKER[0];
+        buffer.erase(0, partialMarker ? buffer.size() - 1 : buffer.size());
+        return false;
+    }
+
+    void stampFrame(Frame &frame, int64_t timestampMs, uint64_t nonce)
+    {
+        std::string stamp;
+        stamp.reserve(FRAME_STAMP_SIZE + frame.payload.size());
+        putUint32(stamp, static_cast<uint32_t>(static_cast<uint64_t>(timestampMs) >> 32));
+        putUint32(stamp, static_cast<uint32_t>(timestampMs));
+        putUint32(stamp, static_cast<uint32_t>(nonce >> 32));
+        putUint32(stamp, static_cast<uint32_t>(nonce));
+        stamp += frame.payload;
+        frame.payload = std::move(stamp);
+        frame.flags |= FRAME_STAMPED;
+    }
+
+    bool unstampFrame(Frame &frame, int64_t &timestampMs, uint64_t &nonce)
+    {
+        if (!(frame.flags & FRAME_STAMPED) || frame.payload.size() < FRAME_STAMP_SIZE)
+            return false;
+        timestampMs = static_cast<int64_t>((uint64_t(getUint32(frame.payload, 0)) << 32) | getUint32(frame.payload, 4));
+        nonce = (uint64_t(getUint32(frame.payload, 8)) << 32) | getUint32(frame.payload, 12);
+        frame.payload.erase(0, FRAME_STAMP_SIZE);
+        frame.flags &= ~FRAME_STAMPED;
+        return true;
+    }
+
+    void trackFrame(Frame &frame, uint64_t trackingId)
+    {
+        std::string tracked;
+        tracked.reserve(FRAME_TRACKING_SIZE + frame.payload.size());
+        putUint32(tracked, static_cast<uint32_t>(trackingId >> 32));
+        putUint32(tracked, static_cast<uint32_t>(trackingId));
+        tracked += frame.payload;
+        frame.payload = std::move(tracked);
+        frame.flags |= FRAME_TRACKED;
+    }
+
+    bool untrackFrame(Frame &frame, uint64_t &trackingId)
+    {
+        if (!(frame.flags & FRAME_TRACKED) || frame.payload.size() < FRAME_TRACKING_SIZE)
+            return false;
+        trackingId = (uint64_t(getUint32(frame.payload, 0)) << 32) | getUint32(frame.payload, 4);
+        frame.payload.erase(0, FRAME_TRACKING_SIZE);
+        frame.flags &= ~FRAME_TRACKED;
+        return true;
+    }
+
+    Frame makeReceipt(uint64_t first, uint64_t last)
+    {
+        Frame receipt;
+        receipt.type = FrameType::RECEIPT;
+        if (first != last)
+        {
+            putUint32(receipt.payload, static_cast<uint32_t>(first >> 32));
+            putUint32(receipt.payload, static_cast<uint32_t>(first));
+        }
+        trackFrame(receipt, last);
+        return receipt;
+    }
+
+    bool parseReceipt(Frame &frame, uint64_t &first, uint64_t &last)
+    {
+        if (!untrackFrame(frame, last))
+            return false;
+        if (frame.payload.empty())
+        {
+            first = last;
+            return true;
+        }
+        if (frame.payload.size() != FRAME_TRACKING_SIZE)
+            return false;
+        first = (uint64_t(getUint32(frame.payload, 0)) << 32) | getUint32(frame.payload, 4);
+        return first <= last && last - first < MAX_RECEIPT_RANGE;
+    }
+
+    std::string encodeBatch(const std::vector<std::string> &messages)
+    {
+        size_t size = 0;
+        for (const auto &message : messages)
+            size += 4 + message.size();
+
+        std::string out;
+        out.reserve(size);
+        for (const auto &message : messages)
+        {
+            putUint32(out, static_cast<uint32_t>(message.size()));
+            out += message;
+        }
+        return out;
+    }
+
+    bool decodeBatch(const std::string &payload, std::vector<std::string> &messages)
+    {
+        size_t offset = 0;
+        while (offset < payload.size())
+        {
+            if (payload.size() - offset < 4)
+                return false;
+            uint32_t length = getUint32(payload, offset);
+            offset += 4;
+            if (payload.size() - offset < length)
+                return false;
+            messages.push_back(payload.substr(offset, length));
+            offset += length;
+        }
+        return true;
+    }
+
+    std::string encodeStreamFrame(const StreamFrame &frame)
+    {
+        std::string out;
+        out.reserve(STREAM_HEADER_SIZE + frame.data.size());
+        putUint32(out, frame.streamId);
+        out.push_back(static_cast<char>(frame.kind));
+        out += frame.data;
+        return out;
+    }
+
+    bool decodeStreamFrame(const std::string &payload, StreamFrame &frame)
+    {
+        if (payload.size() < STREAM_HEADER_SIZE)
+            return false;
+        auto kind = static_cast<StreamFrameKind>(payload[4]);
+        if (kind != StreamFrameKind::OPEN && kind != StreamFrameKind::DATA && kind != StreamFrameKind::WINDOW &&
+            kind != StreamFrameKind::CLOSE)
+            return false;
+        frame.streamId = getUint32(payload, 0);
+        frame.kind = kind;
+        frame.data = payload.substr(STREAM_HEADER_SIZE);
+        return true;
+    }
+
+    std::string encodeFragment(uint32_t index, uint64_t total, std::string_view data)
+    {
+        std::string out;
+        out.reserve(FRAGMENT_HEADER_SIZE + data.size());
+        putUint32(out, index);
+        putUint32(out, static_cast<uint32_t>(total >> 32));
+        putUint32(out, static_cast<uint32_t>(total));
+        out += data;
+        return out;
+    }
+
+    bool decodeFragment(const std::string &payload, uint32_t &index, uint64_t &total, std::string &data)
+    {
+        if (payload.size() < FRAGMENT_HEADER_SIZE)
+            return false;
+        index = getUint32(payload, 0);
+        total = (uint64_t(getUint32(payload, 4)) << 32) | getUint32(payload, 8);
+        data = payload.substr(FRAGMENT_HEADER_SIZE);
+        return true;
+    }
+
+    bool compressPayload(const std::string &payload, std::string &compressed, const std::string &dictionary, int level)
+    {
+        z_stream stream{};
+        if (deflateInit(&stream, std::clamp(level, MIN_COMPRESSION_LEVEL, MAX_COMPRESSION_LEVEL)) != Z_OK)
+            return false;
+        if (!dictionary.empty() &&
+            deflateSetDictionary(&stream, reinterpret_cast<const Bytef *>(dictionary.data()), static_cast<uInt>(dictionary.size())) != Z_OK)
+        {
+            deflateEnd(&stream);
+            return false;
+        }
+
+        uLong bound = deflateBound(&stream, static_cast<uLong>(payload.size()));
+        compressed.clear();
+        putUint32(compressed, static_cast<uint32_t>(payload.size()));
+        compressed.resize(4 + bound);
+
+        stream.next_in = reinterpret_cast<Bytef *>(const_cast<char *>(payload.data()));
+        stream.avail_in = static_cast<uInt>(payload.size());
+        stream.next_out = reinterpret_cast<Bytef *>(&compressed[4]);
+        stream.avail_out = static_cast<uInt>(bound);
+        int rc = deflate(&stream, Z_FINISH);
+        compressed.resize(4 + stream.total_out);
+        deflateEnd(&stream);
+        return rc == Z_STREAM_END;
+    }
+
+    uint64_t decompressedSize(const std::string &compressed)
+    {
+        return compressed.size() < 4 ? 0 : getUint32(compressed, 0);
+    }
+
+    bool decompressPayload(const std::string &compressed, std::string &payload, uint64_t maxSize, const std::string &dictionary)
+    {
+        if (compressed.size() < 4)
+            return false;
+        uint32_t size = getUint32(compressed, 0);
+        if (size > MAX_FRAME_SIZE * 16 || size > maxSize)
+            return false;
+
+        z_stream stream{};
+        if (inflateInit(&stream) != Z_OK)
+            return false;
+        payload.assign(size, '\0');
+        stream.next_in = reinterpret_cast<Bytef *>(const_cast<char *>(compressed.data() + 4));
+        stream.avail_in = static_cast<uInt>(compressed.size() - 4);
+        stream.next_out = reinterpret_cast<Bytef *>(&payload[0]);
+        stream.avail_out = size;
+
+        int rc = inflate(&stream, Z_FINISH);
+        if (rc == Z_NEED_DICT && !dictionary.empty())
+        {
+            // zlib checks the dictionary's Adler-32 against the one the stream was compressed with.
+            rc = inflateSetDictionary(&stream, reinterpret_cast<const Bytef *>(dictionary.data()), static_cast<uInt>(dictionary.size()));
+            if (rc == Z_OK)
+                rc = inflate(&stream, Z_FINISH);
+        }
+        bool ok = rc == Z_STREAM_END && stream.total_out == size;
+        inflateEnd(&stream);
+        return ok;
+    }
+
+} // namespace relay
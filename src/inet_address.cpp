@@ -0,0 +1,94 @@
+#include "../include/relay/inet_address.h"
+#include <arpa/inet.h>
+#include <cerrno>
+#include <cstdlib>
+#include <net/if.h>
+#include <unistd.h>
+
+namespace relay
+{
+
+    bool parseInetAddress(const std::string &ip, int port, InetAddress &address)
+    {
+        address = InetAddress{};
+        if (port < 0 || port > 65535)
+            return false;
+        auto *in4 = reinterpret_cast<sockaddr_in *>(&address.storage);
+        if (inet_pton(AF_INET, ip.c_str(), &in4->sin_addr) == 1)
+        {
+            in4->sin_family = AF_INET;
+            in4->sin_port = htons(static_cast<uint16_t>(port));
+            address.length = sizeof(sockaddr_in);
+            return true;
+        }
+
+        std::string host = ip;
+        if (host.size() > 2 && host.front() == '[' && host.back() == ']')
+            host = host.substr(1, host.size() - 2);
+        auto *in6 = reinterpret_cast<sockaddr_in6 *>(&address.storage);
+        size_t percent = host.find('%');
+        if (percent != std::string::npos)
+        {
+            std::string zone = host.substr(percent + 1);
+            host.resize(percent);
+            char *end = nullptr;
+            unsigned long index = std::strtoul(zone.c_str(), &end, 10);
+            in6->sin6_scope_id = !zone.empty() && *end == '\0' ? static_cast<uint32_t>(index) : if_nametoindex(zone.c_str());
+            if (in6->sin6_scope_id == 0)
+                return false;
+        }
+        if (inet_pton(AF_INET6, host.c_str(), &in6->sin6_addr) != 1)
+            return false;
+        in6->sin6_family = AF_INET6;
+        in6->sin6_port = htons(static_cast<uint16_t>(port));
+        address.length = sizeof(sockaddr_in6);
+        return true;
+    }
+
+    std::string formatInetAddress(const sockaddr *address)
+    {
+        char ip[INET6_ADDRSTRLEN] = "";
+        if (address->sa_family == AF_INET)
+        {
+            auto *in4 = reinterpret_cast<const sockaddr_in *>(address);
+            inet_ntop(AF_INET, &in4->sin_addr, ip, sizeof(ip));
+            return std::string(ip) + ":" + std::to_string(ntohs(in4->sin_port));
+        }
+        if (address->sa_family != AF_INET6)
+            return "";
+        auto *in6 = reinterpret_cast<const sockaddr_in6 *>(address);
+        std::string port = std::to_string(ntohs(in6->sin6_port));
+        if (IN6_IS_ADDR_V4MAPPED(&in6->sin6_addr))
+        {
+            inet_ntop(AF_INET, &in6->sin6_addr.s6_addr[12], ip, sizeof(ip));
+            return std::string(ip) + ":" + port;
+        }
+        inet_ntop(AF_INET6, &in6->sin6_addr, ip, sizeof(ip));
+        std::string host = ip;
+        char zone[IF_NAMESIZE];
+        if (in6->sin6_scope_id != 0)
+            host += "%" + std::string(if_indextoname(in6->sin6_scope_id, zone) ? zone : std::to_string(in6->sin6_scope_id));
+        return "[" + host + "]:" + port;
+    }
+
+    bool applyBindOptions(int fd, int family, const BindOptions &options)
+    {
+        int v6only = options.ipv6Only ? 1 : 0;
+        int reuse = 1;
+        return (family != AF_INET6 || setsockopt(fd, IPPROTO_IPV6, IPV6_V6ONLY, &v6only, sizeof(v6only)) == 0) &&
+               (!options.reuseAddress || setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &reuse, sizeof(reuse)) == 0) &&
+               (!options.reusePort || setsockopt(fd, SOL_SOCKET, SO_REUSEPORT, &reuse, sizeof(reuse)) == 0);
+    }
+
+    int openInetSocket(int family, int type, const BindOptions &options)
+    {
+        int fd = ::socket(family, type, 0);
+        if (fd == -1 || applyBindOptions(fd, family, options))
+            return fd;
+        int error = errno;
+        ::close(fd);
+        errno = error;
+        return -1;
+    }
+
+} // namespace relay
@@ -1,5 +1,10 @@
 #include "../include/relay/logger.h"
 
+#include <chrono>
+#include <ctime>
+#include <iomanip>
+#include <sstream>
+
 namespace relay
 {
 
@@ -82,7 +87,7 @@ namespace relay
         auto time = std::chrono::system_clock::to_time_t(now);
         std::ostringstream oss;
         oss << std::put_time(std::localtime(&time), "%Y-%m-%d %H:%M:%S");
-        return oss.string();
+        return oss.str();
     }
 
 } // namespace relay
\ No newline at end of file
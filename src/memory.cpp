@@ -0,0 +1,164 @@
+#include "../include/relay/memory.h"
+#include "../include/relay/logger.h"
+#include <algorithm>
+#include <cerrno>
+#include <condition_variable>
+#include <cstring>
+#include <deque>
+#include <mutex>
+#include <unordered_map>
+#include <fcntl.h>
+#include <sys/socket.h>
+#include <unistd.h>
+
+namespace relay
+{
+
+    struct MemoryListenerState
+    {
+        std::string name;
+        int readyPipe[2] = {-1, -1}; // One byte per connection waiting for accept().
+        std::mutex mutex;
+        std::condition_variable acceptReady;
+        std::deque<int> pending; // Server ends of connections waiting for accept().
+        int backlog = 128;
+        bool stopped = false;
+
+        ~MemoryListenerState()
+        {
+            for (int fd : pending)
+                ::close(fd);
+            for (int fd : readyPipe)
+                if (fd != -1)
+                    ::close(fd);
+        }
+    };
+
+    namespace
+    {
+        std::mutex registryMutex;
+        std::unordered_map<std::string, std::shared_ptr<MemoryListenerState>> registry;
+    }
+
+    bool isMemoryAddress(const std::string &address)
+    {
+        return address.compare(0, sizeof(MEMORY_SOCKET_PREFIX) - 1, MEMORY_SOCKET_PREFIX) == 0;
+    }
+
+    MemoryListener::MemoryListener(std::shared_ptr<MemoryListenerState> state) : state_(std::move(state)) {}
+
+    std::unique_ptr<MemoryListener> MemoryListener::open(const std::string &name, int &error)
+    {
+        if (name.empty())
+        {
+            error = EINVAL;
+            return nullptr;
+        }
+        auto state = std::make_shared<MemoryListenerState>();
+        state->name = name;
+        if (pipe(state->readyPipe) == -1)
+        {
+            error = errno;
+            return nullptr;
+        }
+        int flags = fcntl(state->readyPipe[0], F_GETFL, 0);
+        fcntl(state->readyPipe[0], F_SETFL, flags | O_NONBLOCK);
+
+        std::lock_guard<std::mutex> lock(registryMutex);
+        if (!registry.emplace(name, state).second)
+        {
+            error = EADDRINUSE;
+            return nullptr;
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Memory listener registered as " + name);
+        return std::unique_ptr<MemoryListener>(new MemoryListener(std::move(state)));
+    }
+
+    MemoryListener::~MemoryListener()
+    {
+        stop();
+    }
+
+    int MemoryListener::readyFd() const
+    {
+        return state_->readyPipe[0];
+    }
+
+    void MemoryListener::setBacklog(int backlog)
+    {
+        std::lock_guard<std::mutex> lock(state_->mutex);
+        state_->backlog = std::max(backlog, 1);
+    }
+
+    int MemoryListener::accept()
+    {
+        std::unique_lock<std::mutex> lock(state_->mutex);
+        state_->acceptReady.wait(lock, [this]
+                                 { return state_->stopped || !state_->pending.empty(); });
+        if (state_->stopped)
+            return -1;
+        int fd = state_->pending.front();
+        state_->pending.pop_front();
+        char byte;
+        (void)::read(state_->readyPipe[0], &byte, 1);
+        return fd;
+    }
+
+    void MemoryListener::stop()
+    {
+        {
+            std::lock_guard<std::mutex> lock(registryMutex);
+            auto it = registry.find(state_->name);
+            if (it != registry.end() && it->second == state_)
+                registry.erase(it);
+        }
+        {
+            std::lock_guard<std::mutex> lock(state_->mutex);
+            if (state_->stopped)
+                return;
+            state_->stopped = true;
+            for (int fd : state_->pending)
+                ::close(fd);
+            state_->pending.clear();
+        }
+        state_->acceptReady.notify_all();
+        // Leaves readyFd() readable, so a caller polling it goes on to accept() and learns of the stop.
+        char byte = 0;
+        (void)::write(state_->readyPipe[1], &byte, 1);
+    }
+
+    int connectMemory(const std::string &name, int &error)
+    {
+        std::shared_ptr<MemoryListenerState> state;
+        {
+            std::lock_guard<std::mutex> lock(registryMutex);
+            auto it = registry.find(name);
+            if (it != registry.end())
+                state = it->second;
+        }
+        if (!state)
+        {
+            error = ECONNREFUSED;
+            return -1;
+        }
+
+        std::lock_guard<std::mutex> lock(state->mutex);
+        if (state->stopped || state->pending.size() >= static_cast<size_t>(state->backlog))
+        {
+            error = ECONNREFUSED;
+            return -1;
+        }
+        int pair[2];
+        if (socketpair(AF_UNIX, SOCK_STREAM, 0, pair) == -1)
+        {
+            error = errno;
+            return -1;
+        }
+        state->pending.push_back(pair[0]);
+        char byte = 0;
+        (void)::write(state->readyPipe[1], &byte, 1);
+        state->acceptReady.notify_one();
+        return pair[1];
+    }
+
+} // namespace relay
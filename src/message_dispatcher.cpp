@@ -0,0 +1,110 @@
+#include "../include/relay/message_dispatcher.h"
+#include "../include/relay/logger.h"
+#include <poll.h>
+#include <vector>
+
+namespace relay
+{
+
+    namespace
+    {
+        /// How long the dispatcher waits for input before noticing new subscriptions and connections.
+        constexpr int DISPATCH_POLL_MS = 50;
+    }
+
+    MessageDispatcher::~MessageDispatcher()
+    {
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            stopping_ = true;
+        }
+        if (thread_.joinable())
+            thread_.join();
+    }
+
+    void MessageDispatcher::subscribe(Peer *peer, MessageHandler handler)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        subscribers_[peer] = Subscription{std::move(handler), ++generation_};
+        if (!thread_.joinable())
+            thread_ = std::thread(&MessageDispatcher::run, this);
+        awaitIdleLocked(lock, peer);
+    }
+
+    bool MessageDispatcher::unsubscribe(Peer *peer)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        bool subscribed = subscribers_.erase(peer) > 0;
+        awaitIdleLocked(lock, peer);
+        return subscribed;
+    }
+
+    void MessageDispatcher::awaitIdleLocked(std::unique_lock<std::mutex> &lock, Peer *peer)
+    {
+        if (std::this_thread::get_id() == thread_.get_id())
+            return;
+        idle_.wait(lock, [this, peer]
+                   { return dispatching_ != peer; });
+    }
+
+    void MessageDispatcher::run()
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        while (!stopping_)
+        {
+            // Poll every subscribed connection at once, unless a peer already holds input.
+            std::vector<Peer *> peers;
+            std::vector<pollfd> fds;
+            std::vector<size_t> firstFd;
+            bool pending = false;
+            for (const auto &entry : subscribers_)
+            {
+                peers.push_back(entry.first);
+                firstFd.push_back(fds.size());
+                pending = pending || entry.first->hasQueuedInbound();
+                for (int fd : entry.first->getConnectionFds())
+                    fds.push_back(pollfd{fd, POLLIN, 0});
+            }
+            firstFd.push_back(fds.size());
+            lock.unlock();
+            ::poll(fds.data(), fds.size(), pending ? 0 : DISPATCH_POLL_MS);
+            lock.lock();
+
+            for (size_t i = 0; i < peers.size() && !stopping_; i++)
+            {
+                Peer *peer = peers[i];
+                auto it = subscribers_.find(peer);
+                if (it == subscribers_.end())
+                    continue;
+                bool ready = false;
+                for (size_t fd = firstFd[i]; fd < firstFd[i + 1]; fd++)
+                    ready = ready || fds[fd].revents != 0;
+                if (!ready && !peer->hasQueuedInbound())
+                    continue;
+
+                // Receive and call the handler without holding mutex_, so handlers can subscribe
+                // and unsubscribe; dispatching_ keeps unsubscribe() from returning meanwhile.
+                Subscription subscription = it->second;
+                dispatching_ = peer;
+                lock.unlock();
+                std::string message;
+                bool urgent = false;
+                ReceiveStatus status = peer->receiveMessage(message, urgent, std::chrono::milliseconds(0));
+                bool ended = status == ReceiveStatus::CLOSED || status == ReceiveStatus::DESYNC || status == ReceiveStatus::IDLE;
+                if (status == ReceiveStatus::OK || ended)
+                    subscription.handler(status, message, urgent);
+                lock.lock();
+                dispatching_ = nullptr;
+                idle_.notify_all();
+
+                it = subscribers_.find(peer);
+                if (ended && it != subscribers_.end() && it->second.generation == subscription.generation)
+                {
+                    Logger::getInstance().log(LogLevel::INFO, "Stopped dispatching messages for peer " + peer->getId());
+                    subscribers_.erase(it);
+                }
+            }
+        }
+    }
+
+} // namespace relay
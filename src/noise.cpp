@@ -0,0 +1,615 @@
+#include "../include/relay/noise.h"
+#include "../include/relay/logger.h"
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+#include <openssl/sha.h>
+#include <algorithm>
+#include <sys/socket.h>
+#include <cerrno>
+#include <cstring>
+#include <fcntl.h>
+#include <stdexcept>
+
+namespace relay
+{
+
+    namespace
+    {
+        // Both names are exactly 32 bytes, the hash length, so they are used as the initial hash
+        // without hashing them (Noise specification, section 5.2).
+        const std::string XX_PROTOCOL = "Noise_XX_25519_ChaChaPoly_SHA256";
+        const std::string IK_PROTOCOL = "Noise_IK_25519_ChaChaPoly_SHA256";
+
+        constexpr size_t TAG_SIZE = 16;
+        constexpr size_t MAX_MESSAGE_SIZE = 65535;
+
+        // Handshake message sizes with empty payloads.
+        constexpr size_t XX_FIRST_SIZE = NOISE_KEY_SIZE;
+        constexpr size_t XX_SECOND_SIZE = NOISE_KEY_SIZE + NOISE_KEY_SIZE + TAG_SIZE + TAG_SIZE;
+        constexpr size_t XX_THIRD_SIZE = NOISE_KEY_SIZE + TAG_SIZE + TAG_SIZE;
+        constexpr size_t IK_FIRST_SIZE = NOISE_KEY_SIZE + NOISE_KEY_SIZE + TAG_SIZE + TAG_SIZE;
+        constexpr size_t IK_SECOND_SIZE = NOISE_KEY_SIZE + TAG_SIZE;
+
+        std::string sha256(const std::string &data)
+        {
+            unsigned char digest[SHA256_DIGEST_LENGTH];
+            SHA256(reinterpret_cast<const unsigned char *>(data.data()), data.size(), digest);
+            return std::string(reinterpret_cast<char *>(digest), sizeof(digest));
+        }
+
+        std::string hmacSha256(const std::string &key, const std::string &data)
+        {
+            unsigned char digest[EVP_MAX_MD_SIZE];
+            unsigned int len = 0;
+            HMAC(EVP_sha256(), key.data(), static_cast<int>(key.size()),
+                 reinterpret_cast<const unsigned char *>(data.data()), data.size(), digest, &len);
+            return std::string(reinterpret_cast<char *>(digest), len);
+        }
+
+        /// HKDF with two outputs, as defined in section 4.3 of the Noise specification.
+        std::pair<std::string, std::string> hkdf(const std::string &chainingKey, const std::string &input)
+        {
+            std::string tempKey = hmacSha256(chainingKey, input);
+            std::string first = hmacSha256(tempKey, std::string(1, '\x01'));
+            std::string second = hmacSha256(tempKey, first + '\x02');
+            return {first, second};
+        }
+
+        /// Returns the raw public key of a raw X25519 private key, or empty if it is unusable.
+        std::string publicKeyOf(const std::string &privateKey)
+        {
+            EVP_PKEY *key = EVP_PKEY_new_raw_private_key(EVP_PKEY_X25519, nullptr,
+                                                         reinterpret_cast<const unsigned char *>(privateKey.data()), privateKey.size());
+            if (!key)
+                return "";
+            std::string publicKey(NOISE_KEY_SIZE, '\0');
+            size_t len = publicKey.size();
+            bool ok = EVP_PKEY_get_raw_public_key(key, reinterpret_cast<unsigned char *>(&publicKey[0]), &len) == 1;
+            EVP_PKEY_free(key);
+            return ok && len == NOISE_KEY_SIZE ? publicKey : "";
+        }
+
+        /// Generates a raw X25519 private key, or returns empty on failure.
+        std::string generatePrivateKey()
+        {
+            EVP_PKEY_CTX *ctx = EVP_PKEY_CTX_new_id(EVP_PKEY_X25519, nullptr);
+            EVP_PKEY *key = nullptr;
+            if (!ctx || EVP_PKEY_keygen_init(ctx) != 1 || EVP_PKEY_keygen(ctx, &key) != 1)
+            {
+                EVP_PKEY_CTX_free(ctx);
+                return "";
+            }
+            EVP_PKEY_CTX_free(ctx);
+            std::string privateKey(NOISE_KEY_SIZE, '\0');
+            size_t len = privateKey.size();
+            bool ok = EVP_PKEY_get_raw_private_key(key, reinterpret_cast<unsigned char *>(&privateKey[0]), &len) == 1;
+            EVP_PKEY_free(key);
+            return ok && len == NOISE_KEY_SIZE ? privateKey : "";
+        }
+
+        /// X25519 key agreement. Fails for low-order public keys, whose shared secret is all zeros.
+        bool dh(const std::string &privateKey, const std::string &publicKey, std::string &shared)
+        {
+            EVP_PKEY *local = EVP_PKEY_new_raw_private_key(EVP_PKEY_X25519, nullptr,
+                                                           reinterpret_cast<const unsigned char *>(privateKey.data()), privateKey.size());
+            EVP_PKEY *remote = EVP_PKEY_new_raw_public_key(EVP_PKEY_X25519, nullptr,
+                                                           reinterpret_cast<const unsigned char *>(publicKey.data()), publicKey.size());
+            EVP_PKEY_CTX *ctx = local ? EVP_PKEY_CTX_new(local, nullptr) : nullptr;
+            shared.assign(NOISE_KEY_SIZE, '\0');
+            size_t len = shared.size();
+            bool ok = ctx && remote && EVP_PKEY_derive_init(ctx) == 1 && EVP_PKEY_derive_set_peer(ctx, remote) == 1 &&
+                      EVP_PKEY_derive(ctx, reinterpret_cast<unsigned char *>(&shared[0]), &len) == 1 && len == NOISE_KEY_SIZE;
+            EVP_PKEY_CTX_free(ctx);
+            EVP_PKEY_free(remote);
+            EVP_PKEY_free(local);
+            return ok;
+        }
+
+        /**
+         * @brief A key and nonce for ChaCha20-Poly1305 (Noise specification, section 5.1).
+         */
+        class CipherState
+        {
+        public:
+            void initialize(const std::string &key)
+            {
+                key_ = key;
+                nonce_ = 0;
+            }
+
+            bool hasKey() const { return !key_.empty(); }
+
+            /// Encrypts plaintext into out, tag appended. Fails once the nonces are used up.
+            bool encrypt(const std::string &ad, const std::string &plaintext, std::string &out)
+            {
+                // The nonce 2^64-1 is reserved for rekey().
+                if (nonce_ == UINT64_MAX || !apply(true, nonce_, ad, plaintext, out))
+                    return false;
+                nonce_++;
+                return true;
+            }
+
+            /// Decrypts and authenticates ciphertext into out.
+            bool decrypt(const std::string &ad, const std::string &ciphertext, std::string &out)
+            {
+                if (nonce_ == UINT64_MAX || ciphertext.size() < TAG_SIZE || !apply(false, nonce_, ad, ciphertext, out))
+                    return false;
+                nonce_++;
+                return true;
+            }
+
+            /// Takes back the nonce of the last encrypt(), whose output was never sent.
+            void rewind() { nonce_--; }
+
+            /// Replaces the key with one derived from it, keeping the nonce (section 11.3).
+            bool rekey()
+            {
+                std::string out;
+                if (!apply(true, UINT64_MAX, "", std::string(NOISE_KEY_SIZE, '\0'), out))
+                    return false;
+                key_ = out.substr(0, NOISE_KEY_SIZE);
+                return true;
+            }
+
+        private:
+            std::string key_;
+            uint64_t nonce_ = 0;
+
+            bool apply(bool encrypting, uint64_t nonce, const std::string &ad, const std::string &in, std::string &out)
+            {
+                unsigned char iv[12] = {0};
+                for (int i = 0; i < 8; i++)
+                    iv[4 + i] = static_cast<unsigned char>(nonce >> (8 * i));
+                size_t textLen = encrypting ? in.size() : in.size() - TAG_SIZE;
+                out.assign(textLen + (encrypting ? TAG_SIZE : 0), '\0');
+
+                EVP_CIPHER_CTX *ctx = EVP_CIPHER_CTX_new();
+                auto key = reinterpret_cast<const unsigned char *>(key_.data());
+                auto input = reinterpret_cast<const unsigned char *>(in.data());
+                auto output = reinterpret_cast<unsigned char *>(&out[0]);
+                int len = 0;
+                bool ok = ctx && EVP_CipherInit_ex(ctx, EVP_chacha20_poly1305(), nullptr, key, iv, encrypting ? 1 : 0) == 1 &&
+                          EVP_CipherUpdate(ctx, nullptr, &len, reinterpret_cast<const unsigned char *>(ad.data()), static_cast<int>(ad.size())) == 1 &&
+                          EVP_CipherUpdate(ctx, output, &len, input, static_cast<int>(textLen)) == 1;
+                if (ok && !encrypting)
+                    ok = EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_AEAD_SET_TAG, TAG_SIZE, const_cast<unsigned char *>(input + textLen)) == 1;
+                ok = ok && EVP_CipherFinal_ex(ctx, output + len, &len) == 1;
+                if (ok && encrypting)
+                    ok = EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_AEAD_GET_TAG, TAG_SIZE, output + textLen) == 1;
+                EVP_CIPHER_CTX_free(ctx);
+                return ok;
+            }
+        };
+
+        /**
+         * @brief The chaining key, handshake hash and cipher of a handshake (section 5.2).
+         */
+        class SymmetricState
+        {
+        public:
+            explicit SymmetricState(const std::string &protocol) : hash_(protocol), chainingKey_(protocol)
+            {
+                mixHash(""); // Empty prologue
+            }
+
+            void mixHash(const std::string &data) { hash_ = sha256(hash_ + data); }
+
+            void mixKey(const std::string &input)
+            {
+                auto keys = hkdf(chainingKey_, input);
+                chainingKey_ = keys.first;
+                cipher_.initialize(keys.second);
+            }
+
+            /// Mixes a DH result into the keys; fails if the key agreement does.
+            bool mixDh(const std::string &privateKey, const std::string &publicKey)
+            {
+                std::string shared;
+                if (!dh(privateKey, publicKey, shared))
+                    return false;
+                mixKey(shared);
+                return true;
+            }
+
+            bool encryptAndHash(const std::string &plaintext, std::string &out)
+            {
+                std::string ciphertext = plaintext;
+                if (cipher_.hasKey() && !cipher_.encrypt(hash_, plaintext, ciphertext))
+                    return false;
+                mixHash(ciphertext);
+                out += ciphertext;
+                return true;
+            }
+
+            bool decryptAndHash(const std::string &ciphertext, std::string &out)
+            {
+                out = ciphertext;
+                if (cipher_.hasKey() && !cipher_.decrypt(hash_, ciphertext, out))
+                    return false;
+                mixHash(ciphertext);
+                return true;
+            }
+
+            /// Derives the transport ciphers: first for initiator-to-responder messages.
+            void split(CipherState &first, CipherState &second) const
+            {
+                auto keys = hkdf(chainingKey_, "");
+                first.initialize(keys.first);
+                second.initialize(keys.second);
+            }
+
+        private:
+            std::string hash_;
+            std::string chainingKey_;
+            CipherState cipher_;
+        };
+
+        using handshake::Deadline;
+
+        /// Sends one length-prefixed handshake message.
+        bool sendMessage(int fd, const std::string &message, Deadline deadline, int &error)
+        {
+            std::string data;
+            data += static_cast<char>(message.size() >> 8);
+            data += static_cast<char>(message.size() & 0xff);
+            return handshake::sendAll(fd, data + message, deadline, error);
+        }
+
+        /// Receives one length-prefixed handshake message.
+        bool receiveMessage(int fd, std::string &message, Deadline deadline, int &error)
+        {
+            std::string header;
+            if (!handshake::receiveExactly(fd, 2, header, deadline, error))
+                return false;
+            size_t len = (static_cast<unsigned char>(header[0]) << 8) | static_cast<unsigned char>(header[1]);
+            return handshake::receiveExactly(fd, len, message, deadline, error);
+        }
+
+        /**
+         * @brief SecureChannel over a completed Noise handshake.
+         */
+        class NoiseChannel : public SecureChannel
+        {
+        public:
+            NoiseChannel(int socketFd, CipherState sender, CipherState receiver, std::string remoteKey)
+                : socketFd_(socketFd), sender_(std::move(sender)), receiver_(std::move(receiver)), remoteKey_(std::move(remoteKey)) {}
+
+            ssize_t read(char *buffer, size_t len) override
+            {
+                while (plaintext_.empty())
+                {
+                    if (failed_)
+                    {
+                        errno = EPROTO;
+                        return -1;
+                    }
+                    if (hasRecord())
+                    {
+                        size_t recordLen = recordLength();
+                        if (!receiver_.decrypt("", inbound_.substr(2, recordLen), plaintext_) ||
+                            (plaintext_.empty() && !rekeyed()))
+                        {
+                            failed_ = true;
+                            Logger::getInstance().log(LogLevel::ERROR, "Noise error: failed to decrypt message");
+                            errno = EPROTO;
+                            return -1;
+                        }
+                        inbound_.erase(0, 2 + recordLen);
+                        continue;
+                    }
+                    char chunk[16 * 1024];
+                    ssize_t received;
+                    do
+                        received = ::recv(socketFd_, chunk, sizeof(chunk), 0);
+                    while (received == -1 && errno == EINTR);
+                    if (received == -1)
+                        return -1;
+                    if (received == 0)
+                    {
+                        if (inbound_.empty())
+                            return 0;
+                        failed_ = true;
+                        Logger::getInstance().log(LogLevel::ERROR, "Noise error: connection closed inside a message");
+                        errno = EPROTO;
+                        return -1;
+                    }
+                    inbound_.append(chunk, static_cast<size_t>(received));
+                }
+                size_t n = std::min(len, plaintext_.size());
+                std::memcpy(buffer, plaintext_.data(), n);
+                plaintext_.erase(0, n);
+                return static_cast<ssize_t>(n);
+            }
+
+            ssize_t write(const char *data, size_t len) override
+            {
+                if (failed_)
+                {
+                    errno = EPIPE;
+                    return -1;
+                }
+                // Rotate this direction's keys, as the remote end asked, before sending more under them.
+                if (replyDue_ && !rotateSender())
+                    return -1;
+                size_t n = std::min(len, MAX_MESSAGE_SIZE - TAG_SIZE);
+                return sendRecord(std::string(data, n)) ? static_cast<ssize_t>(n) : -1;
+            }
+
+            bool rekey() override
+            {
+                if (failed_)
+                {
+                    errno = EPIPE;
+                    return false;
+                }
+                // A rotation the remote end asked for is answered by this one.
+                bool answering = replyDue_;
+                if (!rotateSender())
+                    return false;
+                awaitingReply_ = !answering;
+                return true;
+            }
+
+            bool hasPending() const override
+            {
+                return !plaintext_.empty() || hasRecord();
+            }
+
+            void shutdown() override
+            {
+                // Noise has no closing message; shutting the socket down ends the channel.
+            }
+
+            std::string remoteIdentity() const override
+            {
+                return remoteKey_;
+            }
+
+        private:
+            int socketFd_;
+            CipherState sender_;
+            CipherState receiver_;
+            std::string remoteKey_;
+            std::string inbound_;        ///< Received bytes not yet decrypted.
+            std::string plaintext_;      ///< Decrypted bytes not yet returned by read().
+            bool failed_ = false;        ///< Decryption failed or a message was cut short.
+            bool awaitingReply_ = false; ///< rekey() asked the remote end to rotate its keys too.
+            bool replyDue_ = false;      ///< The remote end rotated its keys and awaits the same from this end.
+
+            size_t recordLength() const
+            {
+                return (static_cast<unsigned char>(inbound_[0]) << 8) | static_cast<unsigned char>(inbound_[1]);
+            }
+
+            bool hasRecord() const
+            {
+                return inbound_.size() >= 2 && inbound_.size() >= 2 + recordLength();
+            }
+
+            // A record with an empty plaintext, which write() never sends, marks where its sender
+            // rotated its keys; the records after it use the new ones.
+
+            /// Handles a rekey marker read from the remote end.
+            bool rekeyed()
+            {
+                if (!receiver_.rekey())
+                    return false;
+                if (awaitingReply_)
+                    awaitingReply_ = false;
+                else
+                    replyDue_ = true;
+                return true;
+            }
+
+            /// Sends a rekey marker and rotates the sending keys after it.
+            bool rotateSender()
+            {
+                if (!sendRecord(""))
+                    return false;
+                if (!sender_.rekey())
+                {
+                    failed_ = true;
+                    errno = EPROTO;
+                    return false;
+                }
+                replyDue_ = false;
+                return true;
+            }
+
+            /// Encrypts and sends one record, like write().
+            bool sendRecord(const std::string &plaintext)
+            {
+                std::string ciphertext;
+                if (!sender_.encrypt("", plaintext, ciphertext))
+                {
+                    failed_ = true;
+                    errno = EPROTO;
+                    return false;
+                }
+                std::string record;
+                record += static_cast<char>(ciphertext.size() >> 8);
+                record += static_cast<char>(ciphertext.size() & 0xff);
+                record += ciphertext;
+                size_t total = 0;
+                while (total < record.size())
+                {
+                    ssize_t sent = ::send(socketFd_, record.data() + total, record.size() - total, MSG_NOSIGNAL);
+                    if (sent >= 0)
+                    {
+                        total += static_cast<size_t>(sent);
+                        continue;
+                    }
+                    if (errno == EINTR)
+                        continue;
+                    // An unsent message can be encrypted again under the same nonce; a partly
+                    // sent one leaves the remote end expecting the rest.
+                    if (total == 0)
+                        sender_.rewind();
+                    else
+                        failed_ = true;
+                    return false;
+                }
+                return true;
+            }
+        };
+    }
+
+    NoiseContext::NoiseContext(NoiseSettings settings) : settings_(std::move(settings))
+    {
+        if (settings_.staticPrivateKey.size() != NOISE_KEY_SIZE)
+            throw std::invalid_argument("Noise private key must be " + std::to_string(NOISE_KEY_SIZE) + " bytes");
+        for (const auto &key : settings_.remoteStaticKeys)
+            if (key.size() != NOISE_KEY_SIZE)
+                throw std::invalid_argument("Noise public keys must be " + std::to_string(NOISE_KEY_SIZE) + " bytes");
+        publicKey_ = publicKeyOf(settings_.staticPrivateKey);
+        if (publicKey_.empty())
+            throw std::invalid_argument("Invalid Noise private key");
+    }
+
+    bool NoiseContext::authenticatesPeer() const
+    {
+        return !settings_.remoteStaticKeys.empty();
+    }
+
+    const std::string &NoiseContext::getPublicKey() const
+    {
+        return publicKey_;
+    }
+
+    std::unique_ptr<SecureChannel> NoiseContext::handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const
+    {
+        error = EPROTO;
+        int flags = fcntl(socketFd, F_GETFL, 0);
+        if (flags == -1 || fcntl(socketFd, F_SETFL, flags | O_NONBLOCK) == -1)
+        {
+            error = errno;
+            return nullptr;
+        }
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        const std::string &s = settings_.staticPrivateKey;
+        std::string e = generatePrivateKey();
+        std::string ePublic = publicKeyOf(e);
+        std::string re, rs, message, payload;
+        CipherState first, second;
+        bool ok = !ePublic.empty();
+
+        // Each step below is one token of the handshake pattern: "e", "s", "ee", "es", "se", "ss".
+        if (ok && !server)
+        {
+            bool ik = settings_.remoteStaticKeys.size() == 1;
+            SymmetricState state(ik ? IK_PROTOCOL : XX_PROTOCOL);
+            if (ik)
+            {
+                // IK: <- s ... -> e, es, s, ss  <- e, ee, se
+                rs = settings_.remoteStaticKeys[0];
+                state.mixHash(rs);
+                message = ePublic;
+                state.mixHash(ePublic);
+                ok = state.mixDh(e, rs) && state.encryptAndHash(publicKey_, message) && state.mixDh(s, rs) &&
+                     state.encryptAndHash("", message) && sendMessage(socketFd, message, deadline, error) &&
+                     receiveMessage(socketFd, message, deadline, error) && message.size() >= IK_SECOND_SIZE;
+                if (ok)
+                {
+                    re = message.substr(0, NOISE_KEY_SIZE);
+                    state.mixHash(re);
+                    ok = state.mixDh(e, re) && state.mixDh(s, re) &&
+                         state.decryptAndHash(message.substr(NOISE_KEY_SIZE), payload);
+                }
+            }
+            else
+            {
+                // XX: -> e  <- e, ee, s, es  -> s, se
+                message = ePublic;
+                state.mixHash(ePublic);
+                ok = state.encryptAndHash("", message) && sendMessage(socketFd, message, deadline, error) &&
+                     receiveMessage(socketFd, message, deadline, error) && message.size() >= XX_SECOND_SIZE;
+                if (ok)
+                {
+                    re = message.substr(0, NOISE_KEY_SIZE);
+                    state.mixHash(re);
+                    ok = state.mixDh(e, re) &&
+                         state.decryptAndHash(message.substr(NOISE_KEY_SIZE, NOISE_KEY_SIZE + TAG_SIZE), rs) &&
+                         state.mixDh(e, rs) &&
+                         state.decryptAndHash(message.substr(2 * NOISE_KEY_SIZE + TAG_SIZE), payload);
+                }
+                if (ok && !settings_.remoteStaticKeys.empty() &&
+                    std::find(settings_.remoteStaticKeys.begin(), settings_.remoteStaticKeys.end(), rs) == settings_.remoteStaticKeys.end())
+                {
+                    error = EACCES;
+                    ok = false;
+                }
+                if (ok)
+                {
+                    message.clear();
+                    ok = state.encryptAndHash(publicKey_, message) && state.mixDh(s, re) &&
+                         state.encryptAndHash("", message) && sendMessage(socketFd, message, deadline, error);
+                }
+            }
+            if (ok)
+                state.split(first, second);
+        }
+        else if (ok)
+        {
+            ok = receiveMessage(socketFd, message, deadline, error);
+            // Connecting ends send no payloads, so the first message's size tells the patterns apart.
+            bool ik = message.size() == IK_FIRST_SIZE;
+            ok = ok && (ik || message.size() == XX_FIRST_SIZE);
+            SymmetricState state(ik ? IK_PROTOCOL : XX_PROTOCOL);
+            if (ok && ik)
+            {
+                state.mixHash(publicKey_);
+                re = message.substr(0, NOISE_KEY_SIZE);
+                state.mixHash(re);
+                ok = state.mixDh(s, re) &&
+                     state.decryptAndHash(message.substr(NOISE_KEY_SIZE, NOISE_KEY_SIZE + TAG_SIZE), rs) &&
+                     state.mixDh(s, rs) &&
+                     state.decryptAndHash(message.substr(2 * NOISE_KEY_SIZE + TAG_SIZE), payload);
+            }
+            else if (ok)
+            {
+                re = message;
+                state.mixHash(re);
+                ok = state.decryptAndHash("", payload);
+                message = ePublic;
+                state.mixHash(ePublic);
+                ok = ok && state.mixDh(e, re) && state.encryptAndHash(publicKey_, message) && state.mixDh(s, re) &&
+                     state.encryptAndHash("", message) && sendMessage(socketFd, message, deadline, error) &&
+                     receiveMessage(socketFd, message, deadline, error) && message.size() >= XX_THIRD_SIZE &&
+                     state.decryptAndHash(message.substr(0, NOISE_KEY_SIZE + TAG_SIZE), rs) && state.mixDh(e, rs) &&
+                     state.decryptAndHash(message.substr(NOISE_KEY_SIZE + TAG_SIZE), payload);
+            }
+            if (ok && !settings_.remoteStaticKeys.empty() &&
+                std::find(settings_.remoteStaticKeys.begin(), settings_.remoteStaticKeys.end(), rs) == settings_.remoteStaticKeys.end())
+            {
+                error = EACCES;
+                ok = false;
+            }
+            if (ok && ik)
+            {
+                message = ePublic;
+                state.mixHash(ePublic);
+                ok = state.mixDh(e, re) && state.mixDh(e, rs) && state.encryptAndHash("", message) &&
+                     sendMessage(socketFd, message, deadline, error);
+            }
+            if (ok)
+                state.split(first, second);
+        }
+        fcntl(socketFd, F_SETFL, flags);
+
+        if (!ok)
+        {
+            if (error == EACCES)
+                Logger::getInstance().log(LogLevel::ERROR, "Noise handshake failed: remote static key rejected");
+            else if (error == ETIMEDOUT)
+                Logger::getInstance().log(LogLevel::ERROR, "Noise handshake timed out");
+            else
+                Logger::getInstance().log(LogLevel::ERROR, "Noise handshake failed");
+            return nullptr;
+        }
+        error = 0;
+        if (server)
+            return std::make_unique<NoiseChannel>(socketFd, std::move(second), std::move(first), rs);
+        return std::make_unique<NoiseChannel>(socketFd, std::move(first), std::move(second), rs);
+    }
+
+} // namespace relay
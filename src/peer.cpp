@@ -1,7 +1,11 @@
 #include "../include/relay/peer.h"
 #include "../include/relay/logger.h"
+#include "../include/relay/inet_address.h"
 #include <iostream>
 #include <mutex>
+#include <algorithm>
+#include <thread>
+#include <poll.h>
 
 namespace relay
 {
@@ -88,24 +92,224 @@ namespace relay
     {
         std::lock_guard<std::mutex> lock(mutex_);
 
+        if (circuitRejectsLocked())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Circuit open, not sending message to peer: " + id_);
+            return false;
+        }
+
+        bool sent = sendLocked(message);
+        recordSendResultLocked(sent);
+        return sent;
+    }
+
+    bool Peer::sendBatch(const std::vector<std::string> &messages, bool compress)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (messages.empty())
+            return true;
+
+        if (circuitRejectsLocked())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Circuit open, not sending batch to peer: " + id_);
+            return false;
+        }
+
+        Frame frame;
+        frame.type = FrameType::BATCH;
+        frame.payload = encodeBatch(messages);
+        if (compress)
+        {
+            std::string compressed;
+            if (!compressPayload(frame.payload, compressed, compressionDictionary_, compressionLevel_))
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to compress batch for peer: " + id_);
+                return false;
+            }
+            Logger::getInstance().log(LogLevel::INFO, "Compressed batch for peer " + id_ + " from " + std::to_string(frame.payload.size()) + " to " + std::to_string(compressed.size()) + " bytes");
+            frame.payload = std::move(compressed);
+            frame.flags |= FRAME_COMPRESSED;
+        }
+
+        bool sent = sendFrameLocked(frame, static_cast<int>(messages.size()));
+        recordSendResultLocked(sent);
+        return sent;
+    }
+
+    bool Peer::sendUrgent(const std::string &message)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+
+        if (circuitRejectsLocked())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Circuit open, not sending urgent message to peer: " + id_);
+            return false;
+        }
+
+        Frame frame;
+        frame.type = FrameType::URGENT;
+        frame.payload = message;
+        bool sent = sendFrameLocked(frame, 1);
+        recordSendResultLocked(sent);
+        if (sent)
+            Logger::getInstance().log(LogLevel::DEBUG, "Sent urgent message of " + std::to_string(message.size()) + " bytes to peer " + id_);
+        return sent;
+    }
+
+    bool Peer::sendUnreliable(const std::string &message)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+
+        if (circuitRejectsLocked())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Circuit open, not sending unreliable message to peer: " + id_);
+            return false;
+        }
+
+        Frame frame;
+        frame.payload = message;
+        if (replayWindow_.count() == 0)
+            frame.flags |= FRAME_UNRELIABLE;
+        bool sent = sendFrameLocked(frame, 1);
+        recordSendResultLocked(sent);
+        return sent;
+    }
+
+    void Peer::setCompressionDictionary(const std::string &dictionary)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        compressionDictionary_ = dictionary;
+    }
+
+    void Peer::setCompressionLevel(int level)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        compressionLevel_ = std::clamp(level, MIN_COMPRESSION_LEVEL, MAX_COMPRESSION_LEVEL);
+    }
+
+    int Peer::getCompressionLevel() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return compressionLevel_;
+    }
+
+    void Peer::setCompressionThreshold(uint64_t bytes)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        compressionThreshold_ = bytes;
+    }
+
+    void Peer::getCompressionStats(uint64_t &messages, uint64_t &bytesIn, uint64_t &bytesOut) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        messages = compressedMessages_;
+        bytesIn = compressedBytesIn_;
+        bytesOut = compressedBytesOut_;
+    }
+
+    void Peer::compressMessageLocked(Frame &frame, const SocketWrapper *connection)
+    {
+        if (compressionThreshold_ == 0 || frame.payload.size() < compressionThreshold_)
+            return;
+        if (connection && connection->isSecured() && !(connection->getRemoteHello().flags & HELLO_ZLIB))
+            return;
+        std::string compressed;
+        if (!compressPayload(frame.payload, compressed, compressionDictionary_, compressionLevel_) ||
+            compressed.size() >= frame.payload.size())
+            return;
+        compressedMessages_++;
+        compressedBytesIn_ += frame.payload.size();
+        compressedBytesOut_ += compressed.size();
+        frame.payload = std::move(compressed);
+        frame.flags |= FRAME_COMPRESSED;
+    }
+
+    bool Peer::sendTracked(const std::string &message, uint64_t receiptId)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+
+        if (circuitRejectsLocked())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Circuit open, not sending tracked message to peer: " + id_);
+            return false;
+        }
+
+        Frame frame;
+        frame.payload = message;
+        compressMessageLocked(frame, socket_.get());
+        trackFrame(frame, receiptId);
+        bool sent = sendFrameLocked(frame, 1);
+        recordSendResultLocked(sent);
+        if (sent)
+            Logger::getInstance().log(LogLevel::DEBUG, "Sent tracked message " + std::to_string(receiptId) + " of " + std::to_string(message.size()) + " bytes to peer " + id_);
+        return sent;
+    }
+
+    std::vector<uint64_t> Peer::pollReceipts(std::chrono::milliseconds timeout, size_t maxReceipts)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        auto socket = socket_;
+        if (receipts_.empty() && socket && socket->getMode() == SocketMode::TCP_CLIENT)
+        {
+            // Wait without holding mutex_ so sends are not held up; waitReadable() does not lock the socket either.
+            lock.unlock();
+            bool readable = socket->hasBufferedData() || socket->waitReadable(timeout);
+            lock.lock();
+            if (readable && receipts_.empty() && socket_ == socket)
+                readFrameLocked();
+        }
+
+        size_t count = std::min(maxReceipts, receipts_.size());
+        std::vector<uint64_t> ids(receipts_.begin(), receipts_.begin() + count);
+        receipts_.erase(receipts_.begin(), receipts_.begin() + count);
+        return ids;
+    }
+
+    bool Peer::sendLocked(const std::string &message)
+    {
+        if (message.size() > MAX_UNFRAGMENTED_SIZE)
+        {
+            if (!sendFragmentsLocked(message, [this](Frame fragment)
+                                     { return sendFrameLocked(std::move(fragment), 0); }))
+                return false;
+            messagesSent_++;
+            Logger::getInstance().log(LogLevel::INFO, "Sent fragmented message of " + std::to_string(message.size()) + " bytes to peer " + id_);
+            return true;
+        }
+        Frame frame;
+        frame.payload = message;
+        compressMessageLocked(frame, socket_.get());
+        if (!sendFrameLocked(frame, 1))
+            return false;
+        Logger::getInstance().log(LogLevel::DEBUG, "Sent message of " + std::to_string(message.size()) + " bytes to peer " + id_);
+        return true;
+    }
+
+    bool Peer::sendFrameLocked(Frame frame, int messageCount)
+    {
+        prepareFrameLocked(frame);
         if (!socket_ || !socket_->isOpen())
         {
             isConnected_ = false;
             Logger::getInstance().log(LogLevel::WARNING, "Cannot send message, socket closed for Peer: " + id_);
             return false;
         }
+        if (frame.payload.size() > MAX_FRAME_SIZE)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Frame too large for peer " + id_ + ": " + std::to_string(frame.payload.size()) + " bytes");
+            return false;
+        }
 
         try
         {
             lastSent_ = std::chrono::steady_clock::now();
-            size_t sent = socket_->send(message);
+            size_t sent = socket_->sendFrame(frame);
 
             if (sent > 0)
             {
-                messagesSent_++;
+                messagesSent_ += messageCount;
                 bytesSent_ += sent;
                 isConnected_ = true;
-                Logger::getInstance().log(LogLevel::INFO, "Sent message to peer " + id_ + ": " + message);
                 return true;
             }
         }
@@ -113,97 +317,1597 @@ namespace relay
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to send message to peer: " + id_ + ": " + e.what());
         }
+        recordEventLocked(PeerEventKind::ERROR, PeerEventReason::SEND_FAILED, socket_.get());
+        if (!socket_->isOpen())
+            recordEventLocked(PeerEventKind::DISCONNECTED, PeerEventReason::CLOSED, socket_.get());
         return false;
     }
 
-    std::string Peer::receiveMessage()
+    bool Peer::sendFragmentsLocked(const std::string &message, const std::function<bool(Frame)> &send)
+    {
+        uint32_t index = 0;
+        for (size_t offset = 0; offset < message.size(); offset += FRAGMENT_DATA_SIZE)
+        {
+            Frame fragment;
+            fragment.type = FrameType::FRAGMENT;
+            fragment.payload = encodeFragment(index++, message.size(), std::string_view(message).substr(offset, FRAGMENT_DATA_SIZE));
+            if (!send(std::move(fragment)))
+                return false;
+        }
+        return true;
+    }
+
+    void Peer::setCircuitBreaker(int failureThreshold, std::chrono::milliseconds cooldown)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        circuitThreshold_ = failureThreshold > 0 ? failureThreshold : 0;
+        circuitCooldown_ = cooldown;
+        consecutiveFailures_ = 0;
+        circuitOpen_ = false;
+    }
+
+    bool Peer::isCircuitOpen() const
     {
         std::lock_guard<std::mutex> lock(mutex_);
+        return circuitRejectsLocked();
+    }
+
+    bool Peer::circuitRejectsLocked() const
+    {
+        if (circuitThreshold_ == 0 || !circuitOpen_)
+            return false;
+        // Once the cooldown has passed the circuit is half-open and lets a trial send through.
+        return std::chrono::steady_clock::now() - circuitOpenedAt_ < circuitCooldown_;
+    }
+
+    void Peer::recordSendResultLocked(bool sent)
+    {
+        if (circuitThreshold_ == 0)
+            return;
+        if (sent)
+        {
+            if (circuitOpen_)
+                Logger::getInstance().log(LogLevel::INFO, "Circuit closed for peer: " + id_);
+            consecutiveFailures_ = 0;
+            circuitOpen_ = false;
+            return;
+        }
+
+        consecutiveFailures_++;
+        if (circuitOpen_ || consecutiveFailures_ >= circuitThreshold_)
+        {
+            // A failed half-open trial re-opens the circuit for another cooldown.
+            if (!circuitOpen_)
+                Logger::getInstance().log(LogLevel::WARNING, "Circuit opened for peer " + id_ + " after " + std::to_string(consecutiveFailures_) + " consecutive send failures");
+            circuitOpen_ = true;
+            circuitOpenedAt_ = std::chrono::steady_clock::now();
+        }
+    }
+
+    std::string Peer::receiveMessage()
+    {
+        std::string message;
+        receiveMessage(message);
+        return message;
+    }
+
+    ReceiveStatus Peer::receiveMessage(std::string &message)
+    {
+        bool urgent = false;
+        return receiveMessage(message, urgent);
+    }
+
+    ReceiveStatus Peer::receiveMessage(std::string &message, bool &urgent)
+    {
+        return receiveMessage(message, urgent, std::chrono::milliseconds(-1));
+    }
+
+    ReceiveStatus Peer::receiveMessage(std::string &message, bool &urgent, std::chrono::milliseconds wait)
+    {
+        uint64_t clientId = 0;
+        return receiveMessage(message, urgent, wait, clientId);
+    }
+
+    ReceiveStatus Peer::receiveMessage(std::string &message, bool &urgent, std::chrono::milliseconds wait, uint64_t &clientId)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+
+        std::optional<std::chrono::steady_clock::time_point> deadline;
+        if (wait.count() >= 0)
+            deadline = std::chrono::steady_clock::now() + wait;
+        if (!fillMessageQueueLocked(lock, deadline))
+            return readStatus_;
+        urgent = !urgentQueue_.empty();
+        auto &queue = urgent ? urgentQueue_ : messageQueue_;
+        message = std::move(queue.front().data);
+        clientId = queue.front().clientId;
+        queue.pop();
+        if (--queuedFrom_[clientId] == 0)
+            queuedFrom_.erase(clientId);
+        lastReceived_ = std::chrono::steady_clock::now();
+        messagesReceived_++;
+        bytesReceived_ += message.size();
+        updateLatency();
+        isConnected_ = true;
+        return ReceiveStatus::OK;
+    }
+
+    bool Peer::waitWritable(std::chrono::milliseconds timeout) const
+    {
+        std::vector<std::shared_ptr<SocketWrapper>> connections;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            if (!socket_ || !socket_->isOpen())
+                return false;
+            if (socket_->getMode() == SocketMode::TCP_SERVER)
+                connections = clients_;
+            else
+                connections.push_back(socket_);
+        }
+
+        // Wait without holding mutex_, like SocketWrapper::waitReadable(), so a blocked send elsewhere
+        // does not stall the wait.
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        for (const auto &connection : connections)
+        {
+            if (!connection->isOpen())
+                continue;
+            auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            if (!connection->waitWritable(std::max(remaining, std::chrono::milliseconds(0))))
+                return false;
+        }
+        return true;
+    }
+
+    bool Peer::peekMessage(std::string &message)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        if (!fillMessageQueueLocked(lock))
+            return false;
+        message = urgentQueue_.empty() ? messageQueue_.front().data : urgentQueue_.front().data;
+        return true;
+    }
+
+    bool Peer::fillMessageQueueLocked(std::unique_lock<std::mutex> &lock, std::optional<std::chrono::steady_clock::time_point> deadline)
+    {
+        // Reads only start once data has arrived, so the receive timeout that SO_RCVTIMEO would
+        // put on a blocking read bounds the wait instead, and fails the receive as it did.
+        bool receiveTimeout = !deadline && socketOptions_.receiveTimeout.count() > 0;
+        if (receiveTimeout)
+            deadline = std::chrono::steady_clock::now() + socketOptions_.receiveTimeout;
+        while (messageQueue_.empty() && urgentQueue_.empty())
+        {
+            if (!awaitInboundLocked(lock, deadline))
+            {
+                if (receiveTimeout && readStatus_ == ReceiveStatus::TIMEOUT)
+                    readStatus_ = ReceiveStatus::FAILED;
+                return false;
+            }
+            if (!readFrameLocked(true))
+                return false;
+        }
+
+        // Read frames that have already arrived, so an urgent message right behind them is not
+        // held up by the messages queued ahead of it.
+        for (size_t i = 0; i < URGENT_READ_AHEAD && urgentQueue_.empty(); i++)
+        {
+            if (!readReadyFrameLocked())
+                break;
+        }
+        return true;
+    }
+
+    bool Peer::awaitInboundLocked(std::unique_lock<std::mutex> &lock, std::optional<std::chrono::steady_clock::time_point> deadline)
+    {
+        bool idleTimeout = readIdleTimeout_.count() > 0;
+        std::optional<std::chrono::steady_clock::time_point> until = deadline;
+        while (true)
+        {
+            if (!socket_ || !socket_->isOpen())
+                return true;
+
+            // The connections are held by shared_ptr, so they outlive a close while mutex_ is released.
+            std::vector<std::shared_ptr<SocketWrapper>> connections;
+            if (socket_->getMode() == SocketMode::TCP_SERVER)
+                connections = clients_;
+            else
+                connections.push_back(socket_);
+            std::vector<pollfd> fds;
+            for (const auto &connection : connections)
+            {
+                if (connection->isOpen() && connection->hasBufferedData())
+                    return true;
+                if (connection->isOpen())
+                    fds.push_back(pollfd{connection->getSocketFd(), POLLIN, 0});
+            }
+            // readFrameLocked() reports a server with no clients or a closed connection.
+            if (fds.empty())
+                return true;
+
+            auto idleAt = lastInbound_ + readIdleTimeout_;
+            if (idleTimeout)
+                until = deadline ? std::min(*deadline, idleAt) : idleAt;
+            auto slice = RECEIVE_WAIT_SLICE;
+            if (until)
+                slice = std::min(slice, std::chrono::duration_cast<std::chrono::milliseconds>(*until - std::chrono::steady_clock::now()));
+            // Wait without holding mutex_, so sends, accepts and closes are not held up meanwhile.
+            // A deadline already passed still takes input that has arrived.
+            lock.unlock();
+            int ready = ::poll(fds.data(), fds.size(), static_cast<int>(std::max<int64_t>(slice.count(), 0)));
+            lock.lock();
+            if (ready > 0)
+                return true;
+            if (until && std::chrono::steady_clock::now() >= *until)
+                break;
+        }
+        if (idleTimeout && std::chrono::steady_clock::now() >= lastInbound_ + readIdleTimeout_)
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Read idle timeout for peer " + id_);
+            readStatus_ = ReceiveStatus::IDLE;
+            recordEventLocked(PeerEventKind::ERROR, PeerEventReason::IDLE, socket_.get());
+        }
+        else
+        {
+            readStatus_ = ReceiveStatus::TIMEOUT;
+        }
+        return false;
+    }
 
+    bool Peer::readFrameLocked(bool readyOnly)
+    {
+        readStatus_ = ReceiveStatus::FAILED;
         if (!socket_ || !socket_->isOpen())
         {
             Logger::getInstance().log(LogLevel::WARNING, "Cannot receive message, socket closed for peer: " + id_);
-            return "";
+            readStatus_ = ReceiveStatus::CLOSED;
+            return false;
         }
 
+        // Reports a connection that the read just closed.
+        auto noteClosed = [this](const SocketWrapper &connection, bool wasOpen)
+        {
+            if (!wasOpen || connection.isOpen())
+                return;
+            readStatus_ = connection.isDesynced() ? ReceiveStatus::DESYNC : ReceiveStatus::CLOSED;
+            if (connection.isDesynced())
+                recordEventLocked(PeerEventKind::ERROR, PeerEventReason::DESYNC, &connection);
+            recordEventLocked(PeerEventKind::DISCONNECTED, connection.isDesynced() ? PeerEventReason::DESYNC : PeerEventReason::CLOSED, &connection);
+        };
+
         try
         {
+            std::optional<Frame> frame;
+            SocketWrapper *connection = socket_.get();
             if (socket_->getMode() == SocketMode::TCP_SERVER)
             {
                 if (clients_.empty())
                 {
                     Logger::getInstance().log(LogLevel::WARNING, "No clients connected to receive from");
-                    return "";
+                    return false;
                 }
-                std::string msg;
+                bool attempted = false, anyOpen = false, incomplete = false;
                 for (auto &client : clients_)
                 {
-                    msg = client->receive(1024);
-                    if (!msg.empty())
+                    anyOpen = anyOpen || client->isOpen();
+                    // Only read clients awaitInboundLocked() may have seen, so its timeout holds.
+                    if (readyOnly && !client->hasBufferedData() && !client->waitReadable(std::chrono::milliseconds(0)))
+                        continue;
+                    bool wasOpen = client->isOpen(), partial = false;
+                    frame = client->receiveFrame(partial);
+                    connection = client.get();
+                    if (frame)
                         break;
+                    if (partial)
+                    {
+                        incomplete = true;
+                        continue;
+                    }
+                    attempted = true;
+                    noteClosed(*client, wasOpen);
                 }
-                if (!msg.empty())
-                {
-                    Logger::getInstance().log(LogLevel::INFO, "Recevied message from client: " + msg);
-                    lastReceived_ = std::chrono::steady_clock::now();
-                    messagesReceived_++;
-                    bytesReceived_ += msg.size();
-                    updateLatency();
-                    isConnected_ = true;
-                    return msg;
-                }
+                // Another receiver took the data awaitInboundLocked() saw, or only part of a frame has
+                // arrived; the caller waits again.
+                if (!frame && !attempted && (anyOpen || incomplete))
+                    return true;
             }
             else
             {
-                std::string message = socket_->receive(1024);
-                Logger::getInstance().log(LogLevel::INFO, "Received message from peer " + id_ + ": " + message);
-                if (!message.empty())
-                {
-                    Logger::getInstance().log(LogLevel::INFO, "Recevied message from client: " + message);
-                    lastReceived_ = std::chrono::steady_clock::now();
-                    messagesReceived_++;
-                    bytesReceived_ += message.size();
-                    updateLatency();
-                    isConnected_ = true;
-                    return message;
-                }
+                if (readyOnly && !socket_->hasBufferedData() && !socket_->waitReadable(std::chrono::milliseconds(0)))
+                    return true;
+                bool incomplete = false;
+                frame = socket_->receiveFrame(incomplete);
+                if (incomplete)
+                    return true;
+                if (!frame)
+                    noteClosed(*socket_, true);
             }
+            return frame && queueFrameLocked(std::move(*frame), connection);
         }
         catch (const std::exception &e)
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to receive message from peer " + id_ + ": " + e.what());
-            return "";
+            recordEventLocked(PeerEventKind::ERROR, PeerEventReason::RECEIVE_FAILED, socket_.get());
+            return false;
         }
     }
 
-    bool Peer::isConnected() const
+    bool Peer::readReadyFrameLocked()
     {
-        return socket_ && socket_->isOpen();
+        if (!socket_)
+            return false;
+        std::vector<std::shared_ptr<SocketWrapper>> connections;
+        if (socket_->getMode() == SocketMode::TCP_SERVER)
+            connections = clients_;
+        else
+            connections.push_back(socket_);
+        auto ready = std::find_if(connections.begin(), connections.end(),
+                                  [](const std::shared_ptr<SocketWrapper> &connection)
+                                  { return connection->isOpen() && (connection->hasBufferedData() || connection->waitReadable(std::chrono::milliseconds(0))); });
+        if (ready == connections.end())
+            return false;
+        try
+        {
+            bool incomplete = false;
+            auto frame = (*ready)->receiveFrame(incomplete);
+            if (!frame)
+                return false;
+            queueFrameLocked(std::move(*frame), ready->get());
+            return true;
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to receive message from peer " + id_ + ": " + e.what());
+            return false;
+        }
     }
 
-    void Peer::closeConnection()
+    bool Peer::queueFrameLocked(Frame frame, SocketWrapper *connection)
     {
-        std::lock_guard<std::mutex> lock(mutex_);
-        if (socket_ && socket_->isOpen())
+        lastInbound_ = std::chrono::steady_clock::now();
+        if (!acceptStampLocked(frame, connection))
+            return false;
+
+        if (frame.type == FrameType::STREAM)
+            return queueStreamFrameLocked(frame, connection);
+
+        if (frame.type == FrameType::GOODBYE)
         {
-            socket_->close();
-            Logger::getInstance().log(LogLevel::INFO, "Connection closed for peer: " + id_);
+            goodbyeReason_ = frame.payload;
+            Logger::getInstance().log(LogLevel::INFO, "Peer " + id_ + " said goodbye: " + goodbyeReason_);
+            connection->close();
+            recordEventLocked(PeerEventKind::DISCONNECTED, PeerEventReason::GOODBYE, connection);
+            if (connection == socket_.get())
+                readStatus_ = ReceiveStatus::CLOSED;
+            return false;
+        }
+
+        auto info = clientInfo_.find(connection);
+        uint64_t clientId = info == clientInfo_.end() ? 0 : info->second.first;
+        if (frame.type == FrameType::FRAGMENT)
+            return queueFragmentLocked(frame, connection, clientId);
+
+        if (frame.type == FrameType::RECEIPT)
+        {
+            uint64_t first = 0, last = 0;
+            if (!parseReceipt(frame, first, last))
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Received malformed receipt from peer: " + id_);
+                return false;
+            }
+            for (uint64_t id = first; id <= last && id >= first; id++)
+                receipts_.push_back(id);
+            return true;
+        }
+        uint64_t trackingId = 0;
+        if (untrackFrame(frame, trackingId))
+            acknowledgeLocked(trackingId, connection);
+
+        std::string payload;
+        if (frame.flags & FRAME_COMPRESSED)
+        {
+            // A batch holds several messages, each checked once decoded below.
+            bool single = frame.type == FrameType::MESSAGE || frame.type == FrameType::URGENT;
+            if (single && oversizedLocked(decompressedSize(frame.payload), connection))
+                return false;
+            if (!decompressPayload(frame.payload, payload, single ? maxMessageSize_ : MAX_FRAME_SIZE * 16, compressionDictionary_))
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to decompress frame from peer: " + id_);
+                return false;
+            }
+        }
+        else
+        {
+            payload = frame.payload;
+        }
+
+        if (frame.type == FrameType::MESSAGE || frame.type == FrameType::URGENT)
+        {
+            if (oversizedLocked(payload.size(), connection))
+                return false;
+            (frame.type == FrameType::URGENT ? urgentQueue_ : messageQueue_).push({std::move(payload), clientId});
+            queuedFrom_[clientId]++;
+            return true;
+        }
+
+        std::vector<std::string> messages;
+        if (!decodeBatch(payload, messages))
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Received malformed batch from peer: " + id_);
+            return false;
+        }
+        bool complete = true;
+        for (auto &message : messages)
+        {
+            if (oversizedLocked(message.size(), connection))
+            {
+                complete = false;
+                continue;
+            }
+            messageQueue_.push({std::move(message), clientId});
+            queuedFrom_[clientId]++;
         }
+        return complete;
     }
 
-    void Peer::acceptClients(int maxClients)
+    void Peer::acknowledgeLocked(uint64_t trackingId, SocketWrapper *connection)
     {
-        std::lock_guard<std::mutex> lock(mutex_);
-        if (socket_->getMode() != SocketMode::TCP_SERVER)
-            return;
-        for (int i = 0; i < maxClients; i++)
+        auto now = std::chrono::steady_clock::now();
+        auto pending = pendingAcks_.find(connection);
+        if (pending != pendingAcks_.end() && (trackingId != pending->second.last + 1 || trackingId == 0))
+        {
+            sendAckLocked(connection);
+            pending = pendingAcks_.end();
+        }
+        if (pending == pendingAcks_.end())
+            pending = pendingAcks_.emplace(connection, PendingAck{trackingId, trackingId, now}).first;
+        else
+            pending->second.last = trackingId;
+
+        const auto &run = pending->second;
+        bool due = ackInterval_.count() > 0 && now - run.since >= ackInterval_;
+        if (run.last - run.first + 1 >= ackBatchSize_ || due)
+            sendAckLocked(connection);
+        if (ackInterval_.count() > 0)
         {
-            auto client = socket_->accept();
-            if (client)
+            for (auto it = pendingAcks_.begin(); it != pendingAcks_.end();)
             {
-                clients_.push_back(client);
+                auto next = std::next(it);
+                if (now - it->second.since >= ackInterval_)
+                    sendAckLocked(it->first);
+                it = next;
             }
         }
     }
 
+    void Peer::sendAckLocked(SocketWrapper *connection)
+    {
+        auto pending = pendingAcks_.find(connection);
+        if (pending == pendingAcks_.end())
+            return;
+        PendingAck run = pending->second;
+        pendingAcks_.erase(pending);
+
+        bool known = socket_.get() == connection ||
+                     std::any_of(clients_.begin(), clients_.end(),
+                                 [connection](const std::shared_ptr<SocketWrapper> &client)
+                                 { return client.get() == connection; });
+        if (!known || !connection->isOpen())
+            return;
+        Frame receipt = makeReceipt(run.first, run.last);
+        prepareFrameLocked(receipt);
+        if (connection->sendFrame(receipt) == 0)
+            Logger::getInstance().log(LogLevel::WARNING, "Failed to send receipt " + std::to_string(run.last) + " to peer: " + id_);
+    }
+
+    void Peer::setAckBatching(size_t count, std::chrono::milliseconds interval)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        ackBatchSize_ = std::clamp<size_t>(count, 1, MAX_RECEIPT_RANGE);
+        ackInterval_ = std::max(interval, std::chrono::milliseconds(0));
+        if (ackBatchSize_ == 1)
+        {
+            while (!pendingAcks_.empty())
+                sendAckLocked(pendingAcks_.begin()->first);
+        }
+    }
+
+    void Peer::flushAcks(bool dueOnly)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto now = std::chrono::steady_clock::now();
+        for (auto it = pendingAcks_.begin(); it != pendingAcks_.end();)
+        {
+            auto next = std::next(it);
+            if (!dueOnly || (ackInterval_.count() > 0 && now - it->second.since >= ackInterval_))
+                sendAckLocked(it->first);
+            it = next;
+        }
+    }
+
+    bool Peer::oversizedLocked(uint64_t size, const SocketWrapper *connection)
+    {
+        if (size <= maxMessageSize_)
+            return false;
+        Logger::getInstance().log(LogLevel::ERROR, "Dropped message of " + std::to_string(size) + " bytes from peer " + id_ + ": larger than " + std::to_string(maxMessageSize_) + " bytes");
+        recordEventLocked(PeerEventKind::ERROR, PeerEventReason::RECEIVE_FAILED, connection);
+        return true;
+    }
+
+    bool Peer::queueFragmentLocked(const Frame &frame, const SocketWrapper *connection, uint64_t clientId)
+    {
+        uint32_t index = 0;
+        uint64_t total = 0;
+        std::string data;
+        if (!decodeFragment(frame.payload, index, total, data))
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Received malformed fragment from peer: " + id_);
+            return false;
+        }
+
+        auto &partial = partialMessages_[connection];
+        if (index == 0)
+        {
+            partial = PartialMessage{};
+            partial.total = total;
+            if (oversizedLocked(total, connection))
+            {
+                partial.discard = true;
+                partial.nextIndex = 1;
+                return false;
+            }
+        }
+        else if (index != partial.nextIndex || total != partial.total)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Received fragment out of order from peer: " + id_);
+            partialMessages_.erase(connection);
+            return false;
+        }
+        partial.nextIndex++;
+        if (partial.discard)
+        {
+            if (static_cast<uint64_t>(partial.nextIndex) * FRAGMENT_DATA_SIZE >= partial.total)
+                partialMessages_.erase(connection);
+            return true;
+        }
+
+        partial.data += data;
+        if (partial.data.size() > partial.total)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Received fragments exceeding their message from peer: " + id_);
+            partialMessages_.erase(connection);
+            return false;
+        }
+        if (partial.data.size() == partial.total)
+        {
+            messageQueue_.push({std::move(partial.data), clientId});
+            queuedFrom_[clientId]++;
+            partialMessages_.erase(connection);
+        }
+        return true;
+    }
+
+    bool Peer::queueStreamFrameLocked(const Frame &frame, SocketWrapper *connection)
+    {
+        StreamFrame streamFrame;
+        if (!decodeStreamFrame(frame.payload, streamFrame))
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Received malformed stream frame from peer: " + id_);
+            return false;
+        }
+
+        uint32_t streamId = streamFrame.streamId;
+        if (socket_->getMode() == SocketMode::TCP_SERVER)
+        {
+            auto key = std::make_pair(static_cast<const SocketWrapper *>(connection), streamFrame.streamId);
+            auto known = streamIds_.find(key);
+            if (known != streamIds_.end())
+            {
+                streamId = known->second;
+            }
+            else if (streamFrame.kind == StreamFrameKind::OPEN)
+            {
+                auto client = std::find_if(clients_.begin(), clients_.end(),
+                                           [connection](const std::shared_ptr<SocketWrapper> &c)
+                                           { return c.get() == connection; });
+                if (client == clients_.end())
+                    return false;
+                streamId = ++nextStreamId_;
+                streamIds_[key] = streamId;
+                streams_[streamId] = StreamRoute{*client, streamFrame.streamId};
+            }
+        }
+
+        auto route = streams_.find(streamId);
+        if (route == streams_.end() || route->second.connection.get() != connection)
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Dropped frame for unknown stream " + std::to_string(streamFrame.streamId) + " from peer: " + id_);
+            return false;
+        }
+        if (streamFrame.kind == StreamFrameKind::DATA)
+        {
+            messagesReceived_++;
+            bytesReceived_ += streamFrame.data.size();
+        }
+        if (streamFrame.kind == StreamFrameKind::CLOSE)
+        {
+            route->second.receivedClose = true;
+            if (route->second.sentClose)
+                retireStreamLocked(streamId);
+        }
+        streamFrame.streamId = streamId;
+        streamFrames_.push_back(std::move(streamFrame));
+        return true;
+    }
+
+    uint32_t Peer::openStream(const std::string &name)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || socket_->getMode() != SocketMode::TCP_CLIENT || !socket_->isOpen())
+            return 0;
+        uint32_t streamId = ++nextStreamId_;
+        streams_[streamId] = StreamRoute{socket_, streamId};
+        if (!sendStreamFrameLocked(streamId, StreamFrameKind::OPEN, name))
+        {
+            streams_.erase(streamId);
+            return 0;
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Opened stream " + std::to_string(streamId) + " to peer: " + id_);
+        return streamId;
+    }
+
+    bool Peer::sendStreamFrame(uint32_t streamId, StreamFrameKind kind, const std::string &data)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (kind != StreamFrameKind::DATA && kind != StreamFrameKind::WINDOW && kind != StreamFrameKind::CLOSE)
+            return false;
+        return sendStreamFrameLocked(streamId, kind, data);
+    }
+
+    bool Peer::sendStreamFrameLocked(uint32_t streamId, StreamFrameKind kind, const std::string &data)
+    {
+        auto it = streams_.find(streamId);
+        if (it == streams_.end() || it->second.sentClose)
+            return false;
+        auto &route = it->second;
+
+        Frame frame;
+        frame.type = FrameType::STREAM;
+        frame.payload = encodeStreamFrame(StreamFrame{route.wireId, kind, data});
+        if (frame.payload.size() > MAX_FRAME_SIZE)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Stream frame too large for peer " + id_ + ": " + std::to_string(frame.payload.size()) + " bytes");
+            return false;
+        }
+        prepareFrameLocked(frame);
+
+        size_t sent = 0;
+        try
+        {
+            lastSent_ = std::chrono::steady_clock::now();
+            sent = route.connection->sendFrame(frame);
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to send stream frame to peer: " + id_ + ": " + e.what());
+        }
+        if (sent == 0)
+            return false;
+        bytesSent_ += sent;
+        if (kind == StreamFrameKind::DATA)
+            messagesSent_++;
+        if (kind == StreamFrameKind::CLOSE)
+        {
+            route.sentClose = true;
+            if (route.receivedClose)
+                retireStreamLocked(streamId);
+        }
+        return true;
+    }
+
+    ReceiveStatus Peer::receiveStreamFrame(StreamFrame &frame, std::chrono::milliseconds timeout)
+    {
+        std::unique_lock<std::mutex> lock(mutex_);
+        resetLostStreamsLocked();
+        if (streamFrames_.empty() && socket_ && socket_->isOpen() && !readReadyFrameLocked())
+        {
+            std::vector<std::shared_ptr<SocketWrapper>> connections;
+            if (socket_->getMode() == SocketMode::TCP_SERVER)
+                connections = clients_;
+            else
+                connections.push_back(socket_);
+
+            // Wait without holding mutex_ so sends and other receives are not held up.
+            lock.unlock();
+            std::vector<pollfd> fds;
+            for (const auto &connection : connections)
+            {
+                if (connection->isOpen())
+                    fds.push_back(pollfd{connection->getSocketFd(), POLLIN, 0});
+            }
+            if (fds.empty())
+                std::this_thread::sleep_for(timeout);
+            else
+                ::poll(fds.data(), fds.size(), static_cast<int>(timeout.count()));
+            lock.lock();
+
+            readReadyFrameLocked();
+            resetLostStreamsLocked();
+        }
+
+        if (streamFrames_.empty())
+            return socket_ && socket_->isOpen() ? ReceiveStatus::FAILED : ReceiveStatus::CLOSED;
+        frame = std::move(streamFrames_.front());
+        streamFrames_.pop_front();
+        return ReceiveStatus::OK;
+    }
+
+    void Peer::resetLostStreamsLocked()
+    {
+        bool client = socket_ && socket_->getMode() == SocketMode::TCP_CLIENT;
+        std::vector<uint32_t> lost;
+        for (const auto &[streamId, route] : streams_)
+        {
+            if (!route.connection->isOpen() || (client && route.connection != socket_))
+                lost.push_back(streamId);
+        }
+        for (uint32_t streamId : lost)
+        {
+            retireStreamLocked(streamId);
+            streamFrames_.push_back(StreamFrame{streamId, StreamFrameKind::RESET, ""});
+        }
+    }
+
+    void Peer::retireStreamLocked(uint32_t streamId)
+    {
+        auto it = streams_.find(streamId);
+        if (it == streams_.end())
+            return;
+        streamIds_.erase(std::make_pair(static_cast<const SocketWrapper *>(it->second.connection.get()), it->second.wireId));
+        streams_.erase(it);
+    }
+
+    void Peer::setReplayProtection(std::chrono::milliseconds window)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        replayWindow_ = window.count() > 0 ? window : std::chrono::milliseconds(0);
+        // Seed from the clock so nonces keep increasing across reconnects and restarts.
+        if (nextNonce_ == 0)
+            nextNonce_ = static_cast<uint64_t>(std::chrono::duration_cast<std::chrono::nanoseconds>(
+                                                   std::chrono::system_clock::now().time_since_epoch())
+                                                   .count());
+    }
+
+    void Peer::setFrameResync(bool enabled)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        frameResync_ = enabled;
+        if (socket_)
+            socket_->setFrameResync(enabled);
+        for (auto &client : clients_)
+            client->setFrameResync(enabled);
+    }
+
+    uint64_t Peer::getFrameDesyncs() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        uint64_t desyncs = retiredFrameDesyncs_;
+        if (socket_)
+            desyncs += socket_->getFrameDesyncs();
+        for (const auto &client : clients_)
+            desyncs += client->getFrameDesyncs();
+        return desyncs;
+    }
+
+    uint64_t Peer::getFragmentsLost() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        uint64_t lost = retiredFragmentsLost_;
+        if (socket_)
+            lost += socket_->getFragmentsLost();
+        for (const auto &client : clients_)
+            lost += client->getFragmentsLost();
+        return lost;
+    }
+
+    void Peer::setReadIdleTimeout(std::chrono::milliseconds timeout)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        readIdleTimeout_ = std::max(timeout, std::chrono::milliseconds(0));
+        lastInbound_ = std::chrono::steady_clock::now();
+    }
+
+    void Peer::setMaxMessageSize(uint64_t bytes)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        maxMessageSize_ = bytes > 0 ? bytes : DEFAULT_MAX_MESSAGE_SIZE;
+    }
+
+    uint64_t Peer::getReplaysRejected() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return replaysRejected_;
+    }
+
+    void Peer::prepareFrame(Frame &frame)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        prepareFrameLocked(frame);
+    }
+
+    void Peer::prepareFrameLocked(Frame &frame)
+    {
+        if (replayWindow_.count() == 0 || (frame.flags & FRAME_STAMPED))
+            return;
+        auto now = std::chrono::duration_cast<std::chrono::milliseconds>(std::chrono::system_clock::now().time_since_epoch());
+        stampFrame(frame, now.count(), nextNonce_++);
+    }
+
+    bool Peer::acceptStampLocked(Frame &frame, const SocketWrapper *connection)
+    {
+        int64_t timestampMs = 0;
+        uint64_t nonce = 0;
+        bool stamped = unstampFrame(frame, timestampMs, nonce);
+        if (replayWindow_.count() == 0)
+            return !(frame.flags & FRAME_STAMPED);
+
+        std::string reason;
+        auto now = std::chrono::duration_cast<std::chrono::milliseconds>(std::chrono::system_clock::now().time_since_epoch()).count();
+        auto &lastNonce = lastNonces_[connection];
+        if (!stamped)
+            reason = "missing stamp";
+        else if (timestampMs < now - replayWindow_.count() || timestampMs > now + replayWindow_.count())
+            reason = "timestamp outside window";
+        else if (nonce <= lastNonce)
+            reason = "reused nonce";
+        if (!reason.empty())
+        {
+            replaysRejected_++;
+            Logger::getInstance().log(LogLevel::WARNING, "Rejected frame from peer " + id_ + ": " + reason);
+            return false;
+        }
+        lastNonce = nonce;
+        return true;
+    }
+
+    bool Peer::isSendRetryable() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return socket_ && socket_->isSendRetryable();
+    }
+
+    bool Peer::isConnected() const
+    {
+        return socket_ && socket_->isOpen();
+    }
+
+    void Peer::closeConnection()
+    {
+        {
+            std::lock_guard<std::mutex> connectionsLock(connectionsMutex_);
+            if (socket_)
+                socket_->interrupt();
+            for (auto &client : clients_)
+                client->interrupt();
+        }
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (socket_ && socket_->isOpen())
+        {
+            socket_->close();
+            Logger::getInstance().log(LogLevel::INFO, "Connection closed for peer: " + id_);
+        }
+    }
+
+    bool Peer::closeGracefully(std::chrono::milliseconds timeout)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || !socket_->isOpen())
+            return true;
+
+        std::vector<std::shared_ptr<SocketWrapper>> connections;
+        if (socket_->getMode() == SocketMode::TCP_SERVER)
+            connections = clients_;
+        else
+            connections.push_back(socket_);
+
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        bool closed = true;
+        for (auto &connection : connections)
+        {
+            if (!connection->isOpen())
+                continue;
+            connection->shutdown(false, true);
+        }
+        for (auto &connection : connections)
+        {
+            auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            if (!connection->drainUntilClosed(std::max(remaining, std::chrono::milliseconds(0))))
+                closed = false;
+            connection->close();
+        }
+        socket_->close();
+        isConnected_ = false;
+
+        if (closed)
+            Logger::getInstance().log(LogLevel::INFO, "Connection closed gracefully for peer: " + id_);
+        else
+            Logger::getInstance().log(LogLevel::WARNING, "Timed out waiting for remote close, connection closed for peer: " + id_);
+        return closed;
+    }
+
+    int Peer::closeExpiredClients(std::chrono::milliseconds maxAge, std::chrono::milliseconds grace, const std::string &reason)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || socket_->getMode() != SocketMode::TCP_SERVER)
+            return 0;
+
+        auto now = std::chrono::steady_clock::now();
+        int retired = 0;
+        for (auto &client : clients_)
+        {
+            if (!client->isOpen())
+                continue;
+            auto closeBy = clientCloseBy_.find(client.get());
+            if (closeBy != clientCloseBy_.end())
+            {
+                if (now >= closeBy->second)
+                {
+                    Logger::getInstance().log(LogLevel::WARNING, "Timed out waiting for retired client to close, closing it for peer: " + id_);
+                    client->close();
+                    recordEventLocked(PeerEventKind::DISCONNECTED, PeerEventReason::EXPIRED, client.get());
+                }
+                continue;
+            }
+            if (now - clientAcceptedAt_[client.get()] < maxAge)
+                continue;
+
+            Frame goodbye;
+            goodbye.type = FrameType::GOODBYE;
+            goodbye.payload = reason;
+            prepareFrameLocked(goodbye);
+            if (client->sendFrame(goodbye) == 0)
+                Logger::getInstance().log(LogLevel::WARNING, "Failed to send goodbye to client of peer: " + id_);
+            client->shutdown(false, true);
+            clientCloseBy_[client.get()] = now + grace;
+            retired++;
+        }
+        if (retired > 0)
+            Logger::getInstance().log(LogLevel::INFO, "Retired " + std::to_string(retired) + " client connection(s) for peer " + id_ + ": " + reason);
+        return retired;
+    }
+
+    std::string Peer::getGoodbyeReason() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return goodbyeReason_;
+    }
+
+    void Peer::shutdownWrite()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || !socket_->isOpen())
+            return;
+        if (socket_->getMode() == SocketMode::TCP_SERVER)
+        {
+            for (auto &client : clients_)
+            {
+                if (client->isOpen())
+                    client->shutdown(false, true);
+            }
+        }
+        else
+        {
+            socket_->shutdown(false, true);
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Write side shut down for peer: " + id_);
+    }
+
+    bool Peer::setSocketOptions(const SocketOptions &options)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        socketOptions_.merge(options);
+        if (!socket_ || !socket_->isOpen())
+            return false;
+
+        bool ok = socket_->applyOptions(options);
+        for (auto &client : clients_)
+        {
+            if (client->isOpen() && !client->applyOptions(options))
+                ok = false;
+        }
+        return ok;
+    }
+
+    void Peer::setConnectionSetup(std::chrono::milliseconds connectTimeout, int backlog)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        connectTimeout_ = connectTimeout;
+        listenBacklog_ = backlog > 0 ? backlog : DEFAULT_LISTEN_BACKLOG;
+    }
+
+    void Peer::setSecurity(std::shared_ptr<const ChannelSecurity> security)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        security_ = std::move(security);
+    }
+
+    void Peer::setAcceptFilter(AcceptFilter filter)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        acceptFilter_ = std::move(filter);
+    }
+
+    bool Peer::admitClient(SocketWrapper &client)
+    {
+        AcceptFilter filter;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            filter = acceptFilter_;
+        }
+        std::string address = client.getRemoteAddress();
+        if (!filter || filter(address, client.getRemoteIdentity()))
+            return true;
+        Logger::getInstance().log(LogLevel::WARNING, "Rejected client " + address + " of peer " + id_ + ": refused by accept filter");
+        client.close();
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (recordEvents_)
+        {
+            if (events_.size() >= MAX_PEER_EVENTS)
+                events_.pop_front();
+            events_.push_back(PeerEvent{PeerEventKind::REJECTED, PeerEventReason::DENIED, 0, address});
+        }
+        return false;
+    }
+
+    void Peer::setDraining(bool draining)
+    {
+        draining_ = draining;
+    }
+
+    bool Peer::isDraining() const
+    {
+        return draining_;
+    }
+
+    void Peer::turnAwayClient(SocketWrapper &client)
+    {
+        std::string address = client.getRemoteAddress();
+        // A secured client already read that the server is draining in its hello.
+        if (!client.isSecured())
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            Frame goodbye;
+            goodbye.type = FrameType::GOODBYE;
+            goodbye.payload = DRAINING_REASON;
+            prepareFrameLocked(goodbye);
+            if (client.sendFrame(goodbye) == 0)
+                Logger::getInstance().log(LogLevel::WARNING, "Failed to send goodbye to client " + address + " of peer: " + id_);
+        }
+        client.close();
+        Logger::getInstance().log(LogLevel::INFO, "Turned away client " + address + " of peer " + id_ + ": draining");
+    }
+
+    std::chrono::milliseconds Peer::handshakeTimeoutLocked() const
+    {
+        if (connectTimeout_.count() > 0)
+            return std::min(connectTimeout_, DEFAULT_HANDSHAKE_TIMEOUT);
+        return DEFAULT_HANDSHAKE_TIMEOUT;
+    }
+
+    bool Peer::isAuthenticated() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return security_ && security_->authenticatesPeer();
+    }
+
+    bool Peer::rotateKeys()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        std::vector<std::shared_ptr<SocketWrapper>> connections;
+        if (socket_ && socket_->getMode() == SocketMode::TCP_SERVER)
+            connections = clients_;
+        else if (socket_)
+            connections.push_back(socket_);
+
+        bool opened = false, rotated = true;
+        int error = 0;
+        for (const auto &connection : connections)
+        {
+            if (!connection->isOpen())
+                continue;
+            opened = true;
+            if (!connection->rekey())
+            {
+                rotated = false;
+                error = errno;
+            }
+        }
+        errno = opened ? error : ENOTCONN;
+        return opened && rotated;
+    }
+
+    std::string Peer::getRemoteIdentity() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || socket_->getMode() != SocketMode::TCP_CLIENT)
+            return "";
+        return socket_->getRemoteIdentity();
+    }
+
+    bool Peer::growReceiveBuffer(size_t bytes)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (bytes == 0 || !socket_ || !socket_->isOpen())
+            return false;
+        receiveBufferSize_ = std::max(receiveBufferSize_, bytes);
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+            return socket_->growReceiveBuffer(bytes);
+
+        bool ok = true;
+        for (auto &client : clients_)
+        {
+            if (client->isOpen() && !client->growReceiveBuffer(bytes))
+                ok = false;
+        }
+        return ok;
+    }
+
+    bool Peer::setCork(bool enabled)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || !socket_->isOpen())
+            return false;
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+            return socket_->setCork(enabled);
+
+        bool ok = true;
+        for (auto &client : clients_)
+        {
+            if (client->isOpen() && !client->setCork(enabled))
+                ok = false;
+        }
+        return ok;
+    }
+
+    int Peer::getPathMtu() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || !socket_->isOpen())
+            return -1;
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+            return socket_->getPathMtu();
+
+        int mtu = -1;
+        for (const auto &client : clients_)
+        {
+            int clientMtu = client->isOpen() ? client->getPathMtu() : -1;
+            if (clientMtu > 0 && (mtu < 0 || clientMtu < mtu))
+                mtu = clientMtu;
+        }
+        return mtu;
+    }
+
+    bool Peer::getBufferSizes(int &sendBytes, int &receiveBytes) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!socket_ || !socket_->isOpen())
+            return false;
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+            return socket_->getBufferSizes(sendBytes, receiveBytes);
+
+        bool found = false;
+        for (const auto &client : clients_)
+        {
+            int clientSend = 0, clientReceive = 0;
+            if (!client->isOpen() || !client->getBufferSizes(clientSend, clientReceive))
+                continue;
+            sendBytes = found ? std::min(sendBytes, clientSend) : clientSend;
+            receiveBytes = found ? std::min(receiveBytes, clientReceive) : clientReceive;
+            found = true;
+        }
+        return found;
+    }
+
+    bool Peer::reconnect(const std::string &ip, int port, const std::string &localIp, int localPort)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        SocketMode mode = socket_ ? socket_->getMode() : SocketMode::TCP_CLIENT;
+
+        std::shared_ptr<SocketWrapper> socket;
+        try
+        {
+            socket = std::make_shared<SocketWrapper>(mode);
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to reconnect peer " + id_ + ": " + e.what());
+            return false;
+        }
+        socket->setConnectTimeout(connectTimeout_);
+        if (auto udp = socket_ ? socket_->getUdpTransport() : std::nullopt)
+            socket->useUdpTransport(*udp);
+        if (auto proxy = socket_ ? socket_->getProxy() : std::nullopt)
+            socket->useProxy(*proxy);
+        if (socket_)
+        {
+            socket->setUnixSocketMode(socket_->getUnixSocketMode());
+            socket->setBindOptions(socket_->getBindOptions());
+        }
+        bool bound = mode != SocketMode::TCP_CLIENT || (localIp.empty() && localPort == 0) || socket->bindLocal(localIp, localPort);
+        if (!bound || !socket->initialize(ip, port) ||
+            (security_ && mode == SocketMode::TCP_CLIENT && !socket->secure(*security_, false, handshakeTimeoutLocked())))
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to reconnect peer " + id_ + " to " + ip + ":" + std::to_string(port));
+            return false;
+        }
+        if (mode == SocketMode::TCP_SERVER)
+        {
+            try
+            {
+                socket->listen(listenBacklog_);
+            }
+            catch (const std::exception &e)
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to reconnect peer " + id_ + ": " + e.what());
+                return false;
+            }
+        }
+        socket->applyOptions(socketOptions_);
+        socket->setFrameResync(frameResync_);
+        if (receiveBufferSize_ > 0 && mode != SocketMode::TCP_SERVER)
+            socket->growReceiveBuffer(receiveBufferSize_);
+
+        if (socket_)
+        {
+            retiredFrameDesyncs_ += socket_->getFrameDesyncs();
+            retiredFragmentsLost_ += socket_->getFragmentsLost();
+            socket_->close();
+        }
+        for (auto &client : clients_)
+        {
+            retiredFrameDesyncs_ += client->getFrameDesyncs();
+            retiredFragmentsLost_ += client->getFragmentsLost();
+            client->close();
+        }
+        {
+            std::lock_guard<std::mutex> connectionsLock(connectionsMutex_);
+            clients_.clear();
+            socket_ = socket;
+        }
+        lastNonces_.clear();
+        partialMessages_.clear();
+        pendingAcks_.clear();
+        clientAcceptedAt_.clear();
+        clientCloseBy_.clear();
+        clientsById_.clear();
+        clientInfo_.clear();
+        lastInbound_ = std::chrono::steady_clock::now();
+
+        ip_ = ip;
+        port_ = port;
+        isConnected_ = mode != SocketMode::TCP_SERVER;
+        if (mode != SocketMode::TCP_SERVER)
+            recordEventLocked(PeerEventKind::CONNECTED, PeerEventReason::NONE, socket_.get());
+        Logger::getInstance().log(LogLevel::INFO, "Reconnected peer " + id_ + " to " + ip + ":" + std::to_string(port));
+        return true;
+    }
+
+    bool Peer::acceptClients(int maxClients, int &accepted)
+    {
+        accepted = 0;
+        std::shared_ptr<SocketWrapper> socket;
+        std::shared_ptr<const ChannelSecurity> security;
+        std::chrono::milliseconds handshakeTimeout;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            socket = socket_;
+            security = security_;
+            handshakeTimeout = handshakeTimeoutLocked();
+        }
+        if (!socket || socket->getMode() != SocketMode::TCP_SERVER)
+            return false;
+
+        for (int i = 0; i < maxClients; i++)
+        {
+            std::shared_ptr<SocketWrapper> client;
+            try
+            {
+                client = socket->accept();
+            }
+            catch (const ListenerClosedError &)
+            {
+                Logger::getInstance().log(LogLevel::INFO, "Stopped accepting clients, listener closed for peer: " + id_);
+                return false;
+            }
+            catch (const std::exception &e)
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to accept client for peer " + id_ + ": " + e.what());
+                continue;
+            }
+            ConnectionHello hello;
+            if (isDraining())
+                hello.flags |= HELLO_DRAINING;
+            if (security && !client->secure(*security, true, handshakeTimeout, hello))
+            {
+                Logger::getInstance().log(LogLevel::WARNING, "Rejected client of peer " + id_ + ": handshake failed");
+                client->close();
+                continue;
+            }
+            if (hello.flags & HELLO_DRAINING)
+            {
+                turnAwayClient(*client);
+                continue;
+            }
+            if (!admitClient(*client))
+                continue;
+            if (!addClient(socket, client))
+                return false;
+            accepted++;
+        }
+        return true;
+    }
+
+    void Peer::stopAccepting()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (socket_ && socket_->getMode() == SocketMode::TCP_SERVER)
+            socket_->stopListening();
+    }
+
+    bool Peer::acceptClient(std::chrono::milliseconds timeout)
+    {
+        uint64_t clientId = 0;
+        return acceptClient(timeout, clientId);
+    }
+
+    bool Peer::acceptClient(std::chrono::milliseconds timeout, uint64_t &clientId)
+    {
+        std::shared_ptr<SocketWrapper> socket;
+        std::shared_ptr<const ChannelSecurity> security;
+        std::chrono::milliseconds handshakeTimeout;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            socket = socket_;
+            security = security_;
+            handshakeTimeout = handshakeTimeoutLocked();
+        }
+        if (!socket || socket->getMode() != SocketMode::TCP_SERVER || !socket->waitReadable(timeout))
+            return false;
+
+        std::shared_ptr<SocketWrapper> client;
+        try
+        {
+            client = socket->accept();
+        }
+        catch (const ListenerClosedError &)
+        {
+            return false;
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to accept client for peer " + id_ + ": " + e.what());
+            return false;
+        }
+        ConnectionHello hello;
+        if (isDraining())
+            hello.flags |= HELLO_DRAINING;
+        if (security && !client->secure(*security, true, handshakeTimeout, hello))
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Rejected client of peer " + id_ + ": handshake failed");
+            client->close();
+            return false;
+        }
+        if (hello.flags & HELLO_DRAINING)
+        {
+            turnAwayClient(*client);
+            return false;
+        }
+        if (!admitClient(*client))
+            return false;
+        return addClient(socket, client, &clientId);
+    }
+
+    bool Peer::sendToClient(uint64_t clientId, const std::string &message, bool unreliable)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        if (it == clientsById_.end() || !it->second->isOpen())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Cannot send message, client " + std::to_string(clientId) + " of peer " + id_ + " is closed");
+            return false;
+        }
+
+        auto &client = it->second;
+        auto sendFrame = [this, &client](Frame frame)
+        {
+            prepareFrameLocked(frame);
+            if (frame.payload.size() > MAX_FRAME_SIZE)
+            {
+                Logger::getInstance().log(LogLevel::ERROR, "Frame too large for peer " + id_ + ": " + std::to_string(frame.payload.size()) + " bytes");
+                return false;
+            }
+            lastSent_ = std::chrono::steady_clock::now();
+            size_t sent = client->sendFrame(frame);
+            if (sent == 0)
+            {
+                recordEventLocked(PeerEventKind::ERROR, PeerEventReason::SEND_FAILED, client.get());
+                return false;
+            }
+            bytesSent_ += sent;
+            return true;
+        };
+
+        // Fragments are always sent reliably, since losing one loses the whole message.
+        if (message.size() > MAX_UNFRAGMENTED_SIZE)
+        {
+            if (!sendFragmentsLocked(message, sendFrame))
+                return false;
+        }
+        else
+        {
+            Frame frame;
+            frame.payload = message;
+            compressMessageLocked(frame, client.get());
+            if (unreliable && replayWindow_.count() == 0)
+                frame.flags |= FRAME_UNRELIABLE;
+            if (!sendFrame(std::move(frame)))
+                return false;
+        }
+        messagesSent_++;
+        return true;
+    }
+
+    bool Peer::closeClient(uint64_t clientId)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        if (it == clientsById_.end())
+            return false;
+        it->second->close();
+        return true;
+    }
+
+    bool Peer::isClientOpen(uint64_t clientId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        return it != clientsById_.end() && it->second->isOpen();
+    }
+
+    bool Peer::hasClient(uint64_t clientId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return clientsById_.count(clientId) > 0;
+    }
+
+    bool Peer::isClientDrained(uint64_t clientId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        if (it != clientsById_.end() && it->second->isOpen())
+            return false;
+        return queuedFrom_.count(clientId) == 0;
+    }
+
+    std::string Peer::getClientAddress(uint64_t clientId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        return it == clientsById_.end() ? std::string() : it->second->getRemoteAddress();
+    }
+
+    std::string Peer::getClientRemoteIdentity(uint64_t clientId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        auto it = clientsById_.find(clientId);
+        return it == clientsById_.end() ? std::string() : it->second->getRemoteIdentity();
+    }
+
+    bool Peer::addClient(const std::shared_ptr<SocketWrapper> &listener, const std::shared_ptr<SocketWrapper> &client, uint64_t *clientId)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (listener != socket_)
+        {
+            // The peer reconnected while accepting; the client belongs to the old socket.
+            client->close();
+            return false;
+        }
+        client->applyOptions(socketOptions_);
+        client->setFrameResync(frameResync_);
+        if (receiveBufferSize_ > 0)
+            client->growReceiveBuffer(receiveBufferSize_);
+        clientAcceptedAt_[client.get()] = std::chrono::steady_clock::now();
+        lastInbound_ = clientAcceptedAt_[client.get()];
+        clientsById_[++nextClientId_] = client;
+        clientInfo_[client.get()] = {nextClientId_, client->getRemoteAddress()};
+        if (clientId)
+            *clientId = nextClientId_;
+        {
+            std::lock_guard<std::mutex> connectionsLock(connectionsMutex_);
+            clients_.push_back(client);
+        }
+        recordEventLocked(PeerEventKind::CONNECTED, PeerEventReason::NONE, client.get());
+        return true;
+    }
+
+    void Peer::setEventRecording(bool enabled)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        recordEvents_ = enabled;
+        if (!enabled)
+            events_.clear();
+    }
+
+    std::vector<PeerEvent> Peer::takeEvents()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        std::vector<PeerEvent> events(std::make_move_iterator(events_.begin()), std::make_move_iterator(events_.end()));
+        events_.clear();
+        return events;
+    }
+
+    void Peer::recordEventLocked(PeerEventKind kind, PeerEventReason reason, const SocketWrapper *connection)
+    {
+        if (!recordEvents_)
+            return;
+        PeerEvent event{kind, reason};
+        auto info = clientInfo_.find(connection);
+        if (info != clientInfo_.end())
+        {
+            event.clientId = info->second.first;
+            event.address = info->second.second;
+        }
+        else
+        {
+            InetAddress address;
+            event.address = parseInetAddress(ip_, port_, address) ? formatInetAddress(address.get()) : ip_ + ":" + std::to_string(port_);
+        }
+        if (events_.size() >= MAX_PEER_EVENTS)
+            events_.pop_front();
+        events_.push_back(std::move(event));
+    }
+
+    std::vector<int> Peer::getConnectionFds() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        std::vector<int> fds;
+        if (!socket_ || !socket_->isOpen())
+            return fds;
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+        {
+            fds.push_back(socket_->getSocketFd());
+            return fds;
+        }
+        for (const auto &client : clients_)
+        {
+            if (client->isOpen())
+                fds.push_back(client->getSocketFd());
+        }
+        return fds;
+    }
+
+    bool Peer::hasQueuedInbound() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!messageQueue_.empty() || !urgentQueue_.empty())
+            return true;
+        if (!socket_ || !socket_->isOpen())
+            return false;
+        if (socket_->getMode() != SocketMode::TCP_SERVER)
+            return socket_->hasBufferedData();
+        for (const auto &client : clients_)
+        {
+            if (client->isOpen() && client->hasBufferedData())
+                return true;
+        }
+        return false;
+    }
+
+    int Peer::getClientCount() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return static_cast<int>(std::count_if(clients_.begin(), clients_.end(),
+                                              [](const std::shared_ptr<SocketWrapper> &client)
+                                              { return client->isOpen(); }));
+    }
+
 } // namespace relays
\ No newline at end of file
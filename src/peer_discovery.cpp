@@ -2,9 +2,12 @@
 #include "../include/relay/logger.h"
 #include <iostream>
 #include <cstring>
+#include <algorithm>
 #include <unistd.h>
 #include <arpa/inet.h>
 #include <sys/socket.h>
+#include <ifaddrs.h>
+#include <net/if.h>
 
 namespace relay
 {
@@ -34,8 +37,54 @@ namespace relay
           stopDiscovery_(false),
           socketWrapper_(std::make_shared<SocketWrapper>(SocketMode::UDP))
     {
-        socketWrapper_->initialize(localIp_, multicastPort_);          // Bind to local interface
-        socketWrapper_->enableMulticast(multicastIp_, multicastPort_); // Join multicast group
+        if (!hasMulticastInterface(localIp_))
+        {
+            const std::string errorMsg = "No multicast-capable interface for discovery on " + localIp_;
+            Logger::getInstance().log(LogLevel::ERROR, errorMsg);
+            throw MulticastUnavailableError(errorMsg);
+        }
+        if (!socketWrapper_->initialize(localIp_, multicastPort_)) // Bind to local interface
+            throw std::runtime_error("Failed to bind discovery socket to " + localIp_ + ":" + std::to_string(multicastPort_));
+        try
+        {
+            socketWrapper_->enableMulticast(multicastIp_, multicastPort_); // Join multicast group
+        }
+        catch (const std::runtime_error &e)
+        {
+            throw MulticastUnavailableError(e.what());
+        }
+    }
+
+    bool PeerDiscovery::hasMulticastInterface(const std::string &localIp)
+    {
+        struct ifaddrs *interfaces = nullptr;
+        if (getifaddrs(&interfaces) == -1)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to list network interfaces: " + std::string(strerror(errno)));
+            return false;
+        }
+
+        bool anyAddress = localIp.empty() || localIp == "0.0.0.0";
+        bool found = false;
+        for (auto *ifa = interfaces; ifa && !found; ifa = ifa->ifa_next)
+        {
+            if (!ifa->ifa_addr || ifa->ifa_addr->sa_family != AF_INET)
+                continue;
+            if (!(ifa->ifa_flags & IFF_UP) || !(ifa->ifa_flags & IFF_MULTICAST))
+                continue;
+            if (anyAddress)
+            {
+                found = !(ifa->ifa_flags & IFF_LOOPBACK);
+            }
+            else
+            {
+                char address[INET_ADDRSTRLEN];
+                auto *in = reinterpret_cast<struct ::sockaddr_in *>(ifa->ifa_addr);
+                found = inet_ntop(AF_INET, &in->sin_addr, address, sizeof(address)) && localIp == address;
+            }
+        }
+        freeifaddrs(interfaces);
+        return found;
     }
 
     PeerDiscovery::~PeerDiscovery()
@@ -92,6 +141,55 @@ namespace relay
         return peers_;
     }
 
+    std::vector<std::string> PeerDiscovery::getDiscoveredPeers(size_t offset, size_t limit, size_t &total) const
+    {
+        std::lock_guard<std::mutex> lock(peersMutex_);
+        total = peers_.size();
+        if (offset >= peers_.size())
+        {
+            return {};
+        }
+        size_t end = offset + std::min(limit, peers_.size() - offset);
+        return std::vector<std::string>(peers_.begin() + offset, peers_.begin() + end);
+    }
+
+    bool PeerDiscovery::setAnnouncementMetadata(const std::map<std::string, std::string> &metadata)
+    {
+        std::string announcement;
+        for (const auto &[key, value] : metadata)
+        {
+            if (key.empty() || key.find_first_of("=\n") != std::string::npos || value.find('\n') != std::string::npos)
+            {
+                logError("Invalid announcement metadata entry: " + key);
+                return false;
+            }
+            announcement += "\n" + key + "=" + value;
+        }
+        if (messageSize(DiscoveryMessageType::DISCOVERY_RESPONSE) + announcement.size() > MAX_ANNOUNCEMENT_SIZE)
+        {
+            logError("Announcement metadata exceeds " + std::to_string(MAX_ANNOUNCEMENT_SIZE) + " bytes");
+            return false;
+        }
+
+        std::lock_guard<std::mutex> lock(mutex_);
+        announcement_ = std::move(announcement);
+        return true;
+    }
+
+    std::map<std::string, std::string> PeerDiscovery::getPeerMetadata(const std::string &peerAddr) const
+    {
+        std::lock_guard<std::mutex> lock(peersMutex_);
+        auto it = peerMetadata_.find(peerAddr);
+        return it != peerMetadata_.end() ? it->second : std::map<std::string, std::string>{};
+    }
+
+    std::string PeerDiscovery::getPeerInterface(const std::string &peerAddr) const
+    {
+        std::lock_guard<std::mutex> lock(peersMutex_);
+        auto it = peerInterfaces_.find(peerAddr);
+        return it != peerInterfaces_.end() ? it->second : "";
+    }
+
     void PeerDiscovery::discoverySender()
     {
         while (!stopDiscovery_.load())
@@ -122,16 +220,19 @@ namespace relay
             try
             {
                 struct ::sockaddr_in senderAddr{};
-                std::string response = socketWrapper_->receiveFrom(1024, senderAddr);
+                std::string interfaceName;
+                std::string response = socketWrapper_->receiveFrom(MAX_ANNOUNCEMENT_SIZE, senderAddr, interfaceName);
                 if (!response.empty())
                 {
+                    const std::string responseType = toString(DiscoveryMessageType::DISCOVERY_RESPONSE);
                     if (response == toString(DiscoveryMessageType::DISCOVERY_REQUEST))
                     {
                         respondToDiscovery(senderAddr);
                     }
-                    else if (response == toString(DiscoveryMessageType::DISCOVERY_RESPONSE))
+                    else if (response.compare(0, responseType.size(), responseType) == 0 &&
+                             (response.size() == responseType.size() || response[responseType.size()] == '\n'))
                     {
-                        handleDiscoveryResponse(response, senderAddr);
+                        handleDiscoveryResponse(response, senderAddr, interfaceName);
                     }
                 }
             }
@@ -147,6 +248,10 @@ namespace relay
         try
         {
             std::string response = toString(DiscoveryMessageType::DISCOVERY_RESPONSE);
+            {
+                std::lock_guard<std::mutex> lock(mutex_);
+                response += announcement_;
+            }
             size_t bytesSent = socketWrapper_->sendTo(response, senderAddr);
             Logger::getInstance().log(LogLevel::DEBUG, "Sent discovery response (" + std::to_string(bytesSent) + " bytes) to " + inet_ntoa(senderAddr.sin_addr));
         }
@@ -156,12 +261,26 @@ namespace relay
         }
     }
 
-    void PeerDiscovery::handleDiscoveryResponse(const std::string &response, struct ::sockaddr_in &senderAddr)
+    void PeerDiscovery::handleDiscoveryResponse(const std::string &response, struct ::sockaddr_in &senderAddr, const std::string &interfaceName)
     {
         std::string peerAddr = std::string(inet_ntoa(senderAddr.sin_addr)) + ":" + std::to_string(ntohs(senderAddr.sin_port));
         Logger::getInstance().log(LogLevel::DEBUG, "Received discovery response: " + response + " from " + peerAddr);
 
+        std::map<std::string, std::string> metadata;
+        size_t start = response.find('\n');
+        while (start != std::string::npos)
+        {
+            size_t end = response.find('\n', start + 1);
+            std::string line = response.substr(start + 1, end == std::string::npos ? std::string::npos : end - start - 1);
+            size_t eq = line.find('=');
+            if (eq != std::string::npos && eq > 0)
+                metadata[line.substr(0, eq)] = line.substr(eq + 1);
+            start = end;
+        }
+
         std::lock_guard<std::mutex> lock(peersMutex_);
+        peerMetadata_[peerAddr] = std::move(metadata);
+        peerInterfaces_[peerAddr] = interfaceName;
         bool exists = false;
         for (const std::string& peer : peers_) {
             if (peer == peerAddr) {
@@ -43,6 +43,12 @@ namespace relay
         return false;
     }
 
+    bool PeerManager::hasPeer(const std::string &peerId) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return peers_.find(peerId) != peers_.end();
+    }
+
     std::shared_ptr<Peer> PeerManager::getPeer(const std::string &peerId) const
     {
         std::lock_guard<std::mutex> lock(mutex_);
@@ -80,14 +86,30 @@ namespace relay
             return false;
         }
 
+        if (requireAuthenticated_ && !sourcePeer->isAuthenticated())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Message relay refused, source peer " + sourceId + " is not authenticated");
+            return false;
+        }
+
+        if (!isRelayAllowed(sourceId, targetId))
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Message relay denied by rule: " + sourceId + " -> " + targetId);
+            return false;
+        }
+
         try
         {
-            std::string transformedMessage = "[Relayed] " + std::string(message);
+            // Binary messages, such as envelopes, start with a NUL byte and
+            // are forwarded untouched so the receiver can still decode them.
+            std::string transformedMessage = !message.empty() && message.front() == '\0'
+                                                 ? std::string(message)
+                                                 : "[Relayed] " + std::string(message);
             if (targetPeer->sendMessage(transformedMessage))
             {
                 sourcePeer->updateLastActive();
                 targetPeer->updateLastActive();
-                Logger::getInstance().log(LogLevel::INFO, "Relayed message from " + sourceId + " to " + targetId + ": " + transformedMessage);
+                Logger::getInstance().log(LogLevel::DEBUG, "Relayed message of " + std::to_string(transformedMessage.size()) + " bytes from " + sourceId + " to " + targetId);
                 return true;
             }
             else
@@ -159,36 +181,151 @@ namespace relay
         return peerList;
     }
 
-    void PeerManager::broadcast(const std::string &message)
+    void PeerManager::broadcast(const std::string &message, const std::string &sourceId, const DeliveryFailureHandler &onFailure)
     {
-        std::lock_guard<std::mutex> lock(mutex_);
-        for (auto &[id, peer] : peers_)
+        if (!isRelayAuthenticated(sourceId))
         {
-            if (peer->getSocket()->getMode() == SocketMode::TCP_SERVER)
-            {
-                Logger::getInstance().log(LogLevel::INFO, "Skipping broadcast to server peer " + id + "; relaying to clients");
+            Logger::getInstance().log(LogLevel::WARNING, "Broadcast refused, source peer " + sourceId + " is not authenticated");
+            return;
+        }
 
-                for (const auto &client : peer->getClients())
+        std::vector<std::pair<std::string, DeliveryFailure>> failures;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            for (auto &[id, peer] : peers_)
+            {
+                if (!sourceId.empty() && id == sourceId)
+                {
+                    continue;
+                }
+                if (!isRelayAllowed(sourceId, id))
                 {
-                    if (!client->send(message))
-                    {
-                        Logger::getInstance().log(LogLevel::WARNING, "Failed to relay message");
-                    }
-                    else
-                    {
-                        Logger::getInstance().log(LogLevel::INFO, "Relayed message to client of " + id + " : " + message);
-                    }
+                    Logger::getInstance().log(LogLevel::WARNING, "Skipping broadcast to peer " + id + "; denied by rule");
+                    continue;
                 }
-                continue;
+                if (auto failure = deliverBroadcast(id, *peer, message))
+                    failures.emplace_back(id, *failure);
             }
-            if (!peer->sendMessage(message))
+        }
+
+        // Called without mutex_ so the handler may use the manager.
+        if (onFailure)
+        {
+            for (const auto &[id, reason] : failures)
+                onFailure(id, reason);
+        }
+    }
+
+    bool PeerManager::broadcastTo(const std::string &peerId, const std::string &message, const DeliveryFailureHandler &onFailure)
+    {
+        std::shared_ptr<Peer> peer;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            auto it = peers_.find(peerId);
+            if (it == peers_.end())
+                return false;
+            peer = it->second;
+        }
+        if (!isRelayAllowed("", peerId))
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Skipping broadcast to peer " + peerId + "; denied by rule");
+            return false;
+        }
+
+        // Delivered without mutex_ so broadcasts to different peers can run in parallel.
+        auto failure = deliverBroadcast(peerId, *peer, message);
+        if (failure && onFailure)
+            onFailure(peerId, *failure);
+        return true;
+    }
+
+    std::optional<DeliveryFailure> PeerManager::deliverBroadcast(const std::string &id, Peer &peer, const std::string &message)
+    {
+        if (peer.getSocket()->getMode() == SocketMode::TCP_SERVER)
+        {
+            Logger::getInstance().log(LogLevel::INFO, "Skipping broadcast to server peer " + id + "; relaying to clients");
+
+            Frame frame;
+            frame.payload = message;
+            peer.prepareFrame(frame);
+            std::optional<DeliveryFailure> failure;
+            for (const auto &client : peer.getClients())
             {
-                Logger::getInstance().log(LogLevel::WARNING, "Failed to broadcast message to peer " + id);
+                if (!client->sendFrame(frame))
+                {
+                    Logger::getInstance().log(LogLevel::WARNING, "Failed to relay message");
+                    if (!failure)
+                        failure = client->isOpen() ? DeliveryFailure::SEND_FAILED : DeliveryFailure::DISCONNECTED;
+                }
+                else
+                {
+                    Logger::getInstance().log(LogLevel::DEBUG, "Relayed message of " + std::to_string(message.size()) + " bytes to client of " + id);
+                }
             }
-            else
+            return failure;
+        }
+        if (peer.isCircuitOpen())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Skipping broadcast to peer " + id + "; circuit open");
+            return DeliveryFailure::CIRCUIT_OPEN;
+        }
+        if (!peer.isConnected())
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Skipping broadcast to peer " + id + "; disconnected");
+            return DeliveryFailure::DISCONNECTED;
+        }
+        if (!peer.sendMessage(message))
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Failed to broadcast message to peer " + id);
+            return DeliveryFailure::SEND_FAILED;
+        }
+        Logger::getInstance().log(LogLevel::DEBUG, "Broadcasted message of " + std::to_string(message.size()) + " bytes to peer " + id);
+        return std::nullopt;
+    }
+
+    void PeerManager::setRelayRule(const std::string &fromId, const std::string &toId, bool allowed)
+    {
+        std::lock_guard<std::mutex> lock(rulesMutex_);
+        relayRules_[{fromId, toId}] = allowed;
+        Logger::getInstance().log(LogLevel::INFO, "Relay rule set: " + fromId + " -> " + toId + (allowed ? " allowed" : " denied"));
+    }
+
+    void PeerManager::setRequireAuthenticatedRelays(bool required)
+    {
+        requireAuthenticated_ = required;
+    }
+
+    bool PeerManager::isRelayAuthenticated(const std::string &sourceId) const
+    {
+        if (!requireAuthenticated_ || sourceId.empty())
+            return true;
+        auto source = getPeer(sourceId);
+        return source && source->isAuthenticated();
+    }
+
+    bool PeerManager::isRelayAllowed(const std::string &fromId, const std::string &toId) const
+    {
+        std::lock_guard<std::mutex> lock(rulesMutex_);
+        if (relayRules_.empty())
+        {
+            return true;
+        }
+
+        // Most specific rule wins: exact pair, then either side wildcarded, then both.
+        const std::pair<std::string, std::string> candidates[] = {
+            {fromId, toId},
+            {fromId, "*"},
+            {"*", toId},
+            {"*", "*"},
+        };
+        for (const auto &key : candidates)
+        {
+            auto it = relayRules_.find(key);
+            if (it != relayRules_.end())
             {
-                Logger::getInstance().log(LogLevel::INFO, "Broadcasted message to peer " + id + ": " + message);
+                return it->second;
             }
         }
+        return true;
     }
 };
\ No newline at end of file
@@ -0,0 +1,169 @@
+#include "../include/relay/proxy.h"
+#include "../include/relay/secure_channel.h"
+#include "../include/relay/logger.h"
+#include <openssl/evp.h>
+#include <cerrno>
+#include <cstdlib>
+#include <string>
+
+namespace relay
+{
+
+    namespace
+    {
+        constexpr size_t MAX_CONNECT_RESPONSE = 16 * 1024; // Longest HTTP response header accepted.
+
+        std::string base64(const std::string &data)
+        {
+            std::string out(4 * ((data.size() + 2) / 3) + 1, '\0');
+            int len = EVP_EncodeBlock(reinterpret_cast<unsigned char *>(&out[0]),
+                                      reinterpret_cast<const unsigned char *>(data.data()), static_cast<int>(data.size()));
+            out.resize(len > 0 ? len : 0);
+            return out;
+        }
+
+        // Maps a SOCKS5 reply code to an errno.
+        int socksReplyError(unsigned char reply)
+        {
+            switch (reply)
+            {
+            case 0x00:
+                return 0;
+            case 0x02: // Connection not allowed by ruleset.
+                return EACCES;
+            case 0x03: // Network unreachable.
+            case 0x04: // Host unreachable.
+            case 0x05: // Connection refused.
+            case 0x06: // TTL expired.
+                return ECONNREFUSED;
+            default:
+                return EPROTO;
+            }
+        }
+
+        int socks5Tunnel(int fd, const ProxySettings &proxy, const std::string &host, int port, handshake::Deadline deadline)
+        {
+            int error = 0;
+            std::string reply;
+            bool login = !proxy.username.empty();
+            std::string greeting = login ? std::string("\x05\x01\x02", 3) : std::string("\x05\x01\x00", 3);
+            if (!handshake::sendAll(fd, greeting, deadline, error) || !handshake::receiveExactly(fd, 2, reply, deadline, error))
+                return error;
+            if (reply[0] != 0x05 || static_cast<unsigned char>(reply[1]) == 0xFF)
+                return reply[0] == 0x05 ? EACCES : EPROTO;
+            if (reply[1] == 0x02)
+            {
+                if (proxy.username.size() > 255 || proxy.password.size() > 255)
+                    return EINVAL;
+                std::string auth("\x01", 1);
+                auth += static_cast<char>(proxy.username.size());
+                auth += proxy.username;
+                auth += static_cast<char>(proxy.password.size());
+                auth += proxy.password;
+                if (!handshake::sendAll(fd, auth, deadline, error) || !handshake::receiveExactly(fd, 2, reply, deadline, error))
+                    return error;
+                if (reply[1] != 0x00)
+                    return EACCES;
+            }
+            else if (reply[1] != 0x00)
+            {
+                return EPROTO;
+            }
+
+            std::string request("\x05\x01\x00", 3);
+            InetAddress ip;
+            if (parseInetAddress(host, port, ip) && ip.family() == AF_INET)
+            {
+                request += '\x01';
+                request.append(reinterpret_cast<const char *>(&reinterpret_cast<const sockaddr_in &>(ip.storage).sin_addr), 4);
+            }
+            else if (ip.length > 0)
+            {
+                request += '\x04';
+                request.append(reinterpret_cast<const char *>(&reinterpret_cast<const sockaddr_in6 &>(ip.storage).sin6_addr), 16);
+            }
+            else
+            {
+                if (host.empty() || host.size() > 255)
+                    return EINVAL;
+                request += '\x03';
+                request += static_cast<char>(host.size());
+                request += host;
+            }
+            request += static_cast<char>((port >> 8) & 0xFF);
+            request += static_cast<char>(port & 0xFF);
+            if (!handshake::sendAll(fd, request, deadline, error) || !handshake::receiveExactly(fd, 4, reply, deadline, error))
+                return error;
+            if (reply[0] != 0x05)
+                return EPROTO;
+            if (int replyError = socksReplyError(static_cast<unsigned char>(reply[1])))
+                return replyError;
+
+            // Skip the bound address the proxy reports.
+            size_t addressLen;
+            std::string length;
+            switch (reply[3])
+            {
+            case 0x01:
+                addressLen = 4;
+                break;
+            case 0x04:
+                addressLen = 16;
+                break;
+            case 0x03:
+                if (!handshake::receiveExactly(fd, 1, length, deadline, error))
+                    return error;
+                addressLen = static_cast<unsigned char>(length[0]);
+                break;
+            default:
+                return EPROTO;
+            }
+            return handshake::receiveExactly(fd, addressLen + 2, reply, deadline, error) ? 0 : error;
+        }
+
+        int httpConnectTunnel(int fd, const ProxySettings &proxy, const std::string &host, int port, handshake::Deadline deadline)
+        {
+            InetAddress ip;
+            std::string target = parseInetAddress(host, port, ip) ? formatInetAddress(ip.get()) : host + ":" + std::to_string(port);
+            std::string request = "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n";
+            if (!proxy.username.empty())
+                request += "Proxy-Authorization: Basic " + base64(proxy.username + ":" + proxy.password) + "\r\n";
+            request += "\r\n";
+            int error = 0;
+            if (!handshake::sendAll(fd, request, deadline, error))
+                return error;
+
+            // Read the response header a byte at a time, so nothing the target sends is consumed.
+            std::string response;
+            std::string byte;
+            while (response.size() < 4 || response.compare(response.size() - 4, 4, "\r\n\r\n") != 0)
+            {
+                if (response.size() >= MAX_CONNECT_RESPONSE)
+                    return EPROTO;
+                if (!handshake::receiveExactly(fd, 1, byte, deadline, error))
+                    return error;
+                response += byte;
+            }
+            if (response.compare(0, 5, "HTTP/") != 0)
+                return EPROTO;
+            size_t space = response.find(' ');
+            int status = space == std::string::npos ? 0 : std::atoi(response.c_str() + space + 1);
+            if (status / 100 == 2)
+                return 0;
+            Logger::getInstance().log(LogLevel::WARNING, "Proxy refused CONNECT " + target + ": " + response.substr(0, response.find('\r')));
+            if (status == 407 || status == 403)
+                return EACCES;
+            return status >= 400 ? ECONNREFUSED : EPROTO;
+        }
+    } // namespace
+
+    int openProxyTunnel(int socketFd, const ProxySettings &proxy, const std::string &host, int port,
+                        std::chrono::steady_clock::time_point deadline)
+    {
+        if (port <= 0 || port > 65535)
+            return EINVAL;
+        return proxy.kind == ProxyKind::SOCKS5 ? socks5Tunnel(socketFd, proxy, host, port, deadline)
+                                               : httpConnectTunnel(socketFd, proxy, host, port, deadline);
+    }
+
+} // namespace relay
@@ -3,29 +3,290 @@
 #include "../include/relay/peer_manager.h"
 #include "../include/relay/peer_discovery.h"
 #include "../include/relay/socket_wrapper.h"
+#include "../include/relay/message_dispatcher.h"
+#include "../include/relay/tls.h"
+#include "../include/relay/noise.h"
+#include "../include/relay/shared_secret.h"
+#include "../include/relay/websocket.h"
+#include "../include/relay/memory.h"
+#include "../include/relay/udp.h"
+#include "../include/relay/inet_address.h"
+#include "../include/relay/logger.h"
+#include <cerrno>
 #include <cstring>
+#include <cstdlib>
 #include <vector>
+#include <algorithm>
 
-extern "C"
+namespace
 {
+    // listenerStatus reports why accepting on a server peer stopped.
+    int listenerStatus(relay::Peer *peer)
+    {
+        auto socket = peer->getSocket();
+        if (!socket || socket->getMode() != relay::SocketMode::TCP_SERVER)
+            return RELAY_ERR_FAILED;
+        return socket->isListening() ? RELAY_ERR_FAILED : RELAY_ERR_LISTENER_CLOSED;
+    }
 
-    // Peer functions
-    RelayPeer relay_create_peer(const char *id, const char *ip, int port, int isServer)
+    // sendFailureStatus reports why a send to peer failed.
+    int sendFailureStatus(relay::Peer *peer)
+    {
+        if (peer->isSendRetryable())
+            return RELAY_ERR_TEMPORARY;
+        return peer->isConnected() ? RELAY_ERR_FAILED : RELAY_ERR_DISCONNECTED;
+    }
+
+    // setupErrorStatus maps the errno of a failed bind, connect or listen to a status code.
+    int setupErrorStatus(int error)
+    {
+        switch (error)
+        {
+        case ECONNREFUSED:
+            return RELAY_ERR_CONNECTION_REFUSED;
+        case EADDRINUSE:
+            return RELAY_ERR_ADDRESS_IN_USE;
+        case EINVAL:
+            return RELAY_ERR_INVALID_ADDRESS;
+        case ETIMEDOUT:
+            return RELAY_ERR_TIMEOUT;
+        case EPROTO:
+        case EACCES:
+            return RELAY_ERR_HANDSHAKE_FAILED;
+        case ESHUTDOWN:
+            return RELAY_ERR_SERVER_DRAINING;
+        default:
+            return RELAY_ERR_FAILED;
+        }
+    }
+
+    // tlsSettings converts RelayTlsOptions for relay::TlsContext.
+    relay::TlsSettings tlsSettings(const RelayTlsOptions &options)
+    {
+        relay::TlsSettings settings;
+        for (int i = 0; i < options.certificateCount; i++)
+            settings.certificateChain.emplace_back(options.certificates[i], options.certificateLens[i]);
+        if (options.privateKey)
+            settings.privateKey.assign(options.privateKey, options.privateKeyLen);
+        if (options.serverName)
+            settings.serverName = options.serverName;
+        settings.clientAuth = options.clientAuth >= 2 ? relay::ClientAuth::REQUIRE
+                              : options.clientAuth == 1 ? relay::ClientAuth::REQUEST
+                                                        : relay::ClientAuth::NONE;
+        settings.minVersion = options.minVersion;
+        settings.maxVersion = options.maxVersion;
+        settings.authenticatesPeer = options.authenticated != 0;
+        if (options.verify)
+        {
+            RelayVerifyCallback verify = options.verify;
+            uintptr_t context = options.verifyContext;
+            settings.verify = [verify, context](const std::vector<std::string> &chain)
+            {
+                std::vector<const char *> certificates;
+                std::vector<size_t> lens;
+                for (const auto &cert : chain)
+                {
+                    certificates.push_back(cert.data());
+                    lens.push_back(cert.size());
+                }
+                return verify(context, certificates.data(), lens.data(), static_cast<int>(chain.size())) == 1;
+            };
+        }
+        return settings;
+    }
+
+    // noiseSettings converts RelayNoiseOptions for relay::NoiseContext.
+    relay::NoiseSettings noiseSettings(const RelayNoiseOptions &options)
+    {
+        relay::NoiseSettings settings;
+        if (options.privateKey)
+            settings.staticPrivateKey.assign(options.privateKey, relay::NOISE_KEY_SIZE);
+        for (int i = 0; i < options.remoteKeyCount; i++)
+            settings.remoteStaticKeys.emplace_back(options.remoteKeys + i * relay::NOISE_KEY_SIZE, relay::NOISE_KEY_SIZE);
+        return settings;
+    }
+
+    // sharedSecretSettings converts RelayAuthOptions for relay::SharedSecretContext.
+    relay::SharedSecretSettings sharedSecretSettings(const RelayAuthOptions &options)
     {
+        relay::SharedSecretSettings settings;
+        for (int i = 0; i < options.secretCount; i++)
+            settings.secrets.emplace_back(options.secrets[i], options.secretLens[i]);
+        return settings;
+    }
+
+    // deliveryFailureStatus maps why a broadcast missed a peer to a status code.
+    int deliveryFailureStatus(relay::DeliveryFailure reason)
+    {
+        switch (reason)
+        {
+        case relay::DeliveryFailure::CIRCUIT_OPEN:
+            return RELAY_ERR_CIRCUIT_OPEN;
+        case relay::DeliveryFailure::DISCONNECTED:
+            return RELAY_ERR_DISCONNECTED;
+        default:
+            return RELAY_ERR_FAILED;
+        }
+    }
+
+    // receiveFailureStatus maps why a receive returned no message to a status code.
+    int receiveFailureStatus(relay::ReceiveStatus status)
+    {
+        switch (status)
+        {
+        case relay::ReceiveStatus::CLOSED:
+            return RELAY_ERR_DISCONNECTED;
+        case relay::ReceiveStatus::DESYNC:
+            return RELAY_ERR_FRAME_DESYNC;
+        case relay::ReceiveStatus::IDLE:
+            return RELAY_ERR_READ_IDLE;
+        case relay::ReceiveStatus::TIMEOUT:
+            return RELAY_ERR_TIMEOUT;
+        default:
+            return RELAY_ERR_FAILED;
+        }
+    }
+
+    // sendToClient sends to one client of a server peer, reporting unknown and closed clients.
+    int sendToClient(RelayPeer peer, uint64_t clientId, const char *data, size_t len, bool unreliable)
+    {
+        if (!peer || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->sendToClient(clientId, data ? std::string(data, len) : std::string(), unreliable))
+            return RELAY_OK;
+        if (!p->hasClient(clientId))
+            return RELAY_ERR_NOT_FOUND;
+        return p->isClientOpen(clientId) ? RELAY_ERR_FAILED : RELAY_ERR_DISCONNECTED;
+    }
+
+    // dispatcher serves every peer with a message callback. It is never destroyed, since its
+    // thread may be running a callback into the host when the process exits.
+    relay::MessageDispatcher &dispatcher()
+    {
+        static auto *instance = new relay::MessageDispatcher();
+        return *instance;
+    }
+
+    // Opens a peer for relay_open_peer_with, or a client peer on the connected socket fd for
+    // relay_open_peer_fd if fd is not -1. The fd is closed on failure.
+    RelayPeer openPeer(const char *id, const char *ip, int port, int isServer, const RelayOpenOptions *options, int fd, int *status)
+    {
+        int ignored;
+        int &result = status ? *status : ignored;
+        result = RELAY_ERR_FAILED;
+        auto adopted = fd >= 0 ? std::make_shared<relay::SocketWrapper>(fd) : nullptr;
+        RelayOpenOptions defaults{nullptr, 0, 0, 0, nullptr, nullptr, nullptr, nullptr, nullptr, 0, nullptr, 0, 0, 0};
+        const RelayOpenOptions &opts = options ? *options : defaults;
+        const char *localIp = opts.localIp;
+        int localPort = opts.localPort;
+        int backlog = opts.backlog > 0 ? opts.backlog : relay::DEFAULT_LISTEN_BACKLOG;
+        auto connectTimeout = std::chrono::milliseconds(std::max<int64_t>(opts.connectTimeoutMs, 0));
+        std::shared_ptr<const relay::ChannelSecurity> security;
+        const char *securityName = opts.websocket ? "WebSocket" : opts.tls ? "TLS" : opts.noise ? "Noise" : "shared secret";
+        if ((opts.tls ? 1 : 0) + (opts.noise ? 1 : 0) + (opts.auth ? 1 : 0) > 1)
+        {
+            fprintf(stderr, "[ERROR] Peer %s can only use one of TLS, Noise and shared secrets\n", id);
+            result = RELAY_ERR_INVALID_CONFIG;
+            return nullptr;
+        }
+        try
+        {
+            if (opts.tls)
+                security = std::make_shared<relay::TlsContext>(tlsSettings(*opts.tls));
+            else if (opts.noise)
+                security = std::make_shared<relay::NoiseContext>(noiseSettings(*opts.noise));
+            else if (opts.auth)
+                security = std::make_shared<relay::SharedSecretContext>(sharedSecretSettings(*opts.auth));
+            if (opts.websocket)
+            {
+                relay::WebSocketSettings settings;
+                if (opts.websocket->path && *opts.websocket->path)
+                    settings.path = opts.websocket->path;
+                if (opts.websocket->host)
+                    settings.host = opts.websocket->host;
+                settings.inner = security;
+                security = std::make_shared<relay::WebSocketContext>(std::move(settings));
+            }
+        }
+        catch (const std::exception &e)
+        {
+            fprintf(stderr, "[ERROR] Invalid %s settings for peer %s: %s\n", securityName, id, e.what());
+            result = RELAY_ERR_INVALID_CONFIG;
+            return nullptr;
+        }
+
         auto mode = isServer ? relay::SocketMode::TCP_SERVER : relay::SocketMode::TCP_CLIENT;
-        auto socket = std::make_shared<relay::SocketWrapper>(mode);
-        if (!socket->initialize(ip, port))
+        auto socket = adopted ? adopted : std::make_shared<relay::SocketWrapper>(mode);
+        socket->setConnectTimeout(connectTimeout);
+        if (opts.udp && !adopted)
+        {
+            relay::UdpSettings udp;
+            if (opts.udp->retransmitTimeoutMs > 0)
+                udp.retransmitTimeout = std::chrono::milliseconds(opts.udp->retransmitTimeoutMs);
+            if (opts.udp->window > 0)
+                udp.window = static_cast<size_t>(opts.udp->window);
+            if (opts.udp->idleTimeoutMs > 0)
+                udp.idleTimeout = std::chrono::milliseconds(opts.udp->idleTimeoutMs);
+            if (opts.udp->reassemblyTimeoutMs > 0)
+                udp.reassemblyTimeout = std::chrono::milliseconds(opts.udp->reassemblyTimeoutMs);
+            socket->useUdpTransport(udp);
+        }
+        if (opts.socketMode > 0)
+            socket->setUnixSocketMode(opts.socketMode);
+        relay::BindOptions bind;
+        bind.ipv6Only = opts.ipv6Only != 0;
+        bind.reuseAddress = opts.reuseAddress != 0;
+        bind.reusePort = opts.reusePort != 0;
+        socket->setBindOptions(bind);
+        if (opts.proxy && !isServer && !adopted)
+        {
+            relay::ProxySettings proxy;
+            proxy.kind = opts.proxy->http ? relay::ProxyKind::HTTP_CONNECT : relay::ProxyKind::SOCKS5;
+            if (!opts.proxy->ip || !relay::parseInetAddress(opts.proxy->ip, opts.proxy->port, proxy.address))
+            {
+                fprintf(stderr, "[ERROR] Invalid proxy address for peer %s\n", id);
+                result = RELAY_ERR_INVALID_ADDRESS;
+                return nullptr;
+            }
+            proxy.username = opts.proxy->username ? opts.proxy->username : "";
+            proxy.password = opts.proxy->password ? opts.proxy->password : "";
+            socket->useProxy(proxy);
+        }
+        bool bindLocal = !isServer && !adopted && ((localIp && *localIp) || localPort != 0);
+        if (bindLocal && !socket->bindLocal(localIp ? localIp : "", localPort))
+        {
+            fprintf(stderr, "[ERROR] Failed to bind client peer %s to %s:%d\n", id, localIp ? localIp : "", localPort);
+            result = setupErrorStatus(socket->getSetupError());
+            return nullptr;
+        }
+        if (!adopted && !socket->initialize(ip, port))
         {
             fprintf(stderr, "[ERROR] Failed to initialize %s peer %s at %s:%d\n",
                     isServer ? "server" : "client", id, ip, port);
+            result = setupErrorStatus(socket->getSetupError());
+            return nullptr;
+        }
+        auto handshakeTimeout = connectTimeout.count() > 0 ? std::min(connectTimeout, relay::DEFAULT_HANDSHAKE_TIMEOUT) : relay::DEFAULT_HANDSHAKE_TIMEOUT;
+        if (security && !isServer && !socket->secure(*security, false, handshakeTimeout))
+        {
+            fprintf(stderr, "[ERROR] Peer %s failed the %s handshake with %s:%d\n", id, securityName, ip, port);
+            result = setupErrorStatus(socket->getSetupError());
             return nullptr;
         }
         auto peer = new relay::Peer(id, ip, port, socket);
-        if (isServer)
+        peer->setConnectionSetup(connectTimeout, backlog);
+        peer->setSecurity(security);
+        if (isServer && (opts.udp || relay::isMemoryAddress(ip)))
+        {
+            socket->listen(backlog);
+        }
+        else if (isServer)
         {
             // For server, we need to call listen()
-            if (listen(socket->getSocketFd(), 5) == -1)
-            { // 5 is backlog
+            if (listen(socket->getSocketFd(), backlog) == -1)
+            {
+                result = setupErrorStatus(errno);
                 fprintf(stderr, "[ERROR] Failed to listen on peer %s: %s\n", id, strerror(errno));
                 delete peer;
                 return nullptr;
@@ -33,16 +294,207 @@ extern "C"
         }
         else
         {
-            socket->setReceiveTimeout(2);
+            relay::SocketOptions options;
+            options.receiveTimeout = std::chrono::seconds(2);
+            peer->setSocketOptions(options);
         }
+        result = RELAY_OK;
         return peer;
     }
 
+} // namespace
+
+extern "C"
+{
+
+    // Peer functions
+    RelayPeer relay_create_peer(const char *id, const char *ip, int port, int isServer)
+    {
+        return relay_create_peer_from(id, ip, port, isServer, nullptr, 0);
+    }
+
+    RelayPeer relay_create_peer_from(const char *id, const char *ip, int port, int isServer, const char *localIp, int localPort)
+    {
+        return relay_open_peer(id, ip, port, isServer, localIp, localPort, nullptr);
+    }
+
+    RelayPeer relay_open_peer(const char *id, const char *ip, int port, int isServer, const char *localIp, int localPort, int *status)
+    {
+        RelayOpenOptions options{localIp, localPort, 0, 0, nullptr, nullptr, nullptr, nullptr, nullptr, 0, nullptr, 0, 0, 0};
+        return relay_open_peer_with(id, ip, port, isServer, &options, status);
+    }
+
+    RelayPeer relay_open_peer_with(const char *id, const char *ip, int port, int isServer, const RelayOpenOptions *options, int *status)
+    {
+        return openPeer(id, ip, port, isServer, options, -1, status);
+    }
+
+    RelayPeer relay_open_peer_fd(const char *id, int fd, const char *address, const RelayOpenOptions *options, int *status)
+    {
+        if (fd < 0)
+        {
+            if (status)
+                *status = RELAY_ERR_FAILED;
+            return nullptr;
+        }
+        return openPeer(id, address ? address : "", 0, 0, options, fd, status);
+    }
+
+    int relay_connect_memory(const char *address, int *fd)
+    {
+        if (!address || !fd || !relay::isMemoryAddress(address))
+            return RELAY_ERR_INVALID_ADDRESS;
+        int error = 0;
+        *fd = relay::connectMemory(address + sizeof(relay::MEMORY_SOCKET_PREFIX) - 1, error);
+        return *fd == -1 ? setupErrorStatus(error) : RELAY_OK;
+    }
+
     int relay_send_message(RelayPeer peer, const char *message)
     {
         if (!peer || !message)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        return p->sendMessage(message) ? RELAY_OK : sendFailureStatus(p);
+    }
+
+    int relay_send_bytes(RelayPeer peer, const char *data, size_t len)
+    {
+        if (!peer || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        return p->sendMessage(std::string(data ? data : "", len)) ? RELAY_OK : sendFailureStatus(p);
+    }
+
+    int relay_wait_writable(RelayPeer peer, int64_t timeoutMs)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->waitWritable(std::chrono::milliseconds(timeoutMs)))
+            return RELAY_OK;
+        return p->isConnected() ? RELAY_ERR_TIMEOUT : RELAY_ERR_DISCONNECTED;
+    }
+
+    int relay_send_urgent(RelayPeer peer, const char *message)
+    {
+        if (!peer || !message)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        return p->sendUrgent(message) ? RELAY_OK : sendFailureStatus(p);
+    }
+
+    int relay_send_unreliable(RelayPeer peer, const char *data, size_t len)
+    {
+        if (!peer || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        return p->sendUnreliable(std::string(data ? data : "", len)) ? RELAY_OK : sendFailureStatus(p);
+    }
+
+    uint64_t relay_get_fragments_lost(RelayPeer peer)
+    {
+        if (!peer)
             return 0;
-        return static_cast<relay::Peer *>(peer)->sendMessage(message) ? 1 : 0;
+        return static_cast<relay::Peer *>(peer)->getFragmentsLost();
+    }
+
+    int relay_send_batch(RelayPeer peer, const char **messages, int count, int compress)
+    {
+        if (!peer || (!messages && count > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        std::vector<std::string> batch(messages, messages + count);
+        return p->sendBatch(batch, compress != 0) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    void relay_set_compression_dictionary(RelayPeer peer, const char *dictionary, size_t len)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setCompressionDictionary(dictionary ? std::string(dictionary, len) : std::string());
+    }
+
+    void relay_set_compression_level(RelayPeer peer, int level)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setCompressionLevel(level);
+    }
+
+    int relay_get_compression_level(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getCompressionLevel();
+    }
+
+    void relay_set_compression_threshold(RelayPeer peer, uint64_t bytes)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setCompressionThreshold(bytes);
+    }
+
+    void relay_get_compression_stats(RelayPeer peer, uint64_t *messages, uint64_t *bytesIn, uint64_t *bytesOut)
+    {
+        if (!peer || !messages || !bytesIn || !bytesOut)
+            return;
+        static_cast<relay::Peer *>(peer)->getCompressionStats(*messages, *bytesIn, *bytesOut);
+    }
+
+    int relay_send_tracked(RelayPeer peer, const char *message, uint64_t receiptId)
+    {
+        if (!peer || !message)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        if (p->sendTracked(message, receiptId))
+            return RELAY_OK;
+        return p->isConnected() ? RELAY_ERR_FAILED : RELAY_ERR_DISCONNECTED;
+    }
+
+    int relay_send_tracked_bytes(RelayPeer peer, const char *data, size_t len, uint64_t receiptId)
+    {
+        if (!peer || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        if (p->sendTracked(std::string(data ? data : "", len), receiptId))
+            return RELAY_OK;
+        return p->isConnected() ? RELAY_ERR_FAILED : RELAY_ERR_DISCONNECTED;
+    }
+
+    int relay_poll_receipts(RelayPeer peer, uint64_t *ids, int maxIds, int64_t timeoutMs)
+    {
+        if (!peer || !ids || maxIds <= 0)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        auto receipts = p->pollReceipts(std::chrono::milliseconds(timeoutMs), static_cast<size_t>(maxIds));
+        if (receipts.empty() && !p->isConnected())
+            return RELAY_ERR_DISCONNECTED;
+        std::copy(receipts.begin(), receipts.end(), ids);
+        return static_cast<int>(receipts.size());
+    }
+
+    void relay_set_ack_batching(RelayPeer peer, int count, int64_t intervalMs)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setAckBatching(static_cast<size_t>(std::max(count, 1)), std::chrono::milliseconds(intervalMs));
+    }
+
+    void relay_flush_acks(RelayPeer peer, int dueOnly)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->flushAcks(dueOnly != 0);
     }
 
     const char *relay_receive_message(RelayPeer peer)
@@ -54,21 +506,513 @@ extern "C"
         return result;
     }
 
+    char *relay_receive(RelayPeer peer, int *status, int *urgent)
+    {
+        char *message = nullptr;
+        size_t len = 0;
+        int result = relay_receive_bytes(peer, &message, &len, urgent);
+        if (status)
+            *status = result;
+        return message;
+    }
+
+    int relay_receive_bytes(RelayPeer peer, char **data, size_t *len, int *urgent)
+    {
+        return relay_receive_bytes_within(peer, -1, data, len, urgent);
+    }
+
+    int relay_receive_bytes_within(RelayPeer peer, int64_t timeoutMs, char **data, size_t *len, int *urgent)
+    {
+        return relay_receive_bytes_from(peer, timeoutMs, data, len, urgent, nullptr);
+    }
+
+    int relay_receive_bytes_from(RelayPeer peer, int64_t timeoutMs, char **data, size_t *len, int *urgent, uint64_t *clientId)
+    {
+        int result = RELAY_ERR_FAILED;
+        bool isUrgent = false;
+        uint64_t sender = 0;
+        if (data)
+            *data = nullptr;
+        if (peer && data && len)
+        {
+            std::string msg;
+            auto status = static_cast<relay::Peer *>(peer)->receiveMessage(msg, isUrgent, std::chrono::milliseconds(timeoutMs), sender);
+            if (status != relay::ReceiveStatus::OK)
+            {
+                result = receiveFailureStatus(status);
+            }
+            else
+            {
+                // NUL-terminated as well, so relay_receive can return it as a string. Caller must free.
+                *data = static_cast<char *>(malloc(msg.size() + 1));
+                if (*data)
+                {
+                    memcpy(*data, msg.data(), msg.size());
+                    (*data)[msg.size()] = '\0';
+                    *len = msg.size();
+                    result = RELAY_OK;
+                }
+            }
+        }
+        if (urgent)
+            *urgent = isUrgent ? 1 : 0;
+        if (clientId)
+            *clientId = sender;
+        return result;
+    }
+
+    int relay_peek_message(RelayPeer peer, char **data, size_t *len)
+    {
+        if (!peer || !data || !len)
+            return 0;
+        std::string msg;
+        if (!static_cast<relay::Peer *>(peer)->peekMessage(msg))
+            return 0;
+        *data = static_cast<char *>(malloc(msg.size() + 1));
+        if (!*data)
+            return 0;
+        memcpy(*data, msg.data(), msg.size());
+        (*data)[msg.size()] = '\0';
+        *len = msg.size();
+        return 1;
+    }
+
     void relay_close_peer(RelayPeer peer)
     {
         if (peer)
             static_cast<relay::Peer *>(peer)->closeConnection();
     }
 
+    int relay_close_peer_gracefully(RelayPeer peer, int64_t timeoutMs)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        return static_cast<relay::Peer *>(peer)->closeGracefully(std::chrono::milliseconds(timeoutMs)) ? RELAY_OK : RELAY_ERR_TIMEOUT;
+    }
+
+    void relay_shutdown_peer_write(RelayPeer peer)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->shutdownWrite();
+    }
+
+    int64_t relay_get_peer_latency(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getLatency();
+    }
+
+    int relay_get_peer_messages_sent(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getMessagesSent();
+    }
+
+    int relay_get_peer_messages_received(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getMessagesReceived();
+    }
+
+    size_t relay_get_peer_bytes_sent(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getBytesSent();
+    }
+
+    size_t relay_get_peer_bytes_received(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getBytesReceived();
+    }
+
+    int relay_is_peer_connected(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->isConnected() ? 1 : 0;
+    }
+
+    int relay_is_peer_authenticated(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->isAuthenticated() ? 1 : 0;
+    }
+
+    int relay_rotate_keys(RelayPeer peer)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        if (static_cast<relay::Peer *>(peer)->rotateKeys())
+            return RELAY_OK;
+        switch (errno)
+        {
+        case ENOTSUP:
+            return RELAY_ERR_NOT_ENCRYPTED;
+        case ENOTCONN:
+            return RELAY_ERR_DISCONNECTED;
+        default:
+            return RELAY_ERR_FAILED;
+        }
+    }
+
+    int relay_set_accept_filter(RelayPeer peer, RelayAcceptCallback filter, uintptr_t context)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (!filter)
+        {
+            p->setAcceptFilter(nullptr);
+            return RELAY_OK;
+        }
+        p->setAcceptFilter([filter, context](const std::string &address, const std::string &identity)
+                           { return filter(context, address.c_str(), identity.data(), identity.size()) == 1; });
+        return RELAY_OK;
+    }
+
+    int relay_get_remote_identity(RelayPeer peer, uint64_t clientId, char **data, size_t *len)
+    {
+        if (!peer || !data || !len)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        std::string identity = clientId == 0 ? p->getRemoteIdentity() : p->getClientRemoteIdentity(clientId);
+        if (identity.empty())
+            return RELAY_ERR_NOT_FOUND;
+        *data = static_cast<char *>(malloc(identity.size()));
+        if (!*data)
+            return RELAY_ERR_FAILED;
+        memcpy(*data, identity.data(), identity.size());
+        *len = identity.size();
+        return RELAY_OK;
+    }
+
+    void relay_set_circuit_breaker(RelayPeer peer, int failureThreshold, int64_t cooldownMs)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setCircuitBreaker(failureThreshold, std::chrono::milliseconds(cooldownMs));
+    }
+
+    void relay_set_replay_protection(RelayPeer peer, int64_t windowMs)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setReplayProtection(std::chrono::milliseconds(windowMs));
+    }
+
+    void relay_set_frame_resync(RelayPeer peer, int enabled)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setFrameResync(enabled != 0);
+    }
+
+    uint64_t relay_get_frame_desyncs(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getFrameDesyncs();
+    }
+
+    void relay_set_read_idle_timeout(RelayPeer peer, int64_t timeoutMs)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setReadIdleTimeout(std::chrono::milliseconds(timeoutMs));
+    }
+
+    void relay_set_max_message_size(RelayPeer peer, uint64_t bytes)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setMaxMessageSize(bytes);
+    }
+
+    uint64_t relay_get_replays_rejected(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getReplaysRejected();
+    }
+
+    int relay_configure_peer(RelayPeer peer, const RelayPeerOptions *options)
+    {
+        if (!peer || !options)
+            return RELAY_ERR_FAILED;
+        relay::SocketOptions socketOptions;
+        socketOptions.sendBufferSize = options->sendBufferSize;
+        socketOptions.receiveBufferSize = options->receiveBufferSize;
+        socketOptions.sendTimeout = std::chrono::milliseconds(options->sendTimeoutMs);
+        socketOptions.receiveTimeout = std::chrono::milliseconds(options->receiveTimeoutMs);
+        if (options->noDelay != 0)
+            socketOptions.noDelay = options->noDelay > 0;
+        socketOptions.keepAlive = std::chrono::milliseconds(options->keepAliveMs);
+        socketOptions.keepAliveInterval = std::chrono::milliseconds(options->keepAliveIntervalMs);
+        socketOptions.keepAliveCount = options->keepAliveCount;
+        return static_cast<relay::Peer *>(peer)->setSocketOptions(socketOptions) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    int relay_reconnect_peer(RelayPeer peer, const char *ip, int port, const char *localIp, int localPort)
+    {
+        if (!peer || !ip)
+            return RELAY_ERR_FAILED;
+        return static_cast<relay::Peer *>(peer)->reconnect(ip, port, localIp ? localIp : "", localPort) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    int relay_set_peer_cork(RelayPeer peer, int enabled)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        return static_cast<relay::Peer *>(peer)->setCork(enabled != 0) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    int relay_grow_receive_buffer(RelayPeer peer, int64_t bytes)
+    {
+        if (!peer || bytes <= 0)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (!p->isConnected())
+            return RELAY_ERR_DISCONNECTED;
+        return p->growReceiveBuffer(static_cast<size_t>(bytes)) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    int relay_get_peer_path_mtu(RelayPeer peer)
+    {
+        if (!peer)
+            return -1;
+        return static_cast<relay::Peer *>(peer)->getPathMtu();
+    }
+
+    int relay_get_peer_buffer_sizes(RelayPeer peer, int *sendBytes, int *recvBytes)
+    {
+        if (!peer || !sendBytes || !recvBytes)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (p->getBufferSizes(*sendBytes, *recvBytes))
+            return RELAY_OK;
+        return p->isConnected() ? RELAY_ERR_FAILED : RELAY_ERR_DISCONNECTED;
+    }
+
     void relay_destroy_peer(RelayPeer peer)
     {
+        dispatcher().unsubscribe(static_cast<relay::Peer *>(peer));
         delete static_cast<relay::Peer *>(peer);
     }
 
-    void relay_accept_clients(RelayPeer peer, int maxClients)
+    void relay_set_peer_events(RelayPeer peer, int enabled)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->setEventRecording(enabled != 0);
+    }
+
+    int relay_take_peer_events(RelayPeer peer, RelayPeerEvent **events, int *count)
+    {
+        if (!peer || !events || !count)
+            return RELAY_ERR_FAILED;
+        auto taken = static_cast<relay::Peer *>(peer)->takeEvents();
+        *count = 0;
+        *events = nullptr;
+        if (taken.empty())
+            return RELAY_OK;
+        *events = static_cast<RelayPeerEvent *>(malloc(taken.size() * sizeof(RelayPeerEvent)));
+        if (!*events)
+            return RELAY_ERR_FAILED;
+        *count = static_cast<int>(taken.size());
+        for (size_t i = 0; i < taken.size(); ++i)
+        {
+            (*events)[i].kind = static_cast<int>(taken[i].kind);
+            (*events)[i].reason = static_cast<int>(taken[i].reason);
+            (*events)[i].clientId = taken[i].clientId;
+            (*events)[i].address = strdup(taken[i].address.c_str());
+        }
+        return RELAY_OK;
+    }
+
+    void relay_free_peer_events(RelayPeerEvent *events, int count)
+    {
+        if (!events)
+            return;
+        for (int i = 0; i < count; ++i)
+            free(events[i].address);
+        free(events);
+    }
+
+    int relay_set_message_callback(RelayPeer peer, RelayMessageCallback callback, uintptr_t context)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        if (!callback)
+        {
+            dispatcher().unsubscribe(p);
+            return RELAY_OK;
+        }
+        dispatcher().subscribe(p, [callback, context](relay::ReceiveStatus status, const std::string &message, bool urgent)
+                               {
+                                   int result = status == relay::ReceiveStatus::OK ? RELAY_OK : receiveFailureStatus(status);
+                                   callback(context, result, message.data(), message.size(), urgent ? 1 : 0); });
+        return RELAY_OK;
+    }
+
+    int relay_accept_clients(RelayPeer peer, int maxClients, int *accepted)
+    {
+        int count = 0;
+        int status = RELAY_ERR_FAILED;
+        if (peer)
+        {
+            auto p = static_cast<relay::Peer *>(peer);
+            status = p->acceptClients(maxClients, count) ? RELAY_OK : listenerStatus(p);
+        }
+        if (accepted)
+            *accepted = count;
+        return status;
+    }
+
+    void relay_stop_accepting(RelayPeer peer)
+    {
+        if (peer)
+            static_cast<relay::Peer *>(peer)->stopAccepting();
+    }
+
+    void relay_set_draining(RelayPeer peer, int draining)
     {
         if (peer)
-            static_cast<relay::Peer *>(peer)->acceptClients(maxClients);
+            static_cast<relay::Peer *>(peer)->setDraining(draining != 0);
+    }
+
+    int relay_accept_client(RelayPeer peer, int64_t timeoutMs)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        return p->acceptClient(std::chrono::milliseconds(timeoutMs)) ? RELAY_OK : listenerStatus(p);
+    }
+
+    int relay_accept_client_id(RelayPeer peer, int64_t timeoutMs, uint64_t *clientId)
+    {
+        if (!peer || !clientId)
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        return p->acceptClient(std::chrono::milliseconds(timeoutMs), *clientId) ? RELAY_OK : listenerStatus(p);
+    }
+
+    int relay_send_to_client(RelayPeer peer, uint64_t clientId, const char *data, size_t len)
+    {
+        return sendToClient(peer, clientId, data, len, false);
+    }
+
+    int relay_send_to_client_unreliable(RelayPeer peer, uint64_t clientId, const char *data, size_t len)
+    {
+        return sendToClient(peer, clientId, data, len, true);
+    }
+
+    int relay_close_client(RelayPeer peer, uint64_t clientId)
+    {
+        if (!peer)
+            return RELAY_ERR_FAILED;
+        return static_cast<relay::Peer *>(peer)->closeClient(clientId) ? RELAY_OK : RELAY_ERR_NOT_FOUND;
+    }
+
+    int relay_is_client_connected(RelayPeer peer, uint64_t clientId)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->isClientOpen(clientId) ? 1 : 0;
+    }
+
+    int relay_is_client_drained(RelayPeer peer, uint64_t clientId)
+    {
+        if (!peer)
+            return 1;
+        return static_cast<relay::Peer *>(peer)->isClientDrained(clientId) ? 1 : 0;
+    }
+
+    char *relay_get_client_address(RelayPeer peer, uint64_t clientId)
+    {
+        if (!peer)
+            return strdup("");
+        return strdup(static_cast<relay::Peer *>(peer)->getClientAddress(clientId).c_str()); // Caller must free
+    }
+
+    char *relay_get_local_address(RelayPeer peer)
+    {
+        auto socket = peer ? static_cast<relay::Peer *>(peer)->getSocket() : nullptr;
+        return strdup(socket ? socket->getLocalAddress().c_str() : ""); // Caller must free
+    }
+
+    char *relay_get_remote_address(RelayPeer peer)
+    {
+        auto socket = peer ? static_cast<relay::Peer *>(peer)->getSocket() : nullptr;
+        return strdup(socket ? socket->getRemoteAddress().c_str() : ""); // Caller must free
+    }
+
+    int relay_get_client_count(RelayPeer peer)
+    {
+        if (!peer)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->getClientCount();
+    }
+
+    uint32_t relay_open_stream(RelayPeer peer)
+    {
+        return relay_open_named_stream(peer, nullptr, 0);
+    }
+
+    uint32_t relay_open_named_stream(RelayPeer peer, const char *name, size_t len)
+    {
+        if (!peer || (!name && len > 0))
+            return 0;
+        return static_cast<relay::Peer *>(peer)->openStream(name ? std::string(name, len) : std::string());
+    }
+
+    int relay_send_stream_frame(RelayPeer peer, uint32_t streamId, int kind, const char *data, size_t len)
+    {
+        if (!peer || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto p = static_cast<relay::Peer *>(peer);
+        std::string payload = data ? std::string(data, len) : std::string();
+        return p->sendStreamFrame(streamId, static_cast<relay::StreamFrameKind>(kind), payload) ? RELAY_OK : sendFailureStatus(p);
+    }
+
+    int relay_receive_stream_frame(RelayPeer peer, int64_t timeoutMs, uint32_t *streamId, int *kind, char **data, size_t *len)
+    {
+        if (!peer || !streamId || !kind || !data || !len)
+            return RELAY_ERR_FAILED;
+        relay::StreamFrame frame;
+        switch (static_cast<relay::Peer *>(peer)->receiveStreamFrame(frame, std::chrono::milliseconds(timeoutMs)))
+        {
+        case relay::ReceiveStatus::OK:
+            break;
+        case relay::ReceiveStatus::CLOSED:
+        case relay::ReceiveStatus::DESYNC:
+            return RELAY_ERR_DISCONNECTED;
+        default:
+            return RELAY_ERR_FAILED;
+        }
+        *data = static_cast<char *>(malloc(frame.data.size() + 1));
+        if (!*data)
+            return RELAY_ERR_FAILED;
+        memcpy(*data, frame.data.data(), frame.data.size());
+        *len = frame.data.size();
+        *streamId = frame.streamId;
+        *kind = static_cast<int>(frame.kind);
+        return RELAY_OK;
+    }
+
+    int relay_close_expired_clients(RelayPeer peer, int64_t maxAgeMs, int64_t graceMs, const char *reason)
+    {
+        if (!peer || !reason)
+            return 0;
+        return static_cast<relay::Peer *>(peer)->closeExpiredClients(std::chrono::milliseconds(maxAgeMs), std::chrono::milliseconds(graceMs), reason);
+    }
+
+    char *relay_get_goodbye_reason(RelayPeer peer)
+    {
+        if (!peer)
+            return strdup("");
+        return strdup(static_cast<relay::Peer *>(peer)->getGoodbyeReason().c_str()); // Caller must free
     }
 
     // PeerManager functions
@@ -85,11 +1029,37 @@ extern "C"
         }
     }
 
+    int relay_remove_peer(RelayPeerManager mgr, const char *peerId)
+    {
+        if (!mgr || !peerId)
+            return RELAY_ERR_FAILED;
+        return static_cast<relay::PeerManager *>(mgr)->removePeer(peerId) ? RELAY_OK : RELAY_ERR_NOT_FOUND;
+    }
+
     int relay_relay_message(RelayPeerManager mgr, const char *sourceId, const char *targetId, const char *message)
     {
-        if (!mgr || !sourceId || !targetId || !message)
-            return 0;
-        return static_cast<relay::PeerManager *>(mgr)->relayMessage(sourceId, targetId, message) ? 1 : 0;
+        if (!message)
+            return RELAY_ERR_FAILED;
+        return relay_relay_bytes(mgr, sourceId, targetId, message, std::strlen(message));
+    }
+
+    int relay_relay_bytes(RelayPeerManager mgr, const char *sourceId, const char *targetId, const char *data, size_t len)
+    {
+        if (!mgr || !sourceId || !targetId || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto manager = static_cast<relay::PeerManager *>(mgr);
+        if (!manager->hasPeer(sourceId) || !manager->hasPeer(targetId))
+            return RELAY_ERR_NOT_FOUND;
+        if (!manager->isRelayAuthenticated(sourceId))
+            return RELAY_ERR_UNAUTHENTICATED;
+        if (!manager->isRelayAllowed(sourceId, targetId))
+            return RELAY_ERR_DENIED;
+        auto target = manager->getPeer(targetId);
+        if (target->isCircuitOpen())
+            return RELAY_ERR_CIRCUIT_OPEN;
+        if (!target->isConnected())
+            return RELAY_ERR_DISCONNECTED;
+        return manager->relayMessage(sourceId, targetId, std::string_view(data ? data : "", len)) ? RELAY_OK : RELAY_ERR_FAILED;
     }
 
     void relay_destroy_peer_manager(RelayPeerManager mgr)
@@ -100,7 +1070,32 @@ extern "C"
     // PeerDiscovery functions
     RelayPeerDiscovery relay_create_peer_discovery(const char *multicastIp, int multicastPort, const char *localIp)
     {
-        return new relay::PeerDiscovery(multicastIp, multicastPort, localIp);
+        return relay_open_peer_discovery(multicastIp, multicastPort, localIp, nullptr);
+    }
+
+    RelayPeerDiscovery relay_open_peer_discovery(const char *multicastIp, int multicastPort, const char *localIp, int *status)
+    {
+        int result = RELAY_ERR_FAILED;
+        RelayPeerDiscovery discovery = nullptr;
+        if (multicastIp && localIp)
+        {
+            try
+            {
+                discovery = new relay::PeerDiscovery(multicastIp, multicastPort, localIp);
+                result = RELAY_OK;
+            }
+            catch (const relay::MulticastUnavailableError &)
+            {
+                result = RELAY_ERR_MULTICAST_UNAVAILABLE;
+            }
+            catch (const std::exception &e)
+            {
+                fprintf(stderr, "[ERROR] Failed to create peer discovery: %s\n", e.what());
+            }
+        }
+        if (status)
+            *status = result;
+        return discovery;
     }
 
     void relay_start_discovery(RelayPeerDiscovery discovery)
@@ -132,6 +1127,72 @@ extern "C"
         return result; // Caller must free array and strings
     }
 
+    const char **relay_get_discovered_peers_page(RelayPeerDiscovery discovery, int offset, int limit, int *count, int *total)
+    {
+        if (!count || !total)
+            return nullptr;
+        *count = 0;
+        *total = 0;
+        if (!discovery || offset < 0 || limit <= 0)
+            return nullptr;
+
+        size_t all = 0;
+        std::vector<std::string> peers = static_cast<relay::PeerDiscovery *>(discovery)->getDiscoveredPeers(offset, limit, all);
+        *total = static_cast<int>(all);
+        if (peers.empty())
+            return nullptr;
+
+        *count = static_cast<int>(peers.size());
+        const char **result = static_cast<const char **>(malloc(peers.size() * sizeof(char *)));
+        for (size_t i = 0; i < peers.size(); ++i)
+        {
+            result[i] = strdup(peers[i].c_str()); // Caller must free each string
+        }
+        return result; // Caller must free array and strings
+    }
+
+    int relay_set_announcement_metadata(RelayPeerDiscovery discovery, const char **keys, const char **values, int count)
+    {
+        if (!discovery || count < 0 || (count > 0 && (!keys || !values)))
+            return RELAY_ERR_FAILED;
+        std::map<std::string, std::string> metadata;
+        for (int i = 0; i < count; ++i)
+        {
+            if (!keys[i] || !values[i])
+                return RELAY_ERR_FAILED;
+            metadata[keys[i]] = values[i];
+        }
+        return static_cast<relay::PeerDiscovery *>(discovery)->setAnnouncementMetadata(metadata) ? RELAY_OK : RELAY_ERR_FAILED;
+    }
+
+    char *relay_get_discovered_peer_metadata(RelayPeerDiscovery discovery, const char *peerAddr)
+    {
+        if (!discovery || !peerAddr)
+            return nullptr;
+        std::map<std::string, std::string> metadata = static_cast<relay::PeerDiscovery *>(discovery)->getPeerMetadata(peerAddr);
+        if (metadata.empty())
+            return nullptr;
+
+        std::string encoded;
+        for (const auto &[key, value] : metadata)
+        {
+            if (!encoded.empty())
+                encoded += '\n';
+            encoded += key + "=" + value;
+        }
+        return strdup(encoded.c_str()); // Caller must free
+    }
+
+    char *relay_get_discovered_peer_interface(RelayPeerDiscovery discovery, const char *peerAddr)
+    {
+        if (!discovery || !peerAddr)
+            return nullptr;
+        std::string interfaceName = static_cast<relay::PeerDiscovery *>(discovery)->getPeerInterface(peerAddr);
+        if (interfaceName.empty())
+            return nullptr;
+        return strdup(interfaceName.c_str()); // Caller must free
+    }
+
     void relay_destroy_peer_discovery(RelayPeerDiscovery discovery)
     {
         delete static_cast<relay::PeerDiscovery *>(discovery);
@@ -146,4 +1207,120 @@ extern "C"
         static_cast<relay::PeerManager *>(mgr)->broadcast(std::string(message));
         return 1;
     }
+
+    int relay_broadcast_from(RelayPeerManager mgr, const char *sourceId, const char *message)
+    {
+        if (!mgr || !sourceId || !message)
+        {
+            return 0;
+        }
+        static_cast<relay::PeerManager *>(mgr)->broadcast(std::string(message), std::string(sourceId));
+        return 1;
+    }
+
+    int relay_broadcast_to(RelayPeerManager mgr, const char *peerId, const char *message)
+    {
+        if (!message)
+            return RELAY_ERR_FAILED;
+        return relay_broadcast_to_bytes(mgr, peerId, message, std::strlen(message));
+    }
+
+    int relay_broadcast_to_bytes(RelayPeerManager mgr, const char *peerId, const char *data, size_t len)
+    {
+        if (!mgr || !peerId || (!data && len > 0))
+            return RELAY_ERR_FAILED;
+        auto m = static_cast<relay::PeerManager *>(mgr);
+        int status = RELAY_OK;
+        bool known = m->broadcastTo(std::string(peerId), std::string(data ? data : "", len),
+                                    [&status](const std::string &, relay::DeliveryFailure reason)
+                                    { status = deliveryFailureStatus(reason); });
+        if (!known)
+            return m->isRelayAllowed("", peerId) ? RELAY_ERR_NOT_FOUND : RELAY_ERR_DENIED;
+        return status;
+    }
+
+    int relay_broadcast_report(RelayPeerManager mgr, const char *sourceId, const char *message, RelayDeliveryFailure **failures, int *count)
+    {
+        if (!message)
+            return 0;
+        return relay_broadcast_report_bytes(mgr, sourceId, message, std::strlen(message), failures, count);
+    }
+
+    int relay_broadcast_report_bytes(RelayPeerManager mgr, const char *sourceId, const char *data, size_t len, RelayDeliveryFailure **failures, int *count)
+    {
+        if (!mgr || (!data && len > 0) || !failures || !count)
+            return 0;
+        std::vector<std::pair<std::string, relay::DeliveryFailure>> failed;
+        static_cast<relay::PeerManager *>(mgr)->broadcast(std::string(data ? data : "", len), sourceId ? std::string(sourceId) : std::string(),
+                                                           [&failed](const std::string &peerId, relay::DeliveryFailure reason)
+                                                           { failed.emplace_back(peerId, reason); });
+
+        *count = static_cast<int>(failed.size());
+        *failures = nullptr;
+        if (failed.empty())
+            return 1;
+        *failures = static_cast<RelayDeliveryFailure *>(malloc(failed.size() * sizeof(RelayDeliveryFailure)));
+        if (!*failures)
+        {
+            *count = 0;
+            return 1;
+        }
+        for (size_t i = 0; i < failed.size(); ++i)
+        {
+            (*failures)[i].peerId = strdup(failed[i].first.c_str());
+            (*failures)[i].status = deliveryFailureStatus(failed[i].second);
+        }
+        return 1;
+    }
+
+    char **relay_get_recent_errors(int *count)
+    {
+        if (!count)
+            return nullptr;
+        auto errors = relay::Logger::getInstance().getRecentErrors();
+        *count = static_cast<int>(errors.size());
+        if (errors.empty())
+            return nullptr;
+        auto list = static_cast<char **>(malloc(errors.size() * sizeof(char *)));
+        for (size_t i = 0; i < errors.size(); ++i)
+            list[i] = strdup(errors[i].c_str());
+        return list;
+    }
+
+    void relay_free_recent_errors(char **errors, int count)
+    {
+        if (!errors)
+            return;
+        for (int i = 0; i < count; ++i)
+            free(errors[i]);
+        free(errors);
+    }
+
+    void relay_free_delivery_failures(RelayDeliveryFailure *failures, int count)
+    {
+        if (!failures)
+            return;
+        for (int i = 0; i < count; ++i)
+            free(failures[i].peerId);
+        free(failures);
+    }
+
+    void relay_add_relay_rule(RelayPeerManager mgr, const char *fromId, const char *toId, int allowed)
+    {
+        if (mgr && fromId && toId)
+            static_cast<relay::PeerManager *>(mgr)->setRelayRule(fromId, toId, allowed != 0);
+    }
+
+    int relay_is_relay_allowed(RelayPeerManager mgr, const char *fromId, const char *toId)
+    {
+        if (!mgr || !fromId || !toId)
+            return 0;
+        return static_cast<relay::PeerManager *>(mgr)->isRelayAllowed(fromId, toId) ? 1 : 0;
+    }
+
+    void relay_set_require_authenticated_relays(RelayPeerManager mgr, int required)
+    {
+        if (mgr)
+            static_cast<relay::PeerManager *>(mgr)->setRequireAuthenticatedRelays(required != 0);
+    }
 }
\ No newline at end of file
@@ -0,0 +1,142 @@
+#include "../include/relay/secure_channel.h"
+#include <sys/socket.h>
+#include <algorithm>
+#include <cerrno>
+#include <climits>
+#include <poll.h>
+
+namespace relay
+{
+
+    namespace
+    {
+        /**
+         * @brief SecureChannel that passes bytes through unchanged.
+         */
+        class PlainChannel : public SecureChannel
+        {
+        public:
+            explicit PlainChannel(int socketFd) : socketFd_(socketFd) {}
+
+            ssize_t read(char *buffer, size_t len) override
+            {
+                ssize_t received;
+                do
+                    received = ::recv(socketFd_, buffer, len, 0);
+                while (received == -1 && errno == EINTR);
+                return received;
+            }
+
+            ssize_t write(const char *data, size_t len) override
+            {
+                ssize_t sent;
+                do
+                    sent = ::send(socketFd_, data, len, MSG_NOSIGNAL);
+                while (sent == -1 && errno == EINTR);
+                return sent;
+            }
+
+            bool hasPending() const override
+            {
+                return false;
+            }
+
+            void shutdown() override
+            {
+                // Nothing to close beyond the socket itself.
+            }
+
+            std::string remoteIdentity() const override
+            {
+                return "";
+            }
+
+            bool rekey() override
+            {
+                errno = ENOTSUP;
+                return false;
+            }
+
+        private:
+            int socketFd_;
+        };
+
+        /// Waits until fd is ready for events; sets error to ETIMEDOUT past the deadline.
+        bool waitFor(int fd, short events, handshake::Deadline deadline, int &error)
+        {
+            while (true)
+            {
+                auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+                if (remaining.count() <= 0)
+                {
+                    error = ETIMEDOUT;
+                    return false;
+                }
+                pollfd pfd{fd, events, 0};
+                int ready = ::poll(&pfd, 1, static_cast<int>(std::min<int64_t>(remaining.count(), INT_MAX)));
+                if (ready > 0)
+                    return true;
+                if (ready == -1 && errno != EINTR)
+                {
+                    error = errno;
+                    return false;
+                }
+            }
+        }
+    }
+
+    std::unique_ptr<SecureChannel> plainChannel(int socketFd)
+    {
+        return std::make_unique<PlainChannel>(socketFd);
+    }
+
+    namespace handshake
+    {
+        bool sendAll(int socketFd, const std::string &data, Deadline deadline, int &error)
+        {
+            size_t total = 0;
+            while (total < data.size())
+            {
+                ssize_t sent = ::send(socketFd, data.data() + total, data.size() - total, MSG_NOSIGNAL);
+                if (sent >= 0)
+                    total += static_cast<size_t>(sent);
+                else if (errno == EAGAIN || errno == EWOULDBLOCK)
+                {
+                    if (!waitFor(socketFd, POLLOUT, deadline, error))
+                        return false;
+                }
+                else if (errno != EINTR)
+                {
+                    error = EPROTO;
+                    return false;
+                }
+            }
+            return true;
+        }
+
+        bool receiveExactly(int socketFd, size_t len, std::string &out, Deadline deadline, int &error)
+        {
+            out.assign(len, '\0');
+            size_t total = 0;
+            while (total < len)
+            {
+                ssize_t received = ::recv(socketFd, &out[total], len - total, 0);
+                if (received > 0)
+                    total += static_cast<size_t>(received);
+                else if (received == -1 && (errno == EAGAIN || errno == EWOULDBLOCK))
+                {
+                    if (!waitFor(socketFd, POLLIN, deadline, error))
+                        return false;
+                }
+                else if (received == 0 || errno != EINTR)
+                {
+                    // The remote end gave up on the handshake.
+                    error = EPROTO;
+                    return false;
+                }
+            }
+            return true;
+        }
+    } // namespace handshake
+
+} // namespace relay
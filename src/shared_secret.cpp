@@ -0,0 +1,133 @@
+#include "../include/relay/shared_secret.h"
+#include "../include/relay/logger.h"
+#include <openssl/crypto.h>
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+#include <openssl/rand.h>
+#include <cerrno>
+#include <fcntl.h>
+#include <stdexcept>
+
+namespace relay
+{
+
+    namespace
+    {
+        /// Starts the accepting end's challenge, so a client reaching a peer without shared
+        /// secrets fails instead of answering garbage.
+        const std::string HELLO = "RLA1";
+        const std::string CLIENT_LABEL = "relay-auth client";
+        const std::string SERVER_LABEL = "relay-auth server";
+
+        constexpr size_t CHALLENGE_SIZE = 32;
+        constexpr size_t PROOF_SIZE = 32;
+
+        /// Returns HMAC-SHA256(secret, label || serverChallenge || clientChallenge).
+        std::string proof(const std::string &secret, const std::string &label,
+                          const std::string &serverChallenge, const std::string &clientChallenge)
+        {
+            std::string data = label + serverChallenge + clientChallenge;
+            unsigned char digest[EVP_MAX_MD_SIZE];
+            unsigned int len = 0;
+            HMAC(EVP_sha256(), secret.data(), static_cast<int>(secret.size()),
+                 reinterpret_cast<const unsigned char *>(data.data()), data.size(), digest, &len);
+            return std::string(reinterpret_cast<char *>(digest), len);
+        }
+
+        bool sameProof(const std::string &a, const std::string &b)
+        {
+            return a.size() == b.size() && CRYPTO_memcmp(a.data(), b.data(), a.size()) == 0;
+        }
+
+        bool randomChallenge(std::string &challenge)
+        {
+            challenge.assign(CHALLENGE_SIZE, '\0');
+            return RAND_bytes(reinterpret_cast<unsigned char *>(&challenge[0]), static_cast<int>(challenge.size())) == 1;
+        }
+    }
+
+    SharedSecretContext::SharedSecretContext(SharedSecretSettings settings) : settings_(std::move(settings))
+    {
+        if (settings_.secrets.empty())
+            throw std::invalid_argument("At least one shared secret is required");
+        for (const auto &secret : settings_.secrets)
+            if (secret.empty())
+                throw std::invalid_argument("Shared secrets must not be empty");
+    }
+
+    bool SharedSecretContext::authenticatesPeer() const
+    {
+        return true;
+    }
+
+    std::unique_ptr<SecureChannel> SharedSecretContext::handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const
+    {
+        error = EPROTO;
+        int flags = fcntl(socketFd, F_GETFL, 0);
+        if (flags == -1 || fcntl(socketFd, F_SETFL, flags | O_NONBLOCK) == -1)
+        {
+            error = errno;
+            return nullptr;
+        }
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        std::string serverChallenge, clientChallenge, message;
+        bool ok;
+
+        if (server)
+        {
+            // -> hello, server challenge  <- client challenge, client proof  -> server proof
+            ok = randomChallenge(serverChallenge) &&
+                 handshake::sendAll(socketFd, HELLO + serverChallenge, deadline, error) &&
+                 handshake::receiveExactly(socketFd, CHALLENGE_SIZE + PROOF_SIZE, message, deadline, error);
+            const std::string *matched = nullptr;
+            if (ok)
+            {
+                clientChallenge = message.substr(0, CHALLENGE_SIZE);
+                std::string answer = message.substr(CHALLENGE_SIZE);
+                // Every secret is tried, so the time taken does not tell which one matched.
+                for (const auto &secret : settings_.secrets)
+                    if (sameProof(answer, proof(secret, CLIENT_LABEL, serverChallenge, clientChallenge)) && !matched)
+                        matched = &secret;
+                if (!matched)
+                {
+                    error = EACCES;
+                    ok = false;
+                }
+            }
+            ok = ok && handshake::sendAll(socketFd, proof(*matched, SERVER_LABEL, serverChallenge, clientChallenge), deadline, error);
+        }
+        else
+        {
+            const std::string &secret = settings_.secrets[0];
+            ok = handshake::receiveExactly(socketFd, HELLO.size() + CHALLENGE_SIZE, message, deadline, error) &&
+                 message.compare(0, HELLO.size(), HELLO) == 0 && randomChallenge(clientChallenge);
+            if (ok)
+            {
+                serverChallenge = message.substr(HELLO.size());
+                ok = handshake::sendAll(socketFd, clientChallenge + proof(secret, CLIENT_LABEL, serverChallenge, clientChallenge), deadline, error) &&
+                     handshake::receiveExactly(socketFd, PROOF_SIZE, message, deadline, error);
+                if (ok && !sameProof(message, proof(secret, SERVER_LABEL, serverChallenge, clientChallenge)))
+                {
+                    error = EACCES;
+                    ok = false;
+                }
+            }
+        }
+        fcntl(socketFd, F_SETFL, flags);
+
+        if (!ok)
+        {
+            if (error == EACCES)
+                Logger::getInstance().log(LogLevel::ERROR, server ? "Shared secret handshake failed: client proved no known secret"
+                                                                  : "Shared secret handshake failed: server proved no knowledge of the secret");
+            else if (error == ETIMEDOUT)
+                Logger::getInstance().log(LogLevel::ERROR, "Shared secret handshake timed out");
+            else
+                Logger::getInstance().log(LogLevel::ERROR, "Shared secret handshake failed");
+            return nullptr;
+        }
+        error = 0;
+        return plainChannel(socketFd);
+    }
+
+} // namespace relay
@@ -1,16 +1,42 @@
 #include "../include/relay/socket_wrapper.h"
 #include "../include/relay/logger.h"
+#include "../include/relay/inet_address.h"
 #include <stdexcept>
 #include <cstring>
 #include <unistd.h>
 #include <arpa/inet.h>
 #include <sys/socket.h>
 #include <netinet/in.h>
+#include <netinet/tcp.h>
 #include <fcntl.h>
+#include <poll.h>
+#include <limits>
+#include <algorithm>
+#include <net/if.h>
+#include <sys/stat.h>
+#include <sys/un.h>
+#include <cstddef>
 
 namespace relay
 {
 
+    namespace
+    {
+        /// Formats an IP or Unix domain socket address; empty for an unnamed Unix domain socket.
+        std::string formatSocketAddress(const sockaddr_storage &storage, socklen_t len)
+        {
+            if (storage.ss_family != AF_UNIX)
+                return formatInetAddress(reinterpret_cast<const sockaddr *>(&storage));
+            // Clients of a Unix domain server are unnamed.
+            auto &address = reinterpret_cast<const sockaddr_un &>(storage);
+            size_t pathLen = len > offsetof(sockaddr_un, sun_path) ? len - offsetof(sockaddr_un, sun_path) : 0;
+            std::string path(address.sun_path, strnlen(address.sun_path, pathLen));
+            if (pathLen > 0 && address.sun_path[0] == '\0')
+                path = "@" + std::string(address.sun_path + 1, pathLen - 1);
+            return path.empty() ? "" : UNIX_SOCKET_PREFIX + path;
+        }
+    } // namespace
+
     SocketWrapper::SocketWrapper(SocketMode mode) : socketFd_(-1), mode_(mode), isSocketOpen_(false), useIPv6_(false)
     {
         std::lock_guard<std::mutex> lock(mutex_);
@@ -44,40 +70,577 @@ namespace relay
             Logger::getInstance().log(LogLevel::ERROR, "Socket is not open.");
             return false;
         }
-        useIPv6_ = useIPv6;
+        if (ip.compare(0, sizeof(UNIX_SOCKET_PREFIX) - 1, UNIX_SOCKET_PREFIX) == 0)
+            return initializeUnixLocked(ip.substr(sizeof(UNIX_SOCKET_PREFIX) - 1));
+        if (isMemoryAddress(ip))
+            return initializeMemoryLocked(ip.substr(sizeof(MEMORY_SOCKET_PREFIX) - 1));
 
-        struct ::sockaddr_in address{};
-        address.sin_family = AF_INET;
-        address.sin_port = htons(port);
-        if (inet_pton(AF_INET, ip.c_str(), &address.sin_addr) <= 0)
+        // A proxy resolves a host name itself.
+        bool proxied = proxy_ && mode_ == SocketMode::TCP_CLIENT && !udpSettings_;
+        InetAddress address;
+        bool parsed = parseInetAddress(ip, port, address);
+        if (!parsed && (!proxied || ip.empty()))
         {
+            setupError_ = EINVAL;
             const std::string errorMsg = "Invalid IP address: " + ip;
             Logger::getInstance().log(LogLevel::ERROR, errorMsg);
             return false;
         }
+        if (parsed && useIPv6 && address.family() == AF_INET)
+        {
+            // An IPv4-mapped address, ::ffff:a.b.c.d.
+            auto in4 = reinterpret_cast<const sockaddr_in &>(address.storage);
+            InetAddress mapped;
+            auto &in6 = reinterpret_cast<sockaddr_in6 &>(mapped.storage);
+            in6.sin6_family = AF_INET6;
+            in6.sin6_port = in4.sin_port;
+            in6.sin6_addr.s6_addr[10] = 0xff;
+            in6.sin6_addr.s6_addr[11] = 0xff;
+            memcpy(&in6.sin6_addr.s6_addr[12], &in4.sin_addr, sizeof(in4.sin_addr));
+            mapped.length = sizeof(in6);
+            address = mapped;
+        }
+        int family = proxied ? proxy_->address.family() : address.family();
+        InetAddress local;
+        bool bindsLocal = localAddressLocked(family, local);
+        if (!udpSettings_ && !useFamilyLocked(family))
+            return false;
 
-        if (mode_ == SocketMode::TCP_SERVER || mode_ == SocketMode::UDP)
+        if (udpSettings_)
         {
-            if (bind(socketFd_, reinterpret_cast<sockaddr *>(&address), sizeof(address)) == -1)
+            // The TCP socket is replaced by a UDP listener's ready pipe or a UDP connection's stream socket.
+            int error = 0;
+            int fd = -1;
+            if (mode_ == SocketMode::TCP_SERVER)
             {
-                const std::string errorMsg = "Failed to bind socket: " + std::string(strerror(errno));
+                udpListener_ = UdpListener::open(address, *udpSettings_, bindOptions_, error);
+                if (udpListener_)
+                    fd = dup(udpListener_->readyFd());
+            }
+            else if ((udpStream_ = connectUdp(bindsLocal ? &local : nullptr, address, *udpSettings_, connectTimeout_, error)))
+            {
+                fd = udpStream_->fd();
+            }
+            if (fd == -1)
+            {
+                setupError_ = error ? error : errno;
+                udpListener_.reset();
+                const std::string errorMsg = std::string(mode_ == SocketMode::TCP_SERVER ? "Failed to bind UDP socket: " : "Failed to connect to UDP server: ") + strerror(setupError_);
                 Logger::getInstance().log(LogLevel::ERROR, errorMsg);
                 return false;
             }
+            ::close(socketFd_);
+            socketFd_ = fd;
         }
-        else if (mode_ == SocketMode::TCP_CLIENT)
+        else if (mode_ == SocketMode::TCP_SERVER || mode_ == SocketMode::UDP)
         {
-            if (connect(socketFd_, reinterpret_cast<sockaddr *>(&address), sizeof(address)) == -1)
+            if ((mode_ == SocketMode::TCP_SERVER && !applyBindOptions(socketFd_, family, bindOptions_)) ||
+                bind(socketFd_, address.get(), address.length) == -1)
             {
-                const std::string errorMsg = "Failed to connect to server: " + std::string(strerror(errno));
+                setupError_ = errno;
+                const std::string errorMsg = "Failed to bind socket: " + std::string(strerror(errno));
                 Logger::getInstance().log(LogLevel::ERROR, errorMsg);
                 return false;
             }
         }
+        else
+        {
+            if (bindsLocal)
+            {
+                // A fixed source port would otherwise stay unusable while the previous connection is in TIME_WAIT.
+                int reuse = 1;
+                if (local_->second != 0)
+                    setsockopt(socketFd_, SOL_SOCKET, SO_REUSEADDR, &reuse, sizeof(reuse));
+                if (bind(socketFd_, local.get(), local.length) == -1)
+                {
+                    setupError_ = errno;
+                    Logger::getInstance().log(LogLevel::ERROR, "Failed to bind local address: " + std::string(strerror(errno)));
+                    return false;
+                }
+                Logger::getInstance().log(LogLevel::INFO, "Socket bound to local address " + formatInetAddress(local.get()));
+            }
+            if (proxied)
+            {
+                auto deadline = std::chrono::steady_clock::now() + (connectTimeout_.count() > 0 ? connectTimeout_ : DEFAULT_HANDSHAKE_TIMEOUT);
+                int error = connectWithin(proxy_->address.get(), proxy_->address.length);
+                if (error != 0)
+                {
+                    setupError_ = error;
+                    Logger::getInstance().log(LogLevel::ERROR, "Failed to connect to proxy: " + std::string(strerror(error)));
+                    return false;
+                }
+                error = openProxyTunnel(socketFd_, *proxy_, ip, port, deadline);
+                if (error != 0)
+                {
+                    setupError_ = error;
+                    Logger::getInstance().log(LogLevel::ERROR, "Proxy could not connect to " + ip + ":" + std::to_string(port) + ": " + strerror(error));
+                    return false;
+                }
+            }
+            else
+            {
+                int error = connectWithin(address.get(), address.length);
+                if (error != 0)
+                {
+                    setupError_ = error;
+                    const std::string errorMsg = "Failed to connect to server: " + std::string(strerror(error));
+                    Logger::getInstance().log(LogLevel::ERROR, errorMsg);
+                    return false;
+                }
+            }
+        }
         Logger::getInstance().log(LogLevel::INFO, "Socket initialized at " + ip + ":" + std::to_string(port));
         return true;
     }
 
+    bool SocketWrapper::initializeUnixLocked(const std::string &path)
+    {
+        struct ::sockaddr_un address{};
+        address.sun_family = AF_UNIX;
+        if (mode_ == SocketMode::UDP || udpSettings_ || path.empty() || path.size() >= sizeof(address.sun_path))
+        {
+            setupError_ = EINVAL;
+            Logger::getInstance().log(LogLevel::ERROR, "Invalid Unix socket address: " + path);
+            return false;
+        }
+        bool abstract = path[0] == '@';
+        memcpy(address.sun_path, path.data(), path.size());
+        if (abstract)
+            address.sun_path[0] = '\0';
+        auto len = static_cast<socklen_t>(abstract ? offsetof(sockaddr_un, sun_path) + path.size() : sizeof(address));
+        auto addr = reinterpret_cast<sockaddr *>(&address);
+
+        int fd = ::socket(AF_UNIX, SOCK_STREAM, 0);
+        if (fd == -1)
+        {
+            setupError_ = errno;
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to create Unix socket: " + std::string(strerror(errno)));
+            return false;
+        }
+        ::close(socketFd_);
+        socketFd_ = fd;
+
+        if (mode_ == SocketMode::TCP_CLIENT)
+        {
+            int error = connectWithin(addr, len);
+            // A missing file means nothing listens there. EACCES would read as a failed handshake.
+            if (error == ENOENT)
+                error = ECONNREFUSED;
+            else if (error == EACCES)
+                error = EPERM;
+            if (error != 0)
+            {
+                setupError_ = error;
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to connect to Unix socket " + path + ": " + strerror(error));
+                return false;
+            }
+            Logger::getInstance().log(LogLevel::INFO, "Socket connected to unix://" + path);
+            return true;
+        }
+
+        int result = ::bind(fd, addr, len);
+        if (result == -1 && errno == EADDRINUSE && !abstract)
+        {
+            // Replace the file of a server that went away without removing it.
+            int probe = ::socket(AF_UNIX, SOCK_STREAM, 0);
+            bool stale = probe != -1 && ::connect(probe, addr, len) == -1 && errno == ECONNREFUSED;
+            if (probe != -1)
+                ::close(probe);
+            struct stat info{};
+            if (stale && ::lstat(path.c_str(), &info) == 0 && S_ISSOCK(info.st_mode) && ::unlink(path.c_str()) == 0)
+            {
+                Logger::getInstance().log(LogLevel::INFO, "Removed stale Unix socket " + path);
+                result = ::bind(fd, addr, len);
+            }
+            else
+            {
+                errno = EADDRINUSE;
+            }
+        }
+        if (result == -1)
+        {
+            setupError_ = errno;
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to bind Unix socket " + path + ": " + strerror(errno));
+            return false;
+        }
+        if (!abstract)
+        {
+            struct stat info{};
+            if ((unixMode_ != 0 && ::chmod(path.c_str(), static_cast<mode_t>(unixMode_)) == -1) || ::stat(path.c_str(), &info) == -1)
+            {
+                setupError_ = errno;
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to set permissions of Unix socket " + path + ": " + strerror(errno));
+                ::unlink(path.c_str());
+                return false;
+            }
+            unixPath_ = path;
+            unixDevice_ = info.st_dev;
+            unixInode_ = info.st_ino;
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Socket bound to unix://" + path);
+        return true;
+    }
+
+    bool SocketWrapper::initializeMemoryLocked(const std::string &name)
+    {
+        int error = EINVAL;
+        int fd = -1;
+        if (mode_ != SocketMode::UDP && !udpSettings_)
+        {
+            if (mode_ == SocketMode::TCP_SERVER)
+            {
+                memoryListener_ = MemoryListener::open(name, error);
+                if (memoryListener_)
+                    fd = dup(memoryListener_->readyFd());
+            }
+            else
+            {
+                fd = connectMemory(name, error);
+            }
+        }
+        if (fd == -1)
+        {
+            setupError_ = error;
+            memoryListener_.reset();
+            Logger::getInstance().log(LogLevel::ERROR, std::string(mode_ == SocketMode::TCP_SERVER ? "Failed to listen on " : "Failed to connect to ") +
+                                                           MEMORY_SOCKET_PREFIX + name + ": " + strerror(error));
+            return false;
+        }
+        ::close(socketFd_);
+        socketFd_ = fd;
+        memoryAddress_ = MEMORY_SOCKET_PREFIX + name;
+        Logger::getInstance().log(LogLevel::INFO, "Socket initialized at " + std::string(MEMORY_SOCKET_PREFIX) + name);
+        return true;
+    }
+
+    void SocketWrapper::useProxy(const ProxySettings &proxy)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        proxy_ = proxy;
+    }
+
+    std::optional<ProxySettings> SocketWrapper::getProxy() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return proxy_;
+    }
+
+    void SocketWrapper::setUnixSocketMode(int mode)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        unixMode_ = mode;
+    }
+
+    int SocketWrapper::getUnixSocketMode() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return unixMode_;
+    }
+
+    bool SocketWrapper::isInetLocked() const
+    {
+        sockaddr_storage address{};
+        socklen_t len = sizeof(address);
+        return getsockname(socketFd_, reinterpret_cast<sockaddr *>(&address), &len) == 0 &&
+               (address.ss_family == AF_INET || address.ss_family == AF_INET6);
+    }
+
+    void SocketWrapper::setConnectTimeout(std::chrono::milliseconds timeout)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        connectTimeout_ = timeout;
+    }
+
+    void SocketWrapper::useUdpTransport(const UdpSettings &settings)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (mode_ == SocketMode::UDP)
+            throw std::logic_error("useUdpTransport() is only for TCP_SERVER and TCP_CLIENT modes.");
+        udpSettings_ = settings;
+    }
+
+    std::optional<UdpSettings> SocketWrapper::getUdpTransport() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return udpSettings_;
+    }
+
+    int SocketWrapper::connectWithin(const sockaddr *address, socklen_t len)
+    {
+        if (connectTimeout_.count() <= 0)
+            return connect(socketFd_, address, len) == -1 ? errno : 0;
+
+        // Connect without blocking, then wait for the handshake to finish in time.
+        int flags = fcntl(socketFd_, F_GETFL, 0);
+        if (flags == -1 || fcntl(socketFd_, F_SETFL, flags | O_NONBLOCK) == -1)
+            return errno;
+        int error = 0;
+        if (connect(socketFd_, address, len) == -1)
+        {
+            error = errno;
+            if (error == EINPROGRESS)
+            {
+                pollfd pfd{socketFd_, POLLOUT, 0};
+                int ready;
+                do
+                    ready = poll(&pfd, 1, static_cast<int>(std::min<int64_t>(connectTimeout_.count(), std::numeric_limits<int>::max())));
+                while (ready == -1 && errno == EINTR);
+                socklen_t errorLen = sizeof(error);
+                if (ready == 0)
+                    error = ETIMEDOUT;
+                else if (ready == -1)
+                    error = errno;
+                else if (getsockopt(socketFd_, SOL_SOCKET, SO_ERROR, &error, &errorLen) == -1)
+                    error = errno;
+            }
+        }
+        fcntl(socketFd_, F_SETFL, flags);
+        return error;
+    }
+
+    bool SocketWrapper::secure(const ChannelSecurity &security, bool server, std::chrono::milliseconds timeout, const ConnectionHello &hello)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return false;
+        // A channel's bytes are not relay frames, so none can be sent unreliably.
+        if (udpStream_)
+            udpStream_->disableFraming();
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        int error = 0;
+        channel_ = security.handshake(socketFd_, server, timeout, error);
+        if (channel_ && !exchangeHelloLocked(hello, deadline, error))
+            channel_.reset();
+        if (!channel_)
+        {
+            setupError_ = error;
+            return false;
+        }
+        if (!server && (remoteHello_.flags & HELLO_DRAINING))
+        {
+            Logger::getInstance().log(LogLevel::WARNING, "Server is draining and refused the connection");
+            channel_.reset();
+            setupError_ = ESHUTDOWN;
+            return false;
+        }
+        return true;
+    }
+
+    bool SocketWrapper::exchangeHelloLocked(const ConnectionHello &hello, std::chrono::steady_clock::time_point deadline, int &error)
+    {
+        // A version byte leaves room to announce more later.
+        constexpr char HELLO_VERSION = 1;
+        const char local[] = {HELLO_VERSION, static_cast<char>(hello.flags | HELLO_ZLIB)};
+        char remote[sizeof(local)];
+        if (channel_->write(local, sizeof(local)) != static_cast<ssize_t>(sizeof(local)))
+        {
+            error = errno ? errno : EPROTO;
+            return false;
+        }
+        size_t received = 0;
+        while (received < sizeof(remote))
+        {
+            auto left = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            if (!channel_->hasPending())
+            {
+                pollfd pfd{socketFd_, POLLIN, 0};
+                int ready = ::poll(&pfd, 1, static_cast<int>(std::max<int64_t>(left.count(), 0)));
+                if (ready == -1 && errno == EINTR)
+                    continue;
+                if (ready <= 0)
+                {
+                    error = ready == 0 ? ETIMEDOUT : errno;
+                    return false;
+                }
+            }
+            ssize_t n = channel_->read(remote + received, sizeof(remote) - received);
+            if (n > 0)
+                received += static_cast<size_t>(n);
+            else if (n == 0 || (errno != EINTR && errno != EAGAIN && errno != EWOULDBLOCK))
+            {
+                error = n == 0 ? ECONNRESET : errno;
+                return false;
+            }
+        }
+        if (remote[0] != HELLO_VERSION)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Connection hello has unknown version " + std::to_string(static_cast<unsigned char>(remote[0])));
+            error = EPROTO;
+            return false;
+        }
+        remoteHello_.flags = static_cast<uint8_t>(remote[1]);
+        return true;
+    }
+
+    ConnectionHello SocketWrapper::getRemoteHello() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return remoteHello_;
+    }
+
+    bool SocketWrapper::isSecured() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return channel_ != nullptr;
+    }
+
+    bool SocketWrapper::rekey()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_ || !channel_)
+        {
+            errno = isSocketOpen_ ? ENOTSUP : ENOTCONN;
+            return false;
+        }
+        if (!channel_->rekey())
+        {
+            if (errno != ENOTSUP)
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to rotate session keys: " + std::string(strerror(errno)));
+            return false;
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Rotated session keys.");
+        return true;
+    }
+
+    std::string SocketWrapper::getRemoteIdentity() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return channel_ ? channel_->remoteIdentity() : "";
+    }
+
+    ssize_t SocketWrapper::sendLocked(const char *data, size_t len, int flags)
+    {
+        return channel_ ? channel_->write(data, len) : ::send(socketFd_, data, len, flags);
+    }
+
+    ssize_t SocketWrapper::receiveLocked(char *buffer, size_t len)
+    {
+        return channel_ ? channel_->read(buffer, len) : ::recv(socketFd_, buffer, len, 0);
+    }
+
+    ssize_t SocketWrapper::receiveAvailableLocked(char *buffer, size_t len)
+    {
+        if (!channel_)
+            return ::recv(socketFd_, buffer, len, MSG_DONTWAIT);
+        // The channel reads the socket itself, so the socket is made non-blocking around the read.
+        int flags = fcntl(socketFd_, F_GETFL, 0);
+        if (flags == -1 || (flags & O_NONBLOCK))
+            return channel_->read(buffer, len);
+        if (fcntl(socketFd_, F_SETFL, flags | O_NONBLOCK) == -1)
+            return -1;
+        ssize_t bytesRead = channel_->read(buffer, len);
+        int readErrno = errno;
+        fcntl(socketFd_, F_SETFL, flags);
+        errno = readErrno;
+        return bytesRead;
+    }
+
+    int SocketWrapper::getSetupError() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return setupError_;
+    }
+
+    std::string SocketWrapper::getRemoteAddress() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return "";
+        if (udpStream_)
+            return udpStream_->remoteAddress();
+        if (!memoryAddress_.empty())
+            return mode_ == SocketMode::TCP_SERVER ? "" : memoryAddress_;
+        sockaddr_storage storage{};
+        socklen_t len = sizeof(storage);
+        if (getpeername(socketFd_, reinterpret_cast<sockaddr *>(&storage), &len) == -1)
+            return "";
+        return formatSocketAddress(storage, len);
+    }
+
+    std::string SocketWrapper::getLocalAddress() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return "";
+        if (udpListener_)
+            return udpListener_->localAddress();
+        if (udpStream_)
+            return udpStream_->localAddress();
+        if (memoryListener_)
+            return memoryAddress_;
+        sockaddr_storage storage{};
+        socklen_t len = sizeof(storage);
+        if (getsockname(socketFd_, reinterpret_cast<sockaddr *>(&storage), &len) == -1)
+            return "";
+        return formatSocketAddress(storage, len);
+    }
+
+    bool SocketWrapper::bindLocal(const std::string &ip, int port)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_ || mode_ != SocketMode::TCP_CLIENT)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Only an open TCP client socket can bind a local address.");
+            return false;
+        }
+
+        InetAddress address;
+        if ((!ip.empty() && !parseInetAddress(ip, port, address)) || port < 0 || port > 65535)
+        {
+            setupError_ = EINVAL;
+            Logger::getInstance().log(LogLevel::ERROR, "Invalid local IP address: " + ip);
+            return false;
+        }
+        local_ = std::make_pair(ip, port);
+        return true;
+    }
+
+    bool SocketWrapper::localAddressLocked(int family, InetAddress &address) const
+    {
+        if (!local_)
+            return false;
+        // An empty IP is the wildcard address of whichever family the connection turns out to use.
+        const std::string &ip = local_->first;
+        parseInetAddress(ip.empty() ? (family == AF_INET6 ? "::" : "0.0.0.0") : ip, local_->second, address);
+        return true;
+    }
+
+    bool SocketWrapper::useFamilyLocked(int family)
+    {
+        InetAddress local;
+        if (localAddressLocked(family, local) && local.family() != family)
+        {
+            setupError_ = EINVAL;
+            Logger::getInstance().log(LogLevel::ERROR, "Local and remote addresses are of different families.");
+            return false;
+        }
+        if (useIPv6_ == (family == AF_INET6))
+            return true;
+        int fd = ::socket(family, mode_ == SocketMode::UDP ? SOCK_DGRAM : SOCK_STREAM, 0);
+        if (fd == -1)
+        {
+            setupError_ = errno;
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to create socket: " + std::string(strerror(errno)));
+            return false;
+        }
+        ::close(socketFd_);
+        socketFd_ = fd;
+        useIPv6_ = family == AF_INET6;
+        return true;
+    }
+
+    void SocketWrapper::setBindOptions(const BindOptions &options)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        bindOptions_ = options;
+    }
+
+    BindOptions SocketWrapper::getBindOptions() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return bindOptions_;
+    }
+
     void SocketWrapper::enableMulticast(const std::string &multicastIp, int multicastPort)
     {
         std::lock_guard<std::mutex> lock(mutex_);
@@ -93,6 +656,9 @@ namespace relay
             Logger::getInstance().log(LogLevel::ERROR, errorMsg);
             throw std::runtime_error(errorMsg);
         }
+        int pktinfo = 1;
+        if (setsockopt(socketFd_, IPPROTO_IP, IP_PKTINFO, &pktinfo, sizeof(pktinfo)) == -1)
+            Logger::getInstance().log(LogLevel::WARNING, "Failed to enable IP_PKTINFO, receiving interfaces will be unknown: " + std::string(strerror(errno)));
         Logger::getInstance().log(LogLevel::INFO, "Joined multicast group " + multicastIp + ":" + std::to_string(multicastPort));
     }
 
@@ -101,6 +667,18 @@ namespace relay
         std::lock_guard<std::mutex> lock(mutex_);
         if (mode_ != SocketMode::TCP_SERVER)
             throw std::logic_error("listen() is only for TCP_SERVER mode.");
+        if (udpListener_)
+        {
+            udpListener_->setBacklog(maxConnections);
+            Logger::getInstance().log(LogLevel::INFO, "UDP socket listening for connections.");
+            return;
+        }
+        if (memoryListener_)
+        {
+            memoryListener_->setBacklog(maxConnections);
+            Logger::getInstance().log(LogLevel::INFO, "Memory socket listening for connections.");
+            return;
+        }
         if (::listen(socketFd_, maxConnections) == -1)
         {
             const std::string errorMsg = "Failed to listen on socket: " + std::string(strerror(errno));
@@ -112,16 +690,65 @@ namespace relay
 
     std::shared_ptr<SocketWrapper> SocketWrapper::accept()
     {
-        std::lock_guard<std::mutex> lock(mutex_);
-        if (mode_ != SocketMode::TCP_SERVER)
-            throw std::logic_error("accept() is only for TCP_SERVER mode.");
+        int listenFd;
+        std::shared_ptr<UdpListener> udpListener;
+        std::shared_ptr<MemoryListener> memoryListener;
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            if (mode_ != SocketMode::TCP_SERVER)
+                throw std::logic_error("accept() is only for TCP_SERVER mode.");
+            if (!isSocketOpen_ || listenerStopped_)
+                throw ListenerClosedError("Listening socket is closed.");
+            udpListener = udpListener_;
+            memoryListener = memoryListener_;
+            listenFd = socketFd_;
+            if (!udpListener && !memoryListener)
+                acceptsInFlight_++;
+        }
+
+        if (udpListener)
+        {
+            auto stream = udpListener->accept();
+            if (!stream)
+                throw ListenerClosedError("Listening socket is closed.");
+            auto client = std::make_shared<SocketWrapper>(stream->fd());
+            client->udpStream_ = std::move(stream);
+            return client;
+        }
+        if (memoryListener)
+        {
+            int fd = memoryListener->accept();
+            if (fd == -1)
+                throw ListenerClosedError("Listening socket is closed.");
+            Logger::getInstance().log(LogLevel::INFO, "Accepted new in-process connection.");
+            return std::make_shared<SocketWrapper>(fd);
+        }
 
-        struct ::sockaddr_in clientAddr{};
+        sockaddr_storage clientAddr{};
         socklen_t addrLen = sizeof(clientAddr);
-        int clientFd = ::accept(socketFd_, reinterpret_cast<sockaddr *>(&clientAddr), &addrLen);
+        int clientFd;
+        do
+        {
+            clientFd = ::accept(listenFd, reinterpret_cast<sockaddr *>(&clientAddr), &addrLen);
+        } while (clientFd == -1 && errno == EINTR && isSocketOpen_);
+        int acceptErrno = errno;
+
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (--acceptsInFlight_ == 0 && deferredCloseFd_ != -1)
+        {
+            ::close(deferredCloseFd_);
+            deferredCloseFd_ = -1;
+        }
+        if (!isSocketOpen_ || listenerStopped_)
+        {
+            if (clientFd != -1)
+                ::close(clientFd);
+            Logger::getInstance().log(LogLevel::INFO, "Accept interrupted, listening socket closed.");
+            throw ListenerClosedError("Listening socket is closed.");
+        }
         if (clientFd == -1)
         {
-            const std::string errorMsg = "Failed to accept connection: " + std::string(strerror(errno));
+            const std::string errorMsg = "Failed to accept connection: " + std::string(strerror(acceptErrno));
             Logger::getInstance().log(LogLevel::ERROR, errorMsg);
             throw std::runtime_error(errorMsg);
         }
@@ -135,7 +762,7 @@ namespace relay
         if (!isSocketOpen_)
             return 0;
 
-        ssize_t bytesSent = ::send(socketFd_, data.c_str(), data.size(), 0);
+        ssize_t bytesSent = sendLocked(data.c_str(), data.size(), 0);
         if (bytesSent == -1)
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to send data: " + std::string(strerror(errno)));
@@ -145,6 +772,34 @@ namespace relay
         return static_cast<size_t>(bytesSent);
     }
 
+    size_t SocketWrapper::sendFrame(const Frame &frame)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return 0;
+
+        const std::string data = encodeFrame(frame);
+        size_t total = 0;
+        sendRetryable_ = false;
+        while (total < data.size())
+        {
+            ssize_t bytesSent = sendLocked(data.data() + total, data.size() - total, MSG_NOSIGNAL);
+            if (bytesSent == -1)
+            {
+                if (errno == EINTR)
+                    continue;
+                // Once part of the frame is out, resending it would corrupt the stream.
+                sendRetryable_ = total == 0 && (errno == EAGAIN || errno == EWOULDBLOCK || errno == ENOBUFS ||
+                                                errno == ENETUNREACH || errno == EHOSTUNREACH || errno == ENETDOWN);
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to send frame: " + std::string(strerror(errno)));
+                return 0;
+            }
+            total += static_cast<size_t>(bytesSent);
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Sent frame of " + std::to_string(total) + " bytes.");
+        return total;
+    }
+
     size_t SocketWrapper::sendTo(const std::string &data, struct ::sockaddr_in &destAddr)
     {
         std::lock_guard<std::mutex> lock(mutex_);
@@ -168,7 +823,7 @@ namespace relay
             return "";
 
         std::vector<char> buffer(bufferSize);
-        ssize_t bytesRead = ::recv(socketFd_, buffer.data(), bufferSize, 0);
+        ssize_t bytesRead = receiveLocked(buffer.data(), bufferSize);
         if (bytesRead == -1)
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to receive data: " + std::string(strerror(errno)));
@@ -177,27 +832,123 @@ namespace relay
         else if (bytesRead == 0)
         {
             Logger::getInstance().log(LogLevel::WARNING, "Connection closed by peer.");
-            close();
+            cleanup();
             return "";
         }
         Logger::getInstance().log(LogLevel::INFO, "Received " + std::to_string(bytesRead) + " bytes.");
         return std::string(buffer.data(), bytesRead);
     }
 
+    std::optional<Frame> SocketWrapper::receiveFrame(bool &incomplete)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        incomplete = false;
+        std::vector<char> buffer(readChunkSize_);
+        while (true)
+        {
+            bool corrupt = false;
+            if (auto frame = decodeFrame(readBuffer_, corrupt))
+            {
+                resyncing_ = false;
+                readStalled_ = false;
+                return frame;
+            }
+            if (corrupt)
+            {
+                if (!resyncing_)
+                    frameDesyncs_++;
+                if (frameResync_)
+                {
+                    if (!resyncing_)
+                        Logger::getInstance().log(LogLevel::WARNING, "Received invalid frame, resyncing to the next frame marker.");
+                    resyncing_ = true;
+                    if (resyncFrame(readBuffer_))
+                        continue;
+                }
+                else
+                {
+                    Logger::getInstance().log(LogLevel::ERROR, "Received invalid frame, closing connection.");
+                    readBuffer_.clear();
+                    desynced_ = true;
+                    cleanup();
+                    return std::nullopt;
+                }
+            }
+            if (!isSocketOpen_)
+                return std::nullopt;
+
+            ssize_t bytesRead = receiveAvailableLocked(buffer.data(), buffer.size());
+            if (bytesRead == -1)
+            {
+                if (errno == EINTR)
+                    continue;
+                if (errno == EAGAIN || errno == EWOULDBLOCK)
+                {
+                    // The rest of the frame has not arrived; the caller waits for it without the lock.
+                    readStalled_ = true;
+                    incomplete = true;
+                    return std::nullopt;
+                }
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to receive data: " + std::string(strerror(errno)));
+                if (channel_ && errno == EPROTO)
+                {
+                    // The channel cannot recover from a protocol error, so the connection is over.
+                    readBuffer_.clear();
+                    cleanup();
+                }
+                return std::nullopt;
+            }
+            else if (bytesRead == 0)
+            {
+                Logger::getInstance().log(LogLevel::WARNING, "Connection closed by peer.");
+                readBuffer_.clear();
+                cleanup();
+                return std::nullopt;
+            }
+            readBuffer_.append(buffer.data(), static_cast<size_t>(bytesRead));
+            readStalled_ = false;
+        }
+    }
+
     std::string SocketWrapper::receiveFrom(size_t bufferSize, struct ::sockaddr_in &senderAddr)
+    {
+        std::string interfaceName;
+        return receiveFrom(bufferSize, senderAddr, interfaceName);
+    }
+
+    std::string SocketWrapper::receiveFrom(size_t bufferSize, struct ::sockaddr_in &senderAddr, std::string &interfaceName)
     {
         std::lock_guard<std::mutex> lock(mutex_);
+        interfaceName.clear();
         if (!isSocketOpen_ || mode_ != SocketMode::UDP)
             return "";
 
         std::vector<char> buffer(bufferSize);
-        socklen_t addrLen = sizeof(senderAddr);
-        ssize_t bytesRead = ::recvfrom(socketFd_, buffer.data(), bufferSize, 0, reinterpret_cast<sockaddr *>(&senderAddr), &addrLen);
+        char control[CMSG_SPACE(sizeof(struct in_pktinfo))];
+        struct iovec iov{buffer.data(), bufferSize};
+        struct msghdr msg{};
+        msg.msg_name = &senderAddr;
+        msg.msg_namelen = sizeof(senderAddr);
+        msg.msg_iov = &iov;
+        msg.msg_iovlen = 1;
+        msg.msg_control = control;
+        msg.msg_controllen = sizeof(control);
+        ssize_t bytesRead = ::recvmsg(socketFd_, &msg, 0);
         if (bytesRead == -1)
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to receiveFrom data: " + std::string(strerror(errno)));
             return "";
         }
+        for (struct cmsghdr *cmsg = CMSG_FIRSTHDR(&msg); cmsg; cmsg = CMSG_NXTHDR(&msg, cmsg))
+        {
+            if (cmsg->cmsg_level != IPPROTO_IP || cmsg->cmsg_type != IP_PKTINFO)
+                continue;
+            struct in_pktinfo info;
+            std::memcpy(&info, CMSG_DATA(cmsg), sizeof(info));
+            char name[IF_NAMESIZE];
+            if (if_indextoname(info.ipi_ifindex, name))
+                interfaceName = name;
+        }
         Logger::getInstance().log(LogLevel::INFO, "Received " + std::to_string(bytesRead) + " bytes from " + inet_ntoa(senderAddr.sin_addr));
         return std::string(buffer.data(), bytesRead);
     }
@@ -205,9 +956,98 @@ namespace relay
     void SocketWrapper::close()
     {
         std::lock_guard<std::mutex> lock(mutex_);
+        cleanup();
+    }
+
+    void SocketWrapper::stopListening()
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_ || mode_ != SocketMode::TCP_SERVER || listenerStopped_)
+            return;
+        if (udpListener_ || memoryListener_)
+        {
+            if (udpListener_)
+                udpListener_->stop();
+            if (memoryListener_)
+                memoryListener_->stop();
+            listenerStopped_ = true;
+            Logger::getInstance().log(LogLevel::INFO, "Stopped listening for connections.");
+            return;
+        }
+        // Shutting down a listening socket wakes blocked accept() calls and refuses new
+        // connections, but keeps the FD, so nothing else can reuse its number.
+        ::shutdown(socketFd_, SHUT_RDWR);
+        listenerStopped_ = true;
+        Logger::getInstance().log(LogLevel::INFO, "Stopped listening for connections.");
+    }
+
+    void SocketWrapper::setFrameResync(bool enabled)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        frameResync_ = enabled;
+    }
+
+    uint64_t SocketWrapper::getFrameDesyncs() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return frameDesyncs_;
+    }
+
+    uint64_t SocketWrapper::getFragmentsLost() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return udpStream_ ? udpStream_->fragmentsLost() : 0;
+    }
+
+    bool SocketWrapper::isDesynced() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return desynced_;
+    }
+
+    bool SocketWrapper::isSendRetryable() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return sendRetryable_;
+    }
+
+    bool SocketWrapper::isListening() const
+    {
+        return mode_ == SocketMode::TCP_SERVER && isSocketOpen_ && !listenerStopped_;
+    }
+
+    void SocketWrapper::cleanup()
+    {
+        // Caller must hold mutex_
         if (isSocketOpen_)
         {
-            ::close(socketFd_);
+            if (channel_)
+                channel_->shutdown();
+            if (udpListener_)
+            {
+                udpListener_->stop();
+                udpListener_.reset();
+            }
+            if (memoryListener_)
+            {
+                memoryListener_->stop();
+                memoryListener_.reset();
+            }
+            struct stat info{};
+            if (!unixPath_.empty() && ::stat(unixPath_.c_str(), &info) == 0 && info.st_dev == unixDevice_ && info.st_ino == unixInode_)
+                ::unlink(unixPath_.c_str());
+            unixPath_.clear();
+            if (acceptsInFlight_ > 0)
+            {
+                // Closing the FD does not wake a blocked accept(); shutting it down does. The
+                // last accept to return closes it, so the FD number cannot be reused under it.
+                ::shutdown(socketFd_, SHUT_RDWR);
+                deferredCloseFd_ = socketFd_;
+            }
+            else
+            {
+                ::close(socketFd_);
+            }
             socketFd_ = -1;
             isSocketOpen_ = false;
             Logger::getInstance().log(LogLevel::INFO, "Socket closed.");
@@ -254,12 +1094,125 @@ namespace relay
     {
         std::lock_guard<std::mutex> lock(mutex_);
         int how = (read && write) ? SHUT_RDWR : (read ? SHUT_RD : SHUT_WR);
+        if (write && channel_)
+            channel_->shutdown();
         if (::shutdown(socketFd_, how) == -1)
         {
             Logger::getInstance().log(LogLevel::ERROR, "Failed to shutdown socket: " + std::string(strerror(errno)));
         }
     }
 
+    int SocketWrapper::getPathMtu() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return -1;
+
+        int value = 0;
+        socklen_t len = sizeof(value);
+#if defined(IP_MTU)
+        if (getsockopt(socketFd_, IPPROTO_IP, IP_MTU, &value, &len) == 0 && value > 0)
+            return value;
+        len = sizeof(value);
+#endif
+        if (mode_ != SocketMode::UDP && getsockopt(socketFd_, IPPROTO_TCP, TCP_MAXSEG, &value, &len) == 0 && value > 0)
+            return value + 40; // IPv4 and TCP headers without options
+        Logger::getInstance().log(LogLevel::WARNING, "Failed to read path MTU: " + std::string(strerror(errno)));
+        return -1;
+    }
+
+    bool SocketWrapper::getBufferSizes(int &sendBytes, int &receiveBytes) const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return false;
+
+        socklen_t sendLen = sizeof(sendBytes);
+        socklen_t receiveLen = sizeof(receiveBytes);
+        if (getsockopt(socketFd_, SOL_SOCKET, SO_SNDBUF, &sendBytes, &sendLen) == -1 ||
+            getsockopt(socketFd_, SOL_SOCKET, SO_RCVBUF, &receiveBytes, &receiveLen) == -1)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to read buffer sizes: " + std::string(strerror(errno)));
+            return false;
+        }
+        return true;
+    }
+
+    bool SocketWrapper::hasBufferedData() const
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        return (!readBuffer_.empty() && !readStalled_) || (channel_ && channel_->hasPending());
+    }
+
+    void SocketWrapper::interrupt()
+    {
+        // Deliberately not locking mutex_: the thread to wake may hold it while blocked.
+        if (isSocketOpen_ && mode_ != SocketMode::TCP_SERVER)
+            ::shutdown(socketFd_, SHUT_RDWR);
+    }
+
+    bool SocketWrapper::waitReadable(std::chrono::milliseconds timeout) const
+    {
+        // Deliberately not locking mutex_: a blocking send or receive elsewhere must not stall the wait.
+        if (!isSocketOpen_)
+            return false;
+        pollfd pfd{socketFd_, POLLIN, 0};
+        int ready;
+        do
+        {
+            ready = ::poll(&pfd, 1, static_cast<int>(timeout.count()));
+        } while (ready == -1 && errno == EINTR);
+        return ready > 0;
+    }
+
+    bool SocketWrapper::waitWritable(std::chrono::milliseconds timeout) const
+    {
+        // Deliberately not locking mutex_, for the same reason as waitReadable().
+        if (!isSocketOpen_)
+            return false;
+        pollfd pfd{socketFd_, POLLOUT, 0};
+        int ready;
+        do
+        {
+            ready = ::poll(&pfd, 1, static_cast<int>(timeout.count()));
+        } while (ready == -1 && errno == EINTR);
+        return ready > 0 && !(pfd.revents & (POLLERR | POLLNVAL));
+    }
+
+    bool SocketWrapper::drainUntilClosed(std::chrono::milliseconds timeout)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return true;
+
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        std::vector<char> buffer(4096);
+        while (true)
+        {
+            auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            if (remaining.count() <= 0)
+                return false;
+
+            pollfd pfd{socketFd_, POLLIN, 0};
+            int ready = ::poll(&pfd, 1, static_cast<int>(remaining.count()));
+            if (ready == -1)
+            {
+                if (errno == EINTR)
+                    continue;
+                Logger::getInstance().log(LogLevel::ERROR, "Failed to wait for connection close: " + std::string(strerror(errno)));
+                return false;
+            }
+            if (ready == 0)
+                return false;
+
+            ssize_t bytesRead = receiveLocked(buffer.data(), buffer.size());
+            if (bytesRead == 0)
+                return true;
+            if (bytesRead == -1 && errno != EINTR && errno != EAGAIN && errno != EWOULDBLOCK)
+                return false;
+        }
+    }
+
     void SocketWrapper::setReceiveTimeout(int seconds)
     {
         std::lock_guard<std::mutex> lock(mutex_);
@@ -269,4 +1222,136 @@ namespace relay
             Logger::getInstance().log(LogLevel::ERROR, "Failed to receive timeout: " + std::string(strerror(errno)));
         }
     }
+
+    void SocketOptions::merge(const SocketOptions &other)
+    {
+        if (other.sendBufferSize > 0)
+            sendBufferSize = other.sendBufferSize;
+        if (other.receiveBufferSize > 0)
+            receiveBufferSize = other.receiveBufferSize;
+        if (other.sendTimeout.count() > 0)
+            sendTimeout = other.sendTimeout;
+        if (other.receiveTimeout.count() > 0)
+            receiveTimeout = other.receiveTimeout;
+        if (other.noDelay)
+            noDelay = other.noDelay;
+        if (other.keepAlive.count() != 0)
+            keepAlive = other.keepAlive;
+        if (other.keepAliveInterval.count() > 0)
+            keepAliveInterval = other.keepAliveInterval;
+        if (other.keepAliveCount > 0)
+            keepAliveCount = other.keepAliveCount;
+    }
+
+    bool SocketWrapper::growReceiveBuffer(size_t bytes)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_ || bytes == 0 || bytes > static_cast<size_t>(std::numeric_limits<int>::max()))
+            return false;
+
+        readChunkSize_ = std::max(readChunkSize_, bytes);
+        int current = 0;
+        socklen_t len = sizeof(current);
+        if (getsockopt(socketFd_, SOL_SOCKET, SO_RCVBUF, &current, &len) == -1)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to get receive buffer size: " + std::string(strerror(errno)));
+            return false;
+        }
+        // Linux reports twice the size set, to account for bookkeeping overhead.
+        if (static_cast<size_t>(current) >= bytes)
+            return true;
+        int size = static_cast<int>(bytes);
+        if (setsockopt(socketFd_, SOL_SOCKET, SO_RCVBUF, &size, sizeof(size)) == -1)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to grow receive buffer: " + std::string(strerror(errno)));
+            return false;
+        }
+        Logger::getInstance().log(LogLevel::INFO, "Grew receive buffer to " + std::to_string(bytes) + " bytes.");
+        return true;
+    }
+
+    bool SocketWrapper::applyOptions(const SocketOptions &options)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_)
+            return false;
+
+        bool ok = true;
+        auto setOption = [&](int level, int name, const void *value, socklen_t len, const char *what)
+        {
+            if (setsockopt(socketFd_, level, name, value, len) == -1)
+            {
+                Logger::getInstance().log(LogLevel::ERROR, std::string("Failed to set ") + what + ": " + strerror(errno));
+                ok = false;
+            }
+        };
+        auto toTimeval = [](std::chrono::milliseconds ms)
+        {
+            return timeval{static_cast<time_t>(ms.count() / 1000), static_cast<suseconds_t>((ms.count() % 1000) * 1000)};
+        };
+
+        if (options.sendBufferSize > 0)
+            setOption(SOL_SOCKET, SO_SNDBUF, &options.sendBufferSize, sizeof(int), "send buffer size");
+        if (options.receiveBufferSize > 0)
+            setOption(SOL_SOCKET, SO_RCVBUF, &options.receiveBufferSize, sizeof(int), "receive buffer size");
+        if (options.sendTimeout.count() > 0)
+        {
+            timeval tv = toTimeval(options.sendTimeout);
+            setOption(SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv), "send timeout");
+        }
+        if (options.receiveTimeout.count() > 0)
+        {
+            timeval tv = toTimeval(options.receiveTimeout);
+            setOption(SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv), "receive timeout");
+        }
+        bool tcp = mode_ != SocketMode::UDP && isInetLocked();
+        if (options.noDelay && tcp)
+        {
+            int value = *options.noDelay ? 1 : 0;
+            setOption(IPPROTO_TCP, TCP_NODELAY, &value, sizeof(value), "TCP_NODELAY");
+        }
+        if (options.keepAlive.count() != 0 && tcp)
+        {
+            int enabled = options.keepAlive.count() > 0 ? 1 : 0;
+            setOption(SOL_SOCKET, SO_KEEPALIVE, &enabled, sizeof(enabled), "SO_KEEPALIVE");
+            if (enabled)
+            {
+                // The kernel counts in whole seconds.
+                auto toSeconds = [](std::chrono::milliseconds ms)
+                {
+                    return static_cast<int>(std::max<int64_t>(1, std::min<int64_t>(ms.count() / 1000, std::numeric_limits<int>::max())));
+                };
+                int idle = toSeconds(options.keepAlive);
+                int interval = toSeconds(options.keepAliveInterval.count() > 0 ? options.keepAliveInterval : options.keepAlive);
+                setOption(IPPROTO_TCP, TCP_KEEPIDLE, &idle, sizeof(idle), "TCP_KEEPIDLE");
+                setOption(IPPROTO_TCP, TCP_KEEPINTVL, &interval, sizeof(interval), "TCP_KEEPINTVL");
+                if (options.keepAliveCount > 0)
+                    setOption(IPPROTO_TCP, TCP_KEEPCNT, &options.keepAliveCount, sizeof(int), "TCP_KEEPCNT");
+            }
+        }
+        return ok;
+    }
+
+    bool SocketWrapper::setCork(bool enabled)
+    {
+        std::lock_guard<std::mutex> lock(mutex_);
+        if (!isSocketOpen_ || mode_ == SocketMode::UDP)
+            return false;
+
+        int value = enabled ? 1 : 0;
+#if defined(TCP_CORK)
+        int option = TCP_CORK;
+#elif defined(TCP_NOPUSH)
+        int option = TCP_NOPUSH;
+#else
+        Logger::getInstance().log(LogLevel::WARNING, "Socket corking is not supported on this platform.");
+        return false;
+#endif
+        if (setsockopt(socketFd_, IPPROTO_TCP, option, &value, sizeof(value)) == -1)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to " + std::string(enabled ? "cork" : "uncork") + " socket: " + strerror(errno));
+            return false;
+        }
+        return true;
+    }
 } // namespace relay
\ No newline at end of file
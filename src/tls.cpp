@@ -0,0 +1,413 @@
+#include "../include/relay/tls.h"
+#include "../include/relay/logger.h"
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+#include <openssl/x509.h>
+#include <arpa/inet.h>
+#include <algorithm>
+#include <sys/socket.h>
+#include <cerrno>
+#include <climits>
+#include <fcntl.h>
+#include <poll.h>
+#include <stdexcept>
+
+namespace relay
+{
+
+    namespace
+    {
+        /// Returns and clears the most recent OpenSSL error as text.
+        std::string opensslError()
+        {
+            unsigned long code = ERR_get_error();
+            ERR_clear_error();
+            if (code == 0)
+                return "unknown error";
+            char text[256];
+            ERR_error_string_n(code, text, sizeof(text));
+            return text;
+        }
+
+        // A BIO over a socket that sends with MSG_NOSIGNAL, so writing to a connection the remote
+        // end dropped fails with EPIPE instead of raising SIGPIPE, as SocketWrapper::sendFrame() does.
+        int socketFd(BIO *bio)
+        {
+            return static_cast<int>(reinterpret_cast<intptr_t>(BIO_get_data(bio)));
+        }
+
+        int bioWrite(BIO *bio, const char *data, int len)
+        {
+            BIO_clear_retry_flags(bio);
+            ssize_t sent;
+            do
+                sent = ::send(socketFd(bio), data, static_cast<size_t>(len), MSG_NOSIGNAL);
+            while (sent == -1 && errno == EINTR);
+            if (sent == -1 && (errno == EAGAIN || errno == EWOULDBLOCK))
+                BIO_set_retry_write(bio);
+            return static_cast<int>(sent);
+        }
+
+        int bioRead(BIO *bio, char *buffer, int len)
+        {
+            BIO_clear_retry_flags(bio);
+            ssize_t received;
+            do
+                received = ::recv(socketFd(bio), buffer, static_cast<size_t>(len), 0);
+            while (received == -1 && errno == EINTR);
+            if (received == -1 && (errno == EAGAIN || errno == EWOULDBLOCK))
+                BIO_set_retry_read(bio);
+            return static_cast<int>(received);
+        }
+
+        long bioCtrl(BIO *, int cmd, long, void *)
+        {
+            return cmd == BIO_CTRL_FLUSH ? 1 : 0;
+        }
+
+        BIO_METHOD *socketMethod()
+        {
+            static BIO_METHOD *method = []
+            {
+                BIO_METHOD *m = BIO_meth_new(BIO_get_new_index() | BIO_TYPE_SOURCE_SINK, "relay socket");
+                BIO_meth_set_write(m, bioWrite);
+                BIO_meth_set_read(m, bioRead);
+                BIO_meth_set_ctrl(m, bioCtrl);
+                BIO_meth_set_create(m, [](BIO *bio)
+                                    { BIO_set_init(bio, 1); return 1; });
+                return m;
+            }();
+            return method;
+        }
+
+        /// State of one handshake, reachable from OpenSSL callbacks through the SSL's app data.
+        struct HandshakeState
+        {
+            const TlsSettings *settings;
+            bool rejected = false; ///< The verifier refused the remote end's chain.
+        };
+
+        /// DER-encodes a certificate.
+        std::string encodeCertificate(X509 *cert)
+        {
+            unsigned char *der = nullptr;
+            int len = i2d_X509(cert, &der);
+            if (len <= 0)
+                return "";
+            std::string encoded(reinterpret_cast<char *>(der), static_cast<size_t>(len));
+            OPENSSL_free(der);
+            return encoded;
+        }
+
+        // Replaces OpenSSL's chain verification with the settings' verifier.
+        int verifyChain(X509_STORE_CTX *store, void *)
+        {
+            auto ssl = static_cast<SSL *>(X509_STORE_CTX_get_ex_data(store, SSL_get_ex_data_X509_STORE_CTX_idx()));
+            auto state = static_cast<HandshakeState *>(SSL_get_app_data(ssl));
+            if (!state->settings->verify)
+                return 1;
+
+            std::vector<std::string> chain;
+            X509 *leaf = X509_STORE_CTX_get0_cert(store);
+            if (leaf)
+                chain.push_back(encodeCertificate(leaf));
+            STACK_OF(X509) *sent = X509_STORE_CTX_get0_untrusted(store);
+            for (int i = 0; sent && i < sk_X509_num(sent); i++)
+            {
+                X509 *cert = sk_X509_value(sent, i);
+                if (cert != leaf)
+                    chain.push_back(encodeCertificate(cert));
+            }
+            if (state->settings->verify(chain))
+                return 1;
+            state->rejected = true;
+            X509_STORE_CTX_set_error(store, X509_V_ERR_CERT_REJECTED);
+            return 0;
+        }
+
+        /// Whether name is an IP address, which the SNI extension must not carry.
+        bool isIpAddress(const std::string &name)
+        {
+            unsigned char address[sizeof(struct in6_addr)];
+            return inet_pton(AF_INET, name.c_str(), address) == 1 || inet_pton(AF_INET6, name.c_str(), address) == 1;
+        }
+
+        /**
+         * @brief SecureChannel over an established OpenSSL connection.
+         */
+        class TlsChannel : public SecureChannel
+        {
+        public:
+            explicit TlsChannel(SSL *ssl) : ssl_(ssl) {}
+            ~TlsChannel() override { SSL_free(ssl_); }
+
+            ssize_t read(char *buffer, size_t len) override
+            {
+                while (true)
+                {
+                    ERR_clear_error();
+                    errno = 0;
+                    int n = SSL_read(ssl_, buffer, static_cast<int>(std::min<size_t>(len, INT_MAX)));
+                    if (n > 0)
+                        return n;
+                    // Without SSL_MODE_AUTO_RETRY a KeyUpdate (see rekey()) is read without returning
+                    // data; the socket itself did not run dry, so read on for the data behind it.
+                    if (SSL_get_error(ssl_, n) == SSL_ERROR_WANT_READ && errno == 0)
+                        continue;
+                    return failure(n, true);
+                }
+            }
+
+            ssize_t write(const char *data, size_t len) override
+            {
+                ERR_clear_error();
+                errno = 0;
+                int n = SSL_write(ssl_, data, static_cast<int>(std::min<size_t>(len, INT_MAX)));
+                return n > 0 ? n : failure(n, false);
+            }
+
+            bool hasPending() const override
+            {
+                return SSL_pending(ssl_) > 0;
+            }
+
+            void shutdown() override
+            {
+                if (failed_ || shutDown_)
+                    return;
+                shutDown_ = true;
+                ERR_clear_error();
+                SSL_shutdown(ssl_);
+            }
+
+            std::string remoteIdentity() const override
+            {
+                X509 *cert = SSL_get0_peer_certificate(ssl_);
+                return cert ? encodeCertificate(cert) : "";
+            }
+
+            bool rekey() override
+            {
+                // Only TLS 1.3 has KeyUpdate; renegotiating TLS 1.2 is not the same thing.
+                if (failed_ || shutDown_ || SSL_version(ssl_) < TLS1_3_VERSION)
+                {
+                    errno = ENOTSUP;
+                    return false;
+                }
+                ERR_clear_error();
+                errno = 0;
+                // Asks the remote end to update its sending keys too. SSL_do_handshake() sends the
+                // KeyUpdate message now rather than with the next record.
+                if (SSL_key_update(ssl_, SSL_KEY_UPDATE_REQUESTED) != 1)
+                {
+                    Logger::getInstance().log(LogLevel::ERROR, "TLS key update failed: " + opensslError());
+                    errno = EPROTO;
+                    return false;
+                }
+                int result = SSL_do_handshake(ssl_);
+                if (result == 1)
+                    return true;
+                // A KeyUpdate still queued goes out with the next record.
+                return failure(result, false) == -1 && errno == EAGAIN;
+            }
+
+        private:
+            SSL *ssl_;
+            bool failed_ = false;   ///< A fatal error occurred; the connection must not be used.
+            bool shutDown_ = false; ///< close_notify was sent.
+
+            /// Maps a failed SSL_read() or SSL_write() to the recv()/send() convention.
+            ssize_t failure(int result, bool reading)
+            {
+                switch (SSL_get_error(ssl_, result))
+                {
+                case SSL_ERROR_ZERO_RETURN:
+                    return 0;
+                case SSL_ERROR_WANT_READ:
+                case SSL_ERROR_WANT_WRITE:
+                    errno = EAGAIN;
+                    return -1;
+                case SSL_ERROR_SYSCALL:
+                    failed_ = true;
+                    if (errno == 0)
+                    {
+                        // The connection ended without close_notify.
+                        if (reading)
+                            return 0;
+                        errno = EPIPE;
+                    }
+                    return -1;
+                default:
+                    failed_ = true;
+                    Logger::getInstance().log(LogLevel::ERROR, "TLS error: " + opensslError());
+                    errno = EPROTO;
+                    return -1;
+                }
+            }
+        };
+    }
+
+    TlsContext::TlsContext(TlsSettings settings) : settings_(std::move(settings))
+    {
+        ctx_ = SSL_CTX_new(TLS_method());
+        if (!ctx_)
+            throw std::runtime_error("Failed to create TLS context: " + opensslError());
+        auto fail = [this](const std::string &what)
+        {
+            std::string message = what + ": " + opensslError();
+            SSL_CTX_free(ctx_);
+            ctx_ = nullptr;
+            Logger::getInstance().log(LogLevel::ERROR, message);
+            throw std::runtime_error(message);
+        };
+
+        if (!SSL_CTX_set_min_proto_version(ctx_, settings_.minVersion ? settings_.minVersion : TLS1_2_VERSION) ||
+            !SSL_CTX_set_max_proto_version(ctx_, settings_.maxVersion))
+            fail("Unsupported TLS version");
+
+        for (size_t i = 0; i < settings_.certificateChain.size(); i++)
+        {
+            const auto &der = settings_.certificateChain[i];
+            auto data = reinterpret_cast<const unsigned char *>(der.data());
+            X509 *cert = d2i_X509(nullptr, &data, static_cast<long>(der.size()));
+            if (!cert)
+                fail("Invalid TLS certificate");
+            int ok = i == 0 ? SSL_CTX_use_certificate(ctx_, cert) : SSL_CTX_add1_chain_cert(ctx_, cert);
+            X509_free(cert);
+            if (!ok)
+                fail("Failed to load TLS certificate");
+        }
+        if (!settings_.certificateChain.empty())
+        {
+            auto data = reinterpret_cast<const unsigned char *>(settings_.privateKey.data());
+            EVP_PKEY *key = d2i_AutoPrivateKey(nullptr, &data, static_cast<long>(settings_.privateKey.size()));
+            if (!key)
+                fail("Invalid TLS private key");
+            int ok = SSL_CTX_use_PrivateKey(ctx_, key);
+            EVP_PKEY_free(key);
+            if (!ok || !SSL_CTX_check_private_key(ctx_))
+                fail("TLS private key does not match the certificate");
+        }
+
+        // Post-handshake messages such as session tickets would make a read on a readable socket
+        // return no data, stalling callers that poll first, so none are sent or waited for.
+        SSL_CTX_set_num_tickets(ctx_, 0);
+        SSL_CTX_set_options(ctx_, SSL_OP_NO_TICKET);
+        SSL_CTX_set_session_cache_mode(ctx_, SSL_SESS_CACHE_OFF);
+        SSL_CTX_clear_mode(ctx_, SSL_MODE_AUTO_RETRY);
+        SSL_CTX_set_mode(ctx_, SSL_MODE_ENABLE_PARTIAL_WRITE | SSL_MODE_ACCEPT_MOVING_WRITE_BUFFER);
+        SSL_CTX_set_cert_verify_callback(ctx_, verifyChain, nullptr);
+    }
+
+    TlsContext::~TlsContext()
+    {
+        SSL_CTX_free(ctx_);
+    }
+
+    bool TlsContext::authenticatesPeer() const
+    {
+        return settings_.authenticatesPeer;
+    }
+
+    std::unique_ptr<SecureChannel> TlsContext::handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const
+    {
+        error = EPROTO;
+        SSL *ssl = SSL_new(ctx_);
+        if (!ssl)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to start TLS handshake: " + opensslError());
+            return nullptr;
+        }
+        BIO *bio = BIO_new(socketMethod());
+        if (!bio)
+        {
+            SSL_free(ssl);
+            Logger::getInstance().log(LogLevel::ERROR, "Failed to start TLS handshake: " + opensslError());
+            return nullptr;
+        }
+        BIO_set_data(bio, reinterpret_cast<void *>(static_cast<intptr_t>(socketFd)));
+        SSL_set_bio(ssl, bio, bio);
+
+        HandshakeState state{&settings_};
+        SSL_set_app_data(ssl, &state);
+        if (server)
+        {
+            int mode = SSL_VERIFY_NONE;
+            if (settings_.clientAuth != ClientAuth::NONE)
+                mode = SSL_VERIFY_PEER | SSL_VERIFY_CLIENT_ONCE;
+            if (settings_.clientAuth == ClientAuth::REQUIRE)
+                mode |= SSL_VERIFY_FAIL_IF_NO_PEER_CERT;
+            SSL_set_verify(ssl, mode, nullptr);
+            SSL_set_accept_state(ssl);
+        }
+        else
+        {
+            // VERIFY_PEER makes OpenSSL abort the handshake when the verifier rejects the chain.
+            SSL_set_verify(ssl, SSL_VERIFY_PEER, nullptr);
+            if (!settings_.serverName.empty() && !isIpAddress(settings_.serverName))
+                SSL_set_tlsext_host_name(ssl, settings_.serverName.c_str());
+            SSL_set_connect_state(ssl);
+        }
+
+        int flags = fcntl(socketFd, F_GETFL, 0);
+        if (flags == -1 || fcntl(socketFd, F_SETFL, flags | O_NONBLOCK) == -1)
+        {
+            error = errno;
+            SSL_free(ssl);
+            return nullptr;
+        }
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        bool done = false;
+        while (!done)
+        {
+            ERR_clear_error();
+            int result = SSL_do_handshake(ssl);
+            if (result == 1)
+            {
+                done = true;
+                break;
+            }
+            int reason = SSL_get_error(ssl, result);
+            if (reason != SSL_ERROR_WANT_READ && reason != SSL_ERROR_WANT_WRITE)
+            {
+                error = state.rejected ? EACCES : EPROTO;
+                Logger::getInstance().log(LogLevel::ERROR, state.rejected ? "TLS handshake failed: certificate rejected" : "TLS handshake failed: " + opensslError());
+                break;
+            }
+            auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            if (remaining.count() <= 0)
+            {
+                error = ETIMEDOUT;
+                Logger::getInstance().log(LogLevel::ERROR, "TLS handshake timed out");
+                break;
+            }
+            pollfd pfd{socketFd, static_cast<short>(reason == SSL_ERROR_WANT_READ ? POLLIN : POLLOUT), 0};
+            if (::poll(&pfd, 1, static_cast<int>(std::min<int64_t>(remaining.count(), INT_MAX))) == -1 && errno != EINTR)
+            {
+                error = errno;
+                break;
+            }
+        }
+        fcntl(socketFd, F_SETFL, flags);
+        SSL_set_app_data(ssl, nullptr);
+
+        // A remote end that presented no certificate never reached verifyChain().
+        X509 *cert = done ? SSL_get1_peer_certificate(ssl) : nullptr;
+        if (cert)
+            X509_free(cert);
+        else if (done && settings_.verify && !settings_.verify({}))
+        {
+            error = EACCES;
+            Logger::getInstance().log(LogLevel::ERROR, "TLS handshake failed: remote end presented no certificate");
+            done = false;
+        }
+        if (!done)
+        {
+            SSL_free(ssl);
+            return nullptr;
+        }
+        error = 0;
+        return std::make_unique<TlsChannel>(ssl);
+    }
+
+} // namespace relay
@@ -0,0 +1,1020 @@
+#include "../include/relay/udp.h"
+#include "../include/relay/frame.h"
+#include "../include/relay/logger.h"
+#include <algorithm>
+#include <atomic>
+#include <cerrno>
+#include <condition_variable>
+#include <cstring>
+#include <deque>
+#include <map>
+#include <mutex>
+#include <random>
+#include <thread>
+#include <vector>
+#include <arpa/inet.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <sys/socket.h>
+#include <unistd.h>
+
+namespace relay
+{
+    using Clock = std::chrono::steady_clock;
+
+    namespace
+    {
+        // Every datagram starts with the magic "RU", a packet type and the connection's ID.
+        enum PacketType : uint8_t
+        {
+            SYN = 1,      // Opens a connection.
+            SYN_ACK = 2,  // Accepts it.
+            DATA = 3,     // A reliable segment: sequence number, acknowledgement, window, flags, bytes.
+            ACK = 4,      // Acknowledgement, window and the sequence numbers received.
+            DATAGRAM = 5, // A fragment of an unreliable frame: ID, index, count, bytes.
+            PING = 6,     // Keepalive carrying the acknowledgement and window.
+            RESET = 7,    // The connection is unknown or was dropped.
+        };
+
+        constexpr uint8_t SEGMENT_END = 0x01; // Last segment of a frame, or of a chunk of an unframed stream.
+        constexpr uint8_t SEGMENT_FIN = 0x02; // The sender will send nothing more.
+
+        constexpr size_t PACKET_HEADER_SIZE = 7;
+        constexpr size_t DATA_HEADER_SIZE = PACKET_HEADER_SIZE + 11;
+        constexpr size_t ACK_HEADER_SIZE = PACKET_HEADER_SIZE + 8;
+        constexpr size_t DATAGRAM_HEADER_SIZE = PACKET_HEADER_SIZE + 8;
+        constexpr size_t SEGMENT_SIZE = UDP_DATAGRAM_SIZE - DATA_HEADER_SIZE;
+        constexpr size_t FRAGMENT_SIZE = UDP_DATAGRAM_SIZE - DATAGRAM_HEADER_SIZE;
+
+        constexpr size_t APP_CHUNK_SIZE = 64 * 1024;        // Bytes read from the stream socket at once.
+        constexpr size_t DELIVERY_LIMIT = 1 << 20;          // Received bytes waiting for the stream socket before reassembly pauses.
+        constexpr size_t PARTIAL_DATAGRAM_LIMIT = 16;       // Unreliable frames reassembled at once; the oldest is dropped.
+        constexpr auto MIN_RTO = std::chrono::milliseconds(10);
+        constexpr auto MAX_RTO = std::chrono::milliseconds(5000);
+        constexpr int FAST_RESEND_SKIPS = 3; // Later segments acknowledged before one is resent early.
+
+        void putUint16(std::string &out, uint16_t value)
+        {
+            out += static_cast<char>(value >> 8);
+            out += static_cast<char>(value);
+        }
+
+        void putUint32(std::string &out, uint32_t value)
+        {
+            for (int shift = 24; shift >= 0; shift -= 8)
+                out += static_cast<char>(value >> shift);
+        }
+
+        uint16_t getUint16(const char *data)
+        {
+            auto bytes = reinterpret_cast<const unsigned char *>(data);
+            return static_cast<uint16_t>(bytes[0] << 8 | bytes[1]);
+        }
+
+        uint32_t getUint32(const char *data)
+        {
+            auto bytes = reinterpret_cast<const unsigned char *>(data);
+            return static_cast<uint32_t>(bytes[0]) << 24 | static_cast<uint32_t>(bytes[1]) << 16 |
+                   static_cast<uint32_t>(bytes[2]) << 8 | bytes[3];
+        }
+
+        std::string packetHeader(PacketType type, uint32_t conv)
+        {
+            std::string packet("RU");
+            packet += static_cast<char>(type);
+            putUint32(packet, conv);
+            return packet;
+        }
+
+        // Widens a 32-bit sequence number from the wire to the one nearest to reference.
+        uint64_t widen(uint32_t seq, uint64_t reference)
+        {
+            int64_t delta = static_cast<int32_t>(seq - static_cast<uint32_t>(reference));
+            return delta < 0 && static_cast<uint64_t>(-delta) > reference ? 0 : reference + delta;
+        }
+
+        bool setNonBlocking(int fd)
+        {
+            int flags = fcntl(fd, F_GETFL, 0);
+            return flags != -1 && fcntl(fd, F_SETFL, flags | O_NONBLOCK) != -1;
+        }
+
+        uint32_t randomConv()
+        {
+            std::random_device random;
+            return static_cast<uint32_t>(random());
+        }
+    } // namespace
+
+    struct UdpSession
+    {
+        struct Segment
+        {
+            uint64_t seq = 0;
+            uint8_t flags = 0;
+            std::string data;
+            Clock::time_point sentAt;
+            Clock::time_point resendAt;
+            std::chrono::microseconds rto{0};
+            int transmissions = 0;
+            int skipped = 0;
+        };
+
+        struct PartialDatagram
+        {
+            std::vector<std::string> fragments;
+            size_t received = 0;
+            Clock::time_point started; // When the first fragment arrived.
+        };
+
+        uint32_t conv = 0;
+        InetAddress remote;
+        std::string remoteAddress;
+        std::string localAddress;
+        int appFd = -1; // The engine's end of the stream socket pair.
+        std::atomic<bool> unframed{false};
+
+        // Sending.
+        std::string fromApp;
+        std::deque<Segment> unsent;
+        std::map<uint64_t, Segment> inflight;
+        uint64_t nextSeq = 0;
+        size_t remoteWindow = 0;
+        uint32_t nextDatagramId = 0;
+        bool appEof = false; // The stream socket reached end-of-file; FIN is queued.
+
+        // Receiving.
+        std::map<uint64_t, std::pair<uint8_t, std::string>> received;
+        uint64_t receiveNext = 0;
+        std::string unit; // Bytes of the frame being reassembled.
+        std::string toApp;
+        size_t toAppOffset = 0;
+        bool remoteFin = false;
+        bool appShutdown = false;
+        bool appGone = false; // The stream socket was closed; received bytes are discarded.
+        std::vector<uint32_t> acks;
+        bool windowUpdate = false;
+        bool advertisedFull = false;
+        std::map<uint32_t, PartialDatagram> partials;
+        std::atomic<uint64_t> fragmentsLost{0}; // Fragments missing from the unreliable frames dropped incomplete.
+
+        // Timing.
+        Clock::time_point lastHeard = Clock::now();
+        Clock::time_point lastSent = Clock::now();
+        std::chrono::microseconds srtt{0};
+        std::chrono::microseconds rttvar{0};
+        std::chrono::microseconds rto{0};
+
+        bool aborted = false;
+        bool resetReceived = false;
+
+        size_t freeWindow(size_t window) const { return received.size() < window ? window - received.size() : 0; }
+        size_t pendingToApp() const { return toApp.size() - toAppOffset; }
+    };
+
+    class UdpEndpoint : public std::enable_shared_from_this<UdpEndpoint>
+    {
+    public:
+        UdpEndpoint(int udpFd, bool client, const UdpSettings &settings)
+            : udpFd_(udpFd), client_(client), settings_(settings)
+        {
+            settings_.window = std::clamp<size_t>(settings_.window, 1, 65535);
+            if (settings_.idleTimeout.count() <= 0)
+                settings_.idleTimeout = UdpSettings().idleTimeout;
+            if (settings_.retransmitTimeout.count() <= 0)
+                settings_.retransmitTimeout = UdpSettings().retransmitTimeout;
+            if (settings_.reassemblyTimeout.count() <= 0)
+                settings_.reassemblyTimeout = UdpSettings().reassemblyTimeout;
+            if (pipe(wakePipe_) == -1 || pipe(readyPipe_) == -1)
+                throw std::runtime_error("Failed to create UDP endpoint pipes: " + std::string(strerror(errno)));
+            setNonBlocking(wakePipe_[0]);
+            setNonBlocking(wakePipe_[1]);
+            setNonBlocking(readyPipe_[0]);
+        }
+
+        ~UdpEndpoint()
+        {
+            ::close(udpFd_);
+            for (int fd : {wakePipe_[0], wakePipe_[1], readyPipe_[0], readyPipe_[1]})
+                ::close(fd);
+        }
+
+        std::shared_ptr<UdpSession> newSession(uint32_t conv, const InetAddress &remote, int &streamFd)
+        {
+            int pair[2];
+            if (socketpair(AF_UNIX, SOCK_STREAM, 0, pair) == -1)
+                return nullptr;
+            setNonBlocking(pair[0]);
+            auto session = std::make_shared<UdpSession>();
+            session->conv = conv;
+            session->remote = remote;
+            session->remoteAddress = formatInetAddress(remote.get());
+            session->localAddress = localAddress();
+            session->appFd = pair[0];
+            session->remoteWindow = settings_.window;
+            session->rto = settings_.retransmitTimeout;
+            streamFd = pair[1];
+            return session;
+        }
+
+        void addSession(std::shared_ptr<UdpSession> session)
+        {
+            sessions_[key(session->remote, session->conv)] = std::move(session);
+        }
+
+        void start()
+        {
+            std::thread([self = shared_from_this()]
+                        { self->run(); })
+                .detach();
+        }
+
+        int readyFd() const { return readyPipe_[0]; }
+
+        std::string localAddress() const
+        {
+            InetAddress address;
+            address.length = sizeof(address.storage);
+            return getsockname(udpFd_, address.get(), &address.length) == 0 ? formatInetAddress(address.get()) : "";
+        }
+
+        void setBacklog(int backlog)
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            backlog_ = std::max(backlog, 1);
+        }
+
+        std::unique_ptr<UdpStream> accept()
+        {
+            std::unique_lock<std::mutex> lock(mutex_);
+            acceptReady_.wait(lock, [this]
+                              { return stopped_ || !pending_.empty(); });
+            if (stopped_)
+                return nullptr;
+            auto [session, fd] = pending_.front();
+            pending_.pop_front();
+            char byte;
+            (void)::read(readyPipe_[0], &byte, 1);
+            return std::make_unique<UdpStream>(session, fd, session->remoteAddress);
+        }
+
+        void stop()
+        {
+            {
+                std::lock_guard<std::mutex> lock(mutex_);
+                if (stopped_)
+                    return;
+                stopped_ = true;
+            }
+            acceptReady_.notify_all();
+            wake();
+        }
+
+    private:
+        using Key = std::pair<std::string, uint32_t>;
+
+        int udpFd_;
+        bool client_; // A connected socket with a single session.
+        UdpSettings settings_;
+        int wakePipe_[2] = {-1, -1};
+        int readyPipe_[2] = {-1, -1}; // One byte per connection waiting for accept().
+        std::map<Key, std::shared_ptr<UdpSession>> sessions_; // Only touched by the thread.
+
+        std::mutex mutex_;
+        std::condition_variable acceptReady_;
+        std::deque<std::pair<std::shared_ptr<UdpSession>, int>> pending_;
+        int backlog_ = 128;
+        bool stopped_ = false;
+
+        static Key key(const InetAddress &address, uint32_t conv)
+        {
+            // The flow label of an IPv6 address can change between datagrams of one connection.
+            std::string id;
+            if (address.family() == AF_INET6)
+            {
+                auto &in6 = reinterpret_cast<const sockaddr_in6 &>(address.storage);
+                id.assign(reinterpret_cast<const char *>(&in6.sin6_addr), sizeof(in6.sin6_addr));
+                id.append(reinterpret_cast<const char *>(&in6.sin6_scope_id), sizeof(in6.sin6_scope_id));
+                id.append(reinterpret_cast<const char *>(&in6.sin6_port), sizeof(in6.sin6_port));
+            }
+            else
+            {
+                auto &in4 = reinterpret_cast<const sockaddr_in &>(address.storage);
+                id.assign(reinterpret_cast<const char *>(&in4.sin_addr), sizeof(in4.sin_addr));
+                id.append(reinterpret_cast<const char *>(&in4.sin_port), sizeof(in4.sin_port));
+            }
+            return {std::move(id), conv};
+        }
+
+        void wake()
+        {
+            char byte = 0;
+            (void)::write(wakePipe_[1], &byte, 1);
+        }
+
+        bool isStopped()
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            return stopped_;
+        }
+
+        void sendPacket(UdpSession *session, const std::string &packet, const InetAddress &to)
+        {
+            ssize_t sent = client_ ? ::send(udpFd_, packet.data(), packet.size(), 0)
+                                   : ::sendto(udpFd_, packet.data(), packet.size(), 0, to.get(), to.length);
+            if (sent == -1 && errno == ECONNREFUSED && session)
+                session->aborted = true;
+            if (session)
+                session->lastSent = Clock::now();
+        }
+
+        void sendReset(uint32_t conv, const InetAddress &to)
+        {
+            sendPacket(nullptr, packetHeader(RESET, conv), to);
+        }
+
+        void run()
+        {
+            std::vector<char> buffer(65536);
+            while (true)
+            {
+                bool stopped = isStopped();
+                if (stopped && !client_)
+                    closePending();
+                if (sessions_.empty() && (client_ || stopped))
+                    break;
+
+                auto now = Clock::now();
+                auto wakeAt = now + settings_.idleTimeout;
+                std::vector<pollfd> fds{{wakePipe_[0], POLLIN, 0}, {udpFd_, POLLIN, 0}};
+                std::vector<UdpSession *> polled;
+                for (auto &[key, session] : sessions_)
+                {
+                    short events = 0;
+                    if (!session->appEof && canQueue(*session))
+                        events |= POLLIN;
+                    if (session->pendingToApp() > 0)
+                        events |= POLLOUT;
+                    if (events)
+                    {
+                        fds.push_back(pollfd{session->appFd, events, 0});
+                        polled.push_back(session.get());
+                    }
+                    wakeAt = std::min(wakeAt, nextTimer(*session));
+                }
+                auto timeout = std::chrono::duration_cast<std::chrono::milliseconds>(wakeAt - now).count();
+                int ready = ::poll(fds.data(), fds.size(), static_cast<int>(std::clamp<int64_t>(timeout, 0, 1000)));
+                if (ready == -1 && errno != EINTR)
+                {
+                    Logger::getInstance().log(LogLevel::ERROR, "UDP endpoint poll failed: " + std::string(strerror(errno)));
+                    break;
+                }
+
+                if (ready > 0 && (fds[0].revents & POLLIN))
+                    while (::read(wakePipe_[0], buffer.data(), buffer.size()) > 0)
+                        ;
+                if (ready > 0 && (fds[1].revents & (POLLIN | POLLERR)))
+                    receivePackets(buffer);
+                for (size_t i = 0; ready > 0 && i < polled.size(); i++)
+                {
+                    short revents = fds[i + 2].revents;
+                    if (revents & (POLLIN | POLLHUP | POLLERR))
+                        readApp(*polled[i]);
+                    if (revents & (POLLOUT | POLLHUP | POLLERR))
+                        writeApp(*polled[i]);
+                }
+
+                for (auto it = sessions_.begin(); it != sessions_.end();)
+                {
+                    if (service(*it->second))
+                        ++it;
+                    else
+                        it = sessions_.erase(it);
+                }
+            }
+            closePending();
+            for (auto &[key, session] : sessions_)
+                ::close(session->appFd);
+            sessions_.clear();
+        }
+
+        void closePending()
+        {
+            std::deque<std::pair<std::shared_ptr<UdpSession>, int>> pending;
+            {
+                std::lock_guard<std::mutex> lock(mutex_);
+                pending.swap(pending_);
+            }
+            for (auto &[session, fd] : pending)
+            {
+                ::close(fd);
+                session->aborted = true;
+            }
+        }
+
+        bool canQueue(const UdpSession &session) const
+        {
+            return session.unsent.size() + session.inflight.size() < 2 * settings_.window;
+        }
+
+        Clock::time_point nextTimer(const UdpSession &session) const
+        {
+            auto next = std::min(session.lastHeard + settings_.idleTimeout, session.lastSent + settings_.idleTimeout / 4);
+            for (const auto &[seq, segment] : session.inflight)
+                next = std::min(next, segment.resendAt);
+            for (const auto &[id, partial] : session.partials)
+                next = std::min(next, partial.started + settings_.reassemblyTimeout);
+            if (!session.unsent.empty() && session.inflight.size() < std::min(settings_.window, session.remoteWindow))
+                next = Clock::now();
+            return next;
+        }
+
+        void receivePackets(std::vector<char> &buffer)
+        {
+            for (int i = 0; i < 512; i++)
+            {
+                InetAddress from;
+                from.length = sizeof(from.storage);
+                ssize_t n = ::recvfrom(udpFd_, buffer.data(), buffer.size(), 0, from.get(), &from.length);
+                if (n == -1)
+                {
+                    // A connected socket reports the ICMP port unreachable of an earlier send.
+                    if (errno == ECONNREFUSED && client_)
+                        for (auto &[key, session] : sessions_)
+                            session->aborted = true;
+                    return;
+                }
+                if (n < static_cast<ssize_t>(PACKET_HEADER_SIZE) || buffer[0] != 'R' || buffer[1] != 'U')
+                    continue;
+                handlePacket(buffer.data(), static_cast<size_t>(n), from);
+            }
+        }
+
+        void handlePacket(const char *data, size_t len, const InetAddress &from)
+        {
+            auto type = static_cast<PacketType>(data[2]);
+            uint32_t conv = getUint32(data + 3);
+            std::shared_ptr<UdpSession> session;
+            if (client_)
+            {
+                if (!sessions_.empty() && sessions_.begin()->second->conv == conv)
+                    session = sessions_.begin()->second;
+            }
+            else
+            {
+                auto it = sessions_.find(key(from, conv));
+                if (it != sessions_.end())
+                    session = it->second;
+                else if (type == SYN)
+                    session = acceptSession(conv, from);
+            }
+            if (!session)
+            {
+                if (type != RESET && type != SYN_ACK && !client_)
+                    sendReset(conv, from);
+                return;
+            }
+
+            session->lastHeard = Clock::now();
+            const char *body = data + PACKET_HEADER_SIZE;
+            size_t bodyLen = len - PACKET_HEADER_SIZE;
+            switch (type)
+            {
+            case SYN:
+                if (!client_)
+                    sendPacket(session.get(), packetHeader(SYN_ACK, conv), from);
+                break;
+            case DATA:
+                if (bodyLen >= DATA_HEADER_SIZE - PACKET_HEADER_SIZE)
+                {
+                    acknowledged(*session, getUint32(body + 4), getUint16(body + 8));
+                    receiveSegment(*session, getUint32(body), static_cast<uint8_t>(body[10]), std::string(body + 11, bodyLen - 11));
+                }
+                break;
+            case ACK:
+                if (bodyLen >= ACK_HEADER_SIZE - PACKET_HEADER_SIZE)
+                {
+                    acknowledged(*session, getUint32(body), getUint16(body + 4));
+                    size_t count = std::min<size_t>(getUint16(body + 6), (bodyLen - 8) / 4);
+                    for (size_t i = 0; i < count; i++)
+                        acknowledgedSegment(*session, getUint32(body + 8 + 4 * i));
+                }
+                break;
+            case DATAGRAM:
+                if (bodyLen >= DATAGRAM_HEADER_SIZE - PACKET_HEADER_SIZE)
+                    receiveFragment(*session, getUint32(body), getUint16(body + 4), getUint16(body + 6), std::string(body + 8, bodyLen - 8));
+                break;
+            case PING:
+                if (bodyLen >= 6)
+                    acknowledged(*session, getUint32(body), getUint16(body + 4));
+                break;
+            case RESET:
+                session->aborted = true;
+                session->resetReceived = true;
+                break;
+            default:
+                break;
+            }
+        }
+
+        std::shared_ptr<UdpSession> acceptSession(uint32_t conv, const InetAddress &from)
+        {
+            std::lock_guard<std::mutex> lock(mutex_);
+            if (stopped_ || pending_.size() >= static_cast<size_t>(backlog_))
+                return nullptr;
+            int streamFd = -1;
+            auto session = newSession(conv, from, streamFd);
+            if (!session)
+                return nullptr;
+            addSession(session);
+            pending_.emplace_back(session, streamFd);
+            char byte = 0;
+            (void)::write(readyPipe_[1], &byte, 1);
+            acceptReady_.notify_one();
+            Logger::getInstance().log(LogLevel::INFO, "Accepted UDP connection from " + session->remoteAddress);
+            return session;
+        }
+
+        // Applies the cumulative acknowledgement and window the remote end reported.
+        void acknowledged(UdpSession &session, uint32_t una, uint16_t window)
+        {
+            uint64_t next = widen(una, session.inflight.empty() ? session.nextSeq : session.inflight.begin()->first);
+            session.inflight.erase(session.inflight.begin(), session.inflight.lower_bound(next));
+            session.remoteWindow = window;
+        }
+
+        void acknowledgedSegment(UdpSession &session, uint32_t seq)
+        {
+            if (session.inflight.empty())
+                return;
+            auto it = session.inflight.find(widen(seq, session.inflight.begin()->first));
+            if (it == session.inflight.end())
+                return;
+            if (it->second.transmissions == 1)
+                sampleRtt(session, std::chrono::duration_cast<std::chrono::microseconds>(Clock::now() - it->second.sentAt));
+            for (auto earlier = session.inflight.begin(); earlier != it; ++earlier)
+                earlier->second.skipped++;
+            session.inflight.erase(it);
+        }
+
+        // Updates the retransmission timeout from a round trip, as RFC 6298 does for TCP.
+        void sampleRtt(UdpSession &session, std::chrono::microseconds rtt)
+        {
+            if (session.srtt.count() == 0)
+            {
+                session.srtt = rtt;
+                session.rttvar = rtt / 2;
+            }
+            else
+            {
+                auto deviation = session.srtt > rtt ? session.srtt - rtt : rtt - session.srtt;
+                session.rttvar = (3 * session.rttvar + deviation) / 4;
+                session.srtt = (7 * session.srtt + rtt) / 8;
+            }
+            session.rto = std::clamp<std::chrono::microseconds>(session.srtt + 4 * session.rttvar, MIN_RTO, MAX_RTO);
+        }
+
+        void receiveSegment(UdpSession &session, uint32_t wireSeq, uint8_t flags, std::string data)
+        {
+            uint64_t seq = widen(wireSeq, session.receiveNext);
+            if (seq >= session.receiveNext + settings_.window)
+                return; // No room; the sender resends it once the window moves.
+            session.acks.push_back(wireSeq);
+            if (seq >= session.receiveNext)
+                session.received.emplace(seq, std::make_pair(flags, std::move(data)));
+        }
+
+        void receiveFragment(UdpSession &session, uint32_t id, uint16_t index, uint16_t count, std::string data)
+        {
+            if (count == 0 || index >= count || session.appGone)
+                return;
+            auto it = session.partials.find(id);
+            if (it == session.partials.end())
+            {
+                if (session.partials.size() >= PARTIAL_DATAGRAM_LIMIT)
+                    dropPartial(session, session.partials.begin());
+                it = session.partials.emplace(id, UdpSession::PartialDatagram{std::vector<std::string>(count), 0, Clock::now()}).first;
+            }
+            auto &partial = it->second;
+            if (partial.fragments.size() != count || !partial.fragments[index].empty() || data.empty())
+                return;
+            partial.fragments[index] = std::move(data);
+            if (++partial.received < count)
+                return;
+            std::string frame;
+            for (auto &fragment : partial.fragments)
+                frame += fragment;
+            session.partials.erase(it);
+            // Unreliable frames are dropped rather than queued behind a slow reader.
+            if (session.pendingToApp() < DELIVERY_LIMIT)
+                session.toApp += frame;
+        }
+
+        void dropPartial(UdpSession &session, std::map<uint32_t, UdpSession::PartialDatagram>::iterator it)
+        {
+            session.fragmentsLost += it->second.fragments.size() - it->second.received;
+            session.partials.erase(it);
+        }
+
+        // Drops the unreliable frames still incomplete after the reassembly timeout.
+        void expirePartials(UdpSession &session, Clock::time_point now)
+        {
+            for (auto it = session.partials.begin(); it != session.partials.end();)
+            {
+                auto next = std::next(it);
+                if (now - it->second.started >= settings_.reassemblyTimeout)
+                    dropPartial(session, it);
+                it = next;
+            }
+        }
+
+        void readApp(UdpSession &session)
+        {
+            char chunk[APP_CHUNK_SIZE];
+            while (!session.appEof && canQueue(session))
+            {
+                ssize_t n = ::recv(session.appFd, chunk, sizeof(chunk), 0);
+                if (n > 0)
+                {
+                    session.fromApp.append(chunk, static_cast<size_t>(n));
+                    queueFromApp(session);
+                    continue;
+                }
+                if (n == -1 && (errno == EAGAIN || errno == EWOULDBLOCK || errno == EINTR))
+                    return;
+                // End-of-file, or the stream socket failed: flush what is left and say goodbye.
+                if (!session.fromApp.empty())
+                    queueReliable(session, session.fromApp, 0);
+                session.fromApp.clear();
+                queueReliable(session, "", SEGMENT_FIN);
+                session.appEof = true;
+            }
+        }
+
+        // Turns the bytes read from the stream socket into segments, or datagrams for unreliable frames.
+        void queueFromApp(UdpSession &session)
+        {
+            while (!session.fromApp.empty())
+            {
+                if (session.unframed)
+                {
+                    queueReliable(session, session.fromApp, 0);
+                    session.fromApp.clear();
+                    return;
+                }
+                bool corrupt = false;
+                auto frame = decodeFrame(session.fromApp, corrupt);
+                if (corrupt)
+                {
+                    // Not relay frames after all; pass the rest through untouched.
+                    session.unframed = true;
+                    continue;
+                }
+                if (!frame)
+                    return;
+                if (frame->flags & FRAME_UNRELIABLE)
+                    sendUnreliable(session, encodeFrame(*frame));
+                else
+                    queueReliable(session, encodeFrame(*frame), 0);
+            }
+        }
+
+        void queueReliable(UdpSession &session, const std::string &data, uint8_t flags)
+        {
+            size_t offset = 0;
+            do
+            {
+                UdpSession::Segment segment;
+                segment.seq = session.nextSeq++;
+                segment.data = data.substr(offset, SEGMENT_SIZE);
+                offset += segment.data.size();
+                segment.flags = offset >= data.size() ? static_cast<uint8_t>(SEGMENT_END | flags) : 0;
+                session.unsent.push_back(std::move(segment));
+            } while (offset < data.size());
+        }
+
+        void sendUnreliable(UdpSession &session, const std::string &frame)
+        {
+            size_t count = (frame.size() + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE;
+            if (count > 65535)
+                return;
+            uint32_t id = session.nextDatagramId++;
+            for (size_t i = 0; i < count; i++)
+            {
+                std::string packet = packetHeader(DATAGRAM, session.conv);
+                putUint32(packet, id);
+                putUint16(packet, static_cast<uint16_t>(i));
+                putUint16(packet, static_cast<uint16_t>(count));
+                packet.append(frame, i * FRAGMENT_SIZE, FRAGMENT_SIZE);
+                sendPacket(&session, packet, session.remote);
+            }
+        }
+
+        void writeApp(UdpSession &session)
+        {
+            while (session.pendingToApp() > 0)
+            {
+                ssize_t n = ::send(session.appFd, session.toApp.data() + session.toAppOffset, session.pendingToApp(), MSG_NOSIGNAL | MSG_DONTWAIT);
+                if (n > 0)
+                {
+                    session.toAppOffset += static_cast<size_t>(n);
+                    continue;
+                }
+                if (n == -1 && (errno == EAGAIN || errno == EWOULDBLOCK || errno == EINTR))
+                    break;
+                session.appGone = true;
+                session.toApp.clear();
+                session.toAppOffset = 0;
+                break;
+            }
+            if (session.toAppOffset == session.toApp.size())
+            {
+                session.toApp.clear();
+                session.toAppOffset = 0;
+            }
+        }
+
+        // Moves received segments that are next in order into the frame being reassembled.
+        void deliver(UdpSession &session)
+        {
+            while (!session.received.empty() && session.received.begin()->first == session.receiveNext &&
+                   (session.appGone || session.pendingToApp() < DELIVERY_LIMIT))
+            {
+                auto [flags, data] = std::move(session.received.begin()->second);
+                session.received.erase(session.received.begin());
+                session.receiveNext++;
+                if (session.advertisedFull)
+                    session.windowUpdate = true;
+                if (session.appGone)
+                    data.clear();
+                session.unit += data;
+                if (flags & SEGMENT_END)
+                {
+                    session.toApp += session.unit;
+                    session.unit.clear();
+                }
+                if (flags & SEGMENT_FIN)
+                    session.remoteFin = true;
+            }
+        }
+
+        void transmit(UdpSession &session, Clock::time_point now)
+        {
+            size_t limit = std::min(settings_.window, session.remoteWindow);
+            while (!session.unsent.empty() && session.inflight.size() < limit)
+            {
+                auto segment = std::move(session.unsent.front());
+                session.unsent.pop_front();
+                segment.rto = session.rto;
+                sendSegment(session, segment, now);
+                session.inflight.emplace(segment.seq, std::move(segment));
+            }
+            for (auto &[seq, segment] : session.inflight)
+            {
+                if (now < segment.resendAt && segment.skipped < FAST_RESEND_SKIPS)
+                    continue;
+                segment.rto = std::min<std::chrono::microseconds>(segment.rto * 2, MAX_RTO);
+                sendSegment(session, segment, now);
+            }
+        }
+
+        void sendSegment(UdpSession &session, UdpSession::Segment &segment, Clock::time_point now)
+        {
+            std::string packet = packetHeader(DATA, session.conv);
+            putUint32(packet, static_cast<uint32_t>(segment.seq));
+            putUint32(packet, static_cast<uint32_t>(session.receiveNext));
+            putUint16(packet, static_cast<uint16_t>(session.freeWindow(settings_.window)));
+            packet += static_cast<char>(segment.flags);
+            packet += segment.data;
+            segment.transmissions++;
+            segment.skipped = 0;
+            segment.sentAt = now;
+            segment.resendAt = now + segment.rto;
+            sendPacket(&session, packet, session.remote);
+        }
+
+        void sendAcks(UdpSession &session, bool keepalive)
+        {
+            auto window = static_cast<uint16_t>(session.freeWindow(settings_.window));
+            session.advertisedFull = window == 0;
+            if (session.acks.empty() && !session.windowUpdate)
+            {
+                if (keepalive)
+                {
+                    std::string packet = packetHeader(PING, session.conv);
+                    putUint32(packet, static_cast<uint32_t>(session.receiveNext));
+                    putUint16(packet, window);
+                    sendPacket(&session, packet, session.remote);
+                }
+                return;
+            }
+            size_t perPacket = (UDP_DATAGRAM_SIZE - ACK_HEADER_SIZE) / 4;
+            size_t offset = 0;
+            do
+            {
+                size_t count = std::min(perPacket, session.acks.size() - offset);
+                std::string packet = packetHeader(ACK, session.conv);
+                putUint32(packet, static_cast<uint32_t>(session.receiveNext));
+                putUint16(packet, window);
+                putUint16(packet, static_cast<uint16_t>(count));
+                for (size_t i = 0; i < count; i++)
+                    putUint32(packet, session.acks[offset + i]);
+                offset += count;
+                sendPacket(&session, packet, session.remote);
+            } while (offset < session.acks.size());
+            session.acks.clear();
+            session.windowUpdate = false;
+        }
+
+        // Runs the session's pending work; returns false once it is over.
+        bool service(UdpSession &session)
+        {
+            auto now = Clock::now();
+            if (!session.aborted && now - session.lastHeard >= settings_.idleTimeout)
+            {
+                Logger::getInstance().log(LogLevel::WARNING, "UDP connection to " + session.remoteAddress + " timed out");
+                session.aborted = true;
+            }
+            if (session.aborted)
+            {
+                if (!session.resetReceived)
+                    sendReset(session.conv, session.remote);
+                ::close(session.appFd);
+                return false;
+            }
+
+            expirePartials(session, now);
+            deliver(session);
+            writeApp(session);
+            if (session.remoteFin && session.pendingToApp() == 0 && !session.appShutdown && !session.appGone)
+            {
+                ::shutdown(session.appFd, SHUT_WR);
+                session.appShutdown = true;
+            }
+            transmit(session, now);
+            sendAcks(session, now - session.lastSent >= settings_.idleTimeout / 4);
+
+            bool sentAll = session.appEof && session.unsent.empty() && session.inflight.empty();
+            bool receivedAll = session.remoteFin ? session.pendingToApp() == 0 || session.appGone : false;
+            if (sentAll && receivedAll)
+            {
+                ::close(session.appFd);
+                return false;
+            }
+            return true;
+        }
+    };
+
+    UdpStream::UdpStream(std::shared_ptr<UdpSession> session, int fd, std::string remoteAddress)
+        : session_(std::move(session)), fd_(fd), remoteAddress_(std::move(remoteAddress)) {}
+
+    std::string UdpStream::localAddress() const
+    {
+        return session_ ? session_->localAddress : "";
+    }
+
+    void UdpStream::disableFraming()
+    {
+        if (session_)
+            session_->unframed = true;
+    }
+
+    uint64_t UdpStream::fragmentsLost() const
+    {
+        return session_ ? session_->fragmentsLost.load() : 0;
+    }
+
+    UdpListener::UdpListener(std::shared_ptr<UdpEndpoint> endpoint) : endpoint_(std::move(endpoint)) {}
+
+    std::unique_ptr<UdpListener> UdpListener::open(const InetAddress &address, const UdpSettings &settings, const BindOptions &bind, int &error)
+    {
+        int fd = openInetSocket(address.family(), SOCK_DGRAM, bind);
+        if (fd == -1 || ::bind(fd, address.get(), address.length) == -1 || !setNonBlocking(fd))
+        {
+            error = errno;
+            if (fd != -1)
+                ::close(fd);
+            return nullptr;
+        }
+        try
+        {
+            auto endpoint = std::make_shared<UdpEndpoint>(fd, false, settings);
+            endpoint->start();
+            return std::unique_ptr<UdpListener>(new UdpListener(endpoint));
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, e.what());
+            error = EMFILE;
+            return nullptr;
+        }
+    }
+
+    UdpListener::~UdpListener()
+    {
+        stop();
+    }
+
+    std::string UdpListener::localAddress() const
+    {
+        return endpoint_->localAddress();
+    }
+
+    int UdpListener::readyFd() const
+    {
+        return endpoint_->readyFd();
+    }
+
+    void UdpListener::setBacklog(int backlog)
+    {
+        endpoint_->setBacklog(backlog);
+    }
+
+    std::unique_ptr<UdpStream> UdpListener::accept()
+    {
+        return endpoint_->accept();
+    }
+
+    void UdpListener::stop()
+    {
+        endpoint_->stop();
+    }
+
+    std::unique_ptr<UdpStream> connectUdp(const InetAddress *local, const InetAddress &remote, const UdpSettings &settings,
+                                          std::chrono::milliseconds timeout, int &error)
+    {
+        if (local && local->family() != remote.family())
+        {
+            error = EINVAL;
+            return nullptr;
+        }
+        int fd = openInetSocket(remote.family(), SOCK_DGRAM);
+        if (fd == -1)
+        {
+            error = errno;
+            return nullptr;
+        }
+        auto fail = [&](int code) -> std::unique_ptr<UdpStream>
+        {
+            error = code;
+            ::close(fd);
+            return nullptr;
+        };
+        if (local && ::bind(fd, local->get(), local->length) == -1)
+            return fail(errno);
+        if (::connect(fd, remote.get(), remote.length) == -1 || !setNonBlocking(fd))
+            return fail(errno);
+
+        // Send SYN until the listener answers, backing off like a retransmission.
+        uint32_t conv = randomConv();
+        auto deadline = Clock::now() + (timeout.count() > 0 ? timeout : (settings.idleTimeout.count() > 0 ? settings.idleTimeout : UdpSettings().idleTimeout));
+        auto rto = settings.retransmitTimeout.count() > 0 ? settings.retransmitTimeout : UdpSettings().retransmitTimeout;
+        std::string syn = packetHeader(SYN, conv);
+        char reply[UDP_DATAGRAM_SIZE];
+        bool accepted = false;
+        while (!accepted)
+        {
+            auto now = Clock::now();
+            if (now >= deadline)
+                return fail(ETIMEDOUT);
+            if (::send(fd, syn.data(), syn.size(), 0) == -1 && errno == ECONNREFUSED)
+                return fail(ECONNREFUSED);
+            auto wait = std::min<Clock::duration>(rto, deadline - now);
+            pollfd pfd{fd, POLLIN, 0};
+            if (::poll(&pfd, 1, static_cast<int>(std::chrono::duration_cast<std::chrono::milliseconds>(wait).count())) > 0)
+            {
+                ssize_t n;
+                while ((n = ::recv(fd, reply, sizeof(reply), 0)) >= 0)
+                    if (static_cast<size_t>(n) >= PACKET_HEADER_SIZE && reply[0] == 'R' && reply[1] == 'U' &&
+                        reply[2] == SYN_ACK && getUint32(reply + 3) == conv)
+                        accepted = true;
+                if (!accepted && errno == ECONNREFUSED)
+                    return fail(ECONNREFUSED);
+            }
+            rto = std::min<std::chrono::milliseconds>(rto * 2, std::chrono::duration_cast<std::chrono::milliseconds>(MAX_RTO));
+        }
+
+        std::shared_ptr<UdpEndpoint> endpoint;
+        try
+        {
+            endpoint = std::make_shared<UdpEndpoint>(fd, true, settings);
+        }
+        catch (const std::exception &e)
+        {
+            Logger::getInstance().log(LogLevel::ERROR, e.what());
+            return fail(EMFILE);
+        }
+        int streamFd = -1;
+        auto session = endpoint->newSession(conv, remote, streamFd);
+        if (!session)
+        {
+            error = errno;
+            return nullptr; // The endpoint closes fd.
+        }
+        endpoint->addSession(session);
+        endpoint->start();
+        Logger::getInstance().log(LogLevel::INFO, "Opened UDP connection to " + session->remoteAddress);
+        return std::make_unique<UdpStream>(session, streamFd, session->remoteAddress);
+    }
+
+} // namespace relay
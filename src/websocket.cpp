@@ -0,0 +1,592 @@
+#include "../include/relay/websocket.h"
+#include "../include/relay/logger.h"
+#include <openssl/evp.h>
+#include <openssl/rand.h>
+#include <openssl/sha.h>
+#include <arpa/inet.h>
+#include <netinet/in.h>
+#include <sys/socket.h>
+#include <algorithm>
+#include <cctype>
+#include <cerrno>
+#include <cstring>
+#include <stdexcept>
+#include <vector>
+
+namespace relay
+{
+
+    namespace
+    {
+        /// Appended to the client's key to compute Sec-WebSocket-Accept (RFC 6455, section 1.3).
+        const std::string ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+
+        constexpr size_t MAX_HANDSHAKE_SIZE = 8192;
+        constexpr size_t MAX_WRITE_PAYLOAD = 64 * 1024;
+
+        enum Opcode : unsigned char
+        {
+            CONTINUATION = 0x0,
+            TEXT = 0x1,
+            BINARY = 0x2,
+            CLOSE = 0x8,
+            PING = 0x9,
+            PONG = 0xa,
+        };
+
+        std::string base64(const std::string &data)
+        {
+            std::string out(4 * ((data.size() + 2) / 3) + 1, '\0');
+            int len = EVP_EncodeBlock(reinterpret_cast<unsigned char *>(&out[0]),
+                                      reinterpret_cast<const unsigned char *>(data.data()), static_cast<int>(data.size()));
+            out.resize(len > 0 ? static_cast<size_t>(len) : 0);
+            return out;
+        }
+
+        std::string acceptKey(const std::string &key)
+        {
+            std::string data = key + ACCEPT_GUID;
+            unsigned char digest[SHA_DIGEST_LENGTH];
+            SHA1(reinterpret_cast<const unsigned char *>(data.data()), data.size(), digest);
+            return base64(std::string(reinterpret_cast<char *>(digest), sizeof(digest)));
+        }
+
+        std::string lower(std::string s)
+        {
+            std::transform(s.begin(), s.end(), s.begin(), [](unsigned char c)
+                           { return static_cast<char>(std::tolower(c)); });
+            return s;
+        }
+
+        std::string trim(const std::string &s)
+        {
+            size_t start = s.find_first_not_of(" \t");
+            size_t end = s.find_last_not_of(" \t");
+            return start == std::string::npos ? "" : s.substr(start, end - start + 1);
+        }
+
+        /**
+         * @brief The start line and headers of an HTTP/1.1 message, header names lowercased.
+         */
+        struct HttpHead
+        {
+            std::string startLine;
+            std::vector<std::pair<std::string, std::string>> headers;
+
+            static HttpHead parse(const std::string &text)
+            {
+                HttpHead head;
+                size_t pos = 0;
+                while (pos < text.size())
+                {
+                    size_t end = text.find("\r\n", pos);
+                    if (end == std::string::npos)
+                        end = text.size();
+                    std::string line = text.substr(pos, end - pos);
+                    pos = end + 2;
+                    if (head.startLine.empty())
+                    {
+                        head.startLine = line;
+                        continue;
+                    }
+                    size_t colon = line.find(':');
+                    if (colon != std::string::npos)
+                        head.headers.emplace_back(lower(trim(line.substr(0, colon))), trim(line.substr(colon + 1)));
+                }
+                return head;
+            }
+
+            std::string get(const std::string &name) const
+            {
+                for (const auto &header : headers)
+                    if (header.first == name)
+                        return header.second;
+                return "";
+            }
+
+            /// Checks whether a comma-separated header holds token, ignoring case.
+            bool hasToken(const std::string &name, const std::string &token) const
+            {
+                std::string value = lower(get(name));
+                size_t pos = 0;
+                while (pos <= value.size())
+                {
+                    size_t end = value.find(',', pos);
+                    if (end == std::string::npos)
+                        end = value.size();
+                    if (trim(value.substr(pos, end - pos)) == token)
+                        return true;
+                    pos = end + 1;
+                }
+                return false;
+            }
+        };
+
+        /// Returns the socket's remote address as a Host header value.
+        std::string peerHost(int fd)
+        {
+            sockaddr_storage addr{};
+            socklen_t len = sizeof(addr);
+            if (getpeername(fd, reinterpret_cast<sockaddr *>(&addr), &len) == -1)
+                return "localhost";
+            char ip[INET6_ADDRSTRLEN] = {0};
+            if (addr.ss_family == AF_INET6)
+            {
+                auto in6 = reinterpret_cast<sockaddr_in6 *>(&addr);
+                inet_ntop(AF_INET6, &in6->sin6_addr, ip, sizeof(ip));
+                return "[" + std::string(ip) + "]:" + std::to_string(ntohs(in6->sin6_port));
+            }
+            auto in4 = reinterpret_cast<sockaddr_in *>(&addr);
+            inet_ntop(AF_INET, &in4->sin_addr, ip, sizeof(ip));
+            return std::string(ip) + ":" + std::to_string(ntohs(in4->sin_port));
+        }
+
+        /**
+         * @brief Bounds the socket's blocking reads and writes by a deadline while it is in scope,
+         *        restoring the previous socket timeouts afterwards.
+         */
+        class HandshakeTimeouts
+        {
+        public:
+            HandshakeTimeouts(int fd, handshake::Deadline deadline) : fd_(fd), deadline_(deadline)
+            {
+                socklen_t len = sizeof(receive_);
+                getsockopt(fd_, SOL_SOCKET, SO_RCVTIMEO, &receive_, &len);
+                len = sizeof(send_);
+                getsockopt(fd_, SOL_SOCKET, SO_SNDTIMEO, &send_, &len);
+            }
+
+            ~HandshakeTimeouts()
+            {
+                setsockopt(fd_, SOL_SOCKET, SO_RCVTIMEO, &receive_, sizeof(receive_));
+                setsockopt(fd_, SOL_SOCKET, SO_SNDTIMEO, &send_, sizeof(send_));
+            }
+
+            /// Limits the next operation to the time left; false with error ETIMEDOUT if none is.
+            bool arm(int &error)
+            {
+                auto remaining = std::chrono::duration_cast<std::chrono::microseconds>(deadline_ - std::chrono::steady_clock::now());
+                if (remaining.count() <= 0)
+                {
+                    error = ETIMEDOUT;
+                    return false;
+                }
+                timeval tv{static_cast<time_t>(remaining.count() / 1000000), static_cast<suseconds_t>(remaining.count() % 1000000)};
+                setsockopt(fd_, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+                setsockopt(fd_, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+                return true;
+            }
+
+        private:
+            int fd_;
+            handshake::Deadline deadline_;
+            timeval receive_{};
+            timeval send_{};
+        };
+
+        /// Writes all of data to channel before the deadline.
+        bool writeAll(SecureChannel &channel, HandshakeTimeouts &timeouts, const std::string &data, int &error)
+        {
+            size_t total = 0;
+            while (total < data.size())
+            {
+                if (!timeouts.arm(error))
+                    return false;
+                ssize_t sent = channel.write(data.data() + total, data.size() - total);
+                if (sent > 0)
+                    total += static_cast<size_t>(sent);
+                else if (sent == -1 && errno == EINTR)
+                    continue;
+                else
+                {
+                    error = sent == -1 && (errno == EAGAIN || errno == EWOULDBLOCK) ? ETIMEDOUT : EPROTO;
+                    return false;
+                }
+            }
+            return true;
+        }
+
+        /// Reads an HTTP head from channel into head; bytes after it are left in rest.
+        bool readHead(SecureChannel &channel, HandshakeTimeouts &timeouts, std::string &head, std::string &rest, int &error)
+        {
+            std::string data;
+            while (true)
+            {
+                size_t end = data.find("\r\n\r\n");
+                if (end != std::string::npos)
+                {
+                    head = data.substr(0, end);
+                    rest = data.substr(end + 4);
+                    return true;
+                }
+                if (data.size() > MAX_HANDSHAKE_SIZE)
+                {
+                    error = EPROTO;
+                    return false;
+                }
+                if (!channel.hasPending() && !timeouts.arm(error))
+                    return false;
+                char chunk[1024];
+                ssize_t received = channel.read(chunk, sizeof(chunk));
+                if (received > 0)
+                    data.append(chunk, static_cast<size_t>(received));
+                else if (received == -1 && errno == EINTR)
+                    continue;
+                else
+                {
+                    error = received == -1 && (errno == EAGAIN || errno == EWOULDBLOCK) ? ETIMEDOUT : EPROTO;
+                    return false;
+                }
+            }
+        }
+
+        /// Encodes one final frame, masked when sent by the connecting end.
+        std::string encodeFrame(unsigned char opcode, const char *payload, size_t len, bool masked)
+        {
+            std::string frame;
+            frame += static_cast<char>(0x80 | opcode);
+            unsigned char maskBit = masked ? 0x80 : 0;
+            if (len < 126)
+                frame += static_cast<char>(maskBit | len);
+            else if (len <= 0xffff)
+            {
+                frame += static_cast<char>(maskBit | 126);
+                frame += static_cast<char>(len >> 8);
+                frame += static_cast<char>(len & 0xff);
+            }
+            else
+            {
+                frame += static_cast<char>(maskBit | 127);
+                for (int shift = 56; shift >= 0; shift -= 8)
+                    frame += static_cast<char>((static_cast<uint64_t>(len) >> shift) & 0xff);
+            }
+            if (!masked)
+                return frame.append(payload, len);
+            unsigned char mask[4] = {0};
+            RAND_bytes(mask, sizeof(mask));
+            frame.append(reinterpret_cast<char *>(mask), sizeof(mask));
+            size_t start = frame.size();
+            frame.append(payload, len);
+            for (size_t i = 0; i < len; i++)
+                frame[start + i] = static_cast<char>(frame[start + i] ^ mask[i % 4]);
+            return frame;
+        }
+
+        /**
+         * @brief SecureChannel that frames the bytes of an inner channel as WebSocket messages.
+         */
+        class WebSocketChannel : public SecureChannel
+        {
+        public:
+            WebSocketChannel(std::unique_ptr<SecureChannel> inner, bool server, std::string inbound)
+                : inner_(std::move(inner)), server_(server), inbound_(std::move(inbound)) {}
+
+            ssize_t read(char *buffer, size_t len) override
+            {
+                while (payload_.empty())
+                {
+                    if (closed_)
+                        return 0;
+                    if (failed_)
+                    {
+                        errno = EPROTO;
+                        return -1;
+                    }
+                    int parsed = parseFrame();
+                    if (parsed < 0)
+                    {
+                        failed_ = true;
+                        Logger::getInstance().log(LogLevel::ERROR, "WebSocket error: malformed frame");
+                        errno = EPROTO;
+                        return -1;
+                    }
+                    if (parsed > 0)
+                        continue;
+                    char chunk[16 * 1024];
+                    ssize_t received = inner_->read(chunk, sizeof(chunk));
+                    if (received == -1)
+                        return -1;
+                    if (received == 0)
+                    {
+                        if (inbound_.empty())
+                            return 0;
+                        failed_ = true;
+                        Logger::getInstance().log(LogLevel::ERROR, "WebSocket error: connection closed inside a frame");
+                        errno = EPROTO;
+                        return -1;
+                    }
+                    inbound_.append(chunk, static_cast<size_t>(received));
+                }
+                size_t n = std::min(len, payload_.size());
+                std::memcpy(buffer, payload_.data(), n);
+                payload_.erase(0, n);
+                return static_cast<ssize_t>(n);
+            }
+
+            ssize_t write(const char *data, size_t len) override
+            {
+                if (failed_ || closed_ || closeSent_)
+                {
+                    errno = EPIPE;
+                    return -1;
+                }
+                size_t n = std::min(len, MAX_WRITE_PAYLOAD);
+                if (!sendFrame(encodeFrame(BINARY, data, n, !server_)))
+                    return -1;
+                return static_cast<ssize_t>(n);
+            }
+
+            bool hasPending() const override
+            {
+                if (!payload_.empty() || inner_->hasPending())
+                    return true;
+                size_t header = 0, length = 0;
+                return frameBounds(header, length) && inbound_.size() >= header + length;
+            }
+
+            void shutdown() override
+            {
+                if (!failed_ && !closeSent_)
+                {
+                    // Status 1000, normal closure.
+                    const char status[2] = {0x03, static_cast<char>(0xe8)};
+                    closeSent_ = sendFrame(encodeFrame(CLOSE, status, sizeof(status), !server_));
+                }
+                inner_->shutdown();
+            }
+
+            std::string remoteIdentity() const override
+            {
+                return inner_->remoteIdentity();
+            }
+
+            bool rekey() override
+            {
+                return inner_->rekey();
+            }
+
+        private:
+            std::unique_ptr<SecureChannel> inner_;
+            bool server_;
+            std::string inbound_;    ///< Received bytes not yet parsed into frames.
+            std::string payload_;    ///< Message payload bytes not yet returned by read().
+            bool failed_ = false;    ///< A frame was malformed or cut short.
+            bool closed_ = false;    ///< The remote end sent a close message.
+            bool closeSent_ = false; ///< This end sent a close message.
+
+            /// Reads the header and payload sizes of the first frame in inbound_, if its header arrived.
+            bool frameBounds(size_t &header, size_t &length) const
+            {
+                if (inbound_.size() < 2)
+                    return false;
+                auto byte = [this](size_t i)
+                { return static_cast<unsigned char>(inbound_[i]); };
+                header = 2;
+                length = byte(1) & 0x7f;
+                if (length == 126)
+                {
+                    header = 4;
+                    if (inbound_.size() < header)
+                        return false;
+                    length = (byte(2) << 8) | byte(3);
+                }
+                else if (length == 127)
+                {
+                    header = 10;
+                    if (inbound_.size() < header)
+                        return false;
+                    uint64_t value = 0;
+                    for (size_t i = 2; i < 10; i++)
+                        value = (value << 8) | byte(i);
+                    length = value > MAX_WEBSOCKET_PAYLOAD ? MAX_WEBSOCKET_PAYLOAD + 1 : static_cast<size_t>(value);
+                }
+                if (byte(1) & 0x80)
+                    header += 4;
+                return true;
+            }
+
+            /// Handles the first frame in inbound_: 1 if one was consumed, 0 if it has not fully arrived, -1 if malformed.
+            int parseFrame()
+            {
+                size_t header = 0, length = 0;
+                if (!frameBounds(header, length))
+                    return 0;
+                unsigned char first = static_cast<unsigned char>(inbound_[0]);
+                bool masked = static_cast<unsigned char>(inbound_[1]) & 0x80;
+                unsigned char opcode = first & 0x0f;
+                // Connecting ends must mask their frames and accepting ends must not; no
+                // extensions are negotiated, so the reserved bits must be clear.
+                if (masked != server_ || (first & 0x70) || length > MAX_WEBSOCKET_PAYLOAD ||
+                    (opcode >= CLOSE && (!(first & 0x80) || length > 125)))
+                    return -1;
+                if (inbound_.size() < header + length)
+                    return 0;
+                std::string payload = inbound_.substr(header, length);
+                if (masked)
+                    for (size_t i = 0; i < length; i++)
+                        payload[i] = static_cast<char>(payload[i] ^ inbound_[header - 4 + i % 4]);
+                inbound_.erase(0, header + length);
+
+                switch (opcode)
+                {
+                case CONTINUATION:
+                case TEXT:
+                case BINARY:
+                    payload_ += payload;
+                    return 1;
+                case CLOSE:
+                    if (!closeSent_)
+                        closeSent_ = sendFrame(encodeFrame(CLOSE, payload.data(), std::min<size_t>(payload.size(), 2), !server_));
+                    closed_ = true;
+                    return 1;
+                case PING:
+                    sendFrame(encodeFrame(PONG, payload.data(), payload.size(), !server_));
+                    return 1;
+                case PONG:
+                    return 1;
+                default:
+                    return -1;
+                }
+            }
+
+            /// Sends a whole frame, failing the channel if only part of it was sent.
+            bool sendFrame(const std::string &frame)
+            {
+                size_t total = 0;
+                while (total < frame.size())
+                {
+                    ssize_t sent = inner_->write(frame.data() + total, frame.size() - total);
+                    if (sent > 0)
+                    {
+                        total += static_cast<size_t>(sent);
+                        continue;
+                    }
+                    if (sent == -1 && errno == EINTR)
+                        continue;
+                    // An unsent frame can simply be sent again; a partly sent one leaves the remote
+                    // end expecting the rest.
+                    if (total > 0)
+                        failed_ = true;
+                    return false;
+                }
+                return true;
+            }
+        };
+    }
+
+    WebSocketContext::WebSocketContext(WebSocketSettings settings) : settings_(std::move(settings))
+    {
+        if (settings_.path.empty())
+            settings_.path = "/";
+        if (settings_.path[0] != '/' || settings_.path.find_first_of(" \r\n") != std::string::npos)
+            throw std::invalid_argument("Invalid WebSocket path: " + settings_.path);
+        if (settings_.host.find_first_of(" \r\n") != std::string::npos)
+            throw std::invalid_argument("Invalid WebSocket host: " + settings_.host);
+    }
+
+    bool WebSocketContext::authenticatesPeer() const
+    {
+        return settings_.inner && settings_.inner->authenticatesPeer();
+    }
+
+    std::unique_ptr<SecureChannel> WebSocketContext::handshake(int socketFd, bool server, std::chrono::milliseconds timeout, int &error) const
+    {
+        error = EPROTO;
+        auto deadline = std::chrono::steady_clock::now() + timeout;
+        std::unique_ptr<SecureChannel> inner;
+        if (settings_.inner)
+        {
+            auto remaining = std::chrono::duration_cast<std::chrono::milliseconds>(deadline - std::chrono::steady_clock::now());
+            inner = settings_.inner->handshake(socketFd, server, remaining, error);
+            if (!inner)
+                return nullptr;
+        }
+        else
+        {
+            inner = plainChannel(socketFd);
+        }
+
+        HandshakeTimeouts timeouts(socketFd, deadline);
+        std::string head, rest, reason;
+        bool ok;
+        if (server)
+        {
+            ok = readHead(*inner, timeouts, head, rest, error);
+            HttpHead request = HttpHead::parse(head);
+            std::string key = request.get("sec-websocket-key");
+            std::string target;
+            if (ok && request.startLine.compare(0, 4, "GET ") == 0)
+                target = request.startLine.substr(4, request.startLine.rfind(' ') - 4);
+            target = target.substr(0, target.find('?'));
+            std::string response;
+            if (!ok)
+                reason = "no upgrade request";
+            else if (target.empty() || !request.hasToken("upgrade", "websocket") || !request.hasToken("connection", "upgrade") ||
+                     request.get("sec-websocket-version") != "13" || key.empty())
+            {
+                response = "HTTP/1.1 400 Bad Request\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\nConnection: close\r\n\r\n";
+                reason = "not a WebSocket upgrade request";
+            }
+            else if (target != settings_.path)
+            {
+                response = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n";
+                reason = "unknown path " + target;
+            }
+            else
+            {
+                response = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+                           "Sec-WebSocket-Accept: " +
+                           acceptKey(key) + "\r\n\r\n";
+            }
+            if (!response.empty())
+            {
+                int ignored = 0;
+                bool sent = writeAll(*inner, timeouts, response, ignored);
+                if (reason.empty() && !sent)
+                {
+                    error = ignored;
+                    reason = "response not sent";
+                }
+            }
+            if (!reason.empty())
+            {
+                if (error != ETIMEDOUT)
+                    error = EPROTO;
+                ok = false;
+            }
+        }
+        else
+        {
+            std::string nonce(16, '\0');
+            RAND_bytes(reinterpret_cast<unsigned char *>(&nonce[0]), static_cast<int>(nonce.size()));
+            std::string key = base64(nonce);
+            std::string host = settings_.host.empty() ? peerHost(socketFd) : settings_.host;
+            std::string request = "GET " + settings_.path + " HTTP/1.1\r\nHost: " + host +
+                                  "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key +
+                                  "\r\nSec-WebSocket-Version: 13\r\n\r\n";
+            ok = writeAll(*inner, timeouts, request, error) && readHead(*inner, timeouts, head, rest, error);
+            HttpHead response = HttpHead::parse(head);
+            if (ok && response.startLine.compare(0, 13, "HTTP/1.1 101 ") != 0 && response.startLine != "HTTP/1.1 101")
+                reason = "server answered " + response.startLine;
+            else if (ok && response.get("sec-websocket-accept") != acceptKey(key))
+                reason = "server sent the wrong Sec-WebSocket-Accept";
+            if (!reason.empty())
+            {
+                error = EPROTO;
+                ok = false;
+            }
+        }
+
+        if (!ok)
+        {
+            if (error == ETIMEDOUT)
+                Logger::getInstance().log(LogLevel::ERROR, "WebSocket handshake timed out");
+            else
+                Logger::getInstance().log(LogLevel::ERROR, "WebSocket handshake failed" + (reason.empty() ? "" : ": " + reason));
+            return nullptr;
+        }
+        error = 0;
+        return std::make_unique<WebSocketChannel>(std::move(inner), server, std::move(rest));
+    }
+
+} // namespace relay
@@ -0,0 +1,390 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// StreamWindow is how many bytes of messages a stream's sender may have
+// outstanding before the application on the other end reads them. It is
+// what keeps one slow stream from holding up the others on the connection.
+const StreamWindow = 256 << 10
+
+// streamPollInterval bounds how long the stream reader waits for incoming
+// data before checking whether it should stop.
+const streamPollInterval = 100 * time.Millisecond
+
+// Stream is one of many ordered message streams multiplexed over a single
+// peer connection, each with its own flow control. Open one with
+// Peer.OpenStream on a client peer and accept it with Peer.AcceptStream on
+// the server. A Stream is safe for concurrent use.
+type Stream struct {
+	id   uint32
+	name string
+	peer *Peer
+	mux  *muxer
+	cond sync.Cond // Uses mux.mu
+
+	incoming  []string // Messages received and not yet read
+	window    int      // Bytes this end may still send
+	consumed  int      // Bytes read since the last window update
+	sentClose bool
+	recvClose bool
+	err       error // Set once the stream's connection is lost
+}
+
+// muxer tracks a peer's streams. While any stream is open, or once
+// AcceptStream has been called, a goroutine reads stream frames off the
+// connection and hands them to their streams.
+type muxer struct {
+	mu        sync.Mutex
+	cond      sync.Cond // Signals accepted streams and the reader stopping
+	streams   map[uint32]*Stream
+	accepted  []*Stream // Opened by the remote end, waiting for AcceptStream
+	accepting bool      // AcceptStream has been called
+	running   bool
+	closed    bool
+	done      chan struct{}
+}
+
+// OpenStream opens a new stream over the peer connection. Opening a stream
+// costs one frame, not a connection, and messages on different streams
+// never wait for each other: each stream may have up to StreamWindow bytes
+// in flight. Only client peers open streams; the server end receives them
+// from AcceptStream. It returns ErrPeerDisconnected if the connection is
+// closed and ErrStreamOpenFailed otherwise. Streams do not survive a
+// reconnect; their Send and Receive return ErrPeerDisconnected.
+func (p *Peer) OpenStream() (*Stream, error) {
+	return p.OpenNamedStream("")
+}
+
+// OpenNamedStream opens a stream like OpenStream, with a name that the
+// server end reads from Stream.Name to tell what the stream carries, for
+// example "control" beside a "bulk" transfer. Names need not be unique.
+func (p *Peer) OpenNamedStream(name string) (*Stream, error) {
+	var cName *C.char
+	if len(name) > 0 {
+		cName = C.CString(name)
+		defer C.free(unsafe.Pointer(cName))
+	}
+	if !p.enter() {
+		return nil, ErrPeerDisconnected
+	}
+	defer p.leave()
+	m := &p.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrPeerDisconnected
+	}
+	// Registered before the reader can see a reply, which waits for mu.
+	id := C.relay_open_named_stream(p.ptr, cName, C.size_t(len(name)))
+	if id == 0 {
+		if !p.IsConnected() {
+			return nil, ErrPeerDisconnected
+		}
+		return nil, ErrStreamOpenFailed
+	}
+	s := m.addLocked(p, uint32(id), name)
+	m.startLocked(p)
+	return s, nil
+}
+
+// AcceptStream waits for a client to open a stream with OpenStream and
+// returns it. It returns ctx's error if ctx ends first and
+// ErrPeerDisconnected once the peer is closed.
+func (p *Peer) AcceptStream(ctx context.Context) (*Stream, error) {
+	m := &p.mux
+	stop := context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.cond.Broadcast()
+	})
+	defer stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accepting = true
+	m.startLocked(p)
+	for len(m.accepted) == 0 && m.running && ctx.Err() == nil {
+		m.cond.Wait()
+	}
+	if len(m.accepted) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrPeerDisconnected
+	}
+	s := m.accepted[0]
+	m.accepted[0] = nil
+	m.accepted = m.accepted[1:]
+	return s, nil
+}
+
+// ID returns the stream's ID, unique among the peer's open streams.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Name returns the name the stream was opened with, empty for one opened
+// with OpenStream or by a peer running an older version of the library.
+func (s *Stream) Name() string {
+	return s.name
+}
+
+// Send sends a message on the stream. It blocks while the other end has not
+// read enough of the messages already sent to leave room for this one; a
+// message larger than StreamWindow waits until nothing is outstanding. It
+// returns ErrStreamClosed after Close and ErrPeerDisconnected once the
+// connection is lost.
+func (s *Stream) Send(message string) error {
+	m := s.mux
+	m.mu.Lock()
+	for s.err == nil && !s.sentClose && s.window < min(len(message), StreamWindow) {
+		s.cond.Wait()
+	}
+	if err := s.sendErrLocked(); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	s.window -= len(message)
+	m.mu.Unlock()
+
+	if err := s.peer.sendStreamFrame(s.id, C.RELAY_STREAM_DATA, message); err != nil {
+		m.mu.Lock()
+		s.window += len(message)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// sendErrLocked returns why the stream cannot send, or nil if it can.
+// Caller must hold s.mux.mu.
+func (s *Stream) sendErrLocked() error {
+	switch {
+	case s.err != nil:
+		return s.err
+	case s.sentClose:
+		return ErrStreamClosed
+	default:
+		return nil
+	}
+}
+
+// Receive returns the next message on the stream, waiting for one to
+// arrive. It returns io.EOF once the other end has closed the stream and
+// every message it sent has been read, and ErrPeerDisconnected if the
+// connection is lost.
+func (s *Stream) Receive() (string, error) {
+	m := s.mux
+	m.mu.Lock()
+	for len(s.incoming) == 0 && !s.recvClose && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.incoming) == 0 {
+		defer m.mu.Unlock()
+		if s.err != nil {
+			return "", s.err
+		}
+		return "", io.EOF
+	}
+	message := s.incoming[0]
+	s.incoming[0] = ""
+	s.incoming = s.incoming[1:]
+	s.consumed += len(message)
+	grant := 0
+	if s.consumed >= StreamWindow/2 && !s.recvClose {
+		grant, s.consumed = s.consumed, 0
+	}
+	m.mu.Unlock()
+
+	if grant > 0 {
+		var credit [4]byte
+		binary.BigEndian.PutUint32(credit[:], uint32(grant))
+		// A lost connection shows up as ErrPeerDisconnected on the next call.
+		s.peer.sendStreamFrame(s.id, C.RELAY_STREAM_WINDOW, string(credit[:]))
+	}
+	return message, nil
+}
+
+// Close closes the sending side of the stream: the other end reads the
+// messages already sent and then io.EOF. Receive keeps working until the
+// other end closes too. Closing a closed stream returns ErrStreamClosed.
+func (s *Stream) Close() error {
+	m := s.mux
+	m.mu.Lock()
+	if err := s.sendErrLocked(); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	s.sentClose = true
+	s.cond.Broadcast()
+	m.mu.Unlock()
+
+	err := s.peer.sendStreamFrame(s.id, C.RELAY_STREAM_CLOSE, "")
+	m.mu.Lock()
+	if err != nil {
+		s.err = err
+	}
+	m.releaseLocked(s)
+	m.mu.Unlock()
+	return err
+}
+
+// sendStreamFrame sends a frame of the given kind on stream id.
+func (p *Peer) sendStreamFrame(id uint32, kind C.int, data string) error {
+	p.throttle(rateSend, 1, len(data))
+	var cData *C.char
+	if len(data) > 0 {
+		cData = C.CString(data)
+		defer C.free(unsafe.Pointer(cData))
+	}
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	start := cgoStart()
+	status := C.relay_send_stream_frame(p.ptr, C.uint32_t(id), kind, cData, C.size_t(len(data)))
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// addLocked registers a new stream. Caller must hold m.mu.
+func (m *muxer) addLocked(p *Peer, id uint32, name string) *Stream {
+	if m.streams == nil {
+		m.streams = make(map[uint32]*Stream)
+	}
+	s := &Stream{id: id, name: name, peer: p, mux: m, window: StreamWindow}
+	s.cond.L = &m.mu
+	m.streams[id] = s
+	return s
+}
+
+// releaseLocked forgets s once both ends have closed it or its connection
+// is lost. Caller must hold m.mu.
+func (m *muxer) releaseLocked(s *Stream) {
+	if (s.sentClose && s.recvClose) || s.err != nil {
+		delete(m.streams, s.id)
+	}
+}
+
+// startLocked runs the reader if it is not already running. Caller must
+// hold m.mu.
+func (m *muxer) startLocked(p *Peer) {
+	if m.cond.L == nil {
+		m.cond.L = &m.mu
+	}
+	if m.running || m.closed {
+		return
+	}
+	m.running = true
+	m.done = make(chan struct{})
+	spawn(func() { m.run(p) })
+}
+
+// run reads stream frames until no stream is open and nobody is accepting,
+// the connection is lost, or the muxer is closed.
+func (m *muxer) run(p *Peer) {
+	defer close(m.done)
+	for {
+		m.mu.Lock()
+		if m.closed || (len(m.streams) == 0 && !m.accepting) {
+			m.stopLocked(nil)
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		var id C.uint32_t
+		var kind C.int
+		var data *C.char
+		var n C.size_t
+		status := C.int(C.RELAY_ERR_DISCONNECTED)
+		if p.enter() {
+			status = C.relay_receive_stream_frame(p.ptr, C.int64_t(streamPollInterval.Milliseconds()), &id, &kind, &data, &n)
+			p.leave()
+		}
+		if status == C.RELAY_ERR_DISCONNECTED {
+			m.mu.Lock()
+			m.stopLocked(ErrPeerDisconnected)
+			m.mu.Unlock()
+			return
+		}
+		if status != C.RELAY_OK {
+			continue
+		}
+		payload := C.GoStringN(data, C.int(n))
+		C.free(unsafe.Pointer(data))
+		p.throttle(rateReceive, 1, len(payload))
+		m.mu.Lock()
+		m.dispatchLocked(p, uint32(id), kind, payload)
+		m.mu.Unlock()
+	}
+}
+
+// dispatchLocked applies a stream frame to its stream. Caller must hold
+// m.mu.
+func (m *muxer) dispatchLocked(p *Peer, id uint32, kind C.int, data string) {
+	if kind == C.RELAY_STREAM_OPEN {
+		m.accepted = append(m.accepted, m.addLocked(p, id, data))
+		m.cond.Broadcast()
+		return
+	}
+	s, ok := m.streams[id]
+	if !ok {
+		return
+	}
+	switch kind {
+	case C.RELAY_STREAM_DATA:
+		s.incoming = append(s.incoming, data)
+	case C.RELAY_STREAM_WINDOW:
+		if len(data) == 4 {
+			s.window += int(binary.BigEndian.Uint32([]byte(data)))
+		}
+	case C.RELAY_STREAM_CLOSE:
+		s.recvClose = true
+	case C.RELAY_STREAM_RESET:
+		s.err = ErrPeerDisconnected
+	}
+	m.releaseLocked(s)
+	s.cond.Broadcast()
+}
+
+// stopLocked marks the reader stopped, failing every open stream with err
+// if it is not nil. Caller must hold m.mu.
+func (m *muxer) stopLocked(err error) {
+	m.running = false
+	if err != nil {
+		for id, s := range m.streams {
+			s.err = err
+			s.cond.Broadcast()
+			delete(m.streams, id)
+		}
+	}
+	m.cond.Broadcast()
+}
+
+// close fails every open stream with ErrPeerDisconnected and waits for the
+// reader to stop.
+func (m *muxer) close() {
+	m.mu.Lock()
+	m.closed = true
+	running, done := m.running, m.done
+	m.mu.Unlock()
+	if running {
+		<-done
+	}
+	m.mu.Lock()
+	m.stopLocked(ErrPeerDisconnected)
+	m.mu.Unlock()
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	server, client := newPair(t)
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if err := s.Send("ping"); err != nil {
+		t.Fatalf("Stream.Send: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted, err := server.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if accepted.ID() != s.ID() {
+		t.Fatalf("accepted stream %d, want %d", accepted.ID(), s.ID())
+	}
+	if got, err := accepted.Receive(); err != nil || got != "ping" {
+		t.Fatalf("Receive = %q, %v, want %q", got, err, "ping")
+	}
+	if err := accepted.Send("pong"); err != nil {
+		t.Fatalf("Stream.Send: %v", err)
+	}
+	if got, err := s.Receive(); err != nil || got != "pong" {
+		t.Fatalf("Receive = %q, %v, want %q", got, err, "pong")
+	}
+
+	// Ordinary messages do not mix with stream data.
+	if err := client.Send("plain"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != "plain" {
+		t.Fatalf("got %q, want %q", got, "plain")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := accepted.Receive(); err != io.EOF {
+		t.Fatalf("Receive after the stream closed: %v, want io.EOF", err)
+	}
+}
+
+func TestNamedStreamsInterleave(t *testing.T) {
+	server, client := newPair(t)
+	a, err := client.OpenNamedStream("a")
+	if err != nil {
+		t.Fatalf("OpenNamedStream: %v", err)
+	}
+	b, err := client.OpenNamedStream("b")
+	if err != nil {
+		t.Fatalf("OpenNamedStream: %v", err)
+	}
+	for i := range 3 {
+		a.Send("a" + string(rune('0'+i)))
+		b.Send("b" + string(rune('0'+i)))
+	}
+	a.Close()
+	b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 2 {
+		s, err := server.AcceptStream(ctx)
+		if err != nil {
+			t.Fatalf("AcceptStream: %v", err)
+		}
+		for i := range 3 {
+			want := s.Name() + string(rune('0'+i))
+			if got, err := s.Receive(); err != nil || got != want {
+				t.Fatalf("stream %s: Receive = %q, %v, want %q", s.Name(), got, err, want)
+			}
+		}
+		if _, err := s.Receive(); err != io.EOF {
+			t.Fatalf("stream %s: Receive after close: %v, want io.EOF", s.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+
+extern int relayGoVerifyPeer(uintptr_t context, char **certificates, size_t *lens, int count);
+*/
+import "C"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"runtime/cgo"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// WithTLS runs TLS on every connection of the peer: a client peer's
+// connection to its server, and every client a server peer accepts. The
+// handshake is done by the C library, so only these fields of cfg are used:
+//
+//   - Certificates: the first entry is the peer's own certificate chain and
+//     key. A server peer needs one; a client peer presents it when the
+//     server asks (mutual TLS).
+//   - RootCAs, ServerName and InsecureSkipVerify: how a client peer checks
+//     the server's certificate. An empty ServerName checks it against the
+//     peer's IP address.
+//   - ClientAuth and ClientCAs: whether a server peer asks for client
+//     certificates and which ones it trusts.
+//   - MinVersion, MaxVersion, Time and VerifyPeerCertificate, as for
+//     crypto/tls.
+//
+// A client peer whose handshake fails is not created, and OpenPeer returns
+// ErrHandshakeFailed, or ErrTimeout if it took too long (see
+// WithConnectTimeout). A server peer closes clients whose handshake fails
+// and keeps accepting. With TLS 1.3 a client peer only learns that the
+// server rejected its certificate once it reads, which then reports
+// ErrPeerDisconnected. It only takes effect when the peer is created.
+func WithTLS(cfg *tls.Config) PeerOption {
+	return func(c *peerConfig) { c.tls = cfg }
+}
+
+// Authenticated reports whether the peer's connections prove who the remote
+// end is: a client peer verifies the server's certificate (or
+// VerifyPeerCertificate checks it), and a server peer requires and verifies
+// a certificate from every client (ClientAuth RequireAndVerifyClientCert,
+// or RequireAnyClientCert with VerifyPeerCertificate). A peer using Noise
+// is authenticated if WithNoisePeerKeys pins the keys it accepts, and one
+// using WithAuthToken or WithPSK always is. Other peers are never
+// authenticated.
+func (p *Peer) Authenticated() bool {
+	if !p.enter() {
+		return false
+	}
+	defer p.leave()
+	return C.relay_is_peer_authenticated(p.ptr) == 1
+}
+
+// RotateKeys replaces the session keys of the peer's encrypted connections
+// without closing them, for example to cap how long one key is used. A TLS
+// 1.3 connection sends a KeyUpdate; a Noise connection rekeys as in section
+// 11.3 of the Noise specification and marks the switch in the stream. Both
+// directions get new keys, since the remote end rotates its own when it
+// reads the request, and messages in flight either way are neither lost
+// nor corrupted. A server peer rotates the connection of every client. It
+// returns ErrNotEncrypted if a connection has no keys to rotate, as with
+// TLS 1.2 or no encryption at all, ErrPeerDisconnected if no connection is
+// open, and ErrSendFailed if the request could not be sent. With Noise the
+// remote end must be running this version of the library.
+func (p *Peer) RotateKeys() error {
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	return statusError(C.relay_rotate_keys(p.ptr), ErrSendFailed)
+}
+
+// RequireAuthenticatedRelays makes the manager refuse to relay or broadcast
+// messages from managed peers that are not Authenticated, or stop refusing
+// them. Relay then returns ErrUnauthenticated and BroadcastFrom delivers
+// nothing. Broadcasts from the manager itself are not affected.
+func (m *PeerManager) RequireAuthenticatedRelays(required bool) {
+	value := 0
+	if required {
+		value = 1
+	}
+	if !m.enter() {
+		return
+	}
+	defer m.leave()
+	C.relay_set_require_authenticated_relays(m.ptr, C.int(value))
+}
+
+// tlsVerifier checks the certificates presented during a peer's TLS
+// handshakes, as crypto/tls would for cfg.
+type tlsVerifier struct {
+	cfg    *tls.Config
+	server bool
+	handle cgo.Handle
+
+	mu   sync.Mutex
+	host string // Checked against the server's certificate if cfg.ServerName is empty
+	err  error  // Why the last chain was rejected
+}
+
+// newTLSVerifier returns a verifier for a peer created with cfg.
+func newTLSVerifier(cfg *tls.Config, server bool, host string) *tlsVerifier {
+	v := &tlsVerifier{cfg: cfg, server: server, host: host}
+	v.handle = cgo.NewHandle(v)
+	return v
+}
+
+// authenticated reports whether a successful handshake proves who the
+// remote end is.
+func (v *tlsVerifier) authenticated() bool {
+	if v.server {
+		return v.cfg.ClientAuth == tls.RequireAndVerifyClientCert ||
+			(v.cfg.ClientAuth == tls.RequireAnyClientCert && v.cfg.VerifyPeerCertificate != nil)
+	}
+	return !v.cfg.InsecureSkipVerify || v.cfg.VerifyPeerCertificate != nil
+}
+
+// setHost changes the name the server's certificate is checked against
+// when cfg.ServerName is empty, for a peer moved to a new address.
+func (v *tlsVerifier) setHost(host string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.host = host
+}
+
+// lastError returns why the last chain was rejected, or nil.
+func (v *tlsVerifier) lastError() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+// verify checks a chain, DER-encoded and leaf first.
+func (v *tlsVerifier) verify(raw [][]byte) error {
+	cfg := v.cfg
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{Intermediates: x509.NewCertPool(), CurrentTime: time.Now()}
+	if cfg.Time != nil {
+		opts.CurrentTime = cfg.Time()
+	}
+	for _, cert := range certs[min(1, len(certs)):] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	var chains [][]*x509.Certificate
+	var err error
+	if v.server {
+		required := cfg.ClientAuth == tls.RequireAnyClientCert || cfg.ClientAuth == tls.RequireAndVerifyClientCert
+		if required && len(certs) == 0 {
+			return errors.New("client presented no certificate")
+		}
+		if len(certs) > 0 && (cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert) {
+			opts.Roots = cfg.ClientCAs
+			opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+			chains, err = certs[0].Verify(opts)
+		}
+	} else {
+		if len(certs) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		if !cfg.InsecureSkipVerify {
+			opts.Roots = cfg.RootCAs
+			opts.DNSName = cfg.ServerName
+			if opts.DNSName == "" {
+				v.mu.Lock()
+				opts.DNSName = v.host
+				v.mu.Unlock()
+			}
+			chains, err = certs[0].Verify(opts)
+		}
+	}
+	if err == nil && cfg.VerifyPeerCertificate != nil {
+		err = cfg.VerifyPeerCertificate(raw, chains)
+	}
+	return err
+}
+
+//export relayGoVerifyPeer
+func relayGoVerifyPeer(context C.uintptr_t, certificates **C.char, lens *C.size_t, count C.int) C.int {
+	v, ok := cgo.Handle(context).Value().(*tlsVerifier)
+	if !ok {
+		return 0
+	}
+	raw := make([][]byte, int(count))
+	if count > 0 {
+		data := unsafe.Slice(certificates, int(count))
+		sizes := unsafe.Slice(lens, int(count))
+		for i := range raw {
+			raw[i] = C.GoBytes(unsafe.Pointer(data[i]), C.int(sizes[i]))
+		}
+	}
+	err := v.verify(raw)
+	v.mu.Lock()
+	v.err = err
+	v.mu.Unlock()
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// newCTLSOptions converts cfg for the C library, allocating in mem.
+func newCTLSOptions(cfg *tls.Config, v *tlsVerifier, mem *cMemory) (*C.RelayTlsOptions, error) {
+	opts := (*C.RelayTlsOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayTlsOptions{}))))
+	*opts = C.RelayTlsOptions{}
+	if len(cfg.Certificates) > 0 {
+		cert := cfg.Certificates[0]
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConfigureFailed, err)
+		}
+		n := len(cert.Certificate)
+		certs := unsafe.Slice((**C.char)(mem.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof((*C.char)(nil))))), n)
+		lens := unsafe.Slice((*C.size_t)(mem.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof(C.size_t(0))))), n)
+		for i, der := range cert.Certificate {
+			certs[i] = (*C.char)(mem.bytes(der))
+			lens[i] = C.size_t(len(der))
+		}
+		opts.certificates = &certs[0]
+		opts.certificateLens = &lens[0]
+		opts.certificateCount = C.int(n)
+		opts.privateKey = (*C.char)(mem.bytes(key))
+		opts.privateKeyLen = C.size_t(len(key))
+	} else if v.server {
+		return nil, fmt.Errorf("%w: a TLS server peer needs a certificate", ErrConfigureFailed)
+	}
+	if cfg.ServerName != "" {
+		opts.serverName = (*C.char)(mem.bytes(append([]byte(cfg.ServerName), 0)))
+	}
+	switch cfg.ClientAuth {
+	case tls.RequestClientCert, tls.VerifyClientCertIfGiven:
+		opts.clientAuth = 1
+	case tls.RequireAnyClientCert, tls.RequireAndVerifyClientCert:
+		opts.clientAuth = 2
+	}
+	opts.minVersion = C.int(cfg.MinVersion)
+	opts.maxVersion = C.int(cfg.MaxVersion)
+	if v.authenticated() {
+		opts.authenticated = 1
+	}
+	opts.verify = C.RelayVerifyCallback(C.relayGoVerifyPeer)
+	opts.verifyContext = C.uintptr_t(v.handle)
+	return opts, nil
+}
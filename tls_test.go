@@ -0,0 +1,197 @@
+package relay
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for 127.0.0.1 signed by its own key.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// exchange sends count messages each way between a server and its client,
+// whose connection on the server is conn, and checks they arrive intact and
+// in order.
+func exchange(t *testing.T, server, client *Peer, conn *Client, count int) {
+	t.Helper()
+	for i := range count {
+		if err := client.Send("up " + strconv.Itoa(i)); err != nil {
+			t.Fatalf("client Send: %v", err)
+		}
+		if err := conn.Send("down " + strconv.Itoa(i)); err != nil {
+			t.Fatalf("server Send: %v", err)
+		}
+	}
+	for i := range count {
+		if got, want := receive(t, server), "up "+strconv.Itoa(i); got != want {
+			t.Fatalf("server got %q, want %q", got, want)
+		}
+		if got, want := receive(t, client), "down "+strconv.Itoa(i); got != want {
+			t.Fatalf("client got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRotateKeysTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	server, client, conn := openPair(t,
+		[]PeerOption{WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})},
+		[]PeerOption{WithTLS(&tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})})
+
+	exchange(t, server, client, conn, 3)
+	if err := client.RotateKeys(); err != nil {
+		t.Fatalf("client RotateKeys: %v", err)
+	}
+	exchange(t, server, client, conn, 3)
+	if err := server.RotateKeys(); err != nil {
+		t.Fatalf("server RotateKeys: %v", err)
+	}
+	exchange(t, server, client, conn, 3)
+}
+
+func TestRotateKeysNoise(t *testing.T) {
+	serverKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	server, client, conn := openPair(t,
+		[]PeerOption{WithNoiseKey(serverKey)},
+		[]PeerOption{WithNoiseKey(clientKey), WithNoisePeerKeys(serverKey.PublicKey())})
+
+	exchange(t, server, client, conn, 3)
+	// Rotate with messages in flight in both directions.
+	if err := client.Send("before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RotateKeys(); err != nil {
+		t.Fatalf("client RotateKeys: %v", err)
+	}
+	if err := client.Send("after"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, server); got != "before" {
+		t.Fatalf("got %q, want %q", got, "before")
+	}
+	if got := receive(t, server); got != "after" {
+		t.Fatalf("got %q, want %q", got, "after")
+	}
+	exchange(t, server, client, conn, 3)
+	if err := server.RotateKeys(); err != nil {
+		t.Fatalf("server RotateKeys: %v", err)
+	}
+	if err := client.RotateKeys(); err != nil {
+		t.Fatalf("client RotateKeys: %v", err)
+	}
+	exchange(t, server, client, conn, 3)
+}
+
+func TestRotateKeysUnencrypted(t *testing.T) {
+	_, client := newPair(t)
+	if err := client.RotateKeys(); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("RotateKeys = %v, want %v", err, ErrNotEncrypted)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCert, clientCert := selfSignedCert(t), selfSignedCert(t)
+	clientCAs := x509.NewCertPool()
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs.AddCert(leaf)
+	serverTLS := WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS13,
+	})
+	server, client, conn := openPair(t,
+		[]PeerOption{serverTLS},
+		[]PeerOption{WithTLS(&tls.Config{Certificates: []tls.Certificate{clientCert}, InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})})
+	if !server.Authenticated() {
+		t.Fatal("server requiring client certificates is not Authenticated")
+	}
+	if client.Authenticated() {
+		t.Fatal("client skipping verification is Authenticated")
+	}
+	exchange(t, server, client, conn, 1)
+
+	// A client without a certificate is turned away once it reads.
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	go server.Accept()
+	anonymous, err := OpenPeer("anonymous", "127.0.0.1", port, 0,
+		WithTLS(&tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}))
+	if err != nil {
+		return
+	}
+	t.Cleanup(anonymous.Destroy)
+	if _, err := anonymous.Receive(); !errors.Is(err, ErrPeerDisconnected) {
+		t.Fatalf("Receive on a client without a certificate: %v, want ErrPeerDisconnected", err)
+	}
+}
+
+func TestRequireAuthenticatedRelays(t *testing.T) {
+	_, a := newPairIDs(t, "a-server", "a")
+	_, b := newPairIDs(t, "b-server", "b")
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(a)
+	m.AddPeer(b)
+	m.RequireAuthenticatedRelays(true)
+	if err := m.Relay("a", "b", "hello"); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Relay from an unauthenticated peer: %v, want ErrUnauthenticated", err)
+	}
+	m.RequireAuthenticatedRelays(false)
+	if err := m.Relay("a", "b", "hello"); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+}
+
+func TestNoisePinnedKey(t *testing.T) {
+	serverKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	otherKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	server, client, conn := openPair(t,
+		[]PeerOption{WithNoiseKey(serverKey)},
+		[]PeerOption{WithNoiseKey(clientKey), WithNoisePeerKeys(serverKey.PublicKey())})
+	if !client.Authenticated() || !client.RemoteStaticKey().Equal(serverKey.PublicKey()) {
+		t.Fatal("pinned client did not authenticate the server's key")
+	}
+	if !conn.RemoteStaticKey().Equal(clientKey.PublicKey()) {
+		t.Fatal("server did not learn the client's static key")
+	}
+	exchange(t, server, client, conn, 1)
+
+	go server.Accept()
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	_, err := OpenPeer("pinned-elsewhere", "127.0.0.1", port, 0,
+		WithNoiseKey(clientKey), WithNoisePeerKeys(otherKey.PublicKey()))
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("OpenPeer pinning another key: %v, want ErrHandshakeFailed", err)
+	}
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"io"
+)
+
+// transferChunk is the size of the messages SendStream sends.
+const transferChunk = 64 << 10
+
+// SendStream sends everything read from r, up to io.EOF, to the server as
+// one transfer, which the server reads with ReceiveStream. The data goes
+// in messages of up to 64 KiB over a stream of its own (see OpenStream), so
+// at most StreamWindow bytes are in flight and neither end holds the whole
+// payload in memory, however large, while ordinary messages keep flowing
+// beside it. Like OpenStream it is only for client peers.
+//
+// If reading r fails, SendStream stops and returns that error, and the
+// receiver's reader returns ErrStreamAborted instead of io.EOF. Errors
+// sending are reported as for Stream.Send.
+func (p *Peer) SendStream(r io.Reader) error {
+	return p.sendStream(r, nil)
+}
+
+// SendStreamProgress is like SendStream but also passes fn the progress of
+// the transfer as it goes, at most every 250ms and once more when it ends,
+// on the calling goroutine. The total is known if r has a Len method, as
+// bytes.Reader, strings.Reader and bytes.Buffer do, and -1 otherwise.
+func (p *Peer) SendStreamProgress(r io.Reader, fn func(Progress)) error {
+	total := int64(-1)
+	if l, ok := r.(interface{ Len() int }); ok {
+		total = int64(l.Len())
+	}
+	meter := newProgressMeter(0, total, fn)
+	defer meter.finish()
+	return p.sendStream(r, meter)
+}
+
+// sendStream sends r as SendStream does, counting the bytes sent with
+// meter if it is not nil.
+func (p *Peer) sendStream(r io.Reader, meter *progressMeter) error {
+	s, err := p.OpenStream()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, transferChunk)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := s.Send(string(buf[:n])); err != nil {
+				return err
+			}
+			if meter != nil {
+				meter.add(n)
+			}
+		}
+		switch {
+		case readErr == io.EOF:
+			return s.Close()
+		case readErr != nil:
+			// Data messages are never empty; an empty one marks the
+			// transfer incomplete.
+			if s.Send("") == nil {
+				s.Close()
+			}
+			return readErr
+		}
+	}
+}
+
+// ReceiveStream waits for a client to start a transfer with SendStream and
+// returns a reader of its data, which returns io.EOF once all of it is
+// read. It takes the next stream a client opens, so do not mix it with
+// AcceptStream on the same peer. Closing the reader before the end
+// discards the rest of the transfer. It returns ErrPeerDisconnected once
+// the peer is closed.
+func (p *Peer) ReceiveStream() (io.ReadCloser, error) {
+	s, err := p.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &transferReader{stream: s}, nil
+}
+
+// transferReader reads the data of one SendStream transfer.
+type transferReader struct {
+	stream  *Stream
+	pending string // Rest of the last message received, not read yet
+	err     error  // Returned once pending is read
+}
+
+func (r *transferReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		message, err := r.stream.Receive()
+		switch {
+		case err != nil:
+			r.err = err
+		case message == "":
+			r.err = ErrStreamAborted
+		default:
+			r.pending = message
+		}
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Close closes the stream and, if the transfer has not ended, keeps
+// reading it in the background so the sender is not left waiting for
+// window. Later reads return ErrStreamClosed.
+func (r *transferReader) Close() error {
+	if r.err == ErrStreamClosed {
+		return ErrStreamClosed
+	}
+	done := r.err != nil
+	r.err, r.pending = ErrStreamClosed, ""
+	s := r.stream
+	s.Close()
+	if !done {
+		drainStream(s)
+	}
+	return nil
+}
+
+// drainStream reads and discards the rest of s in the background, so the
+// other end is not left waiting for window.
+func drainStream(s *Stream) {
+	spawn(func() {
+		for {
+			if _, err := s.Receive(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSendStream(t *testing.T) {
+	server, client := newPair(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1 MiB
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendStream(bytes.NewReader(data)) }()
+
+	r, err := server.ReceiveStream()
+	if err != nil {
+		t.Fatalf("ReceiveStream: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading the transfer: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want the %d sent", len(got), len(data))
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	r.Close()
+}
+
+// failingReader returns some data and then an error.
+type failingReader struct{ sent bool }
+
+var errSource = errors.New("source failed")
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.sent {
+		return 0, errSource
+	}
+	r.sent = true
+	return copy(b, "partial"), nil
+}
+
+func TestSendStreamAborted(t *testing.T) {
+	server, client := newPair(t)
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendStream(&failingReader{}) }()
+
+	r, err := server.ReceiveStream()
+	if err != nil {
+		t.Fatalf("ReceiveStream: %v", err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrStreamAborted) {
+		t.Fatalf("reading an aborted transfer: %v, want ErrStreamAborted", err)
+	}
+	if err := <-sent; err != errSource {
+		t.Fatalf("SendStream = %v, want the reader's error", err)
+	}
+}
+
+func TestSendStreamProgress(t *testing.T) {
+	server, client := newPair(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1 MiB
+	var last Progress
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.SendStreamProgress(bytes.NewReader(data), func(p Progress) { last = p })
+	}()
+
+	r, err := server.ReceiveStream()
+	if err != nil {
+		t.Fatalf("ReceiveStream: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading the transfer: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want the %d sent", len(got), len(data))
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStreamProgress: %v", err)
+	}
+	if !last.Done || last.Bytes != int64(len(data)) || last.Total != int64(len(data)) {
+		t.Fatalf("last progress = %+v, want Done with all %d bytes", last, len(data))
+	}
+	r.Close()
+}
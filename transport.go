@@ -0,0 +1,238 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Transport carries the connections of peers opened on addresses of a
+// scheme registered with RegisterTransport, for links the library does not
+// know, such as Tor, serial lines or radio modems. A client peer opened on
+// "scheme://..." gets its connection from Dial, and a server peer's clients
+// are the connections its listener from Listen accepts. Both receive the
+// whole address, scheme included. The peer's frames, security options and
+// messages then run over those connections as they would over TCP. A
+// Transport must be safe for concurrent use.
+type Transport interface {
+	// Dial connects to address, giving up with ctx's error once ctx is
+	// done (see WithConnectTimeout).
+	Dial(ctx context.Context, address string) (net.Conn, error)
+
+	// Listen starts accepting connections at address. The listener is
+	// closed when the server peer is closed.
+	Listen(address string) (net.Listener, error)
+
+	// Close releases the transport when it is unregistered. Peers already
+	// open on it keep their connections.
+	Close() error
+}
+
+// builtinSchemes are the address schemes the library carries itself.
+var builtinSchemes = map[string]bool{"tcp": true, "udp": true, "unix": true, "mem": true, "ws": true, "wss": true}
+
+// transports holds the transports registered with RegisterTransport.
+var transports struct {
+	mu       sync.RWMutex
+	byScheme map[string]Transport
+}
+
+// transportListeners numbers the in-process listeners behind server peers
+// on a registered transport.
+var transportListeners atomic.Uint64
+
+// RegisterTransport makes t carry the peers opened on addresses that start
+// with scheme followed by "://", as in RegisterTransport("serial", t) for
+// "serial:///dev/ttyUSB0". It returns ErrConfigureFailed if scheme is not
+// a valid URL scheme, is one the library carries itself (tcp, udp, unix,
+// mem, ws, wss) or is already registered.
+func RegisterTransport(scheme string, t Transport) error {
+	if !validScheme(scheme) || t == nil {
+		return fmt.Errorf("%w: invalid transport scheme %q", ErrConfigureFailed, scheme)
+	}
+	scheme = strings.ToLower(scheme)
+	if builtinSchemes[scheme] {
+		return fmt.Errorf("%w: transport scheme %q is built in", ErrConfigureFailed, scheme)
+	}
+	transports.mu.Lock()
+	defer transports.mu.Unlock()
+	if _, ok := transports.byScheme[scheme]; ok {
+		return fmt.Errorf("%w: transport scheme %q is already registered", ErrConfigureFailed, scheme)
+	}
+	if transports.byScheme == nil {
+		transports.byScheme = make(map[string]Transport)
+	}
+	transports.byScheme[scheme] = t
+	return nil
+}
+
+// UnregisterTransport removes the transport registered for scheme and
+// closes it, returning its Close error. Peers can no longer be opened on
+// the scheme; those already open keep their connections. It does nothing
+// if no transport is registered for scheme.
+func UnregisterTransport(scheme string) error {
+	transports.mu.Lock()
+	t, ok := transports.byScheme[strings.ToLower(scheme)]
+	delete(transports.byScheme, strings.ToLower(scheme))
+	transports.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.Close()
+}
+
+// validScheme reports whether scheme is a URL scheme as RFC 3986 defines it.
+func validScheme(scheme string) bool {
+	for i, r := range scheme {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || !(r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.')) {
+			return false
+		}
+	}
+	return scheme != ""
+}
+
+// lookupTransport returns the registered transport for address's scheme, or
+// nil if there is none.
+func lookupTransport(address string) Transport {
+	scheme, _, ok := strings.Cut(address, "://")
+	if !ok {
+		return nil
+	}
+	transports.mu.RLock()
+	defer transports.mu.RUnlock()
+	return transports.byScheme[strings.ToLower(scheme)]
+}
+
+// openOnTransport opens the C peer for cfg on t, returning the listener a
+// server peer accepts clients from. A server peer listens in process (see
+// MemoryScheme), and each connection the listener accepts is bridged to
+// it; a client peer takes over one end of a socket pair bridged to the
+// connection Dial returned.
+func openOnTransport(t Transport, cID *C.char, cfg *peerConfig, cOpen *C.RelayOpenOptions) (C.RelayPeer, net.Listener, error) {
+	if cfg.udp != nil || cfg.localIP != "" || cfg.localPort != 0 {
+		return nil, nil, fmt.Errorf("%w: WithUDP and WithLocalAddr cannot be used with a registered transport", ErrConfigureFailed)
+	}
+	var status C.int
+	if cfg.server {
+		l, err := t.Listen(cfg.ip)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+		}
+		cAddr := C.CString(fmt.Sprintf("%stransport%d", MemoryScheme, transportListeners.Add(1)))
+		ptr := C.relay_open_peer_with(cID, cAddr, 0, 1, cOpen, &status)
+		if ptr == nil {
+			C.free(unsafe.Pointer(cAddr))
+			l.Close()
+			return nil, nil, statusError(status, ErrConnectFailed)
+		}
+		go serveTransport(l, cAddr)
+		return ptr, l, nil
+	}
+
+	ctx := context.Background()
+	if cfg.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.connectTimeout)
+		defer cancel()
+	}
+	conn, err := t.Dial(ctx, cfg.ip)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, ErrTimeout
+		}
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	local, err := fileConn(C.int(fds[1]))
+	if err != nil {
+		syscall.Close(fds[0])
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	go pumpConn(local, conn)
+	cAddr := C.CString(cfg.ip)
+	defer C.free(unsafe.Pointer(cAddr))
+	// The C peer closes its end if the handshake fails, which ends the pump and conn.
+	ptr := C.relay_open_peer_fd(cID, C.int(fds[0]), cAddr, cOpen, &status)
+	if ptr == nil {
+		return nil, nil, statusError(status, ErrConnectFailed)
+	}
+	return ptr, nil, nil
+}
+
+// serveTransport bridges each connection l accepts to the in-process
+// listener at cAddr until l is closed, then frees cAddr.
+func serveTransport(l net.Listener, cAddr *C.char) {
+	defer C.free(unsafe.Pointer(cAddr))
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				time.Sleep(acceptPollInterval)
+				continue
+			}
+			return
+		}
+		var fd C.int
+		// Refused once the server peer is closed or its backlog is full.
+		if C.relay_connect_memory(cAddr, &fd) != C.RELAY_OK {
+			conn.Close()
+			continue
+		}
+		local, err := fileConn(fd)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go pumpConn(local, conn)
+	}
+}
+
+// fileConn wraps the stream socket fd as a net.Conn that owns it.
+func fileConn(fd C.int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "relay-transport")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// pumpConn copies bytes both ways between the peer's end of a socket pair
+// and a transport connection. Each side's end-of-file is passed on as a
+// half-close where the other side supports one, and both are closed once
+// both directions are done.
+func pumpConn(local, remote net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(remote, local)
+	go copyHalf(local, remote)
+	<-done
+	<-done
+	local.Close()
+	remote.Close()
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tcpTransport carries "loop://host:port" addresses over plain TCP.
+type tcpTransport struct {
+	closed chan struct{}
+}
+
+func (tcpTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", strings.TrimPrefix(address, "loop://"))
+}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", strings.TrimPrefix(address, "loop://"))
+}
+
+func (t tcpTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestRegisterTransport(t *testing.T) {
+	tr := tcpTransport{closed: make(chan struct{})}
+	if err := RegisterTransport("loop", tr); err != nil {
+		t.Fatalf("RegisterTransport: %v", err)
+	}
+	t.Cleanup(func() { UnregisterTransport("loop") })
+	if err := RegisterTransport("loop", tr); !errors.Is(err, ErrConfigureFailed) {
+		t.Fatalf("registering twice: %v, want ErrConfigureFailed", err)
+	}
+	if err := RegisterTransport("tcp", tr); !errors.Is(err, ErrConfigureFailed) {
+		t.Fatalf("registering a built-in scheme: %v, want ErrConfigureFailed", err)
+	}
+
+	server, err := OpenPeer("server", "loop://127.0.0.1:0", 0, 1)
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	addr, ok := server.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("LocalAddr = %v, want the transport listener's address", server.LocalAddr())
+	}
+	client, conn := connect(t, server, func() (*Peer, error) {
+		return OpenPeer("client", "loop://"+addr.String(), 0, 0)
+	})
+	exchange(t, server, client, conn, 3)
+	if got, want := client.RemoteAddr(), "loop://"+addr.String(); got == nil || got.String() != want || got.Network() != "loop" {
+		t.Fatalf("RemoteAddr = %v, want %s", got, want)
+	}
+
+	if err := UnregisterTransport("loop"); err != nil {
+		t.Fatalf("UnregisterTransport: %v", err)
+	}
+	select {
+	case <-tr.closed:
+	default:
+		t.Fatal("UnregisterTransport did not close the transport")
+	}
+	exchange(t, server, client, conn, 1)
+	if _, err := OpenPeer("late", "loop://"+addr.String(), 0, 0); err == nil {
+		t.Fatal("OpenPeer on an unregistered scheme succeeded")
+	}
+}
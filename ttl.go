@@ -0,0 +1,44 @@
+package relay
+
+import "time"
+
+// SendWithTTL sends a message in an envelope (see SendEnvelope) that
+// expires ttl from now. Once expired it is dropped instead of delivered:
+// by SendAsync or the send queue (see Enqueue) if it is still queued, by
+// PeerManager.Relay, and by the receiver, which counts it in
+// MessagesExpired, so a late presence ping or price update is never acted
+// on. The receiver reads the message with ReceiveEnvelope, and the two
+// ends' clocks must agree to well within ttl. Errors are reported as for
+// Send.
+func (p *Peer) SendWithTTL(message string, ttl time.Duration) error {
+	now := time.Now()
+	return p.SendEnvelope(Message{Time: now, Expires: now.Add(ttl), Payload: []byte(message)})
+}
+
+// MessagesExpired returns the number of received envelopes dropped because
+// they had expired (see SendWithTTL).
+func (p *Peer) MessagesExpired() uint64 {
+	return p.stale.Load()
+}
+
+// Expired reports whether m has an expiry time that has passed.
+func (m Message) Expired() bool {
+	return !m.Expires.IsZero() && !time.Now().Before(m.Expires)
+}
+
+// isExpired reports whether data is an envelope whose expiry time has
+// passed.
+func isExpired(data []byte) bool {
+	expires, ok := envelopeExpires(data)
+	return ok && !expires.IsZero() && !time.Now().Before(expires)
+}
+
+// dropStale reports whether a received message has expired, counting it
+// if so.
+func (p *Peer) dropStale(message []byte) bool {
+	if !isExpired(message) {
+		return false
+	}
+	p.stale.Add(1)
+	return true
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// envelope returns m encoded as an envelope.
+func envelope(t *testing.T, m Message) string {
+	t.Helper()
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestQueuedEnvelopeExpires(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	reasons := make(chan error, 1)
+	m.SetDeadLetterHandler(func(targetID, message string, reason error) {
+		reasons <- reason
+	})
+	m.AddPeer(client)
+
+	expired := envelope(t, Message{ID: "old", Expires: time.Now().Add(-time.Second)})
+	if err := client.Enqueue(expired, PriorityNormal); err != nil {
+		t.Fatalf("Enqueue expired: %v", err)
+	}
+	if err := client.Enqueue(envelope(t, Message{ID: "new"}), PriorityNormal); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	got, err := server.ReceiveEnvelope()
+	if err != nil {
+		t.Fatalf("ReceiveEnvelope: %v", err)
+	}
+	if got.ID != "new" {
+		t.Fatalf("received envelope %q, want %q", got.ID, "new")
+	}
+	if reason := <-reasons; !errors.Is(reason, ErrMessageExpired) {
+		t.Fatalf("dead-letter reason %v, want ErrMessageExpired", reason)
+	}
+	if n := client.SendQueueExpired(); n != 1 {
+		t.Fatalf("SendQueueExpired = %d, want 1", n)
+	}
+}
+
+func TestRelayedEnvelopeExpiresOnReceipt(t *testing.T) {
+	server, client := newPair(t)
+	m := NewPeerManager()
+	t.Cleanup(m.Destroy)
+	m.AddPeer(server)
+	m.AddPeer(client)
+
+	short := envelope(t, Message{ID: "short", Expires: time.Now().Add(100 * time.Millisecond)})
+	if err := m.Relay("server", "client", short); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := m.Relay("server", "client", envelope(t, Message{ID: "long"})); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+	got, err := server.ReceiveEnvelope()
+	if err != nil {
+		t.Fatalf("ReceiveEnvelope: %v", err)
+	}
+	if got.ID != "long" {
+		t.Fatalf("received envelope %q, want %q", got.ID, "long")
+	}
+	if n := server.MessagesExpired(); n != 1 {
+		t.Fatalf("MessagesExpired = %d, want 1", n)
+	}
+}
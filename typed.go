@@ -0,0 +1,40 @@
+package relay
+
+// Typed sends and receives values of one type T over a peer, so call sites
+// get compile-time checking of their message structs instead of encoding
+// and decoding by hand. Values are encoded with Codec, or the peer's codec
+// (see Peer.SetCodec) if Codec is nil. Both ends must agree on T and the
+// codec. A Typed is a small value that can be copied freely.
+type Typed[T any] struct {
+	Peer  *Peer
+	Codec Codec
+}
+
+// NewTyped returns a Typed[T] over p using the peer's codec.
+func NewTyped[T any](p *Peer) Typed[T] {
+	return Typed[T]{Peer: p}
+}
+
+// Send encodes v and sends it as one message. Errors are reported as for
+// Peer.SendEncoded.
+func (t Typed[T]) Send(v T) error {
+	return t.Peer.sendEncoded(t.codec(), v)
+}
+
+// Receive receives a message and decodes it as a T. Errors are reported as
+// for Peer.ReceiveDecoded.
+func (t Typed[T]) Receive() (T, error) {
+	var v T
+	if err := t.Peer.receiveDecoded(t.codec(), &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
+
+func (t Typed[T]) codec() Codec {
+	if t.Codec != nil {
+		return t.Codec
+	}
+	return t.Peer.Codec()
+}
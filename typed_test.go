@@ -0,0 +1,24 @@
+package relay
+
+import "testing"
+
+func TestTyped(t *testing.T) {
+	server, client := newPair(t)
+	out := NewTyped[point](client)
+	in := Typed[point]{Peer: server}
+	if err := out.Send(point{3, 4, "json"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, err := in.Receive(); err != nil || got != (point{3, 4, "json"}) {
+		t.Fatalf("Receive = %+v, %v", got, err)
+	}
+
+	// A Typed's own codec overrides the peer's.
+	out.Codec, in.Codec = GobCodec, GobCodec
+	if err := out.Send(point{5, 6, "gob"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, err := in.Receive(); err != nil || got != (point{5, 6, "gob"}) {
+		t.Fatalf("Receive = %+v, %v", got, err)
+	}
+}
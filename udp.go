@@ -0,0 +1,119 @@
+package relay
+
+/*
+#include "../include/relay.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"time"
+	"unsafe"
+)
+
+// UDPConfig tunes the reliability layer of a peer opened with WithUDP. Zero
+// fields pick the defaults.
+type UDPConfig struct {
+	// RetransmitTimeout is how long a message waits to be acknowledged
+	// before it is resent, until round trips have been measured; after that
+	// the measured round trip sets it. 200ms by default.
+	RetransmitTimeout time.Duration
+
+	// Window is how many datagrams may be sent ahead of acknowledgements,
+	// and how many the receiver holds to put back in order. 256 by default.
+	Window int
+
+	// IdleTimeout closes a connection that hears nothing from the remote
+	// end for this long; keepalives are sent at a quarter of it, so an idle
+	// connection stays open. 15s by default.
+	IdleTimeout time.Duration
+
+	// ReassemblyTimeout is how long the receiver waits for the rest of an
+	// unreliable message sent in several datagrams once its first one has
+	// arrived; a message still incomplete after that is dropped and its
+	// missing datagrams are counted by FragmentsLost. 1s by default.
+	ReassemblyTimeout time.Duration
+}
+
+// WithUDP carries the peer's connections over UDP instead of TCP, for
+// latency-sensitive traffic such as games and telemetry. A server peer
+// listens on a UDP port and a client peer connects to one; Send and Receive
+// keep their meaning, as messages are acknowledged, resent when lost and
+// put back in order. Messages sent with SendUnreliable or
+// Client.SendUnreliable are sent once instead: they may be lost or overtake
+// others, but are never held up behind a lost datagram. Both ends must use
+// WithUDP. With WithTLS, WithNoiseKey, WithIdentity, WithAuthToken or
+// WithWebSocket every message is sent reliably. A nil cfg uses the
+// defaults. It only takes effect when the peer is created.
+func WithUDP(cfg *UDPConfig) PeerOption {
+	return func(c *peerConfig) {
+		c.udp = &UDPConfig{}
+		if cfg != nil {
+			*c.udp = *cfg
+		}
+	}
+}
+
+// SendUnreliable sends a message that a peer opened with WithUDP sends only
+// once, for data such as positions that the next message replaces anyway:
+// it may be lost, or arrive before messages sent ahead of it. Over TCP, or
+// with SetReplayProtection, it is sent like Send. Errors are reported as
+// for Send.
+func (p *Peer) SendUnreliable(message string) error {
+	if err := p.checkSize(len(message)); err != nil {
+		return err
+	}
+	p.throttle(rateSend, 1, len(message))
+	if !p.enter() {
+		return ErrPeerDisconnected
+	}
+	defer p.leave()
+	cMsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cMsg))
+	start := cgoStart()
+	status := C.relay_send_unreliable(p.ptr, cMsg, C.size_t(len(message)))
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// SendUnreliable sends a message to this client only, like
+// Peer.SendUnreliable.
+func (c *Client) SendUnreliable(message string) error {
+	if err := c.peer.checkSize(len(message)); err != nil {
+		return err
+	}
+	c.peer.throttle(rateSend, 1, len(message))
+	if !c.peer.enter() {
+		return ErrPeerNotFound
+	}
+	defer c.peer.leave()
+	cMsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cMsg))
+	start := cgoStart()
+	status := C.relay_send_to_client_unreliable(c.peer.ptr, C.uint64_t(c.id), cMsg, C.size_t(len(message)))
+	cgoSend.done(start)
+	return statusError(status, ErrSendFailed)
+}
+
+// FragmentsLost returns how many datagrams of unreliable messages never
+// arrived over the peer's UDP connections, counting those of messages
+// dropped because they were still incomplete after the reassembly timeout
+// (see UDPConfig). It is always 0 over TCP.
+func (p *Peer) FragmentsLost() uint64 {
+	if !p.enter() {
+		return 0
+	}
+	defer p.leave()
+	return uint64(C.relay_get_fragments_lost(p.ptr))
+}
+
+// newCUDPOptions converts cfg for the C library, allocating in mem.
+func newCUDPOptions(cfg *UDPConfig, mem *cMemory) *C.RelayUdpOptions {
+	opts := (*C.RelayUdpOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayUdpOptions{}))))
+	*opts = C.RelayUdpOptions{
+		retransmitTimeoutMs: C.int64_t(cfg.RetransmitTimeout.Milliseconds()),
+		window:              C.int(cfg.Window),
+		idleTimeoutMs:       C.int64_t(cfg.IdleTimeout.Milliseconds()),
+		reassemblyTimeoutMs: C.int64_t(cfg.ReassemblyTimeout.Milliseconds()),
+	}
+	return opts
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPFragmentedMessages(t *testing.T) {
+	cfg := &UDPConfig{ReassemblyTimeout: 500 * time.Millisecond}
+	server, client := newPair(t, WithUDP(cfg))
+	// Both are far larger than one datagram, so each is sent in fragments.
+	reliable := strings.Repeat("r", 20000)
+	unreliable := strings.Repeat("u", 8000)
+	if err := client.Send(reliable); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := receive(t, server); got != reliable {
+		t.Fatalf("reliable message arrived with %d bytes, want %d", len(got), len(reliable))
+	}
+	// Unreliable messages may be lost, even on loopback, so allow a few tries.
+	for i := 0; ; i++ {
+		if err := client.SendUnreliable(unreliable); err != nil {
+			t.Fatalf("SendUnreliable: %v", err)
+		}
+		got, err := server.ReceiveWithTimeout(time.Second)
+		if err == nil {
+			if got != unreliable {
+				t.Fatalf("unreliable message arrived with %d bytes, want %d", len(got), len(unreliable))
+			}
+			break
+		}
+		if i == 5 {
+			t.Fatalf("unreliable message never arrived: %v", err)
+		}
+	}
+	if lost := server.FragmentsLost(); lost != 0 {
+		t.Fatalf("FragmentsLost = %d on loopback, want 0", lost)
+	}
+}
+
+func TestFragmentsLostOverTCP(t *testing.T) {
+	server, client := newPair(t)
+	if err := client.SendUnreliable(strings.Repeat("x", 8000)); err != nil {
+		t.Fatalf("SendUnreliable: %v", err)
+	}
+	receive(t, server)
+	if lost := server.FragmentsLost(); lost != 0 {
+		t.Fatalf("FragmentsLost = %d over TCP, want 0", lost)
+	}
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UnixScheme prefixes the address of a peer on a Unix domain socket, as in
+// NewPeer(id, "unix:///tmp/relay.sock", 0, 1). A server peer creates the
+// socket file, replacing one left behind by a server that is gone, and
+// removes it when closed; a client peer connects to it. The port is
+// ignored. A path starting with "@", as in "unix://@relay", names a Linux
+// abstract socket, which has no file. Everything else, WithTLS and the
+// other security options included, works as over TCP, except that the TCP
+// options (WithNoDelay, WithKeepAlive) do nothing.
+const UnixScheme = "unix://"
+
+// WithUnixSocketMode sets the permission bits of a server peer's Unix
+// domain socket file, such as 0o660 to admit only the owner and group;
+// connecting needs write permission. Without it the file gets the
+// process's umask. It only takes effect when the peer is created, and does
+// nothing for other peers.
+func WithUnixSocketMode(mode os.FileMode) PeerOption {
+	return func(c *peerConfig) {
+		c.unixMode = mode.Perm()
+	}
+}
+
+// checkLocalConfig reports options that cannot be used with a Unix domain
+// socket or in-process address.
+func checkLocalConfig(cfg *peerConfig) error {
+	scheme := UnixScheme
+	if strings.HasPrefix(cfg.ip, MemoryScheme) {
+		scheme = MemoryScheme
+	} else if !strings.HasPrefix(cfg.ip, UnixScheme) {
+		return nil
+	}
+	if cfg.udp != nil {
+		return fmt.Errorf("%w: WithUDP cannot be used with a %s address", ErrConfigureFailed, scheme)
+	}
+	if cfg.localIP != "" || cfg.localPort != 0 {
+		return fmt.Errorf("%w: WithLocalAddr cannot be used with a %s address", ErrConfigureFailed, scheme)
+	}
+	return nil
+}
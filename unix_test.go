@@ -0,0 +1,35 @@
+package relay
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	server, err := OpenPeer("server", UnixScheme+path, 0, 1, WithUnixSocketMode(0o600))
+	if err != nil {
+		t.Fatalf("OpenPeer server: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket file: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("socket file mode = %v, want 0600", mode)
+	}
+	if addr, ok := server.LocalAddr().(*net.UnixAddr); !ok || addr.Name != path {
+		t.Fatalf("LocalAddr = %v, want %s", server.LocalAddr(), path)
+	}
+
+	client, conn := connect(t, server, func() (*Peer, error) { return OpenPeer("client", UnixScheme+path, 0, 0) })
+	exchange(t, server, client, conn, 3)
+
+	server.Destroy()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind after Destroy: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package relay
+
+/*
+#include "../include/relay.h"
+*/
+import "C"
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// WithWebSocket carries every connection of the peer in WebSocket binary
+// messages, for browsers and networks that only let HTTP through. A client
+// peer opens each connection with an HTTP upgrade request for path, and a
+// server peer answers only requests for path, "/" if empty. Combined with
+// WithTLS, WithIdentity, WithNoiseKey or WithAuthToken, that security runs
+// first and the WebSocket inside it, so WithTLS gives wss://. The messages
+// carry the same byte stream as a TCP connection, so messages sent and
+// received keep their meaning; a browser must send the library's frames in
+// binary messages. It only takes effect when the peer is created. See
+// DialWebSocket and ListenWebSocket for opening peers from ws:// and wss://
+// URLs.
+func WithWebSocket(path string) PeerOption {
+	return func(c *peerConfig) {
+		c.websocket = true
+		c.wsPath = path
+	}
+}
+
+// DialWebSocket opens a client peer connected to the WebSocket server at
+// rawURL, a ws:// or wss:// URL such as "wss://relay.example.com/peers". A
+// host name is resolved, by the proxy if there is one (see WithProxy), and
+// is sent as the Host header. For wss:// the
+// server's certificate is checked against the system roots and the host
+// name unless opts include WithTLS. Errors are as for OpenPeer, and
+// ErrInvalidAddress if rawURL cannot be used.
+func DialWebSocket(id, rawURL string, opts ...PeerOption) (*Peer, error) {
+	return openWebSocket(id, rawURL, false, opts)
+}
+
+// ListenWebSocket opens a server peer that accepts WebSocket clients at
+// rawURL, such as "ws://0.0.0.0:8080/peers". A wss:// URL needs WithTLS
+// with a certificate, or WithIdentity, among opts. Errors are as for
+// DialWebSocket.
+func ListenWebSocket(id, rawURL string, opts ...PeerOption) (*Peer, error) {
+	return openWebSocket(id, rawURL, true, opts)
+}
+
+// openWebSocket opens a peer for a ws:// or wss:// URL.
+func openWebSocket(id, rawURL string, server bool, opts []PeerOption) (*Peer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	secure := u.Scheme == "wss"
+	if !secure && u.Scheme != "ws" {
+		return nil, fmt.Errorf("%w: %q is not a ws:// or wss:// URL", ErrInvalidAddress, rawURL)
+	}
+	port := 80
+	if secure {
+		port = 443
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("%w: port %q", ErrInvalidAddress, p)
+		}
+	}
+	given := peerConfig{server: server}
+	for _, opt := range opts {
+		opt(&given)
+	}
+	host := u.Hostname()
+	path := u.EscapedPath()
+	all := []PeerOption{WithWebSocket(path), func(c *peerConfig) { c.wsHost = u.Host }}
+	if server {
+		all = append(all, WithServerMode())
+	}
+	all = append(all, opts...)
+	if secure {
+		if given.tls == nil && given.identity == nil {
+			if server {
+				return nil, fmt.Errorf("%w: a wss:// server peer needs WithTLS or WithIdentity", ErrConfigureFailed)
+			}
+			all = append(all, WithTLS(&tls.Config{ServerName: host}))
+		}
+	}
+	return OpenPeer(id, host, port, 0, all...)
+}
+
+// newCWebSocketOptions converts the WebSocket settings in cfg for the C
+// library, allocating in mem.
+func newCWebSocketOptions(cfg *peerConfig, mem *cMemory) (*C.RelayWebSocketOptions, error) {
+	for _, s := range []string{cfg.wsPath, cfg.wsHost} {
+		if strings.ContainsAny(s, " \r\n") {
+			return nil, fmt.Errorf("%w: invalid WebSocket path or host %q", ErrConfigureFailed, s)
+		}
+	}
+	if cfg.wsPath != "" && !strings.HasPrefix(cfg.wsPath, "/") {
+		return nil, fmt.Errorf("%w: WebSocket path %q does not start with /", ErrConfigureFailed, cfg.wsPath)
+	}
+	opts := (*C.RelayWebSocketOptions)(mem.malloc(C.size_t(unsafe.Sizeof(C.RelayWebSocketOptions{}))))
+	*opts = C.RelayWebSocketOptions{
+		path: (*C.char)(mem.bytes(append([]byte(cfg.wsPath), 0))),
+		host: (*C.char)(mem.bytes(append([]byte(cfg.wsHost), 0))),
+	}
+	return opts, nil
+}
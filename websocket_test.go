@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	server, err := ListenWebSocket("server", "ws://127.0.0.1:0/peers")
+	if err != nil {
+		t.Fatalf("ListenWebSocket: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := strconv.Itoa(server.LocalAddr().(*net.TCPAddr).Port)
+
+	client, conn := connect(t, server, func() (*Peer, error) {
+		return DialWebSocket("client", "ws://127.0.0.1:"+port+"/peers")
+	})
+	exchange(t, server, client, conn, 3)
+
+	if _, err := DialWebSocket("lost", "ws://127.0.0.1:"+port+"/elsewhere", WithConnectTimeout(200*time.Millisecond)); err == nil {
+		t.Fatal("DialWebSocket to a path the server does not answer succeeded")
+	}
+	if _, err := DialWebSocket("bad", "http://127.0.0.1:"+port+"/peers"); !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("DialWebSocket with an http:// URL: %v, want ErrInvalidAddress", err)
+	}
+}
+
+func TestSecureWebSocket(t *testing.T) {
+	if _, err := ListenWebSocket("server", "wss://127.0.0.1:0/"); !errors.Is(err, ErrConfigureFailed) {
+		t.Fatalf("wss:// server without a certificate: %v, want ErrConfigureFailed", err)
+	}
+	cert := selfSignedCert(t)
+	server, err := ListenWebSocket("server", "wss://127.0.0.1:0/",
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		t.Fatalf("ListenWebSocket: %v", err)
+	}
+	t.Cleanup(server.Destroy)
+	port := strconv.Itoa(server.LocalAddr().(*net.TCPAddr).Port)
+
+	client, conn := connect(t, server, func() (*Peer, error) {
+		return DialWebSocket("client", "wss://127.0.0.1:"+port+"/", WithTLS(&tls.Config{InsecureSkipVerify: true}))
+	})
+	exchange(t, server, client, conn, 3)
+}